@@ -0,0 +1,67 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"srsx/internal/loadgen"
+	"srsx/internal/logger"
+	"srsx/internal/signal"
+)
+
+func main() {
+	var config loadgen.Config
+	flag.StringVar(&config.RTMP, "rtmp", "127.0.0.1:1935", "The RTMP endpoint of proxy")
+	flag.StringVar(&config.HTTP, "http", "127.0.0.1:8080", "The HTTP stream endpoint of proxy, for FLV and HLS")
+	flag.StringVar(&config.API, "api", "127.0.0.1:1985", "The HTTP API endpoint of proxy, for WHEP")
+	flag.StringVar(&config.App, "app", "live", "The app of streams")
+	flag.StringVar(&config.Stream, "stream", "loadgen", "The stream name prefix, stream is named as prefix-index")
+	flag.IntVar(&config.Publishers, "publishers", 1, "The number of RTMP publishers")
+	flag.IntVar(&config.FLVPlayers, "flv", 0, "The number of HTTP-FLV players")
+	flag.IntVar(&config.HLSPlayers, "hls", 0, "The number of HLS players")
+	flag.IntVar(&config.WHEPPlayers, "whep", 0, "The number of WHEP players")
+	flag.StringVar(&config.Ramp, "ramp", loadgen.RampLinear, "The ramp profile, instant, linear or step")
+	flag.DurationVar(&config.RampDuration, "ramp-duration", 10*time.Second, "The duration to ramp up all clients")
+	flag.IntVar(&config.RampStepSize, "ramp-step", 10, "The number of clients to start in each step, for step ramp")
+	flag.DurationVar(&config.Duration, "duration", 60*time.Second, "The duration to run, after all clients started")
+	flag.DurationVar(&config.ReportInterval, "report", 5*time.Second, "The interval to print the report")
+	flag.StringVar(&config.Source, "source", "", "The FLV file to publish in loop, publish synthetic audio if empty")
+	flag.IntVar(&config.Bitrate, "bitrate", 128, "The bitrate in kbps of synthetic stream")
+
+	var soak bool
+	var soakConfig loadgen.SoakConfig
+	flag.BoolVar(&soak, "soak", false, "Whether run in soak mode, which runs cycles and checks the invariants of proxy")
+	flag.StringVar(&soakConfig.System, "system", "127.0.0.1:12025", "The System API endpoint of proxy, for soak mode")
+	flag.IntVar(&soakConfig.Cycles, "soak-cycles", 0, "The number of cycles for soak mode, 0 means forever")
+	flag.DurationVar(&soakConfig.Settle, "soak-settle", 10*time.Second, "The duration to wait for proxy cleanup after each cycle")
+	flag.IntVar(&soakConfig.GoroutineTolerance, "soak-goroutines", 50, "The maximum growth of goroutines of proxy")
+	flag.IntVar(&soakConfig.FDTolerance, "soak-fds", 20, "The maximum growth of fds of proxy")
+	flag.IntVar(&soakConfig.MaxLBEntries, "soak-lb-entries", 10000, "The maximum entries of each load balancer state")
+	flag.Parse()
+
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
+	signal.InstallSignals(ctx, cancel)
+
+	if soak {
+		if err := loadgen.NewSoakTester(&config, &soakConfig).Run(ctx); err != nil {
+			logger.Ef(ctx, "soak: %+v", err)
+			os.Exit(-1)
+		}
+		logger.Df(ctx, "Soak test done")
+		return
+	}
+
+	report, err := loadgen.NewLoadGenerator(&config).Run(ctx)
+	if err != nil {
+		logger.Ef(ctx, "loadgen: %+v", err)
+		os.Exit(-1)
+	}
+
+	logger.Df(ctx, "Final report %v", report)
+}
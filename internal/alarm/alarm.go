@@ -0,0 +1,280 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package alarm
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	stdSync "sync"
+	"sync/atomic"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/logger"
+	"srsx/internal/session"
+)
+
+// The metrics of proxy utilization, with soft limits to alarm.
+const (
+	// The number of client sessions.
+	MetricSessions = "sessions"
+	// The bandwidth of proxied traffic in Mbps, both directions.
+	MetricBandwidth = "bandwidth"
+	// The CPU usage of proxy process in percent of all CPUs.
+	MetricCPU = "cpu"
+)
+
+// The ratio of soft limit to resolve the firing alarm, to avoid flapping around the limit.
+const resolveRatio = 0.9
+
+// Usage is the utilization of proxy, sampled in interval.
+type Usage struct {
+	// The number of client sessions.
+	Sessions int `json:"sessions"`
+	// The bandwidth of proxied traffic in Mbps, both directions.
+	Bandwidth float64 `json:"bandwidth"`
+	// The CPU usage of proxy process in percent of all CPUs, -1 if not supported by OS.
+	CPU float64 `json:"cpu"`
+	// The max ratio of the metrics to their soft limits in percent, zero if no limit, to autoscale on the
+	// single metric.
+	Utilization float64 `json:"utilization"`
+	// The time sampled.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Alarm is the state of soft limit of a metric.
+type Alarm struct {
+	// The metric, sessions, bandwidth or cpu.
+	Metric string `json:"metric"`
+	// The soft limit of metric.
+	Threshold float64 `json:"threshold"`
+	// The current value of metric.
+	Value float64 `json:"value"`
+	// Whether the metric exceeds the soft limit.
+	Firing bool `json:"firing"`
+	// The time the state changed.
+	Since time.Time `json:"since"`
+}
+
+// UsageMonitor samples the utilization of proxy, and alarms when crossing the soft limits, by the logs
+// and alarm events to webhook, so the edge fleets autoscale on the real proxy load.
+type UsageMonitor interface {
+	// Run to sample the usage in interval, until ctx done.
+	Run(ctx context.Context)
+	// AddBytes adds the bytes of proxied traffic, for bandwidth.
+	AddBytes(n int)
+	// Usage returns the last sampled usage.
+	Usage() *Usage
+	// Alarms returns the state of soft limits, only the configured metrics.
+	Alarms() []*Alarm
+}
+
+type usageMonitorImpl struct {
+	// The interval to sample the usage.
+	interval time.Duration
+	// The soft limits of metrics, zero to disable.
+	limits map[string]float64
+
+	// The total bytes of proxied traffic.
+	bytes uint64
+	// The last sampled bytes and CPU time, to calculate the rates.
+	lastBytes uint64
+	lastCPU   time.Duration
+
+	// The last sampled usage.
+	usage *Usage
+	// The alarms of metrics, key is the metric.
+	alarms map[string]*Alarm
+	// The lock to protect usage and alarms.
+	lock stdSync.Mutex
+}
+
+// NewUsageMonitor creates a usage monitor by options, without soft limits.
+func NewUsageMonitor(opts ...func(*usageMonitorImpl)) UsageMonitor {
+	v := &usageMonitorImpl{
+		interval: 5 * time.Second, limits: make(map[string]float64),
+		usage: &Usage{CPU: -1}, alarms: make(map[string]*Alarm),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewUsageMonitorFromEnvironment creates the usage monitor by the interval and soft limits in environment.
+func NewUsageMonitorFromEnvironment(environment env.Environment) (UsageMonitor, error) {
+	interval, err := time.ParseDuration(environment.AlarmInterval())
+	if err != nil || interval <= 0 {
+		return nil, errors.Errorf("invalid alarm interval %v", environment.AlarmInterval())
+	}
+
+	limits := make(map[string]float64)
+	for metric, value := range map[string]string{
+		MetricSessions:  environment.AlarmMaxSessions(),
+		MetricBandwidth: environment.AlarmMaxBandwidth(),
+		MetricCPU:       environment.AlarmMaxCPU(),
+	} {
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit < 0 {
+			return nil, errors.Errorf("invalid alarm max %v %v", metric, value)
+		}
+		if limit > 0 {
+			limits[metric] = limit
+		}
+	}
+
+	return NewUsageMonitor(func(v *usageMonitorImpl) {
+		v.interval, v.limits = interval, limits
+	}), nil
+}
+
+func (v *usageMonitorImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	v.lastCPU = processCPUTime()
+	lastAt := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		elapsed := now.Sub(lastAt).Seconds()
+		lastAt = now
+
+		usage := &Usage{Sessions: len(session.SrsSessionManager.List("")), CPU: -1, UpdatedAt: now}
+
+		bytes := atomic.LoadUint64(&v.bytes)
+		usage.Bandwidth = float64(bytes-v.lastBytes) * 8 / 1e6 / elapsed
+		v.lastBytes = bytes
+
+		if cpu := processCPUTime(); cpu >= 0 && v.lastCPU >= 0 {
+			usage.CPU = (cpu - v.lastCPU).Seconds() / elapsed / float64(runtime.NumCPU()) * 100
+			v.lastCPU = cpu
+		}
+
+		values := map[string]float64{
+			MetricSessions: float64(usage.Sessions), MetricBandwidth: usage.Bandwidth, MetricCPU: usage.CPU,
+		}
+		for metric, limit := range v.limits {
+			usage.Utilization = math.Max(usage.Utilization, values[metric]/limit*100)
+		}
+
+		v.lock.Lock()
+		v.usage = usage
+		v.lock.Unlock()
+
+		for metric, limit := range v.limits {
+			v.check(ctx, metric, limit, values[metric])
+		}
+	}
+}
+
+// check the value of metric with the soft limit, and alarm when the state changes.
+func (v *usageMonitorImpl) check(ctx context.Context, metric string, limit, value float64) {
+	v.lock.Lock()
+	alarm, ok := v.alarms[metric]
+	if !ok {
+		alarm = &Alarm{Metric: metric, Threshold: limit, Since: time.Now()}
+		v.alarms[metric] = alarm
+	}
+
+	alarm.Value = value
+	changed := false
+	if !alarm.Firing && value >= limit {
+		alarm.Firing, alarm.Since, changed = true, time.Now(), true
+	} else if alarm.Firing && value < limit*resolveRatio {
+		alarm.Firing, alarm.Since, changed = false, time.Now(), true
+	}
+	firing := alarm.Firing
+	v.lock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	state := "resolved"
+	if firing {
+		state = "firing"
+		logger.Wf(ctx, "Alarm %v firing, value=%.1f, threshold=%v", metric, value, limit)
+	} else {
+		logger.Df(ctx, "Alarm %v resolved, value=%.1f, threshold=%v", metric, value, limit)
+	}
+
+	event.SrsEventNotifier.Notify(ctx, &event.Event{
+		Type: "alarm", Time: time.Now(),
+		Data: map[string]interface{}{
+			"metric": metric, "state": state, "value": value, "threshold": limit,
+		},
+	})
+}
+
+func (v *usageMonitorImpl) AddBytes(n int) {
+	atomic.AddUint64(&v.bytes, uint64(n))
+}
+
+func (v *usageMonitorImpl) Usage() *Usage {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	usage := *v.usage
+	return &usage
+}
+
+func (v *usageMonitorImpl) Alarms() []*Alarm {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	alarms := []*Alarm{}
+	for _, metric := range []string{MetricSessions, MetricBandwidth, MetricCPU} {
+		if limit, ok := v.limits[metric]; !ok {
+			continue
+		} else if alarm, ok := v.alarms[metric]; ok {
+			copied := *alarm
+			alarms = append(alarms, &copied)
+		} else {
+			alarms = append(alarms, &Alarm{Metric: metric, Threshold: limit})
+		}
+	}
+	return alarms
+}
+
+// processCPUTime returns the user and system CPU time of current process, -1 if not supported by OS.
+func processCPUTime() time.Duration {
+	// Only linux supports the /proc filesystem.
+	b, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		return -1
+	}
+
+	// The command in parentheses might contain spaces, so parse the fields after it, where the utime and
+	// stime are the 14th and 15th fields, in clock ticks, which is 100 per second for almost all Linux.
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return -1
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return -1
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return time.Duration(utime+stime) * time.Second / 100
+}
+
+// SrsUsageMonitor is the global usage monitor of proxy, without soft limits by default.
+var SrsUsageMonitor = NewUsageMonitor()
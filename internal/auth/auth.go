@@ -0,0 +1,334 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/dryrun"
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/tarpit"
+)
+
+// The timeout to verify a client by Oryx.
+const oryxVerifyTimeout = 3 * time.Second
+
+// The actions of clients to authenticate.
+const (
+	// The client publishes the stream.
+	ActionPublish = "publish"
+	// The client plays the stream.
+	ActionPlay = "play"
+)
+
+// Client is a client to authenticate.
+type Client struct {
+	// The action of client, publish or play.
+	Action string
+	// The protocol of client, such as rtmp, http, hls, rtc or srt.
+	Protocol string
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string
+	// The address of client, in ip:port or ip.
+	RemoteAddr string
+	// The query string of client, like ?secret=xxx, which has the secret.
+	Param string
+	// The HTTP headers of client, nil if not HTTP, such as RTMP and SRT.
+	Header http.Header
+
+	// The annotations of session, set by the external authorization service.
+	Annotations map[string]string
+	// The labels of session, like user id, plan or region, set by the auth hooks.
+	Labels map[string]string
+}
+
+// addLabels merges the labels to client.
+func (v *Client) addLabels(labels map[string]string) {
+	if len(labels) > 0 && v.Labels == nil {
+		v.Labels = make(map[string]string)
+	}
+	for k, value := range labels {
+		v.Labels[k] = value
+	}
+}
+
+// Authenticator authenticates the publishers and players by the secrets, such as SRS Stack (Oryx).
+type Authenticator interface {
+	// Authenticate the client, returns error if rejected.
+	Authenticate(ctx context.Context, c *Client) error
+}
+
+type nopAuthenticator struct{}
+
+// NewNopAuthenticator creates an authenticator which allows all clients.
+func NewNopAuthenticator() Authenticator {
+	return &nopAuthenticator{}
+}
+
+func (v *nopAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	return nil
+}
+
+// oryxAuthenticator verifies the secrets of clients by the HTTP hooks of SRS Stack (Oryx), the same as
+// the on_publish and on_play callbacks of SRS, so the secrets are managed by Oryx only.
+type oryxAuthenticator struct {
+	// The API of Oryx, like http://127.0.0.1:2022
+	api string
+	// Whether verify the players.
+	verifyPlay bool
+	// The duration to cache the verified clients, zero to disable.
+	cacheDuration time.Duration
+
+	// The verified clients, key is the action, stream URL and param.
+	verified map[string]*oryxVerified
+	// The lock to protect verified.
+	lock stdSync.Mutex
+}
+
+// NewOryxAuthenticator creates an authenticator by Oryx with options.
+func NewOryxAuthenticator(opts ...func(*oryxAuthenticator)) Authenticator {
+	v := &oryxAuthenticator{cacheDuration: 30 * time.Second, verified: make(map[string]*oryxVerified)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// chainAuthenticator authenticates the client by all authenticators in order, and the client is
+// rejected by the first one which rejects it.
+type chainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+func (v *chainAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	for _, authenticator := range v.authenticators {
+		if err := authenticator.Authenticate(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewAuthenticatorFromEnvironment creates the authenticator by the publish secret, the Oryx API and the external
+// authorization service in environment, which allows all clients if none is configured.
+func NewAuthenticatorFromEnvironment(environment env.Environment) (Authenticator, error) {
+	var authenticators []Authenticator
+
+	// Verify the publish token first, which is local and cheap, before the hooks.
+	if authenticator, err := newTokenAuthenticatorFromEnvironment(environment); err != nil {
+		return nil, errors.Wrapf(err, "create token authenticator")
+	} else if authenticator != nil {
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if authenticator, err := newOryxAuthenticatorFromEnvironment(environment); err != nil {
+		return nil, errors.Wrapf(err, "create oryx authenticator")
+	} else if authenticator != nil {
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if authenticator, err := newExtAuthzAuthenticatorFromEnvironment(environment); err != nil {
+		return nil, errors.Wrapf(err, "create ext authz authenticator")
+	} else if authenticator != nil {
+		authenticators = append(authenticators, authenticator)
+	}
+
+	switch len(authenticators) {
+	case 0:
+		return NewNopAuthenticator(), nil
+	case 1:
+		return &guardedAuthenticator{authenticators[0]}, nil
+	default:
+		return &guardedAuthenticator{&chainAuthenticator{authenticators: authenticators}}, nil
+	}
+}
+
+// guardedAuthenticator allows the client rejected by the authenticator in dry-run mode, and logs the client
+// would be denied, or delays the rejection if the client is in tarpit.
+type guardedAuthenticator struct {
+	authenticator Authenticator
+}
+
+func (v *guardedAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	err := v.authenticator.Authenticate(ctx, c)
+	if err == nil {
+		return nil
+	}
+
+	if !dryrun.SrsDryRun.Enforce(ctx, dryrun.KindAuth, "deny %v %v from %v for %v, %v",
+		c.Protocol, c.Action, c.RemoteAddr, c.StreamURL, err) {
+		return nil
+	}
+
+	tarpit.SrsTarpit.Reject(ctx, c.RemoteAddr, tarpit.ReasonAuth)
+	return err
+}
+
+// newOryxAuthenticatorFromEnvironment creates the authenticator by the Oryx API in environment, returns
+// nil if not configured.
+func newOryxAuthenticatorFromEnvironment(environment env.Environment) (Authenticator, error) {
+	api := strings.TrimSuffix(environment.OryxAPI(), "/")
+	if api == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(api, "http://") && !strings.HasPrefix(api, "https://") {
+		return nil, errors.Errorf("invalid oryx api %v", environment.OryxAPI())
+	}
+
+	cacheDuration, err := time.ParseDuration(environment.OryxCacheDuration())
+	if err != nil || cacheDuration < 0 {
+		return nil, errors.Errorf("invalid cache duration %v", environment.OryxCacheDuration())
+	}
+
+	return NewOryxAuthenticator(func(v *oryxAuthenticator) {
+		v.api, v.verifyPlay, v.cacheDuration = api, environment.OryxVerifyPlay() == "on", cacheDuration
+	}), nil
+}
+
+// oryxVerified is a verified client of Oryx.
+type oryxVerified struct {
+	// The expire time of verified client.
+	expireAt time.Time
+	// The labels of session by Oryx.
+	labels map[string]string
+}
+
+func (v *oryxAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	if c.Action == ActionPlay && !v.verifyPlay {
+		return nil
+	}
+
+	key := fmt.Sprintf("%v %v%v", c.Action, c.StreamURL, c.Param)
+	if verified := v.cached(key); verified != nil {
+		c.addLabels(verified.labels)
+		return nil
+	}
+
+	if err := v.verify(ctx, c); err != nil {
+		return errors.Wrapf(err, "verify %v %v client from %v for %v by oryx", c.Protocol, c.Action, c.RemoteAddr, c.StreamURL)
+	}
+
+	if v.cacheDuration > 0 {
+		v.lock.Lock()
+		v.verified[key] = &oryxVerified{expireAt: time.Now().Add(v.cacheDuration), labels: c.Labels}
+		v.lock.Unlock()
+	}
+	logger.Df(ctx, "Oryx verified %v %v client from %v for %v", c.Protocol, c.Action, c.RemoteAddr, c.StreamURL)
+	return nil
+}
+
+// cached returns the verified client if not expired, or nil, and removes the expired clients.
+func (v *oryxAuthenticator) cached(key string) *oryxVerified {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	for k, verified := range v.verified {
+		if now.After(verified.expireAt) {
+			delete(v.verified, k)
+		}
+	}
+
+	return v.verified[key]
+}
+
+// verify the client by the hooks of Oryx, in the format of SRS HTTP callback.
+// See https://ossrs.io/lts/en-us/docs/v6/doc/http-callback
+func (v *oryxAuthenticator) verify(ctx context.Context, c *Client) error {
+	vhost, app, stream := parseStreamURL(c.StreamURL)
+	ip := clientIP(c.RemoteAddr)
+
+	param := c.Param
+	if param != "" && !strings.HasPrefix(param, "?") {
+		param = "?" + param
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"action": fmt.Sprintf("on_%v", c.Action), "client_id": logger.GenerateContextID(), "ip": ip,
+		"vhost": vhost, "app": app, "stream": stream, "param": param,
+		"stream_url": fmt.Sprintf("/%v/%v", app, stream), "tcUrl": fmt.Sprintf("%v://%v/%v", c.Protocol, vhost, app),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "marshal client")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oryxVerifyTimeout)
+	defer cancel()
+
+	api := fmt.Sprintf("%v/terraform/v1/hooks/srs/verify", v.api)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", api)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", api)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request %v failed, status=%v, body=%v", api, resp.Status, string(body))
+	}
+
+	// The response is ok, by number 0, or JSON object with code 0, the same as SRS. The optional labels
+	// in data are attached to the session.
+	if s := strings.TrimSpace(string(body)); s == "0" {
+		return nil
+	}
+	var res struct {
+		Code int `json:"code"`
+		Data struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(body))
+	}
+	if res.Code != 0 {
+		return errors.Errorf("rejected, code=%v, body=%v", res.Code, string(body))
+	}
+	c.addLabels(res.Data.Labels)
+	return nil
+}
+
+// parseStreamURL parses the stream URL in vhost/app/stream schema.
+func parseStreamURL(streamURL string) (vhost, app, stream string) {
+	vhost = streamURL
+	if index := strings.Index(streamURL, "/"); index >= 0 {
+		vhost, app = streamURL[:index], streamURL[index+1:]
+	}
+	if index := strings.LastIndex(app, "/"); index >= 0 {
+		app, stream = app[:index], app[index+1:]
+	}
+	return
+}
+
+// clientIP returns the IP of client address in ip:port or ip.
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// SrsAuthenticator is the global authenticator, which allows all clients if none of publish secret, Oryx and
+// external authorization service is configured.
+var SrsAuthenticator Authenticator = NewNopAuthenticator()
@@ -0,0 +1,200 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The results of external authorization service.
+const (
+	// Allow the client, the default result.
+	ExtAuthzAllow = "allow"
+	// Deny the client.
+	ExtAuthzDeny = "deny"
+	// Redirect the client to the location.
+	ExtAuthzRedirect = "redirect"
+)
+
+// RedirectError is the error to redirect the client to another location, by the external authorization
+// service. The HTTP clients, such as HTTP-FLV, HLS, WHIP and WHEP, follow the location, while the RTMP and
+// SRT clients are rejected because there is no redirect.
+type RedirectError struct {
+	// The location to redirect to.
+	Location string
+}
+
+func (v *RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %v", v.Location)
+}
+
+// IsRedirect returns the redirect error if err is caused by redirect.
+func IsRedirect(err error) (*RedirectError, bool) {
+	r, ok := errors.Cause(err).(*RedirectError)
+	return r, ok
+}
+
+// extAuthzAuthenticator calls the external authorization service for each new session, like the ext_authz
+// of Envoy, so the business logic is implemented by the service without changing the proxy. The service
+// allows, denies, redirects the client, or annotates the session.
+type extAuthzAuthenticator struct {
+	// The URL of service, like http://127.0.0.1:8080/authz
+	url string
+	// The timeout to call the service.
+	timeout time.Duration
+	// Whether allow the client if failed to call the service.
+	failureModeAllow bool
+}
+
+// NewExtAuthzAuthenticator creates an authenticator by the external authorization service with options.
+func NewExtAuthzAuthenticator(opts ...func(*extAuthzAuthenticator)) Authenticator {
+	v := &extAuthzAuthenticator{timeout: 3 * time.Second}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// newExtAuthzAuthenticatorFromEnvironment creates the authenticator by the URL of service in environment,
+// returns nil if not configured. Only the HTTP service is supported, the gRPC service is rejected.
+func newExtAuthzAuthenticatorFromEnvironment(environment env.Environment) (Authenticator, error) {
+	url := environment.ExtAuthzURL()
+	if url == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(url, "grpc://") || strings.HasPrefix(url, "grpcs://") {
+		return nil, errors.Errorf("grpc ext authz %v not supported, use http service", url)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, errors.Errorf("invalid ext authz url %v", url)
+	}
+
+	timeout, err := time.ParseDuration(environment.ExtAuthzTimeout())
+	if err != nil || timeout <= 0 {
+		return nil, errors.Errorf("invalid ext authz timeout %v", environment.ExtAuthzTimeout())
+	}
+
+	return NewExtAuthzAuthenticator(func(v *extAuthzAuthenticator) {
+		v.url, v.timeout = url, timeout
+		v.failureModeAllow = environment.ExtAuthzFailureModeAllow() == "on"
+	}), nil
+}
+
+func (v *extAuthzAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	res, err := v.check(ctx, c)
+	if err != nil {
+		if v.failureModeAllow {
+			logger.Wf(ctx, "Ext authz allow %v %v client from %v for %v, ignore err %+v",
+				c.Protocol, c.Action, c.RemoteAddr, c.StreamURL, err)
+			return nil
+		}
+		return errors.Wrapf(err, "check %v %v client from %v for %v by ext authz", c.Protocol, c.Action, c.RemoteAddr, c.StreamURL)
+	}
+
+	switch res.Result {
+	case "", ExtAuthzAllow:
+		if len(res.Annotations) > 0 && c.Annotations == nil {
+			c.Annotations = make(map[string]string)
+		}
+		for k, value := range res.Annotations {
+			c.Annotations[k] = value
+		}
+		c.addLabels(res.Labels)
+		logger.Df(ctx, "Ext authz allowed %v %v client from %v for %v, annotations=%v, labels=%v",
+			c.Protocol, c.Action, c.RemoteAddr, c.StreamURL, res.Annotations, res.Labels)
+		return nil
+	case ExtAuthzDeny:
+		return errors.Errorf("denied %v %v client from %v for %v by ext authz, reason=%v",
+			c.Protocol, c.Action, c.RemoteAddr, c.StreamURL, res.Reason)
+	case ExtAuthzRedirect:
+		if res.Location == "" {
+			return errors.Errorf("redirect %v %v client for %v without location", c.Protocol, c.Action, c.StreamURL)
+		}
+		logger.Df(ctx, "Ext authz redirect %v %v client from %v for %v to %v, reason=%v",
+			c.Protocol, c.Action, c.RemoteAddr, c.StreamURL, res.Location, res.Reason)
+		return &RedirectError{Location: res.Location}
+	default:
+		return errors.Errorf("invalid ext authz result %v", res.Result)
+	}
+}
+
+// extAuthzResponse is the response of external authorization service.
+type extAuthzResponse struct {
+	// The result, allow, deny or redirect, default to allow.
+	Result string `json:"result"`
+	// The reason of result, for logging.
+	Reason string `json:"reason"`
+	// The location to redirect to, for redirect.
+	Location string `json:"location"`
+	// The annotations of session, for allow.
+	Annotations map[string]string `json:"annotations"`
+	// The labels of session, like user id, plan or region, for allow.
+	Labels map[string]string `json:"labels"`
+}
+
+// check the client by the service, with the full context of client. The status 200 is the result in
+// body, while 4xx denies the client, and others are failures.
+func (v *extAuthzAuthenticator) check(ctx context.Context, c *Client) (*extAuthzResponse, error) {
+	vhost, app, stream := parseStreamURL(c.StreamURL)
+
+	headers := make(map[string]string)
+	for k := range c.Header {
+		headers[strings.ToLower(k)] = c.Header.Get(k)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"request_id": logger.ContextID(ctx), "action": c.Action, "protocol": c.Protocol,
+		"stream_url": c.StreamURL, "vhost": vhost, "app": app, "stream": stream,
+		"remote_addr": c.RemoteAddr, "ip": clientIP(c.RemoteAddr), "param": c.Param, "headers": headers,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal client")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v", v.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %v", v.url)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", v.url)
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return &extAuthzResponse{Result: ExtAuthzDeny, Reason: fmt.Sprintf("%v %v", resp.Status, string(body))}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request %v failed, status=%v, body=%v", v.url, resp.Status, string(body))
+	}
+
+	res := &extAuthzResponse{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, res); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", string(body))
+		}
+	}
+	return res, nil
+}
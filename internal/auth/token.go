@@ -0,0 +1,90 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// tokenAuthenticator verifies the publishers by the token in query, which is the HMAC-SHA256 of vhost/app/stream
+// and the optional expire time, signed by the shared secret, so the unauthorized publishers are rejected by the
+// proxy itself, without any hook or backend contact. The vhost is signed, so a token is never reused for the
+// same app/stream of other vhosts.
+type tokenAuthenticator struct {
+	// The shared secret to sign the tokens.
+	secret []byte
+}
+
+// NewTokenAuthenticator creates an authenticator of publish tokens signed by secret.
+func NewTokenAuthenticator(secret string) Authenticator {
+	return &tokenAuthenticator{secret: []byte(secret)}
+}
+
+// newTokenAuthenticatorFromEnvironment creates the authenticator by the publish secret in environment, returns
+// nil if not configured.
+func newTokenAuthenticatorFromEnvironment(environment env.Environment) (Authenticator, error) {
+	if environment.PublishSecret() == "" {
+		return nil, nil
+	}
+	return NewTokenAuthenticator(environment.PublishSecret()), nil
+}
+
+func (v *tokenAuthenticator) Authenticate(ctx context.Context, c *Client) error {
+	if c.Action != ActionPublish {
+		return nil
+	}
+
+	if err := v.verify(c); err != nil {
+		return errors.Wrapf(err, "verify %v publisher from %v for %v by token", c.Protocol, c.RemoteAddr, c.StreamURL)
+	}
+
+	logger.Df(ctx, "Token verified %v publisher from %v for %v", c.Protocol, c.RemoteAddr, c.StreamURL)
+	return nil
+}
+
+// verify the token and expire in the query of client, like ?token=xxx&expire=1767225600.
+func (v *tokenAuthenticator) verify(c *Client) error {
+	q, err := url.ParseQuery(strings.TrimPrefix(c.Param, "?"))
+	if err != nil {
+		return errors.Wrapf(err, "parse query %v", c.Param)
+	}
+
+	token := q.Get("token")
+	if token == "" {
+		return errors.Errorf("no token")
+	}
+
+	// The token never expires if no expire, like the stream key of OBS.
+	vhost, app, stream := parseStreamURL(c.StreamURL)
+	message := fmt.Sprintf("%v/%v/%v", vhost, app, stream)
+	if expire := q.Get("expire"); expire != "" {
+		expireAt, err := strconv.ParseInt(expire, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse expire %v", expire)
+		}
+		if time.Now().Unix() > expireAt {
+			return errors.Errorf("token expired at %v", time.Unix(expireAt, 0).Format(time.RFC3339))
+		}
+		message = fmt.Sprintf("%v:%v", message, expire)
+	}
+
+	h := hmac.New(sha256.New, v.secret)
+	h.Write([]byte(message))
+	if expect, err := hex.DecodeString(token); err != nil || !hmac.Equal(expect, h.Sum(nil)) {
+		return errors.Errorf("invalid token")
+	}
+	return nil
+}
@@ -7,13 +7,26 @@ import (
 	"context"
 	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/auth"
+	"srsx/internal/clock"
 	"srsx/internal/debug"
+	"srsx/internal/dryrun"
 	"srsx/internal/env"
 	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/geo"
+	"srsx/internal/incident"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
 	"srsx/internal/protocol"
+	"srsx/internal/relay"
+	"srsx/internal/restream"
+	"srsx/internal/session"
 	"srsx/internal/signal"
+	"srsx/internal/store"
+	"srsx/internal/tarpit"
 	"srsx/internal/version"
 )
 
@@ -29,7 +42,13 @@ type Bootstrap interface {
 }
 
 // bootstrapImpl implements the Bootstrap interface.
-type bootstrapImpl struct{}
+type bootstrapImpl struct {
+	// The state store of load balancer or relay schedules, closed at last, nil if not used.
+	store store.Store
+	// The state store of proxy, such as the relay schedules, which is the store of load balancer with values
+	// encrypted if configured, or in memory for memory load balancer.
+	state store.Store
+}
 
 // NewBootstrap creates a new Bootstrap instance.
 func NewBootstrap() Bootstrap {
@@ -46,6 +65,12 @@ func (b *bootstrapImpl) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	signal.InstallSignals(ctx, cancel)
 
+	// Drain the proxy by System API or SIGUSR2, which quits gracefully after the sessions drained.
+	protocol.SrsProxyDrainer = protocol.NewProxyDrainer(cancel)
+	signal.InstallDrain(ctx, func() {
+		protocol.SrsProxyDrainer.Drain(ctx, "signal")
+	})
+
 	// Run the main loop, ignore the user cancel error.
 	err := b.Run(ctx)
 	if err != nil && ctx.Err() != context.Canceled {
@@ -73,30 +98,252 @@ func (b *bootstrapImpl) Run(ctx context.Context) error {
 		return errors.Wrapf(err, "install force quit")
 	}
 
+	// Monitor the clock jumps, to compensate the TTL of state store.
+	go clock.SrsClock.Run(ctx)
+
+	// Reload the .env file by SIGHUP, and the changes are available by System API.
+	signal.InstallReload(ctx, environment)
+
+	// Upgrade the binary without downtime by SIGUSR1, which passes the listeners to the new process.
+	signal.InstallUpgrade(ctx, func() {
+		if pid, err := protocol.UpgradeProxy(ctx, environment); err != nil {
+			logger.Wf(ctx, "Upgrade failed, err %+v", err)
+		} else {
+			logger.Df(ctx, "Upgrade to new process %v, draining", pid)
+		}
+	})
+
 	// Start the Go pprof if enabled.
 	debug.HandleGoPprof(ctx, environment)
 
-	// Initialize the load balancer.
+	// Locate the clients by the geolocation database and the headers of CDN.
+	if geo.SrsLocator, err = geo.NewLocatorFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create geo locator")
+	}
+
+	// Detect the restreaming by the tokens of clients.
+	if restream.SrsDetector, err = restream.NewDetectorFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create restream detector")
+	}
+
+	// Delay the rejections of clients which repeatedly fail auth or exceed the rate limit.
+	if tarpit.SrsTarpit, err = tarpit.NewTarpitFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create tarpit")
+	}
+
+	// Verify the secrets of clients by SRS Stack (Oryx) and external authorization service if configured.
+	if auth.SrsAuthenticator, err = auth.NewAuthenticatorFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create authenticator")
+	}
+	if api := environment.OryxAPI(); api != "" {
+		logger.Df(ctx, "Verify clients by oryx %v, play=%v", api, environment.OryxVerifyPlay())
+	}
+	if url := environment.ExtAuthzURL(); url != "" {
+		logger.Df(ctx, "Verify clients by ext authz %v, failure mode allow=%v", url, environment.ExtAuthzFailureModeAllow())
+	}
+
+	// The client sessions, with the labels by auth hooks for metrics and metering.
+	if session.SrsSessionManager, err = session.NewSessionManagerFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create session manager")
+	}
+
+	// Sample the usage of proxy, and alarm when crossing the soft limits, for autoscaling.
+	if alarm.SrsUsageMonitor, err = alarm.NewUsageMonitorFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create usage monitor")
+	}
+	go alarm.SrsUsageMonitor.Run(ctx)
+
+	// Capture the diagnostic snapshot when the sessions closed by error spike, for post-incident analysis.
+	if incident.SrsIncidentRecorder, err = incident.NewRecorderFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create incident recorder")
+	}
+	go incident.SrsIncidentRecorder.Run(ctx)
+
+	// Only log the decisions of routing, policy, auth and limits in dry-run mode, without enforcing them.
+	if dryrun.SrsDryRun, err = dryrun.NewDryRunFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create dry run")
+	}
+	if dryrun.SrsDryRun.Enabled() {
+		logger.Wf(ctx, "Dry-run mode, routing, policy, auth and limits are not enforced")
+	}
+
+	// Load the policy to deny, throttle or route the clients.
+	if policy.SrsPolicyEngine, err = policy.NewEngineFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create policy engine")
+	}
+
+	// Load the routing pools and rules, to route the new streams by vhost or app.
+	if lb.SrsServerRouter, err = lb.NewSRSServerRouterFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create server router")
+	}
+	if file := environment.RoutingFile(); file != "" {
+		config := lb.SrsServerRouter.Config()
+		logger.Df(ctx, "Route streams by %v, pools=%v, rules=%v", file, len(config.Pools), len(config.Rules))
+	}
+
+	// Initialize the load balancer, and the state store is closed by startServers.
 	if err := b.initializeLoadBalancer(ctx, environment); err != nil {
+		if b.store != nil {
+			b.store.Close()
+		}
 		return err
 	}
 
 	// Parse the gracefully quit timeout.
 	gracefulQuitTimeout, err := time.ParseDuration(environment.GraceQuitTimeout())
 	if err != nil {
+		if b.store != nil {
+			b.store.Close()
+		}
 		return errors.Wrapf(err, "parse gracefully quit timeout")
 	}
 
+	// Parse the drain timeouts of protocols, which override the gracefully quit timeout.
+	timeouts, err := parseDrainTimeouts(environment.GraceQuitTimeouts(), gracefulQuitTimeout)
+	if err != nil {
+		if b.store != nil {
+			b.store.Close()
+		}
+		return errors.Wrapf(err, "parse gracefully quit timeouts %v", environment.GraceQuitTimeouts())
+	}
+	logger.Df(ctx, "Drain sessions when quit, timeouts %v", timeouts)
+	if force, err := time.ParseDuration(environment.ForceQuitTimeout()); err == nil && timeouts.max() >= force {
+		logger.Wf(ctx, "Drain timeout %v exceeds force quit timeout %v, sessions are killed by force quit",
+			timeouts.max(), force)
+	}
+
 	// Start all servers and block until context is cancelled.
-	return b.startServers(ctx, environment, gracefulQuitTimeout)
+	return b.startServers(ctx, environment, gracefulQuitTimeout, timeouts)
 }
 
 // initializeLoadBalancer sets up the load balancer based on configuration.
 func (b *bootstrapImpl) initializeLoadBalancer(ctx context.Context, environment env.Environment) error {
+	cipher, err := store.NewCipherFromEnvironment(environment)
+	if err != nil {
+		return errors.Wrapf(err, "create cipher")
+	}
+
+	// Elect a leader of proxies, to run the tasks of cluster once, such as the keepalive of backends.
+	if lb.SrsLeaderElection, err = lb.NewLeaderElectionFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create leader election")
+	}
+	store.IsLeader = lb.SrsLeaderElection.IsLeader
+	go lb.SrsLeaderElection.Run(ctx)
+	if election := environment.LeaderElection(); election != "" {
+		logger.Df(ctx, "Elect leader by %v, identity=%v", election, lb.SrsLeaderElection.State().Identity)
+	}
+
+	// Remove the failing backend servers from new streams, by the circuit breaker.
+	if lb.SrsServerBreaker, err = lb.NewSRSServerBreakerFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create circuit breaker")
+	}
+
+	// Return the streams failed over to the fallback pool of routing rule, by the failback policy.
+	if lb.SrsServerFailback, err = lb.NewSRSServerFailbackFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create failback")
+	}
+	go lb.SrsServerFailback.Run(ctx)
+
+	// Ramp up the traffic share of newly registered backend servers.
+	if lb.SrsServerSlowStart, err = lb.NewSRSServerSlowStartFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create slow start")
+	}
+
+	// Forecast the bitrate of streams, to place the new stream on server with enough bandwidth budget.
+	if lb.SrsServerBandwidth, err = lb.NewSRSServerBandwidthFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create server bandwidth")
+	}
+
+	// Prefer the backend servers in the region of client, for multi-region deployments.
+	if lb.SrsServerRegions, err = lb.NewSRSServerRegionsFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create server regions")
+	}
+	if lb.SrsServerRegions.Enabled() {
+		logger.Df(ctx, "Server regions %v", lb.SrsServerRegions)
+	}
+
+	// The key to keep the picked server of publishers and players.
+	if lb.SrsPickAffinity, err = lb.NewPickAffinityFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create pick affinity")
+	}
+	logger.Df(ctx, "Pick affinity %v", lb.SrsPickAffinity)
+
+	// Resolve the backend servers registered or configured by hostname, and re-resolve in TTL.
+	if lb.SrsServerResolver, err = lb.NewSRSServerResolverFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create server resolver")
+	}
+	go lb.SrsServerResolver.Run(ctx)
+
+	// Connect to backend servers over TLS, when the proxy and SRS traverse untrusted networks.
+	if lb.SrsServerTLS, err = lb.NewSRSServerTLSFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create server tls")
+	}
+	if backendTLS := environment.BackendTLS(); backendTLS != "off" {
+		logger.Df(ctx, "Backend TLS %v, ca=%v, server name=%v",
+			lb.SrsServerTLS, environment.BackendTLSCA(), environment.BackendTLSServerName())
+	}
+
+	// Query the load of backend servers for load-aware strategy and max streams, before creating the strategy.
+	// Only the selected servers are watched, so it does nothing if neither is used.
+	if lb.SrsServerLoadMonitor, err = lb.NewSRSServerLoadMonitorFromEnvironment(environment); err != nil {
+		return errors.Wrapf(err, "create load monitor")
+	}
+	go lb.SrsServerLoadMonitor.Run(ctx)
+
+	// Write the persisted data in legacy format or versioned envelope, before any data is written.
+	if err := lb.ConfigureSchema(ctx, environment); err != nil {
+		return errors.Wrapf(err, "configure schema")
+	}
+
+	// Build the HLS streaming from the data in shared store, such as Redis.
+	lb.NewHLSPlayStreamFromDTO = protocol.NewHLSPlayStreamFromDTO
+	lb.NewRTCConnectionFromDTO = protocol.NewRTCConnectionFromDTO
+	// Keep the picked server of the stream with active sessions.
+	lb.IsStreamActive = func(streamURL string) bool {
+		return session.SrsSessionManager.Count(streamURL) > 0
+	}
+	// Re-route the sessions of stream when failing back.
+	lb.KickStream = func(ctx context.Context, streamURL string) int {
+		return session.SrsSessionManager.Kick(ctx, streamURL)
+	}
+
 	switch environment.LoadBalancerType() {
 	case "redis":
+		rdb, err := store.NewRedisClient(environment)
+		if err != nil {
+			return errors.Wrapf(err, "create redis client")
+		}
+		s := store.NewRedisStore(rdb, environment.RedisKeyPrefix())
+		b.store = s
+		if cipher != nil {
+			s = store.NewEncryptedStore(s, cipher)
+		}
+		b.state = s
 		lb.SrsLoadBalancer = lb.NewRedisLoadBalancer(environment)
+	case "file":
+		s, err := store.NewFileStore(ctx, environment.StoreFile())
+		if err != nil {
+			return errors.Wrapf(err, "create file store %v", environment.StoreFile())
+		}
+		b.store = s
+		if cipher != nil {
+			s = store.NewEncryptedStore(s, cipher)
+		}
+		b.state = s
+		lb.SrsLoadBalancer = lb.NewStoreLoadBalancer(environment, s)
+	case "sql":
+		s, err := store.NewSQLStore(ctx, environment.SQLDriver(), environment.SQLDSN())
+		if err != nil {
+			return errors.Wrapf(err, "create sql store %v", environment.SQLDriver())
+		}
+		b.store = s
+		if cipher != nil {
+			s = store.NewEncryptedStore(s, cipher)
+		}
+		b.state = s
+		lb.SrsLoadBalancer = lb.NewStoreLoadBalancer(environment, s)
 	default:
+		b.state = store.NewMemoryStore()
 		lb.SrsLoadBalancer = lb.NewMemoryLoadBalancer(environment)
 	}
 
@@ -104,55 +351,266 @@ func (b *bootstrapImpl) initializeLoadBalancer(ctx context.Context, environment
 		return errors.Wrapf(err, "initialize srs load balancer")
 	}
 
+	// The registration tokens of backend servers, persisted in state store to share with proxies.
+	if lb.SrsServerRegistrar, err = lb.NewSRSServerRegistrarFromEnvironment(environment, b.state); err != nil {
+		return errors.Wrapf(err, "create server registrar")
+	}
+
+	// The draining backend servers, persisted in state store to share with proxies.
+	lb.SrsServerDrainer = lb.NewSRSServerDrainer(b.state)
+	go lb.SrsServerDrainer.Run(ctx)
+
+	// Discover the backend servers by the EndpointSlices of Kubernetes, besides the registered servers.
+	if service := environment.K8sService(); service != "" {
+		discovery, err := lb.NewKubernetesDiscoveryFromEnvironment(environment)
+		if err != nil {
+			return errors.Wrapf(err, "create k8s discovery")
+		}
+		go discovery.Run(ctx)
+		logger.Df(ctx, "Discover SRS media servers by k8s service %v", service)
+	}
+
+	// Discover the backend servers by the SRV or A/AAAA records of DNS name, besides the registered servers.
+	if name := environment.DNSName(); name != "" {
+		discovery, err := lb.NewDNSDiscoveryFromEnvironment(environment)
+		if err != nil {
+			return errors.Wrapf(err, "create dns discovery")
+		}
+		go discovery.Run(ctx)
+		logger.Df(ctx, "Discover SRS media servers by dns name %v", name)
+	}
+
+	// Load the static backend servers from file, and reload by SIGHUP.
+	if filename := environment.BackendsFile(); filename != "" {
+		discovery, err := lb.NewStaticDiscoveryFromEnvironment(ctx, environment)
+		if err != nil {
+			return errors.Wrapf(err, "create static discovery")
+		}
+		signal.HandleReload("backends", discovery.Reload)
+		go discovery.Run(ctx)
+		logger.Df(ctx, "Discover SRS media servers by static file %v", filename)
+	}
+
 	return nil
 }
 
-// startServers initializes and starts all protocol servers.
-func (b *bootstrapImpl) startServers(ctx context.Context, environment env.Environment, gracefulQuitTimeout time.Duration) error {
+// startServers initializes and starts all protocol servers, and blocks until context is cancelled, then
+// shutdown in order: stop accepting, drain client sessions, close servers and upstream relays, then close
+// the load balancer and state store.
+func (b *bootstrapImpl) startServers(
+	ctx context.Context, environment env.Environment, gracefulQuitTimeout time.Duration, timeouts *drainTimeouts,
+) error {
+	// The servers run in a separate context, which is cancelled after draining the sessions, rather than
+	// immediately cancelled by signals.
+	serveCtx, cancelServe := context.WithCancel(logger.WithContext(context.Background()))
+	defer cancelServe()
+
+	components := newComponentManager()
+	defer components.Close(ctx)
+
+	// Close the load balancer and state store at last, after all servers which use the load balancer.
+	components.Add("store", func(ctx context.Context) error {
+		if lb.SrsLoadBalancer != nil {
+			if err := lb.SrsLoadBalancer.Close(); err != nil {
+				logger.Wf(ctx, "Close load balancer failed, err %+v", err)
+			}
+		}
+		if b.store != nil {
+			return b.store.Close()
+		}
+		return nil
+	}, "rtmp", "rtc", "srt", "http-api", "http-stream", "system-api", "events", "relay", "scheduler")
+
+	// Flush the events, after all servers closed, which generate the events.
+	if url := environment.WebhookURL(); url != "" {
+		event.SrsEventNotifier = event.NewWebhookNotifier(logger.WithContext(context.Background()), url)
+		logger.Df(ctx, "Post events to webhook %v", url)
+	}
+	event.SrsEventNotifier = event.NewHistoryNotifier(event.SrsEventNotifier, event.SrsEventHistory)
+	components.Add("events", func(ctx context.Context) error {
+		return event.SrsEventNotifier.Close()
+	}, "rtmp", "rtc", "srt", "http-api", "http-stream")
+
+	// The deadline to quit, set when quiting, the HTTP servers shutdown in the budget remaining after the
+	// sessions drained.
+	var quitDeadline time.Time
+
+	// Drain the client sessions after all servers stop accepting, then cancel the remaining sessions, before
+	// the HTTP servers shutdown, which wait for the active requests. Each protocol is kicked in its own timeout.
+	components.Add("drain", func(ctx context.Context) error {
+		return b.drainSessions(ctx, quitDeadline, timeouts, cancelServe)
+	}, "rtmp-accept", "http-api-accept", "http-stream-accept")
+
+	// Limit the concurrent connections of listeners and client IPs, before the servers accept clients.
+	if err := protocol.ConfigureConnLimits(ctx, environment); err != nil {
+		return errors.Wrapf(err, "connection limits")
+	}
+
+	// Limit the egress bitrate of each client connection.
+	if err := protocol.ConfigureEgressThrottle(ctx, environment); err != nil {
+		return errors.Wrapf(err, "egress throttle")
+	}
+
+	// Capture the traffic of sessions to pcap files, started by System API.
+	if err := protocol.ConfigureTrafficCapture(ctx, environment); err != nil {
+		return errors.Wrapf(err, "traffic capture")
+	}
+
+	// Sample the bitrate of sessions in interval, for the stats to read without side effects.
+	go protocol.RunBitrateSampler(ctx)
+
+	// Cache the latest GOP of edge streams, for the new viewers to start instantly.
+	if err := protocol.ConfigureEdgeRelay(ctx, environment); err != nil {
+		return errors.Wrapf(err, "edge relay")
+	}
+
+	// Shard the streams to proxies by the hash of stream URL, before the servers accept clients.
+	if err := protocol.ConfigureStreamSharding(ctx, environment); err != nil {
+		return errors.Wrapf(err, "stream sharding")
+	}
+
 	// Start the RTMP server.
 	srsRTMPServer := protocol.NewSRSRTMPServer(environment)
-	if err := srsRTMPServer.Run(ctx); err != nil {
+	if err := srsRTMPServer.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "rtmp server")
 	}
-	defer srsRTMPServer.Close()
+	components.Add("rtmp-accept", func(ctx context.Context) error {
+		return srsRTMPServer.StopAccepting()
+	})
+	// Close the RTMP server and the upstream relays of publishers, after sessions drained.
+	components.Add("rtmp", func(ctx context.Context) error {
+		return srsRTMPServer.Close()
+	}, "drain")
 
 	// Start the WebRTC server.
 	srsWebRTCServer := protocol.NewSRSWebRTCServer(environment)
-	if err := srsWebRTCServer.Run(ctx); err != nil {
+	if err := srsWebRTCServer.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "rtc server")
 	}
-	defer srsWebRTCServer.Close()
+	// The UDP server is unable to stop accepting, so close it after sessions drained.
+	components.Add("rtc", func(ctx context.Context) error {
+		return srsWebRTCServer.Close()
+	}, "drain")
 
 	// Start the HTTP API server.
 	srsHTTPAPIServer := protocol.NewSRSHTTPAPIServer(environment, gracefulQuitTimeout, srsWebRTCServer)
-	if err := srsHTTPAPIServer.Run(ctx); err != nil {
+	if err := srsHTTPAPIServer.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "http api server")
 	}
-	defer srsHTTPAPIServer.Close()
+	components.Add("http-api-accept", func(ctx context.Context) error {
+		return srsHTTPAPIServer.StopAccepting()
+	})
+	// Shutdown the HTTP server after sessions drained, which waits for the active requests in the remaining budget.
+	components.Add("http-api", func(ctx context.Context) error {
+		ctx, cancel := context.WithDeadline(context.Background(), quitDeadline)
+		defer cancel()
+		return srsHTTPAPIServer.Close(ctx)
+	}, "drain")
 
 	// Start the SRT server.
 	srsSRTServer := protocol.NewSRSSRTServer(environment)
-	if err := srsSRTServer.Run(ctx); err != nil {
+	if err := srsSRTServer.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "srt server")
 	}
-	defer srsSRTServer.Close()
+	// The UDP server is unable to stop accepting, so close it after sessions drained.
+	components.Add("srt", func(ctx context.Context) error {
+		return srsSRTServer.Close()
+	}, "drain")
+
+	// Start the relay tasks, which publish to the backend servers, so stop them before the load balancer.
+	relayManager, err := relay.NewManagerFromEnvironment(serveCtx, environment)
+	if err != nil {
+		return errors.Wrapf(err, "create relay manager")
+	}
+	relay.SrsRelayManager = relayManager
+
+	// Start and stop the relay tasks by schedules in state store, so stop it before the relay manager.
+	relayScheduler, err := relay.NewSchedulerFromEnvironment(serveCtx, environment, relayManager, b.state)
+	if err != nil {
+		return errors.Wrapf(err, "create relay scheduler")
+	}
+	relay.SrsRelayScheduler = relayScheduler
+	logger.Df(ctx, "Relay scheduler enabled=%v, schedules=%v", environment.RelayScheduler(), len(relayScheduler.List()))
+
+	components.Add("scheduler", func(ctx context.Context) error {
+		return relay.SrsRelayScheduler.Close()
+	})
+	components.Add("relay", func(ctx context.Context) error {
+		return relay.SrsRelayManager.Close()
+	}, "scheduler")
 
 	// Start the System API server.
 	systemAPI := protocol.NewSystemAPI(environment, gracefulQuitTimeout)
-	if err := systemAPI.Run(ctx); err != nil {
+	if err := systemAPI.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "system api server")
 	}
-	defer systemAPI.Close()
+	// Keep the System API until all servers closed, to query the state when quiting.
+	components.Add("system-api", func(ctx context.Context) error {
+		return systemAPI.Close()
+	}, "rtmp", "rtc", "srt")
 
 	// Start the HTTP web server.
-	srsHTTPStreamServer := protocol.NewSRSHTTPStreamServer(environment, gracefulQuitTimeout)
-	if err := srsHTTPStreamServer.Run(ctx); err != nil {
+	srsHTTPStreamServer := protocol.NewSRSHTTPStreamServer(environment, timeouts.timeout("hls"))
+	if err := srsHTTPStreamServer.Run(serveCtx); err != nil {
 		return errors.Wrapf(err, "http server")
 	}
-	defer srsHTTPStreamServer.Close()
+	components.Add("http-stream-accept", func(ctx context.Context) error {
+		return srsHTTPStreamServer.StopAccepting()
+	})
+	// Shutdown the HTTP server after sessions drained, which waits for the HLS requests in the remaining budget of
+	// HLS timeout.
+	components.Add("http-stream", func(ctx context.Context) error {
+		deadline := quitDeadline.Add(timeouts.timeout("hls") - timeouts.max())
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		return srsHTTPStreamServer.Close(ctx)
+	}, "drain")
+
+	// Notify ready after all servers started, and remove the ready file once quiting.
+	if err := notifyReady(ctx, environment); err != nil {
+		return errors.Wrapf(err, "notify ready")
+	}
+	components.Add("ready", func(ctx context.Context) error {
+		return removeReady(environment)
+	})
 
 	// Wait for the main loop to quit.
 	<-ctx.Done()
+	logger.Df(ctx, "Shutdown all components")
+	quitDeadline = time.Now().Add(timeouts.max())
+	protocol.SrsProxyDrainer.Drain(ctx, "quit")
+
+	return nil
+}
 
+// drainSessions waits for the client sessions to quit in timeouts, kicks the sessions of protocol when its
+// timeout expires, then cancels the remaining sessions at the deadline, which is the longest timeout.
+func (b *bootstrapImpl) drainSessions(
+	ctx context.Context, deadline time.Time, timeouts *drainTimeouts, cancel context.CancelFunc,
+) error {
+	defer cancel()
+
+	starttime := deadline.Add(-timeouts.max())
+	for time.Now().Before(deadline) {
+		sessions := session.SrsSessionManager.List("")
+		if len(sessions) == 0 {
+			return nil
+		}
+
+		for _, s := range sessions {
+			if !s.Kicked() && time.Since(starttime) >= timeouts.timeout(s.Protocol) {
+				session.SrsSessionManager.KickSession(ctx, s, session.CloseDrained)
+			}
+		}
+
+		logger.Df(ctx, "Drain %v sessions, timeout in %v", len(sessions), time.Until(deadline))
+		time.Sleep(time.Second)
+	}
+
+	sessions := session.SrsSessionManager.List("")
+	for _, s := range sessions {
+		s.SetCloseReason(session.CloseDrained)
+	}
+	logger.Wf(ctx, "Drain timeout, cancel %v sessions", len(sessions))
 	return nil
 }
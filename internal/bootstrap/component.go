@@ -0,0 +1,107 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package bootstrap
+
+import (
+	"context"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// component is a part of proxy which should be closed in order when quiting.
+type component struct {
+	// The name of component.
+	name string
+	// The components which must be closed before this one.
+	after []string
+	// The function to close the component.
+	close func(ctx context.Context) error
+}
+
+// componentManager closes the components in the order of dependency, for example, stop accepting
+// before draining the sessions, and close the load balancer after all servers.
+type componentManager struct {
+	// The components in the order added.
+	components []*component
+}
+
+func newComponentManager() *componentManager {
+	return &componentManager{}
+}
+
+// Add the component name, which is closed by fn after all components in after are closed.
+func (v *componentManager) Add(name string, fn func(ctx context.Context) error, after ...string) {
+	v.components = append(v.components, &component{name: name, after: after, close: fn})
+}
+
+// Close all components in the order of dependency. The components without dependency between them
+// are closed concurrently. The error of component is logged and does not stop closing others.
+func (v *componentManager) Close(ctx context.Context) error {
+	levels, err := v.levels()
+	if err != nil {
+		return errors.Wrapf(err, "sort components")
+	}
+
+	for _, level := range levels {
+		var wg stdSync.WaitGroup
+		for _, c := range level {
+			wg.Add(1)
+			go func(c *component) {
+				defer wg.Done()
+
+				starttime := time.Now()
+				if err := c.close(ctx); err != nil {
+					logger.Wf(ctx, "Close component %v failed, err %+v", c.name, err)
+				} else {
+					logger.Df(ctx, "Close component %v done, cost=%v", c.name, time.Since(starttime))
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+	return nil
+}
+
+// levels sorts the components by dependency, each level is closed after the previous level. The
+// dependency to a component not added is ignored, so the components are able to be added optionally.
+func (v *componentManager) levels() ([][]*component, error) {
+	names := make(map[string]*component)
+	for _, c := range v.components {
+		names[c.name] = c
+	}
+
+	closed := make(map[string]bool)
+	var levels [][]*component
+	for len(closed) < len(v.components) {
+		var level []*component
+		for _, c := range v.components {
+			if closed[c.name] {
+				continue
+			}
+
+			ready := true
+			for _, after := range c.after {
+				if _, ok := names[after]; ok && !closed[after] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, c)
+			}
+		}
+
+		if len(level) == 0 {
+			return nil, errors.Errorf("dependency cycle in components")
+		}
+		for _, c := range level {
+			closed[c.name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package bootstrap
+
+import (
+	"strings"
+	"time"
+
+	"srsx/internal/errors"
+)
+
+// drainProtocols is the protocols which are able to drain in their own grace timeout.
+var drainProtocols = []string{"rtmp", "http", "hls", "rtc", "srt"}
+
+// drainTimeouts is the grace timeouts to drain the client sessions when quiting, by protocol, for example,
+// give the RTMP publishers 60s to finish but the HLS viewers only 5s.
+type drainTimeouts struct {
+	// The default timeout, for the protocols not configured.
+	fallback time.Duration
+	// The timeout of protocols, key is the protocol, such as rtmp.
+	protocols map[string]time.Duration
+}
+
+// parseDrainTimeouts parses the timeouts of protocols, like rtmp=60s,hls=5s, and the protocols not configured
+// use the fallback timeout.
+func parseDrainTimeouts(s string, fallback time.Duration) (*drainTimeouts, error) {
+	v := &drainTimeouts{fallback: fallback, protocols: make(map[string]time.Duration)}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid timeout %v", item)
+		}
+
+		protocol := strings.TrimSpace(kv[0])
+		if !isDrainProtocol(protocol) {
+			return nil, errors.Errorf("invalid protocol %v, should be %v", protocol, strings.Join(drainProtocols, ","))
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || timeout < 0 {
+			return nil, errors.Errorf("invalid timeout %v of %v", kv[1], protocol)
+		}
+		v.protocols[protocol] = timeout
+	}
+	return v, nil
+}
+
+// timeout returns the grace timeout of protocol.
+func (v *drainTimeouts) timeout(protocol string) time.Duration {
+	if timeout, ok := v.protocols[protocol]; ok {
+		return timeout
+	}
+	return v.fallback
+}
+
+// max returns the longest grace timeout of all protocols, to wait for all sessions.
+func (v *drainTimeouts) max() time.Duration {
+	max := v.fallback
+	for _, timeout := range v.protocols {
+		if timeout > max {
+			max = timeout
+		}
+	}
+	return max
+}
+
+func (v *drainTimeouts) String() string {
+	var items []string
+	for _, protocol := range drainProtocols {
+		items = append(items, protocol+"="+v.timeout(protocol).String())
+	}
+	return strings.Join(items, ",")
+}
+
+func isDrainProtocol(protocol string) bool {
+	for _, p := range drainProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/protocol"
+)
+
+// notifyReady emits the ready status in a single log line, when all servers started. It also writes the
+// status to the ready file, and one line to the ready FD, such as the notification FD of s6, if configured.
+func notifyReady(ctx context.Context, environment env.Environment) error {
+	b, err := json.Marshal(protocol.NewReadyStatus(environment))
+	if err != nil {
+		return errors.Wrapf(err, "marshal ready status")
+	}
+	logger.Df(ctx, "Proxy ready %v", string(b))
+
+	// Write to a temporary file then rename it, so the reader never gets a partial file.
+	if filename := environment.ReadyFile(); filename != "" {
+		tmpfile := filename + ".tmp"
+		if err := ioutil.WriteFile(tmpfile, append(b, '\n'), 0644); err != nil {
+			return errors.Wrapf(err, "write %v", tmpfile)
+		}
+		if err := os.Rename(tmpfile, filename); err != nil {
+			return errors.Wrapf(err, "rename %v to %v", tmpfile, filename)
+		}
+	}
+
+	// Write one line to the FD then close it, which is the ready notification of s6.
+	if fd := environment.ReadyFD(); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 3 {
+			return errors.Errorf("invalid ready fd %v", fd)
+		}
+
+		f := os.NewFile(uintptr(n), "ready")
+		if f == nil {
+			return errors.Errorf("invalid ready fd %v", fd)
+		}
+		defer f.Close()
+
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			return errors.Wrapf(err, "write ready fd %v", fd)
+		}
+	}
+	return nil
+}
+
+// removeReady removes the ready file when quiting, so the stale file is not taken as ready. The file written by
+// another process is kept, for example, the new process of upgrade.
+func removeReady(environment env.Environment) error {
+	if filename := environment.ReadyFile(); filename != "" {
+		var status protocol.ReadyStatus
+		if b, err := ioutil.ReadFile(filename); err == nil && json.Unmarshal(b, &status) == nil && status.PID != os.Getpid() {
+			return nil
+		}
+
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove %v", filename)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package clock
+
+import (
+	"context"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/logger"
+)
+
+// The interval to check the wall clock.
+const checkInterval = time.Second
+
+// The wall clock jumps, if it diffs from the monotonic clock more than this threshold in an interval.
+const jumpThreshold = 5 * time.Second
+
+// The rate to slew the compensation back to the wall clock, 0.1 means 100ms per second, so the TTL
+// is at most 10% shorter when slewing, which is safe for the heartbeat of backends.
+const slewRate = 0.1
+
+// Clock monitors the wall clock, and compensates the clock jumps, such as the VM pause or NTP correction.
+// Because the expiration of state is persisted in wall clock, a clock jump causes mass false-expiry of
+// backends, so the compensated clock is used for TTL and aliveness, which slews to the wall clock slowly.
+type Clock interface {
+	// Run the monitor until ctx is done.
+	Run(ctx context.Context)
+	// Now returns the compensated wall clock.
+	Now() time.Time
+	// Stats returns the stats of clock.
+	Stats() *Stats
+}
+
+// Stats is the stats of clock.
+type Stats struct {
+	// The compensation of clock, which is the wall clock minus compensated clock.
+	Offset string `json:"offset"`
+	// The number of clock jumps detected.
+	Jumps int `json:"jumps"`
+	// The last clock jump, empty if no jump.
+	LastJump string `json:"last_jump,omitempty"`
+	// The time of last clock jump.
+	LastJumpAt time.Time `json:"last_jump_at,omitempty"`
+}
+
+type clockImpl struct {
+	// The compensation, the wall clock minus compensated clock.
+	offset time.Duration
+	// The number of clock jumps.
+	jumps int
+	// The last clock jump and the time it's detected.
+	lastJump   time.Duration
+	lastJumpAt time.Time
+	// The lock to protect fields.
+	lock stdSync.Mutex
+}
+
+// NewClock creates a new clock, which should be run to monitor the clock jumps.
+func NewClock() Clock {
+	return &clockImpl{}
+}
+
+func (v *clockImpl) Run(ctx context.Context) {
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(checkInterval):
+		}
+
+		// The Sub of time.Now uses monotonic clock, while the Round(0) strips the monotonic clock, so
+		// the diff is the jump of wall clock.
+		now := time.Now()
+		elapsed := now.Sub(last)
+		jump := now.Round(0).Sub(last.Round(0)) - elapsed
+		last = now
+
+		v.lock.Lock()
+		if jump > jumpThreshold || jump < -jumpThreshold {
+			v.offset += jump
+			v.jumps++
+			v.lastJump, v.lastJumpAt = jump, now
+			logger.Wf(ctx, "Clock jumps %v in %v, compensate offset to %v", jump, elapsed, v.offset)
+		} else if v.offset != 0 {
+			v.offset = slew(v.offset, time.Duration(float64(elapsed)*slewRate))
+			if v.offset == 0 {
+				logger.Df(ctx, "Clock compensation done, back to wall clock")
+			}
+		}
+		v.lock.Unlock()
+	}
+}
+
+func (v *clockImpl) Now() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return time.Now().Add(-v.offset)
+}
+
+func (v *clockImpl) Stats() *Stats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	stats := &Stats{Offset: v.offset.String(), Jumps: v.jumps, LastJumpAt: v.lastJumpAt}
+	if v.jumps > 0 {
+		stats.LastJump = v.lastJump.String()
+	}
+	return stats
+}
+
+// slew moves the offset towards zero by step.
+func slew(offset, step time.Duration) time.Duration {
+	if offset > step {
+		return offset - step
+	}
+	if offset < -step {
+		return offset + step
+	}
+	return 0
+}
+
+// SrsClock is the global clock instance, to compensate clock jumps.
+var SrsClock = NewClock()
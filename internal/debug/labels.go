@@ -0,0 +1,20 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package debug
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// DoWithProfileLabels calls f with the current goroutine tagged by the protocol and stream URL, so the CPU
+// and heap profiles can be broken down by stream, for example:
+//
+//	go tool pprof -tagfocus=stream=__defaultVhost__/live/livestream http://localhost:6060/debug/pprof/profile
+//
+// The labels are restored when f returns, so it never leaks to the following requests served by the same
+// goroutine, such as the HTTP keep-alive connection. The goroutines started by f inherit the labels.
+func DoWithProfileLabels(ctx context.Context, protocol, streamURL string, f func(ctx context.Context)) {
+	pprof.Do(ctx, pprof.Labels("protocol", protocol, "stream", streamURL), f)
+}
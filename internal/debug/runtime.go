@@ -0,0 +1,40 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package debug
+
+import (
+	"io/ioutil"
+	"runtime"
+)
+
+// RuntimeStats is the runtime resources of process, used to detect the leak of goroutines and fds.
+type RuntimeStats struct {
+	// The number of goroutines.
+	Goroutines int `json:"goroutines"`
+	// The number of open file descriptors, -1 if not supported by OS.
+	FDs int `json:"fds"`
+	// The bytes of allocated heap objects.
+	HeapAlloc uint64 `json:"heap_alloc"`
+	// The number of allocated heap objects.
+	HeapObjects uint64 `json:"heap_objects"`
+}
+
+// NewRuntimeStats samples the runtime resources of current process.
+func NewRuntimeStats() *RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	v := &RuntimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		FDs:         -1,
+		HeapAlloc:   ms.HeapAlloc,
+		HeapObjects: ms.HeapObjects,
+	}
+
+	// Only linux supports the /proc filesystem.
+	if files, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		v.FDs = len(files)
+	}
+	return v
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package dryrun
+
+import (
+	"context"
+	"fmt"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The kinds of decisions, which are not enforced in dry-run mode.
+const (
+	// The client denied by authentication, such as Oryx or external authorization.
+	KindAuth = "auth"
+	// The client denied, throttled or routed by policy.
+	KindPolicy = "policy"
+	// The new stream routed by routing rules.
+	KindRoute = "route"
+	// The client rejected by quota, the rate limit or max players.
+	KindQuota = "quota"
+	// The token revoked for restreaming.
+	KindRestream = "restream"
+)
+
+// The max number of recent decisions to keep.
+const maxRecords = 100
+
+// Record is a decision which would be enforced if not in dry-run mode.
+type Record struct {
+	// The kind of decision, such as auth, policy, route, quota or restream.
+	Kind string `json:"kind"`
+	// The decision, like deny client from 1.2.3.4 for live/livestream.
+	Message string `json:"message"`
+	// The context ID of client, to correlate with the logs.
+	ContextID string `json:"cid,omitempty"`
+	// The time of decision.
+	Time time.Time `json:"time"`
+}
+
+// Stats is the state and decisions of dry-run mode.
+type Stats struct {
+	// Whether in dry-run mode.
+	Enabled bool `json:"enabled"`
+	// The time the mode changed.
+	Since time.Time `json:"since"`
+	// The number of decisions not enforced since the mode enabled, key is the kind.
+	Counts map[string]int64 `json:"counts"`
+	// The recent decisions not enforced, the latest first.
+	Recent []*Record `json:"recent"`
+}
+
+// DryRun evaluates the routing rules, auth policies and limits, but only logs what would happen instead of
+// enforcing them, like "would deny" or "would route to B", so the operators validate the changes against the
+// live traffic safely.
+type DryRun interface {
+	// Enabled returns whether in dry-run mode.
+	Enabled() bool
+	// SetEnabled enables or disables the dry-run mode, and resets the decisions if changed.
+	SetEnabled(ctx context.Context, enabled bool)
+	// Enforce returns whether to enforce the decision, always true if not in dry-run mode. In dry-run mode,
+	// logs and records the decision as would be enforced, and returns false.
+	Enforce(ctx context.Context, kind, format string, args ...interface{}) bool
+	// Stats returns the state and decisions of dry-run mode.
+	Stats() *Stats
+}
+
+type dryRunImpl struct {
+	// Whether in dry-run mode.
+	enabled bool
+	// The time the mode changed.
+	since time.Time
+	// The number of decisions, key is the kind.
+	counts map[string]int64
+	// The recent decisions, the oldest first.
+	records []*Record
+	// The lock to protect all fields.
+	lock stdSync.Mutex
+}
+
+// NewDryRun creates the dry-run mode by options, disabled by default.
+func NewDryRun(opts ...func(*dryRunImpl)) DryRun {
+	v := &dryRunImpl{since: time.Now(), counts: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewDryRunFromEnvironment creates the dry-run mode by the flag in environment.
+func NewDryRunFromEnvironment(environment env.Environment) (DryRun, error) {
+	if flag := environment.DryRun(); flag != "on" && flag != "off" {
+		return nil, errors.Errorf("invalid dry run %v", flag)
+	}
+
+	return NewDryRun(func(v *dryRunImpl) {
+		v.enabled = environment.DryRun() == "on"
+	}), nil
+}
+
+func (v *dryRunImpl) Enabled() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.enabled
+}
+
+func (v *dryRunImpl) SetEnabled(ctx context.Context, enabled bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.enabled == enabled {
+		return
+	}
+
+	v.enabled, v.since = enabled, time.Now()
+	v.counts, v.records = make(map[string]int64), nil
+	logger.Df(ctx, "Dry-run mode changed to %v", enabled)
+}
+
+func (v *dryRunImpl) Enforce(ctx context.Context, kind, format string, args ...interface{}) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.enabled {
+		return true
+	}
+
+	message := fmt.Sprintf(format, args...)
+	logger.Wf(ctx, "Dry-run %v would %v", kind, message)
+
+	v.counts[kind]++
+	v.records = append(v.records, &Record{
+		Kind: kind, Message: message, ContextID: logger.ContextID(ctx), Time: time.Now(),
+	})
+	if len(v.records) > maxRecords {
+		v.records = v.records[len(v.records)-maxRecords:]
+	}
+	return false
+}
+
+func (v *dryRunImpl) Stats() *Stats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	stats := &Stats{Enabled: v.enabled, Since: v.since, Counts: make(map[string]int64), Recent: []*Record{}}
+	for kind, count := range v.counts {
+		stats.Counts[kind] = count
+	}
+	for i := len(v.records) - 1; i >= 0; i-- {
+		record := *v.records[i]
+		stats.Recent = append(stats.Recent, &record)
+	}
+	return stats
+}
+
+// SrsDryRun is the global dry-run mode, disabled by default.
+var SrsDryRun = NewDryRun()
@@ -0,0 +1,62 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package env
+
+import (
+	"context"
+	"os"
+
+	"srsx/internal/logger"
+)
+
+// envAlias is another name of variable, such as the old name before renamed, or the SRS compatible name.
+type envAlias struct {
+	// The alias name of variable.
+	Alias string
+	// The canonical name of variable.
+	Name string
+	// Whether the alias is deprecated, which will be removed in future release, so warn the user.
+	Deprecated bool
+}
+
+// The aliases of variables. Please add the old name as deprecated alias when renaming a variable, so the
+// users are able to upgrade without changing the configuration at the same time.
+var envAliases = []*envAlias{
+	// The SRS compatible names, to share the same configuration with SRS.
+	{Alias: "SRS_LISTEN", Name: "PROXY_RTMP_SERVER"},
+	{Alias: "SRS_HTTP_API_LISTEN", Name: "PROXY_HTTP_API"},
+	{Alias: "SRS_HTTP_SERVER_LISTEN", Name: "PROXY_HTTP_SERVER"},
+	{Alias: "SRS_RTC_SERVER_LISTEN", Name: "PROXY_WEBRTC_SERVER"},
+	{Alias: "SRS_SRT_SERVER_LISTEN", Name: "PROXY_SRT_SERVER"},
+}
+
+// The canonical variables which are set by alias, so they are updated when the alias changes by reload.
+var aliasedVariables = make(map[string]string)
+
+// applyEnvAliases sets the canonical variables by aliases, which should be called before setting the
+// default values. The canonical variable takes precedence, if both are set.
+func applyEnvAliases(ctx context.Context) {
+	for _, alias := range envAliases {
+		value := os.Getenv(alias.Alias)
+		if value == "" {
+			continue
+		}
+
+		if alias.Deprecated {
+			logger.Wf(ctx, "%v is deprecated, please use %v instead", alias.Alias, alias.Name)
+		}
+
+		current := os.Getenv(alias.Name)
+		if current != "" && aliasedVariables[alias.Name] != alias.Alias {
+			if current != value {
+				logger.Wf(ctx, "Ignore %v=%v, conflict with %v=%v", alias.Alias, value, alias.Name, current)
+			}
+			continue
+		}
+
+		os.Setenv(alias.Name, value)
+		aliasedVariables[alias.Name] = alias.Alias
+		logger.Df(ctx, "Set %v=%v by alias %v", alias.Name, value, alias.Alias)
+	}
+}
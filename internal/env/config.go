@@ -0,0 +1,163 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package env
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The max number of revisions kept in the history of configuration changes.
+const maxConfigRevisions = 100
+
+// The variables of secrets, which are masked in the effective configuration and changes.
+var secretVariables = map[string]bool{
+	"PROXY_ADMIN_TOKEN":          true,
+	"PROXY_CDN_SECRET":           true,
+	"PROXY_FORWARD_SECRET":       true,
+	"PROXY_GOSSIP_SECRET":        true,
+	"PROXY_PUBLISH_SECRET":       true,
+	"PROXY_REDIS_PASSWORD":       true,
+	"PROXY_S3_SECRET_KEY":        true,
+	"PROXY_SQL_DSN":              true,
+	"PROXY_STORE_ENCRYPTION_KEY": true,
+}
+
+// The variables managed by environment, registered by setEnvDefault.
+var knownVariables []string
+
+// The variables set by the process environment before loading .env, which are never overwritten by .env, the
+// same as the startup.
+var processVariables map[string]bool
+
+// snapshotProcessVariables saves the variables of process environment, before loading .env.
+func snapshotProcessVariables() {
+	processVariables = make(map[string]bool)
+	for _, kv := range os.Environ() {
+		if index := strings.Index(kv, "="); index > 0 {
+			processVariables[kv[:index]] = true
+		}
+	}
+}
+
+// ConfigChange is the change of a variable by reload.
+type ConfigChange struct {
+	// The name of variable.
+	Key string `json:"key"`
+	// The value before reload, masked if secret.
+	From string `json:"from"`
+	// The value after reload, masked if secret.
+	To string `json:"to"`
+}
+
+// ConfigRevision is a reload which changes the configuration.
+type ConfigRevision struct {
+	// The revision number, increased by each reload with changes.
+	Revision int `json:"revision"`
+	// The time of reload.
+	Time time.Time `json:"time"`
+	// The changed variables.
+	Changes []*ConfigChange `json:"changes"`
+}
+
+func (e *environment) Config() map[string]string {
+	config := e.rawConfig()
+	for key, value := range config {
+		config[key] = sanitizeValue(key, value)
+	}
+	return config
+}
+
+func (e *environment) Reload(ctx context.Context) ([]*ConfigChange, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	before := e.rawConfig()
+
+	// Update the variables by .env file, except the ones set by process environment, which take precedence
+	// like the startup. Note that the variable removed from file is not unset.
+	values, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reload .env file")
+	}
+	for key, value := range values {
+		if !processVariables[key] {
+			os.Setenv(key, value)
+		}
+	}
+	applyEnvAliases(ctx)
+	buildDefaultEnvironmentVariables(ctx)
+
+	after := e.rawConfig()
+	var changes []*ConfigChange
+	for _, key := range knownVariables {
+		if before[key] != after[key] {
+			changes = append(changes, &ConfigChange{
+				Key: key, From: sanitizeValue(key, before[key]), To: sanitizeValue(key, after[key]),
+			})
+		}
+	}
+
+	if len(changes) == 0 {
+		logger.Df(ctx, "Reload .env without changes")
+		return nil, nil
+	}
+
+	e.revision++
+	e.revisions = append(e.revisions, &ConfigRevision{Revision: e.revision, Time: time.Now(), Changes: changes})
+	if len(e.revisions) > maxConfigRevisions {
+		e.revisions = e.revisions[len(e.revisions)-maxConfigRevisions:]
+	}
+
+	for _, change := range changes {
+		logger.Df(ctx, "Reload %v from %v to %v", change.Key, change.From, change.To)
+	}
+	return changes, nil
+}
+
+func (e *environment) ConfigChanges() []*ConfigRevision {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	revisions := make([]*ConfigRevision, len(e.revisions))
+	copy(revisions, e.revisions)
+	return revisions
+}
+
+// rawConfig returns the values of known variables, without masking the secrets.
+func (e *environment) rawConfig() map[string]string {
+	config := make(map[string]string)
+	for _, key := range knownVariables {
+		config[key] = os.Getenv(key)
+	}
+	return config
+}
+
+// registerVariable registers the variable as known, in alphabet order.
+func registerVariable(key string) {
+	index := sort.SearchStrings(knownVariables, key)
+	if index < len(knownVariables) && knownVariables[index] == key {
+		return
+	}
+
+	knownVariables = append(knownVariables, "")
+	copy(knownVariables[index+1:], knownVariables[index:])
+	knownVariables[index] = key
+}
+
+// sanitizeValue masks the value of secret variable.
+func sanitizeValue(key, value string) string {
+	if secretVariables[key] && value != "" {
+		return "******"
+	}
+	return value
+}
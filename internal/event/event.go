@@ -0,0 +1,215 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The max number of events in queue, the new events are dropped if full.
+const webhookQueueSize = 1024
+
+// The timeout to post an event to webhook.
+const webhookTimeout = 3 * time.Second
+
+// The max number of recent events in history.
+const historySize = 128
+
+// Event is a notification of proxy, such as the SCTE-35 marker passing through.
+type Event struct {
+	// The type of event, such as scte35.
+	Type string `json:"type"`
+	// The time of event.
+	Time time.Time `json:"time"`
+	// The stream URL in vhost/app/stream schema, optional.
+	StreamURL string `json:"stream_url,omitempty"`
+	// The data of event, depends on type.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Notifier delivers the events of proxy to external systems.
+type Notifier interface {
+	// Whether the notifier is enabled, so the caller is able to skip detecting events.
+	Enabled() bool
+	// Notify the event asynchronously, never blocks the caller.
+	Notify(ctx context.Context, e *Event)
+	// Close the notifier, flushes the events in queue.
+	Close() error
+}
+
+type nopNotifier struct{}
+
+// NewNopNotifier creates a notifier which discards all events.
+func NewNopNotifier() Notifier {
+	return &nopNotifier{}
+}
+
+func (v *nopNotifier) Enabled() bool {
+	return false
+}
+
+func (v *nopNotifier) Notify(ctx context.Context, e *Event) {
+}
+
+func (v *nopNotifier) Close() error {
+	return nil
+}
+
+// webhookNotifier posts the events in JSON to a HTTP webhook.
+type webhookNotifier struct {
+	// The URL of webhook.
+	url string
+	// The events to post.
+	queue chan *Event
+	// The wait group for post goroutine.
+	wg stdSync.WaitGroup
+	// Whether closed, protected by lock.
+	closed bool
+	lock   stdSync.RWMutex
+}
+
+// NewWebhookNotifier creates a notifier which posts events to url.
+func NewWebhookNotifier(ctx context.Context, url string) Notifier {
+	v := &webhookNotifier{url: url, queue: make(chan *Event, webhookQueueSize)}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for e := range v.queue {
+			if err := v.post(e); err != nil {
+				logger.Wf(ctx, "Webhook post %v event to %v failed, err %+v", e.Type, v.url, err)
+			}
+		}
+	}()
+	return v
+}
+
+func (v *webhookNotifier) Enabled() bool {
+	return true
+}
+
+func (v *webhookNotifier) Notify(ctx context.Context, e *Event) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if v.closed {
+		return
+	}
+
+	select {
+	case v.queue <- e:
+	default:
+		logger.Wf(ctx, "Webhook queue full, drop %v event of %v", e.Type, e.StreamURL)
+	}
+}
+
+func (v *webhookNotifier) Close() error {
+	v.lock.Lock()
+	if !v.closed {
+		v.closed = true
+		close(v.queue)
+	}
+	v.lock.Unlock()
+
+	v.wg.Wait()
+	return nil
+}
+
+func (v *webhookNotifier) post(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "post %v", string(b))
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("post %v failed, status=%v", string(b), resp.Status)
+	}
+	return nil
+}
+
+// History keeps the recent events in memory, for the diagnostic snapshots of incidents.
+type History interface {
+	// Add the event, drops the oldest event if full.
+	Add(e *Event)
+	// Recent returns the recent events, the oldest first.
+	Recent() []*Event
+}
+
+type historyImpl struct {
+	// The max number of events.
+	size int
+	// The recent events, the oldest first.
+	events []*Event
+	// The lock to protect events.
+	lock stdSync.Mutex
+}
+
+// NewHistory creates a history which keeps the recent size events.
+func NewHistory(size int) History {
+	return &historyImpl{size: size}
+}
+
+func (v *historyImpl) Add(e *Event) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.events = append(v.events, e)
+	if len(v.events) > v.size {
+		v.events = v.events[len(v.events)-v.size:]
+	}
+}
+
+func (v *historyImpl) Recent() []*Event {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return append([]*Event{}, v.events...)
+}
+
+// historyNotifier adds the events to history, then delivers them by the notifier.
+type historyNotifier struct {
+	// The notifier to deliver events.
+	Notifier
+	// The history of events.
+	history History
+}
+
+// NewHistoryNotifier creates a notifier which adds the events to history, before delivered by notifier.
+func NewHistoryNotifier(notifier Notifier, history History) Notifier {
+	return &historyNotifier{Notifier: notifier, history: history}
+}
+
+func (v *historyNotifier) Notify(ctx context.Context, e *Event) {
+	v.history.Add(e)
+	v.Notifier.Notify(ctx, e)
+}
+
+// SrsEventHistory is the global history of recent events.
+var SrsEventHistory = NewHistory(historySize)
+
+// SrsEventNotifier is the global event notifier, which discards events if webhook is not configured.
+var SrsEventNotifier Notifier = NewNopNotifier()
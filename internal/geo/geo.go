@@ -0,0 +1,172 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package geo
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// Location is the geolocation of client address.
+type Location struct {
+	// The ISO 3166-1 alpha-2 country code in upper case, such as US, empty if unknown.
+	Country string `json:"country,omitempty"`
+	// The autonomous system number, such as AS13335, empty if unknown.
+	ASN string `json:"asn,omitempty"`
+	// The latitude and longitude, only available if HasCoordinates.
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	// Whether the coordinates is available.
+	HasCoordinates bool `json:"-"`
+}
+
+// DistanceTo returns the great-circle distance in kilometers to location o, by the haversine formula.
+func (v *Location) DistanceTo(o *Location) float64 {
+	const earthRadius = 6371.0
+
+	toRadian := func(degree float64) float64 {
+		return degree * math.Pi / 180
+	}
+
+	dLat, dLon := toRadian(o.Latitude-v.Latitude), toRadian(o.Longitude-v.Longitude)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadian(v.Latitude))*math.Cos(toRadian(o.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Locator finds the geolocation of client.
+type Locator interface {
+	// Locate the client by ip, and the header of HTTP request which is nil for other protocols. Never
+	// returns nil, the fields are empty if unknown.
+	Locate(ip string, header http.Header) *Location
+}
+
+// geoRange is a CIDR range in the database.
+type geoRange struct {
+	// The CIDR of range.
+	network *net.IPNet
+	// The location of range.
+	location Location
+}
+
+type locatorImpl struct {
+	// The ranges sorted by prefix length in descending order, so the most specific range matches first.
+	ranges []*geoRange
+	// The header of country code set by CDN, such as CF-IPCountry, empty to ignore.
+	countryHeader string
+	// The header of ASN set by CDN, empty to ignore.
+	asnHeader string
+}
+
+// NewLocator creates a locator by the ranges in database file, and the headers set by CDN, which are
+// used first if present. The database file is ignored if empty.
+func NewLocator(filename, countryHeader, asnHeader string) (Locator, error) {
+	v := &locatorImpl{countryHeader: countryHeader, asnHeader: asnHeader}
+	if filename != "" {
+		if err := v.load(filename); err != nil {
+			return nil, errors.Wrapf(err, "load %v", filename)
+		}
+	}
+	return v, nil
+}
+
+// NewLocatorFromEnvironment creates the locator by the database file and the headers in environment.
+func NewLocatorFromEnvironment(environment env.Environment) (Locator, error) {
+	return NewLocator(environment.GeoFile(), environment.GeoCountryHeader(), environment.GeoASNHeader())
+}
+
+// load the database file in CSV, each line is a range like below, the ASN and coordinates are optional:
+//
+//	# cidr,country,asn,latitude,longitude
+//	1.0.0.0/24,AU,AS13335,-33.49,143.21
+func (v *locatorImpl) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "open")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 2 {
+			return errors.Errorf("invalid line %v: %v", line, text)
+		}
+
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return errors.Wrapf(err, "parse cidr at line %v: %v", line, text)
+		}
+
+		r := &geoRange{network: network, location: Location{Country: strings.ToUpper(fields[1])}}
+		if len(fields) > 2 {
+			r.location.ASN = strings.ToUpper(fields[2])
+		}
+		if len(fields) > 4 && fields[3] != "" && fields[4] != "" {
+			if r.location.Latitude, err = strconv.ParseFloat(fields[3], 64); err != nil {
+				return errors.Wrapf(err, "parse latitude at line %v: %v", line, text)
+			}
+			if r.location.Longitude, err = strconv.ParseFloat(fields[4], 64); err != nil {
+				return errors.Wrapf(err, "parse longitude at line %v: %v", line, text)
+			}
+			r.location.HasCoordinates = true
+		}
+		v.ranges = append(v.ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "read")
+	}
+
+	sort.SliceStable(v.ranges, func(i, j int) bool {
+		ones, _ := v.ranges[i].network.Mask.Size()
+		other, _ := v.ranges[j].network.Mask.Size()
+		return ones > other
+	})
+	return nil
+}
+
+func (v *locatorImpl) Locate(ip string, header http.Header) *Location {
+	location := &Location{}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, r := range v.ranges {
+			if r.network.Contains(parsed) {
+				*location = r.location
+				break
+			}
+		}
+	}
+
+	if header != nil {
+		if country := header.Get(v.countryHeader); v.countryHeader != "" && country != "" {
+			location.Country = strings.ToUpper(country)
+		}
+		if asn := header.Get(v.asnHeader); v.asnHeader != "" && asn != "" {
+			if asn = strings.ToUpper(asn); !strings.HasPrefix(asn, "AS") {
+				asn = "AS" + asn
+			}
+			location.ASN = asn
+		}
+	}
+	return location
+}
+
+// SrsLocator is the global locator, which knows nothing by default.
+var SrsLocator Locator = &locatorImpl{}
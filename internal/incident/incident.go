@@ -0,0 +1,307 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package incident
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/alarm"
+	"srsx/internal/debug"
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/session"
+)
+
+// The max number of snapshots kept in memory, the oldest is dropped if full.
+const maxSnapshots = 16
+
+// The max number of streams in snapshot, the streams with most sessions first.
+const maxTopStreams = 20
+
+// The format of snapshot ID, the time captured in UTC.
+const snapshotIDFormat = "20060102T150405.000Z"
+
+// Summary is the brief of snapshot, to list the snapshots.
+type Summary struct {
+	// The ID of snapshot, the time captured in UTC, like 20250101T000000.000Z.
+	ID string `json:"id"`
+	// The time captured.
+	Time time.Time `json:"time"`
+	// The reason to capture, such as the errors exceed the threshold, or manual.
+	Reason string `json:"reason"`
+	// The number of sessions closed by error in the last interval.
+	Errors int64 `json:"errors"`
+}
+
+// Snapshot is the diagnostic bundle of proxy captured when the incident happens, for the post-incident
+// analysis, without someone running commands during the outage.
+type Snapshot struct {
+	*Summary
+	// The runtime resources of proxy.
+	Runtime *debug.RuntimeStats `json:"runtime"`
+	// The usage of proxy, the sessions, bandwidth and CPU.
+	Usage *alarm.Usage `json:"usage"`
+	// The streams with most sessions.
+	Streams []*session.StreamStats `json:"streams"`
+	// The circuit breakers of backend servers with failures.
+	Breakers []*lb.SRSServerBreakerState `json:"breakers"`
+	// The load of backend servers, key is the server ID.
+	Loads map[string]*lb.SRSServerLoad `json:"loads"`
+	// The latency in milliseconds of backend servers, key is the server ID.
+	Latencies map[string]float64 `json:"latencies"`
+	// The recent events, the oldest first.
+	Events []*event.Event `json:"events"`
+	// The number of sessions closed in the last interval, by protocol then close reason.
+	Closes map[string]map[string]int64 `json:"closes"`
+	// The stacks of goroutines, grouped by the same stack.
+	Goroutines string `json:"goroutines"`
+}
+
+// Recorder watches the error rate of proxy, and captures a diagnostic snapshot automatically when the
+// sessions closed by error in interval exceed the threshold.
+type Recorder interface {
+	// Run to watch the error rate in interval, until ctx done.
+	Run(ctx context.Context)
+	// Capture a snapshot for reason, for example, manually by System API.
+	Capture(ctx context.Context, reason string) (*Snapshot, error)
+	// Snapshots returns the summaries of snapshots in memory, the latest first.
+	Snapshots() []*Summary
+	// Snapshot returns the snapshot by id, or nil if not found.
+	Snapshot(id string) *Snapshot
+}
+
+type recorderImpl struct {
+	// The interval to check the error rate.
+	interval time.Duration
+	// The number of sessions closed by error in interval to capture a snapshot, 0 to disable.
+	maxErrors int64
+	// The min duration between the automatic snapshots, to not capture during the whole outage.
+	cooldown time.Duration
+	// The directory to write the snapshots, empty to keep in memory only.
+	dir string
+
+	// The closes of sessions at the last check, to calculate the deltas.
+	lastCloses map[string]map[string]int64
+	// The time of last automatic snapshot.
+	lastCaptured time.Time
+	// The snapshots, the oldest first.
+	snapshots []*Snapshot
+	// The lock to protect lastCloses and snapshots.
+	lock stdSync.Mutex
+}
+
+// NewRecorder creates a recorder by options, which only captures the snapshots manually.
+func NewRecorder(opts ...func(*recorderImpl)) Recorder {
+	v := &recorderImpl{
+		interval: 10 * time.Second, cooldown: 10 * time.Minute,
+		lastCloses: make(map[string]map[string]int64),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewRecorderFromEnvironment creates the recorder by the threshold of errors in environment.
+func NewRecorderFromEnvironment(environment env.Environment) (Recorder, error) {
+	interval, err := time.ParseDuration(environment.IncidentInterval())
+	if err != nil || interval <= 0 {
+		return nil, errors.Errorf("invalid incident interval %v", environment.IncidentInterval())
+	}
+	maxErrors, err := strconv.ParseInt(environment.IncidentMaxErrors(), 10, 64)
+	if err != nil || maxErrors < 0 {
+		return nil, errors.Errorf("invalid incident max errors %v", environment.IncidentMaxErrors())
+	}
+	cooldown, err := time.ParseDuration(environment.IncidentCooldown())
+	if err != nil || cooldown < 0 {
+		return nil, errors.Errorf("invalid incident cooldown %v", environment.IncidentCooldown())
+	}
+
+	dir := environment.IncidentDir()
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "create incident dir %v", dir)
+		}
+	}
+
+	return NewRecorder(func(v *recorderImpl) {
+		v.interval, v.maxErrors, v.cooldown, v.dir = interval, maxErrors, cooldown, dir
+	}), nil
+}
+
+func (v *recorderImpl) Run(ctx context.Context) {
+	if v.maxErrors <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	v.deltas(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		closes := v.deltas(true)
+		var errs int64
+		for _, reasons := range closes {
+			errs += reasons[session.CloseError]
+		}
+		if errs < v.maxErrors || time.Since(v.lastCaptured) < v.cooldown {
+			continue
+		}
+
+		v.lastCaptured = time.Now()
+		reason := fmt.Sprintf("errors %v in %v, threshold %v", errs, v.interval, v.maxErrors)
+		if _, err := v.capture(ctx, reason, errs, closes); err != nil {
+			logger.Wf(ctx, "Incident capture snapshot for %v failed, err %+v", reason, err)
+		}
+	}
+}
+
+func (v *recorderImpl) Capture(ctx context.Context, reason string) (*Snapshot, error) {
+	closes := v.deltas(false)
+
+	var errs int64
+	for _, reasons := range closes {
+		errs += reasons[session.CloseError]
+	}
+	return v.capture(ctx, reason, errs, closes)
+}
+
+func (v *recorderImpl) Snapshots() []*Summary {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	summaries := make([]*Summary, 0, len(v.snapshots))
+	for i := len(v.snapshots) - 1; i >= 0; i-- {
+		summaries = append(summaries, v.snapshots[i].Summary)
+	}
+	return summaries
+}
+
+func (v *recorderImpl) Snapshot(id string) *Snapshot {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, snapshot := range v.snapshots {
+		if snapshot.ID == id {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// deltas returns the number of sessions closed since last check, by protocol then close reason, and starts
+// the next check if update.
+func (v *recorderImpl) deltas(update bool) map[string]map[string]int64 {
+	closes := session.SrsSessionManager.Closes()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	deltas := make(map[string]map[string]int64)
+	for protocol, reasons := range closes {
+		deltas[protocol] = make(map[string]int64)
+		for reason, n := range reasons {
+			if delta := n - v.lastCloses[protocol][reason]; delta > 0 {
+				deltas[protocol][reason] = delta
+			}
+		}
+	}
+	if update {
+		v.lastCloses = closes
+	}
+	return deltas
+}
+
+// capture the snapshot, keeps it in memory, and writes it to the directory if set.
+func (v *recorderImpl) capture(ctx context.Context, reason string, errs int64, closes map[string]map[string]int64) (*Snapshot, error) {
+	now := time.Now()
+	snapshot := &Snapshot{
+		Summary: &Summary{
+			ID: now.UTC().Format(snapshotIDFormat), Time: now, Reason: reason, Errors: errs,
+		},
+		Runtime:   debug.NewRuntimeStats(),
+		Usage:     alarm.SrsUsageMonitor.Usage(),
+		Breakers:  lb.SrsServerBreaker.States(),
+		Loads:     lb.SrsServerLoadMonitor.Loads(),
+		Latencies: lb.SrsServerLatency.Latencies(),
+		Events:    event.SrsEventHistory.Recent(),
+		Closes:    closes,
+	}
+
+	// The streams with most sessions first.
+	streams := session.SrsSessionManager.Streams()
+	total := func(s *session.StreamStats) (n int) {
+		for _, sessions := range s.Sessions {
+			n += sessions
+		}
+		return
+	}
+	sort.SliceStable(streams, func(i, j int) bool {
+		return total(streams[i]) > total(streams[j])
+	})
+	if len(streams) > maxTopStreams {
+		streams = streams[:maxTopStreams]
+	}
+	snapshot.Streams = streams
+
+	var stacks bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&stacks, 1); err != nil {
+		return nil, errors.Wrapf(err, "dump goroutines")
+	}
+	snapshot.Goroutines = stacks.String()
+
+	v.lock.Lock()
+	v.snapshots = append(v.snapshots, snapshot)
+	if len(v.snapshots) > maxSnapshots {
+		v.snapshots = v.snapshots[len(v.snapshots)-maxSnapshots:]
+	}
+	v.lock.Unlock()
+
+	logger.Wf(ctx, "Incident snapshot %v captured for %v, goroutines=%v, streams=%v, events=%v",
+		snapshot.ID, reason, snapshot.Runtime.Goroutines, len(snapshot.Streams), len(snapshot.Events))
+
+	event.SrsEventNotifier.Notify(ctx, &event.Event{
+		Type: "incident", Time: now,
+		Data: map[string]interface{}{
+			"id": snapshot.ID, "reason": reason, "errors": errs,
+		},
+	})
+
+	if v.dir != "" {
+		b, err := json.Marshal(snapshot)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal snapshot %v", snapshot.ID)
+		}
+
+		filename := path.Join(v.dir, fmt.Sprintf("incident-%v.json", snapshot.ID))
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return nil, errors.Wrapf(err, "write snapshot %v", filename)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// SrsIncidentRecorder is the global incident recorder, which only captures the snapshots manually by default.
+var SrsIncidentRecorder = NewRecorder()
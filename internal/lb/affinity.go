@@ -0,0 +1,118 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// The affinity modes of Pick, the key to keep the picked server.
+const (
+	// Sticky by stream URL, all clients of a stream are proxied to the same server.
+	AffinityStream = "stream"
+	// Sticky by stream URL and client IP, so the players of a stream are spread to servers, while each
+	// client keeps its server, for example, the backend servers are edges pulling from the same origin.
+	AffinityClient = "client"
+	// Not sticky, the server is selected for each client by strategy.
+	AffinityNone = "none"
+)
+
+// ClientAffinityDuration is the duration to keep the picked server of client, in Redis or state store.
+const ClientAffinityDuration = 30 * time.Minute
+
+// PickAffinity is the affinity modes of publishers and players.
+type PickAffinity struct {
+	// The affinity of publishers.
+	Publish string
+	// The affinity of players.
+	Play string
+}
+
+// NewPickAffinity creates the affinity, which is sticky by stream URL for both publishers and players.
+func NewPickAffinity() *PickAffinity {
+	return &PickAffinity{Publish: AffinityStream, Play: AffinityStream}
+}
+
+// NewPickAffinityFromEnvironment creates the affinity of publishers and players in environment.
+func NewPickAffinityFromEnvironment(environment env.Environment) (*PickAffinity, error) {
+	v := &PickAffinity{Publish: environment.PublishAffinity(), Play: environment.PlayAffinity()}
+	for _, affinity := range []string{v.Publish, v.Play} {
+		if affinity != AffinityStream && affinity != AffinityClient && affinity != AffinityNone {
+			return nil, errors.Errorf("invalid affinity %v", affinity)
+		}
+	}
+	return v, nil
+}
+
+func (v *PickAffinity) String() string {
+	return fmt.Sprintf("publish=%v, play=%v", v.Publish, v.Play)
+}
+
+// clientKey is the context key of client IP.
+type clientKey struct{}
+
+// affinityKey is the context key of affinity mode.
+type affinityKey struct{}
+
+// WithClient returns a context to pick the server for the client from remoteAddr, which is the key for the
+// client affinity.
+func WithClient(ctx context.Context, remoteAddr string) context.Context {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	return context.WithValue(ctx, clientKey{}, ip)
+}
+
+// withAffinity returns a context to pick the server by the affinity mode, of publisher or player.
+func withAffinity(ctx context.Context, affinity string) context.Context {
+	return context.WithValue(ctx, affinityKey{}, affinity)
+}
+
+// pickKey returns the key to keep the picked server of stream, by the affinity and client in ctx, which is
+// the stream URL by default, and empty if not sticky. It's always sticky by stream URL if the client is
+// unknown, for example, the HLS streaming shared by players, or the relay tasks.
+func pickKey(ctx context.Context, streamURL string) string {
+	ip, _ := ctx.Value(clientKey{}).(string)
+	if ip == "" {
+		return streamURL
+	}
+
+	affinity, _ := ctx.Value(affinityKey{}).(string)
+	switch affinity {
+	case AffinityClient:
+		return fmt.Sprintf("%v#%v", streamURL, ip)
+	case AffinityNone:
+		return ""
+	}
+	return streamURL
+}
+
+// unpickKeys returns the keys to clear the picked server of stream, the stream URL and the client in ctx if
+// known, because the affinity of publishers and players might be different.
+func unpickKeys(ctx context.Context, streamURL string) []string {
+	keys := []string{streamURL}
+	if ip, _ := ctx.Value(clientKey{}).(string); ip != "" {
+		keys = append(keys, fmt.Sprintf("%v#%v", streamURL, ip))
+	}
+	return keys
+}
+
+// pickTTL returns the TTL of the picked server by key in the shared store, which never expires for the stream,
+// while expires in ClientAffinityDuration for the client, to not keep the keys of left clients.
+func pickTTL(key, streamURL string) time.Duration {
+	if key == streamURL {
+		return 0
+	}
+	return ClientAffinityDuration
+}
+
+// SrsPickAffinity is the global affinity of Pick, which is sticky by stream URL by default.
+var SrsPickAffinity = NewPickAffinity()
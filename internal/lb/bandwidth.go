@@ -0,0 +1,207 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// The window to sample the bitrate of stream.
+const bitrateWindow = 5 * time.Second
+
+// The weight of the latest sample in the moving average of bitrate.
+const bitrateAlpha = 0.3
+
+// The stream placed on server without traffic in this duration is regarded as gone.
+const bitrateIdleDuration = 30 * time.Second
+
+// The history of stream is kept in this duration after the last traffic, to forecast when republished.
+const bitrateHistoryTTL = 24 * time.Hour
+
+// SRSServerBandwidth forecasts the bitrate of streams by their recent history, and places the new stream on
+// the server with enough bandwidth budget, instead of counting the streams only, because the streams vary
+// from sub-Mbps audio to tens of Mbps 4K, and the origins of fleet vary in the network capacity. The used
+// bandwidth of server is the sum of forecasted bitrate of the streams placed on it by this proxy.
+type SRSServerBandwidth interface {
+	// AddBytes adds the bytes of publisher of stream, to track the bitrate of stream.
+	AddBytes(streamURL string, n int)
+	// Forecast returns the bitrate in Mbps of stream, by the recent history, or the default if unknown.
+	Forecast(streamURL string) float64
+	// Full returns whether the server has no budget for the stream, always false if unlimited.
+	Full(server *SRSServer, streamURL string) bool
+	// Attempt places the stream on the server.
+	Attempt(server *SRSServer, streamURL string)
+	// Used returns the forecasted bandwidth in Mbps of the streams placed on server.
+	Used(server *SRSServer) float64
+}
+
+// streamBitrate is the bitrate history of a stream.
+type streamBitrate struct {
+	// The moving average of bitrate in Mbps, 0 if not sampled yet.
+	bitrate float64
+	// The bytes in current window.
+	bytes int
+	// The start time of current window.
+	windowAt time.Time
+	// The time of last traffic.
+	activeAt time.Time
+}
+
+// placedStream is a stream placed on server.
+type placedStream struct {
+	// The ID of server.
+	serverID string
+	// The time placed.
+	placedAt time.Time
+}
+
+type srsServerBandwidthImpl struct {
+	// The bitrate in Mbps of stream without history.
+	defaultBitrate float64
+
+	// The bitrate history of streams, key is the stream URL.
+	streams map[string]*streamBitrate
+	// The server of streams placed on, key is the stream URL.
+	placed map[string]*placedStream
+	// The lock to protect streams and placed.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerBandwidth creates the bandwidth forecaster of backend servers with options.
+func NewSRSServerBandwidth(opts ...func(*srsServerBandwidthImpl)) SRSServerBandwidth {
+	v := &srsServerBandwidthImpl{
+		defaultBitrate: 2, streams: make(map[string]*streamBitrate), placed: make(map[string]*placedStream),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerBandwidthFromEnvironment creates the bandwidth forecaster by the default bitrate in environment.
+func NewSRSServerBandwidthFromEnvironment(environment env.Environment) (SRSServerBandwidth, error) {
+	defaultBitrate, err := strconv.ParseFloat(environment.StreamDefaultBitrate(), 64)
+	if err != nil || defaultBitrate < 0 {
+		return nil, errors.Errorf("invalid stream default bitrate %v", environment.StreamDefaultBitrate())
+	}
+
+	return NewSRSServerBandwidth(func(v *srsServerBandwidthImpl) {
+		v.defaultBitrate = defaultBitrate
+	}), nil
+}
+
+func (v *srsServerBandwidthImpl) AddBytes(streamURL string, n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	stream, ok := v.streams[streamURL]
+	if !ok {
+		stream = &streamBitrate{windowAt: now}
+		v.streams[streamURL] = stream
+	}
+
+	// Restart the window after idle, for example, republished, to not sample the gap as low bitrate.
+	if now.Sub(stream.activeAt) > bitrateWindow {
+		stream.bytes, stream.windowAt = 0, now
+	}
+	stream.bytes += n
+	stream.activeAt = now
+
+	if elapsed := now.Sub(stream.windowAt); elapsed >= bitrateWindow {
+		sample := float64(stream.bytes) * 8 / 1e6 / elapsed.Seconds()
+		if stream.bitrate == 0 {
+			stream.bitrate = sample
+		} else {
+			stream.bitrate = bitrateAlpha*sample + (1-bitrateAlpha)*stream.bitrate
+		}
+		stream.bytes, stream.windowAt = 0, now
+	}
+}
+
+func (v *srsServerBandwidthImpl) Forecast(streamURL string) float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.forecast(streamURL)
+}
+
+// forecast returns the bitrate of stream, the lock must be held.
+func (v *srsServerBandwidthImpl) forecast(streamURL string) float64 {
+	if stream, ok := v.streams[streamURL]; ok && stream.bitrate > 0 {
+		return stream.bitrate
+	}
+	return v.defaultBitrate
+}
+
+func (v *srsServerBandwidthImpl) Full(server *SRSServer, streamURL string) bool {
+	if server.MaxBandwidth <= 0 {
+		return false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// The stream already placed on the server is not counted twice, for example, re-picked.
+	used := v.used(server, streamURL)
+	return used+v.forecast(streamURL) > float64(server.MaxBandwidth)
+}
+
+func (v *srsServerBandwidthImpl) Attempt(server *SRSServer, streamURL string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Remove the streams which are gone, and the history which is too old.
+	now := time.Now()
+	for url, stream := range v.placed {
+		if !v.alive(url, stream, now) {
+			delete(v.placed, url)
+		}
+	}
+	for url, stream := range v.streams {
+		if now.Sub(stream.activeAt) > bitrateHistoryTTL {
+			delete(v.streams, url)
+		}
+	}
+
+	v.placed[streamURL] = &placedStream{serverID: server.ID(), placedAt: now}
+}
+
+func (v *srsServerBandwidthImpl) Used(server *SRSServer) float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.used(server, "")
+}
+
+// used returns the bandwidth of the alive streams placed on server, except the stream, the lock must be held.
+func (v *srsServerBandwidthImpl) used(server *SRSServer, except string) float64 {
+	var used float64
+	now := time.Now()
+	for url, stream := range v.placed {
+		if url != except && stream.serverID == server.ID() && v.alive(url, stream, now) {
+			used += v.forecast(url)
+		}
+	}
+	return used
+}
+
+// alive returns whether the placed stream is just placed or still has traffic, the lock must be held.
+func (v *srsServerBandwidthImpl) alive(streamURL string, stream *placedStream, now time.Time) bool {
+	if now.Sub(stream.placedAt) <= bitrateIdleDuration {
+		return true
+	}
+	if history, ok := v.streams[streamURL]; ok && now.Sub(history.activeAt) <= bitrateIdleDuration {
+		return true
+	}
+	return false
+}
+
+// SrsServerBandwidth is the global bandwidth forecaster of backend servers.
+var SrsServerBandwidth = NewSRSServerBandwidth()
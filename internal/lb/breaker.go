@@ -0,0 +1,219 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The states of circuit breaker.
+const (
+	// The server is healthy, and selected for new streams.
+	BreakerClosed = "closed"
+	// The server fails too many times, and not selected until cooldown.
+	BreakerOpen = "open"
+	// The cooldown is done, and a stream is selected to the server to probe whether it recovers.
+	BreakerHalfOpen = "half-open"
+)
+
+// SRSServerBreakerState is the state of circuit breaker of a server.
+type SRSServerBreakerState struct {
+	// The ID of server.
+	ID string `json:"id"`
+	// The state, closed, open or half-open.
+	State string `json:"state"`
+	// The consecutive failures.
+	Failures int `json:"failures"`
+	// The time to probe the server again, for open state.
+	RetryAt time.Time `json:"retry_at,omitempty"`
+}
+
+// SRSServerBreaker tracks the consecutive dial and proxy failures of each backend server on this proxy, and
+// temporarily removes the server from Pick candidates when the failures reach the threshold, for example,
+// a half-dead server which still heartbeats. After cooldown, the breaker is half-open, and a stream is
+// selected to the server to probe it, which closes the breaker if success, or opens it again if fails.
+type SRSServerBreaker interface {
+	// Available returns whether the server is able to be selected for new stream.
+	Available(server *SRSServer) bool
+	// Attempt marks the server selected for new stream, which is the probe if half-open.
+	Attempt(server *SRSServer)
+	// Success resets the failures of server, and closes the breaker.
+	Success(server *SRSServer)
+	// Failure records a failure of server, returns whether the breaker is open.
+	Failure(server *SRSServer) bool
+	// States returns the states of servers with failures, sorted by ID.
+	States() []*SRSServerBreakerState
+}
+
+// srsServerBreakerEntry is the failures of a server.
+type srsServerBreakerEntry struct {
+	// The consecutive failures.
+	failures int
+	// The time to probe the server again, zero if not open.
+	retryAt time.Time
+	// The time the probe is selected, zero if no probe in flight.
+	probeAt time.Time
+	// The time of last failure.
+	updatedAt time.Time
+}
+
+type srsServerBreakerImpl struct {
+	// The consecutive failures to open the breaker, 0 to disable.
+	threshold int
+	// The duration to wait before probing the server.
+	cooldown time.Duration
+
+	// The failures of servers, key is the ID of server.
+	entries map[string]*srsServerBreakerEntry
+	// The lock to protect entries.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerBreaker creates a new circuit breaker of backend servers with options.
+func NewSRSServerBreaker(opts ...func(*srsServerBreakerImpl)) SRSServerBreaker {
+	v := &srsServerBreakerImpl{
+		threshold: 5, cooldown: 30 * time.Second, entries: make(map[string]*srsServerBreakerEntry),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerBreakerFromEnvironment creates the circuit breaker by the threshold and cooldown in
+// environment.
+func NewSRSServerBreakerFromEnvironment(environment env.Environment) (SRSServerBreaker, error) {
+	threshold, err := strconv.Atoi(environment.BreakerThreshold())
+	if err != nil || threshold < 0 {
+		return nil, errors.Errorf("invalid threshold %v", environment.BreakerThreshold())
+	}
+	cooldown, err := time.ParseDuration(environment.BreakerCooldown())
+	if err != nil || cooldown <= 0 {
+		return nil, errors.Errorf("invalid cooldown %v", environment.BreakerCooldown())
+	}
+
+	return NewSRSServerBreaker(func(v *srsServerBreakerImpl) {
+		v.threshold, v.cooldown = threshold, cooldown
+	}), nil
+}
+
+func (v *srsServerBreakerImpl) Available(server *SRSServer) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	entry, ok := v.entries[server.ID()]
+	if !ok || entry.retryAt.IsZero() {
+		return true
+	}
+
+	// Open until cooldown, then half-open with only one probe in flight. The probe is regarded as lost if
+	// no result in cooldown, for example, the stream is never connected.
+	now := time.Now()
+	if now.Before(entry.retryAt) {
+		return false
+	}
+	return entry.probeAt.IsZero() || now.Sub(entry.probeAt) > v.cooldown
+}
+
+func (v *srsServerBreakerImpl) Attempt(server *SRSServer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if entry, ok := v.entries[server.ID()]; ok && !entry.retryAt.IsZero() {
+		entry.probeAt = time.Now()
+	}
+}
+
+func (v *srsServerBreakerImpl) Success(server *SRSServer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.entries, server.ID())
+}
+
+func (v *srsServerBreakerImpl) Failure(server *SRSServer) bool {
+	if v.threshold == 0 {
+		return false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Remove the entries of the servers which are dead or restarted, with new ID.
+	now := time.Now()
+	for id, entry := range v.entries {
+		if now.Sub(entry.updatedAt) > ServerAliveDuration && now.After(entry.retryAt) {
+			delete(v.entries, id)
+		}
+	}
+
+	entry, ok := v.entries[server.ID()]
+	if !ok {
+		entry = &srsServerBreakerEntry{}
+		v.entries[server.ID()] = entry
+	}
+	entry.failures, entry.updatedAt = entry.failures+1, now
+
+	// Open the breaker if reach the threshold, or the probe fails when half-open.
+	if entry.failures >= v.threshold || !entry.probeAt.IsZero() {
+		entry.retryAt, entry.probeAt = now.Add(v.cooldown), time.Time{}
+	}
+	return !entry.retryAt.IsZero()
+}
+
+func (v *srsServerBreakerImpl) States() []*SRSServerBreakerState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	states := make([]*SRSServerBreakerState, 0, len(v.entries))
+	for id, entry := range v.entries {
+		state := &SRSServerBreakerState{ID: id, State: BreakerClosed, Failures: entry.failures}
+		if !entry.retryAt.IsZero() {
+			state.State, state.RetryAt = BreakerOpen, entry.retryAt
+			if !now.Before(entry.retryAt) {
+				state.State = BreakerHalfOpen
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ID < states[j].ID
+	})
+	return states
+}
+
+// ReportBackend reports the result of connecting or proxying the stream to backend server, to the circuit
+// breaker. The stream is unpicked if the breaker is open, so it's re-picked to another server by the next
+// client, while the failure caused by the client, such as cancelled, is ignored. The latency to dial and get
+// the first response is observed if succeeded, for latency-aware strategy, and 0 is ignored, such as UDP.
+func ReportBackend(ctx context.Context, streamURL string, server *SRSServer, latency time.Duration, err error) {
+	if err == nil {
+		SrsServerBreaker.Success(server)
+		if latency > 0 {
+			SrsServerLatency.Observe(server, latency)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if SrsServerBreaker.Failure(server) {
+		logger.Wf(ctx, "Circuit breaker open for %v, stream %v, err %v", server, streamURL, err)
+		if err := SrsLoadBalancer.Unpick(ctx, streamURL); err != nil {
+			logger.Wf(ctx, "Unpick %v failed, %v", streamURL, err)
+		}
+	}
+}
+
+// SrsServerBreaker is the global circuit breaker of backend servers.
+var SrsServerBreaker = NewSRSServerBreaker()
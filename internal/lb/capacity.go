@@ -0,0 +1,94 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	stdSync "sync"
+	"time"
+)
+
+// SRSServerCapacity tracks the number of streams of backend servers, and the server which reaches its max
+// streams gets no new stream. The streams is the larger one of the number reported by heartbeat and queried
+// from the HTTP API of SRS, plus the new streams selected to the server since then on this proxy, so a burst
+// of new streams does not exceed the max streams before the streams is updated.
+type SRSServerCapacity interface {
+	// Full returns whether the server reaches its max streams, always false if unlimited.
+	Full(server *SRSServer) bool
+	// Attempt counts a new stream selected to the server.
+	Attempt(server *SRSServer)
+	// Streams returns the number of streams of server.
+	Streams(server *SRSServer) int
+}
+
+type srsServerCapacityImpl struct {
+	// The time of new streams selected to servers, key is the server ID.
+	pending map[string][]time.Time
+	// The lock to protect pending.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerCapacity creates the capacity of backend servers.
+func NewSRSServerCapacity() SRSServerCapacity {
+	return &srsServerCapacityImpl{pending: make(map[string][]time.Time)}
+}
+
+func (v *srsServerCapacityImpl) Full(server *SRSServer) bool {
+	if server.MaxStreams <= 0 {
+		return false
+	}
+
+	// Query the streams of server from the HTTP API of SRS.
+	SrsServerLoadMonitor.Watch([]*SRSServer{server})
+	return v.Streams(server) >= server.MaxStreams
+}
+
+func (v *srsServerCapacityImpl) Attempt(server *SRSServer) {
+	if server.MaxStreams <= 0 {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Remove the servers which are dead or restarted, with new ID.
+	now := time.Now()
+	for id, times := range v.pending {
+		if len(times) > 0 && now.Sub(times[len(times)-1]) > ServerAliveDuration {
+			delete(v.pending, id)
+		}
+	}
+
+	v.pending[server.ID()] = append(v.pending[server.ID()], now)
+}
+
+func (v *srsServerCapacityImpl) Streams(server *SRSServer) int {
+	streams, updatedAt := server.Streams, server.UpdatedAt
+	if load := SrsServerLoadMonitor.Load(server); load != nil && load.Error == "" {
+		if load.Streams > streams {
+			streams = load.Streams
+		}
+		if load.StreamsUpdatedAt.After(updatedAt) {
+			updatedAt = load.StreamsUpdatedAt
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// The new streams before the streams updated are already counted.
+	times := v.pending[server.ID()]
+	for len(times) > 0 && !times[0].After(updatedAt) {
+		times = times[1:]
+	}
+	if len(times) > 0 {
+		v.pending[server.ID()] = times
+	} else {
+		delete(v.pending, server.ID())
+	}
+
+	return streams + len(times)
+}
+
+// SrsServerCapacity is the global capacity of backend servers.
+var SrsServerCapacity = NewSRSServerCapacity()
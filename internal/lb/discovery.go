@@ -0,0 +1,452 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The files of service account in Kubernetes pod, to access the API server in cluster.
+const (
+	kubernetesTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// The interval to keep the discovered servers alive, and to retry the watch when failed.
+const discoveryInterval = 30 * time.Second
+
+// SRSServerDiscovery discovers the backend servers, and keeps the servers of load balancer in sync, so the
+// servers don't need to register by heartbeat.
+type SRSServerDiscovery interface {
+	// Run to discover the servers until ctx done.
+	Run(ctx context.Context)
+	// Servers returns the discovered servers.
+	Servers() []*SRSServer
+}
+
+// discoveredServers keeps the discovered servers in sync with load balancer, shared by the discoveries. The
+// removed servers are drained, so the existing sessions continue until the servers expire.
+type discoveredServers struct {
+	// The name of discovery, for logs.
+	name string
+	// The options to update the server, for example, the weights.
+	environment env.Environment
+
+	// The servers updated to load balancer, key is the server ID.
+	servers map[string]*SRSServer
+	// The lock to protect servers.
+	lock stdSync.Mutex
+}
+
+func newDiscoveredServers(name string, environment env.Environment) *discoveredServers {
+	return &discoveredServers{name: name, environment: environment, servers: make(map[string]*SRSServer)}
+}
+
+// Run to keep the discovered servers alive until ctx done, because they never heartbeat.
+func (v *discoveredServers) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryInterval):
+			v.keepalive(ctx)
+		}
+	}
+}
+
+func (v *discoveredServers) Servers() []*SRSServer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	servers := []*SRSServer{}
+	for _, server := range v.servers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// sync the discovered servers to load balancer, and drain the removed servers, which expire later.
+func (v *discoveredServers) sync(ctx context.Context, servers map[string]*SRSServer) {
+	v.lock.Lock()
+	var removed []*SRSServer
+	for id, server := range v.servers {
+		if _, ok := servers[id]; !ok {
+			removed = append(removed, server)
+		}
+	}
+
+	var changed []*SRSServer
+	for id, server := range servers {
+		if last, ok := v.servers[id]; !ok || last.Draining != server.Draining {
+			changed = append(changed, server)
+		}
+	}
+	v.servers = servers
+	v.lock.Unlock()
+
+	for _, server := range changed {
+		logger.Df(ctx, "%v discovery update SRS media server, %+v", v.name, server)
+	}
+	for _, server := range removed {
+		server.Draining = true
+		v.update(ctx, server)
+		logger.Df(ctx, "%v discovery remove SRS media server, %+v", v.name, server)
+	}
+	v.keepalive(ctx)
+}
+
+// keepalive updates all discovered servers to load balancer.
+func (v *discoveredServers) keepalive(ctx context.Context) {
+	for _, server := range v.Servers() {
+		v.update(ctx, server)
+	}
+}
+
+// update the server to load balancer, with the configured weight, max streams, max bandwidth and drain. Only
+// the leader updates, because the discovered servers are the same for proxies.
+func (v *discoveredServers) update(ctx context.Context, server *SRSServer) {
+	if !SrsLeaderElection.IsLeader() {
+		return
+	}
+
+	weights, _ := ParseServerWeights(v.environment.ServerWeights())
+	allMaxStreams, _ := ParseServerMaxStreams(v.environment.ServerMaxStreams())
+	allMaxBandwidth, _ := ParseServerMaxBandwidth(v.environment.ServerMaxBandwidth())
+
+	// Copy the server, because the load balancer might keep the pointer.
+	s := *server
+	s.UpdatedAt = time.Now()
+	if w, ok := weights[s.ServerID]; ok {
+		s.Weight = w
+	}
+	if n, ok := allMaxStreams[s.ServerID]; ok {
+		s.MaxStreams = n
+	}
+	if n, ok := allMaxBandwidth[s.ServerID]; ok {
+		s.MaxBandwidth = n
+	}
+	s.Draining = s.Draining || SrsServerDrainer.IsDraining(&s)
+
+	if err := SrsLoadBalancer.Update(ctx, &s); err != nil {
+		logger.Wf(ctx, "%v discovery update %+v failed, %+v", v.name, &s, err)
+	}
+}
+
+// kubernetesEndpointSlice is the EndpointSlice of discovery.k8s.io/v1, only the fields used.
+type kubernetesEndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"targetRef"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// kubernetesDiscovery watches the EndpointSlices of a headless Service, and updates the ready endpoints as
+// backend servers, while the not ready, terminating and removed endpoints are drained, so the existing sessions
+// continue until the servers expire. The ports of Service are named rtmp, http, api, srt and rtc.
+type kubernetesDiscovery struct {
+	// The client to API server.
+	*kubernetesClient
+	// The namespace and name of Service.
+	namespace, service string
+	// The servers updated to load balancer.
+	*discoveredServers
+
+	// The servers of each EndpointSlice, key is the name of slice.
+	slices map[string][]*SRSServer
+	// The lock to protect slices.
+	lock stdSync.Mutex
+}
+
+// NewKubernetesDiscoveryFromEnvironment creates the discovery of the Service in environment, by the service
+// account of pod, or the API server in environment.
+func NewKubernetesDiscoveryFromEnvironment(environment env.Environment) (SRSServerDiscovery, error) {
+	v := &kubernetesDiscovery{
+		discoveredServers: newDiscoveredServers("K8s", environment), slices: make(map[string][]*SRSServer),
+	}
+
+	v.namespace, v.service = parseKubernetesName(environment.K8sService())
+	if v.service == "" || v.namespace == "" {
+		return nil, errors.Errorf("invalid k8s service %v", environment.K8sService())
+	}
+
+	var err error
+	if v.kubernetesClient, err = newKubernetesClient(environment.K8sAPI()); err != nil {
+		return nil, errors.Wrapf(err, "create k8s client")
+	}
+	return v, nil
+}
+
+func (v *kubernetesDiscovery) Run(ctx context.Context) {
+	go v.discoveredServers.Run(ctx)
+
+	for ctx.Err() == nil {
+		// The watch is closed by API server in minutes, so list and watch again immediately.
+		err := v.watch(ctx)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		logger.Wf(ctx, "K8s discovery of %v/%v failed, retry in %v, err %+v",
+			v.namespace, v.service, discoveryInterval, err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(discoveryInterval):
+		}
+	}
+}
+
+// watch lists the EndpointSlices, then watches the changes from the version of list, until the watch is
+// closed or expired by API server.
+func (v *kubernetesDiscovery) watch(ctx context.Context) error {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*kubernetesEndpointSlice `json:"items"`
+	}
+
+	resp, err := v.request(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "list endpointslices")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return errors.Wrapf(err, "decode endpointslices")
+	}
+
+	v.lock.Lock()
+	v.slices = make(map[string][]*SRSServer)
+	v.lock.Unlock()
+	for _, slice := range list.Items {
+		v.updateSlice(slice)
+	}
+	v.sync(ctx)
+
+	resp, err = v.request(ctx, url.Values{
+		"watch": {"true"}, "resourceVersion": {list.Metadata.ResourceVersion}, "allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "watch endpointslices")
+	}
+	defer resp.Body.Close()
+	logger.Df(ctx, "K8s discovery watch %v/%v from version %v", v.namespace, v.service, list.Metadata.ResourceVersion)
+
+	decoder := json.NewDecoder(resp.Body)
+	for ctx.Err() == nil {
+		var e struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "decode event")
+		}
+
+		switch e.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var slice kubernetesEndpointSlice
+			if err := json.Unmarshal(e.Object, &slice); err != nil {
+				return errors.Wrapf(err, "decode %v endpointslice", e.Type)
+			}
+			if e.Type == "DELETED" {
+				v.lock.Lock()
+				delete(v.slices, slice.Metadata.Name)
+				v.lock.Unlock()
+			} else {
+				v.updateSlice(&slice)
+			}
+			v.sync(ctx)
+		case "ERROR":
+			// Usually the version is expired, so list again.
+			return errors.Errorf("watch error %v", string(e.Object))
+		}
+	}
+	return nil
+}
+
+// request the EndpointSlices of Service from API server, with the query such as watch.
+func (v *kubernetesDiscovery) request(ctx context.Context, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("labelSelector", fmt.Sprintf("kubernetes.io/service-name=%v", v.service))
+	u := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%v/endpointslices?%v", v.namespace, query.Encode())
+
+	resp, err := v.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %v", u)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.Errorf("request %v, status=%v, body=%v", u, resp.StatusCode, string(b))
+	}
+	return resp, nil
+}
+
+// kubernetesClient is the client to Kubernetes API server, shared by the discovery and leader election.
+type kubernetesClient struct {
+	// The URL of API server.
+	api string
+	// The file of bearer token, empty for no authentication, such as by kubectl proxy.
+	tokenFile string
+	// The HTTP client to API server.
+	client *http.Client
+}
+
+// newKubernetesClient creates the client to the API server api, or the API server in cluster, with the token
+// and CA of service account, if api is empty.
+func newKubernetesClient(api string) (*kubernetesClient, error) {
+	v := &kubernetesClient{api: strings.TrimSuffix(api, "/"), client: &http.Client{}}
+	if v.api != "" {
+		return v, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.Errorf("no k8s api, not in cluster")
+	}
+	v.api, v.tokenFile = fmt.Sprintf("https://%v", net.JoinHostPort(host, port)), kubernetesTokenFile
+
+	ca, err := ioutil.ReadFile(kubernetesCAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read ca %v", kubernetesCAFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.Errorf("invalid ca %v", kubernetesCAFile)
+	}
+	v.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return v, nil
+}
+
+// do sends the request of method to path of API server, with the JSON body if not nil.
+func (v *kubernetesClient) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, v.api+path, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v", path)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// The token of service account is rotated, so read it for each request.
+	if v.tokenFile != "" {
+		token, err := ioutil.ReadFile(v.tokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read token %v", v.tokenFile)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", strings.TrimSpace(string(token))))
+	}
+
+	return v.client.Do(req)
+}
+
+// parseKubernetesName parses the name of resource, which might be namespace/name, or in the namespace of pod
+// by default.
+func parseKubernetesName(s string) (namespace, name string) {
+	if ns, name, ok := strings.Cut(s, "/"); ok {
+		return ns, name
+	}
+	if b, err := ioutil.ReadFile(kubernetesNamespaceFile); err == nil {
+		return strings.TrimSpace(string(b)), s
+	}
+	return "default", s
+}
+
+// updateSlice converts the endpoints of slice to servers, the not ready or terminating endpoints are draining.
+func (v *kubernetesDiscovery) updateSlice(slice *kubernetesEndpointSlice) {
+	ports := make(map[string][]string)
+	for _, port := range slice.Ports {
+		ports[port.Name] = []string{fmt.Sprintf("%v", port.Port)}
+	}
+
+	var servers []*SRSServer
+	for _, endpoint := range slice.Endpoints {
+		if len(endpoint.Addresses) == 0 {
+			continue
+		}
+
+		// The pod name and uid, or address if not a pod, to identify the server.
+		name, uid := endpoint.Addresses[0], endpoint.Addresses[0]
+		if endpoint.TargetRef != nil && endpoint.TargetRef.Name != "" {
+			name, uid = endpoint.TargetRef.Name, endpoint.TargetRef.UID
+		}
+
+		server := NewSRSServer(func(srs *SRSServer) {
+			srs.IP, srs.ServerID, srs.ServiceID, srs.PID = endpoint.Addresses[0], name, uid, "k8s"
+			srs.RTMP, srs.HTTP, srs.API = ports["rtmp"], ports["http"], ports["api"]
+			srs.SRT, srs.RTC = ports["srt"], ports["rtc"]
+			srs.UpdatedAt = time.Now()
+			srs.Labels = make(map[string]string)
+			if endpoint.Zone != "" {
+				srs.Labels["zone"] = endpoint.Zone
+			}
+			if endpoint.NodeName != "" {
+				srs.Labels["node"] = endpoint.NodeName
+			}
+		})
+
+		// The ready is nil for unknown, which should be ready.
+		ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+		terminating := endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating
+		server.Draining = !ready || terminating
+		servers = append(servers, server)
+	}
+
+	v.lock.Lock()
+	v.slices[slice.Metadata.Name] = servers
+	v.lock.Unlock()
+}
+
+// sync the servers of all slices to load balancer.
+func (v *kubernetesDiscovery) sync(ctx context.Context) {
+	v.lock.Lock()
+	servers := make(map[string]*SRSServer)
+	for _, slice := range v.slices {
+		for _, server := range slice {
+			servers[server.ID()] = server
+		}
+	}
+	v.lock.Unlock()
+
+	v.discoveredServers.sync(ctx, servers)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The timeout to resolve the DNS name and targets.
+const dnsResolveTimeout = 5 * time.Second
+
+// The protocols of backend server, with the network of SRV records, like _rtmp._tcp and _srt._udp.
+var dnsProtocols = []struct {
+	name, network string
+}{
+	{"rtmp", "tcp"}, {"http", "tcp"}, {"api", "tcp"}, {"srt", "udp"}, {"rtc", "udp"},
+}
+
+// dnsDiscovery resolves a DNS name in interval, and updates the resolved backend servers, for the simple
+// deployments without Redis or a registry, such as a Consul service or a headless Service. The SRV records are
+// preferred, where the target is the server and the port of each protocol is by its own SRV records, and fallback
+// to the A/AAAA records with the configured ports.
+type dnsDiscovery struct {
+	// The DNS name to resolve.
+	name string
+	// The interval to resolve.
+	interval time.Duration
+	// The ports of protocols for A/AAAA records, and the protocols without SRV records.
+	ports map[string]int
+	// The resolver of DNS.
+	resolver *net.Resolver
+	// The servers updated to load balancer.
+	*discoveredServers
+}
+
+// NewDNSDiscoveryFromEnvironment creates the discovery of the DNS name in environment.
+func NewDNSDiscoveryFromEnvironment(environment env.Environment) (SRSServerDiscovery, error) {
+	name := strings.TrimSuffix(environment.DNSName(), ".")
+	if name == "" {
+		return nil, errors.Errorf("empty dns name")
+	}
+
+	interval, err := time.ParseDuration(environment.DNSInterval())
+	if err != nil || interval <= 0 || interval >= ServerAliveDuration {
+		return nil, errors.Errorf("invalid dns interval %v", environment.DNSInterval())
+	}
+
+	ports, err := parseServerValues(environment.DNSPorts(), "dns port")
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse dns ports %v", environment.DNSPorts())
+	}
+	for protocol, port := range ports {
+		if port > 65535 {
+			return nil, errors.Errorf("invalid dns port %v=%v", protocol, port)
+		}
+	}
+	if ports["rtmp"] <= 0 {
+		return nil, errors.Errorf("no rtmp port in %v", environment.DNSPorts())
+	}
+
+	// Use the DNS server in environment, for example, the Consul agent, or the system resolver.
+	resolver := net.DefaultResolver
+	if server := environment.DNSResolver(); server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, errors.Wrapf(err, "invalid dns resolver %v", server)
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &dnsDiscovery{
+		name: name, interval: interval, ports: ports, resolver: resolver,
+		discoveredServers: newDiscoveredServers("DNS", environment),
+	}, nil
+}
+
+func (v *dnsDiscovery) Run(ctx context.Context) {
+	go v.discoveredServers.Run(ctx)
+
+	for ctx.Err() == nil {
+		// Keep the servers if failed, to not drain all servers by a temporary failure of DNS.
+		if servers, err := v.resolve(ctx); err != nil {
+			logger.Wf(ctx, "DNS discovery of %v failed, keep %v servers, err %+v", v.name, len(v.Servers()), err)
+		} else {
+			v.sync(ctx, servers)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(v.interval):
+		}
+	}
+}
+
+// resolve the servers by the SRV records of name, or the A/AAAA records if no SRV record of RTMP.
+func (v *dnsDiscovery) resolve(ctx context.Context) (map[string]*SRSServer, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsResolveTimeout)
+	defer cancel()
+
+	// The SRV records of RTMP are required, because RTMP is mandatory for server.
+	_, records, err := v.resolver.LookupSRV(ctx, "rtmp", "tcp", v.name)
+	if err != nil && !isDNSNotFound(err) {
+		return nil, errors.Wrapf(err, "lookup srv _rtmp._tcp.%v", v.name)
+	}
+	if len(records) > 0 {
+		return v.resolveSRV(ctx, records)
+	}
+
+	addrs, err := v.resolver.LookupIPAddr(ctx, v.name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lookup %v", v.name)
+	}
+
+	servers := make(map[string]*SRSServer)
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		server := v.newServer(ip, ip, nil)
+		servers[server.ID()] = server
+	}
+	return servers, nil
+}
+
+// resolveSRV resolves the SRV records of other protocols and the address of targets, where the target of SRV
+// records of RTMP is the server, and the SRV records of other targets are ignored.
+func (v *dnsDiscovery) resolveSRV(ctx context.Context, records []*net.SRV) (map[string]*SRSServer, error) {
+	// The ports of each target, key is the target, then the protocol.
+	targets := make(map[string]map[string]int)
+	rtmps := make(map[string]*net.SRV)
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		targets[target] = map[string]int{"rtmp": int(record.Port)}
+		rtmps[target] = record
+	}
+
+	for _, protocol := range dnsProtocols[1:] {
+		_, records, err := v.resolver.LookupSRV(ctx, protocol.name, protocol.network, v.name)
+		if err != nil && !isDNSNotFound(err) {
+			return nil, errors.Wrapf(err, "lookup srv _%v._%v.%v", protocol.name, protocol.network, v.name)
+		}
+		for _, record := range records {
+			if ports, ok := targets[strings.TrimSuffix(record.Target, ".")]; ok {
+				ports[protocol.name] = int(record.Port)
+			}
+		}
+	}
+
+	servers := make(map[string]*SRSServer)
+	for target, ports := range targets {
+		addrs, err := v.resolver.LookupIPAddr(ctx, target)
+		if err != nil || len(addrs) == 0 {
+			logger.Wf(ctx, "DNS discovery ignore target %v of %v, err %+v", target, v.name, err)
+			continue
+		}
+
+		// Prefer the IPv4 address, because the backend server usually listens on IPv4.
+		ip := addrs[0].IP
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				ip = addr.IP
+				break
+			}
+		}
+
+		server := v.newServer(ip.String(), target, ports)
+		if record := rtmps[target]; record.Weight > 0 {
+			server.Weight = int(record.Weight)
+		}
+		server.Labels["priority"] = fmt.Sprintf("%v", rtmps[target].Priority)
+		servers[server.ID()] = server
+	}
+	return servers, nil
+}
+
+// newServer creates the server of ip, identified by the id, with the ports of protocols overriding the
+// configured ports.
+func (v *dnsDiscovery) newServer(ip, id string, ports map[string]int) *SRSServer {
+	endpoints := make(map[string][]string)
+	for _, protocol := range dnsProtocols {
+		port, ok := ports[protocol.name]
+		if !ok {
+			port = v.ports[protocol.name]
+		}
+		if port > 0 {
+			endpoints[protocol.name] = []string{fmt.Sprintf("%v", port)}
+		}
+	}
+
+	return NewSRSServer(func(srs *SRSServer) {
+		srs.IP, srs.ServerID, srs.ServiceID, srs.PID = ip, id, ip, "dns"
+		srs.RTMP, srs.HTTP, srs.API = endpoints["rtmp"], endpoints["http"], endpoints["api"]
+		srs.SRT, srs.RTC = endpoints["srt"], endpoints["rtc"]
+		srs.UpdatedAt = time.Now()
+		srs.Labels = make(map[string]string)
+	})
+}
+
+// isDNSNotFound returns whether the err is no such record, rather than a failure of DNS.
+func isDNSNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+)
+
+// The interval to reload the draining servers from the state store, so the servers drained by other proxies
+// get no new streams from this proxy in the interval.
+const drainReloadInterval = 3 * time.Second
+
+// SRSServerDrainer marks the backend servers draining, which get no new streams from Pick, while the existing
+// sessions and picked streams continue, for example, to upgrade SRS without disruption. The draining servers
+// are persisted in the state store, so they are shared by the proxies of the same Redis, file or SQL store.
+type SRSServerDrainer interface {
+	// Drain the server by id, which is the ID of server, or the server id or device id of SRS.
+	Drain(ctx context.Context, id string) error
+	// Undrain the server by id, returns false if not draining.
+	Undrain(ctx context.Context, id string) (bool, error)
+	// IsDraining returns whether the server is draining, by the servers loaded from the state store.
+	IsDraining(server *SRSServer) bool
+	// List the ids of draining servers, sorted.
+	List() []string
+	// Run reloads the draining servers from the state store in interval, until ctx done.
+	Run(ctx context.Context)
+}
+
+type srsServerDrainerImpl struct {
+	// The state store to persist the draining servers.
+	store store.Store
+	// The ids of draining servers, loaded from store.
+	ids map[string]bool
+	// The lock to protect ids.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerDrainer creates a new drainer of backend servers, persisted in s.
+func NewSRSServerDrainer(s store.Store) SRSServerDrainer {
+	return &srsServerDrainerImpl{store: s, ids: make(map[string]bool)}
+}
+
+func (v *srsServerDrainerImpl) Drain(ctx context.Context, id string) error {
+	if err := v.store.Set(ctx, v.key(id), []byte(time.Now().Format(time.RFC3339)), 0); err != nil {
+		return errors.Wrapf(err, "save draining %v", id)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.ids[id] = true
+	return nil
+}
+
+func (v *srsServerDrainerImpl) Undrain(ctx context.Context, id string) (bool, error) {
+	_, err := v.store.Get(ctx, v.key(id))
+	if err != nil && !store.IsNotFound(err) {
+		return false, errors.Wrapf(err, "load draining %v", id)
+	}
+	if err := v.store.Delete(ctx, v.key(id)); err != nil {
+		return false, errors.Wrapf(err, "delete draining %v", id)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.ids, id)
+	return err == nil, nil
+}
+
+func (v *srsServerDrainerImpl) IsDraining(server *SRSServer) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.ids) == 0 {
+		return false
+	}
+	return v.ids[server.ID()] || (server.ServerID != "" && v.ids[server.ServerID]) ||
+		(server.DeviceID != "" && v.ids[server.DeviceID])
+}
+
+func (v *srsServerDrainerImpl) List() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	ids := make([]string, 0, len(v.ids))
+	for id := range v.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (v *srsServerDrainerImpl) Run(ctx context.Context) {
+	for {
+		if err := v.reload(ctx); err != nil {
+			logger.Wf(ctx, "Reload draining servers failed, %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(drainReloadInterval):
+		}
+	}
+}
+
+// reload the draining servers from the state store.
+func (v *srsServerDrainerImpl) reload(ctx context.Context) error {
+	prefix := v.key("")
+
+	ids := make(map[string]bool)
+	if err := v.store.Scan(ctx, prefix, func(k string, b []byte) bool {
+		ids[k[len(prefix):]] = true
+		return true
+	}); err != nil {
+		return errors.Wrapf(err, "scan %v", prefix)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.ids = ids
+	return nil
+}
+
+func (v *srsServerDrainerImpl) key(id string) string {
+	return fmt.Sprintf("srs-proxy-draining:%v", id)
+}
+
+// SrsServerDrainer is the global drainer of backend servers, persisted in memory until the state store is
+// created by bootstrap.
+var SrsServerDrainer = NewSRSServerDrainer(store.NewMemoryStore())
@@ -0,0 +1,201 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"sort"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The policies to fail back the streams from the fallback pool to the preferred pool of routing rule.
+const (
+	// The streams stay in the fallback pool, until re-picked by System API.
+	FailbackManual = "manual"
+	// The streams are re-picked and the sessions are kicked, once the preferred pool is available for hold.
+	FailbackImmediate = "immediate"
+	// The stream is re-picked when the publisher reconnects, after it stays in the fallback pool for hold.
+	FailbackOnNextPublish = "on-next-publish"
+)
+
+// SRSServerFailoverState is a stream picked from the fallback pool of routing rule, because no server of the
+// preferred pool was available.
+type SRSServerFailoverState struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The name of routing rule.
+	Rule string `json:"rule"`
+	// The preferred pool, and the fallback pool of rule.
+	Pool     string `json:"pool"`
+	Fallback string `json:"fallback"`
+	// The policy to fail back, manual, immediate or on-next-publish.
+	Failback string `json:"failback"`
+	// The time the stream failed over.
+	FailoverAt time.Time `json:"failover_at"`
+}
+
+// SRSServerFailback tracks the streams failed over to the fallback pool of routing rule on this proxy, and
+// returns them to the preferred pool by the failback policy of rule. To avoid flapping, the stream stays in
+// the fallback pool for hold at least, and for immediate policy, the preferred pool must stay available for
+// hold, which is observed by the new streams routed by the rule.
+type SRSServerFailback interface {
+	// Picked records the stream picked by rule, from the fallback pool if failover, which marks the preferred
+	// pool unavailable, or from the preferred pool, which clears the failover of stream.
+	Picked(ctx context.Context, streamURL string, rule *RoutingRule, failover bool)
+	// Publish fails back the stream before picking for publisher, by unpicking it, so it's re-picked from the
+	// preferred pool, or the fallback pool again if still unavailable.
+	Publish(ctx context.Context, streamURL string)
+	// Run fails back the streams of immediate policy, until ctx done.
+	Run(ctx context.Context)
+	// States returns the streams failed over, sorted by stream URL.
+	States() []*SRSServerFailoverState
+}
+
+type srsServerFailbackImpl struct {
+	// The duration to hold before failing back.
+	hold time.Duration
+
+	// The streams failed over, key is stream URL.
+	streams map[string]*SRSServerFailoverState
+	// The time the preferred pool becomes available, key is the name of rule, not exists if unavailable.
+	availableAt map[string]time.Time
+	// The lock to protect streams and availableAt.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerFailback creates a new failback of streams with options.
+func NewSRSServerFailback(opts ...func(*srsServerFailbackImpl)) SRSServerFailback {
+	v := &srsServerFailbackImpl{
+		hold:        60 * time.Second,
+		streams:     make(map[string]*SRSServerFailoverState),
+		availableAt: make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerFailbackFromEnvironment creates the failback by the hold in environment.
+func NewSRSServerFailbackFromEnvironment(environment env.Environment) (SRSServerFailback, error) {
+	hold, err := time.ParseDuration(environment.FailbackHold())
+	if err != nil || hold < 0 {
+		return nil, errors.Errorf("invalid hold %v", environment.FailbackHold())
+	}
+
+	return NewSRSServerFailback(func(v *srsServerFailbackImpl) {
+		v.hold = hold
+	}), nil
+}
+
+func (v *srsServerFailbackImpl) Picked(ctx context.Context, streamURL string, rule *RoutingRule, failover bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !failover {
+		if _, ok := v.availableAt[rule.Name]; !ok {
+			v.availableAt[rule.Name] = time.Now()
+		}
+		if _, ok := v.streams[streamURL]; ok {
+			delete(v.streams, streamURL)
+			logger.Df(ctx, "Failback %v to pool %v by rule %v", streamURL, rule.Pool, rule.Name)
+		}
+		return
+	}
+
+	delete(v.availableAt, rule.Name)
+	logger.Wf(ctx, "Failover %v from pool %v to %v by rule %v", streamURL, rule.Pool, rule.Fallback, rule.Name)
+
+	// The stream without affinity is picked for each client, so there is nothing to fail back.
+	if pickKey(ctx, streamURL) == "" {
+		return
+	}
+	v.streams[streamURL] = &SRSServerFailoverState{
+		StreamURL: streamURL, Rule: rule.Name, Pool: rule.Pool, Fallback: rule.Fallback,
+		Failback: rule.Failback, FailoverAt: time.Now(),
+	}
+}
+
+func (v *srsServerFailbackImpl) Publish(ctx context.Context, streamURL string) {
+	v.lock.Lock()
+	state, ok := v.streams[streamURL]
+	if !ok || state.Failback == FailbackManual || time.Since(state.FailoverAt) < v.hold {
+		v.lock.Unlock()
+		return
+	}
+	delete(v.streams, streamURL)
+	v.lock.Unlock()
+
+	logger.Df(ctx, "Failback %v by rule %v on publish, failover at %v", streamURL, state.Rule, state.FailoverAt)
+	if err := SrsLoadBalancer.Unpick(ctx, streamURL); err != nil {
+		logger.Wf(ctx, "Unpick %v failed, %v", streamURL, err)
+	}
+}
+
+func (v *srsServerFailbackImpl) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+
+		for _, state := range v.ready() {
+			if err := SrsLoadBalancer.Unpick(ctx, state.StreamURL); err != nil {
+				logger.Wf(ctx, "Unpick %v failed, %v", state.StreamURL, err)
+				continue
+			}
+
+			var kicked int
+			if KickStream != nil {
+				kicked = KickStream(ctx, state.StreamURL)
+			}
+			logger.Df(ctx, "Failback %v by rule %v immediately, failover at %v, kicked %v sessions",
+				state.StreamURL, state.Rule, state.FailoverAt, kicked)
+		}
+	}
+}
+
+// ready removes and returns the streams of immediate policy, which stay in the fallback pool for hold, while
+// the preferred pool is available for hold.
+func (v *srsServerFailbackImpl) ready() []*SRSServerFailoverState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var states []*SRSServerFailoverState
+	for streamURL, state := range v.streams {
+		if state.Failback != FailbackImmediate || time.Since(state.FailoverAt) < v.hold {
+			continue
+		}
+		if availableAt, ok := v.availableAt[state.Rule]; !ok || time.Since(availableAt) < v.hold {
+			continue
+		}
+		delete(v.streams, streamURL)
+		states = append(states, state)
+	}
+	return states
+}
+
+func (v *srsServerFailbackImpl) States() []*SRSServerFailoverState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	states := make([]*SRSServerFailoverState, 0, len(v.streams))
+	for _, state := range v.streams {
+		copied := *state
+		states = append(states, &copied)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].StreamURL < states[j].StreamURL
+	})
+	return states
+}
+
+// SrsServerFailback is the global failback of streams failed over to fallback pools.
+var SrsServerFailback = NewSRSServerFailback()
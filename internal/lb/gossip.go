@@ -0,0 +1,467 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"sync/atomic"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+)
+
+// The path of gossip in System API of proxy.
+const GossipPath = "/api/v1/proxy/gossip"
+
+// The timeout to exchange the state with a peer.
+const gossipTimeout = 3 * time.Second
+
+// The number of peers to exchange the state with, in each round.
+const gossipFanout = 3
+
+// The duration to forget a peer learned from others, if not heard from it directly.
+const gossipPeerTimeout = 30 * time.Second
+
+// The duration to keep the unpicked streams, to override the stale picked servers of peers.
+const gossipTombstoneDuration = 60 * time.Second
+
+// The header of the secret shared by proxies to gossip.
+const gossipSecretHeader = "X-SRS-Proxy-Gossip-Secret"
+
+// The key to bind the sealed state, so the state is unable to be replayed as a value of store.
+var gossipCipherKey = []byte(GossipPath)
+
+// The client to exchange with peers, which never follows the redirects, so a peer can't redirect the proxy to
+// request another URL.
+var gossipClient = &http.Client{
+	Timeout: gossipTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// gossipMessage is the state of a proxy, exchanged with peers.
+type gossipMessage struct {
+	// The id of proxy, to ignore the messages of itself.
+	Origin string `json:"origin"`
+	// The System API URL of proxy, to be learned by peers, empty if not advertised.
+	Advertise string `json:"advertise,omitempty"`
+	// The System API URLs of the peers known by proxy, to discover the peers.
+	Peers []string `json:"peers,omitempty"`
+	// The alive backend servers.
+	Servers []*SRSServer `json:"servers,omitempty"`
+	// The picked servers of streams.
+	Picks []*gossipPick `json:"picks,omitempty"`
+	// The time the streams are unpicked, key is stream URL.
+	Unpicks map[string]time.Time `json:"unpicks,omitempty"`
+}
+
+// gossipPick is the picked server of a stream.
+type gossipPick struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The ID of picked server.
+	ServerID string `json:"server_id"`
+	// The time picked, the first pick wins if picked by multiple proxies concurrently.
+	PickedAt time.Time `json:"picked_at"`
+	// The proxy which picked the server, to break the tie of first pick.
+	Origin string `json:"origin"`
+	// The time of last use, to evict the idle streams on all proxies.
+	UsedAt time.Time `json:"used_at"`
+}
+
+// GossipPeer is a peer proxy to exchange the state.
+type GossipPeer struct {
+	// The System API URL of peer.
+	URL string `json:"url"`
+	// Whether the peer is configured, which is never forgot.
+	Seed bool `json:"seed"`
+	// The time heard from the peer, zero if never.
+	HeardAt time.Time `json:"heard_at,omitempty"`
+}
+
+// Gossip exchanges the backend servers and the picked servers of streams of memory load balancer with the peer
+// proxies, so multiple proxies share the state without Redis. Each proxy pushes its full state to some random
+// peers periodically, and merges the state responded by peers, so the state converges in a few rounds, even if
+// some messages are lost. The backend server of newer heartbeat wins, and the first pick of stream wins.
+type Gossip interface {
+	// Authorize verifies the secret of request r from a peer.
+	Authorize(r *http.Request) error
+	// Exchange merges the state b received from a peer, and returns the state of this proxy.
+	Exchange(ctx context.Context, b []byte) ([]byte, error)
+	// Peers returns the peers, sorted by URL.
+	Peers() []*GossipPeer
+}
+
+type memoryGossip struct {
+	// The memory load balancer to share the state.
+	lb *MemoryLoadBalancer
+	// The id of proxy.
+	origin string
+	// The System API URL of this proxy, empty if not advertised.
+	advertise string
+	// The interval to exchange the state.
+	interval time.Duration
+	// The cipher to seal the messages, nil if not enabled.
+	cipher store.Cipher
+	// The secret shared by proxies.
+	secret string
+	// The networks of the peers learned from others.
+	allow []*net.IPNet
+
+	// The peers, key is the URL.
+	peers map[string]*GossipPeer
+	// The time the streams are unpicked, key is stream URL.
+	unpicked map[string]time.Time
+	// The lock to protect peers and unpicked.
+	lock stdSync.Mutex
+}
+
+// newMemoryGossipFromEnvironment creates the gossip of memory load balancer by the peers in environment, returns
+// nil if not enabled.
+func newMemoryGossipFromEnvironment(environment env.Environment, lb *MemoryLoadBalancer) (*memoryGossip, error) {
+	if environment.GossipPeers() == "" && environment.GossipAdvertise() == "" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(environment.GossipInterval())
+	if err != nil || interval <= 0 {
+		return nil, errors.Errorf("invalid interval %v", environment.GossipInterval())
+	}
+
+	if environment.GossipSecret() == "" {
+		return nil, errors.Errorf("no gossip secret, require PROXY_GOSSIP_SECRET to gossip")
+	}
+
+	var allow []*net.IPNet
+	for _, cidr := range strings.Split(environment.GossipAllow(), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse allow %v", cidr)
+			}
+			allow = append(allow, network)
+		}
+	}
+
+	cipher, err := store.NewCipherFromEnvironment(environment)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create cipher")
+	}
+
+	v := &memoryGossip{
+		lb: lb, origin: logger.GenerateContextID(), interval: interval, cipher: cipher,
+		secret: environment.GossipSecret(), allow: allow,
+		advertise: strings.TrimSuffix(environment.GossipAdvertise(), "/"),
+		peers:     make(map[string]*GossipPeer), unpicked: make(map[string]time.Time),
+	}
+	for _, peer := range strings.Split(environment.GossipPeers(), ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" && peer != v.advertise {
+			v.peers[peer] = &GossipPeer{URL: peer, Seed: true}
+		}
+	}
+	return v, nil
+}
+
+// Run exchanges the state with random peers in each interval, until ctx done.
+func (v *memoryGossip) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(v.interval):
+		}
+
+		var wg stdSync.WaitGroup
+		for _, peer := range v.pickPeers() {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				if err := v.push(ctx, peer); err != nil {
+					logger.Wf(ctx, "Gossip: exchange with %v failed, %v", peer, err)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+// Unpick records the stream unpicked, to override the picked server of peers.
+func (v *memoryGossip) Unpick(streamURL string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.unpicked[streamURL] = time.Now()
+}
+
+func (v *memoryGossip) Authorize(r *http.Request) error {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(gossipSecretHeader)), []byte(v.secret)) != 1 {
+		return errors.Errorf("invalid gossip secret")
+	}
+	return nil
+}
+
+func (v *memoryGossip) Exchange(ctx context.Context, b []byte) ([]byte, error) {
+	if err := v.merge(ctx, b); err != nil {
+		return nil, errors.Wrapf(err, "merge")
+	}
+	return v.marshal()
+}
+
+func (v *memoryGossip) Peers() []*GossipPeer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	peers := make([]*GossipPeer, 0, len(v.peers))
+	for _, peer := range v.peers {
+		copied := *peer
+		peers = append(peers, &copied)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].URL < peers[j].URL
+	})
+	return peers
+}
+
+// pickPeers forgets the learned peers not heard in timeout, and returns some random peers to exchange.
+func (v *memoryGossip) pickPeers() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var peers []string
+	for url, peer := range v.peers {
+		if !peer.Seed && time.Since(peer.HeardAt) > gossipPeerTimeout {
+			delete(v.peers, url)
+			continue
+		}
+		peers = append(peers, url)
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > gossipFanout {
+		peers = peers[:gossipFanout]
+	}
+	return peers
+}
+
+// push the state of this proxy to peer, and merges the state responded by peer.
+func (v *memoryGossip) push(ctx context.Context, peer string) error {
+	b, err := v.marshal()
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gossipTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+GossipPath, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "create request")
+	}
+	req.Header.Set(gossipSecretHeader, v.secret)
+
+	resp, err := gossipClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "post")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("post failed, status=%v", resp.Status)
+	}
+
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		return errors.Wrapf(err, "read")
+	}
+	return v.merge(ctx, b)
+}
+
+// marshal the state of this proxy, and seals it if cipher is enabled.
+func (v *memoryGossip) marshal() ([]byte, error) {
+	m := &gossipMessage{Origin: v.origin, Advertise: v.advertise}
+
+	v.lb.servers.Range(func(key string, server *SRSServer) bool {
+		if time.Since(server.UpdatedAt) < ServerAliveDuration {
+			m.Servers = append(m.Servers, server)
+		}
+		return true
+	})
+
+	// Only the picked servers of streams are exchanged, while the client affinity is kept by each proxy.
+	v.lb.picked.Range(func(key string, picked *memoryPickedServer) bool {
+		if key == picked.streamURL {
+			m.Picks = append(m.Picks, &gossipPick{
+				StreamURL: picked.streamURL, ServerID: picked.server.ID(), PickedAt: picked.pickedAt,
+				Origin: picked.origin, UsedAt: time.Unix(0, atomic.LoadInt64(&picked.usedAt)),
+			})
+		}
+		return true
+	})
+
+	v.lock.Lock()
+	for url := range v.peers {
+		m.Peers = append(m.Peers, url)
+	}
+	for streamURL, unpickedAt := range v.unpicked {
+		if time.Since(unpickedAt) > gossipTombstoneDuration {
+			delete(v.unpicked, streamURL)
+			continue
+		}
+		if m.Unpicks == nil {
+			m.Unpicks = make(map[string]time.Time)
+		}
+		m.Unpicks[streamURL] = unpickedAt
+	}
+	v.lock.Unlock()
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal")
+	}
+
+	if v.cipher != nil {
+		if b, err = v.cipher.Seal(gossipCipherKey, b); err != nil {
+			return nil, errors.Wrapf(err, "seal")
+		}
+	}
+	return b, nil
+}
+
+// merge the state b of peer, which is sealed if cipher is enabled.
+func (v *memoryGossip) merge(ctx context.Context, b []byte) error {
+	if v.cipher != nil {
+		var err error
+		if b, err = v.cipher.Open(gossipCipherKey, b); err != nil {
+			return errors.Wrapf(err, "open")
+		}
+	}
+
+	var m gossipMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	if m.Origin == v.origin {
+		return nil
+	}
+
+	// Learn the peers, the sender is heard directly, while the others are heard by the sender.
+	v.lock.Lock()
+	for _, url := range append(m.Peers, m.Advertise) {
+		if url == "" || url == v.advertise {
+			continue
+		}
+		peer, ok := v.peers[url]
+		if !ok {
+			if !v.allowed(url) {
+				logger.Wf(ctx, "Gossip: ignore peer %v from %v, not allowed", url, m.Origin)
+				continue
+			}
+			peer = &GossipPeer{URL: url, HeardAt: time.Now()}
+			v.peers[url] = peer
+			logger.Df(ctx, "Gossip: learn peer %v from %v", url, m.Origin)
+		}
+		if url == m.Advertise {
+			peer.HeardAt = time.Now()
+		}
+	}
+
+	// The unpicked streams override the picked servers before them.
+	for streamURL, unpickedAt := range m.Unpicks {
+		if last, ok := v.unpicked[streamURL]; !ok || unpickedAt.After(last) {
+			v.unpicked[streamURL] = unpickedAt
+		}
+		if picked, ok := v.lb.picked.Load(streamURL); ok && !picked.pickedAt.After(unpickedAt) {
+			v.lb.picked.Delete(streamURL)
+		}
+	}
+	unpicked := make(map[string]time.Time, len(v.unpicked))
+	for streamURL, unpickedAt := range v.unpicked {
+		unpicked[streamURL] = unpickedAt
+	}
+	v.lock.Unlock()
+
+	// The server of newer heartbeat wins.
+	for _, server := range m.Servers {
+		if local, ok := v.lb.servers.Load(server.ID()); !ok || server.UpdatedAt.After(local.UpdatedAt) {
+			v.lb.servers.Store(server.ID(), server)
+		}
+	}
+
+	for _, pick := range m.Picks {
+		if unpickedAt, ok := unpicked[pick.StreamURL]; ok && !pick.PickedAt.After(unpickedAt) {
+			continue
+		}
+		if v.lb.pickedTTL > 0 && time.Since(pick.UsedAt) >= v.lb.pickedTTL {
+			continue
+		}
+		server, ok := v.lb.servers.Load(pick.ServerID)
+		if !ok {
+			continue
+		}
+
+		// The same server is picked, only update the time of last use.
+		local, ok := v.lb.picked.Load(pick.StreamURL)
+		if ok && local.server.ID() == pick.ServerID {
+			if pick.UsedAt.UnixNano() > atomic.LoadInt64(&local.usedAt) {
+				atomic.StoreInt64(&local.usedAt, pick.UsedAt.UnixNano())
+			}
+			continue
+		}
+
+		// The first pick wins, if picked by multiple proxies concurrently.
+		if ok && (local.pickedAt.Before(pick.PickedAt) ||
+			(local.pickedAt.Equal(pick.PickedAt) && local.origin <= pick.Origin)) {
+			continue
+		}
+		if ok {
+			logger.Wf(ctx, "Gossip: stream %v picked %v by %v, override %v", pick.StreamURL, pick.ServerID,
+				pick.Origin, local.server.ID())
+		}
+
+		picked := &memoryPickedServer{
+			server: server, streamURL: pick.StreamURL, pickedAt: pick.PickedAt, origin: pick.Origin,
+			usedAt: pick.UsedAt.UnixNano(),
+		}
+		v.lb.picked.Store(pick.StreamURL, picked)
+	}
+	return nil
+}
+
+// allowed returns whether the peer learned from others is allowed, which must be a HTTP or HTTPS URL without
+// path, and the host is an IP in the allowed networks, not a hostname which resolves to anywhere.
+func (v *memoryGossip) allowed(peer string) bool {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Path != "" || u.RawQuery != "" {
+		return false
+	}
+
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		return false
+	}
+	for _, network := range v.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SrsGossip is the global gossip of memory load balancer, nil if not enabled.
+var SrsGossip Gossip
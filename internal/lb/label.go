@@ -0,0 +1,211 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"srsx/internal/errors"
+)
+
+// The operators of label requirement, the same as Kubernetes.
+const (
+	labelOperatorEquals       = "="
+	labelOperatorNotEquals    = "!="
+	labelOperatorIn           = "in"
+	labelOperatorNotIn        = "notin"
+	labelOperatorExists       = "exists"
+	labelOperatorDoesNotExist = "!"
+)
+
+// labelRequirement is a requirement of label selector, like region=us-east or tier in (premium,gold).
+type labelRequirement struct {
+	// The key of label.
+	key string
+	// The operator, such as =, !=, in, notin, exists or !.
+	operator string
+	// The values of label, empty for exists and !.
+	values []string
+}
+
+// matches returns whether the labels match the requirement. Like Kubernetes, the != and notin are also
+// matched if the label does not exist.
+func (v *labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[v.key]
+	switch v.operator {
+	case labelOperatorExists:
+		return ok
+	case labelOperatorDoesNotExist:
+		return !ok
+	case labelOperatorEquals, labelOperatorIn:
+		return ok && containsString(v.values, value)
+	case labelOperatorNotEquals, labelOperatorNotIn:
+		return !ok || !containsString(v.values, value)
+	}
+	return false
+}
+
+// LabelSelector selects the backend servers by labels, in the expression of Kubernetes label selector,
+// like region=us-east,tier in (premium,gold),!canary, and all requirements must be matched.
+type LabelSelector struct {
+	// The expression of selector.
+	expression string
+	// The parsed requirements.
+	requirements []*labelRequirement
+}
+
+// ParseLabelSelector parses the expression of label selector, the requirements are separated by comma:
+//
+//	key=value, key==value, key!=value, key in (v1,v2), key notin (v1,v2), key, !key
+//
+// Returns nil if the expression is empty.
+func ParseLabelSelector(expression string) (*LabelSelector, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+
+	// Split the requirements by the comma, which is not in the parentheses.
+	var items []string
+	var depth, start int
+	for i, c := range expression {
+		switch c {
+		case '(':
+			if depth++; depth > 1 {
+				return nil, errors.Errorf("nested parentheses in %v", expression)
+			}
+		case ')':
+			if depth--; depth < 0 {
+				return nil, errors.Errorf("unbalanced parentheses in %v", expression)
+			}
+		case ',':
+			if depth == 0 {
+				items, start = append(items, expression[start:i]), i+1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("unbalanced parentheses in %v", expression)
+	}
+	items = append(items, expression[start:])
+
+	v := &LabelSelector{expression: expression}
+	for _, item := range items {
+		requirement, err := parseLabelRequirement(strings.TrimSpace(item))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %v", expression)
+		}
+		v.requirements = append(v.requirements, requirement)
+	}
+	return v, nil
+}
+
+// parseLabelRequirement parses a requirement, like region=us-east or tier in (premium,gold).
+func parseLabelRequirement(item string) (*labelRequirement, error) {
+	if item == "" {
+		return nil, errors.Errorf("empty requirement")
+	}
+
+	// The set based requirement, like tier in (premium,gold).
+	if index := strings.Index(item, "("); index >= 0 {
+		if !strings.HasSuffix(item, ")") {
+			return nil, errors.Errorf("invalid requirement %v", item)
+		}
+
+		fields := strings.Fields(item[:index])
+		if len(fields) != 2 || (fields[1] != labelOperatorIn && fields[1] != labelOperatorNotIn) {
+			return nil, errors.Errorf("invalid requirement %v", item)
+		}
+
+		var values []string
+		for _, value := range strings.Split(item[index+1:len(item)-1], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return nil, errors.Errorf("empty values of %v", item)
+		}
+		return newLabelRequirement(fields[0], fields[1], values)
+	}
+
+	// The equality based requirement, like region=us-east, region==us-east or region!=us-east.
+	for _, operator := range []string{"!=", "==", "="} {
+		if index := strings.Index(item, operator); index >= 0 {
+			key, value := strings.TrimSpace(item[:index]), strings.TrimSpace(item[index+len(operator):])
+			if operator == "==" {
+				operator = labelOperatorEquals
+			}
+			return newLabelRequirement(key, operator, []string{value})
+		}
+	}
+
+	// The existence requirement, like canary or !canary.
+	if strings.HasPrefix(item, "!") {
+		return newLabelRequirement(strings.TrimSpace(item[1:]), labelOperatorDoesNotExist, nil)
+	}
+	return newLabelRequirement(item, labelOperatorExists, nil)
+}
+
+func newLabelRequirement(key, operator string, values []string) (*labelRequirement, error) {
+	if key == "" || strings.ContainsAny(key, " \t!=(),") {
+		return nil, errors.Errorf("invalid key %v", key)
+	}
+	for _, value := range values {
+		if strings.ContainsAny(value, " \t!=(),") {
+			return nil, errors.Errorf("invalid value %v of %v", value, key)
+		}
+	}
+	return &labelRequirement{key: key, operator: operator, values: values}, nil
+}
+
+// Matches returns whether the labels match all requirements.
+func (v *LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range v.requirements {
+		if !requirement.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *LabelSelector) String() string {
+	return v.expression
+}
+
+// serverSelectorKey is the context key of label selector.
+type serverSelectorKey struct{}
+
+// WithServerSelector returns a context to select the server matched the selector for new stream, for
+// example, the selector specified by client.
+func WithServerSelector(ctx context.Context, selector *LabelSelector) context.Context {
+	return context.WithValue(ctx, serverSelectorKey{}, selector)
+}
+
+// formatLabels formats the labels in the order of keys, like region=us-east,tier=premium.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, fmt.Sprintf("%v=%v", key, labels[key]))
+	}
+	return strings.Join(items, ",")
+}
+
+// containsString returns whether value is in values.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	stdSync "sync"
+	"time"
+)
+
+// The weight of the latest sample in the moving average of latency.
+const latencyAlpha = 0.3
+
+// The latency of server without sample in this duration is stale, and regarded as unknown, so the server
+// regarded as slow gets the chance to be measured again.
+const latencyStaleDuration = 5 * time.Minute
+
+// The min latency of server, to bound the weight of the very fast server, such as on the same host.
+const latencyMin = time.Millisecond
+
+// SRSServerLatency tracks the moving average of latency of backend servers, which is the duration to dial
+// and get the first response, such as the RTMP play or publish response, or the HTTP response header.
+type SRSServerLatency interface {
+	// Observe the latency of server.
+	Observe(server *SRSServer, latency time.Duration)
+	// Latency returns the moving average of latency of server, 0 if unknown or stale.
+	Latency(server *SRSServer) time.Duration
+	// Latencies returns the moving average of latency in milliseconds of servers, key is the server ID.
+	Latencies() map[string]float64
+}
+
+// serverLatency is the latency of a server.
+type serverLatency struct {
+	// The moving average of latency.
+	latency time.Duration
+	// The time of last sample.
+	updatedAt time.Time
+}
+
+type srsServerLatencyImpl struct {
+	// The latency of servers, key is the server ID.
+	servers map[string]*serverLatency
+	// The lock to protect servers.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerLatency creates the latency tracker of backend servers.
+func NewSRSServerLatency() SRSServerLatency {
+	return &srsServerLatencyImpl{servers: make(map[string]*serverLatency)}
+}
+
+func (v *srsServerLatencyImpl) Observe(server *SRSServer, latency time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	current, ok := v.servers[server.ID()]
+	if !ok || now.Sub(current.updatedAt) > latencyStaleDuration {
+		v.servers[server.ID()] = &serverLatency{latency: latency, updatedAt: now}
+		return
+	}
+
+	current.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(current.latency))
+	current.updatedAt = now
+}
+
+func (v *srsServerLatencyImpl) Latency(server *SRSServer) time.Duration {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	current, ok := v.servers[server.ID()]
+	if !ok || time.Since(current.updatedAt) > latencyStaleDuration {
+		return 0
+	}
+	return current.latency
+}
+
+func (v *srsServerLatencyImpl) Latencies() map[string]float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	latencies := make(map[string]float64)
+	for id, current := range v.servers {
+		if time.Since(current.updatedAt) > latencyStaleDuration {
+			delete(v.servers, id)
+			continue
+		}
+		latencies[id] = float64(current.latency) / float64(time.Millisecond)
+	}
+	return latencies
+}
+
+// SrsServerLatency is the global latency tracker of backend servers.
+var SrsServerLatency = NewSRSServerLatency()
@@ -6,8 +6,12 @@ package lb
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/utils"
 )
 
 // If server heartbeat in this duration, it's alive.
@@ -25,6 +29,18 @@ type SRSServer struct {
 	IP string `json:"ip,omitempty"`
 	// The server device ID, configured by user.
 	DeviceID string `json:"device_id,omitempty"`
+	// The group of server, configured by user, to route streams to the group by policy.
+	Group string `json:"group,omitempty"`
+	// The labels of server, configured by user, like region=us-east, to select servers by label selector.
+	Labels map[string]string `json:"labels,omitempty"`
+	// The weight of server for weighted-random strategy, default to 1, and 0 to pick no new stream.
+	Weight int `json:"weight"`
+	// The max number of streams of server, 0 for unlimited.
+	MaxStreams int `json:"max_streams,omitempty"`
+	// The max bandwidth in Mbps of server, 0 for unlimited.
+	MaxBandwidth int `json:"max_bandwidth,omitempty"`
+	// The number of streams of server, reported by heartbeat, optional.
+	Streams int `json:"streams,omitempty"`
 	// The server id of SRS, store in file, may not change, mandatory.
 	ServerID string `json:"server_id,omitempty"`
 	// The service id of SRS, always change when restarted, mandatory.
@@ -43,9 +59,19 @@ type SRSServer struct {
 	RTC []string `json:"rtc,omitempty"`
 	// Last update time.
 	UpdatedAt time.Time `json:"update_at,omitempty"`
+	// The error of probing the endpoints when registering, empty if ok or not probed.
+	ProbeError string `json:"probe_error,omitempty"`
+	// Whether the server is draining, which gets no new stream while the existing sessions continue.
+	Draining bool `json:"draining,omitempty"`
+	// The id of registration token, empty if registered without token.
+	RegistrationID string `json:"registration_id,omitempty"`
 }
 
 func (v *SRSServer) ID() string {
+	// The server registered by token is stable, not changed when restarted with new service id and pid.
+	if v.RegistrationID != "" {
+		return fmt.Sprintf("%v-%v", v.ServerID, v.RegistrationID)
+	}
 	return fmt.Sprintf("%v-%v-%v", v.ServerID, v.ServiceID, v.PID)
 }
 
@@ -62,6 +88,24 @@ func (v *SRSServer) Format(f fmt.State, c rune) {
 			if v.DeviceID != "" {
 				sb.WriteString(fmt.Sprintf(", device=%v", v.DeviceID))
 			}
+			if v.Group != "" {
+				sb.WriteString(fmt.Sprintf(", group=%v", v.Group))
+			}
+			if len(v.Labels) > 0 {
+				sb.WriteString(fmt.Sprintf(", labels=[%v]", formatLabels(v.Labels)))
+			}
+			if v.Weight != 1 {
+				sb.WriteString(fmt.Sprintf(", weight=%v", v.Weight))
+			}
+			if v.MaxStreams > 0 {
+				sb.WriteString(fmt.Sprintf(", streams=%v/%v", v.Streams, v.MaxStreams))
+			}
+			if v.MaxBandwidth > 0 {
+				sb.WriteString(fmt.Sprintf(", bandwidth=%vMbps", v.MaxBandwidth))
+			}
+			if v.Draining {
+				sb.WriteString(", draining")
+			}
 			if len(v.RTMP) > 0 {
 				sb.WriteString(fmt.Sprintf(", rtmp=[%v]", strings.Join(v.RTMP, ",")))
 			}
@@ -88,13 +132,72 @@ func (v *SRSServer) Format(f fmt.State, c rune) {
 }
 
 func NewSRSServer(opts ...func(*SRSServer)) *SRSServer {
-	v := &SRSServer{}
+	v := &SRSServer{Weight: 1}
 	for _, opt := range opts {
 		opt(v)
 	}
 	return v
 }
 
+// ValidateEndpoints validates the endpoints of server in strict mode, tcp for RTMP, HTTP and API, and udp for
+// SRT and RTC, to reject the misconfigured server when registering, instead of failing to proxy.
+func (v *SRSServer) ValidateEndpoints() error {
+	for _, group := range []struct {
+		name, network string
+		endpoints     []string
+	}{
+		{"rtmp", "tcp", v.RTMP}, {"http", "tcp", v.HTTP}, {"api", "tcp", v.API},
+		{"srt", "udp", v.SRT}, {"rtc", "udp", v.RTC},
+	} {
+		for _, endpoint := range group.endpoints {
+			if _, err := utils.ParseListenEndpointStrict(endpoint, group.network); err != nil {
+				return errors.Wrapf(err, "%v endpoint", group.name)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseServerWeights parses the configured weights of servers, like server1=3,origin2=1, where the key is
+// the server id or device id of SRS.
+func ParseServerWeights(s string) (map[string]int, error) {
+	return parseServerValues(s, "weight")
+}
+
+// ParseServerMaxStreams parses the configured max streams of servers, like server1=100,origin2=50, where the
+// key is the server id or device id of SRS.
+func ParseServerMaxStreams(s string) (map[string]int, error) {
+	return parseServerValues(s, "max streams")
+}
+
+// ParseServerMaxBandwidth parses the configured max bandwidth in Mbps of servers, like server1=1000,origin2=400,
+// where the key is the server id or device id of SRS.
+func ParseServerMaxBandwidth(s string) (map[string]int, error) {
+	return parseServerValues(s, "max bandwidth")
+}
+
+// parseServerValues parses the non-negative values of servers, like server1=3,origin2=1.
+func parseServerValues(s, name string) (map[string]int, error) {
+	values := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid %v %v", name, item)
+		}
+
+		value, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid %v %v", name, item)
+		}
+		values[strings.TrimSpace(kv[0])] = value
+	}
+	return values, nil
+}
+
 // HLSPlayStream is the interface for HLS streaming sessions.
 type HLSPlayStream interface {
 	// GetSPBHID returns the SRS Proxy Backend HLS ID.
@@ -103,20 +206,77 @@ type HLSPlayStream interface {
 	Initialize(ctx context.Context) HLSPlayStream
 }
 
+// HLSPlayStreamDTO is the concrete data of HLS streaming, which is persisted in the shared store such
+// as Redis, so the HLS streaming is resolvable on any proxy, for example, the TS request is routed to a
+// different proxy from the m3u8 request.
+type HLSPlayStreamDTO struct {
+	// The spbhid, used to identify the backend server.
+	SPBHID string `json:"spbhid"`
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The full request URL for HLS streaming
+	FullURL string `json:"full_url"`
+}
+
+// NewHLSPlayStreamFromDTO creates the HLS streaming from the persisted data, which is set by the
+// protocol package because the concrete type is defined there.
+var NewHLSPlayStreamFromDTO func(dto *HLSPlayStreamDTO) HLSPlayStream
+
+// IsStreamActive returns whether the stream has active client sessions, to avoid evicting the picked
+// server of a long-running stream, which is set by bootstrap because the sessions are managed by the
+// session package. The stream is regarded as inactive if not set.
+var IsStreamActive func(streamURL string) bool
+
+// KickStream disconnects the client sessions of stream on this proxy, returns the number of kicked sessions,
+// to re-route the clients to the re-picked server, which is set by bootstrap because the sessions are managed
+// by the session package. Nothing is kicked if not set.
+var KickStream func(ctx context.Context, streamURL string) int
+
 // RTCConnection is the interface for WebRTC streaming connections.
 type RTCConnection interface {
 	// GetUfrag returns the ICE username fragment.
 	GetUfrag() string
 }
 
+// RTCConnectionDTO is the concrete data of WebRTC streaming, which is persisted in the shared store such as
+// Redis, so the WHIP or WHEP session is resumable on any proxy, for example, the proxy died and the client
+// retries the signaling or the ICE binding against another proxy.
+type RTCConnectionDTO struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The ufrag, the ICE username, in local:remote format.
+	Ufrag string `json:"ufrag"`
+	// The role of client, publisher for WHIP or viewer for WHEP.
+	Role string `json:"role"`
+	// The backend server picked by WHIP or WHEP.
+	Backend *SRSServer `json:"backend,omitempty"`
+	// The resource URL of session, the Location responded by backend, to delete or update the session.
+	Location string `json:"location,omitempty"`
+	// The annotations of session, set by the external authorization service.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The labels of session, like user id, plan or region, set by the auth hooks.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NewRTCConnectionFromDTO creates the WebRTC streaming from the persisted data, which is set by the
+// protocol package because the concrete type is defined there.
+var NewRTCConnectionFromDTO func(dto *RTCConnectionDTO) RTCConnection
+
 // SRSLoadBalancer is the interface to load balance the SRS servers.
 type SRSLoadBalancer interface {
 	// Initialize the load balancer.
 	Initialize(ctx context.Context) error
 	// Update the backend server.
 	Update(ctx context.Context, server *SRSServer) error
-	// Pick a backend server for the specified stream URL.
-	Pick(ctx context.Context, streamURL string) (*SRSServer, error)
+	// PickForPublish picks a backend server for the publisher of the specified stream URL, by the strategy
+	// and affinity of publishers, for example, pinned to one origin.
+	PickForPublish(ctx context.Context, streamURL string) (*SRSServer, error)
+	// PickForPlay picks a backend server for the player of the specified stream URL, by the strategy and
+	// affinity of players, for example, spread across edges.
+	PickForPlay(ctx context.Context, streamURL string) (*SRSServer, error)
+	// Unpick clears the picked server for the specified stream URL, and the client in ctx if known, so it's
+	// re-picked next time.
+	Unpick(ctx context.Context, streamURL string) error
 	// Load or store the HLS streaming for the specified stream URL.
 	LoadOrStoreHLS(ctx context.Context, streamURL string, value HLSPlayStream) (HLSPlayStream, error)
 	// Load the HLS streaming by SPBHID, the SRS Proxy Backend HLS ID.
@@ -125,7 +285,21 @@ type SRSLoadBalancer interface {
 	StoreWebRTC(ctx context.Context, streamURL string, value RTCConnection) error
 	// Load the WebRTC streaming by ufrag, the ICE username.
 	LoadWebRTCByUfrag(ctx context.Context, ufrag string) (RTCConnection, error)
+	// Stats returns the number of entries of each state, such as servers and picked streams, which
+	// should be bounded, and used to detect the leak of state.
+	Stats(ctx context.Context) (map[string]int, error)
+	// Close the connections owned by the load balancer, such as the Redis client, while the state store is
+	// closed by its owner.
+	Close() error
 }
 
+// ErrNoServerAvailable is the cause of Pick error when no backend server is available for the stream,
+// use errors.Cause to check it.
+var ErrNoServerAvailable = errors.New("no server available")
+
+// ErrClusterFull is the cause of Pick error when all backend servers for the stream reach their max streams,
+// use errors.Cause to check it.
+var ErrClusterFull = errors.New("cluster full")
+
 // SrsLoadBalancer is the global SRS load balancer instance.
 var SrsLoadBalancer SRSLoadBalancer
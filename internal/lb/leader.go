@@ -0,0 +1,447 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	stdSync "sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+)
+
+// The types of leader election.
+const (
+	LeaderElectionNone  = "none"
+	LeaderElectionRedis = "redis"
+	LeaderElectionK8s   = "k8s"
+)
+
+// The timeout to resign the leadership when quit.
+const leaderResignTimeout = 3 * time.Second
+
+// The format of MicroTime in Kubernetes, for the time of Lease.
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// redisLeaderRenew renews the lock in KEYS[1] for ARGV[2] milliseconds, if held by ARGV[1]. Returns 1 if
+// renewed, 0 if held by others.
+var redisLeaderRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisLeaderResign deletes the lock in KEYS[1], if held by ARGV[1].
+var redisLeaderResign = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// LeaderState is the state of leader election of this proxy.
+type LeaderState struct {
+	// The type of election, none, redis or k8s.
+	Type string `json:"type"`
+	// The identity of this proxy.
+	Identity string `json:"identity"`
+	// The identity of leader, empty if unknown.
+	Leader string `json:"leader"`
+	// Whether this proxy is the leader.
+	IsLeader bool `json:"is_leader"`
+	// The time this proxy renewed the lease, zero if not leader.
+	RenewedAt time.Time `json:"renewed_at,omitempty"`
+}
+
+// LeaderElection elects a leader of proxies, so the tasks of cluster, such as the keepalive of default and
+// discovered backends, run once per cluster by the leader, instead of each proxy doing the duplicated work.
+// The leader holds a lease, and renews it in a third of lease, so a new leader is elected after the leader
+// dies for lease. The leader steps down if failed to renew before the lease expires, so there is at most one
+// leader, if the clocks of proxies are synchronized.
+type LeaderElection interface {
+	// Run to campaign for and renew the leadership until ctx done, then resign.
+	Run(ctx context.Context)
+	// IsLeader indicates whether this proxy is the leader, always true if election is disabled.
+	IsLeader() bool
+	// State returns the state of election.
+	State() *LeaderState
+}
+
+// leaderCampaigner acquires the lease for a leader election, by a Redis lock or a Kubernetes Lease.
+type leaderCampaigner interface {
+	// campaign acquires the lease for identity, or renews it if held by identity, returns the leader.
+	campaign(ctx context.Context, identity string, lease time.Duration) (string, error)
+	// resign releases the lease if held by identity.
+	resign(ctx context.Context, identity string) error
+}
+
+type leaderElectionImpl struct {
+	// The type of election.
+	typ string
+	// The identity of this proxy.
+	identity string
+	// The duration of lease.
+	lease time.Duration
+	// The campaigner to acquire the lease, nil if election is disabled.
+	campaigner leaderCampaigner
+
+	// The identity of leader.
+	leader string
+	// The time this proxy renewed the lease.
+	renewedAt time.Time
+	// The lock to protect leader and renewedAt.
+	lock stdSync.Mutex
+}
+
+// NewLeaderElection creates a disabled election, where this proxy is always the leader.
+func NewLeaderElection() LeaderElection {
+	identity := leaderIdentity()
+	return &leaderElectionImpl{typ: LeaderElectionNone, identity: identity, leader: identity}
+}
+
+// NewLeaderElectionFromEnvironment creates the election by the type and lease in environment.
+func NewLeaderElectionFromEnvironment(environment env.Environment) (LeaderElection, error) {
+	if environment.LeaderElection() == "" {
+		return NewLeaderElection(), nil
+	}
+
+	lease, err := time.ParseDuration(environment.LeaderLease())
+	if err != nil || lease < time.Second {
+		return nil, errors.Errorf("invalid lease %v", environment.LeaderLease())
+	}
+
+	v := &leaderElectionImpl{typ: environment.LeaderElection(), identity: leaderIdentity(), lease: lease}
+	switch v.typ {
+	case LeaderElectionRedis:
+		rdb, err := store.NewRedisClient(environment)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create redis client")
+		}
+		key := fmt.Sprintf("%vsrs-proxy-leader", environment.RedisKeyPrefix())
+		v.campaigner = &redisLeaderCampaigner{rdb: rdb, key: key}
+	case LeaderElectionK8s:
+		namespace, name := parseKubernetesName(environment.LeaderK8sLease())
+		if namespace == "" || name == "" {
+			return nil, errors.Errorf("invalid k8s lease %v", environment.LeaderK8sLease())
+		}
+		client, err := newKubernetesClient(environment.K8sAPI())
+		if err != nil {
+			return nil, errors.Wrapf(err, "create k8s client")
+		}
+		v.campaigner = &kubernetesLeaderCampaigner{kubernetesClient: client, namespace: namespace, name: name}
+	default:
+		return nil, errors.Errorf("invalid leader election %v", v.typ)
+	}
+	return v, nil
+}
+
+// leaderIdentity returns the identity of proxy, the hostname which is the pod name in Kubernetes, with a
+// random id to identify the restarted proxy.
+func leaderIdentity() string {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "proxy"
+	}
+	return fmt.Sprintf("%v-%v", hostname, logger.GenerateContextID())
+}
+
+func (v *leaderElectionImpl) Run(ctx context.Context) {
+	if v.campaigner == nil {
+		return
+	}
+
+	for {
+		v.campaign(ctx)
+
+		select {
+		case <-ctx.Done():
+			v.resign(ctx)
+			return
+		case <-time.After(v.lease / 3):
+		}
+	}
+}
+
+func (v *leaderElectionImpl) IsLeader() bool {
+	if v.campaigner == nil {
+		return true
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.isLeader()
+}
+
+func (v *leaderElectionImpl) State() *LeaderState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	state := &LeaderState{Type: v.typ, Identity: v.identity, Leader: v.leader, IsLeader: true}
+	if v.campaigner != nil {
+		state.IsLeader, state.RenewedAt = v.isLeader(), v.renewedAt
+	}
+	return state
+}
+
+// isLeader indicates whether this proxy holds the lease, which is not expired.
+func (v *leaderElectionImpl) isLeader() bool {
+	return v.leader == v.identity && time.Since(v.renewedAt) < v.lease
+}
+
+// campaign for the leadership, and updates the state.
+func (v *leaderElectionImpl) campaign(ctx context.Context) {
+	// Start the clock before request, so the lease expires before that of the lock or Lease.
+	starttime := time.Now()
+	leader, err := v.campaigner.campaign(ctx, v.identity, v.lease)
+	if err != nil && ctx.Err() == nil {
+		logger.Wf(ctx, "LeaderElection: %v campaign failed, err %+v", v.typ, err)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	wasLeader := v.isLeader()
+	if err == nil {
+		v.leader = leader
+		if leader == v.identity {
+			v.renewedAt = starttime
+		}
+	}
+
+	if isLeader := v.isLeader(); isLeader && !wasLeader {
+		logger.Df(ctx, "LeaderElection: %v elected as leader by %v, lease=%v", v.identity, v.typ, v.lease)
+	} else if !isLeader && wasLeader {
+		logger.Wf(ctx, "LeaderElection: %v lost leadership to %v by %v", v.identity, v.leader, v.typ)
+	}
+}
+
+// resign the leadership when quit, so a new leader is elected immediately.
+func (v *leaderElectionImpl) resign(ctx context.Context) {
+	v.lock.Lock()
+	isLeader := v.isLeader()
+	v.leader, v.renewedAt = "", time.Time{}
+	v.lock.Unlock()
+
+	if !isLeader {
+		return
+	}
+
+	// Resign by a new context, because ctx is done.
+	resignCtx, cancel := context.WithTimeout(logger.WithContext(context.Background()), leaderResignTimeout)
+	defer cancel()
+	if err := v.campaigner.resign(resignCtx, v.identity); err != nil {
+		logger.Wf(ctx, "LeaderElection: %v resign failed, err %+v", v.identity, err)
+		return
+	}
+	logger.Df(ctx, "LeaderElection: %v resigned by %v", v.identity, v.typ)
+}
+
+// redisLeaderCampaigner acquires the lease by a lock in Redis, which expires after lease.
+type redisLeaderCampaigner struct {
+	// The redis client sdk.
+	rdb *redis.Client
+	// The key of lock.
+	key string
+}
+
+func (v *redisLeaderCampaigner) campaign(ctx context.Context, identity string, lease time.Duration) (string, error) {
+	renewed, err := redisLeaderRenew.Run(ctx, v.rdb, []string{v.key}, identity, lease.Milliseconds()).Int()
+	if err != nil {
+		return "", errors.Wrapf(err, "renew key=%v", v.key)
+	}
+	if renewed == 1 {
+		return identity, nil
+	}
+
+	if ok, err := v.rdb.SetNX(ctx, v.key, identity, lease).Result(); err != nil {
+		return "", errors.Wrapf(err, "acquire key=%v", v.key)
+	} else if ok {
+		return identity, nil
+	}
+
+	leader, err := v.rdb.Get(ctx, v.key).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "get key=%v", v.key)
+	}
+	return leader, nil
+}
+
+func (v *redisLeaderCampaigner) resign(ctx context.Context, identity string) error {
+	if err := redisLeaderResign.Run(ctx, v.rdb, []string{v.key}, identity).Err(); err != nil {
+		return errors.Wrapf(err, "resign key=%v", v.key)
+	}
+	return nil
+}
+
+// kubernetesLease is the Lease of coordination.k8s.io/v1, only the fields used.
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       *string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *string `json:"acquireTime,omitempty"`
+		RenewTime            *string `json:"renewTime,omitempty"`
+		LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// kubernetesLeaderCampaigner acquires the lease by a Lease of Kubernetes, which is updated by the resource
+// version, so only one proxy acquires it if updated concurrently. The proxy requires the permissions to get,
+// create and update the Lease.
+type kubernetesLeaderCampaigner struct {
+	// The client to API server.
+	*kubernetesClient
+	// The namespace and name of Lease.
+	namespace, name string
+}
+
+func (v *kubernetesLeaderCampaigner) campaign(ctx context.Context, identity string, lease time.Duration) (string, error) {
+	current, err := v.get(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "get lease")
+	}
+
+	now := time.Now()
+	if current == nil {
+		current = &kubernetesLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		current.Metadata.Name, current.Metadata.Namespace = v.name, v.namespace
+	}
+
+	// The lease is held by others, and not expired.
+	holder, transitions := "", 0
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if current.Spec.LeaseTransitions != nil {
+		transitions = *current.Spec.LeaseTransitions
+	}
+	if holder != "" && holder != identity && !v.expired(current, now) {
+		return holder, nil
+	}
+
+	// Acquire or renew the lease.
+	seconds, renewTime := int((lease+time.Second-1)/time.Second), now.UTC().Format(kubernetesMicroTime)
+	current.Spec.HolderIdentity, current.Spec.LeaseDurationSeconds = &identity, &seconds
+	current.Spec.RenewTime = &renewTime
+	if holder != identity {
+		transitions++
+		current.Spec.AcquireTime, current.Spec.LeaseTransitions = &renewTime, &transitions
+	}
+
+	if ok, err := v.put(ctx, current); err != nil {
+		return "", errors.Wrapf(err, "update lease")
+	} else if !ok {
+		// Updated by others concurrently, the leader is unknown until next campaign.
+		return "", nil
+	}
+	return identity, nil
+}
+
+func (v *kubernetesLeaderCampaigner) resign(ctx context.Context, identity string) error {
+	current, err := v.get(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "get lease")
+	}
+	if current == nil || current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != identity {
+		return nil
+	}
+
+	// Release the lease by the empty holder, like client-go.
+	holder, seconds, renewTime := "", 1, time.Now().UTC().Format(kubernetesMicroTime)
+	current.Spec.HolderIdentity, current.Spec.LeaseDurationSeconds = &holder, &seconds
+	current.Spec.RenewTime = &renewTime
+	if _, err := v.put(ctx, current); err != nil {
+		return errors.Wrapf(err, "update lease")
+	}
+	return nil
+}
+
+// expired indicates whether the lease is expired at now.
+func (v *kubernetesLeaderCampaigner) expired(lease *kubernetesLease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	renewTime, err := time.Parse(kubernetesMicroTime, *lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// get the Lease, returns nil if not exists.
+func (v *kubernetesLeaderCampaigner) get(ctx context.Context) (*kubernetesLease, error) {
+	u := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases/%v", v.namespace, v.name)
+	resp, err := v.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %v", u)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", u)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request %v, status=%v, body=%v", u, resp.StatusCode, string(b))
+	}
+
+	var lease kubernetesLease
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return &lease, nil
+}
+
+// put creates the Lease if no resource version, or updates it, returns false if conflict with others.
+func (v *kubernetesLeaderCampaigner) put(ctx context.Context, lease *kubernetesLease) (bool, error) {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return false, errors.Wrapf(err, "marshal %v", lease)
+	}
+
+	method, u := http.MethodPut, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases/%v", v.namespace, v.name)
+	if lease.Metadata.ResourceVersion == "" {
+		method, u = http.MethodPost, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases", v.namespace)
+	}
+
+	resp, err := v.do(ctx, method, u, bytes.NewReader(b))
+	if err != nil {
+		return false, errors.Wrapf(err, "request %v", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return false, errors.Errorf("request %v, status=%v, body=%v", u, resp.StatusCode, string(b))
+	}
+	return true, nil
+}
+
+// SrsLeaderElection is the global leader election, the proxy is always the leader if disabled.
+var SrsLeaderElection LeaderElection = NewLeaderElection()
@@ -0,0 +1,350 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// The timeout to query the HTTP API of backend server.
+const loadQueryTimeout = 3 * time.Second
+
+// The min interval to query the streams of backend server, which is longer than the summaries, because the
+// streams API responses all streams in pages.
+const loadStreamsInterval = 30 * time.Second
+
+// The number of streams in each page of streams API, and the max pages to query.
+const (
+	loadStreamsPageSize = 100
+	loadStreamsMaxPages = 100
+)
+
+// SRSServerLoad is the load of backend server, queried from the HTTP API of SRS.
+type SRSServerLoad struct {
+	// The CPU usage of system in percent.
+	CPU float64 `json:"cpu"`
+	// The memory usage of system in percent.
+	Memory float64 `json:"memory"`
+	// The number of connections of SRS.
+	Connections int `json:"connections"`
+	// The number of streams of SRS, queried in a longer interval than the others.
+	Streams int `json:"streams"`
+	// The time of last query of streams.
+	StreamsUpdatedAt time.Time `json:"streams_update_at"`
+	// Whether the server is overloaded, which gets no new stream.
+	Overloaded bool `json:"overloaded"`
+	// The error of last query, empty if ok.
+	Error string `json:"error,omitempty"`
+	// The time of last query.
+	UpdatedAt time.Time `json:"update_at"`
+}
+
+// SRSServerLoadMonitor queries the load of backend servers periodically, for load-aware strategy and max
+// streams of servers. The servers are watched when selecting, and unwatched if not selected for a while.
+type SRSServerLoadMonitor interface {
+	// Run the monitor, blocks until ctx is cancelled.
+	Run(ctx context.Context)
+	// Watch the servers to query the load.
+	Watch(servers []*SRSServer)
+	// Load returns the load of server, nil if not queried yet.
+	Load(server *SRSServer) *SRSServerLoad
+	// Loads returns the loads of all watched servers, key is the server ID.
+	Loads() map[string]*SRSServerLoad
+}
+
+// watchedServer is a server watched by monitor.
+type watchedServer struct {
+	// The server to query.
+	server *SRSServer
+	// The load of server, nil if not queried yet.
+	load *SRSServerLoad
+	// The time watched, to unwatch the servers not selected for a while.
+	watchedAt time.Time
+}
+
+type srsServerLoadMonitorImpl struct {
+	// The interval to query the load.
+	interval time.Duration
+	// The max CPU usage in percent, overloaded if exceeded.
+	maxCPU float64
+	// The max memory usage in percent, overloaded if exceeded.
+	maxMemory float64
+	// The max number of streams, overloaded if exceeded, zero for unlimited.
+	maxStreams int
+
+	// The watched servers, key is the server ID.
+	servers map[string]*watchedServer
+	// The lock to protect servers.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerLoadMonitor creates a monitor by options.
+func NewSRSServerLoadMonitor(opts ...func(*srsServerLoadMonitorImpl)) SRSServerLoadMonitor {
+	v := &srsServerLoadMonitorImpl{
+		interval: 5 * time.Second, maxCPU: 80, maxMemory: 90, servers: make(map[string]*watchedServer),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerLoadMonitorFromEnvironment creates the monitor by the interval and thresholds in environment.
+func NewSRSServerLoadMonitorFromEnvironment(environment env.Environment) (SRSServerLoadMonitor, error) {
+	interval, err := time.ParseDuration(environment.LoadInterval())
+	if err != nil || interval <= 0 {
+		return nil, errors.Errorf("invalid interval %v", environment.LoadInterval())
+	}
+	maxCPU, err := strconv.ParseFloat(environment.LoadMaxCPU(), 64)
+	if err != nil || maxCPU <= 0 {
+		return nil, errors.Errorf("invalid max cpu %v", environment.LoadMaxCPU())
+	}
+	maxMemory, err := strconv.ParseFloat(environment.LoadMaxMemory(), 64)
+	if err != nil || maxMemory <= 0 {
+		return nil, errors.Errorf("invalid max memory %v", environment.LoadMaxMemory())
+	}
+	maxStreams, err := strconv.Atoi(environment.LoadMaxStreams())
+	if err != nil || maxStreams < 0 {
+		return nil, errors.Errorf("invalid max streams %v", environment.LoadMaxStreams())
+	}
+
+	return NewSRSServerLoadMonitor(func(v *srsServerLoadMonitorImpl) {
+		v.interval, v.maxCPU, v.maxMemory, v.maxStreams = interval, maxCPU, maxMemory, maxStreams
+	}), nil
+}
+
+func (v *srsServerLoadMonitorImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Unwatch the servers not selected for a while, which are usually dead.
+		var servers []*watchedServer
+		v.lock.Lock()
+		for id, s := range v.servers {
+			if time.Since(s.watchedAt) > ServerAliveDuration {
+				delete(v.servers, id)
+			} else {
+				servers = append(servers, s)
+			}
+		}
+		v.lock.Unlock()
+
+		var wg stdSync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *watchedServer) {
+				defer wg.Done()
+
+				v.lock.Lock()
+				last := s.load
+				v.lock.Unlock()
+
+				load := v.query(ctx, s.server, last)
+
+				v.lock.Lock()
+				s.load = load
+				v.lock.Unlock()
+
+				// Log when the state changes, to avoid flooding the logs.
+				wasOverloaded := last != nil && last.Overloaded
+				if load.Error != "" {
+					logger.Wf(ctx, "Query load of %v failed, %v", s.server, load.Error)
+				} else if load.Overloaded && !wasOverloaded {
+					logger.Wf(ctx, "Server %v overloaded, cpu=%.1f%%, memory=%.1f%%, streams=%v",
+						s.server, load.CPU, load.Memory, load.Streams)
+				} else if !load.Overloaded && wasOverloaded {
+					logger.Df(ctx, "Server %v recovered, cpu=%.1f%%, memory=%.1f%%, streams=%v",
+						s.server, load.CPU, load.Memory, load.Streams)
+				}
+			}(s)
+		}
+		wg.Wait()
+	}
+}
+
+func (v *srsServerLoadMonitorImpl) Watch(servers []*SRSServer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	for _, server := range servers {
+		if s, ok := v.servers[server.ID()]; ok {
+			s.server, s.watchedAt = server, now
+		} else {
+			v.servers[server.ID()] = &watchedServer{server: server, watchedAt: now}
+		}
+	}
+}
+
+func (v *srsServerLoadMonitorImpl) Load(server *SRSServer) *SRSServerLoad {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if s, ok := v.servers[server.ID()]; ok {
+		return s.load
+	}
+	return nil
+}
+
+func (v *srsServerLoadMonitorImpl) Loads() map[string]*SRSServerLoad {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	loads := make(map[string]*SRSServerLoad)
+	for id, s := range v.servers {
+		if s.load != nil {
+			loads[id] = s.load
+		}
+	}
+	return loads
+}
+
+// query the load of server by the HTTP API of SRS, the error is set in load. The streams of last load are
+// reused if queried in the streams interval.
+func (v *srsServerLoadMonitorImpl) query(ctx context.Context, server *SRSServer, last *SRSServerLoad) *SRSServerLoad {
+	load := &SRSServerLoad{UpdatedAt: time.Now()}
+	if last != nil && last.Error == "" && time.Since(last.StreamsUpdatedAt) < v.streamsInterval() {
+		load.Streams, load.StreamsUpdatedAt = last.Streams, last.StreamsUpdatedAt
+	}
+
+	if err := v.queryAPI(ctx, server, load); err != nil {
+		load.Error = err.Error()
+		return load
+	}
+
+	load.Overloaded = load.CPU > v.maxCPU || load.Memory > v.maxMemory ||
+		(v.maxStreams > 0 && load.Streams > v.maxStreams)
+	return load
+}
+
+func (v *srsServerLoadMonitorImpl) queryAPI(ctx context.Context, server *SRSServer, load *SRSServerLoad) error {
+	if len(server.API) == 0 {
+		return errors.Errorf("no api server")
+	}
+
+	_, ip, port, err := utils.ParseListenEndpoint(server.API[0])
+	if err != nil {
+		return errors.Wrapf(err, "parse endpoint %v", server.API[0])
+	}
+
+	host := server.IP
+	if ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	}
+	addr := net.JoinHostPort(host, fmt.Sprintf("%v", port))
+
+	// See https://ossrs.io/lts/en-us/docs/v6/doc/http-api#summaries
+	var summaries struct {
+		Data struct {
+			System struct {
+				CPUPercent    float64 `json:"cpu_percent"`
+				MemRAMPercent float64 `json:"mem_ram_percent"`
+				ConnSRS       int     `json:"conn_srs"`
+			} `json:"system"`
+		} `json:"data"`
+	}
+	if err := queryJSON(ctx, fmt.Sprintf("%v://%v/api/v1/summaries", SrsServerTLS.Scheme(BackendProtocolAPI), addr), &summaries); err != nil {
+		return errors.Wrapf(err, "query summaries")
+	}
+
+	// The CPU and memory of SRS is ratio in [0, 1].
+	load.CPU = summaries.Data.System.CPUPercent * 100
+	load.Memory = summaries.Data.System.MemRAMPercent * 100
+	load.Connections = summaries.Data.System.ConnSRS
+
+	// Query the streams in the streams interval, which are not in the summaries.
+	if !load.StreamsUpdatedAt.IsZero() {
+		return nil
+	}
+
+	streams, err := queryStreams(ctx, fmt.Sprintf("%v://%v", SrsServerTLS.Scheme(BackendProtocolAPI), addr))
+	if err != nil {
+		return errors.Wrapf(err, "query streams")
+	}
+	load.Streams, load.StreamsUpdatedAt = streams, time.Now()
+	return nil
+}
+
+// streamsInterval returns the interval to query the streams, at least the interval of load.
+func (v *srsServerLoadMonitorImpl) streamsInterval() time.Duration {
+	if v.interval > loadStreamsInterval {
+		return v.interval
+	}
+	return loadStreamsInterval
+}
+
+// queryStreams returns the number of streams of server at api, by the pages of streams API, and stops at the
+// max pages.
+func queryStreams(ctx context.Context, api string) (int, error) {
+	var total int
+	for page := 0; page < loadStreamsMaxPages; page++ {
+		// See https://ossrs.io/lts/en-us/docs/v6/doc/http-api#streams
+		var streams struct {
+			Streams []json.RawMessage `json:"streams"`
+		}
+		url := fmt.Sprintf("%v/api/v1/streams/?start=%v&count=%v", api, page*loadStreamsPageSize, loadStreamsPageSize)
+		if err := queryJSON(ctx, url, &streams); err != nil {
+			return 0, errors.Wrapf(err, "query page %v", page)
+		}
+
+		total += len(streams.Streams)
+		if len(streams.Streams) < loadStreamsPageSize {
+			break
+		}
+	}
+	return total, nil
+}
+
+// queryJSON requests the api, and unmarshals the JSON response to v.
+func queryJSON(ctx context.Context, api string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, loadQueryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", api)
+	}
+
+	resp, err := SrsServerTLS.HTTPClient().Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", api)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request %v failed, status=%v, body=%v", api, resp.Status, string(b))
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return nil
+}
+
+// SrsServerLoadMonitor is the global monitor of backend server loads.
+var SrsServerLoadMonitor = NewSRSServerLoadMonitor()
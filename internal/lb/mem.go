@@ -5,8 +5,7 @@ package lb
 
 import (
 	"context"
-	"fmt"
-	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"srsx/internal/env"
@@ -15,14 +14,42 @@ import (
 	"srsx/internal/sync"
 )
 
+// memoryPickedServer is the picked server of a stream, with the time of last use for eviction.
+type memoryPickedServer struct {
+	// The picked server.
+	server *SRSServer
+	// The stream URL, while the key of picked server may be the stream URL and client IP.
+	streamURL string
+	// The time of last use in unix nanoseconds, accessed atomically.
+	usedAt int64
+	// The time picked, and the proxy which picked it, for gossip.
+	pickedAt time.Time
+	origin   string
+}
+
+// touch updates the time of last use.
+func (v *memoryPickedServer) touch() {
+	atomic.StoreInt64(&v.usedAt, time.Now().UnixNano())
+}
+
+// idle returns the duration since last use.
+func (v *memoryPickedServer) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&v.usedAt)))
+}
+
 // MemoryLoadBalancer stores state in memory.
 type MemoryLoadBalancer struct {
 	// The environment interface.
 	environment env.Environment
+	// The strategies to select server for new stream, of publishers and players.
+	publishStrategy, playStrategy SRSServerStrategy
 	// All available SRS servers, key is server ID.
 	servers sync.Map[string, *SRSServer]
-	// The picked server to service client by specified stream URL, key is stream url.
-	picked sync.Map[string, *SRSServer]
+	// The picked server to service client by specified stream URL, key is stream url, or stream url and
+	// client IP by affinity.
+	picked sync.Map[string, *memoryPickedServer]
+	// The TTL of picked server since last use, zero to never evict.
+	pickedTTL time.Duration
 	// The HLS streaming, key is stream URL.
 	hlsStreamURL sync.Map[string, HLSPlayStream]
 	// The HLS streaming, key is SPBHID.
@@ -31,6 +58,8 @@ type MemoryLoadBalancer struct {
 	rtcStreamURL sync.Map[string, RTCConnection]
 	// The WebRTC streaming, key is ufrag.
 	rtcUfrag sync.Map[string, RTCConnection]
+	// The gossip to share the servers and picked streams with peer proxies, nil if not enabled.
+	gossip *memoryGossip
 }
 
 // NewMemoryLoadBalancer creates a new memory-based load balancer.
@@ -41,6 +70,29 @@ func NewMemoryLoadBalancer(environment env.Environment) SRSLoadBalancer {
 }
 
 func (v *MemoryLoadBalancer) Initialize(ctx context.Context) error {
+	var err error
+	if v.publishStrategy, v.playStrategy, err = newPickStrategies(v.environment); err != nil {
+		return errors.Wrapf(err, "create strategies")
+	}
+
+	// Evict the picked server of the stream, after the stream goes idle.
+	if v.pickedTTL, err = time.ParseDuration(v.environment.PickedTTL()); err != nil || v.pickedTTL < 0 {
+		return errors.Errorf("invalid picked ttl %v", v.environment.PickedTTL())
+	}
+	if v.pickedTTL > 0 {
+		go v.reapPicked(ctx)
+	}
+
+	// Share the state with peer proxies by gossip, for HA without Redis.
+	if v.gossip, err = newMemoryGossipFromEnvironment(v.environment, v); err != nil {
+		return errors.Wrapf(err, "create gossip")
+	} else if v.gossip != nil {
+		SrsGossip = v.gossip
+		go v.gossip.Run(ctx)
+		logger.Df(ctx, "MemoryLB: gossip with peers %v, advertise=%v, interval=%v",
+			len(v.gossip.Peers()), v.gossip.advertise, v.gossip.interval)
+	}
+
 	server, err := NewDefaultSRSForDebugging(v.environment)
 	if err != nil {
 		return errors.Wrapf(err, "initialize default SRS")
@@ -74,10 +126,23 @@ func (v *MemoryLoadBalancer) Update(ctx context.Context, server *SRSServer) erro
 	return nil
 }
 
-func (v *MemoryLoadBalancer) Pick(ctx context.Context, streamURL string) (*SRSServer, error) {
-	// Always proxy to the same server for the same stream URL.
-	if server, ok := v.picked.Load(streamURL); ok {
-		return server, nil
+func (v *MemoryLoadBalancer) PickForPublish(ctx context.Context, streamURL string) (*SRSServer, error) {
+	ctx = withAffinity(ctx, SrsPickAffinity.Publish)
+	SrsServerFailback.Publish(ctx, streamURL)
+	return v.pick(ctx, v.publishStrategy, streamURL)
+}
+
+func (v *MemoryLoadBalancer) PickForPlay(ctx context.Context, streamURL string) (*SRSServer, error) {
+	return v.pick(withAffinity(ctx, SrsPickAffinity.Play), v.playStrategy, streamURL)
+}
+
+// pick a backend server for streamURL by strategy, and the affinity in ctx.
+func (v *MemoryLoadBalancer) pick(ctx context.Context, strategy SRSServerStrategy, streamURL string) (*SRSServer, error) {
+	// Always proxy to the same server for the same stream URL, or client by affinity.
+	key := pickKey(ctx, streamURL)
+	if picked, ok := v.picked.Load(key); key != "" && ok {
+		picked.touch()
+		return picked.server, nil
 	}
 
 	// Gather all servers that were alive within the last few seconds.
@@ -99,16 +164,80 @@ func (v *MemoryLoadBalancer) Pick(ctx context.Context, streamURL string) (*SRSSe
 
 	// No server found, failed.
 	if len(servers) == 0 {
-		return nil, fmt.Errorf("no server available for %v", streamURL)
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v", streamURL)
 	}
 
-	// Pick a server randomly from servers. Use global rand which is thread-safe since Go 1.20.
-	// For older Go versions, this is still safe as we're only reading from the servers slice.
-	server := servers[rand.Intn(len(servers))]
-	v.picked.Store(streamURL, server)
+	// Select a server from servers by strategy, in the group routed by policy if specified.
+	server, err := selectServer(ctx, strategy, streamURL, servers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "select server for %v", streamURL)
+	}
+	if key != "" {
+		picked := &memoryPickedServer{server: server, streamURL: streamURL, pickedAt: time.Now()}
+		if v.gossip != nil {
+			picked.origin = v.gossip.origin
+		}
+		picked.touch()
+		v.picked.Store(key, picked)
+	}
 	return server, nil
 }
 
+// reapPicked evicts the picked servers idle for TTL periodically, except the streams with active
+// sessions, such as a long-running HTTP-FLV stream, which never picks again.
+func (v *MemoryLoadBalancer) reapPicked(ctx context.Context) {
+	interval := v.pickedTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var evicted int
+		v.picked.Range(func(key string, picked *memoryPickedServer) bool {
+			if picked.idle() < v.pickedTTL {
+				return true
+			}
+
+			// Keep the stream with active sessions, and touch it to check again after TTL. The key of client
+			// affinity is evicted, which is picked again when the client reconnects.
+			if key == picked.streamURL && IsStreamActive != nil && IsStreamActive(picked.streamURL) {
+				picked.touch()
+				return true
+			}
+
+			v.picked.Delete(key)
+			evicted++
+			return true
+		})
+
+		if evicted > 0 {
+			logger.Df(ctx, "MemoryLB: Evict %v idle picked streams, ttl=%v, remaining=%v",
+				evicted, v.pickedTTL, v.picked.Len())
+		}
+	}
+}
+
+func (v *MemoryLoadBalancer) Unpick(ctx context.Context, streamURL string) error {
+	for _, key := range unpickKeys(ctx, streamURL) {
+		v.picked.Delete(key)
+	}
+
+	// Notify the peers to drop the picked server, so the stream is re-picked on all proxies.
+	if v.gossip != nil {
+		v.gossip.Unpick(streamURL)
+	}
+	return nil
+}
+
 func (v *MemoryLoadBalancer) LoadHLSBySPBHID(ctx context.Context, spbhid string) (HLSPlayStream, error) {
 	// Load the HLS streaming for the SPBHID, for TS files.
 	if actual, ok := v.hlsSPBHID.Load(spbhid); !ok {
@@ -147,3 +276,18 @@ func (v *MemoryLoadBalancer) LoadWebRTCByUfrag(ctx context.Context, ufrag string
 		return actual, nil
 	}
 }
+
+func (v *MemoryLoadBalancer) Stats(ctx context.Context) (map[string]int, error) {
+	return map[string]int{
+		"servers": v.servers.Len(),
+		"picked":  v.picked.Len(),
+		"hls":     v.hlsStreamURL.Len(),
+		"spbhid":  v.hlsSPBHID.Len(),
+		"rtc":     v.rtcStreamURL.Len(),
+		"ufrag":   v.rtcUfrag.Len(),
+	}, nil
+}
+
+func (v *MemoryLoadBalancer) Close() error {
+	return nil
+}
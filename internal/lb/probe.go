@@ -0,0 +1,235 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/rtmp"
+	"srsx/internal/sync"
+	"srsx/internal/utils"
+)
+
+// The timeout to probe each endpoint of backend server.
+const probeTimeout = 3 * time.Second
+
+// SRSServerProber verifies the advertised endpoints of backend server actually speak the expected
+// protocol, to prevent the traffic blackholes from typo'd ports.
+type SRSServerProber interface {
+	// Probe returns the result of server, and done is false if not probed yet, then the server is probed in
+	// background, so the registration never waits for the probing. The result is cached by the server ID and
+	// endpoints, so the heartbeat of server gets the result, and does not probe it again.
+	Probe(ctx context.Context, server *SRSServer) (done bool, err error)
+}
+
+type srsServerProberImpl struct {
+	// The cached probe results, key is the server ID and endpoints.
+	results sync.Map[string, *probeResult]
+	// The servers being probed, key is the server ID and endpoints.
+	probing sync.Map[string, bool]
+}
+
+// probeResult is the cached result of probe.
+type probeResult struct {
+	// The error of probe, nil if ok.
+	err error
+	// The time to expire the result.
+	expireAt time.Time
+}
+
+// NewSRSServerProber creates a new prober for backend servers.
+func NewSRSServerProber() SRSServerProber {
+	return &srsServerProberImpl{}
+}
+
+func (v *srsServerProberImpl) Probe(ctx context.Context, server *SRSServer) (bool, error) {
+	key := fmt.Sprintf("%v rtmp=%v http=%v api=%v srt=%v rtc=%v", server.ID(),
+		server.RTMP, server.HTTP, server.API, server.SRT, server.RTC)
+	if result, ok := v.results.Load(key); ok && time.Now().Before(result.expireAt) {
+		return true, result.err
+	}
+
+	// Probe the server once, for the heartbeats during probing.
+	if _, loaded := v.probing.LoadOrStore(key, true); loaded {
+		return false, nil
+	}
+
+	// Remove the expired results, because the service id of server changes when restarted.
+	v.results.Range(func(k string, result *probeResult) bool {
+		if time.Now().After(result.expireAt) {
+			v.results.Delete(k)
+		}
+		return true
+	})
+
+	// The probe is not canceled with the request of registration.
+	go func() {
+		defer v.probing.Delete(key)
+
+		err := v.probe(ctx, server)
+		v.results.Store(key, &probeResult{err: err, expireAt: time.Now().Add(ServerAliveDuration)})
+		if err != nil {
+			logger.Wf(ctx, "Probe SRS media server %v failed, err %+v", server, err)
+		} else {
+			logger.Df(ctx, "Probe SRS media server %v ok", server)
+		}
+	}()
+	return false, nil
+}
+
+func (v *srsServerProberImpl) probe(ctx context.Context, server *SRSServer) error {
+	for _, endpoint := range server.RTMP {
+		if err := probeEndpoint(server.IP, endpoint, probeRTMP); err != nil {
+			return errors.Wrapf(err, "probe rtmp %v", endpoint)
+		}
+	}
+	for _, endpoint := range server.HTTP {
+		if err := probeEndpoint(server.IP, endpoint, probeHTTP); err != nil {
+			return errors.Wrapf(err, "probe http %v", endpoint)
+		}
+	}
+	for _, endpoint := range server.API {
+		if err := probeEndpoint(server.IP, endpoint, probeAPI); err != nil {
+			return errors.Wrapf(err, "probe api %v", endpoint)
+		}
+	}
+	for _, endpoint := range server.RTC {
+		if err := probeEndpoint(server.IP, endpoint, probeSTUN); err != nil {
+			return errors.Wrapf(err, "probe rtc %v", endpoint)
+		}
+	}
+	for _, endpoint := range server.SRT {
+		if err := probeEndpoint(server.IP, endpoint, probeUDP); err != nil {
+			return errors.Wrapf(err, "probe srt %v", endpoint)
+		}
+	}
+	return nil
+}
+
+// probeEndpoint parses the endpoint, and probes the address by fn. The IP of endpoint is used if
+// specified, otherwise the IP of server.
+func probeEndpoint(serverIP, endpoint string, fn func(addr string) error) error {
+	_, ip, port, err := utils.ParseListenEndpoint(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "parse endpoint %v", endpoint)
+	}
+
+	host := serverIP
+	if ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	}
+	return fn(net.JoinHostPort(host, fmt.Sprintf("%v", port)))
+}
+
+// probeRTMP does the RTMP simple handshake, expects the S0 with RTMP version 3.
+func probeRTMP(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return errors.Wrapf(err, "dial %v", addr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if conn, err = SrsServerTLS.Client(ctx, BackendProtocolRTMP, conn); err != nil {
+		return errors.Wrapf(err, "tls %v", addr)
+	}
+
+	hs := rtmp.NewHandshake()
+	if err := hs.WriteC0S0(conn); err != nil {
+		return errors.Wrapf(err, "write c0")
+	}
+	if err := hs.WriteC1S1(conn); err != nil {
+		return errors.Wrapf(err, "write c1")
+	}
+
+	s0, err := hs.ReadC0S0(conn)
+	if err != nil {
+		return errors.Wrapf(err, "read s0")
+	}
+	if len(s0) == 0 || s0[0] != 3 {
+		return errors.Errorf("invalid s0 %v, not rtmp", s0)
+	}
+	return nil
+}
+
+// probeHTTP requests the HTTP server, expects any HTTP response.
+func probeHTTP(addr string) error {
+	client := http.Client{Timeout: probeTimeout, Transport: SrsServerTLS.HTTPClient().Transport}
+	resp, err := client.Get(fmt.Sprintf("%v://%v/", SrsServerTLS.Scheme(BackendProtocolHTTP), addr))
+	if err != nil {
+		return errors.Wrapf(err, "request %v", addr)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// probeAPI requests the /api/v1/versions of SRS, expects a JSON response.
+func probeAPI(addr string) error {
+	client := http.Client{Timeout: probeTimeout, Transport: SrsServerTLS.HTTPClient().Transport}
+	api := fmt.Sprintf("%v://%v/api/v1/versions", SrsServerTLS.Scheme(BackendProtocolAPI), addr)
+	resp, err := client.Get(api)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", api)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		return errors.Errorf("request %v failed, status=%v, body=%v", api, resp.Status, string(b))
+	}
+	return nil
+}
+
+// probeSTUN sends a STUN binding request, see probeUDP.
+func probeSTUN(addr string) error {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, 0x0001)
+	binary.BigEndian.PutUint32(b[4:], 0x2112A442)
+	_, _ = rand.Read(b[8:20])
+	return probeUDPWith(addr, b)
+}
+
+// probeUDP sends an empty packet, see probeUDPWith.
+func probeUDP(addr string) error {
+	return probeUDPWith(addr, []byte{0})
+}
+
+// probeUDPWith sends the packet b to addr, and fails if the port is unreachable. Because the UDP server,
+// such as SRS WebRTC server, may ignore the packet without valid session, no response is treated as ok.
+func probeUDPWith(addr string, b []byte) error {
+	conn, err := net.DialTimeout("udp", addr, probeTimeout)
+	if err != nil {
+		return errors.Wrapf(err, "dial %v", addr)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(b); err != nil {
+		return errors.Wrapf(err, "write %v", addr)
+	}
+
+	// The connected UDP socket gets the ICMP port unreachable, as connection refused error.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1500)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return errors.Wrapf(err, "read %v", addr)
+	}
+	return nil
+}
@@ -7,8 +7,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
-	"strconv"
+	stdSync "sync"
+	"sync/atomic"
 	"time"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -17,49 +17,164 @@ import (
 	"srsx/internal/env"
 	"srsx/internal/errors"
 	"srsx/internal/logger"
+	"srsx/internal/store"
+	"srsx/internal/sync"
 )
 
+// The duration to cache the servers in memory for Redis LB, to reduce the requests to Redis.
+const RedisCacheDuration = 30 * time.Second
+
+// The duration to cache the alive servers in memory for Redis LB, which is short because the load of servers
+// changes quickly, but avoids querying the index of servers for each new stream at high connection rates.
+const RedisPickCacheDuration = 3 * time.Second
+
+// The max number of stream affinity cached in memory for Redis LB, the new streams are not cached when full,
+// and always query Redis, so a proxy with lots of streams never exhausts the memory.
+const RedisCacheMaxURLs = 100000
+
+// The types of messages in the pub/sub channel of Redis LB, to invalidate the cache of other proxies.
+const (
+	// The server changed, such as draining or the endpoints changed, the key is the server key.
+	redisMessageServer = "server"
+	// The stream unpicked to re-pick a server, the key is the stream URL or the key of affinity.
+	redisMessageUnpick = "unpick"
+)
+
+// redisMessage is the message in the pub/sub channel, to invalidate the cache of other proxies immediately,
+// instead of waiting for the cache to expire.
+type redisMessage struct {
+	// The type of message, server or unpick.
+	Type string `json:"type"`
+	// The key to invalidate.
+	Key string `json:"key"`
+	// The proxy which publishes the message, to ignore the messages of itself.
+	Origin string `json:"origin"`
+}
+
+// redisCachedServer is the server cached in memory, which expires after RedisCacheDuration.
+type redisCachedServer struct {
+	// The server object.
+	server *SRSServer
+	// The time to expire the cache.
+	expireAt time.Time
+}
+
+// redisCachedURL is the stream affinity cached in memory, which expires after RedisCacheDuration, so the stream
+// re-picked by other proxies is reloaded from Redis, even when the message to invalidate it is lost.
+type redisCachedURL struct {
+	// The server key in Redis.
+	serverKey string
+	// The time to expire the cache.
+	expireAt time.Time
+}
+
+// redisCachedAlive is the alive servers cached in memory, which expires after RedisPickCacheDuration.
+type redisCachedAlive struct {
+	// The alive servers.
+	servers []*SRSServer
+	// The key in Redis of each server.
+	keys map[*SRSServer]string
+	// The time to expire the cache.
+	expireAt time.Time
+}
+
 // RedisLoadBalancer stores state in Redis.
 type RedisLoadBalancer struct {
 	// The environment interface.
 	environment env.Environment
+	// The strategies to select server for new stream, of publishers and players.
+	publishStrategy, playStrategy SRSServerStrategy
 	// The redis client sdk.
 	rdb *redis.Client
+	// The subscription of the pub/sub channel, to invalidate the cache.
+	pubsub *redis.PubSub
+	// The cipher to encrypt values, nil if not enabled.
+	cipher store.Cipher
+	// The cached servers, key is the server key in Redis.
+	cacheServers sync.Map[string, *redisCachedServer]
+	// The cached stream affinity, key is stream URL, at most RedisCacheMaxURLs entries.
+	cacheURLs sync.Map[string, *redisCachedURL]
+	// The number of entries in cacheURLs, updated atomically.
+	nnCacheURLs int64
+	// The last time to remove the expired entries in cacheURLs, in Unix nanoseconds, updated atomically.
+	sweepURLsAt int64
+	// The cached alive servers, nil if not cached, protected by aliveLock.
+	cacheAlive *redisCachedAlive
+	aliveLock  stdSync.Mutex
+	// The id of proxy, the origin of messages in pub/sub channel.
+	origin string
 }
 
+// redisServersHeartbeat adds the server ARGV[1] to the index KEYS[1] scored by the Unix time of Redis, and removes
+// the servers without heartbeat in ARGV[2] seconds, so the proxies with skewed clocks agree on the alive servers.
+var redisServersHeartbeat = redis.NewScript(`
+redis.replicate_commands()
+local now = tonumber(redis.call('TIME')[1])
+redis.call('ZADD', KEYS[1], now, ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. (now - tonumber(ARGV[2])))
+return now
+`)
+
+// redisServersAlive returns the servers in the index KEYS[1] with heartbeat in ARGV[1] seconds, by the Unix time
+// of Redis.
+var redisServersAlive = redis.NewScript(`
+local now = tonumber(redis.call('TIME')[1])
+return redis.call('ZRANGEBYSCORE', KEYS[1], now - tonumber(ARGV[1]), '+inf')
+`)
+
 // NewRedisLoadBalancer creates a new Redis-based load balancer.
 func NewRedisLoadBalancer(environment env.Environment) SRSLoadBalancer {
 	return &RedisLoadBalancer{
-		environment: environment,
+		environment: environment, origin: logger.GenerateContextID(),
 	}
 }
 
 func (v *RedisLoadBalancer) Initialize(ctx context.Context) error {
-	redisDatabase, err := strconv.Atoi(v.environment.RedisDB())
+	rdb, err := store.NewRedisClient(v.environment)
 	if err != nil {
-		return errors.Wrapf(err, "invalid PROXY_REDIS_DB %v", v.environment.RedisDB())
+		return errors.Wrapf(err, "create redis client")
 	}
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%v:%v", v.environment.RedisHost(), v.environment.RedisPort()),
-		Password: v.environment.RedisPassword(),
-		DB:       redisDatabase,
-	})
 	v.rdb = rdb
 
+	if v.publishStrategy, v.playStrategy, err = newPickStrategies(v.environment); err != nil {
+		return errors.Wrapf(err, "create strategies")
+	}
+
+	if v.cipher, err = store.NewCipherFromEnvironment(v.environment); err != nil {
+		return errors.Wrapf(err, "create cipher")
+	} else if v.cipher != nil {
+		logger.Df(ctx, "RedisLB: encrypt values by AES-GCM")
+	}
+
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		return errors.Wrapf(err, "unable to connect to redis %v", rdb.String())
 	}
 	logger.Df(ctx, "RedisLB: connected to redis %v ok", rdb.String())
 
+	if err := v.preload(ctx); err != nil {
+		return errors.Wrapf(err, "preload cache")
+	}
+
+	// Subscribe before serving, to not miss the invalidations by other proxies.
+	pubsub := rdb.Subscribe(ctx, v.redisKeyEvents())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return errors.Wrapf(err, "subscribe %v", v.redisKeyEvents())
+	}
+	v.pubsub = pubsub
+	go v.subscribe(ctx, pubsub)
+
 	server, err := NewDefaultSRSForDebugging(v.environment)
 	if err != nil {
 		return errors.Wrapf(err, "initialize default SRS")
 	}
 
 	if server != nil {
-		if err := v.Update(ctx, server); err != nil {
-			return errors.Wrapf(err, "update default SRS %+v", server)
+		// The default SRS is shared by proxies, so only the leader keeps it alive.
+		if SrsLeaderElection.IsLeader() {
+			if err := v.Update(ctx, server); err != nil {
+				return errors.Wrapf(err, "update default SRS %+v", server)
+			}
 		}
 
 		// Keep alive.
@@ -69,6 +184,9 @@ func (v *RedisLoadBalancer) Initialize(ctx context.Context) error {
 				case <-ctx.Done():
 					return
 				case <-time.After(30 * time.Second):
+					if !SrsLeaderElection.IsLeader() {
+						continue
+					}
 					if err := v.Update(ctx, server); err != nil {
 						logger.Wf(ctx, "update default SRS %+v failed, %+v", server, err)
 					}
@@ -81,168 +199,282 @@ func (v *RedisLoadBalancer) Initialize(ctx context.Context) error {
 }
 
 func (v *RedisLoadBalancer) Update(ctx context.Context, server *SRSServer) error {
-	b, err := json.Marshal(server)
+	b, err := marshalSchema(SchemaServer, server)
 	if err != nil {
 		return errors.Wrapf(err, "marshal server %+v", server)
 	}
 
 	key := v.redisKeyServer(server.ID())
-	if err = v.rdb.Set(ctx, key, b, ServerAliveDuration).Err(); err != nil {
+	if err = v.set(ctx, key, b, ServerAliveDuration); err != nil {
 		return errors.Wrapf(err, "set key=%v server %+v", key, server)
 	}
 
-	// Query all servers from redis, in json string.
-	var serverKeys []string
-	if b, err := v.rdb.Get(ctx, v.redisKeyServers()).Bytes(); err == nil {
-		if err := json.Unmarshal(b, &serverKeys); err != nil {
-			return errors.Wrapf(err, "unmarshal key=%v servers %v", v.redisKeyServers(), string(b))
-		}
+	// Notify other proxies to drop the stale server in cache, if the server is changed, for example, draining.
+	if cached, ok := v.cacheServers.Load(key); ok && isServerChanged(cached.server, server) {
+		v.publish(ctx, redisMessageServer, key)
+		v.dropAlive()
 	}
-
-	// Check each server expiration, if not exists in redis, remove from servers.
-	for i := len(serverKeys) - 1; i >= 0; i-- {
-		if _, err := v.rdb.Get(ctx, serverKeys[i]).Bytes(); err != nil {
-			serverKeys = append(serverKeys[:i], serverKeys[i+1:]...)
-		}
+	v.cacheServer(key, server)
+
+	// Index the server by the time of heartbeat in a sorted set, and remove the expired servers by score, so
+	// the proxies update the index atomically, without the race of read-modify-write. The time is of Redis, not
+	// the clock of proxy.
+	aliveSeconds := int64(ServerAliveDuration / time.Second)
+	if err := redisServersHeartbeat.Run(ctx, v.rdb, []string{v.redisKeyServers()}, key, aliveSeconds).Err(); err != nil {
+		return errors.Wrapf(err, "index key=%v server %+v", v.redisKeyServers(), server)
 	}
 
-	// Add server to servers if not exists.
-	var found bool
-	for _, serverKey := range serverKeys {
-		if serverKey == key {
-			found = true
-			break
+	// Keep the legacy list for the old proxies in rolling upgrade.
+	if v.environment.RedisLegacyServers() == "on" {
+		if err := v.updateLegacyServers(ctx, key); err != nil {
+			return errors.Wrapf(err, "update legacy key=%v server %+v", v.redisKeyLegacyServers(), server)
 		}
 	}
-	if !found {
-		serverKeys = append(serverKeys, key)
+
+	return nil
+}
+
+// updateLegacyServers adds the server key to the legacy JSON list of servers, and removes the dead servers, which
+// is read and written by the old proxies before the sorted set index.
+func (v *RedisLoadBalancer) updateLegacyServers(ctx context.Context, key string) error {
+	serverKeys, err := v.loadLegacyServers(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load legacy servers")
 	}
 
-	// Update all servers to redis.
-	b, err = json.Marshal(serverKeys)
+	values, err := v.mget(ctx, serverKeys)
 	if err != nil {
-		return errors.Wrapf(err, "marshal servers %+v", serverKeys)
+		return errors.Wrapf(err, "get servers %v", serverKeys)
 	}
-	if err = v.rdb.Set(ctx, v.redisKeyServers(), b, 0).Err(); err != nil {
-		return errors.Wrapf(err, "set key=%v servers %+v", v.redisKeyServers(), serverKeys)
+
+	alive := []string{key}
+	for i, serverKey := range serverKeys {
+		if serverKey != key && len(values[i]) > 0 {
+			alive = append(alive, serverKey)
+		}
 	}
 
+	b, err := json.Marshal(alive)
+	if err != nil {
+		return errors.Wrapf(err, "marshal servers %+v", alive)
+	}
+	if err = v.set(ctx, v.redisKeyLegacyServers(), b, 0); err != nil {
+		return errors.Wrapf(err, "set key=%v servers %+v", v.redisKeyLegacyServers(), alive)
+	}
 	return nil
 }
 
-func (v *RedisLoadBalancer) Pick(ctx context.Context, streamURL string) (*SRSServer, error) {
-	key := fmt.Sprintf("srs-proxy-url:%v", streamURL)
-
-	// Always proxy to the same server for the same stream URL.
-	if serverKey, err := v.rdb.Get(ctx, key).Result(); err == nil {
-		// If server not exists, ignore and pick another server for the stream URL.
-		if b, err := v.rdb.Get(ctx, serverKey).Bytes(); err == nil && len(b) > 0 {
-			var server SRSServer
-			if err := json.Unmarshal(b, &server); err != nil {
-				return nil, errors.Wrapf(err, "unmarshal key=%v server %v", key, string(b))
-			}
-
-			// TODO: If server fail, we should migrate the streams to another server.
-			return &server, nil
-		}
+// loadLegacyServers reads the server keys in the legacy JSON list, empty if not exists.
+func (v *RedisLoadBalancer) loadLegacyServers(ctx context.Context) ([]string, error) {
+	b, err := v.get(ctx, v.redisKeyLegacyServers())
+	if err != nil || len(b) == 0 {
+		return nil, nil
 	}
 
-	// Query all servers from redis, in json string.
 	var serverKeys []string
-	if b, err := v.rdb.Get(ctx, v.redisKeyServers()).Bytes(); err == nil {
-		if err := json.Unmarshal(b, &serverKeys); err != nil {
-			return nil, errors.Wrapf(err, "unmarshal key=%v servers %v", v.redisKeyServers(), string(b))
-		}
+	if err := json.Unmarshal(b, &serverKeys); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal key=%v servers %v", v.redisKeyLegacyServers(), string(b))
 	}
+	return serverKeys, nil
+}
+
+func (v *RedisLoadBalancer) PickForPublish(ctx context.Context, streamURL string) (*SRSServer, error) {
+	ctx = withAffinity(ctx, SrsPickAffinity.Publish)
+	SrsServerFailback.Publish(ctx, streamURL)
+	return v.pick(ctx, v.publishStrategy, streamURL)
+}
+
+func (v *RedisLoadBalancer) PickForPlay(ctx context.Context, streamURL string) (*SRSServer, error) {
+	return v.pick(withAffinity(ctx, SrsPickAffinity.Play), v.playStrategy, streamURL)
+}
 
-	// No server found, failed.
-	if len(serverKeys) == 0 {
-		return nil, fmt.Errorf("no server available for %v", streamURL)
+// pick a backend server for streamURL by strategy, and the affinity in ctx.
+func (v *RedisLoadBalancer) pick(ctx context.Context, strategy SRSServerStrategy, streamURL string) (*SRSServer, error) {
+	// The key of picked server by affinity, empty if not sticky.
+	pk := pickKey(ctx, streamURL)
+	key := v.redisKeyURL(pk)
+
+	// Use the cached affinity and server, to avoid requesting Redis, for example, the first wave of
+	// reconnecting clients after proxy restarts. Only the affinity of stream is cached, because the
+	// clients are too many to cache.
+	if serverKey := v.loadURL(pk); serverKey != "" && pk == streamURL {
+		if cached, ok := v.cacheServers.Load(serverKey); ok && time.Now().Before(cached.expireAt) {
+			return cached.server, nil
+		}
 	}
 
-	// All server should be alive, if not, should have been removed by redis. So we only
-	// random pick one that is always available. Use global rand which is thread-safe since Go 1.20.
+	// Read the picked server by affinity, and the alive servers by the score of index, in one round trip. The
+	// alive servers are cached for a short duration, so high connection rates don't hammer Redis.
+	alive := v.loadAlive()
 	var serverKey string
-	var server SRSServer
-	for i := 0; i < 3; i++ {
-		tryServerKey := serverKeys[rand.Intn(len(serverKeys))]
-		b, err := v.rdb.Get(ctx, tryServerKey).Bytes()
-		if err == nil && len(b) > 0 {
-			if err := json.Unmarshal(b, &server); err != nil {
-				return nil, errors.Wrapf(err, "unmarshal key=%v server %v", serverKey, string(b))
+	if pk != "" || alive == nil {
+		var affinity *redis.StringCmd
+		var index *redis.Cmd
+		if _, err := v.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			if pk != "" {
+				affinity = pipe.Get(ctx, key)
+			}
+			if alive == nil {
+				index = redisServersAlive.Eval(ctx, pipe, []string{v.redisKeyServers()}, int64(ServerAliveDuration/time.Second))
 			}
+			return nil
+		}); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "query key=%v and servers", key)
+		}
 
-			serverKey = tryServerKey
-			break
+		if affinity != nil {
+			if b, err := affinity.Bytes(); err == nil {
+				if b, err = v.open(key, b); err != nil {
+					return nil, errors.Wrapf(err, "open key=%v", key)
+				}
+				serverKey = string(b)
+			}
+		}
+
+		// Load all alive servers, with the picked server by affinity, in one round trip. The dead servers
+		// have been expired by redis.
+		if alive == nil {
+			serverKeys, err := index.StringSlice()
+			if err != nil {
+				return nil, errors.Wrapf(err, "query key=%v servers", v.redisKeyServers())
+			}
+
+			// Also query the servers registered by the old proxies in rolling upgrade, the dead servers in
+			// legacy list are ignored, because their keys have been expired by redis.
+			if v.environment.RedisLegacyServers() == "on" {
+				legacyKeys, err := v.loadLegacyServers(ctx)
+				if err != nil {
+					return nil, errors.Wrapf(err, "query legacy servers")
+				}
+				serverKeys = mergeServerKeys(serverKeys, legacyKeys)
+			}
+			if alive, err = v.queryAlive(ctx, serverKeys, serverKey); err != nil {
+				return nil, errors.Wrapf(err, "query servers %v", serverKeys)
+			}
 		}
 	}
-	if serverKey == "" {
-		return nil, errors.Errorf("no server available in %v for %v", serverKeys, streamURL)
+
+	// Always proxy to the same server for the same stream URL, or client by affinity. If server not exists,
+	// ignore and pick another server for the stream URL.
+	if serverKey != "" {
+		server, err := v.loadServer(ctx, alive, serverKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load key=%v server %v", key, serverKey)
+		}
+
+		// TODO: If server fail, we should migrate the streams to another server.
+		if server != nil {
+			v.cacheServer(serverKey, server)
+			if pk == streamURL {
+				v.cacheURL(pk, serverKey)
+			}
+			return server, nil
+		}
 	}
 
-	// Update the picked server for the stream URL.
-	if err := v.rdb.Set(ctx, key, []byte(serverKey), 0).Err(); err != nil {
+	servers := alive.servers
+	if len(servers) == 0 {
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v", streamURL)
+	}
+
+	// Select a server from servers by strategy, in the group routed by policy if specified.
+	server, err := selectServer(ctx, strategy, streamURL, servers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "select server for %v", streamURL)
+	}
+	serverKey = alive.keys[server]
+	v.cacheServer(serverKey, server)
+
+	// Update the picked server for the stream URL, or client by affinity.
+	if pk == "" {
+		return server, nil
+	}
+	if err := v.set(ctx, key, []byte(serverKey), pickTTL(pk, streamURL)); err != nil {
 		return nil, errors.Wrapf(err, "set key=%v server %v", key, serverKey)
 	}
+	if pk == streamURL {
+		v.cacheURL(pk, serverKey)
+	}
 
-	return &server, nil
+	return server, nil
+}
+
+func (v *RedisLoadBalancer) Unpick(ctx context.Context, streamURL string) error {
+	for _, pk := range unpickKeys(ctx, streamURL) {
+		key := v.redisKeyURL(pk)
+		if err := v.rdb.Del(ctx, key).Err(); err != nil {
+			return errors.Wrapf(err, "del key=%v", key)
+		}
+
+		// Notify other proxies to drop the affinity in cache, so they re-pick the same server from Redis.
+		v.dropURL(pk)
+		v.publish(ctx, redisMessageUnpick, pk)
+	}
+	return nil
 }
 
 func (v *RedisLoadBalancer) LoadHLSBySPBHID(ctx context.Context, spbhid string) (HLSPlayStream, error) {
 	key := v.redisKeySPBHID(spbhid)
 
-	b, err := v.rdb.Get(ctx, key).Bytes()
+	b, err := v.get(ctx, key)
 	if err != nil {
 		return nil, errors.Wrapf(err, "get key=%v HLS", key)
 	}
 
-	// Store the raw JSON bytes that will be unmarshaled by the concrete type
-	// The caller will need to handle the deserialization
-	var actual map[string]interface{}
-	if err := json.Unmarshal(b, &actual); err != nil {
-		return nil, errors.Wrapf(err, "unmarshal key=%v HLS %v", key, string(b))
+	// Renew the HLS streaming, because the TS files are requested continuously.
+	if err := v.rdb.Expire(ctx, key, HLSAliveDuration).Err(); err != nil {
+		return nil, errors.Wrapf(err, "expire key=%v HLS", key)
 	}
 
-	// Return nil for now - Redis LB needs the concrete type to properly deserialize
-	// This is a limitation of using Redis with interfaces
-	return nil, errors.Errorf("Redis load balancer cannot deserialize interface types")
+	return v.buildHLS(ctx, key, b)
 }
 
 func (v *RedisLoadBalancer) LoadOrStoreHLS(ctx context.Context, streamURL string, value HLSPlayStream) (HLSPlayStream, error) {
-	b, err := json.Marshal(value)
+	b, err := marshalSchema(SchemaHLS, value)
 	if err != nil {
 		return nil, errors.Wrapf(err, "marshal HLS %v", value)
 	}
 
+	// Only store the HLS streaming if not exists, so all proxies use the same SPBHID for the stream URL.
 	key := v.redisKeyHLS(streamURL)
-	if err = v.rdb.Set(ctx, key, b, HLSAliveDuration).Err(); err != nil {
+	actual := value
+	if ok, err := v.setNX(ctx, key, b, HLSAliveDuration); err != nil {
 		return nil, errors.Wrapf(err, "set key=%v HLS %v", key, value)
+	} else if !ok {
+		if b, err = v.get(ctx, key); err != nil {
+			return nil, errors.Wrapf(err, "get key=%v HLS", key)
+		}
+		if actual, err = v.buildHLS(ctx, key, b); err != nil {
+			return nil, errors.Wrapf(err, "build key=%v HLS", key)
+		}
+		if err := v.rdb.Expire(ctx, key, HLSAliveDuration).Err(); err != nil {
+			return nil, errors.Wrapf(err, "expire key=%v HLS", key)
+		}
 	}
 
-	// Get SPBHID from value
-	key2 := v.redisKeySPBHID(value.GetSPBHID())
-	if err := v.rdb.Set(ctx, key2, b, HLSAliveDuration).Err(); err != nil {
-		return nil, errors.Wrapf(err, "set key=%v HLS %v", key2, value)
+	// Update the HLS streaming for the SPBHID, for TS files.
+	key2 := v.redisKeySPBHID(actual.GetSPBHID())
+	if err := v.set(ctx, key2, b, HLSAliveDuration); err != nil {
+		return nil, errors.Wrapf(err, "set key=%v HLS %v", key2, actual)
 	}
 
-	// Return the same value since we just stored it
-	return value, nil
+	return actual, nil
 }
 
 func (v *RedisLoadBalancer) StoreWebRTC(ctx context.Context, streamURL string, value RTCConnection) error {
-	b, err := json.Marshal(value)
+	b, err := marshalSchema(SchemaRTC, value)
 	if err != nil {
 		return errors.Wrapf(err, "marshal WebRTC %v", value)
 	}
 
 	key := v.redisKeyRTC(streamURL)
-	if err = v.rdb.Set(ctx, key, b, RTCAliveDuration).Err(); err != nil {
+	if err = v.set(ctx, key, b, RTCAliveDuration); err != nil {
 		return errors.Wrapf(err, "set key=%v WebRTC %v", key, value)
 	}
 
 	// Get Ufrag from value
 	key2 := v.redisKeyUfrag(value.GetUfrag())
-	if err := v.rdb.Set(ctx, key2, b, RTCAliveDuration).Err(); err != nil {
+	if err := v.set(ctx, key2, b, RTCAliveDuration); err != nil {
 		return errors.Wrapf(err, "set key=%v WebRTC %v", key2, value)
 	}
 
@@ -252,41 +484,458 @@ func (v *RedisLoadBalancer) StoreWebRTC(ctx context.Context, streamURL string, v
 func (v *RedisLoadBalancer) LoadWebRTCByUfrag(ctx context.Context, ufrag string) (RTCConnection, error) {
 	key := v.redisKeyUfrag(ufrag)
 
-	b, err := v.rdb.Get(ctx, key).Bytes()
+	b, err := v.get(ctx, key)
 	if err != nil {
 		return nil, errors.Wrapf(err, "get key=%v WebRTC", key)
 	}
 
-	// Return nil for now - Redis LB needs the concrete type to properly deserialize
-	// This is a limitation of using Redis with interfaces
-	var actual map[string]interface{}
-	if err := json.Unmarshal(b, &actual); err != nil {
+	return buildRTC(ctx, key, b)
+}
+
+func (v *RedisLoadBalancer) Stats(ctx context.Context) (map[string]int, error) {
+	stats := make(map[string]int)
+	for name, pattern := range map[string]string{
+		"servers": v.redisKeyServer("*"),
+		"picked":  v.redisKeyURL("*"),
+		"hls":     v.redisKeyHLS("*"),
+		"spbhid":  v.redisKeySPBHID("*"),
+		"rtc":     v.redisKeyRTC("*"),
+		"ufrag":   v.redisKeyUfrag("*"),
+	} {
+		var n int
+		iter := v.rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			n++
+		}
+		if err := iter.Err(); err != nil {
+			return nil, errors.Wrapf(err, "scan %v", pattern)
+		}
+		stats[name] = n
+	}
+
+	stats["cache-servers"] = v.cacheServers.Len()
+	stats["cache-urls"] = int(atomic.LoadInt64(&v.nnCacheURLs))
+	return stats, nil
+}
+
+// Close the subscription and the Redis client of load balancer, which is not shared with the state store.
+func (v *RedisLoadBalancer) Close() error {
+	if v.pubsub != nil {
+		v.pubsub.Close()
+	}
+	if v.rdb != nil {
+		return v.rdb.Close()
+	}
+	return nil
+}
+
+// preload loads the servers and stream affinity from Redis to the cache, so the first wave of
+// reconnecting clients after proxy restarts doesn't hammer Redis.
+func (v *RedisLoadBalancer) preload(ctx context.Context) error {
+	starttime := time.Now()
+
+	iter := v.rdb.Scan(ctx, 0, v.redisKeyServer("*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if b, err := v.get(ctx, key); err == nil {
+			var server SRSServer
+			if err := unmarshalSchema(ctx, SchemaServer, b, &server); err != nil {
+				logger.Wf(ctx, "RedisLB: ignore invalid server key=%v, %v", key, err)
+				continue
+			}
+			v.cacheServer(key, &server)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errors.Wrapf(err, "scan servers")
+	}
+
+	prefix := v.redisKeyURL("")
+	iter = v.rdb.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if serverKey, err := v.get(ctx, key); err == nil {
+			v.cacheURL(key[len(prefix):], string(serverKey))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errors.Wrapf(err, "scan stream urls")
+	}
+
+	logger.Df(ctx, "RedisLB: preload %v servers and %v streams, cost=%v",
+		v.cacheServers.Len(), atomic.LoadInt64(&v.nnCacheURLs), time.Since(starttime))
+	return nil
+}
+
+// subscribe the messages in pub/sub channel, and invalidates the cache, until ctx done. The messages are lost
+// when reconnecting to Redis, so the cache still expires in RedisCacheDuration.
+func (v *RedisLoadBalancer) subscribe(ctx context.Context, pubsub *redis.PubSub) {
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-ch:
+		}
+		if msg == nil {
+			return
+		}
+
+		b := []byte(msg.Payload)
+		if v.cipher != nil {
+			var err error
+			if b, err = v.cipher.Open([]byte(v.redisKeyEvents()), b); err != nil {
+				logger.Wf(ctx, "RedisLB: ignore invalid message, err %+v", err)
+				continue
+			}
+		}
+
+		var m redisMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			logger.Wf(ctx, "RedisLB: ignore invalid message %v, err %+v", string(b), err)
+			continue
+		}
+		if m.Origin == v.origin {
+			continue
+		}
+
+		switch m.Type {
+		case redisMessageServer:
+			v.cacheServers.Delete(m.Key)
+			v.dropAlive()
+		case redisMessageUnpick:
+			v.dropURL(m.Key)
+		}
+		logger.Df(ctx, "RedisLB: invalidate %v %v by proxy %v", m.Type, m.Key, m.Origin)
+	}
+}
+
+// publish the message to invalidate the cache of other proxies, which is ignored if failed, because the cache
+// still expires in RedisCacheDuration.
+func (v *RedisLoadBalancer) publish(ctx context.Context, typ, key string) {
+	b, err := json.Marshal(&redisMessage{Type: typ, Key: key, Origin: v.origin})
+	if err != nil {
+		logger.Wf(ctx, "RedisLB: marshal %v %v message, err %+v", typ, key, err)
+		return
+	}
+
+	if v.cipher != nil {
+		if b, err = v.cipher.Seal([]byte(v.redisKeyEvents()), b); err != nil {
+			logger.Wf(ctx, "RedisLB: seal %v %v message, err %+v", typ, key, err)
+			return
+		}
+	}
+
+	if err := v.rdb.Publish(ctx, v.redisKeyEvents(), b).Err(); err != nil {
+		logger.Wf(ctx, "RedisLB: publish %v %v to %v, err %+v", typ, key, v.redisKeyEvents(), err)
+	}
+}
+
+// isServerChanged returns whether the server is changed, which should not be used in cache, such as the
+// draining state, the probe error or the endpoints.
+func isServerChanged(a, b *SRSServer) bool {
+	if a.IP != b.IP || a.Draining != b.Draining || a.ProbeError != b.ProbeError {
+		return true
+	}
+	return fmt.Sprint(a.RTMP, a.HTTP, a.API, a.SRT, a.RTC) != fmt.Sprint(b.RTMP, b.HTTP, b.API, b.SRT, b.RTC)
+}
+
+// cacheServer caches the server by key, for RedisCacheDuration.
+func (v *RedisLoadBalancer) cacheServer(key string, server *SRSServer) {
+	v.cacheServers.Store(key, &redisCachedServer{
+		server: server, expireAt: time.Now().Add(RedisCacheDuration),
+	})
+}
+
+// loadURL returns the server key of cached stream affinity, or empty if not cached or expired.
+func (v *RedisLoadBalancer) loadURL(pk string) string {
+	if cached, ok := v.cacheURLs.Load(pk); ok && time.Now().Before(cached.expireAt) {
+		return cached.serverKey
+	}
+	return ""
+}
+
+// cacheURL caches the stream affinity for RedisCacheDuration. When the cache is full, the expired entries are
+// removed at most once per second, and the affinity is not cached if still full.
+func (v *RedisLoadBalancer) cacheURL(pk, serverKey string) {
+	cached := &redisCachedURL{serverKey: serverKey, expireAt: time.Now().Add(RedisCacheDuration)}
+	if _, ok := v.cacheURLs.Load(pk); ok {
+		v.cacheURLs.Store(pk, cached)
+		return
+	}
+
+	if atomic.LoadInt64(&v.nnCacheURLs) >= RedisCacheMaxURLs {
+		v.sweepURLs()
+		if atomic.LoadInt64(&v.nnCacheURLs) >= RedisCacheMaxURLs {
+			return
+		}
+	}
+
+	if _, loaded := v.cacheURLs.LoadOrStore(pk, cached); loaded {
+		v.cacheURLs.Store(pk, cached)
+	} else {
+		atomic.AddInt64(&v.nnCacheURLs, 1)
+	}
+}
+
+// dropURL removes the cached stream affinity.
+func (v *RedisLoadBalancer) dropURL(pk string) {
+	if _, loaded := v.cacheURLs.LoadAndDelete(pk); loaded {
+		atomic.AddInt64(&v.nnCacheURLs, -1)
+	}
+}
+
+// sweepURLs removes the expired stream affinity in cache, at most once per second, because it ranges all
+// entries.
+func (v *RedisLoadBalancer) sweepURLs() {
+	now := time.Now()
+	last := atomic.LoadInt64(&v.sweepURLsAt)
+	if now.UnixNano()-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&v.sweepURLsAt, last, now.UnixNano()) {
+		return
+	}
+
+	v.cacheURLs.Range(func(pk string, cached *redisCachedURL) bool {
+		if now.After(cached.expireAt) {
+			v.dropURL(pk)
+		}
+		return true
+	})
+}
+
+// loadAlive returns the cached alive servers, or nil if not cached or expired.
+func (v *RedisLoadBalancer) loadAlive() *redisCachedAlive {
+	v.aliveLock.Lock()
+	defer v.aliveLock.Unlock()
+
+	if v.cacheAlive == nil || time.Now().After(v.cacheAlive.expireAt) {
+		return nil
+	}
+	return v.cacheAlive
+}
+
+// dropAlive drops the cached alive servers, to query them from Redis for the next new stream.
+func (v *RedisLoadBalancer) dropAlive() {
+	v.aliveLock.Lock()
+	defer v.aliveLock.Unlock()
+	v.cacheAlive = nil
+}
+
+// queryAlive loads the alive servers of serverKeys in one round trip, and caches them for
+// RedisPickCacheDuration. The server of extra key is also loaded and cached in cacheServers, if not in
+// serverKeys, for example, the picked server by affinity which is not indexed yet.
+func (v *RedisLoadBalancer) queryAlive(ctx context.Context, serverKeys []string, extra string) (*redisCachedAlive, error) {
+	keys := serverKeys
+	if extra != "" {
+		keys = append(append([]string{}, serverKeys...), extra)
+	}
+
+	alive := &redisCachedAlive{
+		keys: make(map[*SRSServer]string), expireAt: time.Now().Add(RedisPickCacheDuration),
+	}
+	if len(keys) == 0 {
+		return alive, nil
+	}
+
+	values, err := v.mget(ctx, keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get servers %v", keys)
+	}
+
+	for i, serverKey := range keys {
+		b := values[i]
+		if len(b) == 0 {
+			continue
+		}
+
+		var server SRSServer
+		if err := unmarshalSchema(ctx, SchemaServer, b, &server); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal key=%v server %v", serverKey, string(b))
+		}
+		if i == len(serverKeys) {
+			v.cacheServer(serverKey, &server)
+			continue
+		}
+		alive.servers, alive.keys[&server] = append(alive.servers, &server), serverKey
+	}
+
+	v.aliveLock.Lock()
+	defer v.aliveLock.Unlock()
+	v.cacheAlive = alive
+	return alive, nil
+}
+
+// loadServer returns the server of serverKey, from the cached servers, the alive servers, or Redis if not
+// found in cache. Returns nil if the server not exists or fails to read.
+func (v *RedisLoadBalancer) loadServer(ctx context.Context, alive *redisCachedAlive, serverKey string) (*SRSServer, error) {
+	if cached, ok := v.cacheServers.Load(serverKey); ok && time.Now().Before(cached.expireAt) {
+		return cached.server, nil
+	}
+
+	for server, key := range alive.keys {
+		if key == serverKey {
+			return server, nil
+		}
+	}
+
+	b, err := v.get(ctx, serverKey)
+	if err != nil || len(b) == 0 {
+		return nil, nil
+	}
+
+	var server SRSServer
+	if err := unmarshalSchema(ctx, SchemaServer, b, &server); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal key=%v server %v", serverKey, string(b))
+	}
+	return &server, nil
+}
+
+// open decrypts the value b of key if cipher is enabled.
+func (v *RedisLoadBalancer) open(key string, b []byte) ([]byte, error) {
+	if v.cipher == nil {
+		return b, nil
+	}
+	return v.cipher.Open([]byte(key), b)
+}
+
+// get reads the value of key, and decrypts it if cipher is enabled.
+func (v *RedisLoadBalancer) get(ctx context.Context, key string) ([]byte, error) {
+	b, err := v.rdb.Get(ctx, key).Bytes()
+	if err != nil || v.cipher == nil {
+		return b, err
+	}
+	return v.cipher.Open([]byte(key), b)
+}
+
+// mget reads the values of keys in one round trip, and decrypts them if cipher is enabled. The value is nil
+// if the key not exists.
+func (v *RedisLoadBalancer) mget(ctx context.Context, keys []string) ([][]byte, error) {
+	results, err := v.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	for i, result := range results {
+		s, ok := result.(string)
+		if !ok {
+			continue
+		}
+
+		b := []byte(s)
+		if v.cipher != nil {
+			if b, err = v.cipher.Open([]byte(keys[i]), b); err != nil {
+				return nil, errors.Wrapf(err, "open key=%v", keys[i])
+			}
+		}
+		values[i] = b
+	}
+	return values, nil
+}
+
+// setNX encrypts the value if cipher is enabled, and writes it to key if not exists. Returns true if
+// the value is written.
+func (v *RedisLoadBalancer) setNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	if v.cipher != nil {
+		b, err := v.cipher.Seal([]byte(key), value)
+		if err != nil {
+			return false, errors.Wrapf(err, "seal key=%v", key)
+		}
+		value = b
+	}
+	return v.rdb.SetNX(ctx, key, value, ttl).Result()
+}
+
+// buildHLS creates the HLS streaming from the persisted data b of key.
+func (v *RedisLoadBalancer) buildHLS(ctx context.Context, key string, b []byte) (HLSPlayStream, error) {
+	var dto HLSPlayStreamDTO
+	if err := unmarshalSchema(ctx, SchemaHLS, b, &dto); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal key=%v HLS %v", key, string(b))
+	}
+
+	if NewHLSPlayStreamFromDTO == nil {
+		return nil, errors.Errorf("no HLS streaming factory for key=%v", key)
+	}
+	return NewHLSPlayStreamFromDTO(&dto), nil
+}
+
+// buildRTC creates the WebRTC streaming from the persisted data b of key.
+func buildRTC(ctx context.Context, key string, b []byte) (RTCConnection, error) {
+	var dto RTCConnectionDTO
+	if err := unmarshalSchema(ctx, SchemaRTC, b, &dto); err != nil {
 		return nil, errors.Wrapf(err, "unmarshal key=%v WebRTC %v", key, string(b))
 	}
 
-	return nil, errors.Errorf("Redis load balancer cannot deserialize interface types")
+	if NewRTCConnectionFromDTO == nil {
+		return nil, errors.Errorf("no WebRTC streaming factory for key=%v", key)
+	}
+	return NewRTCConnectionFromDTO(&dto), nil
+}
+
+// set encrypts the value if cipher is enabled, and writes it to key.
+func (v *RedisLoadBalancer) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if v.cipher != nil {
+		b, err := v.cipher.Seal([]byte(key), value)
+		if err != nil {
+			return errors.Wrapf(err, "seal key=%v", key)
+		}
+		value = b
+	}
+	return v.rdb.Set(ctx, key, value, ttl).Err()
 }
 
 func (v *RedisLoadBalancer) redisKeyUfrag(ufrag string) string {
-	return fmt.Sprintf("srs-proxy-ufrag:%v", ufrag)
+	return fmt.Sprintf("%vsrs-proxy-ufrag:%v", v.environment.RedisKeyPrefix(), ufrag)
 }
 
 func (v *RedisLoadBalancer) redisKeyRTC(streamURL string) string {
-	return fmt.Sprintf("srs-proxy-rtc:%v", streamURL)
+	return fmt.Sprintf("%vsrs-proxy-rtc:%v", v.environment.RedisKeyPrefix(), streamURL)
 }
 
 func (v *RedisLoadBalancer) redisKeySPBHID(spbhid string) string {
-	return fmt.Sprintf("srs-proxy-spbhid:%v", spbhid)
+	return fmt.Sprintf("%vsrs-proxy-spbhid:%v", v.environment.RedisKeyPrefix(), spbhid)
 }
 
 func (v *RedisLoadBalancer) redisKeyHLS(streamURL string) string {
-	return fmt.Sprintf("srs-proxy-hls:%v", streamURL)
+	return fmt.Sprintf("%vsrs-proxy-hls:%v", v.environment.RedisKeyPrefix(), streamURL)
+}
+
+func (v *RedisLoadBalancer) redisKeyURL(streamURL string) string {
+	return fmt.Sprintf("%vsrs-proxy-url:%v", v.environment.RedisKeyPrefix(), streamURL)
 }
 
 func (v *RedisLoadBalancer) redisKeyServer(serverID string) string {
-	return fmt.Sprintf("srs-proxy-server:%v", serverID)
+	return fmt.Sprintf("%vsrs-proxy-server:%v", v.environment.RedisKeyPrefix(), serverID)
+}
+
+func (v *RedisLoadBalancer) redisKeyEvents() string {
+	return fmt.Sprintf("%vsrs-proxy-events", v.environment.RedisKeyPrefix())
 }
 
 func (v *RedisLoadBalancer) redisKeyServers() string {
-	return fmt.Sprintf("srs-proxy-all-servers")
+	return fmt.Sprintf("%vsrs-proxy-servers", v.environment.RedisKeyPrefix())
+}
+
+// redisKeyLegacyServers is the JSON list of server keys, written by the old proxies before the sorted set index.
+func (v *RedisLoadBalancer) redisKeyLegacyServers() string {
+	return fmt.Sprintf("%vsrs-proxy-all-servers", v.environment.RedisKeyPrefix())
+}
+
+// mergeServerKeys appends the keys in others not in keys.
+func mergeServerKeys(keys, others []string) []string {
+	for _, other := range others {
+		var found bool
+		for _, key := range keys {
+			if key == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, other)
+		}
+	}
+	return keys
 }
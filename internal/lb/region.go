@@ -0,0 +1,277 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/geo"
+	"srsx/internal/logger"
+)
+
+// SRSServerRegions prefers the backend servers in the region of client, by the region label of servers, for
+// the multi-region deployments. The region of client is specified by header, or mapped from the country of
+// client, or the nearest region by the coordinates of client. The other regions are the fallback, from the
+// nearest to the farthest, when no server is available in the preferred region.
+type SRSServerRegions interface {
+	// Locate returns the regions of client from the nearest to the farthest, by ip and the header of HTTP
+	// request which is nil for other protocols. Returns nil if the region of client is unknown.
+	Locate(ip string, header http.Header) []string
+	// Filter the servers in the first region of ctx which has any server, returns all servers if none
+	// matched or the regions of client is unknown.
+	Filter(ctx context.Context, streamURL string, servers []*SRSServer) []*SRSServer
+	// Enabled returns whether the regions are configured.
+	Enabled() bool
+}
+
+// srsRegion is a region with optional coordinates.
+type srsRegion struct {
+	// The name of region, such as us-east.
+	name string
+	// The coordinates of region, only available if HasCoordinates.
+	location geo.Location
+}
+
+type srsServerRegionsImpl struct {
+	// The regions in the order configured.
+	regions []*srsRegion
+	// The region of countries, key is the country code in upper case.
+	countries map[string]string
+	// The header of region specified by client or CDN, empty to ignore.
+	header string
+	// The label of backend server for region.
+	label string
+}
+
+// NewSRSServerRegions creates the regions of backend servers with options.
+func NewSRSServerRegions(opts ...func(*srsServerRegionsImpl)) SRSServerRegions {
+	v := &srsServerRegionsImpl{countries: make(map[string]string), label: "region"}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerRegionsFromEnvironment creates the regions by the coordinates and countries of regions, the
+// header and the label in environment.
+func NewSRSServerRegionsFromEnvironment(environment env.Environment) (SRSServerRegions, error) {
+	regions, err := parseRegions(environment.Regions())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse regions %v", environment.Regions())
+	}
+
+	countries, err := parseRegionCountries(environment.RegionCountries())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse region countries %v", environment.RegionCountries())
+	}
+
+	// The regions only mapped from countries have no coordinates.
+	for _, name := range countries {
+		if findRegion(regions, name) == nil {
+			regions = append(regions, &srsRegion{name: name})
+		}
+	}
+
+	label := environment.RegionLabel()
+	if label == "" {
+		label = "region"
+	}
+
+	return NewSRSServerRegions(func(v *srsServerRegionsImpl) {
+		v.regions, v.countries, v.header, v.label = regions, countries, environment.RegionHeader(), label
+	}), nil
+}
+
+// parseRegions parses the coordinates of regions, like us-east=39.04/-77.49,eu-west=53.34/-6.26, and the
+// coordinates are optional, like us-east,eu-west.
+func parseRegions(s string) ([]*srsRegion, error) {
+	var regions []*srsRegion
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		region := &srsRegion{name: strings.TrimSpace(kv[0])}
+		if region.name == "" || findRegion(regions, region.name) != nil {
+			return nil, errors.Errorf("invalid region %v", item)
+		}
+
+		if len(kv) == 2 {
+			coordinates := strings.Split(kv[1], "/")
+			if len(coordinates) != 2 {
+				return nil, errors.Errorf("invalid coordinates %v of %v", kv[1], region.name)
+			}
+
+			var err error
+			if region.location.Latitude, err = strconv.ParseFloat(strings.TrimSpace(coordinates[0]), 64); err != nil {
+				return nil, errors.Wrapf(err, "parse latitude %v of %v", coordinates[0], region.name)
+			}
+			if region.location.Longitude, err = strconv.ParseFloat(strings.TrimSpace(coordinates[1]), 64); err != nil {
+				return nil, errors.Wrapf(err, "parse longitude %v of %v", coordinates[1], region.name)
+			}
+			region.location.HasCoordinates = true
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// parseRegionCountries parses the countries of regions, like us-east=US|CA,eu-west=GB|DE, returns the region
+// of countries.
+func parseRegionCountries(s string) (map[string]string, error) {
+	countries := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.Errorf("invalid region countries %v", item)
+		}
+
+		name := strings.TrimSpace(kv[0])
+		for _, country := range strings.Split(kv[1], "|") {
+			if country = strings.ToUpper(strings.TrimSpace(country)); country == "" {
+				continue
+			}
+			if region, ok := countries[country]; ok && region != name {
+				return nil, errors.Errorf("country %v in both %v and %v", country, region, name)
+			}
+			countries[country] = name
+		}
+	}
+	return countries, nil
+}
+
+func findRegion(regions []*srsRegion, name string) *srsRegion {
+	for _, region := range regions {
+		if region.name == name {
+			return region
+		}
+	}
+	return nil
+}
+
+func (v *srsServerRegionsImpl) Enabled() bool {
+	return len(v.regions) > 0
+}
+
+func (v *srsServerRegionsImpl) Locate(ip string, header http.Header) []string {
+	if !v.Enabled() {
+		return nil
+	}
+
+	// The region specified by client or CDN is always preferred, even not configured.
+	var preferred string
+	if v.header != "" && header != nil {
+		preferred = strings.TrimSpace(header.Get(v.header))
+	}
+
+	location := geo.SrsLocator.Locate(ip, header)
+	if preferred == "" {
+		preferred = v.countries[location.Country]
+	}
+
+	// The distance to the preferred region if known, or to the client, to sort the fallback regions.
+	origin := location
+	if region := findRegion(v.regions, preferred); region != nil && region.location.HasCoordinates {
+		origin = &region.location
+	}
+	if !origin.HasCoordinates {
+		if preferred == "" {
+			return nil
+		}
+
+		regions := []string{preferred}
+		for _, region := range v.regions {
+			if region.name != preferred {
+				regions = append(regions, region.name)
+			}
+		}
+		return regions
+	}
+
+	// Sort the regions by distance, the regions without coordinates are the last.
+	candidates := append([]*srsRegion(nil), v.regions...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := &candidates[i].location, &candidates[j].location
+		if !a.HasCoordinates || !b.HasCoordinates {
+			return a.HasCoordinates && !b.HasCoordinates
+		}
+		return origin.DistanceTo(a) < origin.DistanceTo(b)
+	})
+
+	var regions []string
+	if preferred != "" {
+		regions = append(regions, preferred)
+	}
+	for _, region := range candidates {
+		if region.name != preferred {
+			regions = append(regions, region.name)
+		}
+	}
+	return regions
+}
+
+func (v *srsServerRegionsImpl) Filter(ctx context.Context, streamURL string, servers []*SRSServer) []*SRSServer {
+	regions, _ := ctx.Value(serverRegionsKey{}).([]string)
+	for i, region := range regions {
+		matched := filterServers(servers, func(server *SRSServer) bool {
+			return server.Labels[v.label] == region
+		})
+		if len(matched) == 0 {
+			continue
+		}
+
+		if i > 0 {
+			logger.Wf(ctx, "Pick %v fall back to region %v, no server in %v", streamURL, region, strings.Join(regions[:i], ","))
+		}
+		return matched
+	}
+	return servers
+}
+
+func (v *srsServerRegionsImpl) String() string {
+	var items []string
+	for _, region := range v.regions {
+		if region.location.HasCoordinates {
+			items = append(items, fmt.Sprintf("%v=%v/%v", region.name, region.location.Latitude, region.location.Longitude))
+		} else {
+			items = append(items, region.name)
+		}
+	}
+	return fmt.Sprintf("regions=[%v], countries=%v, header=%v, label=%v",
+		strings.Join(items, ","), len(v.countries), v.header, v.label)
+}
+
+// serverRegionsKey is the context key of the regions of client.
+type serverRegionsKey struct{}
+
+// WithClientRegions returns a context to prefer the servers in the regions of client from remoteAddr and
+// the header of HTTP request which is nil for other protocols.
+func WithClientRegions(ctx context.Context, remoteAddr string, header http.Header) context.Context {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	regions := SrsServerRegions.Locate(ip, header)
+	if len(regions) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, serverRegionsKey{}, regions)
+}
+
+// SrsServerRegions is the global regions of backend servers.
+var SrsServerRegions = NewSRSServerRegions()
@@ -0,0 +1,199 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+)
+
+// SRSServerRegistration is a registration token issued for the identity of a backend server, which is the
+// server id or device id of SRS. The token is in the form of id.secret, where only the hash of secret is
+// persisted, so the token is shown once when issued.
+type SRSServerRegistration struct {
+	// The id of token, to revoke it.
+	ID string `json:"id"`
+	// The server id or device id of SRS, to bind the token.
+	Identity string `json:"identity"`
+	// The SHA256 of secret in hex, never responded by API.
+	Hash string `json:"hash,omitempty"`
+	// The time issued.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SRSServerRegistrar issues the registration tokens for backend servers, and verifies them when registering.
+// The server registered by token has a stable ID by the token, so a backend restarting with a new service id
+// and pid updates its existing record, instead of creating a duplicated one. Each token is revoked individually,
+// for example, the registration requests are stolen. The tokens are persisted in the state store, so they are
+// shared by proxies with Redis, file or SQL.
+type SRSServerRegistrar interface {
+	// Issue a token for identity, returns the token and the registration.
+	Issue(ctx context.Context, identity string) (string, *SRSServerRegistration, error)
+	// Verify the token for the server id or device id, returns the registration.
+	Verify(ctx context.Context, token, serverID, deviceID string) (*SRSServerRegistration, error)
+	// Revoke the token by id.
+	Revoke(ctx context.Context, id string) error
+	// List the registrations, sorted by identity and id.
+	List(ctx context.Context) ([]*SRSServerRegistration, error)
+	// Required returns whether the token is required to register.
+	Required() bool
+}
+
+type srsServerRegistrarImpl struct {
+	// The state store to persist the registrations.
+	store store.Store
+	// Whether the token is required to register.
+	required bool
+}
+
+// NewSRSServerRegistrar creates a registrar which persists the registrations in s.
+func NewSRSServerRegistrar(s store.Store, opts ...func(*srsServerRegistrarImpl)) SRSServerRegistrar {
+	v := &srsServerRegistrarImpl{store: s}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerRegistrarFromEnvironment creates the registrar in s, and the token is required if enabled in
+// environment.
+func NewSRSServerRegistrarFromEnvironment(environment env.Environment, s store.Store) (SRSServerRegistrar, error) {
+	required := environment.RegisterToken()
+	if required != "on" && required != "off" {
+		return nil, errors.Errorf("invalid register token %v", required)
+	}
+
+	return NewSRSServerRegistrar(s, func(v *srsServerRegistrarImpl) {
+		v.required = required == "on"
+	}), nil
+}
+
+func (v *srsServerRegistrarImpl) Issue(ctx context.Context, identity string) (string, *SRSServerRegistration, error) {
+	if identity == "" {
+		return "", nil, errors.Errorf("empty identity")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, errors.Wrapf(err, "generate secret")
+	}
+
+	r := &SRSServerRegistration{
+		ID: logger.GenerateContextID(), Identity: identity, Hash: registrationHash(hex.EncodeToString(secret)),
+		CreatedAt: time.Now(),
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "marshal registration")
+	}
+	if err := v.store.Set(ctx, v.key(r.ID), b, 0); err != nil {
+		return "", nil, errors.Wrapf(err, "save registration %v", r.ID)
+	}
+
+	token := fmt.Sprintf("%v.%v", r.ID, hex.EncodeToString(secret))
+	return token, r.masked(), nil
+}
+
+func (v *srsServerRegistrarImpl) Verify(ctx context.Context, token, serverID, deviceID string) (*SRSServerRegistration, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, errors.Errorf("invalid token")
+	}
+
+	b, err := v.store.Get(ctx, v.key(id))
+	if store.IsNotFound(err) {
+		return nil, errors.Errorf("token %v not found or revoked", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "load registration %v", id)
+	}
+
+	var r SRSServerRegistration
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal registration %v", id)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Hash), []byte(registrationHash(secret))) != 1 {
+		return nil, errors.Errorf("token %v mismatch", id)
+	}
+
+	// The token is bound to the identity, so it's not used by other servers.
+	if r.Identity != serverID && (deviceID == "" || r.Identity != deviceID) {
+		return nil, errors.Errorf("token %v of %v, not for server %v device %v", id, r.Identity, serverID, deviceID)
+	}
+	return r.masked(), nil
+}
+
+func (v *srsServerRegistrarImpl) Revoke(ctx context.Context, id string) error {
+	if _, err := v.store.Get(ctx, v.key(id)); store.IsNotFound(err) {
+		return errors.Errorf("token %v not found", id)
+	} else if err != nil {
+		return errors.Wrapf(err, "load registration %v", id)
+	}
+
+	if err := v.store.Delete(ctx, v.key(id)); err != nil {
+		return errors.Wrapf(err, "delete registration %v", id)
+	}
+	return nil
+}
+
+func (v *srsServerRegistrarImpl) List(ctx context.Context) ([]*SRSServerRegistration, error) {
+	registrations := []*SRSServerRegistration{}
+	if err := v.store.Scan(ctx, v.key(""), func(k string, b []byte) bool {
+		var r SRSServerRegistration
+		if err := json.Unmarshal(b, &r); err != nil {
+			logger.Wf(ctx, "Ignore invalid registration key=%v, %v", k, string(b))
+			return true
+		}
+		registrations = append(registrations, r.masked())
+		return true
+	}); err != nil {
+		return nil, errors.Wrapf(err, "scan registrations")
+	}
+
+	sort.Slice(registrations, func(i, j int) bool {
+		if registrations[i].Identity != registrations[j].Identity {
+			return registrations[i].Identity < registrations[j].Identity
+		}
+		return registrations[i].ID < registrations[j].ID
+	})
+	return registrations, nil
+}
+
+func (v *srsServerRegistrarImpl) Required() bool {
+	return v.required
+}
+
+func (v *srsServerRegistrarImpl) key(id string) string {
+	return fmt.Sprintf("srs-proxy-registration:%v", id)
+}
+
+// masked returns a copy of registration without the hash of secret.
+func (v *SRSServerRegistration) masked() *SRSServerRegistration {
+	r := *v
+	r.Hash = ""
+	return &r
+}
+
+// registrationHash returns the SHA256 of secret in hex.
+func registrationHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// SrsServerRegistrar is the global registrar of backend servers.
+var SrsServerRegistrar SRSServerRegistrar
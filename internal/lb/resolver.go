@@ -0,0 +1,214 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"net"
+	"sort"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The hostname not resolved by proxy in this number of TTLs is removed from cache, for example, the server
+// is unregistered.
+const resolvedIdleTTLs = 10
+
+// ResolvedHost is the cached IP of the hostname of backend server.
+type ResolvedHost struct {
+	// The hostname of server.
+	Host string `json:"host"`
+	// The resolved IP, the IPv4 address preferred.
+	IP string `json:"ip"`
+	// The time resolved, not updated if re-resolve failed.
+	ResolvedAt time.Time `json:"resolved_at"`
+	// The error of last re-resolve, the stale IP is used if failed.
+	Error string `json:"error,omitempty"`
+
+	// The time last used by proxy.
+	usedAt time.Time
+}
+
+// SRSServerResolver resolves the hostname of backend server, which registers or is configured by hostname
+// instead of IP, and caches the IP in TTL. The cached hostnames are re-resolved in TTL, so the new IP is used
+// by the new connections, instead of pinning to the stale IP.
+type SRSServerResolver interface {
+	// Run to re-resolve the cached hostnames in TTL, until ctx done.
+	Run(ctx context.Context)
+	// Resolve the host of server, returns the host if it's an IP, or the cached IP of hostname, which is
+	// resolved if not cached.
+	Resolve(ctx context.Context, host string) (string, error)
+	// Hosts returns the cached hostnames, sorted by host.
+	Hosts() []*ResolvedHost
+}
+
+type srsServerResolverImpl struct {
+	// The TTL of cached IP, 0 to resolve for each connection.
+	ttl time.Duration
+	// The resolver of DNS.
+	resolver *net.Resolver
+
+	// The cached hostnames, key is the host.
+	hosts map[string]*ResolvedHost
+	// The lock to protect hosts.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerResolver creates a resolver by options, which caches the IP of hostname in 30s.
+func NewSRSServerResolver(opts ...func(*srsServerResolverImpl)) SRSServerResolver {
+	v := &srsServerResolverImpl{
+		ttl: 30 * time.Second, resolver: net.DefaultResolver, hosts: make(map[string]*ResolvedHost),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerResolverFromEnvironment creates the resolver by the TTL in environment.
+func NewSRSServerResolverFromEnvironment(environment env.Environment) (SRSServerResolver, error) {
+	ttl, err := time.ParseDuration(environment.BackendDNSTTL())
+	if err != nil || ttl < 0 {
+		return nil, errors.Errorf("invalid backend dns ttl %v", environment.BackendDNSTTL())
+	}
+
+	return NewSRSServerResolver(func(v *srsServerResolverImpl) {
+		v.ttl = ttl
+	}), nil
+}
+
+func (v *srsServerResolverImpl) Run(ctx context.Context) {
+	if v.ttl <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(v.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		v.lock.Lock()
+		hosts := make([]string, 0, len(v.hosts))
+		for host, resolved := range v.hosts {
+			if time.Since(resolved.usedAt) > resolvedIdleTTLs*v.ttl {
+				delete(v.hosts, host)
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+		v.lock.Unlock()
+
+		for _, host := range hosts {
+			v.refresh(ctx, host)
+		}
+	}
+}
+
+func (v *srsServerResolverImpl) Resolve(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	if v.ttl > 0 {
+		v.lock.Lock()
+		resolved, ok := v.hosts[host]
+		if ok {
+			resolved.usedAt = time.Now()
+		}
+		v.lock.Unlock()
+
+		if ok {
+			return resolved.IP, nil
+		}
+	}
+
+	ip, err := v.lookup(ctx, host)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %v", host)
+	}
+
+	if v.ttl > 0 {
+		now := time.Now()
+		v.lock.Lock()
+		v.hosts[host] = &ResolvedHost{Host: host, IP: ip, ResolvedAt: now, usedAt: now}
+		v.lock.Unlock()
+		logger.Df(ctx, "Resolve backend host %v to %v, ttl=%v", host, ip, v.ttl)
+	}
+	return ip, nil
+}
+
+func (v *srsServerResolverImpl) Hosts() []*ResolvedHost {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	hosts := make([]*ResolvedHost, 0, len(v.hosts))
+	for _, resolved := range v.hosts {
+		copied := *resolved
+		hosts = append(hosts, &copied)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// refresh re-resolves the cached hostname, and keeps the stale IP if failed, to not fail all connections by a
+// temporary failure of DNS.
+func (v *srsServerResolverImpl) refresh(ctx context.Context, host string) {
+	ip, err := v.lookup(ctx, host)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	resolved, ok := v.hosts[host]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		resolved.Error = err.Error()
+		logger.Wf(ctx, "Re-resolve backend host %v failed, keep %v, err %+v", host, resolved.IP, err)
+		return
+	}
+
+	if resolved.IP != ip {
+		logger.Wf(ctx, "Backend host %v changed from %v to %v", host, resolved.IP, ip)
+	}
+	resolved.IP, resolved.ResolvedAt, resolved.Error = ip, time.Now(), ""
+}
+
+// lookup the IP of host, the IPv4 address preferred, because the backend server usually listens on IPv4.
+func (v *srsServerResolverImpl) lookup(ctx context.Context, host string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsResolveTimeout)
+	defer cancel()
+
+	addrs, err := v.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", errors.Wrapf(err, "lookup %v", host)
+	}
+	if len(addrs) == 0 {
+		return "", errors.Errorf("no address of %v", host)
+	}
+
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return ip.String(), nil
+}
+
+// SrsServerResolver is the global resolver of the hostnames of backend servers.
+var SrsServerResolver = NewSRSServerResolver()
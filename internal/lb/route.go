@@ -0,0 +1,194 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// RoutingRule routes the new streams matched to a pool of backend servers. The empty condition matches
+// any stream, and all conditions must be matched.
+type RoutingRule struct {
+	// The name of rule, for logging.
+	Name string `json:"name,omitempty"`
+	// The patterns of vhost, such as __defaultVhost__ or *.example.com.
+	Vhosts []string `json:"vhosts,omitempty"`
+	// The patterns of app/stream, such as live/* for all streams of app live.
+	Streams []string `json:"streams,omitempty"`
+	// The pool of backend servers to route, optional if selector is set.
+	Pool string `json:"pool,omitempty"`
+	// The label selector of backend servers to route, like region=us-east,tier in (premium,gold), optional
+	// if pool is set. Both the pool and selector must be matched if set.
+	Selector string `json:"selector,omitempty"`
+	// The pool of backend servers to fail over, when no server of the pool and selector is available, such as
+	// all down, draining or circuit open. Optional, the stream fails if not set.
+	Fallback string `json:"fallback,omitempty"`
+	// The policy to fail back the streams from fallback pool, manual, immediate or on-next-publish, default
+	// to on-next-publish if fallback is set.
+	Failback string `json:"failback,omitempty"`
+
+	// The parsed label selector.
+	selector *LabelSelector
+}
+
+// RoutingConfig is the pools of backend servers, and the rules to route the new streams to pools, the
+// first matched rule applies. The stream not matched is picked from all servers.
+type RoutingConfig struct {
+	// The servers of pools, key is the pool name, value is the server id or device id of SRS. The
+	// servers registered with group of the pool name are also in the pool.
+	Pools map[string][]string `json:"pools,omitempty"`
+	// The rules in order.
+	Rules []*RoutingRule `json:"rules"`
+}
+
+// SRSServerRouter routes the new streams to the pools of backend servers, by vhost or app.
+type SRSServerRouter interface {
+	// Route returns the matched rule of new stream, nil if not routed.
+	Route(ctx context.Context, streamURL string) *RoutingRule
+	// InPool returns whether the server is in pool.
+	InPool(server *SRSServer, pool string) bool
+	// Config returns the routing config.
+	Config() *RoutingConfig
+}
+
+type srsServerRouterImpl struct {
+	// The routing config.
+	config *RoutingConfig
+	// The pools of servers, key is the server id or device id of SRS.
+	pools map[string]map[string]bool
+}
+
+// NewSRSServerRouter creates a router by config, which routes nothing if nil.
+func NewSRSServerRouter(config *RoutingConfig) (SRSServerRouter, error) {
+	if config == nil {
+		config = &RoutingConfig{}
+	}
+	if config.Rules == nil {
+		config.Rules = []*RoutingRule{}
+	}
+
+	v := &srsServerRouterImpl{config: config, pools: make(map[string]map[string]bool)}
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%v", i)
+		}
+		if rule.Pool == "" && rule.Selector == "" {
+			return nil, errors.Errorf("rule %v: empty pool and selector", rule.Name)
+		}
+		selector, err := ParseLabelSelector(rule.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %v: invalid selector", rule.Name)
+		}
+		rule.selector = selector
+		if rule.Fallback != "" && rule.Failback == "" {
+			rule.Failback = FailbackOnNextPublish
+		}
+		switch rule.Failback {
+		case "", FailbackManual, FailbackImmediate, FailbackOnNextPublish:
+		default:
+			return nil, errors.Errorf("rule %v: invalid failback %v", rule.Name, rule.Failback)
+		}
+		for _, pattern := range append(append([]string{}, rule.Vhosts...), rule.Streams...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Errorf("rule %v: invalid pattern %v", rule.Name, pattern)
+			}
+		}
+	}
+
+	for pool, ids := range config.Pools {
+		for _, id := range ids {
+			if v.pools[id] == nil {
+				v.pools[id] = make(map[string]bool)
+			}
+			v.pools[id][pool] = true
+		}
+	}
+	return v, nil
+}
+
+// NewSRSServerRouterFromEnvironment creates the router by the routing file in environment.
+func NewSRSServerRouterFromEnvironment(environment env.Environment) (SRSServerRouter, error) {
+	filename := environment.RoutingFile()
+	if filename == "" {
+		return NewSRSServerRouter(nil)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", filename)
+	}
+
+	var config RoutingConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+
+	router, err := NewSRSServerRouter(&config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid routing %v", filename)
+	}
+	return router, nil
+}
+
+func (v *srsServerRouterImpl) Route(ctx context.Context, streamURL string) *RoutingRule {
+	if len(v.config.Rules) == 0 {
+		return nil
+	}
+
+	// The stream URL is in vhost/app/stream schema.
+	vhost, appStream := streamURL, ""
+	if index := strings.Index(streamURL, "/"); index >= 0 {
+		vhost, appStream = streamURL[:index], streamURL[index+1:]
+	}
+
+	for _, rule := range v.config.Rules {
+		if matchPattern(rule.Vhosts, vhost) && matchPattern(rule.Streams, appStream) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the server is in the pool and matches the selector of rule.
+func (v *RoutingRule) Matches(router SRSServerRouter, server *SRSServer) bool {
+	if v.Pool != "" && !router.InPool(server, v.Pool) {
+		return false
+	}
+	return v.selector == nil || v.selector.Matches(server.Labels)
+}
+
+func (v *srsServerRouterImpl) InPool(server *SRSServer, pool string) bool {
+	if server.Group == pool {
+		return true
+	}
+	return v.pools[server.ServerID][pool] || (server.DeviceID != "" && v.pools[server.DeviceID][pool])
+}
+
+func (v *srsServerRouterImpl) Config() *RoutingConfig {
+	return v.config
+}
+
+// matchPattern returns whether value matches any of patterns, or true if no pattern.
+func matchPattern(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SrsServerRouter is the global router of new streams, which routes nothing by default.
+var SrsServerRouter, _ = NewSRSServerRouter(nil)
@@ -0,0 +1,140 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"encoding/json"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The kinds of persisted data, each kind has its own schema version.
+const (
+	SchemaServer = "server"
+	SchemaHLS    = "hls"
+	SchemaRTC    = "rtc"
+)
+
+// The current schema version of each kind. Please increase the version and add a migration to
+// schemaMigrations, when changing the struct fields of the persisted data.
+var schemaVersions = map[string]int{
+	SchemaServer: 2,
+	SchemaHLS:    1,
+	SchemaRTC:    1,
+}
+
+// The migrations of each kind, key is the version to migrate from, which converts the data of version
+// N to N+1. The version 0 is the legacy data without envelope, written by the old proxy.
+var schemaMigrations = map[string]map[int]func(data json.RawMessage) (json.RawMessage, error){
+	SchemaServer: {0: migrateLegacy, 1: migrateServerWeight},
+	SchemaHLS:    {0: migrateLegacy},
+	SchemaRTC:    {0: migrateLegacy},
+}
+
+// migrateLegacy migrates the legacy data to version 1, which has the same fields.
+func migrateLegacy(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+// migrateServerWeight migrates the server to version 2, which has the weight, default to 1.
+func migrateServerWeight(data json.RawMessage) (json.RawMessage, error) {
+	var server map[string]interface{}
+	if err := json.Unmarshal(data, &server); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(data))
+	}
+
+	if _, ok := server["weight"]; !ok {
+		server["weight"] = 1
+	}
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %v", server)
+	}
+	return b, nil
+}
+
+// Whether write the persisted data in versioned envelope, or the legacy format without envelope, which the old
+// proxies are able to read during rolling upgrade. Both formats are read.
+var schemaWriteEnvelope bool
+
+// ConfigureSchema configures the format to write the persisted data by environment.
+func ConfigureSchema(ctx context.Context, environment env.Environment) error {
+	switch environment.SchemaEnvelope() {
+	case "on":
+		schemaWriteEnvelope = true
+	case "off":
+		schemaWriteEnvelope = false
+	default:
+		return errors.Errorf("invalid schema envelope %v", environment.SchemaEnvelope())
+	}
+	logger.Df(ctx, "Schema write envelope=%v", schemaWriteEnvelope)
+	return nil
+}
+
+// schemaEnvelope is the versioned JSON envelope of the persisted data.
+type schemaEnvelope struct {
+	// The kind of data, such as server.
+	Kind string `json:"kind"`
+	// The schema version of data.
+	Version int `json:"version"`
+	// The data in JSON.
+	Data json.RawMessage `json:"data"`
+}
+
+// marshalSchema marshals the value of kind in a versioned envelope, or in the legacy format if the envelope is
+// not enabled, which is the data of current version without envelope.
+func marshalSchema(kind string, value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %v %v", kind, value)
+	}
+
+	if !schemaWriteEnvelope {
+		return data, nil
+	}
+
+	b, err := json.Marshal(&schemaEnvelope{Kind: kind, Version: schemaVersions[kind], Data: data})
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %v envelope", kind)
+	}
+	return b, nil
+}
+
+// unmarshalSchema unmarshals the value of kind from b, and migrates the data to the current version.
+// The legacy data without envelope is migrated from version 0.
+func unmarshalSchema(ctx context.Context, kind string, b []byte, value interface{}) error {
+	var envelope schemaEnvelope
+	if err := json.Unmarshal(b, &envelope); err != nil || envelope.Kind != kind || envelope.Data == nil {
+		envelope = schemaEnvelope{Kind: kind, Version: 0, Data: b}
+	}
+
+	current := schemaVersions[kind]
+	if envelope.Version > current {
+		// Written by a newer proxy, for example, during rolling upgrade, we try to decode it because
+		// the JSON ignores the unknown fields.
+		logger.Wf(ctx, "%v schema version %v is newer than %v, decode it anyway", kind, envelope.Version, current)
+	}
+
+	data := envelope.Data
+	for version := envelope.Version; version < current; version++ {
+		migrate, ok := schemaMigrations[kind][version]
+		if !ok {
+			return errors.Errorf("no migration for %v from version %v", kind, version)
+		}
+
+		var err error
+		if data, err = migrate(data); err != nil {
+			return errors.Wrapf(err, "migrate %v from version %v", kind, version)
+		}
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return errors.Wrapf(err, "unmarshal %v version %v, %v", kind, envelope.Version, string(data))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// SRSServerSlowStart ramps up the traffic share of newly registered backend servers over a window, instead
+// of immediately giving them an equal share, to avoid overwhelming the cold caches and freshly started
+// origins. The server is new when first seen by this proxy, and the servers seen when the proxy starts are
+// regarded as warm, because the proxy might restart while the servers keep running.
+type SRSServerSlowStart interface {
+	// Factor returns the traffic factor of server, in (0, 1], and 1 if not in slow start window.
+	Factor(server *SRSServer) float64
+	// Filter the servers by the factor, each server is kept in probability of its factor, so the new
+	// server gets the share of factor. Returns all servers if none is kept.
+	Filter(servers []*SRSServer) []*SRSServer
+}
+
+type srsServerSlowStartImpl struct {
+	// The window to ramp up the traffic of new server, 0 to disable.
+	window time.Duration
+	// The aggression of ramping, 1 for linear, larger to ramp faster at the beginning.
+	aggression float64
+	// The min factor of new server, in (0, 1].
+	minFactor float64
+	// The time the slow start created, the servers seen in a heartbeat duration are warm.
+	createdAt time.Time
+
+	// The time each server first seen, key is the ID of server.
+	seen map[string]time.Time
+	// The time each server last seen, key is the ID of server.
+	lastSeen map[string]time.Time
+	// The lock to protect seen and lastSeen.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerSlowStart creates the slow start of backend servers with options.
+func NewSRSServerSlowStart(opts ...func(*srsServerSlowStartImpl)) SRSServerSlowStart {
+	v := &srsServerSlowStartImpl{
+		aggression: 1, minFactor: 0.1, createdAt: time.Now(),
+		seen: make(map[string]time.Time), lastSeen: make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerSlowStartFromEnvironment creates the slow start by the window, aggression and min percent in
+// environment.
+func NewSRSServerSlowStartFromEnvironment(environment env.Environment) (SRSServerSlowStart, error) {
+	window, err := time.ParseDuration(environment.SlowStartWindow())
+	if err != nil || window < 0 {
+		return nil, errors.Errorf("invalid slow start window %v", environment.SlowStartWindow())
+	}
+	aggression, err := strconv.ParseFloat(environment.SlowStartAggression(), 64)
+	if err != nil || aggression <= 0 {
+		return nil, errors.Errorf("invalid slow start aggression %v", environment.SlowStartAggression())
+	}
+	minPercent, err := strconv.ParseFloat(environment.SlowStartMinPercent(), 64)
+	if err != nil || minPercent <= 0 || minPercent > 100 {
+		return nil, errors.Errorf("invalid slow start min percent %v", environment.SlowStartMinPercent())
+	}
+
+	return NewSRSServerSlowStart(func(v *srsServerSlowStartImpl) {
+		v.window, v.aggression, v.minFactor = window, aggression, minPercent/100
+	}), nil
+}
+
+func (v *srsServerSlowStartImpl) Factor(server *SRSServer) float64 {
+	if v.window <= 0 {
+		return 1
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Remove the servers which are dead or restarted, with new ID.
+	now := time.Now()
+	for id, lastSeen := range v.lastSeen {
+		if now.Sub(lastSeen) > ServerAliveDuration {
+			delete(v.seen, id)
+			delete(v.lastSeen, id)
+		}
+	}
+
+	id := server.ID()
+	seen, ok := v.seen[id]
+	if !ok {
+		seen = now
+		// The servers already alive when proxy starts are not new.
+		if now.Sub(v.createdAt) < ServerAliveDuration {
+			seen = now.Add(-v.window)
+		}
+		v.seen[id] = seen
+	}
+	v.lastSeen[id] = now
+
+	// The factor is (elapsed/window)^(1/aggression), at least min factor, like the slow start of Envoy.
+	elapsed := now.Sub(seen)
+	if elapsed >= v.window {
+		return 1
+	}
+	factor := math.Pow(float64(elapsed)/float64(v.window), 1/v.aggression)
+	return math.Max(v.minFactor, factor)
+}
+
+func (v *srsServerSlowStartImpl) Filter(servers []*SRSServer) []*SRSServer {
+	if v.window <= 0 {
+		return servers
+	}
+
+	kept := filterServers(servers, func(server *SRSServer) bool {
+		factor := v.Factor(server)
+		return factor >= 1 || rand.Float64() < factor
+	})
+	if len(kept) == 0 {
+		return servers
+	}
+	return kept
+}
+
+// SrsServerSlowStart is the global slow start of backend servers, disabled by default.
+var SrsServerSlowStart = NewSRSServerSlowStart()
@@ -0,0 +1,146 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// StaticServer is a backend server declared in the file, in the same fields of register API.
+type StaticServer struct {
+	// The server id of SRS, mandatory.
+	ServerID string `json:"server"`
+	// The IP of SRS, mandatory.
+	IP string `json:"ip"`
+	// The RTMP listen endpoints, mandatory.
+	RTMP []string `json:"rtmp"`
+	// The HTTP Stream listen endpoints, optional.
+	HTTP []string `json:"http,omitempty"`
+	// The API listen endpoints, optional.
+	API []string `json:"api,omitempty"`
+	// The SRT listen endpoints, optional.
+	SRT []string `json:"srt,omitempty"`
+	// The RTC listen endpoints, optional.
+	RTC []string `json:"rtc,omitempty"`
+	// The device id of SRS, optional.
+	DeviceID string `json:"device_id,omitempty"`
+	// The group of SRS, to route streams to the group by policy, optional.
+	Group string `json:"group,omitempty"`
+	// The weight of SRS for weighted-random strategy, optional, default to 1.
+	Weight *int `json:"weight,omitempty"`
+	// The max number of streams of SRS, optional, default to 0 for unlimited.
+	MaxStreams int `json:"max_streams,omitempty"`
+	// The max bandwidth in Mbps of SRS, optional, default to 0 for unlimited.
+	MaxBandwidth int `json:"max_bandwidth,omitempty"`
+	// The labels of SRS, like {"region": "us-east"}, optional.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Whether the server is draining, optional.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// StaticConfig is the backend servers declared in the file.
+type StaticConfig struct {
+	// The servers.
+	Servers []*StaticServer `json:"servers"`
+}
+
+// staticDiscovery loads the backend servers from the file, and reloads it by Reload, for example, when got
+// SIGHUP. The servers removed from the file are drained, and expire later, like the other discoveries.
+type staticDiscovery struct {
+	// The file of servers.
+	filename string
+	// The servers updated to load balancer.
+	*discoveredServers
+}
+
+// NewStaticDiscoveryFromEnvironment creates the discovery of the backends file in environment, which fails
+// if the file is invalid.
+func NewStaticDiscoveryFromEnvironment(ctx context.Context, environment env.Environment) (*staticDiscovery, error) {
+	v := &staticDiscovery{
+		filename: environment.BackendsFile(), discoveredServers: newDiscoveredServers("Static", environment),
+	}
+
+	servers, err := v.load()
+	if err != nil {
+		return nil, errors.Wrapf(err, "load %v", v.filename)
+	}
+	v.sync(ctx, servers)
+
+	return v, nil
+}
+
+// Reload the servers from the file, and keep the servers if failed.
+func (v *staticDiscovery) Reload(ctx context.Context) error {
+	servers, err := v.load()
+	if err != nil {
+		return errors.Wrapf(err, "load %v", v.filename)
+	}
+
+	logger.Df(ctx, "Static discovery reload %v servers from %v", len(servers), v.filename)
+	v.sync(ctx, servers)
+	return nil
+}
+
+// load the servers from the file, key is the server ID.
+func (v *staticDiscovery) load() (map[string]*SRSServer, error) {
+	b, err := ioutil.ReadFile(v.filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", v.filename)
+	}
+
+	var config StaticConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+
+	servers := make(map[string]*SRSServer)
+	for i, s := range config.Servers {
+		if s.ServerID == "" {
+			return nil, errors.Errorf("server #%v: empty server", i)
+		}
+		if s.IP == "" {
+			return nil, errors.Errorf("server %v: empty ip", s.ServerID)
+		}
+		if len(s.RTMP) == 0 {
+			return nil, errors.Errorf("server %v: empty rtmp", s.ServerID)
+		}
+		if s.Weight != nil && *s.Weight < 0 {
+			return nil, errors.Errorf("server %v: invalid weight %v", s.ServerID, *s.Weight)
+		}
+		if s.MaxStreams < 0 || s.MaxBandwidth < 0 {
+			return nil, errors.Errorf("server %v: invalid max streams %v or bandwidth %v", s.ServerID, s.MaxStreams, s.MaxBandwidth)
+		}
+
+		server := NewSRSServer(func(srs *SRSServer) {
+			srs.IP, srs.DeviceID, srs.Group, srs.Labels = s.IP, s.DeviceID, s.Group, s.Labels
+			srs.MaxStreams, srs.MaxBandwidth, srs.Draining = s.MaxStreams, s.MaxBandwidth, s.Draining
+			srs.ServerID, srs.ServiceID, srs.PID = s.ServerID, "static", "static"
+			srs.RTMP, srs.HTTP, srs.API = s.RTMP, s.HTTP, s.API
+			srs.SRT, srs.RTC = s.SRT, s.RTC
+			srs.UpdatedAt = time.Now()
+		})
+		if err := server.ValidateEndpoints(); err != nil {
+			return nil, errors.Wrapf(err, "server %v", s.ServerID)
+		}
+		if s.Weight != nil {
+			server.Weight = *s.Weight
+		}
+		if server.Labels == nil {
+			server.Labels = make(map[string]string)
+		}
+
+		if _, ok := servers[server.ID()]; ok {
+			return nil, errors.Errorf("server %v: duplicated", s.ServerID)
+		}
+		servers[server.ID()] = server
+	}
+	return servers, nil
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+	"srsx/internal/sync"
+)
+
+// StoreLoadBalancer persists the backend servers and the stream affinity in a store.Store, such as
+// the embedded file store, so the affinity survives the restart of proxy. The HLS sessions are kept in
+// memory, because they are bound to the HTTP sessions of this proxy, while the WebRTC sessions are also
+// persisted by ufrag, to resume the WHIP or WHEP session on another proxy sharing the SQL store.
+type StoreLoadBalancer struct {
+	// The environment interface.
+	environment env.Environment
+	// The strategies to select server for new stream, of publishers and players.
+	publishStrategy, playStrategy SRSServerStrategy
+	// The store for servers and affinity.
+	store store.Store
+	// The HLS streaming, key is stream URL.
+	hlsStreamURL sync.Map[string, HLSPlayStream]
+	// The HLS streaming, key is SPBHID.
+	hlsSPBHID sync.Map[string, HLSPlayStream]
+	// The WebRTC streaming, key is stream URL.
+	rtcStreamURL sync.Map[string, RTCConnection]
+	// The WebRTC streaming, key is ufrag.
+	rtcUfrag sync.Map[string, RTCConnection]
+}
+
+// NewStoreLoadBalancer creates a new load balancer which persists state in s.
+func NewStoreLoadBalancer(environment env.Environment, s store.Store) SRSLoadBalancer {
+	return &StoreLoadBalancer{
+		environment: environment,
+		store:       s,
+	}
+}
+
+func (v *StoreLoadBalancer) Initialize(ctx context.Context) error {
+	var err error
+	if v.publishStrategy, v.playStrategy, err = newPickStrategies(v.environment); err != nil {
+		return errors.Wrapf(err, "create strategies")
+	}
+
+	server, err := NewDefaultSRSForDebugging(v.environment)
+	if err != nil {
+		return errors.Wrapf(err, "initialize default SRS")
+	}
+
+	if server != nil {
+		// The default SRS is shared by proxies, so only the leader keeps it alive.
+		if SrsLeaderElection.IsLeader() {
+			if err := v.Update(ctx, server); err != nil {
+				return errors.Wrapf(err, "update default SRS %+v", server)
+			}
+		}
+
+		// Keep alive.
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(30 * time.Second):
+					if !SrsLeaderElection.IsLeader() {
+						continue
+					}
+					if err := v.Update(ctx, server); err != nil {
+						logger.Wf(ctx, "update default SRS %+v failed, %+v", server, err)
+					}
+				}
+			}
+		}()
+		logger.Df(ctx, "StoreLB: Initialize default SRS media server, %+v", server)
+	}
+	return nil
+}
+
+func (v *StoreLoadBalancer) Update(ctx context.Context, server *SRSServer) error {
+	b, err := marshalSchema(SchemaServer, server)
+	if err != nil {
+		return errors.Wrapf(err, "marshal server %+v", server)
+	}
+
+	key := v.keyServer(server.ID())
+	if err := v.store.Set(ctx, key, b, ServerAliveDuration); err != nil {
+		return errors.Wrapf(err, "set key=%v server %+v", key, server)
+	}
+
+	v.record(ctx, "register", server.ID(), b)
+	return nil
+}
+
+func (v *StoreLoadBalancer) PickForPublish(ctx context.Context, streamURL string) (*SRSServer, error) {
+	ctx = withAffinity(ctx, SrsPickAffinity.Publish)
+	SrsServerFailback.Publish(ctx, streamURL)
+	return v.pick(ctx, v.publishStrategy, streamURL)
+}
+
+func (v *StoreLoadBalancer) PickForPlay(ctx context.Context, streamURL string) (*SRSServer, error) {
+	return v.pick(withAffinity(ctx, SrsPickAffinity.Play), v.playStrategy, streamURL)
+}
+
+// pick a backend server for streamURL by strategy, and the affinity in ctx.
+func (v *StoreLoadBalancer) pick(ctx context.Context, strategy SRSServerStrategy, streamURL string) (*SRSServer, error) {
+	// The key of picked server by affinity, empty if not sticky.
+	pk := pickKey(ctx, streamURL)
+	key := v.keyURL(pk)
+
+	// Always proxy to the same server for the same stream URL, or client by affinity, if the server is alive.
+	if pk != "" {
+		if serverKey, err := v.store.Get(ctx, key); err == nil {
+			if server, err := v.loadServer(ctx, string(serverKey)); err == nil {
+				v.record(ctx, "session", streamURL, serverKey)
+				return server, nil
+			} else if !store.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "load server %v for %v", string(serverKey), streamURL)
+			}
+		} else if !store.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "get key=%v", key)
+		}
+	}
+
+	// All servers in store are alive, because the dead servers are expired.
+	var serverKeys []string
+	var servers []*SRSServer
+	if err := v.store.Scan(ctx, v.keyServer(""), func(k string, b []byte) bool {
+		var server SRSServer
+		if err := unmarshalSchema(ctx, SchemaServer, b, &server); err != nil {
+			logger.Wf(ctx, "StoreLB: ignore invalid server key=%v, %v", k, string(b))
+			return true
+		}
+		serverKeys, servers = append(serverKeys, k), append(servers, &server)
+		return true
+	}); err != nil {
+		return nil, errors.Wrapf(err, "scan servers")
+	}
+
+	// No server found, failed.
+	if len(servers) == 0 {
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v", streamURL)
+	}
+
+	// Select a server from servers by strategy, in the group routed by policy if specified.
+	server, err := selectServer(ctx, strategy, streamURL, servers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "select server for %v", streamURL)
+	}
+
+	var serverKey string
+	for index, s := range servers {
+		if s == server {
+			serverKey = serverKeys[index]
+		}
+	}
+
+	// Update the picked server for the stream URL, or client by affinity.
+	if pk != "" {
+		if err := v.store.Set(ctx, key, []byte(serverKey), pickTTL(pk, streamURL)); err != nil {
+			return nil, errors.Wrapf(err, "set key=%v server %v", key, serverKey)
+		}
+	}
+	v.record(ctx, "session", streamURL, []byte(serverKey))
+
+	return server, nil
+}
+
+func (v *StoreLoadBalancer) Unpick(ctx context.Context, streamURL string) error {
+	for _, pk := range unpickKeys(ctx, streamURL) {
+		key := v.keyURL(pk)
+		if err := v.store.Delete(ctx, key); err != nil {
+			return errors.Wrapf(err, "delete key=%v", key)
+		}
+	}
+	return nil
+}
+
+func (v *StoreLoadBalancer) LoadHLSBySPBHID(ctx context.Context, spbhid string) (HLSPlayStream, error) {
+	// Load the HLS streaming for the SPBHID, for TS files.
+	if actual, ok := v.hlsSPBHID.Load(spbhid); !ok {
+		return nil, errors.Errorf("no HLS streaming for SPBHID %v", spbhid)
+	} else {
+		return actual, nil
+	}
+}
+
+func (v *StoreLoadBalancer) LoadOrStoreHLS(ctx context.Context, streamURL string, value HLSPlayStream) (HLSPlayStream, error) {
+	// Update the HLS streaming for the stream URL, for M3u8.
+	actual, _ := v.hlsStreamURL.LoadOrStore(streamURL, value)
+	if actual == nil {
+		return nil, errors.Errorf("load or store HLS streaming for %v failed", streamURL)
+	}
+
+	// Update the HLS streaming for the SPBHID, for TS files.
+	v.hlsSPBHID.Store(value.GetSPBHID(), actual)
+
+	return actual, nil
+}
+
+func (v *StoreLoadBalancer) StoreWebRTC(ctx context.Context, streamURL string, value RTCConnection) error {
+	// Update the WebRTC streaming for the stream URL.
+	v.rtcStreamURL.Store(streamURL, value)
+
+	// Update the WebRTC streaming for the ufrag.
+	v.rtcUfrag.Store(value.GetUfrag(), value)
+
+	b, err := marshalSchema(SchemaRTC, value)
+	if err != nil {
+		return errors.Wrapf(err, "marshal WebRTC %v", value)
+	}
+
+	key := v.keyUfrag(value.GetUfrag())
+	if err := v.store.Set(ctx, key, b, RTCAliveDuration); err != nil {
+		return errors.Wrapf(err, "set key=%v WebRTC %v", key, value)
+	}
+	return nil
+}
+
+func (v *StoreLoadBalancer) LoadWebRTCByUfrag(ctx context.Context, ufrag string) (RTCConnection, error) {
+	if actual, ok := v.rtcUfrag.Load(ufrag); ok {
+		return actual, nil
+	}
+
+	// Resume the WebRTC streaming stored by another proxy.
+	key := v.keyUfrag(ufrag)
+	b, err := v.store.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "no WebRTC streaming for ufrag %v", ufrag)
+	}
+	return buildRTC(ctx, key, b)
+}
+
+func (v *StoreLoadBalancer) Stats(ctx context.Context) (map[string]int, error) {
+	stats := map[string]int{
+		"hls":    v.hlsStreamURL.Len(),
+		"spbhid": v.hlsSPBHID.Len(),
+		"rtc":    v.rtcStreamURL.Len(),
+		"ufrag":  v.rtcUfrag.Len(),
+	}
+
+	for name, prefix := range map[string]string{"servers": v.keyServer(""), "picked": v.keyURL("")} {
+		var n int
+		if err := v.store.Scan(ctx, prefix, func(key string, value []byte) bool {
+			n++
+			return true
+		}); err != nil {
+			return nil, errors.Wrapf(err, "scan %v", prefix)
+		}
+		stats[name] = n
+	}
+	return stats, nil
+}
+
+func (v *StoreLoadBalancer) Close() error {
+	return nil
+}
+
+// record writes the history event, if the store supports history, such as SQL. The failure is
+// ignored, because the history is not required by proxy.
+func (v *StoreLoadBalancer) record(ctx context.Context, kind, key string, value []byte) {
+	if h, ok := v.store.(store.Historian); ok {
+		if err := h.Record(ctx, kind, key, value); err != nil {
+			logger.Wf(ctx, "StoreLB: record %v key=%v failed, %+v", kind, key, err)
+		}
+	}
+}
+
+// loadServer loads the server by key, returns store.ErrNotFound if server is dead.
+func (v *StoreLoadBalancer) loadServer(ctx context.Context, serverKey string) (*SRSServer, error) {
+	if !strings.HasPrefix(serverKey, v.keyServer("")) {
+		return nil, store.ErrNotFound
+	}
+
+	b, err := v.store.Get(ctx, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var server SRSServer
+	if err := unmarshalSchema(ctx, SchemaServer, b, &server); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal key=%v server %v", serverKey, string(b))
+	}
+	return &server, nil
+}
+
+func (v *StoreLoadBalancer) keyURL(streamURL string) string {
+	return fmt.Sprintf("srs-proxy-url:%v", streamURL)
+}
+
+func (v *StoreLoadBalancer) keyUfrag(ufrag string) string {
+	return fmt.Sprintf("srs-proxy-ufrag:%v", ufrag)
+}
+
+func (v *StoreLoadBalancer) keyServer(serverID string) string {
+	return fmt.Sprintf("srs-proxy-server:%v", serverID)
+}
@@ -0,0 +1,509 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/dryrun"
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The number of virtual nodes of each server in the hash ring, to balance the streams between servers.
+const consistentHashReplicas = 160
+
+// SRSServerStrategy selects a backend server for a new stream, from the alive servers.
+type SRSServerStrategy interface {
+	// Select a server in servers for streamURL, the servers is not empty.
+	Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error)
+}
+
+// NewSRSServerStrategy creates the strategy by name, such as random, consistent-hash, least-connections,
+// weighted-random, load-aware or latency-aware.
+func NewSRSServerStrategy(name string) (SRSServerStrategy, error) {
+	switch name {
+	case "", "random":
+		return &randomStrategy{}, nil
+	case "consistent-hash":
+		return &consistentHashStrategy{}, nil
+	case "least-connections":
+		return &leastConnectionsStrategy{connections: SrsServerConnections}, nil
+	case "weighted-random":
+		return &weightedRandomStrategy{}, nil
+	case "load-aware":
+		return &loadAwareStrategy{monitor: SrsServerLoadMonitor}, nil
+	case "latency-aware":
+		return &latencyAwareStrategy{latency: SrsServerLatency}, nil
+	}
+	return nil, errors.Errorf("invalid strategy %v", name)
+}
+
+// newPickStrategies creates the independent strategies of publishers and players in environment, which are
+// the strategy of load balancer if not specified.
+func newPickStrategies(environment env.Environment) (publish, play SRSServerStrategy, err error) {
+	publishName, playName := environment.PublishStrategy(), environment.PlayStrategy()
+	if publishName == "" {
+		publishName = environment.LoadBalancerStrategy()
+	}
+	if playName == "" {
+		playName = environment.LoadBalancerStrategy()
+	}
+
+	if publish, err = NewSRSServerStrategy(publishName); err != nil {
+		return nil, nil, errors.Wrapf(err, "create publish strategy")
+	}
+	if play, err = NewSRSServerStrategy(playName); err != nil {
+		return nil, nil, errors.Wrapf(err, "create play strategy")
+	}
+	return publish, play, nil
+}
+
+// serverGroupKey is the context key of server group.
+type serverGroupKey struct{}
+
+// WithServerGroup returns a context to select the server in group for new stream, for example, the
+// stream is routed to the group by policy.
+func WithServerGroup(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, serverGroupKey{}, group)
+}
+
+// selectServer selects a server in servers by strategy, only the servers in the group of ctx are
+// selected if specified, or in the pool and matched the selector routed by vhost or app, and matched the
+// selector of ctx if specified. The draining servers, the servers flagged by probe, the servers with
+// circuit breaker open, and the servers which reach the max streams, are never selected. The servers in
+// the nearest region of client are preferred. The new servers in slow start window are selected in a
+// ramping share.
+func selectServer(ctx context.Context, strategy SRSServerStrategy, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	available := filterServers(servers, func(server *SRSServer) bool {
+		return !server.Draining && !SrsServerDrainer.IsDraining(server)
+	})
+	if len(available) == 0 {
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v, all %v servers draining", streamURL, len(servers))
+	}
+	servers = available
+
+	// The servers flagged by the probe error are not selected, because the endpoints are unreachable.
+	probed := filterServers(servers, func(server *SRSServer) bool {
+		return server.ProbeError == ""
+	})
+	if len(probed) == 0 {
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v, all %v servers flagged by probe", streamURL, len(servers))
+	}
+	servers = probed
+
+	// The servers with circuit breaker open are not selected, until cooldown.
+	healthy := filterServers(servers, SrsServerBreaker.Available)
+	if len(healthy) == 0 {
+		return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v, all %v servers circuit open", streamURL, len(servers))
+	}
+	servers = healthy
+
+	// The group routed by policy overrides the rule routed by vhost or app.
+	if group, _ := ctx.Value(serverGroupKey{}).(string); group != "" {
+		servers = filterServers(servers, func(server *SRSServer) bool {
+			return SrsServerRouter.InPool(server, group)
+		})
+		if len(servers) == 0 {
+			return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v in group %v", streamURL, group)
+		}
+	} else if rule := SrsServerRouter.Route(ctx, streamURL); rule != nil {
+		matched := filterServers(servers, func(server *SRSServer) bool {
+			return rule.Matches(SrsServerRouter, server)
+		})
+
+		// Fail over to the fallback pool if no server of the preferred pool is available.
+		failover := len(matched) == 0 && rule.Fallback != ""
+		if failover {
+			matched = filterServers(servers, func(server *SRSServer) bool {
+				return SrsServerRouter.InPool(server, rule.Fallback)
+			})
+		}
+
+		// Select from all servers in dry-run mode, and log the servers the rule would route to.
+		if dryrun.SrsDryRun.Enforce(ctx, dryrun.KindRoute, "route %v by rule %v to %v, pool=%v, selector=%v",
+			streamURL, rule.Name, serverIDs(matched), rule.Pool, rule.Selector) {
+			if len(matched) == 0 {
+				return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v by rule %v, pool=%v, selector=%v, fallback=%v",
+					streamURL, rule.Name, rule.Pool, rule.Selector, rule.Fallback)
+			}
+			servers = matched
+
+			if rule.Fallback != "" {
+				SrsServerFailback.Picked(ctx, streamURL, rule, failover)
+			}
+		}
+	}
+
+	// The selector of client is always applied, to narrow down the servers.
+	if selector, _ := ctx.Value(serverSelectorKey{}).(*LabelSelector); selector != nil {
+		servers = filterServers(servers, func(server *SRSServer) bool {
+			return selector.Matches(server.Labels)
+		})
+		if len(servers) == 0 {
+			return nil, errors.Wrapf(ErrNoServerAvailable, "pick %v by selector %v", streamURL, selector)
+		}
+	}
+
+	// The servers which reach the max streams are not selected, and the cluster is full if all servers are full.
+	room := filterServers(servers, func(server *SRSServer) bool {
+		return !SrsServerCapacity.Full(server)
+	})
+	if len(room) == 0 {
+		return nil, errors.Wrapf(ErrClusterFull, "pick %v, all %v servers full", streamURL, len(servers))
+	}
+	servers = room
+
+	// The servers without the bandwidth budget for the forecasted bitrate of stream are not selected.
+	room = filterServers(servers, func(server *SRSServer) bool {
+		return !SrsServerBandwidth.Full(server, streamURL)
+	})
+	if len(room) == 0 {
+		return nil, errors.Wrapf(ErrClusterFull, "pick %v, all %v servers out of bandwidth, forecast=%.1fMbps",
+			streamURL, len(servers), SrsServerBandwidth.Forecast(streamURL))
+	}
+	servers = room
+
+	// Prefer the servers in the nearest region of client, and fall back to the next nearest regions.
+	servers = SrsServerRegions.Filter(ctx, streamURL, servers)
+
+	// Ramp up the traffic share of the new servers in slow start window.
+	servers = SrsServerSlowStart.Filter(servers)
+
+	// Select by the key of affinity if sticky by client, so the consistent hashing spreads the clients of
+	// a stream to servers.
+	key := streamURL
+	if pk := pickKey(ctx, streamURL); pk != "" {
+		key = pk
+	}
+
+	server, err := strategy.Select(ctx, key, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	SrsServerBreaker.Attempt(server)
+	SrsServerCapacity.Attempt(server)
+	SrsServerBandwidth.Attempt(server, streamURL)
+	return server, nil
+}
+
+// serverIDs returns the server IDs of servers, like [origin1,origin2], for logging.
+func serverIDs(servers []*SRSServer) string {
+	var ids []string
+	for _, server := range servers {
+		ids = append(ids, server.ServerID)
+	}
+	return fmt.Sprintf("[%v]", strings.Join(ids, ","))
+}
+
+// filterServers returns the servers matched by filter.
+func filterServers(servers []*SRSServer, filter func(server *SRSServer) bool) []*SRSServer {
+	var matched []*SRSServer
+	for _, server := range servers {
+		if filter(server) {
+			matched = append(matched, server)
+		}
+	}
+	return matched
+}
+
+// randomStrategy selects a server randomly.
+type randomStrategy struct{}
+
+func (v *randomStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	// Use global rand which is thread-safe since Go 1.20.
+	return servers[rand.Intn(len(servers))], nil
+}
+
+// weightedRandomStrategy selects a server randomly in proportion to the weight of server, so the
+// operators are able to gradually shift traffic to new or more powerful servers. The server with zero
+// weight is not selected, unless all servers are zero, then selects randomly.
+type weightedRandomStrategy struct{}
+
+func (v *weightedRandomStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	var total int
+	for _, server := range servers {
+		if server.Weight > 0 {
+			total += server.Weight
+		}
+	}
+	if total == 0 {
+		return servers[rand.Intn(len(servers))], nil
+	}
+
+	n := rand.Intn(total)
+	for _, server := range servers {
+		if server.Weight <= 0 {
+			continue
+		}
+		if n -= server.Weight; n < 0 {
+			return server, nil
+		}
+	}
+	return servers[len(servers)-1], nil
+}
+
+// The max number of hash rings cached, one for each set of servers, such as the servers of each group.
+const consistentHashMaxRings = 16
+
+// consistentHashNode is a virtual node of server in the hash ring.
+type consistentHashNode struct {
+	// The hash of virtual node.
+	hash uint32
+	// The key of server, the server id of SRS.
+	key string
+}
+
+// consistentHashStrategy maps the stream to a server by the hash ring, so the stream maps to the same
+// server deterministically, and only the streams of the joined or left server are remapped. The rings are
+// cached by the keys of servers, so the ring is only built when the servers join or leave.
+type consistentHashStrategy struct {
+	// The hash rings, key is the sorted keys of servers.
+	rings map[string][]consistentHashNode
+	// The lock to protect rings.
+	lock stdSync.Mutex
+}
+
+func (v *consistentHashStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	// Use the server id of SRS, which does not change when restarted, and the latest one is used if
+	// there are multiple servers with the same server id, for example, the restarted one.
+	latest := make(map[string]*SRSServer)
+	for _, server := range servers {
+		key := server.ServerID
+		if key == "" {
+			key = server.ID()
+		}
+		if current, ok := latest[key]; !ok || server.UpdatedAt.After(current.UpdatedAt) {
+			latest[key] = server
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ring := v.ring(keys)
+
+	// The first node clockwise from the hash of stream.
+	hash := crc32.ChecksumIEEE([]byte(streamURL))
+	index := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if index == len(ring) {
+		index = 0
+	}
+	return latest[ring[index].key], nil
+}
+
+// ring returns the cached hash ring of the sorted keys of servers, or builds it if not cached.
+func (v *consistentHashStrategy) ring(keys []string) []consistentHashNode {
+	id := strings.Join(keys, "\n")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if ring, ok := v.rings[id]; ok {
+		return ring
+	}
+
+	ring := make([]consistentHashNode, 0, len(keys)*consistentHashReplicas)
+	for _, key := range keys {
+		for i := 0; i < consistentHashReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v#%v", key, i)))
+			ring = append(ring, consistentHashNode{hash: hash, key: key})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].key < ring[j].key
+	})
+
+	// Drop all rings if full, which are the stale sets of servers, because the servers seldom change.
+	if v.rings == nil || len(v.rings) >= consistentHashMaxRings {
+		v.rings = make(map[string][]consistentHashNode)
+	}
+	v.rings[id] = ring
+	return ring
+}
+
+// leastConnectionsStrategy selects the server with the least active sessions on this proxy, and
+// selects randomly between the servers with the same sessions.
+type leastConnectionsStrategy struct {
+	// The active sessions of servers.
+	connections SRSServerConnections
+}
+
+func (v *leastConnectionsStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	var least []*SRSServer
+	var leastCount int
+	for _, server := range servers {
+		count := v.connections.Count(server)
+		if len(least) == 0 || count < leastCount {
+			least, leastCount = []*SRSServer{server}, count
+		} else if count == leastCount {
+			least = append(least, server)
+		}
+	}
+	return least[rand.Intn(len(least))], nil
+}
+
+// loadAwareStrategy selects a server randomly in proportion to the headroom of CPU and memory, queried
+// from the HTTP API of SRS, and the overloaded server gets no new stream. The server not queried yet or
+// failed to query is regarded as idle, and the least loaded server is selected if all are overloaded.
+type loadAwareStrategy struct {
+	// The load of servers.
+	monitor SRSServerLoadMonitor
+}
+
+func (v *loadAwareStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	v.monitor.Watch(servers)
+
+	// The headroom of server in percent, at least 1 so the busy server is still able to be selected.
+	headroom := func(load *SRSServerLoad) int {
+		if load == nil || load.Error != "" {
+			return 100
+		}
+		if used := int(math.Max(load.CPU, load.Memory)); used < 99 {
+			return 100 - used
+		}
+		return 1
+	}
+
+	var candidates []*SRSServer
+	var weights []int
+	var total int
+	var least *SRSServer
+	var leastHeadroom int
+	for _, server := range servers {
+		load := v.monitor.Load(server)
+		room := headroom(load)
+		if least == nil || room > leastHeadroom {
+			least, leastHeadroom = server, room
+		}
+		if load != nil && load.Error == "" && load.Overloaded {
+			continue
+		}
+		candidates, weights, total = append(candidates, server), append(weights, room), total+room
+	}
+	if len(candidates) == 0 {
+		logger.Wf(ctx, "All %v servers overloaded, select %v for %v", len(servers), least, streamURL)
+		return least, nil
+	}
+
+	n := rand.Intn(total)
+	for i, server := range candidates {
+		if n -= weights[i]; n < 0 {
+			return server, nil
+		}
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// latencyAwareStrategy selects a server randomly in inverse proportion to the moving average of latency to
+// dial and get the first response of server, so the faster server gets more new streams, and the slower server
+// still gets a few to measure whether it recovers. The server without latency is regarded as the fastest, to be
+// measured soon.
+type latencyAwareStrategy struct {
+	// The latency of servers.
+	latency SRSServerLatency
+}
+
+func (v *latencyAwareStrategy) Select(ctx context.Context, streamURL string, servers []*SRSServer) (*SRSServer, error) {
+	latencies := make([]time.Duration, len(servers))
+	var fastest time.Duration
+	for i, server := range servers {
+		latency := v.latency.Latency(server)
+		if latency > 0 && latency < latencyMin {
+			latency = latencyMin
+		}
+		if latency > 0 && (fastest == 0 || latency < fastest) {
+			fastest = latency
+		}
+		latencies[i] = latency
+	}
+	if fastest == 0 {
+		return servers[rand.Intn(len(servers))], nil
+	}
+
+	var weights []float64
+	var total float64
+	for _, latency := range latencies {
+		if latency == 0 {
+			latency = fastest
+		}
+		weight := float64(fastest) / float64(latency)
+		weights, total = append(weights, weight), total+weight
+	}
+
+	n := rand.Float64() * total
+	for i, server := range servers {
+		if n -= weights[i]; n < 0 {
+			return server, nil
+		}
+	}
+	return servers[len(servers)-1], nil
+}
+
+// SRSServerConnections counts the active sessions of each backend server on this proxy.
+type SRSServerConnections interface {
+	// Acquire a session of server, returns the function to release it when the session is closed.
+	// The release function is safe to be called more than once.
+	Acquire(server *SRSServer) func()
+	// Count the active sessions of server.
+	Count(server *SRSServer) int
+}
+
+type srsServerConnectionsImpl struct {
+	// The active sessions, key is the server ID.
+	counters map[string]int
+	// The lock to protect counters.
+	lock stdSync.Mutex
+}
+
+// NewSRSServerConnections creates a new counter of backend server sessions.
+func NewSRSServerConnections() SRSServerConnections {
+	return &srsServerConnectionsImpl{counters: make(map[string]int)}
+}
+
+func (v *srsServerConnectionsImpl) Acquire(server *SRSServer) func() {
+	key := server.ID()
+
+	v.lock.Lock()
+	v.counters[key]++
+	v.lock.Unlock()
+
+	var once stdSync.Once
+	return func() {
+		once.Do(func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			if v.counters[key]--; v.counters[key] <= 0 {
+				delete(v.counters, key)
+			}
+		})
+	}
+}
+
+func (v *srsServerConnectionsImpl) Count(server *SRSServer) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.counters[server.ID()]
+}
+
+// SrsServerConnections is the global counter of backend server sessions.
+var SrsServerConnections = NewSRSServerConnections()
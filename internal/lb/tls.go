@@ -0,0 +1,148 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// The protocols of backend server over TCP, which might be over TLS.
+const (
+	BackendProtocolRTMP = "rtmp"
+	BackendProtocolHTTP = "http"
+	BackendProtocolAPI  = "api"
+)
+
+// SRSServerTLS is the TLS to backend servers, to re-encrypt the traffic when the proxy and SRS traverse
+// untrusted networks. The RTMP is rtmps, while the HTTP and API are https, on the same ports of backend.
+type SRSServerTLS interface {
+	// Enabled returns whether connect to the protocol of backend servers over TLS.
+	Enabled(protocol string) bool
+	// Scheme returns the scheme of URL to the HTTP or API of backend servers, http or https.
+	Scheme(protocol string) string
+	// Client does the TLS handshake over the TCP conn to the protocol of backend server, or returns the conn
+	// itself if not enabled.
+	Client(ctx context.Context, protocol string, conn net.Conn) (net.Conn, error)
+	// HTTPClient returns the client to request the HTTP and API of backend servers.
+	HTTPClient() *http.Client
+}
+
+type srsServerTLSImpl struct {
+	// The protocols over TLS, key is the protocol.
+	protocols map[string]bool
+	// The TLS config to verify the backend servers.
+	config *tls.Config
+	// The client to request the HTTP and API of backend servers.
+	client *http.Client
+}
+
+// NewSRSServerTLS creates the TLS to backend servers by options, which is disabled by default.
+func NewSRSServerTLS(opts ...func(*srsServerTLSImpl)) SRSServerTLS {
+	v := &srsServerTLSImpl{protocols: make(map[string]bool), client: http.DefaultClient}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSRSServerTLSFromEnvironment creates the TLS to backend servers by the protocols, CA and server name in
+// environment.
+func NewSRSServerTLSFromEnvironment(environment env.Environment) (SRSServerTLS, error) {
+	protocols := make(map[string]bool)
+	switch value := environment.BackendTLS(); value {
+	case "", "off":
+		return NewSRSServerTLS(), nil
+	case "on":
+		for _, protocol := range []string{BackendProtocolRTMP, BackendProtocolHTTP, BackendProtocolAPI} {
+			protocols[protocol] = true
+		}
+	default:
+		for _, protocol := range strings.Split(value, ",") {
+			switch protocol = strings.TrimSpace(protocol); protocol {
+			case BackendProtocolRTMP, BackendProtocolHTTP, BackendProtocolAPI:
+				protocols[protocol] = true
+			default:
+				return nil, errors.Errorf("invalid backend tls protocol %v of %v", protocol, value)
+			}
+		}
+	}
+
+	config := &tls.Config{ServerName: environment.BackendTLSServerName(), MinVersion: tls.VersionTLS12}
+	if caFile := environment.BackendTLSCA(); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read ca %v", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("invalid ca %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return NewSRSServerTLS(func(v *srsServerTLSImpl) {
+		v.protocols, v.config, v.client = protocols, config, &http.Client{Transport: transport}
+	}), nil
+}
+
+func (v *srsServerTLSImpl) Enabled(protocol string) bool {
+	return v.protocols[protocol]
+}
+
+func (v *srsServerTLSImpl) Scheme(protocol string) string {
+	if v.protocols[protocol] {
+		return "https"
+	}
+	return "http"
+}
+
+func (v *srsServerTLSImpl) Client(ctx context.Context, protocol string, conn net.Conn) (net.Conn, error) {
+	if !v.protocols[protocol] {
+		return conn, nil
+	}
+
+	// Verify the certificate by the IP of backend, if no server name.
+	config := v.config.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, errors.Wrapf(err, "tls handshake with %v", conn.RemoteAddr())
+	}
+	return tlsConn, nil
+}
+
+func (v *srsServerTLSImpl) HTTPClient() *http.Client {
+	return v.client
+}
+
+func (v *srsServerTLSImpl) String() string {
+	var protocols []string
+	for _, protocol := range []string{BackendProtocolRTMP, BackendProtocolHTTP, BackendProtocolAPI} {
+		if v.protocols[protocol] {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return fmt.Sprintf("protocols=%v", strings.Join(protocols, ","))
+}
+
+// SrsServerTLS is the global TLS to backend servers.
+var SrsServerTLS = NewSRSServerTLS()
@@ -0,0 +1,65 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+
+	"srsx/internal/errors"
+	"srsx/internal/rtmp"
+)
+
+// flvTag is an audio, video or script tag in FLV file.
+type flvTag struct {
+	// The RTMP message type, same to FLV tag type.
+	MessageType rtmp.MessageType
+	// The timestamp in milliseconds.
+	Timestamp uint64
+	// The tag data.
+	Payload []byte
+}
+
+// readFLVTags reads all tags in FLV file, see https://veovera.org/docs/legacy/video-file-format-v10-1-spec.pdf
+func readFLVTags(filename string) ([]*flvTag, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file")
+	}
+
+	// FLV header 9 bytes, and the first previous tag size 4 bytes.
+	if len(b) < 13 || string(b[:3]) != "FLV" {
+		return nil, errors.Errorf("invalid flv header")
+	}
+
+	// The data offset is the size of header, at least 9 bytes, followed by the first previous tag size.
+	offset := uint64(binary.BigEndian.Uint32(b[5:]))
+	if offset < 9 || offset+4 > uint64(len(b)) {
+		return nil, errors.Errorf("invalid flv data offset %v of %v bytes", offset, len(b))
+	}
+	p := b[offset+4:]
+
+	var tags []*flvTag
+	for len(p) >= 11 {
+		typ := rtmp.MessageType(p[0])
+		size := int(binary.BigEndian.Uint32(p) & 0x00ffffff)
+		timestamp := uint64(p[4])<<16 | uint64(p[5])<<8 | uint64(p[6]) | uint64(p[7])<<24
+		p = p[11:]
+
+		// Ignore the last truncated tag, for the file which is still recording.
+		if len(p) < size+4 {
+			break
+		}
+
+		if typ == rtmp.MessageTypeAudio || typ == rtmp.MessageTypeVideo || typ == rtmp.MessageTypeAMF0Data {
+			tags = append(tags, &flvTag{MessageType: typ, Timestamp: timestamp, Payload: p[:size]})
+		}
+		p = p[size+4:]
+	}
+
+	if len(tags) == 0 {
+		return nil, errors.Errorf("no tags")
+	}
+	return tags, nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// runFLVPlayer plays the HTTP-FLV stream until the context is cancelled.
+func runFLVPlayer(ctx context.Context, m *Metrics, streamURL string) error {
+	starttime := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", streamURL)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", streamURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("play %v failed, status=%v", streamURL, resp.Status)
+	}
+	m.Connected(time.Since(starttime))
+
+	buf := make([]byte, 32*1024)
+	for first := true; ctx.Err() == nil; first = false {
+		n, err := resp.Body.Read(buf)
+		if n > 0 && first {
+			m.FirstByte(time.Since(starttime))
+			logger.Df(ctx, "FLV play %v, first byte cost=%v", streamURL, time.Since(starttime))
+		}
+		m.AddBytes(n)
+
+		if err == io.EOF {
+			return errors.Errorf("stream %v EOF", streamURL)
+		} else if err != nil {
+			return errors.Wrapf(err, "read %v", streamURL)
+		}
+	}
+	return nil
+}
+
+// runHLSPlayer plays the HLS stream until the context is cancelled, which refreshes the m3u8 and
+// downloads the new segments, like a typical HLS player.
+func runHLSPlayer(ctx context.Context, m *Metrics, streamURL string) error {
+	starttime := time.Now()
+
+	base, err := url.Parse(streamURL)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", streamURL)
+	}
+
+	played := make(map[string]bool)
+	for first := true; ctx.Err() == nil; first = false {
+		segments, err := fetchM3u8(ctx, m, base.String())
+		if err != nil {
+			return errors.Wrapf(err, "fetch m3u8 %v", streamURL)
+		}
+		if first {
+			m.Connected(time.Since(starttime))
+		}
+
+		for _, segment := range segments {
+			if played[segment] {
+				continue
+			}
+			played[segment] = true
+
+			u, err := base.Parse(segment)
+			if err != nil {
+				return errors.Wrapf(err, "parse segment %v", segment)
+			}
+
+			n, err := fetchSegment(ctx, u.String())
+			if err != nil {
+				return errors.Wrapf(err, "fetch segment %v", u.String())
+			}
+			if len(played) == 1 {
+				m.FirstByte(time.Since(starttime))
+				logger.Df(ctx, "HLS play %v, first segment cost=%v", streamURL, time.Since(starttime))
+			}
+			m.AddBytes(int(n))
+		}
+
+		// Refresh the m3u8 about every segment duration.
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+	return nil
+}
+
+// fetchM3u8 requests the m3u8 and returns the segment URLs in it.
+func fetchM3u8(ctx context.Context, m *Metrics, m3u8URL string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m3u8URL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("status=%v", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read body")
+	}
+	m.AddBytes(len(b))
+
+	var segments []string
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	return segments, nil
+}
+
+// fetchSegment downloads the segment and returns the size of it.
+func fetchSegment(ctx context.Context, segmentURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, segmentURL, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "create request")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("status=%v", resp.Status)
+	}
+
+	return io.Copy(ioutil.Discard, resp.Body)
+}
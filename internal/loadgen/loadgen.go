@@ -0,0 +1,246 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The ramp profiles, to control how fast the clients are started.
+const (
+	// Start all clients at once.
+	RampInstant = "instant"
+	// Start clients one by one, evenly spread over the ramp duration.
+	RampLinear = "linear"
+	// Start clients in batches of RampStep, evenly spread over the ramp duration.
+	RampStep = "step"
+)
+
+// Config is the configuration for the load generator.
+type Config struct {
+	// The RTMP endpoint of proxy, like 127.0.0.1:1935.
+	RTMP string
+	// The HTTP stream endpoint of proxy, like 127.0.0.1:8080.
+	HTTP string
+	// The HTTP API endpoint of proxy for WHEP, like 127.0.0.1:1985.
+	API string
+	// The app of streams.
+	App string
+	// The stream name prefix, stream is named as prefix-index.
+	Stream string
+
+	// The number of RTMP publishers.
+	Publishers int
+	// The number of HTTP-FLV players.
+	FLVPlayers int
+	// The number of HLS players.
+	HLSPlayers int
+	// The number of WHEP players.
+	WHEPPlayers int
+
+	// The ramp profile, instant, linear or step.
+	Ramp string
+	// The duration to ramp up all clients.
+	RampDuration time.Duration
+	// The number of clients to start in each step, for step ramp profile.
+	RampStepSize int
+	// The duration to run the test, after all clients are started.
+	Duration time.Duration
+	// The interval to print the report.
+	ReportInterval time.Duration
+
+	// The FLV file to publish in loop, optional. Publish synthetic audio stream if empty.
+	Source string
+	// The bitrate in kbps of each publisher, for synthetic stream.
+	Bitrate int
+}
+
+// LoadGenerator simulates publishers and players against the proxy.
+type LoadGenerator interface {
+	// Run starts all clients by the ramp profile, and blocks until the duration elapsed or the
+	// context is cancelled. Returns the final report.
+	Run(ctx context.Context) (*Report, error)
+}
+
+type loadGeneratorImpl struct {
+	// The configuration.
+	config *Config
+	// The metrics of all clients.
+	report *Report
+	// The tags of source FLV, to publish in loop.
+	source []*flvTag
+	// The wait group for all clients.
+	wg stdSync.WaitGroup
+}
+
+// NewLoadGenerator creates a new LoadGenerator by config.
+func NewLoadGenerator(config *Config) LoadGenerator {
+	return &loadGeneratorImpl{
+		config: config,
+		report: NewReport(),
+	}
+}
+
+// client is a simulated publisher or player, which blocks until done or context is cancelled.
+type client struct {
+	// The kind of client, like rtmp-publish or flv-play.
+	kind string
+	// The stream name.
+	stream string
+	// The function to run the client.
+	run func(ctx context.Context, m *Metrics) error
+}
+
+func (v *loadGeneratorImpl) Run(ctx context.Context) (*Report, error) {
+	if v.config.Source != "" {
+		source, err := readFLVTags(v.config.Source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read source %v", v.config.Source)
+		}
+		v.source = source
+	}
+
+	clients, err := v.buildClients()
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, errors.Errorf("no client, please set publishers or players")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Print the report periodically.
+	if v.config.ReportInterval > 0 {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(v.config.ReportInterval):
+					logger.Df(ctx, "Report %v", v.report)
+				}
+			}
+		}()
+	}
+
+	// Start all clients by ramp profile.
+	logger.Df(ctx, "Start %v clients by %v ramp in %v", len(clients), v.config.Ramp, v.config.RampDuration)
+	for i, c := range clients {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if delay := v.rampDelay(i, len(clients)); delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+
+		v.wg.Add(1)
+		go func(c *client) {
+			defer v.wg.Done()
+
+			ctx := logger.WithContext(ctx)
+			m := v.report.Metrics(c.kind)
+			m.Started()
+			defer m.Stopped()
+
+			if err := c.run(ctx, m); err != nil && ctx.Err() == nil {
+				m.Failed()
+				logger.Wf(ctx, "Client %v for %v failed, err %+v", c.kind, c.stream, err)
+			}
+		}(c)
+	}
+
+	// Wait for test duration, then stop all clients.
+	select {
+	case <-ctx.Done():
+	case <-time.After(v.config.Duration):
+	}
+	cancel()
+	v.wg.Wait()
+
+	return v.report, nil
+}
+
+// rampDelay returns the delay before starting the index-th client of total clients.
+func (v *loadGeneratorImpl) rampDelay(index, total int) time.Duration {
+	if index == 0 || total <= 1 || v.config.RampDuration <= 0 {
+		return 0
+	}
+
+	switch v.config.Ramp {
+	case RampLinear:
+		return v.config.RampDuration / time.Duration(total-1)
+	case RampStep:
+		step := v.config.RampStepSize
+		if step <= 0 {
+			step = 1
+		}
+		if index%step != 0 {
+			return 0
+		}
+		steps := (total + step - 1) / step
+		if steps <= 1 {
+			return 0
+		}
+		return v.config.RampDuration / time.Duration(steps-1)
+	}
+	return 0
+}
+
+// buildClients creates the publishers first then players, so players always have streams to play.
+func (v *loadGeneratorImpl) buildClients() ([]*client, error) {
+	c := v.config
+	switch c.Ramp {
+	case RampInstant, RampLinear, RampStep:
+	default:
+		return nil, errors.Errorf("invalid ramp profile %v", c.Ramp)
+	}
+
+	// The number of streams, players are spread over all streams.
+	streams := c.Publishers
+	if streams <= 0 {
+		streams = 1
+	}
+	streamName := func(i int) string {
+		return fmt.Sprintf("%v-%v", c.Stream, i%streams)
+	}
+
+	var clients []*client
+	for i := 0; i < c.Publishers; i++ {
+		stream := streamName(i)
+		clients = append(clients, &client{kind: "rtmp-publish", stream: stream, run: func(ctx context.Context, m *Metrics) error {
+			return runRTMPPublisher(ctx, m, c.RTMP, c.App, stream, v.source, c.Bitrate)
+		}})
+	}
+	for i := 0; i < c.FLVPlayers; i++ {
+		stream := streamName(i)
+		clients = append(clients, &client{kind: "flv-play", stream: stream, run: func(ctx context.Context, m *Metrics) error {
+			return runFLVPlayer(ctx, m, fmt.Sprintf("http://%v/%v/%v.flv", c.HTTP, c.App, stream))
+		}})
+	}
+	for i := 0; i < c.HLSPlayers; i++ {
+		stream := streamName(i)
+		clients = append(clients, &client{kind: "hls-play", stream: stream, run: func(ctx context.Context, m *Metrics) error {
+			return runHLSPlayer(ctx, m, fmt.Sprintf("http://%v/%v/%v.m3u8", c.HTTP, c.App, stream))
+		}})
+	}
+	for i := 0; i < c.WHEPPlayers; i++ {
+		stream := streamName(i)
+		clients = append(clients, &client{kind: "whep-play", stream: stream, run: func(ctx context.Context, m *Metrics) error {
+			return runWHEPPlayer(ctx, m, fmt.Sprintf("http://%v/rtc/v1/whep/?app=%v&stream=%v", c.API, c.App, stream))
+		}})
+	}
+	return clients, nil
+}
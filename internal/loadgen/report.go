@@ -0,0 +1,160 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// Report is the metrics of all kinds of clients.
+type Report struct {
+	// The start time of test.
+	start time.Time
+	// The metrics of each kind of client.
+	metrics map[string]*Metrics
+	// The lock for metrics.
+	lock stdSync.Mutex
+}
+
+func NewReport() *Report {
+	return &Report{
+		start:   time.Now(),
+		metrics: make(map[string]*Metrics),
+	}
+}
+
+// Metrics returns the metrics for the kind of client, create one if not exists.
+func (v *Report) Metrics(kind string) *Metrics {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if m, ok := v.metrics[kind]; ok {
+		return m
+	}
+
+	m := &Metrics{kind: kind}
+	v.metrics[kind] = m
+	return m
+}
+
+func (v *Report) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var kinds []string
+	for kind := range v.metrics {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("elapsed=%v", time.Since(v.start).Round(time.Second)))
+	for _, kind := range kinds {
+		sb.WriteString(", ")
+		sb.WriteString(v.metrics[kind].String())
+	}
+	return sb.String()
+}
+
+// Metrics is the metrics for one kind of client.
+type Metrics struct {
+	// The kind of client.
+	kind string
+
+	// The number of clients started.
+	started int64
+	// The number of clients alive.
+	active int64
+	// The number of clients failed.
+	failed int64
+	// The bytes sent or received.
+	bytes int64
+
+	// The latency to establish the session, like RTMP publish start or HTTP response.
+	connect Latency
+	// The latency to receive the first media bytes.
+	firstByte Latency
+}
+
+func (v *Metrics) Started() {
+	atomic.AddInt64(&v.started, 1)
+	atomic.AddInt64(&v.active, 1)
+}
+
+func (v *Metrics) Stopped() {
+	atomic.AddInt64(&v.active, -1)
+}
+
+func (v *Metrics) Failed() {
+	atomic.AddInt64(&v.failed, 1)
+}
+
+func (v *Metrics) AddBytes(n int) {
+	atomic.AddInt64(&v.bytes, int64(n))
+}
+
+func (v *Metrics) Connected(d time.Duration) {
+	v.connect.Add(d)
+}
+
+func (v *Metrics) FirstByte(d time.Duration) {
+	v.firstByte.Add(d)
+}
+
+func (v *Metrics) String() string {
+	return fmt.Sprintf("%v(started=%v, active=%v, failed=%v, bytes=%v, connect=%v, first-byte=%v)",
+		v.kind, atomic.LoadInt64(&v.started), atomic.LoadInt64(&v.active), atomic.LoadInt64(&v.failed),
+		atomic.LoadInt64(&v.bytes), &v.connect, &v.firstByte)
+}
+
+// Latency collects the latency samples, to report the percentiles.
+type Latency struct {
+	// The samples of latency.
+	samples []time.Duration
+	// The lock for samples.
+	lock stdSync.Mutex
+}
+
+func (v *Latency) Add(d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.samples = append(v.samples, d)
+}
+
+// Percentile returns the p-th percentile of samples, p is in [0, 100].
+func (v *Latency) Percentile(p float64) time.Duration {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.samples) == 0 {
+		return 0
+	}
+
+	samples := append([]time.Duration{}, v.samples...)
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+
+	index := int(float64(len(samples)-1) * p / 100)
+	return samples[index]
+}
+
+func (v *Latency) String() string {
+	v.lock.Lock()
+	n := len(v.samples)
+	v.lock.Unlock()
+
+	if n == 0 {
+		return "n/a"
+	}
+
+	return fmt.Sprintf("[n=%v p50=%v p90=%v p99=%v max=%v]", n,
+		v.Percentile(50).Round(time.Millisecond), v.Percentile(90).Round(time.Millisecond),
+		v.Percentile(99).Round(time.Millisecond), v.Percentile(100).Round(time.Millisecond))
+}
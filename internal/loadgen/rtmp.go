@@ -0,0 +1,198 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/rtmp"
+)
+
+// runRTMPPublisher publishes a stream to rtmp://endpoint/app/stream until the context is cancelled.
+// If source is not empty, loop the FLV tags of it, or publish a synthetic stream.
+func runRTMPPublisher(ctx context.Context, m *Metrics, endpoint, app, stream string, source []*flvTag, bitrate int) error {
+	starttime := time.Now()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "dial %v", endpoint)
+	}
+	defer c.Close()
+
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	// Simple RTMP handshake with server.
+	hs := rtmp.NewHandshake()
+	if err := hs.WriteC0S0(c); err != nil {
+		return errors.Wrapf(err, "write c0")
+	}
+	if err := hs.WriteC1S1(c); err != nil {
+		return errors.Wrapf(err, "write c1")
+	}
+	if _, err = hs.ReadC0S0(c); err != nil {
+		return errors.Wrapf(err, "read s0")
+	}
+	if _, err := hs.ReadC1S1(c); err != nil {
+		return errors.Wrapf(err, "read s1")
+	}
+	if _, err = hs.ReadC2S2(c); err != nil {
+		return errors.Wrapf(err, "read s2")
+	}
+	if err := hs.WriteC2S2(c, hs.C1S1()); err != nil {
+		return errors.Wrapf(err, "write c2")
+	}
+
+	client := rtmp.NewProtocol(c)
+	tcUrl := fmt.Sprintf("rtmp://%v/%v", endpoint, app)
+
+	connectApp := rtmp.NewConnectAppPacket()
+	connectApp.CommandObject.Set("tcUrl", rtmp.NewAmf0String(tcUrl))
+	if err := client.WritePacket(ctx, connectApp, 1); err != nil {
+		return errors.Wrapf(err, "write connect app")
+	}
+
+	var connectAppRes *rtmp.ConnectAppResPacket
+	if _, err := rtmp.ExpectPacket(ctx, client, &connectAppRes); err != nil {
+		return errors.Wrapf(err, "expect connect app res")
+	}
+
+	createStream := rtmp.NewCreateStreamPacket()
+	createStream.TransactionID = 2
+	createStream.CommandObject = rtmp.NewAmf0Null()
+	if err := client.WritePacket(ctx, createStream, 0); err != nil {
+		return errors.Wrapf(err, "createStream")
+	}
+
+	var streamID int
+	for streamID == 0 {
+		var res *rtmp.CreateStreamResPacket
+		if _, err := rtmp.ExpectPacket(ctx, client, &res); err != nil {
+			return errors.Wrapf(err, "expect createStream res")
+		}
+		streamID = int(res.StreamID)
+	}
+
+	publish := rtmp.NewPublishPacket()
+	publish.TransactionID = 3
+	publish.CommandObject = rtmp.NewAmf0Null()
+	publish.StreamName = *rtmp.NewAmf0String(stream)
+	publish.StreamType = *rtmp.NewAmf0String("live")
+	if err := client.WritePacket(ctx, publish, streamID); err != nil {
+		return errors.Wrapf(err, "publish")
+	}
+
+	for {
+		var res *rtmp.CallPacket
+		if _, err := rtmp.ExpectPacket(ctx, client, &res); err != nil {
+			return errors.Wrapf(err, "expect publish res")
+		}
+		if res.CommandName == "onStatus" {
+			if code := res.ArgsCode(); code != "NetStream.Publish.Start" {
+				return errors.Errorf("publish rejected, code=%v", code)
+			}
+			break
+		}
+	}
+	m.Connected(time.Since(starttime))
+	logger.Df(ctx, "RTMP publish %v/%v, sid=%v, cost=%v", tcUrl, stream, streamID, time.Since(starttime))
+
+	// Drain the messages from server, such as acknowledgement.
+	go func() {
+		for ctx.Err() == nil {
+			if _, err := client.ReadMessage(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	if len(source) > 0 {
+		return publishFLV(ctx, m, client, streamID, source)
+	}
+	return publishSynthetic(ctx, m, client, streamID, bitrate)
+}
+
+// publishSynthetic publishes an AAC audio only stream, padded to the bitrate in kbps. The payload
+// of frames is random, because the proxy and origin never decode the audio frames.
+func publishSynthetic(ctx context.Context, m *Metrics, client *rtmp.Protocol, streamID, bitrate int) error {
+	// The AAC sequence header, AAC-LC, 44.1kHz, stereo.
+	sh := rtmp.NewStreamMessage(streamID)
+	sh.MessageType = rtmp.MessageTypeAudio
+	sh.Payload = []byte{0xaf, 0x00, 0x12, 0x10}
+	if err := client.WriteMessage(ctx, sh); err != nil {
+		return errors.Wrapf(err, "write sequence header")
+	}
+
+	// Send 1024 samples per frame, about 43 frames per second.
+	interval := time.Duration(1024*1000/44100) * time.Millisecond
+	frameSize := bitrate * 1000 / 8 * int(interval) / int(time.Second)
+	if frameSize < 8 {
+		frameSize = 8
+	}
+
+	starttime := time.Now()
+	for ctx.Err() == nil {
+		frame := rtmp.NewStreamMessage(streamID)
+		frame.MessageType = rtmp.MessageTypeAudio
+		frame.Timestamp = uint64(time.Since(starttime) / time.Millisecond)
+		frame.Payload = make([]byte, frameSize)
+		_, _ = rand.Read(frame.Payload[2:])
+		frame.Payload[0], frame.Payload[1] = 0xaf, 0x01
+
+		if err := client.WriteMessage(ctx, frame); err != nil {
+			return errors.Wrapf(err, "write frame")
+		}
+		m.AddBytes(len(frame.Payload))
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+
+	return nil
+}
+
+// publishFLV loops the source FLV tags in realtime.
+func publishFLV(ctx context.Context, m *Metrics, client *rtmp.Protocol, streamID int, source []*flvTag) error {
+	var base uint64
+	for ctx.Err() == nil {
+		starttime := time.Now()
+
+		var last uint64
+		for _, tag := range source {
+			msg := rtmp.NewStreamMessage(streamID)
+			msg.MessageType = tag.MessageType
+			msg.Timestamp = base + tag.Timestamp
+			msg.Payload = tag.Payload
+
+			// Wait until the timestamp of tag, to publish in realtime.
+			if wait := time.Duration(tag.Timestamp)*time.Millisecond - time.Since(starttime); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(wait):
+				}
+			}
+
+			if err := client.WriteMessage(ctx, msg); err != nil {
+				return errors.Wrapf(err, "write tag")
+			}
+			m.AddBytes(len(msg.Payload))
+			last = tag.Timestamp
+		}
+
+		base += last + 1
+	}
+	return nil
+}
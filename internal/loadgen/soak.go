@@ -0,0 +1,155 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"srsx/internal/debug"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// SoakConfig is the configuration for soak test, which runs the load generator in cycles.
+type SoakConfig struct {
+	// The System API endpoint of proxy, like 127.0.0.1:12025.
+	System string
+	// The number of cycles to run, 0 means forever.
+	Cycles int
+	// The duration to wait after clients stopped, for proxy to cleanup sessions.
+	Settle time.Duration
+	// The maximum growth of goroutines compared to the baseline.
+	GoroutineTolerance int
+	// The maximum growth of fds compared to the baseline.
+	FDTolerance int
+	// The maximum number of entries in each load balancer state.
+	MaxLBEntries int
+}
+
+// SoakTester continuously publishes, plays and tears down sessions, and asserts the invariants
+// of proxy after each cycle, to guard against resource leaks.
+type SoakTester interface {
+	// Run the cycles until an invariant is violated, the cycles done, or the context is cancelled.
+	// Returns error if any invariant is violated.
+	Run(ctx context.Context) error
+}
+
+type soakTesterImpl struct {
+	// The configuration for each cycle.
+	config *Config
+	// The configuration for soak test.
+	soak *SoakConfig
+}
+
+// NewSoakTester creates a new SoakTester by config.
+func NewSoakTester(config *Config, soak *SoakConfig) SoakTester {
+	return &soakTesterImpl{config: config, soak: soak}
+}
+
+// proxyRuntime is the response of proxy runtime API.
+type proxyRuntime struct {
+	debug.RuntimeStats
+	LoadBalancer map[string]int `json:"lb"`
+}
+
+func (v *soakTesterImpl) Run(ctx context.Context) error {
+	var baseline *proxyRuntime
+	for cycle := 0; v.soak.Cycles <= 0 || cycle < v.soak.Cycles; cycle++ {
+		// Use new streams for each cycle, so the leak of stream state is detected.
+		config := *v.config
+		config.Stream = fmt.Sprintf("%v-c%v", v.config.Stream, cycle)
+
+		report, err := NewLoadGenerator(&config).Run(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "cycle %v", cycle)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		logger.Df(ctx, "Soak cycle %v done, %v", cycle, report)
+
+		// Wait for proxy to cleanup the sessions.
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(v.soak.Settle):
+		}
+
+		current, err := v.queryRuntime(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "query runtime, cycle %v", cycle)
+		}
+		logger.Df(ctx, "Soak cycle %v runtime goroutines=%v, fds=%v, heap=%v, lb=%v",
+			cycle, current.Goroutines, current.FDs, current.HeapAlloc, current.LoadBalancer)
+
+		// The first cycle warms up the proxy, such as the connection pool, so use it as baseline.
+		if baseline == nil {
+			baseline = current
+			continue
+		}
+
+		if err := v.check(baseline, current); err != nil {
+			return errors.Wrapf(err, "invariant violated, cycle %v", cycle)
+		}
+	}
+	return nil
+}
+
+// check asserts the invariants of current runtime, compared to baseline.
+func (v *soakTesterImpl) check(baseline, current *proxyRuntime) error {
+	if delta := current.Goroutines - baseline.Goroutines; delta > v.soak.GoroutineTolerance {
+		return errors.Errorf("goroutines grow %v, from %v to %v, tolerance %v",
+			delta, baseline.Goroutines, current.Goroutines, v.soak.GoroutineTolerance)
+	}
+
+	if current.FDs >= 0 && baseline.FDs >= 0 {
+		if delta := current.FDs - baseline.FDs; delta > v.soak.FDTolerance {
+			return errors.Errorf("fds grow %v, from %v to %v, tolerance %v",
+				delta, baseline.FDs, current.FDs, v.soak.FDTolerance)
+		}
+	}
+
+	for name, n := range current.LoadBalancer {
+		if n > v.soak.MaxLBEntries {
+			return errors.Errorf("lb %v has %v entries, max %v", name, n, v.soak.MaxLBEntries)
+		}
+	}
+	return nil
+}
+
+// queryRuntime requests the runtime API of proxy.
+func (v *soakTesterImpl) queryRuntime(ctx context.Context) (*proxyRuntime, error) {
+	api := fmt.Sprintf("http://%v/api/v1/proxy/runtime", v.soak.System)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v", api)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", api)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request %v failed, status=%v, body=%v", api, resp.Status, string(b))
+	}
+
+	var res struct {
+		Data proxyRuntime `json:"data"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return &res.Data, nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package loadgen
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// runWHEPPlayer requests the WHEP API with a recvonly offer, then keeps sending STUN binding requests
+// to the candidate in answer, until the context is cancelled. It does not setup DTLS and SRTP, so it
+// only covers the signaling and ICE path of proxy, which is the most expensive part for proxy.
+func runWHEPPlayer(ctx context.Context, m *Metrics, whepURL string) error {
+	starttime := time.Now()
+
+	ufrag, pwd := randomHex(4), randomHex(12)
+	offer := buildWHEPOffer(ufrag, pwd)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, whepURL, strings.NewReader(offer))
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", whepURL)
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", whepURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("whep %v failed, status=%v", whepURL, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read answer")
+	}
+	m.Connected(time.Since(starttime))
+
+	answer := string(b)
+	localUfrag, localPwd, err := utils.ParseIceUfragPwd(answer)
+	if err != nil {
+		return errors.Wrapf(err, "parse answer %v", answer)
+	}
+
+	// Use the host of WHEP URL, because the candidate IP may be not reachable.
+	port := regexp.MustCompile(`a=candidate:\S+ \d+ udp \d+ \S+ (\d+) typ host`).FindStringSubmatch(answer)
+	if len(port) <= 1 {
+		return errors.Errorf("no candidate in answer %v", answer)
+	}
+	u, err := url.Parse(whepURL)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", whepURL)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(u.Hostname(), port[1]))
+	if err != nil {
+		return errors.Wrapf(err, "dial candidate %v", port[1])
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Receive the STUN binding response, as first bytes of session.
+	go func() {
+		buf := make([]byte, 1500)
+		for first := true; ctx.Err() == nil; first = false {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if first {
+				m.FirstByte(time.Since(starttime))
+				logger.Df(ctx, "WHEP play %v, first stun response cost=%v", whepURL, time.Since(starttime))
+			}
+			m.AddBytes(n)
+		}
+	}()
+
+	// Keep sending STUN binding requests, like the ICE consent freshness.
+	username := fmt.Sprintf("%v:%v", localUfrag, ufrag)
+	for ctx.Err() == nil {
+		if _, err := conn.Write(buildSTUNBindingRequest(username, localPwd)); err != nil {
+			return errors.Wrapf(err, "write stun")
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
+
+// buildWHEPOffer builds a recvonly offer with opus and H.264.
+func buildWHEPOffer(ufrag, pwd string) string {
+	var fingerprint []string
+	for i := 0; i < 32; i++ {
+		fingerprint = append(fingerprint, strings.ToUpper(randomHex(1)))
+	}
+
+	lines := []string{
+		"v=0",
+		"o=- 0 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"a=group:BUNDLE 0 1",
+		"a=msid-semantic: WMS",
+	}
+	media := []struct {
+		kind, payload, rtpmap, fmtp string
+	}{
+		{"audio", "111", "opus/48000/2", "minptime=10;useinbandfec=1"},
+		{"video", "106", "H264/90000", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+	}
+	for i, media := range media {
+		lines = append(lines,
+			fmt.Sprintf("m=%v 9 UDP/TLS/RTP/SAVPF %v", media.kind, media.payload),
+			"c=IN IP4 0.0.0.0",
+			"a=rtcp:9 IN IP4 0.0.0.0",
+			fmt.Sprintf("a=ice-ufrag:%v", ufrag),
+			fmt.Sprintf("a=ice-pwd:%v", pwd),
+			fmt.Sprintf("a=fingerprint:sha-256 %v", strings.Join(fingerprint, ":")),
+			"a=setup:actpass",
+			fmt.Sprintf("a=mid:%v", i),
+			"a=recvonly",
+			"a=rtcp-mux",
+			fmt.Sprintf("a=rtpmap:%v %v", media.payload, media.rtpmap),
+			fmt.Sprintf("a=fmtp:%v %v", media.payload, media.fmtp),
+		)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// buildSTUNBindingRequest builds a STUN binding request with USERNAME, MESSAGE-INTEGRITY and FINGERPRINT,
+// see https://datatracker.ietf.org/doc/html/rfc5389#section-15
+func buildSTUNBindingRequest(username, pwd string) []byte {
+	attr := func(typ uint16, value []byte) []byte {
+		b := make([]byte, 4, 4+len(value)+3)
+		binary.BigEndian.PutUint16(b, typ)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+		b = append(b, value...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, 0x0001)
+	binary.BigEndian.PutUint32(b[4:], 0x2112A442)
+	_, _ = rand.Read(b[8:20])
+	b = append(b, attr(0x0006, []byte(username))...)
+
+	// The length includes the MESSAGE-INTEGRITY attribute, when calculating the HMAC.
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-20+24))
+	mac := hmac.New(sha1.New, []byte(pwd))
+	mac.Write(b)
+	b = append(b, attr(0x0008, mac.Sum(nil))...)
+
+	// The length includes the FINGERPRINT attribute, when calculating the CRC32.
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-20+8))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b)^0x5354554e)
+	b = append(b, attr(0x8028, crc)...)
+
+	return b
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
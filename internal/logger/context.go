@@ -8,11 +8,15 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
 )
 
 type key string
 
 var cidKey key = "cid.proxy.ossrs.org"
+var labelsKey key = "labels.proxy.ossrs.org"
 
 // generateContextID generates a random context id in string.
 func GenerateContextID() string {
@@ -41,3 +45,25 @@ func ContextID(ctx context.Context) string {
 	}
 	return ""
 }
+
+// WithLabels creates a new context with labels of session, like user id or plan, which will be used for log.
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	if len(labels) == 0 {
+		return ctx
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return context.WithValue(ctx, labelsKey, strings.Join(pairs, ","))
+}
+
+// contextLabels returns the labels in context, like plan=pro,region=us, or empty string if not set.
+func contextLabels(ctx context.Context) string {
+	if labels, ok := ctx.Value(labelsKey).(string); ok {
+		return labels
+	}
+	return ""
+}
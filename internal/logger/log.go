@@ -30,7 +30,11 @@ func newLoggerPlus(opts ...func(*loggerPlus)) *loggerPlus {
 func (v *loggerPlus) Printf(ctx context.Context, f string, a ...interface{}) {
 	format, args := f, a
 	if cid := ContextID(ctx); cid != "" {
-		format, args = "[%v][%v][%v] "+format, append([]interface{}{v.level, os.Getpid(), cid}, a...)
+		if labels := contextLabels(ctx); labels != "" {
+			format, args = "[%v][%v][%v][%v] "+format, append([]interface{}{v.level, os.Getpid(), cid, labels}, a...)
+		} else {
+			format, args = "[%v][%v][%v] "+format, append([]interface{}{v.level, os.Getpid(), cid}, a...)
+		}
 	}
 
 	v.logger.Printf(format, args...)
@@ -0,0 +1,48 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package netutil
+
+import (
+	"net"
+
+	"srsx/internal/errors"
+)
+
+// The size of socket buffers of UDP, to absorb the bursts of packets, such as a keyframe of WebRTC or SRT,
+// which is capped by the system, such as net.core.rmem_max of Linux or kern.ipc.maxsockbuf of macOS.
+const UDPBufferSize = 4 * 1024 * 1024
+
+// The minimum size of socket buffers of UDP, to stop shrinking the buffers if rejected by the system.
+const udpMinBufferSize = 64 * 1024
+
+// TuneUDP sets the socket options of UDP conn for relaying packets, by the platform, so the UDP relay performs
+// consistently across deployment targets. See tuneUDP of each platform for details.
+func TuneUDP(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Wrapf(err, "raw conn")
+	}
+
+	if err := tuneUDP(conn, rc); err != nil {
+		return errors.Wrapf(err, "tune udp %v", conn.LocalAddr())
+	}
+	return nil
+}
+
+// setUDPBuffers sets the read and write buffers of conn to UDPBufferSize, halving the size if rejected by the
+// system, until udpMinBufferSize.
+func setUDPBuffers(conn *net.UDPConn) error {
+	for _, set := range []func(int) error{conn.SetReadBuffer, conn.SetWriteBuffer} {
+		var err error
+		for size := UDPBufferSize; size >= udpMinBufferSize; size /= 2 {
+			if err = set(size); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "set buffer")
+		}
+	}
+	return nil
+}
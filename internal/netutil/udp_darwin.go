@@ -0,0 +1,19 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build darwin
+
+package netutil
+
+import (
+	"net"
+	"syscall"
+)
+
+// tuneUDP sets the buffers, which macOS rejects by ENOBUFS if exceeds kern.ipc.maxsockbuf, instead of capping
+// it like Linux, so the buffers are halved until accepted, see setUDPBuffers. The default buffers of macOS are
+// too small for the bursts of packets, so the buffers must be set.
+func tuneUDP(conn *net.UDPConn, rc syscall.RawConn) error {
+	return setUDPBuffers(conn)
+}
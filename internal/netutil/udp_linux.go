@@ -0,0 +1,46 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build linux
+
+package netutil
+
+import (
+	"net"
+	"syscall"
+
+	"srsx/internal/errors"
+)
+
+const (
+	// soNoCheck is the SO_NO_CHECK of Linux, to send UDP packets without checksum.
+	soNoCheck = 0xb
+	// solUDP and udpGRO are the UDP_GRO of Linux, to coalesce the received UDP packets.
+	solUDP = 0x11
+	udpGRO = 0x68
+)
+
+// tuneUDP sets the buffers, which Linux silently caps by net.core.rmem_max and wmem_max. It also makes sure
+// the checksum is sent even if the NIC offloads it, because some NICs and virtual switches drop the packets
+// without checksum, and disables UDP GRO, because the coalesced packets are relayed as one packet without
+// being split. The UDP_GRO is ignored by kernels before 5.0, which don't support it.
+func tuneUDP(conn *net.UDPConn, rc syscall.RawConn) error {
+	if err := setUDPBuffers(conn); err != nil {
+		return errors.Wrapf(err, "buffers")
+	}
+
+	var err error
+	if r0 := rc.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soNoCheck, 0); err != nil {
+			err = errors.Wrapf(err, "SO_NO_CHECK")
+			return
+		}
+		if r1 := syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 0); r1 != nil && r1 != syscall.ENOPROTOOPT {
+			err = errors.Wrapf(r1, "UDP_GRO")
+		}
+	}); r0 != nil {
+		return r0
+	}
+	return err
+}
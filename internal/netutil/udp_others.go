@@ -0,0 +1,17 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !linux && !darwin && !windows
+
+package netutil
+
+import (
+	"net"
+	"syscall"
+)
+
+// tuneUDP only sets the buffers, because there is no known pitfall of other platforms.
+func tuneUDP(conn *net.UDPConn, rc syscall.RawConn) error {
+	return setUDPBuffers(conn)
+}
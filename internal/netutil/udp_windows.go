@@ -0,0 +1,43 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package netutil
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"srsx/internal/errors"
+)
+
+// sioUDPNetReset is the SIO_UDP_NETRESET of Windows, to report the TTL expired of UDP by WSAENETRESET.
+const sioUDPNetReset = syscall.IOC_IN | syscall.IOC_VENDOR | 15
+
+// tuneUDP sets the buffers, and disables SIO_UDP_CONNRESET and SIO_UDP_NETRESET, because Windows fails the next
+// read of UDP socket by WSAECONNRESET or WSAENETRESET, when an ICMP error is received for a packet sent to any
+// client, which stops the UDP listener serving all other clients. Go disables SIO_UDP_NETRESET only since 1.23,
+// so both are disabled explicitly for the older toolchains.
+func tuneUDP(conn *net.UDPConn, rc syscall.RawConn) error {
+	if err := setUDPBuffers(conn); err != nil {
+		return errors.Wrapf(err, "buffers")
+	}
+
+	var err error
+	if r0 := rc.Control(func(fd uintptr) {
+		for _, iocc := range []uint32{syscall.SIO_UDP_CONNRESET, sioUDPNetReset} {
+			flag, ret := uint32(0), uint32(0)
+			if err = syscall.WSAIoctl(syscall.Handle(fd), iocc, (*byte)(unsafe.Pointer(&flag)),
+				uint32(unsafe.Sizeof(flag)), nil, 0, &ret, nil, 0); err != nil {
+				err = errors.Wrapf(err, "ioctl %x", iocc)
+				return
+			}
+		}
+	}); r0 != nil {
+		return r0
+	}
+	return err
+}
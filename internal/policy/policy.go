@@ -0,0 +1,333 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/geo"
+	"srsx/internal/logger"
+)
+
+// The actions of rule.
+const (
+	// Allow the client.
+	ActionAllow = "allow"
+	// Deny the client.
+	ActionDeny = "deny"
+	// Allow the client, and limit the bitrate to Throttle kbps.
+	ActionThrottle = "throttle"
+	// Allow the client, and place the new stream to the backend servers of Group.
+	ActionRoute = "route"
+)
+
+// The operations of client, to match by rule.
+const (
+	// The client publishes a stream.
+	OperationPublish = "publish"
+	// The client plays a stream.
+	OperationPlay = "play"
+)
+
+// Rule matches the clients by conditions, and applies the action to the matched clients. The empty
+// condition matches any client, and all conditions must be matched.
+type Rule struct {
+	// The name of rule, for logging.
+	Name string `json:"name,omitempty"`
+	// The country codes, such as US.
+	Countries []string `json:"countries,omitempty"`
+	// The ASNs, such as AS13335.
+	ASNs []string `json:"asns,omitempty"`
+	// The vhosts, such as __defaultVhost__.
+	Vhosts []string `json:"vhosts,omitempty"`
+	// The apps, such as live.
+	Apps []string `json:"apps,omitempty"`
+	// The protocols, such as rtmp, http, hls, rtc or srt.
+	Protocols []string `json:"protocols,omitempty"`
+	// The operations of client, publish or play.
+	Operations []string `json:"operations,omitempty"`
+	// The time of day in local time of proxy, like 08:00-18:00, or 22:00-06:00 crossing midnight.
+	Time string `json:"time,omitempty"`
+	// The action, allow, deny, throttle or route.
+	Action string `json:"action"`
+	// The max bitrate in kbps, for throttle.
+	Throttle int `json:"throttle,omitempty"`
+	// The group of backend servers, for route.
+	Group string `json:"group,omitempty"`
+
+	// The parsed time of day, in minutes from midnight.
+	from, to int
+}
+
+// Policy is the rules to filter clients, the first matched rule applies.
+type Policy struct {
+	// The action if no rule matched, allow or deny, default to allow.
+	Default string `json:"default,omitempty"`
+	// The rules in order.
+	Rules []*Rule `json:"rules"`
+}
+
+// Request is a client to evaluate.
+type Request struct {
+	// The protocol of client, such as rtmp, http, hls, rtc or srt.
+	Protocol string
+	// The operation of client, publish or play.
+	Operation string
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string
+	// The address of client, in ip:port or ip.
+	RemoteAddr string
+	// The header of HTTP request, nil for other protocols.
+	Header http.Header
+}
+
+// Decision is the result of evaluating a client.
+type Decision struct {
+	// The action, allow, deny, throttle or route.
+	Action string
+	// The matched rule, nil if no rule matched.
+	Rule *Rule
+}
+
+// Denied returns whether the client is denied.
+func (v *Decision) Denied() bool {
+	return v.Action == ActionDeny
+}
+
+// Throttle returns the max bitrate in kbps, or zero if not throttled.
+func (v *Decision) Throttle() int {
+	if v.Action == ActionThrottle && v.Rule != nil {
+		return v.Rule.Throttle
+	}
+	return 0
+}
+
+// Group returns the group of backend servers to route, or empty if not routed.
+func (v *Decision) Group() string {
+	if v.Action == ActionRoute && v.Rule != nil {
+		return v.Rule.Group
+	}
+	return ""
+}
+
+func (v *Decision) String() string {
+	if v.Rule == nil {
+		return fmt.Sprintf("%v by default", v.Action)
+	}
+	return fmt.Sprintf("%v by rule %v", v.Action, v.Rule.Name)
+}
+
+// Engine evaluates the clients by the policy.
+type Engine interface {
+	// Evaluate the client, returns the decision.
+	Evaluate(ctx context.Context, r *Request) *Decision
+	// Policy returns the current policy.
+	Policy() *Policy
+	// Update the policy, and save to the file if configured.
+	Update(ctx context.Context, p *Policy) error
+}
+
+type engineImpl struct {
+	// The file to load and save the policy, empty if not configured.
+	filename string
+	// The current policy, protected by lock.
+	policy *Policy
+	lock   stdSync.RWMutex
+}
+
+// NewEngine creates a policy engine, loads the policy from filename if not empty.
+func NewEngine(filename string) (Engine, error) {
+	v := &engineImpl{filename: filename, policy: &Policy{Default: ActionAllow, Rules: []*Rule{}}}
+	if filename == "" {
+		return v, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", filename)
+	}
+
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	if err := p.initialize(); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy %v", filename)
+	}
+	v.policy = &p
+	return v, nil
+}
+
+// NewEngineFromEnvironment creates the policy engine by the policy file in environment.
+func NewEngineFromEnvironment(environment env.Environment) (Engine, error) {
+	return NewEngine(environment.PolicyFile())
+}
+
+func (v *engineImpl) Evaluate(ctx context.Context, r *Request) *Decision {
+	v.lock.RLock()
+	p := v.policy
+	v.lock.RUnlock()
+
+	if len(p.Rules) == 0 {
+		return &Decision{Action: p.Default}
+	}
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	location := geo.SrsLocator.Locate(ip, r.Header)
+
+	// The stream URL is in vhost/app/stream schema.
+	var vhost, app string
+	parts := strings.SplitN(r.StreamURL, "/", 3)
+	if vhost = parts[0]; len(parts) > 1 {
+		app = parts[1]
+	}
+
+	now := time.Now()
+	minutes := now.Hour()*60 + now.Minute()
+
+	for _, rule := range p.Rules {
+		if !matchAny(rule.Countries, location.Country) || !matchAny(rule.ASNs, location.ASN) ||
+			!matchAny(rule.Vhosts, vhost) || !matchAny(rule.Apps, app) ||
+			!matchAny(rule.Protocols, r.Protocol) || !matchAny(rule.Operations, r.Operation) {
+			continue
+		}
+		if rule.Time != "" && !matchTime(rule.from, rule.to, minutes) {
+			continue
+		}
+		return &Decision{Action: rule.Action, Rule: rule}
+	}
+	return &Decision{Action: p.Default}
+}
+
+func (v *engineImpl) Policy() *Policy {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.policy
+}
+
+func (v *engineImpl) Update(ctx context.Context, p *Policy) error {
+	if err := p.initialize(); err != nil {
+		return errors.Wrapf(err, "invalid policy")
+	}
+
+	if v.filename != "" {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "marshal policy")
+		}
+
+		// Write to a temporary file then rename, to avoid a corrupted file when crashing.
+		tmpfile := v.filename + ".tmp"
+		if err := ioutil.WriteFile(tmpfile, b, 0644); err != nil {
+			return errors.Wrapf(err, "write %v", tmpfile)
+		}
+		if err := os.Rename(tmpfile, v.filename); err != nil {
+			return errors.Wrapf(err, "rename %v to %v", tmpfile, v.filename)
+		}
+	}
+
+	v.lock.Lock()
+	v.policy = p
+	v.lock.Unlock()
+
+	logger.Df(ctx, "Update policy default=%v, rules=%v", p.Default, len(p.Rules))
+	return nil
+}
+
+// initialize validates the policy, and parses the time of rules.
+func (v *Policy) initialize() error {
+	if v.Default == "" {
+		v.Default = ActionAllow
+	}
+	if v.Default != ActionAllow && v.Default != ActionDeny {
+		return errors.Errorf("invalid default action %v", v.Default)
+	}
+	if v.Rules == nil {
+		v.Rules = []*Rule{}
+	}
+
+	for i, rule := range v.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%v", i)
+		}
+
+		switch rule.Action {
+		case ActionAllow, ActionDeny:
+		case ActionThrottle:
+			if rule.Throttle <= 0 {
+				return errors.Errorf("rule %v: invalid throttle %v", rule.Name, rule.Throttle)
+			}
+			// Only the HTTP-FLV and HTTP-TS responses are able to throttle, so the rule must not match others.
+			if len(rule.Protocols) == 0 {
+				return errors.Errorf("rule %v: throttle requires protocols http", rule.Name)
+			}
+			for _, protocol := range rule.Protocols {
+				if !strings.EqualFold(protocol, "http") {
+					return errors.Errorf("rule %v: throttle not supported by %v", rule.Name, protocol)
+				}
+			}
+		case ActionRoute:
+			if rule.Group == "" {
+				return errors.Errorf("rule %v: empty group", rule.Name)
+			}
+		default:
+			return errors.Errorf("rule %v: invalid action %v", rule.Name, rule.Action)
+		}
+
+		for _, operation := range rule.Operations {
+			if operation != OperationPublish && operation != OperationPlay {
+				return errors.Errorf("rule %v: invalid operation %v", rule.Name, operation)
+			}
+		}
+
+		if rule.Time != "" {
+			var fromHour, fromMinute, toHour, toMinute int
+			if n, err := fmt.Sscanf(rule.Time, "%d:%d-%d:%d", &fromHour, &fromMinute, &toHour, &toMinute); err != nil || n != 4 ||
+				fromHour < 0 || fromHour > 24 || toHour < 0 || toHour > 24 ||
+				fromMinute < 0 || fromMinute > 59 || toMinute < 0 || toMinute > 59 {
+				return errors.Errorf("rule %v: invalid time %v", rule.Name, rule.Time)
+			}
+			rule.from, rule.to = fromHour*60+fromMinute, toHour*60+toMinute
+		}
+	}
+	return nil
+}
+
+// matchAny returns true if values is empty, or value is in values, case-insensitive.
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTime returns true if minutes is in [from, to), which crosses midnight if from is after to.
+func matchTime(from, to, minutes int) bool {
+	if from <= to {
+		return minutes >= from && minutes < to
+	}
+	return minutes >= from || minutes < to
+}
+
+// SrsPolicyEngine is the global policy engine, which allows all clients by default.
+var SrsPolicyEngine Engine = &engineImpl{policy: &Policy{Default: ActionAllow, Rules: []*Rule{}}}
@@ -0,0 +1,128 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/session"
+	"srsx/internal/version"
+)
+
+// protocolAlternative is an alternative protocol to publish or play the stream, when the requested
+// protocol is unavailable on the backend of stream.
+type protocolAlternative struct {
+	// The protocol, such as rtmp, srt, http-flv, hls, whip or whep.
+	Protocol string `json:"protocol"`
+	// The URL of stream by the protocol, on this proxy.
+	URL string `json:"url"`
+}
+
+// listenerPort returns the port of proxy listener name, or empty if not listening.
+func listenerPort(name string) string {
+	status, ok := srsListeners.Load(name)
+	if !ok || !status.Listening {
+		return ""
+	}
+	if _, port, err := net.SplitHostPort(status.Addr); err == nil {
+		return port
+	}
+	return ""
+}
+
+// protocolAlternatives returns the protocols available on both the proxy and the backend, to publish or
+// play the stream by role, except the requested protocol. The URLs use the hostname of request r.
+func protocolAlternatives(r *http.Request, backend *lb.SRSServer, streamURL, protocol, role string) []*protocolAlternative {
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+
+	// The stream URL is in vhost/app/stream schema.
+	vhost, appStream := streamURL, ""
+	if index := strings.Index(streamURL, "/"); index >= 0 {
+		vhost, appStream = streamURL[:index], streamURL[index+1:]
+	}
+	app, stream := appStream, ""
+	if index := strings.LastIndex(appStream, "/"); index >= 0 {
+		app, stream = appStream[:index], appStream[index+1:]
+	}
+
+	alternatives := []*protocolAlternative{}
+	add := func(name string, available bool, listener, scheme, path string) {
+		if name == protocol || !available {
+			return
+		}
+		if port := listenerPort(listener); port != "" {
+			alternatives = append(alternatives, &protocolAlternative{
+				Protocol: name, URL: fmt.Sprintf("%v://%v%v", scheme, net.JoinHostPort(hostname, port), path),
+			})
+		}
+	}
+
+	// See https://github.com/Haivision/srt/blob/master/docs/features/access-control.md
+	srtStreamID := fmt.Sprintf("#!::r=%v,m=request", appStream)
+	if role == session.RolePublisher {
+		srtStreamID = fmt.Sprintf("#!::r=%v,m=publish", appStream)
+	}
+	if vhost != "__defaultVhost__" {
+		srtStreamID = fmt.Sprintf("#!::h=%v,%v", vhost, strings.TrimPrefix(srtStreamID, "#!::"))
+	}
+
+	rtcQuery := url.Values{"app": []string{app}, "stream": []string{stream}}.Encode()
+	hasRTC, hasHTTP := len(backend.RTC) > 0 && len(backend.API) > 0, len(backend.HTTP) > 0
+	add("rtmp", len(backend.RTMP) > 0, "rtmp", "rtmp", "/"+appStream)
+	add("srt", len(backend.SRT) > 0, "srt", "srt", "?streamid="+srtStreamID)
+	if role == session.RolePublisher {
+		add("whip", hasRTC, "http-api", "http", "/rtc/v1/whip/?"+rtcQuery)
+	} else {
+		add("http-flv", hasHTTP, "http-stream", "http", "/"+appStream+".flv")
+		add("hls", hasHTTP, "http-stream", "http", "/"+appStream+".m3u8")
+		add("whep", hasRTC, "http-api", "http", "/rtc/v1/whep/?"+rtcQuery)
+	}
+	return alternatives
+}
+
+// writeProtocolUnavailable responses 503 with the alternatives of protocols, in the header
+// X-SRS-Proxy-Alternatives and the JSON body, so the smart players are able to switch automatically.
+func writeProtocolUnavailable(ctx context.Context, w http.ResponseWriter, protocol, message string, alternatives []*protocolAlternative) {
+	type Response struct {
+		Code int    `json:"code"`
+		PID  string `json:"pid"`
+		Data struct {
+			Reason       string                 `json:"reason"`
+			Protocol     string                 `json:"protocol"`
+			Message      string                 `json:"message"`
+			Alternatives []*protocolAlternative `json:"alternatives"`
+		} `json:"data"`
+	}
+
+	res := Response{Code: http.StatusServiceUnavailable, PID: fmt.Sprintf("%v", os.Getpid())}
+	res.Data.Reason, res.Data.Protocol, res.Data.Message = "protocol-unavailable", protocol, message
+	res.Data.Alternatives = alternatives
+	b, _ := json.Marshal(&res)
+
+	var names []string
+	for _, alternative := range alternatives {
+		names = append(names, alternative.Protocol)
+	}
+
+	w.Header().Set("Server", fmt.Sprintf("%v/%v", version.Signature(), version.Version()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-SRS-Proxy-Alternatives", strings.Join(names, ", "))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(b)
+
+	logger.Wf(ctx, "Protocol %v unavailable, %v, alternatives=%v", protocol, message, names)
+}
@@ -4,22 +4,43 @@
 package protocol
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/clock"
+	"srsx/internal/debug"
+	"srsx/internal/dryrun"
 	"srsx/internal/env"
 	"srsx/internal/errors"
+	"srsx/internal/incident"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
+	"srsx/internal/relay"
+	"srsx/internal/restream"
+	"srsx/internal/session"
+	"srsx/internal/tarpit"
 	"srsx/internal/utils"
 	"srsx/internal/version"
 )
 
+// The max size of gossip message from peer proxy.
+const maxGossipMessageSize = 16 * 1024 * 1024
+
 // srsHTTPAPIServer is the proxy for SRS HTTP API, to proxy the WebRTC HTTP API like WHIP and WHEP,
 // to proxy other HTTP API of SRS like the streams and clients, etc.
 type srsHTTPAPIServer struct {
@@ -27,6 +48,8 @@ type srsHTTPAPIServer struct {
 	environment env.Environment
 	// The underlayer HTTP server.
 	server *http.Server
+	// The TCP listeners for HTTP and HTTPS server, closed to stop accepting when quiting.
+	listeners []*net.TCPListener
 	// The WebRTC server.
 	rtc *srsWebRTCServer
 	// The gracefully quit timeout, wait server to quit.
@@ -44,9 +67,18 @@ func NewSRSHTTPAPIServer(environment env.Environment, gracefulQuitTimeout time.D
 	return v
 }
 
-func (v *srsHTTPAPIServer) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), v.gracefulQuitTimeout)
-	defer cancel()
+// StopAccepting closes the listeners to stop accepting new connections, and closes the idle connections, while
+// the active requests are kept until Close.
+func (v *srsHTTPAPIServer) StopAccepting() error {
+	v.server.SetKeepAlivesEnabled(false)
+	for _, listener := range v.listeners {
+		listener.Close()
+	}
+	return nil
+}
+
+// Close shuts down the server, and waits for the active requests until ctx is done.
+func (v *srsHTTPAPIServer) Close(ctx context.Context) error {
 	v.server.Shutdown(ctx)
 
 	v.wg.Wait()
@@ -55,15 +87,45 @@ func (v *srsHTTPAPIServer) Close() error {
 
 func (v *srsHTTPAPIServer) Run(ctx context.Context) error {
 	// Parse address to listen.
-	addr := v.environment.HttpAPI()
-	if !strings.Contains(addr, ":") {
-		addr = ":" + addr
+	addrs, err := utils.ParseListenAddrs(v.environment.HttpAPI(), "tcp")
+	if err != nil {
+		return errors.Wrapf(err, "parse http api %v", v.environment.HttpAPI())
 	}
 
 	// Create server and handler.
 	mux := http.NewServeMux()
-	v.server = &http.Server{Addr: addr, Handler: mux}
-	logger.Df(ctx, "HTTP API server listen at %v", addr)
+	v.server = &http.Server{Addr: addrs[0], Handler: mux}
+
+	// Listen before serving, to fail at startup, and get the actual address if the port is 0.
+	listeners, err := srsUpgrader.listenTCPs(ctx, "http-api", addrs)
+	if err != nil {
+		return errors.Wrapf(err, "listen http api %v", strings.Join(addrs, ","))
+	}
+	addr := listeners[0].Addr().String()
+	for i, listener := range listeners {
+		logger.Df(ctx, "HTTP API server listen at %v", listener.Addr())
+		updateListener(listenerName("http-api", i), listener.Addr().String(), true, nil)
+	}
+
+	// The HTTPS API server terminates TLS, for the WHIP and WHEP of https pages.
+	var tlsListeners []*net.TCPListener
+	var tlsConfig *tls.Config
+	if v.environment.HttpsAPI() != "" {
+		tlsAddrs, err := utils.ParseListenAddrs(v.environment.HttpsAPI(), "tcp")
+		if err != nil {
+			return errors.Wrapf(err, "parse https api %v", v.environment.HttpsAPI())
+		}
+
+		if tlsListeners, tlsConfig, err = listenHTTPS(ctx, v.environment, "https-api", tlsAddrs); err != nil {
+			return errors.Wrapf(err, "https api")
+		}
+		for i, listener := range tlsListeners {
+			logger.Df(ctx, "HTTPS API server listen at %v", listener.Addr())
+			updateListener(listenerName("https-api", i), listener.Addr().String(), true, nil)
+		}
+	}
+
+	v.listeners = append(append(v.listeners, listeners...), tlsListeners...)
 
 	// Shutdown the server gracefully when quiting.
 	go func() {
@@ -101,23 +163,44 @@ func (v *srsHTTPAPIServer) Run(ctx context.Context) error {
 		}
 	})
 
-	// Run HTTP API server.
-	v.wg.Add(1)
-	go func() {
-		defer v.wg.Done()
+	// Run HTTP API server, for each listener, over TLS if config is not nil.
+	serve := func(name string, listener net.Listener, config *tls.Config) {
+		addr := listener.Addr().String()
 
-		err := v.server.ListenAndServe()
-		if err != nil {
-			if err == http.ErrServerClosed {
-				logger.Df(ctx, "HTTP API server done")
-			} else if ctx.Err() != nil {
-				logger.Df(ctx, "HTTP API server done with context canceled")
-			} else {
-				// TODO: If HTTP API server closed unexpectedly, we should notice the main loop to quit.
-				logger.Wf(ctx, "HTTP API accept err %+v", err)
-			}
+		listener = newLimitListener(ctx, name, listener)
+		if config != nil {
+			listener = tls.NewListener(listener, config)
 		}
-	}()
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			err := v.server.Serve(listener)
+			if err != nil {
+				if err == http.ErrServerClosed {
+					logger.Df(ctx, "HTTP API server %v done", name)
+					updateListener(name, addr, false, nil)
+				} else if ctx.Err() != nil {
+					logger.Df(ctx, "HTTP API server %v done with context canceled", name)
+					updateListener(name, addr, false, nil)
+				} else if utils.IsClosedNetworkError(err) {
+					logger.Df(ctx, "HTTP API server %v stop accepting", name)
+					updateListener(name, addr, false, nil)
+				} else {
+					// TODO: If HTTP API server closed unexpectedly, we should notice the main loop to quit.
+					logger.Wf(ctx, "HTTP API %v accept err %+v", name, err)
+					updateListener(name, addr, false, err)
+				}
+			}
+		}()
+	}
+	for i, listener := range listeners {
+		serve(listenerName("http-api", i), listener, nil)
+	}
+	for i, listener := range tlsListeners {
+		serve(listenerName("https-api", i), listener, tlsConfig)
+	}
 
 	return nil
 }
@@ -132,6 +215,8 @@ type systemAPI struct {
 	server *http.Server
 	// The gracefully quit timeout, wait server to quit.
 	gracefulQuitTimeout time.Duration
+	// The prober to verify the endpoints of registering backend.
+	prober lb.SRSServerProber
 	// The wait group for all goroutines.
 	wg sync.WaitGroup
 }
@@ -140,6 +225,7 @@ func NewSystemAPI(environment env.Environment, gracefulQuitTimeout time.Duration
 	v := &systemAPI{
 		environment:         environment,
 		gracefulQuitTimeout: gracefulQuitTimeout,
+		prober:              lb.NewSRSServerProber(),
 	}
 	return v
 }
@@ -153,17 +239,125 @@ func (v *systemAPI) Close() error {
 	return nil
 }
 
+// isStrategy returns whether the strategy of load balancer, publishers or players is name.
+func isStrategy(environment env.Environment, name string) bool {
+	return environment.LoadBalancerStrategy() == name || environment.PublishStrategy() == name ||
+		environment.PlayStrategy() == name
+}
+
+// verifyAdmin verifies the admin token of request r, in the bearer authorization or the token in query, and
+// rejects all requests if no admin token is configured.
+func (v *systemAPI) verifyAdmin(r *http.Request) error {
+	expect := v.environment.AdminToken()
+	if expect == "" {
+		return errors.Errorf("disabled, no PROXY_ADMIN_TOKEN")
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expect)) != 1 {
+		return errors.Errorf("invalid admin token")
+	}
+	return nil
+}
+
+// features returns whether the features are enabled. The TLS is terminated by the RTMPS and HTTPS listeners,
+// while the HTTP/3 is not supported by proxy, so it should be terminated by a front load balancer, like Nginx.
+func features(environment env.Environment) map[string]bool {
+	lbType := environment.LoadBalancerType()
+	return map[string]bool{
+		"tls":                isTLSListening(),
+		"http3":              false,
+		"redis":              lbType == "redis",
+		"store":              lbType == "file" || lbType == "sql",
+		"store-encryption":   environment.StoreEncryptionKey() != "" || environment.StoreEncryptionKeyFile() != "",
+		"register-probe":     environment.RegisterProbe() == "flag" || environment.RegisterProbe() == "reject",
+		"rtmps":              environment.RtmpsServer() != "",
+		"https":              environment.HttpsServer() != "" || environment.HttpsAPI() != "" || environment.HttpsSystemAPI() != "",
+		"backend-tls":        environment.BackendTLS() != "" && environment.BackendTLS() != "off",
+		"rtmp-publish-grace": environment.RtmpPublishGrace() != "" && environment.RtmpPublishGrace() != "0s",
+		"default-backend":    environment.DefaultBackendEnabled() == "on",
+		"load-aware":         isStrategy(environment, "load-aware"),
+		"latency-aware":      isStrategy(environment, "latency-aware"),
+		"http-quota":         environment.HttpMaxPlayers() != "0" || environment.HttpRateLimit() != "0",
+		"origin-shield":      environment.CdnSecret() != "",
+		"hls-offload":        environment.S3Endpoint() != "",
+		"restream-detect":    environment.RestreamDetect() == "on",
+		"tarpit":             environment.Tarpit() == "on",
+		"conn-limit":         environment.MaxConns() != "0" || environment.MaxListenerConns() != "" || environment.MaxIPConns() != "0",
+		"policy":             environment.PolicyFile() != "" || len(policy.SrsPolicyEngine.Policy().Rules) > 0,
+		"routing":            environment.RoutingFile() != "",
+		"dry-run":            dryrun.SrsDryRun.Enabled(),
+		"circuit-breaker":    environment.BreakerThreshold() != "0",
+		"relay":              len(relay.SrsRelayManager.List()) > 0,
+		"relay-schedule":     len(relay.SrsRelayScheduler.List()) > 0,
+		"publish-token":      environment.PublishSecret() != "",
+		"oryx-auth":          environment.OryxAPI() != "",
+		"alarm":              len(alarm.SrsUsageMonitor.Alarms()) > 0,
+		"incident":           environment.IncidentMaxErrors() != "0",
+		"capture":            environment.CaptureDir() != "",
+		"egress-throttle":    environment.MaxConnEgressKbps() != "0",
+		"redirect":           environment.RedirectMode() != "" && environment.RedirectMode() != "off",
+		"edge-fanout":        environment.EdgeFanout() == "on",
+		"edge-gop-cache":     environment.EdgeFanout() == "on" && environment.EdgeGopCache() == "on",
+		"regions":            environment.Regions() != "" || environment.RegionCountries() != "",
+		"gossip":             environment.GossipPeers() != "",
+		"forward":            environment.Forward() == "on",
+		"stream-shard":       srsStreamSharding.Enabled(),
+		"leader-election":    environment.LeaderElection() != "",
+		"register-token":     environment.RegisterToken() == "on",
+		"pprof":              environment.GoPprof() != "",
+	}
+}
+
 func (v *systemAPI) Run(ctx context.Context) error {
 	// Parse address to listen.
-	addr := v.environment.SystemAPI()
-	if !strings.Contains(addr, ":") {
-		addr = ":" + addr
+	addr, err := utils.ParseListenAddr(v.environment.SystemAPI(), "tcp")
+	if err != nil {
+		return errors.Wrapf(err, "parse system api %v", v.environment.SystemAPI())
+	}
+
+	// Forward the HLS and WebRTC requests to the peer proxy which owns the session, by the System API of peers.
+	if err := srsForwarder.configure(v.environment); err != nil {
+		return errors.Wrapf(err, "configure forwarder")
+	}
+	if v.environment.Forward() == "on" {
+		logger.Df(ctx, "Forward to peers %v", srsForwarder.listPeers())
 	}
 
 	// Create server and handler.
 	mux := http.NewServeMux()
 	v.server = &http.Server{Addr: addr, Handler: mux}
+
+	// Listen before serving, to fail at startup, and get the actual address if the port is 0.
+	listener, err := srsUpgrader.listenTCP(ctx, "system-api", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen system api %v", addr)
+	}
+	addr = listener.Addr().String()
 	logger.Df(ctx, "System API server listen at %v", addr)
+	updateListener("system-api", addr, true, nil)
+
+	// The HTTPS System API terminates TLS, for the backends and operators over untrusted networks.
+	var tlsListeners []net.Listener
+	if v.environment.HttpsSystemAPI() != "" {
+		tlsAddrs, err := utils.ParseListenAddrs(v.environment.HttpsSystemAPI(), "tcp")
+		if err != nil {
+			return errors.Wrapf(err, "parse https system api %v", v.environment.HttpsSystemAPI())
+		}
+
+		listeners, tlsConfig, err := listenHTTPS(ctx, v.environment, "https-system-api", tlsAddrs)
+		if err != nil {
+			return errors.Wrapf(err, "https system api")
+		}
+		for i, listener := range listeners {
+			logger.Df(ctx, "HTTPS System API server listen at %v", listener.Addr())
+			updateListener(listenerName("https-system-api", i), listener.Addr().String(), true, nil)
+			tlsListeners = append(tlsListeners, tls.NewListener(listener, tlsConfig))
+		}
+	}
 
 	// Shutdown the server gracefully when quiting.
 	go func() {
@@ -189,8 +383,10 @@ func (v *systemAPI) Run(ctx context.Context) error {
 	logger.Df(ctx, "Handle /api/v1/srs/register by %v", addr)
 	mux.HandleFunc("/api/v1/srs/register", func(w http.ResponseWriter, r *http.Request) {
 		if err := func() error {
-			var deviceID, ip, serverID, serviceID, pid string
+			var deviceID, group, ip, serverID, serviceID, pid, token string
+			weight, maxStreams, maxBandwidth, streams := 1, 0, 0, 0
 			var rtmp, stream, api, srt, rtc []string
+			var labels map[string]string
 			if err := utils.ParseBody(r.Body, &struct {
 				// The IP of SRS, mandatory.
 				IP *string `json:"ip"`
@@ -212,8 +408,23 @@ func (v *systemAPI) Run(ctx context.Context) error {
 				RTC *[]string `json:"rtc"`
 				// The device id of SRS, optional.
 				DeviceID *string `json:"device_id"`
+				// The group of SRS, to route streams to the group by policy, optional.
+				Group *string `json:"group"`
+				// The weight of SRS for weighted-random strategy, optional, default to 1.
+				Weight *int `json:"weight"`
+				// The max number of streams of SRS, optional, default to 0 for unlimited.
+				MaxStreams *int `json:"max_streams"`
+				// The max bandwidth in Mbps of SRS, optional, default to 0 for unlimited.
+				MaxBandwidth *int `json:"max_bandwidth"`
+				// The number of streams of SRS, optional.
+				Streams *int `json:"streams"`
+				// The labels of SRS, like {"region": "us-east"}, to select servers by label selector, optional.
+				Labels *map[string]string `json:"labels"`
+				// The registration token issued by proxy, optional, or in query or bearer authorization.
+				Token *string `json:"token"`
 			}{
-				IP: &ip, DeviceID: &deviceID,
+				IP: &ip, DeviceID: &deviceID, Group: &group, Weight: &weight, Labels: &labels, Token: &token,
+				MaxStreams: &maxStreams, MaxBandwidth: &maxBandwidth, Streams: &streams,
 				ServerID: &serverID, ServiceID: &serviceID, PID: &pid,
 				RTMP: &rtmp, HTTP: &stream, API: &api, SRT: &srt, RTC: &rtc,
 			}); err != nil {
@@ -235,14 +446,105 @@ func (v *systemAPI) Run(ctx context.Context) error {
 			if len(rtmp) == 0 {
 				return errors.Errorf("empty rtmp")
 			}
+			if weight < 0 {
+				return errors.Errorf("invalid weight %v", weight)
+			}
+			if maxStreams < 0 {
+				return errors.Errorf("invalid max streams %v", maxStreams)
+			}
+			if maxBandwidth < 0 {
+				return errors.Errorf("invalid max bandwidth %v", maxBandwidth)
+			}
+			if streams < 0 {
+				return errors.Errorf("invalid streams %v", streams)
+			}
+			for key := range labels {
+				if key == "" {
+					return errors.Errorf("empty label key")
+				}
+			}
+
+			// Verify the registration token, which binds the identity of server, and makes the ID stable.
+			if token == "" {
+				token = r.URL.Query().Get("token")
+			}
+			if token == "" {
+				token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			}
+			var registrationID string
+			if token != "" {
+				registration, err := lb.SrsServerRegistrar.Verify(ctx, token, serverID, deviceID)
+				if err != nil {
+					return errors.Wrapf(err, "verify token")
+				}
+				registrationID = registration.ID
+			} else if lb.SrsServerRegistrar.Required() {
+				return errors.Errorf("no token for server %v", serverID)
+			}
+
+			// The configured weight overrides the reported one, by server id or device id.
+			weights, err := lb.ParseServerWeights(v.environment.ServerWeights())
+			if err != nil {
+				return errors.Wrapf(err, "parse weights %v", v.environment.ServerWeights())
+			}
+			if w, ok := weights[serverID]; ok {
+				weight = w
+			} else if w, ok := weights[deviceID]; ok && deviceID != "" {
+				weight = w
+			}
+
+			// The configured max streams overrides the reported one, by server id or device id.
+			allMaxStreams, err := lb.ParseServerMaxStreams(v.environment.ServerMaxStreams())
+			if err != nil {
+				return errors.Wrapf(err, "parse max streams %v", v.environment.ServerMaxStreams())
+			}
+			if n, ok := allMaxStreams[serverID]; ok {
+				maxStreams = n
+			} else if n, ok := allMaxStreams[deviceID]; ok && deviceID != "" {
+				maxStreams = n
+			}
+
+			// The configured max bandwidth overrides the reported one, by server id or device id.
+			allMaxBandwidth, err := lb.ParseServerMaxBandwidth(v.environment.ServerMaxBandwidth())
+			if err != nil {
+				return errors.Wrapf(err, "parse max bandwidth %v", v.environment.ServerMaxBandwidth())
+			}
+			if n, ok := allMaxBandwidth[serverID]; ok {
+				maxBandwidth = n
+			} else if n, ok := allMaxBandwidth[deviceID]; ok && deviceID != "" {
+				maxBandwidth = n
+			}
 
 			server := lb.NewSRSServer(func(srs *lb.SRSServer) {
-				srs.IP, srs.DeviceID = ip, deviceID
+				srs.IP, srs.DeviceID, srs.Group, srs.Weight = ip, deviceID, group, weight
+				srs.Labels, srs.MaxStreams, srs.Streams = labels, maxStreams, streams
+				srs.MaxBandwidth = maxBandwidth
 				srs.ServerID, srs.ServiceID, srs.PID = serverID, serviceID, pid
 				srs.RTMP, srs.HTTP, srs.API = rtmp, stream, api
 				srs.SRT, srs.RTC = srt, rtc
+				srs.RegistrationID = registrationID
 				srs.UpdatedAt = time.Now()
 			})
+			server.Draining = lb.SrsServerDrainer.IsDraining(server)
+
+			if err := server.ValidateEndpoints(); err != nil {
+				return errors.Wrapf(err, "validate SRS server %+v", server)
+			}
+
+			// Verify each endpoint speaks the expected protocol in background, to prevent traffic blackholes. The
+			// server is rejected until probed ok, or flagged by the probe error, which is not selected.
+			if probe := v.environment.RegisterProbe(); probe == "flag" || probe == "reject" {
+				done, err := v.prober.Probe(logger.WithContextID(context.Background(), logger.ContextID(ctx)), server)
+				if probe == "reject" && !done {
+					return errors.Errorf("probing SRS server %+v, retry later", server)
+				} else if probe == "reject" && err != nil {
+					return errors.Wrapf(err, "probe SRS server %+v", server)
+				} else if err != nil {
+					server.ProbeError = err.Error()
+					logger.Wf(ctx, "Flag SRS media server %+v, probe err %+v", server, err)
+				}
+			}
+
 			if err := lb.SrsLoadBalancer.Update(ctx, server); err != nil {
 				return errors.Wrapf(err, "update SRS server %+v", server)
 			}
@@ -263,23 +565,1081 @@ func (v *systemAPI) Run(ctx context.Context) error {
 		})
 	})
 
-	// Run System API server.
-	v.wg.Add(1)
-	go func() {
-		defer v.wg.Done()
+	// The registration tokens of backend servers, use POST to issue a token for the server id or device id of
+	// SRS, which is responded only once. The tokens are managed by admin only.
+	logger.Df(ctx, "Handle /api/v1/proxy/registrations by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/registrations", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method == http.MethodPost {
+				var identity string
+				if err := utils.ParseBody(r.Body, &struct {
+					// The server id or device id of SRS.
+					Identity *string `json:"identity"`
+				}{
+					Identity: &identity,
+				}); err != nil {
+					return errors.Wrapf(err, "parse body")
+				}
+
+				token, registration, err := lb.SrsServerRegistrar.Issue(ctx, identity)
+				if err != nil {
+					return errors.Wrapf(err, "issue token")
+				}
+				logger.Df(ctx, "Issue registration token %v for %v", registration.ID, identity)
+
+				type Response struct {
+					Code  int                       `json:"code"`
+					PID   string                    `json:"pid"`
+					Token string                    `json:"token"`
+					Data  *lb.SRSServerRegistration `json:"data"`
+				}
+
+				utils.ApiResponse(ctx, w, r, &Response{
+					Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Token: token, Data: registration,
+				})
+				return nil
+			}
+
+			registrations, err := lb.SrsServerRegistrar.List(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "list registrations")
+			}
+
+			type Response struct {
+				Code int                         `json:"code"`
+				PID  string                      `json:"pid"`
+				Data []*lb.SRSServerRegistration `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: registrations,
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
 
-		err := v.server.ListenAndServe()
+	logger.Df(ctx, "Handle /api/v1/proxy/registrations/{id} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/registrations/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/registrations/")
+			if id == "" {
+				return errors.Errorf("empty id")
+			}
+
+			if err := lb.SrsServerRegistrar.Revoke(ctx, id); err != nil {
+				return errors.Wrapf(err, "revoke token")
+			}
+			logger.Df(ctx, "Revoke registration token %v", id)
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The runtime resources of proxy, to detect the leak of goroutines, fds and load balancer state.
+	logger.Df(ctx, "Handle /api/v1/proxy/runtime by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/runtime", func(w http.ResponseWriter, r *http.Request) {
+		lbStats, err := lb.SrsLoadBalancer.Stats(ctx)
 		if err != nil {
-			if err == http.ErrServerClosed {
-				logger.Df(ctx, "System API server done")
-			} else if ctx.Err() != nil {
-				logger.Df(ctx, "System API server done with context canceled")
-			} else {
-				// TODO: If System API server closed unexpectedly, we should notice the main loop to quit.
-				logger.Wf(ctx, "System API accept err %+v", err)
+			utils.ApiError(ctx, w, r, errors.Wrapf(err, "load balancer stats"))
+			return
+		}
+
+		type Response struct {
+			Code int    `json:"code"`
+			PID  string `json:"pid"`
+			Data struct {
+				*debug.RuntimeStats
+				LoadBalancer map[string]int               `json:"lb"`
+				Loads        map[string]*lb.SRSServerLoad `json:"loads"`
+				Latencies    map[string]float64           `json:"latencies"`
+				Resolved     []*lb.ResolvedHost           `json:"resolved"`
+				Clock        *clock.Stats                 `json:"clock"`
+				Labels       map[string]map[string]int    `json:"labels"`
+				Closes       map[string]map[string]int64  `json:"closes"`
+			} `json:"data"`
+		}
+
+		res := Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+		res.Data.RuntimeStats = debug.NewRuntimeStats()
+		res.Data.LoadBalancer = lbStats
+		res.Data.Loads = lb.SrsServerLoadMonitor.Loads()
+		res.Data.Latencies = lb.SrsServerLatency.Latencies()
+		res.Data.Resolved = lb.SrsServerResolver.Hosts()
+		res.Data.Clock = clock.SrsClock.Stats()
+		res.Data.Labels = session.SrsSessionManager.LabelStats()
+		res.Data.Closes = session.SrsSessionManager.Closes()
+		utils.ApiResponse(ctx, w, r, &res)
+	})
+
+	// The usage of proxy and the state of soft limits, for the alarms and autoscaling.
+	logger.Df(ctx, "Handle /api/v1/proxy/alarms by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/alarms", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int    `json:"code"`
+			PID  string `json:"pid"`
+			Data struct {
+				Usage  *alarm.Usage   `json:"usage"`
+				Alarms []*alarm.Alarm `json:"alarms"`
+			} `json:"data"`
+		}
+
+		res := Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+		res.Data.Usage = alarm.SrsUsageMonitor.Usage()
+		res.Data.Alarms = alarm.SrsUsageMonitor.Alarms()
+		utils.ApiResponse(ctx, w, r, &res)
+	})
+
+	// The diagnostic snapshots of incidents, captured automatically when the sessions closed by error spike,
+	// use POST to capture a snapshot manually, with the reason in query.
+	logger.Df(ctx, "Handle /api/v1/proxy/incidents by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/incidents", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			reason := r.URL.Query().Get("reason")
+			if reason == "" {
+				reason = "manual"
+			}
+
+			snapshot, err := incident.SrsIncidentRecorder.Capture(ctx, reason)
+			if err != nil {
+				utils.ApiError(ctx, w, r, errors.Wrapf(err, "capture snapshot for %v", reason))
+				return
+			}
+
+			type Response struct {
+				Code int               `json:"code"`
+				PID  string            `json:"pid"`
+				Data *incident.Summary `json:"data"`
 			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: snapshot.Summary,
+			})
+			return
 		}
-	}()
+
+		type Response struct {
+			Code int                 `json:"code"`
+			PID  string              `json:"pid"`
+			Data []*incident.Summary `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: incident.SrsIncidentRecorder.Snapshots(),
+		})
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/incidents/{id} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/incidents/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/incidents/")
+		snapshot := incident.SrsIncidentRecorder.Snapshot(id)
+		if snapshot == nil {
+			utils.ApiError(ctx, w, r, errors.Errorf("snapshot %v not found", id))
+			return
+		}
+
+		type Response struct {
+			Code int                `json:"code"`
+			PID  string             `json:"pid"`
+			Data *incident.Snapshot `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: snapshot,
+		})
+	})
+
+	// The traffic captures of sessions to pcap files, use POST to capture a session in duration, by the session
+	// ID, or the next session from the client IP, like ?session=x&duration=10s or ?ip=x&duration=10s. The pcap
+	// holds the raw bytes of client, such as the stream key and token, so the captures are managed by admin only.
+	logger.Df(ctx, "Handle /api/v1/proxy/captures by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/captures", func(w http.ResponseWriter, r *http.Request) {
+		if err := v.verifyAdmin(r); err != nil {
+			utils.ApiError(ctx, w, r, errors.Wrapf(err, "verify admin"))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			q := r.URL.Query()
+			duration, err := time.ParseDuration(q.Get("duration"))
+			if err != nil {
+				utils.ApiError(ctx, w, r, errors.Wrapf(err, "parse duration %v", q.Get("duration")))
+				return
+			}
+
+			capture, err := srsTrafficCapturer.Start(ctx, q.Get("session"), q.Get("ip"), duration)
+			if err != nil {
+				utils.ApiError(ctx, w, r, errors.Wrapf(err, "capture session=%v, ip=%v", q.Get("session"), q.Get("ip")))
+				return
+			}
+
+			type Response struct {
+				Code int             `json:"code"`
+				PID  string          `json:"pid"`
+				Data *TrafficCapture `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: capture,
+			})
+			return
+		}
+
+		type Response struct {
+			Code int               `json:"code"`
+			PID  string            `json:"pid"`
+			Data []*TrafficCapture `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: srsTrafficCapturer.List(),
+		})
+	})
+
+	// Download the pcap file of capture, which is complete after the capture is done.
+	logger.Df(ctx, "Handle /api/v1/proxy/captures/{id} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/captures/", func(w http.ResponseWriter, r *http.Request) {
+		if err := v.verifyAdmin(r); err != nil {
+			utils.ApiError(ctx, w, r, errors.Wrapf(err, "verify admin"))
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/captures/")
+		capture := srsTrafficCapturer.Capture(id)
+		if capture == nil {
+			utils.ApiError(ctx, w, r, errors.Errorf("capture %v not found", id))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v.pcap", capture.ID))
+		http.ServeFile(w, r, capture.File)
+	})
+
+	// The usage of proxy in the format of Kubernetes external metrics, for HPA by a metrics adapter, or KEDA
+	// by the metrics-api scaler. Filter by metric name if metric is specified.
+	logger.Df(ctx, "Handle /api/v1/proxy/metrics/external by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/metrics/external", func(w http.ResponseWriter, r *http.Request) {
+		type ExternalMetricValue struct {
+			MetricName   string            `json:"metricName"`
+			MetricLabels map[string]string `json:"metricLabels"`
+			Timestamp    time.Time         `json:"timestamp"`
+			Value        string            `json:"value"`
+		}
+		type Response struct {
+			Kind       string                 `json:"kind"`
+			APIVersion string                 `json:"apiVersion"`
+			Metadata   struct{}               `json:"metadata"`
+			Items      []*ExternalMetricValue `json:"items"`
+		}
+
+		// The value is a Kubernetes quantity, in milli units to keep the fractions.
+		usage := alarm.SrsUsageMonitor.Usage()
+		res := Response{Kind: "ExternalMetricValueList", APIVersion: "external.metrics.k8s.io/v1beta1"}
+		res.Items = []*ExternalMetricValue{}
+		for _, m := range []struct {
+			name  string
+			value float64
+		}{
+			{"proxy_sessions", float64(usage.Sessions)},
+			{"proxy_bandwidth_mbps", usage.Bandwidth},
+			{"proxy_cpu_percent", math.Max(0, usage.CPU)},
+			{"proxy_utilization_percent", usage.Utilization},
+		} {
+			if metric := r.URL.Query().Get("metric"); metric != "" && metric != m.name {
+				continue
+			}
+			res.Items = append(res.Items, &ExternalMetricValue{
+				MetricName: m.name, MetricLabels: map[string]string{"pid": fmt.Sprintf("%v", os.Getpid())},
+				Timestamp: usage.UpdatedAt, Value: fmt.Sprintf("%vm", int64(m.value*1000)),
+			})
+		}
+		utils.ApiResponse(ctx, w, r, &res)
+	})
+
+	// The build information, enabled features and listener status, to understand a deployment in one call.
+	logger.Df(ctx, "Handle /api/v1/proxy/info by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/info", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int    `json:"code"`
+			PID  string `json:"pid"`
+			Data struct {
+				Build     *version.BuildInfo `json:"build"`
+				Features  map[string]bool    `json:"features"`
+				Listeners []*ListenerStatus  `json:"listeners"`
+			} `json:"data"`
+		}
+
+		res := Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+		res.Data.Build = version.NewBuildInfo()
+		res.Data.Features = features(v.environment)
+		res.Data.Listeners = listListeners()
+		utils.ApiResponse(ctx, w, r, &res)
+	})
+
+	// The effective configuration of proxy, the secrets are masked.
+	logger.Df(ctx, "Handle /api/v1/proxy/config by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/config", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int               `json:"code"`
+			PID  string            `json:"pid"`
+			Data map[string]string `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: v.environment.Config(),
+		})
+	})
+
+	// The history of configuration changes by reload, to confirm what's actually running.
+	logger.Df(ctx, "Handle /api/v1/proxy/config/changes by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/config/changes", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                   `json:"code"`
+			PID  string                `json:"pid"`
+			Data []*env.ConfigRevision `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: v.environment.ConfigChanges(),
+		})
+	})
+
+	// The client sessions of proxy, with the fingerprint of HTTP clients, to identify the scraping or
+	// restreaming bots. Filter by stream URL in vhost/app/stream schema if stream is specified.
+	logger.Df(ctx, "Handle /api/v1/proxy/sessions by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/sessions", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                `json:"code"`
+			PID  string             `json:"pid"`
+			Data []*session.Session `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			Data: session.SrsSessionManager.List(r.URL.Query().Get("stream")),
+		})
+	})
+
+	// The number of sessions of each stream, by protocol, and the WebRTC viewers and publishers.
+	logger.Df(ctx, "Handle /api/v1/proxy/streams by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/streams", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                    `json:"code"`
+			PID  string                 `json:"pid"`
+			Data []*session.StreamStats `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: session.SrsSessionManager.Streams(),
+		})
+	})
+
+	// The edge streams pulled once from backend, and the number of local viewers fanned out.
+	logger.Df(ctx, "Handle /api/v1/proxy/edges by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/edges", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                 `json:"code"`
+			PID  string              `json:"pid"`
+			Data []*EdgeStreamStatus `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: srsEdgeRelay.List(),
+		})
+	})
+
+	// The RTMP sessions with the stats, the metadata, codecs, frames and bitrate by the RTMP messages. Filter
+	// by stream URL if stream is specified.
+	logger.Df(ctx, "Handle /api/v1/proxy/rtmp/stats by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/rtmp/stats", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                `json:"code"`
+			PID  string             `json:"pid"`
+			Data []*session.Session `json:"data"`
+		}
+
+		res := &Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: []*session.Session{}}
+		for _, s := range session.SrsSessionManager.List(r.URL.Query().Get("stream")) {
+			if s.Protocol == "rtmp" && s.Stats != nil {
+				res.Data = append(res.Data, s)
+			}
+		}
+		utils.ApiResponse(ctx, w, r, res)
+	})
+
+	// The traffic of RTMP streams, the bytes, bitrate and duration of all sessions of each stream, the most
+	// bitrate first, to find the streams which consume the bandwidth through proxy.
+	logger.Df(ctx, "Handle /api/v1/proxy/rtmp/streams by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/rtmp/streams", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                  `json:"code"`
+			PID  string               `json:"pid"`
+			Data []*RTMPStreamTraffic `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: listRTMPStreamTraffic(),
+		})
+	})
+
+	// The stats of SRT sessions, one JSON object per line in the format of srt-live-transmit, so the SRT
+	// monitoring scripts are able to target the proxy. Filter by stream URL if stream is specified.
+	logger.Df(ctx, "Handle /api/v1/proxy/srt/stats by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/srt/stats", func(w http.ResponseWriter, r *http.Request) {
+		var lines bytes.Buffer
+		for _, s := range session.SrsSessionManager.List(r.URL.Query().Get("stream")) {
+			if s.Protocol != "srt" || s.Stats == nil {
+				continue
+			}
+
+			b, err := json.Marshal(s.Stats)
+			if err != nil {
+				utils.ApiError(ctx, w, r, errors.Wrapf(err, "marshal stats of %v", s.ID))
+				return
+			}
+			lines.Write(b)
+			lines.WriteString("\n")
+		}
+
+		w.Header().Set("Server", fmt.Sprintf("%v/%v", version.Signature(), version.Version()))
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(lines.Bytes())
+	})
+
+	// The policy to deny, throttle or route the clients, use PUT or POST to replace the policy, which is
+	// saved to PROXY_POLICY_FILE if configured.
+	logger.Df(ctx, "Handle /api/v1/proxy/policy by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/policy", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				var p policy.Policy
+				if err := utils.ParseBody(r.Body, &p); err != nil {
+					return errors.Wrapf(err, "parse body")
+				}
+				if err := policy.SrsPolicyEngine.Update(ctx, &p); err != nil {
+					return errors.Wrapf(err, "update policy")
+				}
+			}
+
+			type Response struct {
+				Code int            `json:"code"`
+				PID  string         `json:"pid"`
+				Data *policy.Policy `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: policy.SrsPolicyEngine.Policy(),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The routing pools and rules of new streams, loaded from PROXY_ROUTING_FILE.
+	logger.Df(ctx, "Handle /api/v1/proxy/routing by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/routing", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int               `json:"code"`
+			PID  string            `json:"pid"`
+			Data *lb.RoutingConfig `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: lb.SrsServerRouter.Config(),
+		})
+	})
+
+	// The dry-run mode and the decisions not enforced, use PUT or POST with {"enabled":true} to toggle the mode,
+	// which resets the decisions.
+	logger.Df(ctx, "Handle /api/v1/proxy/dryrun by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/dryrun", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				var enabled bool
+				if err := utils.ParseBody(r.Body, &struct {
+					Enabled *bool `json:"enabled"`
+				}{
+					Enabled: &enabled,
+				}); err != nil {
+					return errors.Wrapf(err, "parse body")
+				}
+				dryrun.SrsDryRun.SetEnabled(ctx, enabled)
+			}
+
+			type Response struct {
+				Code int           `json:"code"`
+				PID  string        `json:"pid"`
+				Data *dryrun.Stats `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: dryrun.SrsDryRun.Stats(),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The circuit breakers of backend servers with failures, the server with open breaker gets no new stream.
+	logger.Df(ctx, "Handle /api/v1/proxy/breakers by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/breakers", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                         `json:"code"`
+			PID  string                      `json:"pid"`
+			Data []*lb.SRSServerBreakerState `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: lb.SrsServerBreaker.States(),
+		})
+	})
+
+	// The streams failed over to the fallback pool of routing rule, which fail back by the policy of rule.
+	logger.Df(ctx, "Handle /api/v1/proxy/failovers by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/failovers", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                          `json:"code"`
+			PID  string                       `json:"pid"`
+			Data []*lb.SRSServerFailoverState `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: lb.SrsServerFailback.States(),
+		})
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/leader by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/leader", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int             `json:"code"`
+			PID  string          `json:"pid"`
+			Data *lb.LeaderState `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: lb.SrsLeaderElection.State(),
+		})
+	})
+
+	// Drain the proxy itself, use POST by admin to stop accepting new connections and quit after the sessions
+	// drained, or GET to query the draining state.
+	logger.Df(ctx, "Handle /api/v1/proxy/drain by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := v.verifyAdmin(r); err != nil {
+				utils.ApiError(ctx, w, r, errors.Wrapf(err, "verify admin"))
+				return
+			}
+			SrsProxyDrainer.Drain(ctx, "api")
+		}
+
+		type Response struct {
+			Code int              `json:"code"`
+			PID  string           `json:"pid"`
+			Data *ProxyDrainState `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: SrsProxyDrainer.State(),
+		})
+	})
+
+	// Upgrade the binary without downtime, use POST to start the new process with the listeners, and drain this
+	// process after the new process is ready.
+	logger.Df(ctx, "Handle /api/v1/proxy/upgrade by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method != http.MethodPost {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			pid, err := UpgradeProxy(ctx, v.environment)
+			if err != nil {
+				return errors.Wrapf(err, "upgrade")
+			}
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+				Data struct {
+					// The pid of new process.
+					PID int `json:"pid"`
+				} `json:"data"`
+			}
+
+			res := &Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+			res.Data.PID = pid
+			utils.ApiResponse(ctx, w, r, res)
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The forwarding between proxies, to query the owner of session, and serve the request forwarded by peer.
+	logger.Df(ctx, "Handle %v by %v", ForwardOwnerPath, addr)
+	mux.HandleFunc(ForwardOwnerPath, func(w http.ResponseWriter, r *http.Request) {
+		srsForwarder.ServeOwner(ctx, w, r)
+	})
+
+	logger.Df(ctx, "Handle %v by %v", ForwardPath, addr)
+	mux.HandleFunc(ForwardPath, func(w http.ResponseWriter, r *http.Request) {
+		srsForwarder.ServeForward(ctx, w, r)
+	})
+
+	// The gossip between memory proxies, use POST to exchange the state, or GET to list the peers.
+	logger.Df(ctx, "Handle %v by %v", lb.GossipPath, addr)
+	mux.HandleFunc(lb.GossipPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if lb.SrsGossip == nil {
+				return errors.Errorf("gossip not enabled")
+			}
+			if err := lb.SrsGossip.Authorize(r); err != nil {
+				return errors.Wrapf(err, "authorize")
+			}
+
+			if r.Method == http.MethodPost {
+				b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxGossipMessageSize))
+				if err != nil {
+					return errors.Wrapf(err, "read body")
+				}
+
+				res, err := lb.SrsGossip.Exchange(ctx, b)
+				if err != nil {
+					return errors.Wrapf(err, "exchange")
+				}
+
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write(res)
+				return nil
+			}
+
+			type Response struct {
+				Code int              `json:"code"`
+				PID  string           `json:"pid"`
+				Data []*lb.GossipPeer `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: lb.SrsGossip.Peers(),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The relay tasks by FFmpeg, use POST to add a task, which pulls the input such as an RTSP camera, and
+	// publishes into the cluster via the backend server picked for the stream.
+	logger.Df(ctx, "Handle /api/v1/proxy/relays by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/relays", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method == http.MethodPost {
+				var task relay.Task
+				if err := utils.ParseBody(r.Body, &task); err != nil {
+					return errors.Wrapf(err, "parse body")
+				}
+
+				status, err := relay.SrsRelayManager.Add(ctx, &task)
+				if err != nil {
+					return errors.Wrapf(err, "add relay task")
+				}
+
+				type Response struct {
+					Code int           `json:"code"`
+					PID  string        `json:"pid"`
+					Data *relay.Status `json:"data"`
+				}
+
+				utils.ApiResponse(ctx, w, r, &Response{
+					Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: status,
+				})
+				return nil
+			}
+
+			type Response struct {
+				Code int             `json:"code"`
+				PID  string          `json:"pid"`
+				Data []*relay.Status `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: relay.SrsRelayManager.List(),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/relays/{id} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/relays/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/relays/")
+			if id == "" {
+				return errors.Errorf("empty id")
+			}
+
+			if err := relay.SrsRelayManager.Remove(ctx, id); err != nil {
+				return errors.Wrapf(err, "remove relay task")
+			}
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The schedules of relay tasks, use POST to add a schedule, which starts and stops the task by the cron
+	// expressions, for example, pulls a feed only during business hours.
+	logger.Df(ctx, "Handle /api/v1/proxy/schedules by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/schedules", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method == http.MethodPost {
+				var schedule relay.Schedule
+				if err := utils.ParseBody(r.Body, &schedule); err != nil {
+					return errors.Wrapf(err, "parse body")
+				}
+
+				status, err := relay.SrsRelayScheduler.Add(ctx, &schedule)
+				if err != nil {
+					return errors.Wrapf(err, "add relay schedule")
+				}
+
+				type Response struct {
+					Code int                   `json:"code"`
+					PID  string                `json:"pid"`
+					Data *relay.ScheduleStatus `json:"data"`
+				}
+
+				utils.ApiResponse(ctx, w, r, &Response{
+					Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: status,
+				})
+				return nil
+			}
+
+			type Response struct {
+				Code int                     `json:"code"`
+				PID  string                  `json:"pid"`
+				Data []*relay.ScheduleStatus `json:"data"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: relay.SrsRelayScheduler.List(),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/schedules/{id} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/schedules/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := v.verifyAdmin(r); err != nil {
+				return errors.Wrapf(err, "verify admin")
+			}
+
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/schedules/")
+			if id == "" {
+				return errors.Errorf("empty id")
+			}
+
+			if err := relay.SrsRelayScheduler.Remove(ctx, id); err != nil {
+				return errors.Wrapf(err, "remove relay schedule")
+			}
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The tokens revoked for restreaming, use DELETE /api/v1/proxy/tokens/revoked/{token} to restore a
+	// token, for example, which is revoked by mistake.
+	logger.Df(ctx, "Handle /api/v1/proxy/tokens/revoked by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/tokens/revoked", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                      `json:"code"`
+			PID  string                   `json:"pid"`
+			Data []*restream.RevokedToken `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: restream.SrsDetector.Revoked(),
+		})
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/tokens/revoked/{token} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/tokens/revoked/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			token := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/tokens/revoked/")
+			if token == "" {
+				return errors.Errorf("empty token")
+			}
+
+			if !restream.SrsDetector.Restore(token) {
+				return errors.Errorf("token %v not revoked", token)
+			}
+			logger.Df(ctx, "Restore revoked token %v", token)
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The client IPs in tarpit, which repeatedly fail auth or exceed the rate limit, use DELETE to release
+	// the client IP from tarpit.
+	logger.Df(ctx, "Handle /api/v1/proxy/tarpit by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/tarpit", func(w http.ResponseWriter, r *http.Request) {
+		type Response struct {
+			Code int                `json:"code"`
+			PID  string             `json:"pid"`
+			Data []*tarpit.Offender `json:"data"`
+		}
+
+		utils.ApiResponse(ctx, w, r, &Response{
+			Code: 0, PID: fmt.Sprintf("%v", os.Getpid()), Data: tarpit.SrsTarpit.Offenders(),
+		})
+	})
+
+	logger.Df(ctx, "Handle /api/v1/proxy/tarpit/{ip} by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/tarpit/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			ip := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/tarpit/")
+			if ip == "" {
+				return errors.Errorf("empty ip")
+			}
+
+			if !tarpit.SrsTarpit.Release(ip) {
+				return errors.Errorf("ip %v not in tarpit", ip)
+			}
+			logger.Df(ctx, "Release client %v from tarpit", ip)
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+			}
+
+			utils.ApiResponse(ctx, w, r, &Response{
+				Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+			})
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// Force re-pick the backend server for a stream, for example, after fixing a misrouted placement.
+	// The stream is the stream URL in vhost/app/stream schema, like __defaultVhost__/live/livestream,
+	// and the sessions of stream are disconnected if kick=true, so they re-route to the new backend.
+	logger.Df(ctx, "Handle /api/v1/proxy/streams/{stream}/repick by %v", addr)
+	mux.HandleFunc("/api/v1/proxy/streams/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method != http.MethodPost {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			streamURL := strings.TrimPrefix(r.URL.Path, "/api/v1/proxy/streams/")
+			if !strings.HasSuffix(streamURL, "/repick") {
+				return errors.Errorf("invalid path %v", r.URL.Path)
+			}
+			if streamURL = strings.TrimSuffix(streamURL, "/repick"); streamURL == "" {
+				return errors.Errorf("empty stream")
+			}
+
+			if err := lb.SrsLoadBalancer.Unpick(ctx, streamURL); err != nil {
+				return errors.Wrapf(err, "unpick %v", streamURL)
+			}
+
+			var kicked int
+			if kick := r.URL.Query().Get("kick"); kick == "true" || kick == "1" {
+				kicked = session.SrsSessionManager.Kick(ctx, streamURL)
+			}
+			logger.Df(ctx, "Repick stream %v, kicked %v sessions", streamURL, kicked)
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+				Data struct {
+					StreamURL string `json:"stream_url"`
+					Kicked    int    `json:"kicked"`
+				} `json:"data"`
+			}
+
+			res := Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+			res.Data.StreamURL, res.Data.Kicked = streamURL, kicked
+			utils.ApiResponse(ctx, w, r, &res)
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// Drain the backend server, which gets no new stream while the existing sessions continue, to upgrade
+	// SRS without disruption. The id is the ID of server, or the server id or device id of SRS, and the
+	// DELETE method undrains it.
+	logger.Df(ctx, "Handle /api/v1/servers/{id}/drain by %v", addr)
+	mux.HandleFunc("/api/v1/servers/", func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1/servers/")
+			if !strings.HasSuffix(id, "/drain") {
+				return errors.Errorf("invalid path %v", r.URL.Path)
+			}
+			if id = strings.TrimSuffix(id, "/drain"); id == "" || strings.Contains(id, "/") {
+				return errors.Errorf("invalid id %v", id)
+			}
+
+			draining := r.Method == http.MethodPost
+			if draining {
+				if err := lb.SrsServerDrainer.Drain(ctx, id); err != nil {
+					return errors.Wrapf(err, "drain %v", id)
+				}
+				logger.Df(ctx, "Drain SRS media server %v", id)
+			} else if ok, err := lb.SrsServerDrainer.Undrain(ctx, id); err != nil {
+				return errors.Wrapf(err, "undrain %v", id)
+			} else if ok {
+				logger.Df(ctx, "Undrain SRS media server %v", id)
+			}
+
+			type Response struct {
+				Code int    `json:"code"`
+				PID  string `json:"pid"`
+				Data struct {
+					ID       string   `json:"id"`
+					Draining bool     `json:"draining"`
+					Servers  []string `json:"servers"`
+				} `json:"data"`
+			}
+
+			res := Response{Code: 0, PID: fmt.Sprintf("%v", os.Getpid())}
+			res.Data.ID, res.Data.Draining, res.Data.Servers = id, draining, lb.SrsServerDrainer.List()
+			utils.ApiResponse(ctx, w, r, &res)
+			return nil
+		}(); err != nil {
+			utils.ApiError(ctx, w, r, err)
+		}
+	})
+
+	// The built-in test player, to play the stream through proxy and show the sessions of stream.
+	logger.Df(ctx, "Handle /players/ by %v", addr)
+	mux.HandleFunc("/players/", servePlayer)
+
+	// Run System API server, for each listener.
+	serve := func(name string, listener net.Listener) {
+		addr := listener.Addr().String()
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			err := v.server.Serve(listener)
+			if err != nil {
+				if err == http.ErrServerClosed {
+					logger.Df(ctx, "System API server %v done", name)
+					updateListener(name, addr, false, nil)
+				} else if ctx.Err() != nil {
+					logger.Df(ctx, "System API server %v done with context canceled", name)
+					updateListener(name, addr, false, nil)
+				} else {
+					// TODO: If System API server closed unexpectedly, we should notice the main loop to quit.
+					logger.Wf(ctx, "System API %v accept err %+v", name, err)
+					updateListener(name, addr, false, err)
+				}
+			}
+		}()
+	}
+	serve("system-api", listener)
+	for i, tlsListener := range tlsListeners {
+		serve(listenerName("https-system-api", i), tlsListener)
+	}
 
 	return nil
 }
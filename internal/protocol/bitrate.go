@@ -0,0 +1,93 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"time"
+
+	"srsx/internal/session"
+)
+
+// The interval to sample the bitrate of sessions.
+const bitrateSampleInterval = time.Second
+
+// bitrateSampled is the stats of session, whose bitrate is sampled by the bitrate sampler.
+type bitrateSampled interface {
+	// sampleBitrate samples the bitrate of all directions at now, which is only called by the sampler.
+	sampleBitrate(now time.Time)
+}
+
+// bitrateSampler samples the bitrate of the stats of all sessions by a ticker, so the readers of stats, like
+// the System API and the stream traffic, are free of side effects, and get the same bitrate of the last
+// interval however often they read.
+type bitrateSampler struct {
+}
+
+// The sampler of bitrate of the RTMP, WebRTC and SRT sessions.
+var srsBitrateSampler = &bitrateSampler{}
+
+// Run samples the bitrate of sessions in interval, until ctx done.
+func (v *bitrateSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(bitrateSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			v.sample(now)
+		}
+	}
+}
+
+// sample the bitrate of all sessions at now.
+func (v *bitrateSampler) sample(now time.Time) {
+	for _, s := range session.SrsSessionManager.List("") {
+		if stats, ok := s.Stats.(bitrateSampled); ok {
+			stats.sampleBitrate(now)
+		}
+	}
+}
+
+// bitrateMeter is the bitrate of the bytes in one direction, sampled by the sampler, where the total bytes
+// are counted by the stats, which also protects the meter by its lock.
+type bitrateMeter struct {
+	// The total bytes and time of last sample.
+	sampleBytes uint64
+	sampleAt    time.Time
+	// The bitrate in bits per second of last sample.
+	bps float64
+}
+
+// sample the bitrate by the total bytes at now, since the last sample or createdAt.
+func (v *bitrateMeter) sample(total uint64, now, createdAt time.Time) {
+	from := v.sampleAt
+	if from.IsZero() {
+		from = createdAt
+	}
+
+	if elapsed := now.Sub(from); elapsed > 0 {
+		v.bps = float64(total-v.sampleBytes) * 8 / elapsed.Seconds()
+		v.sampleBytes, v.sampleAt = total, now
+	}
+}
+
+// bitrate returns the bits per second of last sample, or the average since createdAt if not sampled yet,
+// without any side effect.
+func (v *bitrateMeter) bitrate(total uint64, now, createdAt time.Time) float64 {
+	if !v.sampleAt.IsZero() {
+		return v.bps
+	}
+	if elapsed := now.Sub(createdAt); elapsed > 0 {
+		return float64(total) * 8 / elapsed.Seconds()
+	}
+	return 0
+}
+
+// RunBitrateSampler samples the bitrate of sessions in interval, until ctx done, see bitrateSampler.
+func RunBitrateSampler(ctx context.Context) {
+	srsBitrateSampler.Run(ctx)
+}
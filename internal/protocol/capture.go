@@ -0,0 +1,587 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	stdSync "sync"
+	"sync/atomic"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/session"
+	"srsx/internal/sync"
+)
+
+// The max number of captures kept in list, the oldest done capture and its file are removed if full.
+const maxTrafficCaptures = 16
+
+// The max number of active captures, pending or capturing, to limit the cost of captures.
+const maxActiveTrafficCaptures = 4
+
+// The max bytes of a capture file, the capture is done when exceeded.
+const maxTrafficCaptureBytes = 256 * 1024 * 1024
+
+// The max packets queued to write to the capture file, the packets are dropped if full, to never block the
+// session by the disk.
+const maxTrafficCaptureQueue = 1024
+
+// The max payload of a packet in capture, the larger data is split to packets, to fit the IP total length.
+const maxCapturePayload = 65000
+
+// The state of capture.
+const (
+	// Waiting for the next session from the IP.
+	captureStatePending = "pending"
+	// Recording the traffic of session.
+	captureStateCapturing = "capturing"
+	// The capture is done by duration, size or error.
+	captureStateDone = "done"
+)
+
+// TrafficCapture records the raw bytes between a client and proxy to a pcap file in duration, to debug the
+// interop issues without tcpdump on the host of proxy. The TCP of RTMP and HTTP, and the UDP of SRT and WebRTC,
+// are written as IP packets, so the pcap is decoded by Wireshark as the protocol.
+type TrafficCapture struct {
+	// The ID of capture.
+	ID string `json:"id"`
+	// The session to capture, which is bound later if capture by IP.
+	SessionID string `json:"session_id,omitempty"`
+	// The IP of client to capture the next session, empty if capture by session.
+	IP string `json:"ip,omitempty"`
+	// The file of pcap.
+	File string `json:"file"`
+	// The state, pending, capturing or done.
+	State string `json:"state"`
+	// The time started and the duration in seconds to capture.
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration"`
+	// The packets and bytes of payload captured, updated atomically by the writer.
+	Packets int64 `json:"packets"`
+	Bytes   int64 `json:"bytes"`
+	// The packets dropped because the queue is full, updated atomically.
+	Dropped int64 `json:"dropped,omitempty"`
+	// The error to write the file, if any.
+	Error string `json:"error,omitempty"`
+
+	// The writer of pcap file, only used by the goroutine of writer.
+	file   *os.File
+	writer *bufio.Writer
+	// The next sequence of TCP, from client and to client.
+	seqs [2]uint32
+	// The timer to stop the capture by duration.
+	timer *time.Timer
+	// The packets to write by the goroutine of writer.
+	packets chan *capturePacket
+	// Closed when the capture is done, to stop the writer.
+	done chan struct{}
+}
+
+// capturePacket is the payload queued to write to the capture file.
+type capturePacket struct {
+	// The addresses of proxy and client.
+	local, remote net.Addr
+	// Whether the payload is from client.
+	fromClient bool
+	// The copy of payload.
+	payload []byte
+	// The time received or sent.
+	at time.Time
+}
+
+// trafficCapturer manages the captures of sessions, started by System API. The sessions record the traffic by
+// the context ID, which is the ID of session, so there is almost no cost if nothing to capture.
+type trafficCapturer struct {
+	// The directory to write the pcap files, empty to disable.
+	dir string
+	// The max duration of a capture.
+	maxDuration time.Duration
+
+	// The number of active captures, pending or capturing, to ignore the traffic fast if none.
+	active int32
+	// The capturing sessions, key is the session ID, to look up for each packet without lock.
+	sessions sync.Map[string, *TrafficCapture]
+	// The captures, the oldest first.
+	captures []*TrafficCapture
+	// The lock to protect the captures and the state of captures.
+	lock stdSync.Mutex
+}
+
+// The captures of sessions, by PROXY_CAPTURE_DIR and PROXY_CAPTURE_MAX_DURATION.
+var srsTrafficCapturer = &trafficCapturer{}
+
+// configure the directory and max duration by environment.
+func (v *trafficCapturer) configure(ctx context.Context, environment env.Environment) error {
+	maxDuration, err := time.ParseDuration(environment.CaptureMaxDuration())
+	if err != nil || maxDuration <= 0 {
+		return errors.Errorf("invalid capture max duration %v", environment.CaptureMaxDuration())
+	}
+
+	v.dir, v.maxDuration = environment.CaptureDir(), maxDuration
+	if v.dir != "" {
+		if err := os.MkdirAll(v.dir, 0755); err != nil {
+			return errors.Wrapf(err, "create capture dir %v", v.dir)
+		}
+		logger.Df(ctx, "Traffic capture dir=%v, max duration=%v", v.dir, maxDuration)
+	}
+	return nil
+}
+
+// Start to capture the session sessionID, or the next session from ip, in duration.
+func (v *trafficCapturer) Start(ctx context.Context, sessionID, ip string, duration time.Duration) (*TrafficCapture, error) {
+	if v.dir == "" {
+		return nil, errors.Errorf("capture disabled, no PROXY_CAPTURE_DIR")
+	}
+	if (sessionID == "") == (ip == "") {
+		return nil, errors.Errorf("require either session or ip")
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, errors.Errorf("invalid ip %v", ip)
+	}
+	if duration <= 0 || duration > v.maxDuration {
+		return nil, errors.Errorf("invalid duration %v, max %v", duration, v.maxDuration)
+	}
+
+	// The session must exist, to capture by session.
+	if sessionID != "" {
+		var found bool
+		for _, s := range session.SrsSessionManager.List("") {
+			found = found || s.ID == sessionID
+		}
+		if !found {
+			return nil, errors.Errorf("session %v not found", sessionID)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if sessionID != "" {
+		if _, ok := v.sessions.Load(sessionID); ok {
+			return nil, errors.Errorf("session %v is capturing", sessionID)
+		}
+	}
+	if active := atomic.LoadInt32(&v.active); active >= maxActiveTrafficCaptures {
+		return nil, errors.Errorf("too many captures %v, max %v", active, maxActiveTrafficCaptures)
+	}
+
+	now := time.Now()
+	c := &TrafficCapture{
+		ID: fmt.Sprintf("%v-%v", now.UTC().Format("20060102T150405"), logger.GenerateContextID()),
+		IP: ip, State: captureStatePending, StartedAt: now, Duration: duration.Seconds(),
+		packets: make(chan *capturePacket, maxTrafficCaptureQueue), done: make(chan struct{}),
+	}
+	c.File = path.Join(v.dir, fmt.Sprintf("%v.pcap", c.ID))
+	if err := c.open(); err != nil {
+		return nil, errors.Wrapf(err, "open %v", c.File)
+	}
+
+	if sessionID != "" {
+		c.SessionID, c.State = sessionID, captureStateCapturing
+		v.sessions.Store(sessionID, c)
+	}
+
+	// Remove the oldest done capture and its file if full. There is always a done capture, because the active
+	// captures are less than the list.
+	if len(v.captures) >= maxTrafficCaptures {
+		for i, capture := range v.captures {
+			if capture.State == captureStateDone {
+				v.captures = append(v.captures[:i], v.captures[i+1:]...)
+				if err := os.Remove(capture.File); err != nil && !os.IsNotExist(err) {
+					logger.Wf(ctx, "Remove capture %v file %v, err %+v", capture.ID, capture.File, err)
+				}
+				break
+			}
+		}
+	}
+	v.captures = append(v.captures, c)
+	atomic.AddInt32(&v.active, 1)
+
+	go v.write(c)
+	c.timer = time.AfterFunc(duration, func() {
+		v.stop(c, nil)
+	})
+
+	logger.Df(ctx, "Start capture %v of session=%v, ip=%v, duration=%v, file=%v",
+		c.ID, sessionID, ip, duration, c.File)
+	return c.snapshot(), nil
+}
+
+// attach the capture by IP to the new session of ctx from remote, so the session is captured from the first
+// bytes, such as the handshake.
+func (v *trafficCapturer) attach(ctx context.Context, remote net.Addr) {
+	if atomic.LoadInt32(&v.active) == 0 {
+		return
+	}
+
+	ip := captureAddrIP(remote)
+	if ip == nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, c := range v.captures {
+		if c.State == captureStatePending && net.ParseIP(c.IP).Equal(ip) {
+			c.SessionID, c.State = logger.ContextID(ctx), captureStateCapturing
+			v.sessions.Store(c.SessionID, c)
+			logger.Df(ctx, "Attach capture %v to session %v from %v", c.ID, c.SessionID, remote)
+			return
+		}
+	}
+}
+
+// record the payload p between client remote and proxy local, of the session of ctx. The payload is copied and
+// queued to the writer, or dropped if the queue is full, so the session is never blocked by the disk.
+func (v *trafficCapturer) record(ctx context.Context, local, remote net.Addr, fromClient bool, p []byte) {
+	if atomic.LoadInt32(&v.active) == 0 || len(p) == 0 {
+		return
+	}
+
+	c, ok := v.sessions.Load(logger.ContextID(ctx))
+	if !ok {
+		return
+	}
+
+	packet := &capturePacket{
+		local: local, remote: remote, fromClient: fromClient, payload: append([]byte(nil), p...), at: time.Now(),
+	}
+	select {
+	case c.packets <- packet:
+	case <-c.done:
+	default:
+		atomic.AddInt64(&c.Dropped, 1)
+	}
+}
+
+// write the queued packets of capture c to file, until done, then flushes and closes the file.
+func (v *trafficCapturer) write(c *TrafficCapture) {
+	for {
+		select {
+		case packet := <-c.packets:
+			if err := c.write(packet); err != nil {
+				v.stop(c, err)
+			} else if atomic.LoadInt64(&c.Bytes) >= maxTrafficCaptureBytes {
+				v.stop(c, errors.Errorf("exceed max bytes %v", maxTrafficCaptureBytes))
+			}
+		case <-c.done:
+			// Write the packets queued before done, to not lose the tail of capture.
+			for len(c.packets) > 0 {
+				if err := c.write(<-c.packets); err != nil {
+					break
+				}
+			}
+
+			err := c.close()
+
+			v.lock.Lock()
+			if err != nil && c.Error == "" {
+				c.Error = err.Error()
+			}
+			v.lock.Unlock()
+
+			logger.Df(context.Background(), "Stop capture %v of session=%v, ip=%v, packets=%v, bytes=%v, dropped=%v, err=%v",
+				c.ID, c.SessionID, c.IP, atomic.LoadInt64(&c.Packets), atomic.LoadInt64(&c.Bytes),
+				atomic.LoadInt64(&c.Dropped), c.Error)
+			return
+		}
+	}
+}
+
+// stop the capture c, by the error if not nil.
+func (v *trafficCapturer) stop(c *TrafficCapture, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if c.State == captureStateDone {
+		return
+	}
+
+	c.State = captureStateDone
+	if err != nil {
+		c.Error = err.Error()
+	}
+	c.timer.Stop()
+	close(c.done)
+
+	if c.SessionID != "" {
+		if current, ok := v.sessions.Load(c.SessionID); ok && current == c {
+			v.sessions.Delete(c.SessionID)
+		}
+	}
+	atomic.AddInt32(&v.active, -1)
+}
+
+// List the captures, the oldest first.
+func (v *trafficCapturer) List() []*TrafficCapture {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	captures := make([]*TrafficCapture, 0, len(v.captures))
+	for _, c := range v.captures {
+		captures = append(captures, c.snapshot())
+	}
+	return captures
+}
+
+// Capture returns the capture by id, or nil if not found.
+func (v *trafficCapturer) Capture(id string) *TrafficCapture {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, c := range v.captures {
+		if c.ID == id {
+			return c.snapshot()
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of capture, to marshal without lock.
+func (v *TrafficCapture) snapshot() *TrafficCapture {
+	return &TrafficCapture{
+		ID: v.ID, SessionID: v.SessionID, IP: v.IP, File: v.File, State: v.State,
+		StartedAt: v.StartedAt, Duration: v.Duration, Packets: atomic.LoadInt64(&v.Packets),
+		Bytes: atomic.LoadInt64(&v.Bytes), Dropped: atomic.LoadInt64(&v.Dropped), Error: v.Error,
+	}
+}
+
+// open the pcap file, and write the global header, in the link type of raw IP.
+func (v *TrafficCapture) open() error {
+	f, err := os.Create(v.File)
+	if err != nil {
+		return errors.Wrapf(err, "create")
+	}
+
+	v.file, v.writer = f, bufio.NewWriter(f)
+	v.seqs = [2]uint32{1, 1}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 262144)
+	binary.LittleEndian.PutUint32(header[20:], 101)
+	if _, err := v.writer.Write(header); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "write header")
+	}
+	return nil
+}
+
+func (v *TrafficCapture) close() error {
+	if v.file == nil {
+		return nil
+	}
+	defer v.file.Close()
+
+	if err := v.writer.Flush(); err != nil {
+		return errors.Wrapf(err, "flush %v", v.File)
+	}
+	return nil
+}
+
+// write the payload of packet as IP packets, the TCP segments or UDP datagrams between client remote and proxy
+// local.
+func (v *TrafficCapture) write(packet *capturePacket) error {
+	local, remote, fromClient, p, now := packet.local, packet.remote, packet.fromClient, packet.payload, packet.at
+	src, dst := remote, local
+	if !fromClient {
+		src, dst = local, remote
+	}
+	srcIP, srcPort := captureAddrIP(src), captureAddrPort(src)
+	dstIP, dstPort := captureAddrIP(dst), captureAddrPort(dst)
+	if srcIP == nil || dstIP == nil {
+		return nil
+	}
+
+	_, isUDP := local.(*net.UDPAddr)
+
+	for len(p) > 0 {
+		payload := p
+		if !isUDP && len(payload) > maxCapturePayload {
+			payload = p[:maxCapturePayload]
+		}
+		p = p[len(payload):]
+
+		// The transport header, TCP with PSH and ACK, or UDP, without checksum.
+		var transport []byte
+		protocol := byte(17)
+		if isUDP {
+			transport = make([]byte, 8)
+			binary.BigEndian.PutUint16(transport[0:], srcPort)
+			binary.BigEndian.PutUint16(transport[2:], dstPort)
+			binary.BigEndian.PutUint16(transport[4:], uint16(8+len(payload)))
+		} else {
+			direction := 0
+			if !fromClient {
+				direction = 1
+			}
+
+			protocol = 6
+			transport = make([]byte, 20)
+			binary.BigEndian.PutUint16(transport[0:], srcPort)
+			binary.BigEndian.PutUint16(transport[2:], dstPort)
+			binary.BigEndian.PutUint32(transport[4:], v.seqs[direction])
+			binary.BigEndian.PutUint32(transport[8:], v.seqs[1-direction])
+			transport[12], transport[13] = 5<<4, 0x18
+			binary.BigEndian.PutUint16(transport[14:], 65535)
+			v.seqs[direction] += uint32(len(payload))
+		}
+
+		// The IP header, IPv4 if both are IPv4, or IPv6.
+		var ip []byte
+		if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+			ip = make([]byte, 20)
+			ip[0], ip[8], ip[9] = 0x45, 64, protocol
+			binary.BigEndian.PutUint16(ip[2:], uint16(20+len(transport)+len(payload)))
+			copy(ip[12:], src4)
+			copy(ip[16:], dst4)
+
+			var sum uint32
+			for i := 0; i < 20; i += 2 {
+				sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+			}
+			for sum > 0xffff {
+				sum = (sum >> 16) + (sum & 0xffff)
+			}
+			binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+		} else {
+			ip = make([]byte, 40)
+			ip[0], ip[6], ip[7] = 0x60, protocol, 64
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(transport)+len(payload)))
+			copy(ip[8:], srcIP.To16())
+			copy(ip[24:], dstIP.To16())
+		}
+
+		size := len(ip) + len(transport) + len(payload)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(size))
+		binary.LittleEndian.PutUint32(record[12:], uint32(size))
+
+		for _, b := range [][]byte{record, ip, transport, payload} {
+			if _, err := v.writer.Write(b); err != nil {
+				return errors.Wrapf(err, "write %v", v.File)
+			}
+		}
+
+		atomic.AddInt64(&v.Packets, 1)
+		atomic.AddInt64(&v.Bytes, int64(len(payload)))
+	}
+	return nil
+}
+
+// captureAddrIP returns the IP of TCP or UDP address, or nil if unknown.
+func captureAddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// captureAddrPort returns the port of TCP or UDP address.
+func captureAddrPort(addr net.Addr) uint16 {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return uint16(addr.Port)
+	case *net.UDPAddr:
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// captureConn records the bytes read from and written to client, for the session of context. The context is
+// set when created for RTMP, or bound when the session is created for HTTP, see bindCaptureConn.
+type captureConn struct {
+	net.Conn
+	// The context of session, nil if not bound.
+	ctx atomic.Value
+}
+
+// newCaptureConn wraps the client conn of session ctx, or not bound if ctx is nil.
+func newCaptureConn(ctx context.Context, conn net.Conn) *captureConn {
+	v := &captureConn{Conn: conn}
+	if ctx != nil {
+		v.bind(ctx)
+	}
+	return v
+}
+
+// bind the conn to the session of ctx, and attach the capture by IP.
+func (v *captureConn) bind(ctx context.Context) {
+	v.ctx.Store(ctx)
+	srsTrafficCapturer.attach(ctx, v.Conn.RemoteAddr())
+}
+
+func (v *captureConn) Read(p []byte) (int, error) {
+	n, err := v.Conn.Read(p)
+	if ctx, ok := v.ctx.Load().(context.Context); ok && n > 0 {
+		srsTrafficCapturer.record(ctx, v.Conn.LocalAddr(), v.Conn.RemoteAddr(), true, p[:n])
+	}
+	return n, err
+}
+
+func (v *captureConn) Write(p []byte) (int, error) {
+	n, err := v.Conn.Write(p)
+	if ctx, ok := v.ctx.Load().(context.Context); ok && n > 0 {
+		srsTrafficCapturer.record(ctx, v.Conn.LocalAddr(), v.Conn.RemoteAddr(), false, p[:n])
+	}
+	return n, err
+}
+
+// captureListener wraps the accepted conns by captureConn, which are bound to the sessions of HTTP requests.
+type captureListener struct {
+	net.Listener
+}
+
+// newCaptureListener wraps the listener of HTTP server, used with captureConnContext of server.
+func newCaptureListener(listener net.Listener) net.Listener {
+	return &captureListener{Listener: listener}
+}
+
+func (v *captureListener) Accept() (net.Conn, error) {
+	conn, err := v.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newCaptureConn(nil, conn), nil
+}
+
+// The key of captureConn in the context of HTTP request.
+type captureConnKey struct{}
+
+// captureConnContext is the ConnContext of HTTP server, to save the captureConn in the context of requests.
+func captureConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*captureConn); ok {
+		return context.WithValue(ctx, captureConnKey{}, c)
+	}
+	return ctx
+}
+
+// bindCaptureConn binds the conn of HTTP request r to the session of ctx.
+func bindCaptureConn(ctx context.Context, r *http.Request) {
+	if c, ok := r.Context().Value(captureConnKey{}).(*captureConn); ok {
+		c.bind(ctx)
+	}
+}
+
+// ConfigureTrafficCapture configures the captures of sessions, see trafficCapturer.
+func ConfigureTrafficCapture(ctx context.Context, environment env.Environment) error {
+	return srsTrafficCapturer.configure(ctx, environment)
+}
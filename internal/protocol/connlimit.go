@@ -0,0 +1,185 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	stdSync "sync"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// connLimiter limits the concurrent connections of all listeners, of each listener and of each client IP, to
+// reject the excess connections early, before any backend contact, to protect the backends from connection
+// floods. The WebRTC and SRT sessions over UDP count as connections of the webrtc and srt listeners.
+type connLimiter struct {
+	// The max connections of all listeners, 0 for unlimited.
+	maxConns int
+	// The max connections of each listener, key is the name of listener, empty key for all listeners.
+	maxListenerConns map[string]int
+	// The max connections of each client IP, 0 for unlimited.
+	maxIPConns int
+
+	// The lock to protect the counters.
+	lock stdSync.Mutex
+	// The connections of all listeners.
+	conns int
+	// The connections of each listener, key is the name of listener.
+	listeners map[string]int
+	// The connections of each client IP.
+	ips map[string]int
+}
+
+// The limits of concurrent connections, by PROXY_MAX_CONNS, PROXY_MAX_LISTENER_CONNS and PROXY_MAX_IP_CONNS.
+var srsConnLimiter = &connLimiter{}
+
+// configure the limits by environment.
+func (v *connLimiter) configure(ctx context.Context, environment env.Environment) error {
+	maxConns, err := strconv.Atoi(environment.MaxConns())
+	if err != nil {
+		return errors.Wrapf(err, "parse max conns %v", environment.MaxConns())
+	}
+
+	maxIPConns, err := strconv.Atoi(environment.MaxIPConns())
+	if err != nil {
+		return errors.Wrapf(err, "parse max ip conns %v", environment.MaxIPConns())
+	}
+
+	// The limit of each listener, like rtmp=1000,srt=200, or a number for all listeners.
+	maxListenerConns := make(map[string]int)
+	for _, item := range strings.Split(environment.MaxListenerConns(), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		name, value := "", item
+		if index := strings.Index(item, "="); index >= 0 {
+			name, value = strings.TrimSpace(item[:index]), strings.TrimSpace(item[index+1:])
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Wrapf(err, "parse max listener conns %v", item)
+		}
+		maxListenerConns[name] = n
+	}
+
+	v.maxConns, v.maxListenerConns, v.maxIPConns = maxConns, maxListenerConns, maxIPConns
+	v.listeners, v.ips = make(map[string]int), make(map[string]int)
+	if maxConns > 0 || maxIPConns > 0 || len(maxListenerConns) > 0 {
+		logger.Df(ctx, "Connection limits max=%v, listeners=%v, ip=%v",
+			maxConns, environment.MaxListenerConns(), maxIPConns)
+	}
+	return nil
+}
+
+// Acquire a connection of listener name from client remoteAddr, returns the function to release it when the
+// connection is closed, or error if exceeds the limits. The release function is safe to be called more than once.
+func (v *connLimiter) Acquire(name, remoteAddr string) (func(), error) {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Not configured, for example, the connections of old proxy.
+	if v.listeners == nil {
+		return func() {}, nil
+	}
+
+	if v.maxConns > 0 && v.conns >= v.maxConns {
+		return nil, errors.Errorf("exceed max conns %v", v.maxConns)
+	}
+
+	// The limit of listener like rtmp-1, or of its protocol like rtmp, or of all listeners.
+	maxListenerConns, ok := v.maxListenerConns[name]
+	if !ok {
+		if maxListenerConns, ok = v.maxListenerConns[listenerProtocol(name)]; !ok {
+			maxListenerConns = v.maxListenerConns[""]
+		}
+	}
+	if maxListenerConns > 0 && v.listeners[name] >= maxListenerConns {
+		return nil, errors.Errorf("exceed max conns %v of %v", maxListenerConns, name)
+	}
+
+	if v.maxIPConns > 0 && v.ips[ip] >= v.maxIPConns {
+		return nil, errors.Errorf("exceed max conns %v of ip %v", v.maxIPConns, ip)
+	}
+
+	v.conns++
+	v.listeners[name]++
+	v.ips[ip]++
+
+	var once stdSync.Once
+	return func() {
+		once.Do(func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			v.conns--
+			if v.listeners[name]--; v.listeners[name] <= 0 {
+				delete(v.listeners, name)
+			}
+			if v.ips[ip]--; v.ips[ip] <= 0 {
+				delete(v.ips, ip)
+			}
+		})
+	}, nil
+}
+
+// limitListener closes the excess connections of listener right after accepted, by the connection limits.
+type limitListener struct {
+	net.Listener
+	// The name of listener, such as http-stream.
+	name string
+	// The context for logs.
+	ctx context.Context
+}
+
+// newLimitListener wraps the listener name by the connection limits.
+func newLimitListener(ctx context.Context, name string, listener net.Listener) net.Listener {
+	return &limitListener{Listener: listener, name: name, ctx: ctx}
+}
+
+func (v *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := v.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		release, err := srsConnLimiter.Acquire(v.name, conn.RemoteAddr().String())
+		if err != nil {
+			logger.Wf(v.ctx, "Reject %v connection from %v, %v", v.name, conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		return &limitConn{Conn: conn, release: release}, nil
+	}
+}
+
+// limitConn releases the connection limits when closed.
+type limitConn struct {
+	net.Conn
+	// The function to release the connection.
+	release func()
+}
+
+func (v *limitConn) Close() error {
+	v.release()
+	return v.Conn.Close()
+}
+
+// ConfigureConnLimits configures the limits of concurrent connections, see connLimiter.
+func ConfigureConnLimits(ctx context.Context, environment env.Environment) error {
+	return srsConnLimiter.configure(ctx, environment)
+}
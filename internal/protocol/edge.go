@@ -0,0 +1,532 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/alarm"
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/rtmp"
+	"srsx/internal/session"
+	"srsx/internal/utils"
+)
+
+// The max tags queued for an edge viewer, which is closed if slower than the stream.
+const edgeViewerQueueSize = 1024
+
+// The max tags of the GOP cache of edge stream, which fits the queue of viewer. The GOP larger than it is not
+// cached, and the viewer waits for the next keyframe.
+const edgeGOPCacheMaxTags = edgeViewerQueueSize * 3 / 4
+
+// errEdgeViewerSlow is the error when the edge viewer is too slow to consume the stream.
+var errEdgeViewerSlow = errors.New("edge viewer too slow")
+
+// edgeRelay pulls each stream once from the picked backend by HTTP-FLV, and fans out the tags to all local
+// RTMP and HTTP-FLV viewers, instead of a backend connection per viewer, to reduce the egress of backend. The
+// stream is pulled when the first viewer comes, and stopped when the last viewer quits.
+type edgeRelay struct {
+	// Whether cache the latest GOP of streams, for the new viewers to start instantly.
+	gopCache bool
+
+	// The lock to protect the streams.
+	lock stdSync.Mutex
+	// The pulling streams, key is the stream URL.
+	streams map[string]*edgeStream
+}
+
+// The edge relay, shared by RTMP and HTTP-FLV viewers, enabled by PROXY_EDGE_FANOUT.
+var srsEdgeRelay = newEdgeRelay()
+
+// ConfigureEdgeRelay configures the GOP cache of edge streams by PROXY_EDGE_GOP_CACHE.
+func ConfigureEdgeRelay(ctx context.Context, environment env.Environment) error {
+	srsEdgeRelay.gopCache = environment.EdgeGopCache() == "on"
+	if environment.EdgeFanout() == "on" {
+		logger.Df(ctx, "Edge fan-out gop cache=%v", srsEdgeRelay.gopCache)
+	}
+	return nil
+}
+
+func newEdgeRelay() *edgeRelay {
+	return &edgeRelay{streams: make(map[string]*edgeStream)}
+}
+
+// Subscribe the stream for a viewer, and pulls the stream from backend if not pulling. The serverCtx is
+// the context of server to pull the stream, which outlives the viewer, while ctx is the context of viewer
+// to pick the backend, with the selector and affinity of viewer.
+func (v *edgeRelay) Subscribe(serverCtx, ctx context.Context, streamURL string) (*edgeViewer, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	viewer := newEdgeViewer()
+	if stream, ok := v.streams[streamURL]; ok && stream.add(viewer) {
+		logger.Df(ctx, "Edge subscribe %v from %v, viewers=%v", streamURL, stream.backend, stream.viewers())
+		return viewer, nil
+	}
+
+	backend, err := srsStreamSharding.pick(ctx, streamURL, lb.SrsLoadBalancer.PickForPlay)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pick backend for %v", streamURL)
+	}
+	if len(backend.HTTP) == 0 {
+		return nil, errors.Errorf("no http server of %v for %v", backend, streamURL)
+	}
+
+	stream := newEdgeStream(streamURL, backend, v.gopCache)
+	stream.add(viewer)
+	v.streams[streamURL] = stream
+
+	pullCtx, cancel := context.WithCancel(logger.WithContext(serverCtx))
+	stream.cancel = cancel
+
+	go func() {
+		defer cancel()
+
+		err := stream.pull(pullCtx)
+		logger.Df(pullCtx, "Edge stream %v from %v done, %v", streamURL, backend, err)
+
+		v.lock.Lock()
+		if actual, ok := v.streams[streamURL]; ok && actual == stream {
+			delete(v.streams, streamURL)
+		}
+		v.lock.Unlock()
+
+		stream.close(errors.Wrapf(err, "edge stream %v", streamURL))
+	}()
+
+	logger.Df(ctx, "Edge pull %v from %v", streamURL, backend)
+	return viewer, nil
+}
+
+// Unsubscribe the viewer, and stops pulling the stream if no viewers.
+func (v *edgeRelay) Unsubscribe(ctx context.Context, streamURL string, viewer *edgeViewer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	stream, ok := v.streams[streamURL]
+	if !ok || stream.remove(viewer) > 0 {
+		return
+	}
+
+	delete(v.streams, streamURL)
+	stream.close(errors.Errorf("no viewers"))
+	logger.Df(ctx, "Edge stop pulling %v from %v, no viewers", streamURL, stream.backend)
+}
+
+// EdgeStreamStatus is the status of an edge stream.
+type EdgeStreamStatus struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The backend server to pull the stream.
+	Backend string `json:"backend"`
+	// The number of local viewers.
+	Viewers int `json:"viewers"`
+	// The number of tags in the GOP cache.
+	GOPTags int `json:"gop_tags"`
+	// The time the stream pulled.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// List the status of edge streams, sorted by stream URL.
+func (v *edgeRelay) List() []*EdgeStreamStatus {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	streams := []*EdgeStreamStatus{}
+	for streamURL, stream := range v.streams {
+		viewers, gopTags := stream.status()
+		streams = append(streams, &EdgeStreamStatus{
+			StreamURL: streamURL, Backend: stream.backend.ID(), Viewers: viewers, GOPTags: gopTags,
+			CreatedAt: stream.createdAt,
+		})
+	}
+
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StreamURL < streams[j].StreamURL
+	})
+	return streams
+}
+
+// edgeStream is a stream pulled from backend, which caches the metadata and sequence headers for the
+// viewers joining later, and the latest GOP if enabled, to start the viewers instantly from the cached keyframe.
+type edgeStream struct {
+	// The stream URL in vhost/app/stream schema.
+	streamURL string
+	// The backend server to pull the stream.
+	backend *lb.SRSServer
+	// The time the stream pulled.
+	createdAt time.Time
+	// To stop pulling the stream.
+	cancel context.CancelFunc
+
+	// The lock to protect the fields below.
+	lock stdSync.Mutex
+	// The viewers of stream.
+	subscribers map[*edgeViewer]bool
+	// The cached metadata, video and audio sequence headers, nil if not received.
+	metadata, videoHeader, audioHeader *flvTag
+	// Whether cache the latest GOP.
+	gopCache bool
+	// The tags of latest GOP from the keyframe, empty if no keyframe or the GOP is too large.
+	gop []*flvTag
+	// Whether the stream is closed.
+	closed bool
+}
+
+func newEdgeStream(streamURL string, backend *lb.SRSServer, gopCache bool) *edgeStream {
+	return &edgeStream{
+		streamURL: streamURL, backend: backend, createdAt: time.Now(), gopCache: gopCache,
+		subscribers: make(map[*edgeViewer]bool),
+	}
+}
+
+// add the viewer, returns false if the stream is closed. The viewer starts from the GOP cache if any.
+func (v *edgeStream) add(viewer *edgeViewer) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return false
+	}
+	v.subscribers[viewer] = true
+
+	if len(v.gop) > 0 {
+		v.start(viewer, v.gop[0])
+		for _, tag := range v.gop[1:] {
+			viewer.push(tag)
+		}
+	}
+	return true
+}
+
+// start the viewer from the first tag, with the cached headers by the timestamp of first tag, to start the
+// viewer without gap.
+func (v *edgeStream) start(viewer *edgeViewer, tag *flvTag) {
+	viewer.started = true
+	for _, cached := range []*flvTag{v.metadata, v.videoHeader, v.audioHeader} {
+		if cached != nil {
+			viewer.push(&flvTag{MessageType: cached.MessageType, Timestamp: tag.Timestamp, Payload: cached.Payload})
+		}
+	}
+	viewer.push(tag)
+}
+
+// remove the viewer, returns the number of viewers left.
+func (v *edgeStream) remove(viewer *edgeViewer) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.subscribers, viewer)
+	return len(v.subscribers)
+}
+
+func (v *edgeStream) viewers() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.subscribers)
+}
+
+// status returns the number of viewers, and the tags in GOP cache.
+func (v *edgeStream) status() (viewers, gopTags int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.subscribers), len(v.gop)
+}
+
+// close the stream, stops pulling and closes all viewers by err.
+func (v *edgeStream) close(err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return
+	}
+	v.closed = true
+
+	if v.cancel != nil {
+		v.cancel()
+	}
+	for viewer := range v.subscribers {
+		viewer.close(err)
+	}
+}
+
+// pull the stream from backend by HTTP-FLV, and dispatch the tags to viewers, until backend quit or ctx done.
+func (v *edgeStream) pull(ctx context.Context) error {
+	release := lb.SrsServerConnections.Acquire(v.backend)
+	defer release()
+
+	ip, err := lb.SrsServerResolver.Resolve(ctx, v.backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, v.streamURL, v.backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", v.backend)
+	}
+
+	// The stream URL is vhost/app/stream, and the vhost is the host of request.
+	parts := strings.SplitN(v.streamURL, "/", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid stream url %v", v.streamURL)
+	}
+	backendURL := fmt.Sprintf("%v://%v:%v/%v.flv", lb.SrsServerTLS.Scheme(lb.BackendProtocolHTTP), ip, v.backend.HTTP[0], parts[1])
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request to %v", backendURL)
+	}
+	if parts[0] != "__defaultVhost__" {
+		req.Host = parts[0]
+	}
+
+	starttime := time.Now()
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	lb.ReportBackend(ctx, v.streamURL, v.backend, time.Since(starttime), backendError(resp, err))
+	if err != nil {
+		return errors.Wrapf(err, "do request to %v", backendURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("pull stream from %v failed, status=%v", backendURL, resp.Status)
+	}
+
+	if err := readFLVHeader(resp.Body); err != nil {
+		return errors.Wrapf(err, "read header from %v", backendURL)
+	}
+	logger.Df(ctx, "Edge start pulling from %v", backendURL)
+
+	for {
+		tag, err := readFLVTag(resp.Body)
+		if err != nil {
+			return errors.Wrapf(err, "read tag from %v", backendURL)
+		}
+		v.dispatch(tag)
+	}
+}
+
+// dispatch the tag to all viewers, and cache the metadata, sequence headers and the latest GOP.
+func (v *edgeStream) dispatch(tag *flvTag) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	header := true
+	switch {
+	case tag.MessageType == rtmp.MessageTypeAMF0Data || tag.MessageType == rtmp.MessageTypeAMF3Data:
+		v.metadata = tag
+	case isVideoSequenceHeader(tag):
+		v.videoHeader = tag
+	case isAudioSequenceHeader(tag):
+		v.audioHeader = tag
+	default:
+		header = false
+	}
+
+	// Cache the GOP from the keyframe, or drop it if too large, until the next keyframe.
+	if v.gopCache && !header {
+		if isVideoKeyframe(tag) {
+			v.gop = append(v.gop[:0:0], tag)
+		} else if len(v.gop) >= edgeGOPCacheMaxTags {
+			v.gop = nil
+		} else if len(v.gop) > 0 {
+			v.gop = append(v.gop, tag)
+		}
+	}
+
+	for viewer := range v.subscribers {
+		if viewer.started {
+			viewer.push(tag)
+			continue
+		}
+
+		// The cached headers are sent when the viewer starts, so ignore them before started.
+		if header {
+			continue
+		}
+
+		// Start the viewer from a keyframe, or any tag if there is no video.
+		if v.videoHeader != nil && !isVideoKeyframe(tag) {
+			continue
+		}
+
+		v.start(viewer, tag)
+	}
+}
+
+// edgeViewer is a local viewer of edge stream, which consumes the tags in queue.
+type edgeViewer struct {
+	// The tags to send to viewer.
+	tags chan *flvTag
+	// Whether the viewer is started from a keyframe, protected by the lock of stream.
+	started bool
+	// Closed when the viewer is closed, by the stream or slow.
+	done chan struct{}
+	// The error when closed.
+	err error
+	// To close the viewer once.
+	once stdSync.Once
+}
+
+func newEdgeViewer() *edgeViewer {
+	return &edgeViewer{tags: make(chan *flvTag, edgeViewerQueueSize), done: make(chan struct{})}
+}
+
+// push the tag to queue, and close the viewer if queue is full, never block the stream.
+func (v *edgeViewer) push(tag *flvTag) {
+	select {
+	case v.tags <- tag:
+	default:
+		v.close(errEdgeViewerSlow)
+	}
+}
+
+func (v *edgeViewer) close(err error) {
+	v.once.Do(func() {
+		v.err = err
+		close(v.done)
+	})
+}
+
+// Read the next tag, or returns error when closed.
+func (v *edgeViewer) Read(ctx context.Context) (*flvTag, error) {
+	select {
+	case tag := <-v.tags:
+		return tag, nil
+	case <-v.done:
+		return nil, v.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// isVideoSequenceHeader returns whether the video tag is the sequence header of AVC or HEVC, including the
+// enhanced RTMP.
+func isVideoSequenceHeader(tag *flvTag) bool {
+	if tag.MessageType != rtmp.MessageTypeVideo || len(tag.Payload) < 2 {
+		return false
+	}
+
+	// The enhanced RTMP, the packet type 0 is sequence start.
+	if tag.Payload[0]&0x80 != 0 {
+		return tag.Payload[0]&0x0f == 0
+	}
+
+	codec := tag.Payload[0] & 0x0f
+	return (codec == 7 || codec == 12) && tag.Payload[1] == 0
+}
+
+// isVideoKeyframe returns whether the video tag is a keyframe, the frame type 1.
+func isVideoKeyframe(tag *flvTag) bool {
+	if tag.MessageType != rtmp.MessageTypeVideo || len(tag.Payload) < 1 {
+		return false
+	}
+	return (tag.Payload[0]>>4)&0x07 == 1
+}
+
+// isAudioSequenceHeader returns whether the audio tag is the sequence header of AAC.
+func isAudioSequenceHeader(tag *flvTag) bool {
+	if tag.MessageType != rtmp.MessageTypeAudio || len(tag.Payload) < 2 {
+		return false
+	}
+	return tag.Payload[0]>>4 == 10 && tag.Payload[1] == 0
+}
+
+// serveEdgeViewer serves the RTMP viewer by the edge stream, which is shared by all local viewers. The
+// serverCtx is the context to pull the stream, while ctx is cancelled when the client connection is closed.
+func (v *RTMPConnection) serveEdgeViewer(
+	serverCtx, ctx context.Context, cancel context.CancelFunc, client *rtmp.Protocol,
+	clientSession *session.Session, stats *rtmpStats, streamURL string, currentStreamID int,
+) error {
+	viewer, err := srsEdgeRelay.Subscribe(serverCtx, ctx, streamURL)
+	if err != nil {
+		v.rejectStream(ctx, client, RTMPClientTypeViewer, currentStreamID, err)
+		return errors.Wrapf(err, "subscribe edge %v", streamURL)
+	}
+	defer srsEdgeRelay.Unsubscribe(ctx, streamURL, viewer)
+
+	if err := v.startPlay(ctx, client, currentStreamID); err != nil {
+		return errors.Wrapf(err, "start play")
+	}
+	logger.Df(ctx, "RTMP start streaming by edge")
+
+	// Drop the messages from client, such as the acknowledgement, until client quit.
+	var wg stdSync.WaitGroup
+	wg.Add(1)
+	var r1 error
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		for {
+			m, err := client.ReadMessage(ctx)
+			if r1 = err; r1 != nil {
+				clientSession.SetCloseReason(session.CloseReasonOf(r1, session.CloseClientClosed))
+				return
+			}
+			stats.onClientMessage(ctx, m)
+		}
+	}()
+
+	// Send the tags of edge stream to client, until stream or client quit.
+	r0 := func() error {
+		for {
+			tag, err := viewer.Read(ctx)
+			if err != nil {
+				clientSession.SetCloseReason(session.CloseReasonOf(err, session.CloseBackendClosed))
+				return errors.Wrapf(err, "read edge")
+			}
+
+			m := rtmp.NewStreamMessage(currentStreamID)
+			m.MessageType, m.Timestamp, m.Payload = tag.MessageType, uint64(tag.Timestamp), tag.Payload
+			stats.onBackendMessage(ctx, m)
+			if err := client.WriteMessage(ctx, m); err != nil {
+				clientSession.SetCloseReason(session.CloseReasonOf(err, session.CloseClientClosed))
+				return errors.Wrapf(err, "write message")
+			}
+			alarm.SrsUsageMonitor.AddBytes(len(m.Payload))
+		}
+	}()
+	cancel()
+	wg.Wait()
+
+	// The client closed cancels the reading of edge, so check it first.
+	if r1 != nil && (utils.IsClosedNetworkError(r1) || utils.IsPeerClosedError(r1)) {
+		logger.Df(ctx, "RTMP client disconnected")
+		return nil
+	}
+	if utils.IsClosedNetworkError(r0) || utils.IsPeerClosedError(r0) {
+		logger.Df(ctx, "RTMP edge stream done")
+		return nil
+	}
+	return errors.Wrapf(r0, "proxy edge->client")
+}
+
+// serveEdge serves the HTTP-FLV viewer by the edge stream, which is shared by all local viewers.
+func (v *HTTPFlvTsConnection) serveEdge(ctx context.Context, w http.ResponseWriter, streamURL string) error {
+	viewer, err := srsEdgeRelay.Subscribe(v.ctx, ctx, streamURL)
+	if err != nil {
+		return errors.Wrapf(err, "subscribe edge %v", streamURL)
+	}
+	defer srsEdgeRelay.Unsubscribe(ctx, streamURL, viewer)
+	logger.Df(ctx, "HTTP-FLV start streaming by edge")
+
+	splicer := newFLVSplicer(w)
+	for {
+		tag, err := viewer.Read(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "read edge")
+		}
+
+		if err := splicer.Write(tag); err != nil {
+			return errors.Wrapf(err, "write tag to client")
+		}
+		alarm.SrsUsageMonitor.AddBytes(len(tag.Payload))
+	}
+}
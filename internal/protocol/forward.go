@@ -0,0 +1,423 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// The path of forwarded requests in System API of proxy, followed by the kind of session and the original
+// path, like /api/v1/proxy/forward/hls/live/livestream-0.ts?spbhid=xxx.
+const ForwardPath = "/api/v1/proxy/forward/"
+
+// The path to query whether the session is owned by proxy, in System API of proxy.
+const ForwardOwnerPath = "/api/v1/proxy/owners"
+
+// The timeout to query the owner of session from peers.
+const forwardLookupTimeout = 3 * time.Second
+
+// The duration to keep the owner of session, refreshed when used.
+const forwardOwnerTTL = 60 * time.Second
+
+// The duration to keep the session not owned by any peer, to not query the peers for each request of the
+// unknown session, such as the segments of an expired playlist.
+const forwardMissingTTL = 5 * time.Second
+
+// The max queries of owners to peers in a second, the requests are not forwarded if exceeded, to not amplify
+// the requests of unknown sessions to all peers.
+const forwardMaxLookups = 100
+
+// The header of the forwarded request, which is never forwarded again, to avoid loop.
+const forwardedHeader = "X-SRS-Proxy-Forwarded"
+
+// The header of the secret shared by proxies.
+const forwardSecretHeader = "X-SRS-Proxy-Forward-Secret"
+
+// forwardHandler handles the sessions of a kind, such as hls or rtc, on the owner proxy.
+type forwardHandler struct {
+	// Whether the session of id is owned by this proxy.
+	owns func(ctx context.Context, id string) bool
+	// Serve the request forwarded by peer, with the original path.
+	serve func(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+// forwardOwner is the peer proxy which owns a session.
+type forwardOwner struct {
+	// The System API URL of peer.
+	peer string
+	// The time of last use, to expire the owner.
+	usedAt time.Time
+}
+
+// proxyForwarder forwards the request to the peer proxy which owns the session, when multiple proxies are
+// behind a L4 load balancer, and the request lands on a proxy without the session, for example, the HLS
+// segment after the playlist served by another proxy, or the DELETE of WHEP session. The owner is found by
+// querying the peers, and kept for a while. The forwarded request is served by the owner directly, and never
+// forwarded again.
+type proxyForwarder struct {
+	// Whether forward the requests to peers.
+	enabled bool
+	// The System API URLs of peers, empty to use the peers of gossip.
+	peers []string
+	// The secret shared by proxies, empty to not verify.
+	secret string
+
+	// The handlers of sessions, key is the kind.
+	handlers map[string]*forwardHandler
+	// The owners of sessions, key is kind/id.
+	owners map[string]*forwardOwner
+	// The sessions not owned by any peer, key is kind/id, value is the time to expire.
+	missing map[string]time.Time
+	// The number of lookups in the second started at lookupsAt, to rate limit the lookups.
+	lookups   int
+	lookupsAt time.Time
+	// The lock to protect the fields.
+	lock stdSync.Mutex
+}
+
+// The forwarder, to forward the HLS and WebRTC requests between proxies, enabled by PROXY_FORWARD.
+var srsForwarder = newProxyForwarder()
+
+// The client to query and forward to peers, with the timeouts to connect and wait for the response header,
+// but no timeout for the body, which might be a large segment.
+var forwardClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: forwardLookupTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   forwardLookupTimeout,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	},
+}
+
+func newProxyForwarder() *proxyForwarder {
+	return &proxyForwarder{
+		handlers: make(map[string]*forwardHandler), owners: make(map[string]*forwardOwner),
+		missing: make(map[string]time.Time),
+	}
+}
+
+// configure the forwarder by the peers and secret in environment.
+func (v *proxyForwarder) configure(environment env.Environment) error {
+	enabled := environment.Forward() == "on"
+	if !enabled && environment.Forward() != "off" && environment.Forward() != "" {
+		return errors.Errorf("invalid forward %v", environment.Forward())
+	}
+	if enabled && environment.ForwardSecret() == "" {
+		return errors.Errorf("no forward secret, require PROXY_FORWARD_SECRET to forward")
+	}
+
+	var peers []string
+	for _, peer := range strings.Split(environment.ForwardPeers(), ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			if _, err := url.Parse(peer); err != nil {
+				return errors.Wrapf(err, "parse peer %v", peer)
+			}
+			peers = append(peers, peer)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.enabled, v.peers, v.secret = enabled, peers, environment.ForwardSecret()
+	return nil
+}
+
+// handle registers the handler of sessions of kind.
+func (v *proxyForwarder) handle(kind string, handler *forwardHandler) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.handlers[kind] = handler
+}
+
+// Forward the request of session id to the owner proxy, returns false if not forwarded, for example, not
+// enabled, the request is already forwarded, or no peer owns the session.
+func (v *proxyForwarder) Forward(ctx context.Context, w http.ResponseWriter, r *http.Request, kind, id string) bool {
+	v.lock.Lock()
+	enabled, secret := v.enabled, v.secret
+	v.lock.Unlock()
+
+	if !enabled || r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+
+	peer := v.lookup(ctx, kind, id)
+	if peer == "" {
+		return false
+	}
+
+	if err := v.forward(ctx, w, r, peer, kind, secret); err != nil {
+		v.forget(kind, id)
+		logger.Wf(ctx, "Forward %v %v %v to %v failed, %v", kind, id, r.URL.Path, peer, err)
+		http.Error(w, fmt.Sprintf("forward %v %v", kind, id), http.StatusBadGateway)
+	}
+	return true
+}
+
+// forward the request to the peer, and copy the response to w.
+func (v *proxyForwarder) forward(ctx context.Context, w http.ResponseWriter, r *http.Request, peer, kind, secret string) error {
+	forwardURL := fmt.Sprintf("%v%v%v%v", peer, ForwardPath, kind, r.URL.Path)
+	if r.URL.RawQuery != "" {
+		forwardURL += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, forwardURL, r.Body)
+	if err != nil {
+		return errors.Wrapf(err, "create request to %v", forwardURL)
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(forwardedHeader, "true")
+	req.Header.Set(forwardSecretHeader, secret)
+
+	// The X-Forwarded-For from client is not trusted, so the owner only sees the address of client connected to
+	// this proxy.
+	req.Header.Del("X-Forwarded-For")
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "do request to %v", forwardURL)
+	}
+	defer resp.Body.Close()
+
+	for k, vv := range resp.Header {
+		for _, value := range vv {
+			w.Header().Add(k, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Wf(ctx, "Forward copy response from %v failed, %v", forwardURL, err)
+	}
+
+	logger.Df(ctx, "Forward %v %v to %v, status=%v", r.Method, r.URL.Path, peer, resp.StatusCode)
+	return nil
+}
+
+// lookup the owner of session, from the owners kept or by querying the peers, returns empty if not found, or
+// not owned by any peer recently, or too many lookups.
+func (v *proxyForwarder) lookup(ctx context.Context, kind, id string) string {
+	key := fmt.Sprintf("%v/%v", kind, id)
+	now := time.Now()
+
+	v.lock.Lock()
+	for k, owner := range v.owners {
+		if now.Sub(owner.usedAt) > forwardOwnerTTL {
+			delete(v.owners, k)
+		}
+	}
+	for k, expireAt := range v.missing {
+		if now.After(expireAt) {
+			delete(v.missing, k)
+		}
+	}
+	if owner, ok := v.owners[key]; ok {
+		owner.usedAt = now
+		v.lock.Unlock()
+		return owner.peer
+	}
+	if _, ok := v.missing[key]; ok {
+		v.lock.Unlock()
+		return ""
+	}
+	if now.Sub(v.lookupsAt) >= time.Second {
+		v.lookups, v.lookupsAt = 0, now
+	}
+	if v.lookups >= forwardMaxLookups {
+		v.lock.Unlock()
+		logger.Wf(ctx, "Forward ignore %v %v, exceed %v lookups per second", kind, id, forwardMaxLookups)
+		return ""
+	}
+	v.lookups++
+	secret := v.secret
+	v.lock.Unlock()
+
+	peers := v.listPeers()
+	if len(peers) == 0 {
+		return ""
+	}
+
+	// Query all peers concurrently, the first peer which owns the session wins.
+	lookupCtx, cancel := context.WithTimeout(ctx, forwardLookupTimeout)
+	defer cancel()
+
+	found := make(chan string, len(peers))
+	var wg stdSync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if owned, err := queryOwner(lookupCtx, peer, kind, id, secret); err != nil {
+				logger.Wf(ctx, "Forward query %v %v from %v failed, %v", kind, id, peer, err)
+			} else if owned {
+				found <- peer
+			}
+		}(peer)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	peer, ok := <-found
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if !ok {
+		v.missing[key] = time.Now().Add(forwardMissingTTL)
+		return ""
+	}
+	v.owners[key] = &forwardOwner{peer: peer, usedAt: time.Now()}
+	logger.Df(ctx, "Forward %v %v owned by %v", kind, id, peer)
+	return peer
+}
+
+// forget the owner of session, to query again.
+func (v *proxyForwarder) forget(kind, id string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.owners, fmt.Sprintf("%v/%v", kind, id))
+}
+
+// listPeers returns the peers configured, or the peers of gossip.
+func (v *proxyForwarder) listPeers() []string {
+	v.lock.Lock()
+	peers := append([]string(nil), v.peers...)
+	v.lock.Unlock()
+
+	if len(peers) == 0 && lb.SrsGossip != nil {
+		for _, peer := range lb.SrsGossip.Peers() {
+			peers = append(peers, peer.URL)
+		}
+	}
+	return peers
+}
+
+// queryOwner queries whether the peer owns the session.
+func queryOwner(ctx context.Context, peer, kind, id, secret string) (bool, error) {
+	ownerURL := fmt.Sprintf("%v%v?kind=%v&id=%v", peer, ForwardOwnerPath, url.QueryEscape(kind), url.QueryEscape(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ownerURL, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "create request to %v", ownerURL)
+	}
+	req.Header.Set(forwardSecretHeader, secret)
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "do request to %v", ownerURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("status %v", resp.StatusCode)
+	}
+
+	var res struct {
+		Code int `json:"code"`
+		Data struct {
+			Owned bool `json:"owned"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, errors.Wrapf(err, "decode response")
+	}
+	return res.Code == 0 && res.Data.Owned, nil
+}
+
+// authorize verifies the secret of request from peer, which is rejected if forwarding is not enabled.
+func (v *proxyForwarder) authorize(r *http.Request) error {
+	v.lock.Lock()
+	enabled, secret := v.enabled, v.secret
+	v.lock.Unlock()
+
+	if !enabled || secret == "" {
+		return errors.Errorf("forward disabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(forwardSecretHeader)), []byte(secret)) != 1 {
+		return errors.Errorf("invalid forward secret")
+	}
+	return nil
+}
+
+// handler returns the handler of sessions of kind, nil if not found.
+func (v *proxyForwarder) handler(kind string) *forwardHandler {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.handlers[kind]
+}
+
+// ServeOwner responses whether the session of kind and id in query is owned by this proxy.
+func (v *proxyForwarder) ServeOwner(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if err := v.authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	kind, id := r.URL.Query().Get("kind"), r.URL.Query().Get("id")
+	handler := v.handler(kind)
+	if handler == nil || id == "" {
+		http.Error(w, fmt.Sprintf("invalid kind %v id %v", kind, id), http.StatusBadRequest)
+		return
+	}
+
+	type Owner struct {
+		Kind  string `json:"kind"`
+		ID    string `json:"id"`
+		Owned bool   `json:"owned"`
+	}
+	type Response struct {
+		Code int    `json:"code"`
+		PID  string `json:"pid"`
+		Data *Owner `json:"data"`
+	}
+
+	utils.ApiResponse(ctx, w, r, &Response{
+		Code: 0, PID: fmt.Sprintf("%v", os.Getpid()),
+		Data: &Owner{Kind: kind, ID: id, Owned: handler.owns(ctx, id)},
+	})
+}
+
+// ServeForward serves the request forwarded by peer, by the handler of kind in path, with the original path.
+func (v *proxyForwarder) ServeForward(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if err := v.authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, ForwardPath), "/", 2)
+	handler := v.handler(parts[0])
+	if handler == nil || len(parts) != 2 {
+		http.Error(w, fmt.Sprintf("invalid forward %v", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+
+	// Restore the original request, which is never forwarded again by the header.
+	r.URL.Path, r.URL.RawPath = "/"+parts[1], ""
+	r.RequestURI = r.URL.RequestURI()
+	r.Header.Set(forwardedHeader, "true")
+
+	if err := handler.serve(ctx, w, r); err != nil {
+		utils.ApiError(ctx, w, r, err)
+	}
+}
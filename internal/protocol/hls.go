@@ -0,0 +1,146 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The interval to remove the expired files of HLS buffer.
+const hlsBufferCleanupInterval = 10 * time.Second
+
+// hlsBuffer keeps the last window of HLS playlist and segments per stream on local disk, to continue
+// serving the HLS clients in stale-while-revalidate style, during brief origin outages such as restarts.
+// The files are stored in dir/{escaped stream URL}/{file name}, and expired by the modification time.
+type hlsBuffer struct {
+	// The directory to store files.
+	dir string
+	// The window to keep the files.
+	window time.Duration
+}
+
+// The HLS buffer, nil if disabled. It's global because the HLS stream is created by load balancer.
+var srsHLSBuffer *hlsBuffer
+
+func newHLSBuffer(dir string, window time.Duration) *hlsBuffer {
+	return &hlsBuffer{dir: dir, window: window}
+}
+
+// filename returns the file of name, which is the URL path of playlist or segment, for streamURL. The
+// whole URL path is escaped as file name, because the rendition playlists, such as subtitles, may have
+// the same base name as the main playlist.
+func (v *hlsBuffer) filename(streamURL, name string) string {
+	return filepath.Join(v.dir, url.PathEscape(streamURL), url.PathEscape(name))
+}
+
+// Save the content of playlist or segment by name for streamURL.
+func (v *hlsBuffer) Save(streamURL, name string, b []byte) error {
+	filename := v.filename(streamURL, name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return errors.Wrapf(err, "create dir for %v", filename)
+	}
+
+	// Write to a unique temporary file then rename it, so the reader never gets a partial file, and the
+	// concurrent writers of the same file never race on the temporary file.
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return errors.Wrapf(err, "create temp file for %v", filename)
+	}
+	tmpfile := f.Name()
+
+	_, err = f.Write(b)
+	if r0 := f.Close(); err == nil {
+		err = r0
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return errors.Wrapf(err, "write %v", tmpfile)
+	}
+
+	if err := os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		return errors.Wrapf(err, "rename %v to %v", tmpfile, filename)
+	}
+	return nil
+}
+
+// Load the content of playlist or segment by name for streamURL, fails if not found or expired.
+func (v *hlsBuffer) Load(streamURL, name string) ([]byte, error) {
+	filename := v.filename(streamURL, name)
+	if info, err := os.Stat(filename); err != nil {
+		return nil, errors.Wrapf(err, "stat %v", filename)
+	} else if time.Since(info.ModTime()) > v.window {
+		return nil, errors.Errorf("expired %v, modified at %v", filename, info.ModTime())
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", filename)
+	}
+	return b, nil
+}
+
+// Run the cleanup of expired files, until ctx is done.
+func (v *hlsBuffer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hlsBufferCleanupInterval):
+			if err := v.cleanup(); err != nil {
+				logger.Wf(ctx, "HLS buffer cleanup %v failed, err %+v", v.dir, err)
+			}
+		}
+	}
+}
+
+// cleanup removes the expired files, and the stream dirs without files.
+func (v *hlsBuffer) cleanup() error {
+	streams, err := ioutil.ReadDir(v.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read dir %v", v.dir)
+	}
+
+	for _, stream := range streams {
+		if !stream.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(v.dir, stream.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "read dir %v", dir)
+		}
+
+		var kept int
+		for _, file := range files {
+			if time.Since(file.ModTime()) <= v.window {
+				kept++
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove %v", file.Name())
+			}
+		}
+
+		if kept == 0 {
+			os.Remove(dir)
+		}
+	}
+	return nil
+}
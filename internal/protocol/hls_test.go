@@ -0,0 +1,48 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHLSBufferPreservesMetadataAndSubtitles(t *testing.T) {
+	// A TS packet of the ID3 timed metadata PES, whose payload starts with the ID3 header.
+	id3 := append([]byte{0x47, 0x41, 0x02, 0x10, 0x00, 0x00, 0x01, 0xbd}, []byte("ID3\x04\x00\x00\x00\x00\x00\x0fTXXX")...)
+	id3 = append(id3, bytes.Repeat([]byte{0xff}, 188-len(id3))...)
+
+	buffer := newHLSBuffer(t.TempDir(), time.Minute)
+	streamURL := "__defaultVhost__/live/livestream"
+
+	files := []struct {
+		name, file string
+		content    []byte
+	}{
+		{"main playlist", "/live/livestream.m3u8", []byte("#EXTM3U\n#EXTINF:10.000,\nlivestream-1.ts\n")},
+		{"subtitle playlist", "/live/subtitles/livestream.m3u8", []byte("#EXTM3U\n#EXTINF:10.000,\nlivestream-1.vtt\n")},
+		{"id3 segment", "/live/livestream-1.ts", id3},
+		{"webvtt segment", "/live/subtitles/livestream-1.vtt", []byte("WEBVTT\n\n00:00.000 --> 00:01.000\nHello\n")},
+	}
+
+	for _, tc := range files {
+		if err := buffer.Save(streamURL, tc.file, tc.content); err != nil {
+			t.Fatalf("save %v: %+v", tc.file, err)
+		}
+	}
+
+	// Load after all saved, so the files of the same base name never overwrite each other.
+	for _, tc := range files {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := buffer.Load(streamURL, tc.file)
+			if err != nil {
+				t.Fatalf("load %v: %+v", tc.file, err)
+			}
+			if !bytes.Equal(b, tc.content) {
+				t.Errorf("load %v got %q, expect %q", tc.file, b, tc.content)
+			}
+		})
+	}
+}
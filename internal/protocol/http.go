@@ -4,21 +4,35 @@
 package protocol
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	stdSync "sync"
 	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/auth"
+	"srsx/internal/debug"
+	"srsx/internal/dryrun"
 	"srsx/internal/env"
 	"srsx/internal/errors"
+	"srsx/internal/event"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
+	"srsx/internal/ratelimit"
+	"srsx/internal/restream"
+	"srsx/internal/session"
 	"srsx/internal/utils"
 	"srsx/internal/version"
 )
@@ -31,8 +45,14 @@ type srsHTTPStreamServer struct {
 	environment env.Environment
 	// The underlayer HTTP server.
 	server *http.Server
+	// The TCP listeners for HTTP and HTTPS server, closed to stop accepting when quiting.
+	listeners []*net.TCPListener
 	// The gracefully quit timeout, wait server to quit.
 	gracefulQuitTimeout time.Duration
+	// Whether redirect the clients to backend by HTTP 302, instead of proxying.
+	redirect bool
+	// Whether serve the HTTP-FLV viewers by the edge streams, which are pulled once from backend.
+	edge bool
 	// The wait group for all goroutines.
 	wg stdSync.WaitGroup
 }
@@ -45,9 +65,18 @@ func NewSRSHTTPStreamServer(environment env.Environment, gracefulQuitTimeout tim
 	return v
 }
 
-func (v *srsHTTPStreamServer) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), v.gracefulQuitTimeout)
-	defer cancel()
+// StopAccepting closes the listeners to stop accepting new connections, and closes the idle connections, while
+// the active requests are kept until Close.
+func (v *srsHTTPStreamServer) StopAccepting() error {
+	v.server.SetKeepAlivesEnabled(false)
+	for _, listener := range v.listeners {
+		listener.Close()
+	}
+	return nil
+}
+
+// Close shuts down the server, and waits for the active requests until ctx is done.
+func (v *srsHTTPStreamServer) Close(ctx context.Context) error {
 	v.server.Shutdown(ctx)
 
 	v.wg.Wait()
@@ -56,15 +85,52 @@ func (v *srsHTTPStreamServer) Close() error {
 
 func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 	// Parse address to listen.
-	addr := v.environment.HttpServer()
-	if !strings.Contains(addr, ":") {
-		addr = ":" + addr
+	addrs, err := utils.ParseListenAddrs(v.environment.HttpServer(), "tcp")
+	if err != nil {
+		return errors.Wrapf(err, "parse http server %v", v.environment.HttpServer())
+	}
+
+	if mode, err := parseRedirectMode(v.environment.RedirectMode()); err != nil {
+		return errors.Wrapf(err, "parse redirect mode %v", v.environment.RedirectMode())
+	} else {
+		v.redirect = mode.http
 	}
+	v.edge = v.environment.EdgeFanout() == "on"
 
 	// Create server and handler.
 	mux := http.NewServeMux()
-	v.server = &http.Server{Addr: addr, Handler: mux}
-	logger.Df(ctx, "HTTP Stream server listen at %v", addr)
+	v.server = &http.Server{Addr: addrs[0], Handler: mux, ConnContext: captureConnContext}
+
+	// Listen before serving, to fail at startup, and get the actual address if the port is 0.
+	listeners, err := srsUpgrader.listenTCPs(ctx, "http-stream", addrs)
+	if err != nil {
+		return errors.Wrapf(err, "listen http server %v", strings.Join(addrs, ","))
+	}
+	addr := listeners[0].Addr().String()
+	for i, listener := range listeners {
+		logger.Df(ctx, "HTTP Stream server listen at %v", listener.Addr())
+		updateListener(listenerName("http-stream", i), listener.Addr().String(), true, nil)
+	}
+
+	// The HTTPS server terminates TLS, while the backends are connected over plain HTTP or by backend TLS.
+	var tlsListeners []*net.TCPListener
+	var tlsConfig *tls.Config
+	if v.environment.HttpsServer() != "" {
+		tlsAddrs, err := utils.ParseListenAddrs(v.environment.HttpsServer(), "tcp")
+		if err != nil {
+			return errors.Wrapf(err, "parse https server %v", v.environment.HttpsServer())
+		}
+
+		if tlsListeners, tlsConfig, err = listenHTTPS(ctx, v.environment, "https-stream", tlsAddrs); err != nil {
+			return errors.Wrapf(err, "https server")
+		}
+		for i, listener := range tlsListeners {
+			logger.Df(ctx, "HTTPS Stream server listen at %v", listener.Addr())
+			updateListener(listenerName("https-stream", i), listener.Addr().String(), true, nil)
+		}
+	}
+
+	v.listeners = append(append(v.listeners, listeners...), tlsListeners...)
 
 	// Shutdown the server gracefully when quiting.
 	go func() {
@@ -111,9 +177,171 @@ func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 		logger.Df(ctx, "Handle static files at %v", staticFiles)
 	}
 
+	// The HLS buffer on local disk, to continue serving HLS clients during brief origin outages.
+	if dir := v.environment.HlsBufferDir(); dir != "" {
+		window, err := time.ParseDuration(v.environment.HlsBufferWindow())
+		if err != nil {
+			return errors.Wrapf(err, "parse hls buffer window %v", v.environment.HlsBufferWindow())
+		}
+
+		srsHLSBuffer = newHLSBuffer(dir, window)
+		logger.Df(ctx, "HLS buffer at %v, window=%v", dir, window)
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			srsHLSBuffer.Run(ctx)
+		}()
+	}
+
+	// The object storage to offload the HLS segments and playlists, to serve the players by bucket or CDN.
+	if endpoint := v.environment.S3Endpoint(); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return errors.Errorf("invalid s3 endpoint %v", endpoint)
+		}
+		if v.environment.S3Bucket() == "" {
+			return errors.Errorf("empty s3 bucket")
+		}
+		retention, err := time.ParseDuration(v.environment.S3Retention())
+		if err != nil || retention <= 0 {
+			return errors.Errorf("invalid s3 retention %v", v.environment.S3Retention())
+		}
+
+		srsHLSOffloader = newHLSOffloader(ctx, &s3Client{
+			endpoint: u, bucket: v.environment.S3Bucket(), region: v.environment.S3Region(),
+			accessKey: v.environment.S3AccessKey(), secretKey: v.environment.S3SecretKey(),
+		}, v.environment.S3Prefix(), v.environment.S3PublicURL(), retention)
+		logger.Df(ctx, "HLS offload to %v, bucket=%v, public=%v, retention=%v",
+			endpoint, v.environment.S3Bucket(), srsHLSOffloader.publicURL, retention)
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			srsHLSOffloader.Run(ctx)
+		}()
+	}
+
+	// The slate to keep the viewers connected, when the backend of stream dies.
+	if flvFile, tsFile := v.environment.SlateFLV(), v.environment.SlateTS(); flvFile != "" || tsFile != "" {
+		tsDuration, err := time.ParseDuration(v.environment.SlateTSDuration())
+		if err != nil || tsDuration <= 0 {
+			return errors.Errorf("invalid slate ts duration %v", v.environment.SlateTSDuration())
+		}
+		maxDuration, err := time.ParseDuration(v.environment.SlateMaxDuration())
+		if err != nil || maxDuration <= 0 {
+			return errors.Errorf("invalid slate max duration %v", v.environment.SlateMaxDuration())
+		}
+
+		if srsSlate, err = newSlate(flvFile, tsFile, tsDuration, maxDuration); err != nil {
+			return errors.Wrapf(err, "load slate")
+		}
+		logger.Df(ctx, "Slate flv=%v, ts=%v, duration=%v, max=%v", flvFile, tsFile, tsDuration, maxDuration)
+	}
+
+	// The quota of HTTP playback, to reject the clients by 429 or 503 with Retry-After.
+	maxPlayers, err := strconv.Atoi(v.environment.HttpMaxPlayers())
+	if err != nil || maxPlayers < 0 {
+		return errors.Errorf("invalid http max players %v", v.environment.HttpMaxPlayers())
+	}
+	rateLimit, err := strconv.ParseFloat(v.environment.HttpRateLimit(), 64)
+	if err != nil || rateLimit < 0 {
+		return errors.Errorf("invalid http rate limit %v", v.environment.HttpRateLimit())
+	}
+	retryAfter, err := time.ParseDuration(v.environment.HttpRetryAfter())
+	if err != nil || retryAfter <= 0 {
+		return errors.Errorf("invalid http retry after %v", v.environment.HttpRetryAfter())
+	}
+	limitKey := v.environment.HttpRateLimitKey()
+	if limitKey != rateLimitKeyIP && limitKey != rateLimitKeyToken && limitKey != rateLimitKeyStream {
+		return errors.Errorf("invalid http rate limit key %v", limitKey)
+	}
+	var limiter ratelimit.Limiter
+	if rateLimit > 0 {
+		if limiter, err = ratelimit.NewLimiterFromEnvironment(v.environment, "http", rateLimit); err != nil {
+			return errors.Wrapf(err, "create http rate limiter")
+		}
+	}
+	srsHTTPQuota = newHTTPQuota(maxPlayers, limiter, retryAfter)
+	srsHTTPQuota.limitKey, srsHTTPQuota.tokenParam = limitKey, v.environment.RestreamTokenParam()
+	logger.Df(ctx, "HTTP quota max players=%v, rate limit=%v, key=%v, store=%v, retry after=%v",
+		maxPlayers, rateLimit, limitKey, v.environment.RateLimitStore(), retryAfter)
+
+	// The origin shield of CDN, to verify the requests signed by CDN, and collapse the HLS requests.
+	if secret := v.environment.CdnSecret(); secret != "" {
+		header := v.environment.CdnSecretHeader()
+		if header == "" {
+			return errors.Errorf("empty cdn secret header")
+		}
+		cdnRateLimit, err := strconv.ParseFloat(v.environment.CdnRateLimit(), 64)
+		if err != nil || cdnRateLimit < 0 {
+			return errors.Errorf("invalid cdn rate limit %v", v.environment.CdnRateLimit())
+		}
+
+		var cdnLimiter ratelimit.Limiter
+		if cdnRateLimit > 0 {
+			if cdnLimiter, err = ratelimit.NewLimiterFromEnvironment(v.environment, "cdn", cdnRateLimit); err != nil {
+				return errors.Wrapf(err, "create cdn rate limiter")
+			}
+		}
+
+		cdnOnly := v.environment.CdnOnly() == "on"
+		srsOriginShield = newOriginShield(header, secret, cdnOnly, newHTTPQuota(0, cdnLimiter, retryAfter))
+		logger.Df(ctx, "Origin shield of CDN by header %v, cdn only=%v, rate limit=%v", header, cdnOnly, cdnRateLimit)
+	}
+
+	// The HLS segments forwarded by peer proxy, which lands on the peer but the stream is on this proxy.
+	srsForwarder.handle("hls", &forwardHandler{
+		owns: func(ctx context.Context, id string) bool {
+			_, err := lb.SrsLoadBalancer.LoadHLSBySPBHID(ctx, id)
+			return err == nil
+		},
+		serve: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			spbhid := r.URL.Query().Get("spbhid")
+			stream, err := lb.SrsLoadBalancer.LoadHLSBySPBHID(ctx, spbhid)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("load stream by spbhid %v", spbhid), http.StatusNotFound)
+				return nil
+			}
+			stream.Initialize(ctx).(*HLSPlayStream).ServeHTTP(w, r)
+			return nil
+		},
+	})
+
 	// The default handler, for both static web server and streaming server.
 	logger.Df(ctx, "Handle / by %v", addr)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Verify the request signed by CDN, which is limited by the quota of CDN.
+		quota := srsHTTPQuota
+		if srsOriginShield != nil {
+			if fromCDN, err := srsOriginShield.verify(r); err != nil {
+				logger.Wf(ctx, "Reject HTTP request from %v for %v, %v", r.RemoteAddr, r.URL.Path, err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			} else if fromCDN {
+				quota = srsOriginShield.quota
+			}
+		}
+
+		// If SPBHID is specified, it must be a HLS stream client, for the segments, or the variant and
+		// rendition playlists such as WebVTT subtitles, which are routed to the same backend.
+		if srsProxyBackendID := r.URL.Query().Get("spbhid"); srsProxyBackendID != "" {
+			if stream, err := lb.SrsLoadBalancer.LoadHLSBySPBHID(ctx, srsProxyBackendID); err != nil {
+				// Forward to the peer proxy which serves the playlist, if the stream is not on this proxy.
+				if srsForwarder.Forward(ctx, w, r, "hls", srsProxyBackendID) {
+					return
+				}
+				http.Error(w, fmt.Sprintf("load stream by spbhid %v", srsProxyBackendID), http.StatusBadRequest)
+			} else {
+				// Limit the egress of segments, while the playlists are small and not limited.
+				if !strings.HasSuffix(r.URL.Path, ".m3u8") {
+					w = srsEgressThrottler.newStreamResponseWriter(r.Context(), w)
+				}
+				stream.Initialize(ctx).(*HLSPlayStream).ServeHTTP(w, r)
+			}
+			return
+		}
+
 		// For HLS streaming, we will proxy the request to the streaming server.
 		if strings.HasSuffix(r.URL.Path, ".m3u8") {
 			unifiedURL, fullURL := utils.ConvertURLToStreamURL(r)
@@ -123,6 +351,76 @@ func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 				return
 			}
 
+			// Limit the rate of playlists of client, while the segments are not limited.
+			if err := quota.limit(ctx, r, streamURL); err != nil {
+				err.write(ctx, w)
+				return
+			}
+
+			// Reject the client if the token is revoked for restreaming.
+			if err := restream.SrsDetector.Check(ctx, &restream.Client{
+				StreamURL: streamURL, RemoteAddr: r.RemoteAddr, Query: r.URL.Query(), Header: r.Header,
+			}); err != nil {
+				logger.Wf(ctx, "Reject HLS client from %v for %v, %v", r.RemoteAddr, streamURL, err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			// Deny or route the client by policy. Because the HLS stream is shared by clients, the stream
+			// is picked in the routed group here, and the throttle rules of HLS are rejected when loading policy.
+			policyCtx, decision, err := applyPolicy(ctx, "hls", policy.OperationPlay, streamURL, r.RemoteAddr, r.Header)
+			if err != nil {
+				logger.Wf(ctx, "Reject HLS client, %v", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			// Verify the secret of client in the query, like ?secret=xxx.
+			if err := auth.SrsAuthenticator.Authenticate(ctx, &auth.Client{
+				Action: auth.ActionPlay, Protocol: "hls", StreamURL: streamURL, RemoteAddr: r.RemoteAddr,
+				Param: r.URL.RawQuery, Header: r.Header,
+			}); err != nil {
+				logger.Wf(ctx, "Reject HLS client, %v", err)
+				writeAuthError(w, r, http.StatusFound, err)
+				return
+			}
+
+			// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+			policyCtx, selector, err := applySelector(policyCtx, r.URL.RawQuery)
+			if err != nil {
+				logger.Wf(ctx, "Reject HLS client, %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// Redirect the client to the proxy which owns the stream, because the playlist and segments are
+			// served by the same proxy.
+			if owner := srsStreamSharding.Redirect(streamURL, true); owner != nil {
+				redirectStream(ctx, w, r, owner)
+				return
+			}
+
+			// The HLS stream is shared by players, so the first player picks the server in its region.
+			policyCtx = lb.WithClientRegions(policyCtx, r.RemoteAddr, r.Header)
+			if decision.Group() != "" || selector != nil || lb.SrsServerRegions.Enabled() {
+				if _, err := lb.SrsLoadBalancer.PickForPlay(policyCtx, streamURL); err != nil {
+					logger.Wf(ctx, "Pick backend for %v in group %v by selector %v failed, %v", streamURL, decision.Group(), selector, err)
+				}
+			}
+
+			// Redirect the client to the picked backend, which serves the playlist and segments directly.
+			if v.redirect {
+				backend, err := lb.SrsLoadBalancer.PickForPlay(lb.WithClient(policyCtx, r.RemoteAddr), streamURL)
+				if err != nil && isNoServerError(err) {
+					newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+				} else if err != nil {
+					utils.ApiError(ctx, w, r, errors.Wrapf(err, "pick backend for %v", streamURL))
+				} else if err := redirectHTTP(ctx, w, r, backend); err != nil {
+					utils.ApiError(ctx, w, r, errors.Wrapf(err, "redirect %v to %v", streamURL, backend))
+				}
+				return
+			}
+
 			stream, _ := lb.SrsLoadBalancer.LoadOrStoreHLS(ctx, streamURL, NewHLSPlayStream(func(s *HLSPlayStream) {
 				s.SRSProxyBackendHLSID = logger.GenerateContextID()
 				s.StreamURL, s.FullURL = streamURL, fullURL
@@ -135,19 +433,12 @@ func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 		// For HTTP streaming, we will proxy the request to the streaming server.
 		if strings.HasSuffix(r.URL.Path, ".flv") ||
 			strings.HasSuffix(r.URL.Path, ".ts") {
-			// If SPBHID is specified, it must be a HLS stream client.
-			if srsProxyBackendID := r.URL.Query().Get("spbhid"); srsProxyBackendID != "" {
-				if stream, err := lb.SrsLoadBalancer.LoadHLSBySPBHID(ctx, srsProxyBackendID); err != nil {
-					http.Error(w, fmt.Sprintf("load stream by spbhid %v", srsProxyBackendID), http.StatusBadRequest)
-				} else {
-					stream.Initialize(ctx).(*HLSPlayStream).ServeHTTP(w, r)
-				}
-				return
-			}
-
 			// Use HTTP pseudo streaming to proxy the request.
 			NewHTTPFlvTsConnection(func(c *HTTPFlvTsConnection) {
-				c.ctx = ctx
+				c.ctx, c.quota = ctx, quota
+				c.fingerprintHeader = v.environment.FingerprintTLSHeader()
+				c.fingerprintLog = v.environment.FingerprintLog() == "on"
+				c.redirect, c.edge = v.redirect, v.edge
 			}).ServeHTTP(w, r)
 			return
 		}
@@ -161,23 +452,45 @@ func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 		http.NotFound(w, r)
 	})
 
-	// Run HTTP server.
-	v.wg.Add(1)
-	go func() {
-		defer v.wg.Done()
+	// Run HTTP server, for each listener, over TLS if config is not nil.
+	serve := func(name string, listener net.Listener, config *tls.Config) {
+		addr := listener.Addr().String()
 
-		err := v.server.ListenAndServe()
-		if err != nil {
-			if err == http.ErrServerClosed {
-				logger.Df(ctx, "HTTP Stream server done")
-			} else if ctx.Err() != nil {
-				logger.Df(ctx, "HTTP Stream server done with context canceled")
-			} else {
-				// TODO: If HTTP Stream server closed unexpectedly, we should notice the main loop to quit.
-				logger.Wf(ctx, "HTTP Stream accept err %+v", err)
-			}
+		// Limit the connections, while capture the plain bytes after the TLS is decrypted.
+		listener = newLimitListener(ctx, name, listener)
+		if config != nil {
+			listener = tls.NewListener(listener, config)
 		}
-	}()
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			err := v.server.Serve(newCaptureListener(listener))
+			if err != nil {
+				if err == http.ErrServerClosed {
+					logger.Df(ctx, "HTTP Stream server %v done", name)
+					updateListener(name, addr, false, nil)
+				} else if ctx.Err() != nil {
+					logger.Df(ctx, "HTTP Stream server %v done with context canceled", name)
+					updateListener(name, addr, false, nil)
+				} else if utils.IsClosedNetworkError(err) {
+					logger.Df(ctx, "HTTP Stream server %v stop accepting", name)
+					updateListener(name, addr, false, nil)
+				} else {
+					// TODO: If HTTP Stream server closed unexpectedly, we should notice the main loop to quit.
+					logger.Wf(ctx, "HTTP Stream %v accept err %+v", name, err)
+					updateListener(name, addr, false, err)
+				}
+			}
+		}()
+	}
+	for i, listener := range listeners {
+		serve(listenerName("http-stream", i), listener, nil)
+	}
+	for i, listener := range tlsListeners {
+		serve(listenerName("https-stream", i), listener, tlsConfig)
+	}
 
 	return nil
 }
@@ -191,10 +504,20 @@ func (v *srsHTTPStreamServer) Run(ctx context.Context) error {
 type HTTPFlvTsConnection struct {
 	// The context for HTTP streaming.
 	ctx context.Context
+	// The header of TLS fingerprint set by the TLS terminator, empty to ignore.
+	fingerprintHeader string
+	// Whether log the fingerprint of client.
+	fingerprintLog bool
+	// The quota to limit the rate of client, CDN or direct.
+	quota *httpQuota
+	// Whether redirect the client to backend by HTTP 302, instead of proxying.
+	redirect bool
+	// Whether serve the HTTP-FLV viewer by the edge stream, which is pulled once from backend.
+	edge bool
 }
 
 func NewHTTPFlvTsConnection(opts ...func(*HTTPFlvTsConnection)) *HTTPFlvTsConnection {
-	v := &HTTPFlvTsConnection{}
+	v := &HTTPFlvTsConnection{quota: srsHTTPQuota}
 	for _, opt := range opts {
 		opt(v)
 	}
@@ -227,20 +550,165 @@ func (v *HTTPFlvTsConnection) serve(ctx context.Context, w http.ResponseWriter,
 		return errors.Wrapf(err, "build stream url %v", unifiedURL)
 	}
 
+	// Reject the client by 429 or 503 with Retry-After, if exceeds the rate limit or the proxy is full.
+	if err := v.quota.limit(ctx, r, streamURL); err != nil {
+		err.write(ctx, w)
+		return nil
+	}
+	release, quotaErr := srsHTTPQuota.acquire(ctx)
+	if quotaErr != nil {
+		quotaErr.write(ctx, w)
+		return nil
+	}
+	defer release()
+
+	// Deny, throttle or route the client by policy.
+	ctx, decision, err := applyPolicy(ctx, "http", policy.OperationPlay, streamURL, r.RemoteAddr, r.Header)
+	if err != nil {
+		logger.Wf(ctx, "Reject HTTP client, %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	// Verify the secret of client in the query, like ?secret=xxx.
+	authClient := &auth.Client{
+		Action: auth.ActionPlay, Protocol: "http", StreamURL: streamURL, RemoteAddr: r.RemoteAddr,
+		Param: r.URL.RawQuery, Header: r.Header,
+	}
+	if err := auth.SrsAuthenticator.Authenticate(ctx, authClient); err != nil {
+		logger.Wf(ctx, "Reject HTTP client, %v", err)
+		writeAuthError(w, r, http.StatusFound, err)
+		return nil
+	}
+	ctx = logger.WithLabels(ctx, authClient.Labels)
+
+	// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+	if ctx, _, err = applySelector(ctx, r.URL.RawQuery); err != nil {
+		logger.Wf(ctx, "Reject HTTP client, %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	// Register the session, which is closed by cancelling the context when kicked.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Capture the fingerprint of client, to identify the scraping or restreaming bots.
+	fingerprint := session.NewHTTPFingerprint(r, v.fingerprintHeader)
+	if v.fingerprintLog {
+		logger.Df(ctx, "HTTP client fingerprint http=%v, tls=%v, ua=%v, %v",
+			fingerprint.HTTP, fingerprint.TLS, fingerprint.UserAgent, fingerprint.HTTPString)
+	}
+
+	clientSession := session.SrsSessionManager.Add(ctx, "http", streamURL, r.RemoteAddr, cancel,
+		session.WithFingerprint(fingerprint), session.WithAnnotations(authClient.Annotations),
+		session.WithLabels(authClient.Labels))
+	defer session.SrsSessionManager.Remove(clientSession)
+	bindCaptureConn(ctx, r)
+
+	// Reject the client if the token is revoked for restreaming.
+	if err := restream.SrsDetector.Check(ctx, &restream.Client{
+		StreamURL: streamURL, RemoteAddr: r.RemoteAddr, Query: r.URL.Query(), Header: r.Header,
+		Session: clientSession,
+	}); err != nil {
+		logger.Wf(ctx, "Reject HTTP client from %v for %v, %v", r.RemoteAddr, streamURL, err)
+		clientSession.SetCloseReason(session.CloseAuthFailed)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	// Limit the egress of client, and the bitrate of client by policy.
+	w = srsEgressThrottler.newStreamResponseWriter(r.Context(), w)
+	if kbps := decision.Throttle(); kbps > 0 && dryrun.SrsDryRun.Enforce(ctx, dryrun.KindPolicy,
+		"throttle http client from %v for %v to %vkbps, %v", r.RemoteAddr, streamURL, kbps, decision) {
+		w = srsEgressThrottler.newResponseWriter(ctx, w, kbps)
+	}
+
+	// Keep the picked server by the affinity of players, which might be sticky by client.
+	ctx = lb.WithClient(ctx, r.RemoteAddr)
+	// Prefer the servers in the region of client, by the header or geolocation of client.
+	ctx = lb.WithClientRegions(ctx, r.RemoteAddr, r.Header)
+
+	// Redirect the client to the proxy which owns the stream, by the hash of stream URL.
+	if owner := srsStreamSharding.Redirect(streamURL, false); owner != nil {
+		redirectStream(ctx, w, r, owner)
+		clientSession.SetCloseReason(session.CloseRedirected)
+		return nil
+	}
+
+	// Serve the HTTP-FLV viewer by the edge stream, which is pulled once from backend for all local viewers.
+	if v.edge && !v.redirect && strings.HasSuffix(r.URL.Path, ".flv") {
+		err := v.serveEdge(ctx, w, streamURL)
+		if r.Context().Err() != nil {
+			clientSession.SetCloseReason(session.CloseClientClosed)
+		} else {
+			clientSession.SetCloseReason(session.CloseReasonOf(err, session.CloseBackendClosed))
+		}
+		if err != nil && r.Context().Err() == nil && !utils.IsPeerClosedError(err) {
+			return errors.Wrapf(err, "serve %v by edge", fullURL)
+		}
+		return nil
+	}
+
+	// Keep the HTTP-FLV client connected by slate, when the backend dies.
+	if srsSlate != nil && srsSlate.flv != nil && !v.redirect && strings.HasSuffix(r.URL.Path, ".flv") {
+		err := v.serveWithSlate(ctx, w, r, streamURL)
+		clientSession.SetCloseReason(session.CloseReasonOf(err, session.CloseClientClosed))
+		return err
+	}
+
 	// Pick a backend SRS server to proxy the RTMP stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	backend, err := srsStreamSharding.pick(ctx, streamURL, lb.SrsLoadBalancer.PickForPlay)
 	if err != nil {
+		if isNoServerError(err) {
+			newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+			return nil
+		}
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
 
-	if err = v.serveByBackend(ctx, w, r, backend); err != nil {
+	// Advise the client to switch protocol, if HTTP server is not enabled on the backend.
+	if len(backend.HTTP) == 0 {
+		protocol := "http-ts"
+		if strings.HasSuffix(r.URL.Path, ".flv") {
+			protocol = "http-flv"
+		}
+		alternatives := protocolAlternatives(r, backend, streamURL, protocol, session.RoleViewer)
+		writeProtocolUnavailable(ctx, w, protocol, fmt.Sprintf("no http server of %v", backend), alternatives)
+		return nil
+	}
+
+	// Redirect the client to the picked backend, so the proxy is not in the data path.
+	if v.redirect {
+		if err := redirectHTTP(ctx, w, r, backend); err != nil {
+			return errors.Wrapf(err, "redirect %v to %v", fullURL, backend)
+		}
+		clientSession.SetCloseReason(session.CloseRedirected)
+		return nil
+	}
+
+	// The client closed cancels the request, and the stream might end as backend closed, so check it first.
+	debug.DoWithProfileLabels(ctx, "http", streamURL, func(ctx context.Context) {
+		err = v.serveByBackend(ctx, w, r, streamURL, backend)
+	})
+	if r.Context().Err() != nil {
+		clientSession.SetCloseReason(session.CloseClientClosed)
+	} else if err == nil {
+		clientSession.SetCloseReason(session.CloseBackendClosed)
+	} else {
+		clientSession.SetCloseReason(session.CloseReasonOf(err, session.CloseClientClosed))
+	}
+	if err != nil {
 		return errors.Wrapf(err, "serve %v with %v by backend %+v", fullURL, streamURL, backend)
 	}
 
 	return nil
 }
 
-func (v *HTTPFlvTsConnection) serveByBackend(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *lb.SRSServer) error {
+func (v *HTTPFlvTsConnection) serveByBackend(ctx context.Context, w http.ResponseWriter, r *http.Request, streamURL string, backend *lb.SRSServer) error {
+	release := lb.SrsServerConnections.Acquire(backend)
+	defer release()
+
 	// Parse HTTP port from backend.
 	if len(backend.HTTP) == 0 {
 		return errors.Errorf("no http stream server")
@@ -253,14 +721,21 @@ func (v *HTTPFlvTsConnection) serveByBackend(ctx context.Context, w http.Respons
 		httpPort = int(iv)
 	}
 
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, streamURL, backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
 	// Connect to backend SRS server via HTTP client.
-	backendURL := fmt.Sprintf("http://%v:%v%s", backend.IP, httpPort, r.URL.Path)
+	backendURL := fmt.Sprintf("%v://%v:%v%s", lb.SrsServerTLS.Scheme(lb.BackendProtocolHTTP), ip, httpPort, r.URL.Path)
 	req, err := http.NewRequestWithContext(ctx, r.Method, backendURL, nil)
 	if err != nil {
 		return errors.Wrapf(err, "create request to %v", backendURL)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	starttime := time.Now()
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	lb.ReportBackend(ctx, streamURL, backend, time.Since(starttime), backendError(resp, err))
 	if err != nil {
 		return errors.Wrapf(err, "do request to %v", backendURL)
 	}
@@ -280,14 +755,43 @@ func (v *HTTPFlvTsConnection) serveByBackend(ctx context.Context, w http.Respons
 
 	logger.Df(ctx, "HTTP start streaming")
 
-	// Proxy the stream from backend to client.
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	// Proxy the stream from backend to client, and detect SCTE-35 markers of HTTP-TS if enabled.
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(r.URL.Path, ".ts") && event.SrsEventNotifier.Enabled() {
+		body = io.TeeReader(resp.Body, srsSCTE35.NewScanner(ctx, streamURL, "http-ts"))
+	}
+
+	n, err := io.Copy(w, body)
+	alarm.SrsUsageMonitor.AddBytes(int(n))
+	if err != nil {
 		return errors.Wrapf(err, "copy stream to client, backend=%v", backendURL)
 	}
 
 	return nil
 }
 
+// backendError returns the failure of backend in the response, for circuit breaker, which is the error of
+// request, or the server error. The client error such as 404 is not a failure of backend.
+func backendError(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("status %v", resp.Status)
+	}
+	return nil
+}
+
+// writeAuthError rejects the HTTP client by the error of authenticator with 403, or redirects the client by
+// the status, if redirected by the external authorization service.
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if redirect, ok := auth.IsRedirect(err); ok {
+		http.Redirect(w, r, redirect.Location, status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
 // HLSPlayStream is an HLS stream proxy, which represents the stream level object. This means multiple HLS
 // clients will share this object, and they do not use the same ctx among proxy servers.
 //
@@ -305,6 +809,13 @@ type HLSPlayStream struct {
 	StreamURL string `json:"stream_url"`
 	// The full request URL for HLS streaming
 	FullURL string `json:"full_url"`
+
+	// The lock for the state of slate.
+	lock stdSync.Mutex
+	// Whether the stream was live, served by backend, the slate is only for the live stream.
+	live bool
+	// The time to start serving slate, zero if not serving slate.
+	slateAt time.Time
 }
 
 func NewHLSPlayStream(opts ...func(*HLSPlayStream)) *HLSPlayStream {
@@ -315,6 +826,14 @@ func NewHLSPlayStream(opts ...func(*HLSPlayStream)) *HLSPlayStream {
 	return v
 }
 
+// NewHLSPlayStreamFromDTO creates the HLS streaming from the data persisted by load balancer.
+func NewHLSPlayStreamFromDTO(dto *lb.HLSPlayStreamDTO) lb.HLSPlayStream {
+	return NewHLSPlayStream(func(s *HLSPlayStream) {
+		s.SRSProxyBackendHLSID = dto.SPBHID
+		s.StreamURL, s.FullURL = dto.StreamURL, dto.FullURL
+	})
+}
+
 func (v *HLSPlayStream) Initialize(ctx context.Context) lb.HLSPlayStream {
 	if v.ctx == nil {
 		v.ctx = logger.WithContext(ctx)
@@ -345,19 +864,115 @@ func (v *HLSPlayStream) serve(ctx context.Context, w http.ResponseWriter, r *htt
 		return nil
 	}
 
+	// The slate segments are served by proxy, not the backend.
+	if srsSlate != nil && srsSlate.ts != nil && isSlateSegment(r.URL.Path) {
+		return srsSlate.ServeHLS(ctx, w, r, v.SRSProxyBackendHLSID)
+	}
+
 	// Pick a backend SRS server to proxy the RTMP stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	backend, err := lb.SrsLoadBalancer.PickForPlay(ctx, streamURL)
 	if err != nil {
+		if v.serveFallback(ctx, w, r, err) {
+			return nil
+		}
+		if isNoServerError(err) {
+			newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+			return nil
+		}
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
 
-	if err = v.serveByBackend(ctx, w, r, backend); err != nil {
+	// Advise the client to switch protocol, if HTTP server is not enabled on the backend.
+	if len(backend.HTTP) == 0 {
+		alternatives := protocolAlternatives(r, backend, streamURL, "hls", session.RoleViewer)
+		writeProtocolUnavailable(ctx, w, "hls", fmt.Sprintf("no http server of %v", backend), alternatives)
+		return nil
+	}
+
+	debug.DoWithProfileLabels(ctx, "hls", streamURL, func(ctx context.Context) {
+		err = v.serveByBackend(ctx, w, r, backend)
+	})
+	if err != nil {
 		return errors.Wrapf(err, "serve %v with %v by backend %+v", fullURL, streamURL, backend)
 	}
 
 	return nil
 }
 
+// serveFallback serves the stale file from HLS buffer, or the slate, when failed to serve by backend for
+// err. Returns false if nothing served.
+func (v *HLSPlayStream) serveFallback(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) bool {
+	if v.serveStale(ctx, w, r, err) {
+		return true
+	}
+
+	if srsSlate == nil || srsSlate.ts == nil {
+		return false
+	}
+	if !strings.HasSuffix(r.URL.Path, ".m3u8") && !strings.HasSuffix(r.URL.Path, ".ts") {
+		return false
+	}
+	if !v.startSlate() {
+		return false
+	}
+
+	logger.Wf(ctx, "HLS serve slate %v of %v, err %+v", r.URL.Path, v.StreamURL, err)
+	if err := srsSlate.ServeHLS(ctx, w, r, v.SRSProxyBackendHLSID); err != nil {
+		logger.Wf(ctx, "HLS serve slate %v failed, err %+v", r.URL.Path, err)
+	}
+	return true
+}
+
+// serveStale serves the buffered file from HLS buffer, when failed to serve by backend for err. Returns
+// false if buffer is disabled or the file is not buffered, or expired.
+func (v *HLSPlayStream) serveStale(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) bool {
+	if srsHLSBuffer == nil {
+		return false
+	}
+
+	b, r0 := srsHLSBuffer.Load(v.StreamURL, r.URL.Path)
+	if r0 != nil {
+		return false
+	}
+
+	// The playlist is buffered as backend, so rewrite it by the spbhid of this session.
+	if strings.HasSuffix(r.URL.Path, ".m3u8") {
+		b = []byte(v.rewritePlaylist(string(b)))
+	}
+
+	w.Header().Set("Content-Type", hlsContentType(r.URL.Path))
+	w.Header().Set("X-SRS-Proxy-Stale", "true")
+
+	if _, r0 := w.Write(b); r0 != nil {
+		logger.Wf(ctx, "HLS serve stale %v failed, err %+v", r.URL.Path, r0)
+	}
+	logger.Wf(ctx, "HLS serve stale %v of %v, %vB, err %+v", r.URL.Path, v.StreamURL, len(b), err)
+	return true
+}
+
+// startSlate returns whether to serve the slate, only if the stream was live, and not serving slate for longer
+// than the max duration.
+func (v *HLSPlayStream) startSlate() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.live {
+		return false
+	}
+	if v.slateAt.IsZero() {
+		v.slateAt = time.Now()
+	}
+	return time.Since(v.slateAt) <= srsSlate.maxDuration
+}
+
+// setLive marks the stream live, served by backend, and stops the slate.
+func (v *HLSPlayStream) setLive() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.live, v.slateAt = true, time.Time{}
+}
+
 func (v *HLSPlayStream) serveByBackend(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *lb.SRSServer) error {
 	// Parse HTTP port from backend.
 	if len(backend.HTTP) == 0 {
@@ -371,8 +986,13 @@ func (v *HLSPlayStream) serveByBackend(ctx context.Context, w http.ResponseWrite
 		httpPort = int(iv)
 	}
 
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, v.StreamURL, backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
 	// Connect to backend SRS server via HTTP client.
-	backendURL := fmt.Sprintf("http://%v:%v%s", backend.IP, httpPort, r.URL.Path)
+	backendURL := fmt.Sprintf("%v://%v:%v%s", lb.SrsServerTLS.Scheme(lb.BackendProtocolHTTP), ip, httpPort, r.URL.Path)
 	if r.URL.RawQuery != "" {
 		backendURL += "?" + r.URL.RawQuery
 	}
@@ -382,30 +1002,73 @@ func (v *HLSPlayStream) serveByBackend(ctx context.Context, w http.ResponseWrite
 		return errors.Wrapf(err, "create request to %v", backendURL)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	// Collapse the concurrent requests of CDN edges to one backend request, for origin shield.
+	var resp *http.Response
+	starttime := time.Now()
+	if srsOriginShield != nil && r.Method == http.MethodGet {
+		resp, err = srsOriginShield.Do(ctx, req)
+	} else {
+		resp, err = lb.SrsServerTLS.HTTPClient().Do(req)
+	}
+	lb.ReportBackend(ctx, v.StreamURL, backend, time.Since(starttime), backendError(resp, err))
 	if err != nil {
+		if v.serveFallback(ctx, w, r, err) {
+			return nil
+		}
 		return errors.Errorf("do request to %v EOF", backendURL)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("proxy stream to %v failed, status=%v", backendURL, resp.Status)
+		err := errors.Errorf("proxy stream to %v failed, status=%v", backendURL, resp.Status)
+		if resp.StatusCode >= http.StatusInternalServerError && v.serveFallback(ctx, w, r, err) {
+			return nil
+		}
+		return err
 	}
+	v.setLive()
 
-	// Copy all headers from backend to client.
-	w.WriteHeader(resp.StatusCode)
+	// Copy all headers from backend to client, such as the content type of WebVTT subtitles, except the
+	// content length of playlist, which is changed by rewriting.
+	isPlaylist := strings.HasSuffix(r.URL.Path, ".m3u8")
 	for k, v := range resp.Header {
+		if isPlaylist && k == "Content-Length" {
+			continue
+		}
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
+	w.WriteHeader(resp.StatusCode)
 
-	// For TS file, directly copy it.
-	if !strings.HasSuffix(r.URL.Path, ".m3u8") {
-		if _, err := io.Copy(w, resp.Body); err != nil {
+	// For segments, such as TS and WebVTT, directly copy it, which preserves the ID3 timed metadata in TS,
+	// save to HLS buffer and detect SCTE-35 markers in TS if enabled.
+	if !isPlaylist {
+		var writers []io.Writer
+		var segment bytes.Buffer
+		if srsHLSBuffer != nil {
+			writers = append(writers, &segment)
+		}
+		if event.SrsEventNotifier.Enabled() && strings.HasSuffix(r.URL.Path, ".ts") {
+			writers = append(writers, srsSCTE35.NewScanner(ctx, v.StreamURL, "hls"))
+		}
+
+		var body io.Reader = resp.Body
+		if len(writers) > 0 {
+			body = io.TeeReader(resp.Body, io.MultiWriter(writers...))
+		}
+
+		n, err := io.Copy(w, body)
+		alarm.SrsUsageMonitor.AddBytes(int(n))
+		if err != nil {
 			return errors.Wrapf(err, "copy stream to client, backend=%v", backendURL)
 		}
 
+		if srsHLSBuffer != nil {
+			if err := srsHLSBuffer.Save(v.StreamURL, r.URL.Path, segment.Bytes()); err != nil {
+				logger.Wf(ctx, "HLS buffer save %v failed, err %+v", r.URL.Path, err)
+			}
+		}
 		return nil
 	}
 
@@ -416,16 +1079,85 @@ func (v *HLSPlayStream) serveByBackend(ctx context.Context, w http.ResponseWrite
 		return errors.Wrapf(err, "read stream from %v", backendURL)
 	}
 
-	m3u8 := string(b)
-	if strings.Contains(m3u8, ".ts?") {
-		m3u8 = strings.ReplaceAll(m3u8, ".ts?", fmt.Sprintf(".ts?spbhid=%v&&", v.SRSProxyBackendHLSID))
-	} else {
-		m3u8 = strings.ReplaceAll(m3u8, ".ts", fmt.Sprintf(".ts?spbhid=%v", v.SRSProxyBackendHLSID))
+	if event.SrsEventNotifier.Enabled() {
+		srsSCTE35.ScanPlaylist(ctx, v.StreamURL, string(b))
 	}
 
+	// Offload the segments to object storage, then the segments are served by bucket or CDN.
+	playlist := string(b)
+	if srsHLSOffloader != nil {
+		playlist = srsHLSOffloader.Offload(ctx, v.StreamURL, backendURL, playlist)
+	}
+
+	// Buffer the playlist of backend, which is shared by sessions, and rewritten for each session when serving.
+	if srsHLSBuffer != nil {
+		if err := srsHLSBuffer.Save(v.StreamURL, r.URL.Path, []byte(playlist)); err != nil {
+			logger.Wf(ctx, "HLS buffer save %v failed, err %+v", r.URL.Path, err)
+		}
+	}
+
+	m3u8 := v.rewritePlaylist(playlist)
+
+	alarm.SrsUsageMonitor.AddBytes(len(m3u8))
 	if _, err := io.Copy(w, strings.NewReader(m3u8)); err != nil {
 		return errors.Wrapf(err, "proxy m3u8 client to %v", backendURL)
 	}
 
 	return nil
 }
+
+// rewritePlaylist appends the spbhid to the URIs in playlist, to identify the stream to specified backend
+// server. The URIs are the segments, the variant playlists, and the rendition playlists such as WebVTT
+// subtitles in EXT-X-MEDIA. The other tags, such as SCTE-35 markers, are preserved as is.
+func (v *HLSPlayStream) rewritePlaylist(m3u8 string) string {
+	lines := strings.Split(m3u8, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			lines[i] = v.rewriteURI(line)
+			continue
+		}
+
+		// The URI attribute of tags, for example, EXT-X-MEDIA:TYPE=SUBTITLES,URI="subtitles.m3u8".
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:") || strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:") ||
+			strings.HasPrefix(line, "#EXT-X-MAP:") {
+			if start := strings.Index(line, `URI="`); start >= 0 {
+				start += len(`URI="`)
+				if end := strings.Index(line[start:], `"`); end >= 0 {
+					lines[i] = line[:start] + v.rewriteURI(line[start:start+end]) + line[start+end:]
+				}
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rewriteURI appends the spbhid to the relative URI, while the absolute URI is not served by proxy.
+func (v *HLSPlayStream) rewriteURI(uri string) string {
+	if strings.Contains(uri, "://") {
+		return uri
+	}
+
+	if i := strings.Index(uri, "?"); i >= 0 {
+		return fmt.Sprintf("%v?spbhid=%v&%v", uri[:i], v.SRSProxyBackendHLSID, uri[i+1:])
+	}
+	return fmt.Sprintf("%v?spbhid=%v", uri, v.SRSProxyBackendHLSID)
+}
+
+// hlsContentType returns the content type of HLS file by the extension of URL path.
+func hlsContentType(urlPath string) string {
+	switch path.Ext(urlPath) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".vtt", ".webvtt":
+		return "text/vtt"
+	case ".aac":
+		return "audio/aac"
+	case ".mp4", ".m4s":
+		return "video/mp4"
+	}
+	return "video/mp2t"
+}
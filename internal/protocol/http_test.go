@@ -0,0 +1,106 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"testing"
+)
+
+func TestHLSPlayStreamRewriteURI(t *testing.T) {
+	stream := NewHLSPlayStream(func(v *HLSPlayStream) {
+		v.SRSProxyBackendHLSID = "abc"
+	})
+
+	for _, tc := range []struct {
+		name, uri, expect string
+	}{
+		{"segment", "livestream-1.ts", "livestream-1.ts?spbhid=abc"},
+		{"segment with query", "livestream-1.ts?hls_ctx=xyz", "livestream-1.ts?spbhid=abc&hls_ctx=xyz"},
+		{"webvtt segment", "subtitles/livestream-1.vtt", "subtitles/livestream-1.vtt?spbhid=abc"},
+		{"webvtt playlist", "subtitles/livestream.m3u8", "subtitles/livestream.m3u8?spbhid=abc"},
+		{"absolute", "https://cdn.example.com/livestream-1.ts", "https://cdn.example.com/livestream-1.ts"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := stream.rewriteURI(tc.uri); got != tc.expect {
+				t.Errorf("rewriteURI(%q) = %q, expect %q", tc.uri, got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestHLSPlayStreamRewritePlaylist(t *testing.T) {
+	stream := NewHLSPlayStream(func(v *HLSPlayStream) {
+		v.SRSProxyBackendHLSID = "abc"
+	})
+
+	for _, tc := range []struct {
+		name, m3u8, expect string
+	}{
+		{
+			name: "master with webvtt subtitles",
+			m3u8: "#EXTM3U\n" +
+				`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subtitles/livestream.m3u8"` + "\n" +
+				`#EXT-X-STREAM-INF:BANDWIDTH=2000000,SUBTITLES="subs"` + "\n" +
+				"livestream.m3u8\n",
+			expect: "#EXTM3U\n" +
+				`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subtitles/livestream.m3u8?spbhid=abc"` + "\n" +
+				`#EXT-X-STREAM-INF:BANDWIDTH=2000000,SUBTITLES="subs"` + "\n" +
+				"livestream.m3u8?spbhid=abc\n",
+		},
+		{
+			name: "webvtt media playlist",
+			m3u8: "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXTINF:10.000,\nlivestream-1.vtt\n#EXTINF:10.000,\nlivestream-2.vtt\n",
+			expect: "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXTINF:10.000,\nlivestream-1.vtt?spbhid=abc\n#EXTINF:10.000,\nlivestream-2.vtt?spbhid=abc\n",
+		},
+		{
+			name: "id3 timed metadata tags",
+			m3u8: "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+				`#EXT-X-DATERANGE:ID="ad1",START-DATE="2025-01-01T00:00:00Z",X-COM-EXAMPLE-ID3="AQID"` + "\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2025-01-01T00:00:00.000Z\n" +
+				"#EXTINF:10.000,\nlivestream-1.ts\n",
+			expect: "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+				`#EXT-X-DATERANGE:ID="ad1",START-DATE="2025-01-01T00:00:00Z",X-COM-EXAMPLE-ID3="AQID"` + "\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2025-01-01T00:00:00.000Z\n" +
+				"#EXTINF:10.000,\nlivestream-1.ts?spbhid=abc\n",
+		},
+		{
+			name: "fmp4 init segment",
+			m3u8: "#EXTM3U\n" + `#EXT-X-MAP:URI="init.mp4"` + "\n#EXTINF:4.000,\nlivestream-1.m4s\n",
+			expect: "#EXTM3U\n" + `#EXT-X-MAP:URI="init.mp4?spbhid=abc"` + "\n" +
+				"#EXTINF:4.000,\nlivestream-1.m4s?spbhid=abc\n",
+		},
+		{
+			name:   "absolute segments",
+			m3u8:   "#EXTM3U\n#EXTINF:10.000,\nhttps://cdn.example.com/livestream-1.ts\n",
+			expect: "#EXTM3U\n#EXTINF:10.000,\nhttps://cdn.example.com/livestream-1.ts\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := stream.rewritePlaylist(tc.m3u8); got != tc.expect {
+				t.Errorf("rewritePlaylist got\n%v\nexpect\n%v", got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestHLSContentType(t *testing.T) {
+	for _, tc := range []struct {
+		path, expect string
+	}{
+		{"/live/livestream.m3u8", "application/vnd.apple.mpegurl"},
+		{"/live/subtitles/livestream-1.vtt", "text/vtt"},
+		{"/live/subtitles/livestream-1.webvtt", "text/vtt"},
+		{"/live/livestream-1.aac", "audio/aac"},
+		{"/live/livestream-1.m4s", "video/mp4"},
+		{"/live/livestream-1.ts", "video/mp2t"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := hlsContentType(tc.path); got != tc.expect {
+				t.Errorf("hlsContentType(%q) = %q, expect %q", tc.path, got, tc.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// idleConn closes the connection which is neither read nor written in the timeout, or whose write stalls in the
+// timeout, by the deadlines, so the half-dead peers don't pin the goroutines and sockets forever.
+type idleConn struct {
+	net.Conn
+	// The idle timeout.
+	timeout time.Duration
+}
+
+// newIdleConn wraps the conn by the idle timeout, or returns the conn if timeout is 0.
+func newIdleConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, timeout: timeout}
+}
+
+func (v *idleConn) Read(b []byte) (int, error) {
+	if err := v.Conn.SetReadDeadline(time.Now().Add(v.timeout)); err != nil {
+		return 0, err
+	}
+	return v.Conn.Read(b)
+}
+
+func (v *idleConn) Write(b []byte) (int, error) {
+	if err := v.Conn.SetWriteDeadline(time.Now().Add(v.timeout)); err != nil {
+		return 0, err
+	}
+
+	// The connection is not idle if written, for example, the viewer which only reads, so extend the read.
+	n, err := v.Conn.Write(b)
+	if err == nil {
+		v.Conn.SetReadDeadline(time.Now().Add(v.timeout))
+	}
+	return n, err
+}
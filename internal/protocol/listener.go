@@ -0,0 +1,86 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"srsx/internal/sync"
+)
+
+// ListenerStatus is the status of a protocol listener, such as the RTMP server.
+type ListenerStatus struct {
+	// The name of listener, such as rtmp, rtmps, webrtc, srt, http-stream, http-api or system-api.
+	Name string `json:"name"`
+	// The address to listen.
+	Addr string `json:"addr"`
+	// Whether the listener is listening.
+	Listening bool `json:"listening"`
+	// The error if listener quit unexpectedly.
+	Error string `json:"error,omitempty"`
+	// The time status updated.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// listenerName returns the name of the index-th listener of a protocol, which is name for the first one, and
+// name-index for others, like rtmp and rtmp-1, because the names must be unique for status and hot restart.
+func listenerName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	return fmt.Sprintf("%v-%v", name, index)
+}
+
+// listenerProtocol returns the name of protocol of listener, such as rtmp for rtmp-1.
+func listenerProtocol(name string) string {
+	if index := strings.LastIndex(name, "-"); index > 0 {
+		if _, err := strconv.Atoi(name[index+1:]); err == nil {
+			return name[:index]
+		}
+	}
+	return name
+}
+
+// The status of all listeners, key is the name of listener.
+var srsListeners sync.Map[string, *ListenerStatus]
+
+// updateListener updates the status of listener name, the err is the reason if it quit unexpectedly.
+func updateListener(name, addr string, listening bool, err error) {
+	status := &ListenerStatus{Name: name, Addr: addr, Listening: listening, UpdatedAt: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	srsListeners.Store(name, status)
+}
+
+// isTLSListening returns whether any listener terminates TLS, such as RTMPS or HTTPS.
+func isTLSListening() bool {
+	var listening bool
+	srsListeners.Range(func(name string, status *ListenerStatus) bool {
+		switch listenerProtocol(name) {
+		case "rtmps", "https-stream", "https-api", "https-system-api":
+			listening = listening || status.Listening
+		}
+		return !listening
+	})
+	return listening
+}
+
+// listListeners returns the status of all listeners, sorted by name.
+func listListeners() []*ListenerStatus {
+	listeners := []*ListenerStatus{}
+	srsListeners.Range(func(name string, status *ListenerStatus) bool {
+		listeners = append(listeners, status)
+		return true
+	})
+
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].Name < listeners[j].Name
+	})
+	return listeners
+}
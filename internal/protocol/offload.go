@@ -0,0 +1,383 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+)
+
+// The timeout of each request to object storage, or to pull a segment from origin.
+const s3RequestTimeout = 10 * time.Second
+
+// The client of object storage, with the timeouts of each request, besides the timeout of context, so a stuck
+// bucket never blocks the uploads.
+var s3HTTPClient = &http.Client{
+	Timeout: s3RequestTimeout,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 3 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ResponseHeaderTimeout: s3RequestTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   32,
+	},
+}
+
+// s3Client is a minimal client of S3-compatible object storage, such as AWS S3 and MinIO, which puts and
+// deletes objects by the path-style URL, signed by AWS Signature Version 4.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+type s3Client struct {
+	// The endpoint, like https://s3.us-east-1.amazonaws.com or http://127.0.0.1:9000
+	endpoint *url.URL
+	// The bucket name.
+	bucket string
+	// The region, like us-east-1.
+	region string
+	// The access key and secret key.
+	accessKey, secretKey string
+}
+
+// Put the object by key, with the content type and cache control.
+func (v *s3Client) Put(ctx context.Context, key string, body []byte, contentType, cacheControl string) error {
+	req, err := v.newRequest(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return errors.Wrapf(err, "create request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Cache-Control", cacheControl)
+
+	return v.do(req)
+}
+
+// Delete the object by key.
+func (v *s3Client) Delete(ctx context.Context, key string) error {
+	req, err := v.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request")
+	}
+
+	return v.do(req)
+}
+
+func (v *s3Client) newRequest(ctx context.Context, method, key string, body []byte) (*http.Request, error) {
+	u := *v.endpoint
+	u.Path = fmt.Sprintf("%v/%v/%v", strings.TrimSuffix(u.Path, "/"), v.bucket, key)
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v", u.String())
+	}
+
+	payloadHash := sha256.Sum256(body)
+	v.sign(req, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+	return req, nil
+}
+
+// sign the request by AWS Signature Version 4, the signed headers are host, x-amz-content-sha256 and
+// x-amz-date.
+func (v *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		fmt.Sprintf("host:%v\nx-amz-content-sha256:%v\nx-amz-date:%v\n", req.URL.Host, payloadHash, amzDate),
+		signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, v.region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + v.secretKey)
+	for _, data := range []string{date, v.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, data)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		v.accessKey, scope, signedHeaders, signature))
+}
+
+func (v *s3Client) do(req *http.Request) error {
+	resp, err := s3HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%v %v", req.Method, req.URL.String())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%v %v failed, status=%v, body=%v", req.Method, req.URL.String(), resp.Status, string(b))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes the path by the URI encoding of S3, which keeps the unreserved characters and
+// the slash only.
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+	for _, c := range []byte(p) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+// The max number of segments uploading concurrently, the others are served by proxy, and uploaded when the
+// playlist is pulled again.
+const maxHLSOffloadUploads = 32
+
+// hlsOffloader uploads the HLS segments and playlists pulled from origins to object storage, and rewrites
+// the segment URLs in playlist to the bucket or CDN, so the proxy is a live-to-CDN packager front. The
+// objects are stored in {prefix}/{vhost}/{URL path}, and deleted after the retention.
+type hlsOffloader struct {
+	// The context of uploads, which are in background, not canceled by the requests of players.
+	ctx context.Context
+	// The client of object storage.
+	client *s3Client
+	// The prefix of object keys, empty for the root of bucket.
+	prefix string
+	// The base URL of objects for players, such as a CDN in front of the bucket.
+	publicURL string
+	// The duration to keep the objects since last uploaded.
+	retention time.Duration
+
+	// The time of last upload of objects, key is the object key, zero if uploading.
+	objects map[string]time.Time
+	// The number of segments uploading.
+	uploading int
+	// The lock to protect objects and uploading.
+	lock stdSync.Mutex
+}
+
+// The HLS offloader, nil if disabled.
+var srsHLSOffloader *hlsOffloader
+
+func newHLSOffloader(
+	ctx context.Context, client *s3Client, prefix, publicURL string, retention time.Duration,
+) *hlsOffloader {
+	if publicURL == "" {
+		publicURL = fmt.Sprintf("%v/%v", strings.TrimSuffix(client.endpoint.String(), "/"), client.bucket)
+	}
+	return &hlsOffloader{
+		ctx: ctx, client: client, prefix: strings.Trim(prefix, "/"), publicURL: strings.TrimSuffix(publicURL, "/"),
+		retention: retention, objects: make(map[string]time.Time),
+	}
+}
+
+// key returns the object key of URL path for streamURL, in {prefix}/{vhost}/{URL path}.
+func (v *hlsOffloader) key(streamURL, urlPath string) string {
+	vhost := streamURL
+	if index := strings.Index(streamURL, "/"); index >= 0 {
+		vhost = streamURL[:index]
+	}
+
+	key := path.Join(vhost, path.Clean("/"+urlPath))
+	if v.prefix != "" {
+		key = path.Join(v.prefix, key)
+	}
+	return key
+}
+
+// Offload the segments of playlist pulled from backendURL, returns the playlist with the URLs of the
+// segments uploaded, without waiting for any upload. The new segments are uploaded in background, and kept
+// to be served by proxy until the objects exist, as well as the segments failed to upload. The playlist is
+// also uploaded in background, if all segments are uploaded.
+func (v *hlsOffloader) Offload(ctx context.Context, streamURL, backendURL, m3u8 string) string {
+	base, err := url.Parse(backendURL)
+	if err != nil {
+		logger.Wf(ctx, "HLS offload parse %v failed, err %+v", backendURL, err)
+		return m3u8
+	}
+
+	lines := strings.Split(m3u8, "\n")
+	var segments, uploaded int
+	for i, line := range lines {
+		// Ignore the tags, and the variant playlists, which are served by proxy.
+		uri := strings.TrimSpace(line)
+		if uri == "" || strings.HasPrefix(uri, "#") || strings.Contains(uri, "://") {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil || strings.HasSuffix(u.Path, ".m3u8") {
+			continue
+		}
+		segment := base.ResolveReference(u)
+		segments++
+
+		key := v.key(streamURL, segment.Path)
+		if v.uploaded(ctx, streamURL, key, segment.String()) {
+			lines[i] = fmt.Sprintf("%v/%v", v.publicURL, key)
+			uploaded++
+		}
+	}
+
+	playlist := strings.Join(lines, "\n")
+	if segments > 0 && uploaded == segments {
+		key := v.key(streamURL, base.Path)
+		go func() {
+			if err := v.put(v.ctx, key, []byte(playlist), "no-cache"); err != nil {
+				logger.Wf(ctx, "HLS offload %v of %v failed, err %+v", base.Path, streamURL, err)
+			}
+		}()
+	}
+	return playlist
+}
+
+// uploaded returns whether the segment is uploaded by key, otherwise starts to upload the segment pulled from
+// segmentURL in background, if not uploading and the uploads are not full.
+func (v *hlsOffloader) uploaded(ctx context.Context, streamURL, key, segmentURL string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if uploadedAt, ok := v.objects[key]; ok {
+		return !uploadedAt.IsZero()
+	}
+	if v.uploading >= maxHLSOffloadUploads {
+		return false
+	}
+
+	v.objects[key] = time.Time{}
+	v.uploading++
+	go func() {
+		err := v.upload(v.ctx, key, segmentURL)
+		if err != nil {
+			logger.Wf(ctx, "HLS offload %v of %v failed, err %+v", key, streamURL, err)
+		}
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.uploading--
+		if err != nil {
+			delete(v.objects, key)
+		} else {
+			v.objects[key] = time.Now()
+		}
+	}()
+	return false
+}
+
+// upload the segment pulled from segmentURL by key.
+func (v *hlsOffloader) upload(ctx context.Context, key, segmentURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, segmentURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", segmentURL)
+	}
+
+	// Pull from origin by the client of backend servers, which supports the HTTPS of backend.
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "pull %v", segmentURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("pull %v failed, status=%v", segmentURL, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", segmentURL)
+	}
+
+	return v.put(ctx, key, b, "max-age=3600")
+}
+
+// put the content to object storage by key.
+func (v *hlsOffloader) put(ctx context.Context, key string, b []byte, cacheControl string) error {
+	ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+	defer cancel()
+
+	if err := v.client.Put(ctx, key, b, hlsContentType(key), cacheControl); err != nil {
+		return errors.Wrapf(err, "put %v", key)
+	}
+
+	// Update the time of playlist, which is uploaded each time.
+	if strings.HasSuffix(key, ".m3u8") {
+		v.lock.Lock()
+		v.objects[key] = time.Now()
+		v.lock.Unlock()
+	}
+	return nil
+}
+
+// Run the lifecycle cleanup, which deletes the objects not uploaded for retention.
+func (v *hlsOffloader) Run(ctx context.Context) {
+	interval := v.retention / 2
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		var expired []string
+		v.lock.Lock()
+		for key, uploadedAt := range v.objects {
+			if !uploadedAt.IsZero() && time.Since(uploadedAt) > v.retention {
+				expired = append(expired, key)
+			}
+		}
+		v.lock.Unlock()
+
+		for _, key := range expired {
+			if err := func() error {
+				ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+				defer cancel()
+				return v.client.Delete(ctx, key)
+			}(); err != nil {
+				logger.Wf(ctx, "HLS offload delete %v failed, err %+v", key, err)
+				continue
+			}
+
+			v.lock.Lock()
+			delete(v.objects, key)
+			v.lock.Unlock()
+		}
+
+		if len(expired) > 0 {
+			logger.Df(ctx, "HLS offload delete %v expired objects, retention=%v", len(expired), v.retention)
+		}
+	}
+}
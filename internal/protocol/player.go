@@ -0,0 +1,27 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+
+	"srsx/internal/version"
+)
+
+// The built-in test player, to play any stream through proxy by HTTP-FLV, HLS or WHEP, with the sessions of
+// stream in proxy side alongside, so no external player directory is required to verify a deployment.
+//
+//go:embed player.html
+var playerPage []byte
+
+// servePlayer serves the built-in test player page, the stream and protocol are set by query string, like
+// /players/?stream=live/livestream&protocol=flv&autostart=true
+func servePlayer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", fmt.Sprintf("%v/%v", version.Signature(), version.Version()))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(playerPage)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"srsx/internal/dryrun"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/policy"
+)
+
+// applyPolicy evaluates the policy of client to publish or play by operation, returns error if denied. The
+// returned context selects the backend servers in group for new stream, if the client is routed to a group.
+func applyPolicy(ctx context.Context, protocol, operation, streamURL, remoteAddr string, header http.Header) (context.Context, *policy.Decision, error) {
+	decision := policy.SrsPolicyEngine.Evaluate(ctx, &policy.Request{
+		Protocol: protocol, Operation: operation, StreamURL: streamURL, RemoteAddr: remoteAddr, Header: header,
+	})
+	if decision.Rule != nil {
+		logger.Df(ctx, "Policy %v %v client from %v for %v, %v", protocol, operation, remoteAddr, streamURL, decision)
+	}
+
+	if decision.Denied() && dryrun.SrsDryRun.Enforce(ctx, dryrun.KindPolicy, "deny %v %v client from %v for %v, %v",
+		protocol, operation, remoteAddr, streamURL, decision) {
+		return ctx, decision, errors.Errorf("denied %v %v client from %v for %v, %v",
+			protocol, operation, remoteAddr, streamURL, decision)
+	}
+	if group := decision.Group(); group != "" && dryrun.SrsDryRun.Enforce(ctx, dryrun.KindPolicy,
+		"route %v client from %v for %v to group %v, %v", protocol, remoteAddr, streamURL, group, decision) {
+		ctx = lb.WithServerGroup(ctx, group)
+	}
+	return ctx, decision, nil
+}
+
+// applySelector selects the backend servers by the label selector of client, in the query like
+// ?selector=region%3Dus-east, returns the context to select the servers for new stream. The selector is
+// nil if not specified.
+func applySelector(ctx context.Context, param string) (context.Context, *lb.LabelSelector, error) {
+	// Ignore the malformed query, which is not for proxy.
+	query, _ := url.ParseQuery(strings.TrimPrefix(param, "?"))
+	selector, err := lb.ParseLabelSelector(query.Get("selector"))
+	if err != nil {
+		return ctx, nil, errors.Wrapf(err, "parse selector %v", query.Get("selector"))
+	}
+	if selector != nil {
+		ctx = lb.WithServerSelector(ctx, selector)
+	}
+	return ctx, selector, nil
+}
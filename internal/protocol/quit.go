@@ -0,0 +1,91 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/logger"
+	"srsx/internal/session"
+)
+
+// ProxyDrainState is the draining state of proxy.
+type ProxyDrainState struct {
+	// Whether the proxy is draining.
+	Draining bool `json:"draining"`
+	// The reason to drain, such as api, signal or quit.
+	Reason string `json:"reason,omitempty"`
+	// The time started to drain.
+	Since *time.Time `json:"since,omitempty"`
+	// The number of client sessions to drain.
+	Sessions int `json:"sessions"`
+}
+
+// ProxyDrainer puts the proxy itself in draining state, by System API or SIGUSR2, for example, to replace the
+// proxy without dropping the live sessions. The proxy stops accepting new connections on all listeners, keeps
+// serving the existing sessions, and quits after the sessions drained or the grace timeout expires, which is
+// the same as the graceful quit.
+type ProxyDrainer interface {
+	// Drain starts draining the proxy for reason, it's safe to be called more than once, and only the first
+	// reason is kept.
+	Drain(ctx context.Context, reason string)
+	// Draining returns whether the proxy is draining, to reject the new connections.
+	Draining() bool
+	// State returns the draining state of proxy.
+	State() *ProxyDrainState
+}
+
+type proxyDrainerImpl struct {
+	// The function to quit the proxy gracefully.
+	quit func()
+	// The reason to drain, empty if not draining.
+	reason string
+	// The time started to drain.
+	since time.Time
+	// The lock to protect the fields.
+	lock stdSync.Mutex
+}
+
+// NewProxyDrainer creates the drainer, which quits the proxy gracefully by quit, nil to only mark draining.
+func NewProxyDrainer(quit func()) ProxyDrainer {
+	return &proxyDrainerImpl{quit: quit}
+}
+
+func (v *proxyDrainerImpl) Drain(ctx context.Context, reason string) {
+	v.lock.Lock()
+	if v.reason != "" {
+		v.lock.Unlock()
+		return
+	}
+	v.reason, v.since = reason, time.Now()
+	v.lock.Unlock()
+
+	logger.Df(ctx, "Drain proxy by %v, sessions=%v", reason, len(session.SrsSessionManager.List("")))
+	if v.quit != nil {
+		v.quit()
+	}
+}
+
+func (v *proxyDrainerImpl) Draining() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.reason != ""
+}
+
+func (v *proxyDrainerImpl) State() *ProxyDrainState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	state := &ProxyDrainState{Draining: v.reason != "", Reason: v.reason}
+	if state.Draining {
+		since := v.since
+		state.Since, state.Sessions = &since, len(session.SrsSessionManager.List(""))
+	}
+	return state
+}
+
+// SrsProxyDrainer is the global drainer of proxy, which is set by bootstrap to quit the proxy.
+var SrsProxyDrainer = NewProxyDrainer(nil)
@@ -0,0 +1,204 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"srsx/internal/dryrun"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/ratelimit"
+	"srsx/internal/tarpit"
+	"srsx/internal/version"
+)
+
+// The reasons of quota errors, in the JSON body for the players and CDNs.
+const (
+	// The client exceeds the rate limit of requests.
+	quotaReasonRateLimited = "rate-limited"
+	// The proxy is full of players.
+	quotaReasonCapacity = "capacity"
+	// No backend server is available for the stream.
+	quotaReasonNoServer = "no-server"
+	// All backend servers reach their max streams.
+	quotaReasonClusterFull = "cluster-full"
+)
+
+// quotaError is an error to reject the HTTP playback, with the status 429 or 503 and the duration to
+// retry after, so the compliant players and CDNs back off correctly.
+type quotaError struct {
+	// The HTTP status, 429 or 503.
+	status int
+	// The reason of rejection.
+	reason string
+	// The duration to retry after.
+	retryAfter time.Duration
+	// The detail message.
+	message string
+}
+
+func (v *quotaError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", v.message, v.retryAfter)
+}
+
+// write the error to response, with the Retry-After header in seconds, and a JSON body.
+func (v *quotaError) write(ctx context.Context, w http.ResponseWriter) {
+	seconds := int(math.Ceil(v.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	type Response struct {
+		Code int    `json:"code"`
+		PID  string `json:"pid"`
+		Data struct {
+			Reason     string `json:"reason"`
+			Message    string `json:"message"`
+			RetryAfter int    `json:"retry_after"`
+		} `json:"data"`
+	}
+
+	res := Response{Code: v.status, PID: fmt.Sprintf("%v", os.Getpid())}
+	res.Data.Reason, res.Data.Message, res.Data.RetryAfter = v.reason, v.message, seconds
+	b, _ := json.Marshal(&res)
+
+	w.Header().Set("Server", fmt.Sprintf("%v/%v", version.Signature(), version.Version()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprintf("%v", seconds))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(v.status)
+	w.Write(b)
+
+	logger.Wf(ctx, "Reject HTTP playback with %v, %v", v.status, v.Error())
+}
+
+// isNoServerError returns whether err is caused by no backend server available, or all servers full.
+func isNoServerError(err error) bool {
+	cause := errors.Cause(err)
+	return cause == lb.ErrNoServerAvailable || cause == lb.ErrClusterFull
+}
+
+// newNoServerError creates the error when no backend server is available for the stream.
+func newNoServerError(retryAfter time.Duration, err error) *quotaError {
+	reason := quotaReasonNoServer
+	if errors.Cause(err) == lb.ErrClusterFull {
+		reason = quotaReasonClusterFull
+	}
+
+	return &quotaError{
+		status: http.StatusServiceUnavailable, reason: reason, retryAfter: retryAfter,
+		message: err.Error(),
+	}
+}
+
+// The keys of HTTP rate limit.
+const (
+	// Limit the rate of each client IP.
+	rateLimitKeyIP = "ip"
+	// Limit the rate of each token in query, or client IP if no token.
+	rateLimitKeyToken = "token"
+	// Limit the rate of each stream URL.
+	rateLimitKeyStream = "stream"
+)
+
+// httpQuota limits the HTTP playback, the number of concurrent HTTP-FLV/TS players on this proxy, and
+// the rate of new playback requests of each client IP, token or stream.
+type httpQuota struct {
+	// The max number of concurrent HTTP-FLV/TS players, zero for unlimited.
+	maxPlayers int64
+	// The rate limiter of new playback requests, nil for unlimited.
+	limiter ratelimit.Limiter
+	// The key of rate limit, ip, token or stream.
+	limitKey string
+	// The name of token param in query, for the token key.
+	tokenParam string
+	// The duration to retry after, when the proxy is full or no backend server.
+	retryAfter time.Duration
+
+	// The number of concurrent players.
+	players int64
+}
+
+func newHTTPQuota(maxPlayers int, limiter ratelimit.Limiter, retryAfter time.Duration) *httpQuota {
+	return &httpQuota{
+		maxPlayers: int64(maxPlayers), limiter: limiter, limitKey: rateLimitKeyIP, retryAfter: retryAfter,
+	}
+}
+
+// key returns the key of rate limit of request for stream, by the limit key.
+func (v *httpQuota) key(r *http.Request, streamURL string) string {
+	switch v.limitKey {
+	case rateLimitKeyStream:
+		return fmt.Sprintf("stream:%v", streamURL)
+	case rateLimitKeyToken:
+		if token := r.URL.Query().Get(v.tokenParam); token != "" {
+			return fmt.Sprintf("token:%v", token)
+		}
+	}
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	return fmt.Sprintf("ip:%v", ip)
+}
+
+// limit the rate of new playback requests of client for stream, returns error if exceeded. The request is
+// allowed if the limiter fails, such as Redis is down, to not reject all players.
+func (v *httpQuota) limit(ctx context.Context, r *http.Request, streamURL string) *quotaError {
+	if v.limiter == nil {
+		return nil
+	}
+
+	key := v.key(r, streamURL)
+	retryAfter, err := v.limiter.Take(ctx, key)
+	if err != nil {
+		logger.Wf(ctx, "Ignore rate limit of %v, %v", key, err)
+		return nil
+	}
+	if retryAfter <= 0 {
+		return nil
+	}
+	if !dryrun.SrsDryRun.Enforce(ctx, dryrun.KindQuota, "reject %v for %v with %v, exceed %v requests per second",
+		key, streamURL, http.StatusTooManyRequests, v.limiter.Rate()) {
+		return nil
+	}
+	tarpit.SrsTarpit.Reject(ctx, r.RemoteAddr, tarpit.ReasonRateLimited)
+
+	return &quotaError{
+		status: http.StatusTooManyRequests, reason: quotaReasonRateLimited, retryAfter: retryAfter,
+		message: fmt.Sprintf("exceed %v requests per second of %v", v.limiter.Rate(), key),
+	}
+}
+
+// acquire a player, returns the function to release it, or error if the proxy is full.
+func (v *httpQuota) acquire(ctx context.Context) (func(), *quotaError) {
+	players := atomic.AddInt64(&v.players, 1)
+	release := func() {
+		atomic.AddInt64(&v.players, -1)
+	}
+
+	if v.maxPlayers > 0 && players > v.maxPlayers && dryrun.SrsDryRun.Enforce(ctx, dryrun.KindQuota,
+		"reject player with %v, exceed %v players", http.StatusServiceUnavailable, v.maxPlayers) {
+		release()
+		return nil, &quotaError{
+			status: http.StatusServiceUnavailable, reason: quotaReasonCapacity, retryAfter: v.retryAfter,
+			message: fmt.Sprintf("exceed %v players", v.maxPlayers),
+		}
+	}
+	return release, nil
+}
+
+// srsHTTPQuota is the quota of HTTP playback, which is unlimited by default.
+var srsHTTPQuota = newHTTPQuota(0, nil, 10*time.Second)
@@ -0,0 +1,46 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"os"
+	"sort"
+
+	"srsx/internal/env"
+	"srsx/internal/version"
+)
+
+// ReadyStatus is the status when all servers started, for the orchestration scripts to detect the readiness,
+// and discover the actual addresses when the ports are auto-assigned.
+type ReadyStatus struct {
+	// The version of proxy.
+	Version string `json:"version"`
+	// The process id.
+	PID int `json:"pid"`
+	// The actual address of listeners, key is the name of listener, such as rtmp.
+	Listeners map[string]string `json:"listeners"`
+	// The enabled features, sorted by name.
+	Features []string `json:"features"`
+}
+
+// NewReadyStatus returns the status of the listening servers and enabled features.
+func NewReadyStatus(environment env.Environment) *ReadyStatus {
+	v := &ReadyStatus{
+		Version: version.Version(), PID: os.Getpid(), Listeners: make(map[string]string), Features: []string{},
+	}
+
+	for _, listener := range listListeners() {
+		if listener.Listening {
+			v.Listeners[listener.Name] = listener.Addr
+		}
+	}
+
+	for name, enabled := range features(environment) {
+		if enabled {
+			v.Features = append(v.Features, name)
+		}
+	}
+	sort.Strings(v.Features)
+	return v
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/rtmp"
+	"srsx/internal/utils"
+)
+
+// redirectMode is the protocols to redirect the clients to the picked backend, instead of proxying the media,
+// so the proxy is removed from the data path, for the bandwidth-constrained deployments. The backends must be
+// reachable by clients, by the IP or hostname registered.
+type redirectMode struct {
+	// Whether redirect the RTMP clients by RTMP 302.
+	rtmp bool
+	// Whether redirect the HTTP-FLV, HTTP-TS and HLS clients by HTTP 302.
+	http bool
+}
+
+// parseRedirectMode parses the mode in protocols separated by comma, like rtmp,http, or off to disable.
+func parseRedirectMode(s string) (*redirectMode, error) {
+	v := &redirectMode{}
+	if s == "" || s == "off" {
+		return v, nil
+	}
+
+	for _, protocol := range strings.Split(s, ",") {
+		switch strings.TrimSpace(protocol) {
+		case "rtmp":
+			v.rtmp = true
+		case "http":
+			v.http = true
+		default:
+			return nil, errors.Errorf("invalid protocol %v", protocol)
+		}
+	}
+	return v, nil
+}
+
+// redirectRTMP responses the client by RTMP 302, the NetConnection.Connect.Rejected with the redirect URL of
+// backend in ex, like SRS, so the client connects to the backend directly.
+func redirectRTMP(
+	ctx context.Context, client *rtmp.Protocol, backend *lb.SRSServer, tcUrl, streamName string, currentStreamID int,
+) error {
+	redirectURL, err := backendRTMPURL(backend, tcUrl, streamName)
+	if err != nil {
+		return errors.Wrapf(err, "build redirect url")
+	}
+
+	ex := rtmp.NewAmf0Object()
+	ex.Set("code", rtmp.NewAmf0Number(302))
+	ex.Set("redirect", rtmp.NewAmf0String(redirectURL))
+	ex.Set("redirect2", rtmp.NewAmf0String(redirectURL))
+
+	data := rtmp.NewAmf0Object()
+	data.Set("level", rtmp.NewAmf0String("error"))
+	data.Set("code", rtmp.NewAmf0String("NetConnection.Connect.Rejected"))
+	data.Set("description", rtmp.NewAmf0String("RTMP 302 Redirect"))
+	data.Set("ex", ex)
+
+	res := rtmp.NewCallPacket()
+	res.CommandName = "onStatus"
+	res.CommandObject = rtmp.NewAmf0Null()
+	res.Args = data
+
+	if err := client.WritePacket(ctx, res, currentStreamID); err != nil {
+		return errors.Wrapf(err, "write redirect")
+	}
+	logger.Df(ctx, "RTMP redirect to %v", redirectURL)
+	return nil
+}
+
+// backendRTMPURL returns the RTMP URL of stream on backend, by replacing the host of tcUrl with the backend,
+// and keeping the vhost in query if not the default vhost.
+func backendRTMPURL(backend *lb.SRSServer, tcUrl, streamName string) (string, error) {
+	if len(backend.RTMP) == 0 {
+		return "", errors.Errorf("no rtmp server of %v", backend)
+	}
+
+	u, err := url.Parse(tcUrl)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse tcUrl %v", tcUrl)
+	}
+
+	// The vhost is the hostname of tcUrl, which is lost by the backend host, so keep it in query.
+	q := u.Query()
+	if streamURL, err := utils.BuildStreamURL(tcUrl); err == nil && q.Get("vhost") == "" {
+		if vhost := strings.SplitN(streamURL, "/", 2)[0]; vhost != "__defaultVhost__" {
+			q.Set("vhost", vhost)
+		}
+	}
+
+	scheme := "rtmp"
+	if lb.SrsServerTLS.Enabled(lb.BackendProtocolRTMP) {
+		scheme = "rtmps"
+	}
+
+	u.Scheme, u.Host, u.RawQuery = scheme, net.JoinHostPort(backend.IP, backend.RTMP[0]), q.Encode()
+	return fmt.Sprintf("%v/%v", u.String(), streamName), nil
+}
+
+// redirectHTTP responses the client by HTTP 302, to the same path and query of request on backend.
+func redirectHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *lb.SRSServer) error {
+	if len(backend.HTTP) == 0 {
+		return errors.Errorf("no http server of %v", backend)
+	}
+
+	location := fmt.Sprintf("%v://%v%v", lb.SrsServerTLS.Scheme(lb.BackendProtocolHTTP), net.JoinHostPort(backend.IP, backend.HTTP[0]), r.URL.RequestURI())
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, location, http.StatusFound)
+
+	logger.Df(ctx, "HTTP redirect to %v", location)
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package protocol
+
+import "syscall"
+
+// soReusePort is the SO_REUSEPORT of Linux, which is missing in the syscall package of some architectures.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT of socket, so the kernel distributes the packets to the processes
+// sharing the port, by the hash of addresses.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if r0 := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); r0 != nil {
+		return r0
+	}
+	return err
+}
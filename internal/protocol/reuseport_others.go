@@ -0,0 +1,18 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package protocol
+
+import (
+	"syscall"
+
+	"srsx/internal/errors"
+)
+
+// reusePortControl is not supported, because SO_REUSEPORT doesn't distribute the packets to processes.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.Errorf("reuseport is not supported")
+}
@@ -6,23 +6,44 @@ package protocol
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	stdSync "sync"
+	"sync/atomic"
 	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/auth"
+	"srsx/internal/debug"
 	"srsx/internal/env"
 	"srsx/internal/errors"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
+	"srsx/internal/restream"
+	"srsx/internal/session"
 	"srsx/internal/sync"
 	"srsx/internal/utils"
 )
 
+// The TTL of the owner of client address forwarded to other processes, which is refreshed by each packet, and
+// longer than the ICE consent freshness of 30s, after which the session is closed.
+const rtcForwardTTL = 60 * time.Second
+
+// rtcForward is the owner process of client address, to forward the packets.
+type rtcForward struct {
+	// The index of owner process.
+	owner int
+	// The time in nanoseconds of last packet, updated atomically.
+	seenAt int64
+}
+
 // srsWebRTCServer is the proxy for SRS WebRTC server via WHIP or WHEP protocol. It will figure out
 // which backend server to proxy to. It will also replace the UDP port to the proxy server's in the
 // SDP answer.
@@ -40,6 +61,12 @@ type srsWebRTCServer struct {
 	// TODO: Support fast earch by uint64 address.
 	addresses sync.Map[string, *RTCConnection]
 
+	// The shard of this process, when multiple processes share the UDP port.
+	shard *udpShard
+	// The owner process of client address, to forward the packets of sessions owned by other processes.
+	// The key is UDP address, expired if no packet in TTL, because the session is closed by the owner.
+	forwards sync.Map[string, *rtcForward]
+
 	// The wait group for server.
 	wg stdSync.WaitGroup
 }
@@ -56,6 +83,7 @@ func (v *srsWebRTCServer) Close() error {
 	if v.listener != nil {
 		_ = v.listener.Close()
 	}
+	_ = v.shard.Close()
 
 	v.wg.Wait()
 	return nil
@@ -70,6 +98,11 @@ func (v *srsWebRTCServer) HandleApiForWHIP(ctx context.Context, w http.ResponseW
 		return nil
 	}
 
+	// The request to the resource URL of session, such as DELETE to stop, is proxied to the backend of session.
+	if ufrag := r.URL.Query().Get("session"); ufrag != "" && (r.Method != http.MethodPost || r.URL.Query().Get("action") == "delete") {
+		return v.proxyResourceToBackend(ctx, w, r, ufrag)
+	}
+
 	// Read remote SDP offer from body.
 	remoteSDPOffer, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -85,13 +118,60 @@ func (v *srsWebRTCServer) HandleApiForWHIP(ctx context.Context, w http.ResponseW
 		return errors.Wrapf(err, "build stream url %v", unifiedURL)
 	}
 
+	// Deny or route the client by policy, the throttle rules of WebRTC are rejected when loading policy.
+	if ctx, _, err = applyPolicy(ctx, "rtc", policy.OperationPublish, streamURL, r.RemoteAddr, r.Header); err != nil {
+		return errors.Wrapf(err, "apply policy")
+	}
+
+	// Verify the secret of client in the query, like ?app=live&stream=livestream&secret=xxx.
+	authClient := &auth.Client{
+		Action: auth.ActionPublish, Protocol: "rtc", StreamURL: streamURL, RemoteAddr: r.RemoteAddr, Param: r.URL.RawQuery,
+		Header: r.Header,
+	}
+	if err := auth.SrsAuthenticator.Authenticate(ctx, authClient); err != nil {
+		// The WHIP and WHEP clients follow the redirect with the same method and SDP.
+		if _, ok := auth.IsRedirect(err); ok {
+			logger.Wf(ctx, "Redirect WebRTC client, %v", err)
+			writeAuthError(w, r, http.StatusTemporaryRedirect, err)
+			return nil
+		}
+		return errors.Wrapf(err, "authenticate")
+	}
+
+	// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+	if ctx, _, err = applySelector(ctx, r.URL.RawQuery); err != nil {
+		return errors.Wrapf(err, "apply selector")
+	}
+
+	// Redirect the client to the proxy which owns the stream, because the session is bound to the proxy.
+	if owner := srsStreamSharding.Redirect(streamURL, true); owner != nil {
+		redirectAPI(ctx, w, r, owner)
+		return nil
+	}
+
+	// Keep the picked server by the affinity of publishers, which might be sticky by client.
+	ctx = lb.WithClient(ctx, r.RemoteAddr)
+	// Prefer the servers in the region of client, by the header or geolocation of client.
+	ctx = lb.WithClientRegions(ctx, r.RemoteAddr, r.Header)
+
 	// Pick a backend SRS server to proxy the RTMP stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	backend, err := lb.SrsLoadBalancer.PickForPublish(ctx, streamURL)
 	if err != nil {
+		if isNoServerError(err) {
+			newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+			return nil
+		}
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
 
-	if err = v.proxyApiToBackend(ctx, w, r, backend, string(remoteSDPOffer), streamURL); err != nil {
+	// Advise the client to switch protocol, if WebRTC is not enabled on the backend.
+	if len(backend.RTC) == 0 || len(backend.API) == 0 {
+		alternatives := protocolAlternatives(r, backend, streamURL, "whip", session.RolePublisher)
+		writeProtocolUnavailable(ctx, w, "whip", fmt.Sprintf("no rtc server of %v", backend), alternatives)
+		return nil
+	}
+
+	if err = v.proxyApiToBackend(ctx, w, r, backend, string(remoteSDPOffer), streamURL, session.RolePublisher, authClient); err != nil {
 		return errors.Wrapf(err, "serve %v with %v by backend %+v", fullURL, streamURL, backend)
 	}
 
@@ -107,6 +187,11 @@ func (v *srsWebRTCServer) HandleApiForWHEP(ctx context.Context, w http.ResponseW
 		return nil
 	}
 
+	// The request to the resource URL of session, such as DELETE to stop, is proxied to the backend of session.
+	if ufrag := r.URL.Query().Get("session"); ufrag != "" && (r.Method != http.MethodPost || r.URL.Query().Get("action") == "delete") {
+		return v.proxyResourceToBackend(ctx, w, r, ufrag)
+	}
+
 	// Read remote SDP offer from body.
 	remoteSDPOffer, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -122,13 +207,70 @@ func (v *srsWebRTCServer) HandleApiForWHEP(ctx context.Context, w http.ResponseW
 		return errors.Wrapf(err, "build stream url %v", unifiedURL)
 	}
 
+	// Deny or route the client by policy, the throttle rules of WebRTC are rejected when loading policy.
+	if ctx, _, err = applyPolicy(ctx, "rtc", policy.OperationPlay, streamURL, r.RemoteAddr, r.Header); err != nil {
+		return errors.Wrapf(err, "apply policy")
+	}
+
+	// Verify the secret of client in the query, like ?app=live&stream=livestream&secret=xxx.
+	authClient := &auth.Client{
+		Action: auth.ActionPlay, Protocol: "rtc", StreamURL: streamURL, RemoteAddr: r.RemoteAddr, Param: r.URL.RawQuery,
+		Header: r.Header,
+	}
+	if err := auth.SrsAuthenticator.Authenticate(ctx, authClient); err != nil {
+		// The WHIP and WHEP clients follow the redirect with the same method and SDP.
+		if _, ok := auth.IsRedirect(err); ok {
+			logger.Wf(ctx, "Redirect WebRTC client, %v", err)
+			writeAuthError(w, r, http.StatusTemporaryRedirect, err)
+			return nil
+		}
+		return errors.Wrapf(err, "authenticate")
+	}
+
+	// Reject the viewer if the token is revoked for restreaming. The session is bound to the UDP address
+	// later, so the viewer is checked as stateless client, like HLS.
+	if err := restream.SrsDetector.Check(ctx, &restream.Client{
+		StreamURL: streamURL, RemoteAddr: r.RemoteAddr, Query: r.URL.Query(), Header: r.Header,
+	}); err != nil {
+		logger.Wf(ctx, "Reject WebRTC client from %v for %v, %v", r.RemoteAddr, streamURL, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+	if ctx, _, err = applySelector(ctx, r.URL.RawQuery); err != nil {
+		return errors.Wrapf(err, "apply selector")
+	}
+
+	// Redirect the client to the proxy which owns the stream, because the session is bound to the proxy.
+	if owner := srsStreamSharding.Redirect(streamURL, true); owner != nil {
+		redirectAPI(ctx, w, r, owner)
+		return nil
+	}
+
+	// Keep the picked server by the affinity of players, which might be sticky by client.
+	ctx = lb.WithClient(ctx, r.RemoteAddr)
+	// Prefer the servers in the region of client, by the header or geolocation of client.
+	ctx = lb.WithClientRegions(ctx, r.RemoteAddr, r.Header)
+
 	// Pick a backend SRS server to proxy the RTMP stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	backend, err := lb.SrsLoadBalancer.PickForPlay(ctx, streamURL)
 	if err != nil {
+		if isNoServerError(err) {
+			newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+			return nil
+		}
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
 
-	if err = v.proxyApiToBackend(ctx, w, r, backend, string(remoteSDPOffer), streamURL); err != nil {
+	// Advise the client to switch protocol, if WebRTC is not enabled on the backend.
+	if len(backend.RTC) == 0 || len(backend.API) == 0 {
+		alternatives := protocolAlternatives(r, backend, streamURL, "whep", session.RoleViewer)
+		writeProtocolUnavailable(ctx, w, "whep", fmt.Sprintf("no rtc server of %v", backend), alternatives)
+		return nil
+	}
+
+	if err = v.proxyApiToBackend(ctx, w, r, backend, string(remoteSDPOffer), streamURL, session.RoleViewer, authClient); err != nil {
 		return errors.Wrapf(err, "serve %v with %v by backend %+v", fullURL, streamURL, backend)
 	}
 
@@ -137,7 +279,7 @@ func (v *srsWebRTCServer) HandleApiForWHEP(ctx context.Context, w http.ResponseW
 
 func (v *srsWebRTCServer) proxyApiToBackend(
 	ctx context.Context, w http.ResponseWriter, r *http.Request, backend *lb.SRSServer,
-	remoteSDPOffer string, streamURL string,
+	remoteSDPOffer string, streamURL string, role string, authClient *auth.Client,
 ) error {
 	// Parse HTTP port from backend.
 	if len(backend.API) == 0 {
@@ -151,8 +293,13 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		apiPort = int(iv)
 	}
 
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, streamURL, backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
 	// Connect to backend SRS server via HTTP client.
-	backendURL := fmt.Sprintf("http://%v:%v%s", backend.IP, apiPort, r.URL.Path)
+	backendURL := fmt.Sprintf("%v://%v:%v%s", lb.SrsServerTLS.Scheme(lb.BackendProtocolAPI), ip, apiPort, r.URL.Path)
 	if r.URL.RawQuery != "" {
 		backendURL += "?" + r.URL.RawQuery
 	}
@@ -162,7 +309,9 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		return errors.Wrapf(err, "create request to %v", backendURL)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	starttime := time.Now()
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	lb.ReportBackend(ctx, streamURL, backend, time.Since(starttime), backendError(resp, err))
 	if err != nil {
 		return errors.Errorf("do request to %v EOF", backendURL)
 	}
@@ -172,13 +321,16 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		return errors.Errorf("proxy api to %v failed, status=%v", backendURL, resp.Status)
 	}
 
-	// Copy all headers from backend to client.
-	w.WriteHeader(resp.StatusCode)
+	// Copy all headers from backend to client, such as the Location of session, before the status.
 	for k, v := range resp.Header {
+		if k == "Content-Length" {
+			continue
+		}
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
+	w.WriteHeader(resp.StatusCode)
 
 	// Parse the local SDP answer from backend.
 	b, err := ioutil.ReadAll(resp.Body)
@@ -186,7 +338,21 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		return errors.Wrapf(err, "read stream from %v", backendURL)
 	}
 
-	// Replace the WebRTC UDP port in answer.
+	// Replace the WebRTC UDP port in answer, by the port of proxy.
+	listen, err := utils.ParseListenAddr(v.environment.WebRTCServer(), "udp")
+	if err != nil {
+		return errors.Wrapf(err, "parse webrtc server %v", v.environment.WebRTCServer())
+	}
+
+	// The actual port of proxy, which is auto-assigned if configured 0.
+	_, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return errors.Wrapf(err, "parse webrtc listen %v", listen)
+	}
+	if v.listener != nil {
+		listenPort = fmt.Sprintf("%v", v.listener.LocalAddr().(*net.UDPAddr).Port)
+	}
+
 	localSDPAnswer := string(b)
 	for _, endpoint := range backend.RTC {
 		_, _, port, err := utils.ParseListenEndpoint(endpoint)
@@ -195,7 +361,7 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		}
 
 		from := fmt.Sprintf(" %v typ host", port)
-		to := fmt.Sprintf(" %v typ host", v.environment.WebRTCServer())
+		to := fmt.Sprintf(" %v typ host", listenPort)
 		localSDPAnswer = strings.Replace(localSDPAnswer, from, to, -1)
 	}
 
@@ -216,7 +382,9 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 		LocalICEUfrag: localICEUfrag, LocalICEPwd: localICEPwd,
 	}
 	if err := lb.SrsLoadBalancer.StoreWebRTC(ctx, streamURL, NewRTCConnection(func(c *RTCConnection) {
-		c.StreamURL, c.Ufrag = streamURL, icePair.Ufrag()
+		c.StreamURL, c.Ufrag, c.Role, c.Backend = streamURL, icePair.Ufrag(), role, backend
+		c.Annotations, c.Labels = authClient.Annotations, authClient.Labels
+		c.Location, c.storedAt = resp.Header.Get("Location"), time.Now()
 		c.Initialize(ctx, v.listener)
 
 		// Cache the connection for fast search by username.
@@ -235,11 +403,85 @@ func (v *srsWebRTCServer) proxyApiToBackend(
 	return nil
 }
 
+// proxyResourceToBackend proxies the request to the resource URL of WHIP or WHEP session, such as DELETE to
+// stop the session, to the backend of session by the ufrag, which is persisted in the shared store, so the
+// session is resumable after the client retries the signaling against another proxy. The client should
+// re-establish the session by a new offer, if the session is not found.
+func (v *srsWebRTCServer) proxyResourceToBackend(ctx context.Context, w http.ResponseWriter, r *http.Request, ufrag string) error {
+	connection, ok := v.usernames.Load(ufrag)
+	if !ok {
+		if c, err := lb.SrsLoadBalancer.LoadWebRTCByUfrag(ctx, ufrag); err != nil {
+			logger.Wf(ctx, "WebRTC %v session %v not found, %v", r.Method, ufrag, err)
+		} else {
+			connection = c.(*RTCConnection)
+			logger.Df(ctx, "Resume WebRTC session ufrag=%v, stream=%v, backend=%v", ufrag, connection.StreamURL, connection.Backend)
+		}
+	}
+	if connection == nil || connection.Backend == nil || len(connection.Backend.API) == 0 {
+		// Forward to the peer proxy which owns the session, if the session is not on this proxy.
+		if srsForwarder.Forward(ctx, w, r, "rtc", ufrag) {
+			return nil
+		}
+		http.Error(w, fmt.Sprintf("session %v not found", ufrag), http.StatusNotFound)
+		return nil
+	}
+
+	backend := connection.Backend
+	apiPort, err := strconv.ParseInt(backend.API[0], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parse http port %v", backend.API[0])
+	}
+
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	backendURL := fmt.Sprintf("%v://%v:%v%s", lb.SrsServerTLS.Scheme(lb.BackendProtocolAPI), ip, apiPort, r.URL.Path)
+	if r.URL.RawQuery != "" {
+		backendURL += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, backendURL, r.Body)
+	if err != nil {
+		return errors.Wrapf(err, "create request to %v", backendURL)
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "do request to %v", backendURL)
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return errors.Wrapf(err, "copy response from %v", backendURL)
+	}
+
+	// Close the session on this proxy, after the session is stopped by backend.
+	if r.Method == http.MethodDelete && resp.StatusCode < http.StatusMultipleChoices {
+		v.usernames.Delete(ufrag)
+		if s := connection.session; s != nil {
+			session.SrsSessionManager.KickSession(ctx, s, session.CloseClientClosed)
+		}
+	}
+
+	logger.Df(ctx, "Proxy WebRTC %v of session %v to %v, status=%v", r.Method, ufrag, backendURL, resp.StatusCode)
+	return nil
+}
+
 func (v *srsWebRTCServer) Run(ctx context.Context) error {
 	// Parse address to listen.
-	endpoint := v.environment.WebRTCServer()
-	if !strings.Contains(endpoint, ":") {
-		endpoint = fmt.Sprintf(":%v", endpoint)
+	endpoint, err := utils.ParseListenAddr(v.environment.WebRTCServer(), "udp")
+	if err != nil {
+		return errors.Wrapf(err, "parse webrtc server %v", v.environment.WebRTCServer())
 	}
 
 	saddr, err := net.ResolveUDPAddr("udp", endpoint)
@@ -247,12 +489,57 @@ func (v *srsWebRTCServer) Run(ctx context.Context) error {
 		return errors.Wrapf(err, "resolve udp addr %v", endpoint)
 	}
 
-	listener, err := net.ListenUDP("udp", saddr)
+	shard, err := newUDPShardFromEnvironment(v.environment, "webrtc", 0)
+	if err != nil {
+		return errors.Wrapf(err, "create udp shard")
+	}
+
+	listener, err := srsUpgrader.listenUDP(ctx, "webrtc", saddr, v.environment.UDPReusePort() == "on")
 	if err != nil {
 		return errors.Wrapf(err, "listen udp %v", saddr)
 	}
 	v.listener = listener
-	logger.Df(ctx, "WebRTC server listen at %v", saddr)
+	saddr = listener.LocalAddr().(*net.UDPAddr)
+	logger.Df(ctx, "WebRTC server listen at %v, reuseport=%v", saddr, v.environment.UDPReusePort())
+	updateListener("webrtc", saddr.String(), true, nil)
+
+	// The requests to the resource URL of session forwarded by peer proxy, such as DELETE to stop.
+	srsForwarder.handle("rtc", &forwardHandler{
+		owns: func(ctx context.Context, id string) bool {
+			if _, ok := v.usernames.Load(id); ok {
+				return true
+			}
+			_, err := lb.SrsLoadBalancer.LoadWebRTCByUfrag(ctx, id)
+			return err == nil
+		},
+		serve: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			defer r.Body.Close()
+			return v.proxyResourceToBackend(ctx, w, r, r.URL.Query().Get("session"))
+		},
+	})
+
+	// Handle the packets forwarded by other processes, for the sessions owned by this process.
+	if shard.Enabled() {
+		v.shard = shard
+		if err := shard.Run(ctx, &v.wg, func(addr *net.UDPAddr, data []byte) error {
+			return v.handleClientUDP(ctx, addr, data)
+		}); err != nil {
+			return errors.Wrapf(err, "run udp shard")
+		}
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			v.expireForwards(ctx)
+		}()
+	}
+
+	// Handle the new sessions handed off by the parent process, which is draining for upgrade.
+	if err := srsUpgrader.runHandoff(ctx, "webrtc", &v.wg, func(addr *net.UDPAddr, data []byte) error {
+		return v.handleClientUDP(ctx, addr, data)
+	}); err != nil {
+		return errors.Wrapf(err, "run handoff")
+	}
 
 	// Consume all messages from UDP media transport.
 	v.wg.Add(1)
@@ -266,6 +553,7 @@ func (v *srsWebRTCServer) Run(ctx context.Context) error {
 				// If context is canceled or connection is closed, exit gracefully without logging error.
 				if ctx.Err() != nil || utils.IsClosedNetworkError(err) {
 					logger.Df(ctx, "WebRTC server done")
+					updateListener("webrtc", saddr.String(), false, nil)
 					return
 				}
 				// TODO: If WebRTC server closed unexpectedly, we should notice the main loop to quit.
@@ -274,7 +562,7 @@ func (v *srsWebRTCServer) Run(ctx context.Context) error {
 				continue
 			}
 
-			if err := v.handleClientUDP(ctx, caddr, buf[:n]); err != nil {
+			if err := v.handleListenerUDP(ctx, caddr, buf[:n]); err != nil {
 				logger.Wf(ctx, "WebRTC handle udp %vB failed, addr=%v, err=%+v", n, caddr, err)
 			}
 		}
@@ -283,6 +571,69 @@ func (v *srsWebRTCServer) Run(ctx context.Context) error {
 	return nil
 }
 
+// handleListenerUDP handles the packet from the shared UDP port, which is forwarded to the owner process by
+// the ufrag of STUN binding request, or by the address of client after STUN, if sharded to multiple processes.
+func (v *srsWebRTCServer) handleListenerUDP(ctx context.Context, addr *net.UDPAddr, data []byte) error {
+	if !v.shard.Enabled() {
+		return v.handleClientUDP(ctx, addr, data)
+	}
+
+	var owner int
+	forward, ok := v.forwards.Load(addr.String())
+	if ok {
+		owner = forward.owner
+		atomic.StoreInt64(&forward.seenAt, time.Now().UnixNano())
+	}
+
+	if !utils.RtcIsRTPOrRTCP(data) && utils.RtcIsSTUN(data) {
+		var pkt RTCStunPacket
+		if err := pkt.UnmarshalBinary(data); err != nil {
+			return errors.Wrapf(err, "unmarshal stun packet")
+		}
+
+		// The client might switch to another session, so always update the owner by the ufrag.
+		owner, ok = v.shard.Owner(pkt.Username), true
+		if owner != v.shard.index {
+			v.forwards.Store(addr.String(), &rtcForward{owner: owner, seenAt: time.Now().UnixNano()})
+		} else {
+			v.forwards.Delete(addr.String())
+		}
+	}
+
+	if !ok || owner == v.shard.index {
+		return v.handleClientUDP(ctx, addr, data)
+	}
+	return v.shard.Forward(owner, addr, data)
+}
+
+// expireForwards removes the owners of client addresses without any packet in TTL, until ctx done.
+func (v *srsWebRTCServer) expireForwards(ctx context.Context) {
+	ticker := time.NewTicker(rtcForwardTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var expired int
+		deadline := time.Now().Add(-rtcForwardTTL).UnixNano()
+		v.forwards.Range(func(addr string, forward *rtcForward) bool {
+			if atomic.LoadInt64(&forward.seenAt) < deadline {
+				v.forwards.Delete(addr)
+				expired++
+			}
+			return true
+		})
+
+		if expired > 0 {
+			logger.Df(ctx, "WebRTC expire %v forwarded addresses, ttl=%v", expired, rtcForwardTTL)
+		}
+	}
+}
+
 func (v *srsWebRTCServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr, data []byte) error {
 	var connection *RTCConnection
 
@@ -303,6 +654,11 @@ func (v *srsWebRTCServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr
 			return nil
 		}
 
+		// Never resume the session from shared store when draining, to not accept new connections.
+		if SrsProxyDrainer.Draining() {
+			return nil
+		}
+
 		// Load connection by username.
 		if s, err := lb.SrsLoadBalancer.LoadWebRTCByUfrag(ctx, pkt.Username); err != nil {
 			return errors.Wrapf(err, "load webrtc by ufrag %v", pkt.Username)
@@ -328,8 +684,11 @@ func (v *srsWebRTCServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr
 		v.addresses.Store(addr.String(), connection)
 	}
 
-	// If connection is not found, ignore the packet.
+	// If connection is not found, ignore the packet, or hand off the new session to the new process if upgraded.
 	if connection == nil {
+		if SrsProxyDrainer.Draining() && srsUpgrader.Handoff("webrtc", addr, data) {
+			return nil
+		}
 		// TODO: Should logging the dropped packet, only logging the first one for each address.
 		return nil
 	}
@@ -360,13 +719,32 @@ type RTCConnection struct {
 	StreamURL string `json:"stream_url"`
 	// The ufrag for this WebRTC connection.
 	Ufrag string `json:"ufrag"`
-
+	// The role of client, publisher for WHIP or viewer for WHEP.
+	Role string `json:"role"`
+	// The backend server picked by WHIP or WHEP, which the UDP is proxied to, because the server might
+	// not be sticky by stream URL, see PickAffinity.
+	Backend *lb.SRSServer `json:"backend,omitempty"`
+	// The resource URL of session, the Location responded by backend, to delete or update the session.
+	Location string `json:"location,omitempty"`
+	// The annotations of session, set by the external authorization service.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The labels of session, like user id, plan or region, set by the auth hooks.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// The time stored to load balancer, to refresh the session in the shared store while alive.
+	storedAt time.Time
 	// The UDP connection proxy to backend.
 	backendUDP *net.UDPConn
 	// The client UDP address. Note that it may change.
 	clientUDP *net.UDPAddr
 	// The listener UDP connection, used to send messages to client.
 	listenerUDP *net.UDPConn
+	// The client session, closed by closing the backend UDP when kicked.
+	session *session.Session
+	// Release the session of backend server, for least-connections strategy.
+	release func()
+	// The stats of session, such as the bitrate, RTT and loss.
+	stats *rtcStats
 }
 
 func NewRTCConnection(opts ...func(*RTCConnection)) *RTCConnection {
@@ -377,9 +755,17 @@ func NewRTCConnection(opts ...func(*RTCConnection)) *RTCConnection {
 	return v
 }
 
+// NewRTCConnectionFromDTO creates the WebRTC streaming from the data persisted by load balancer.
+func NewRTCConnectionFromDTO(dto *lb.RTCConnectionDTO) lb.RTCConnection {
+	return NewRTCConnection(func(c *RTCConnection) {
+		c.StreamURL, c.Ufrag, c.Role, c.Backend = dto.StreamURL, dto.Ufrag, dto.Role, dto.Backend
+		c.Location, c.Annotations, c.Labels = dto.Location, dto.Annotations, dto.Labels
+	})
+}
+
 func (v *RTCConnection) Initialize(ctx context.Context, listener *net.UDPConn) *RTCConnection {
 	if v.ctx == nil {
-		v.ctx = logger.WithContext(ctx)
+		v.ctx = logger.WithLabels(logger.WithContext(ctx), v.Labels)
 	}
 	if listener != nil {
 		v.listenerUDP = listener
@@ -397,6 +783,16 @@ func (v *RTCConnection) HandlePacket(addr *net.UDPAddr, data []byte) error {
 	// Update the current UDP address.
 	v.clientUDP = addr
 
+	// Refresh the session in the shared store while alive, to be resumable on another proxy.
+	if time.Since(v.storedAt) > lb.RTCAliveDuration/2 {
+		v.storedAt = time.Now()
+		go func() {
+			if err := lb.SrsLoadBalancer.StoreWebRTC(ctx, v.StreamURL, v); err != nil {
+				logger.Wf(ctx, "Refresh WebRTC %v failed, %v", v.Ufrag, err)
+			}
+		}()
+	}
+
 	// Start the UDP proxy to backend.
 	if err := v.connectBackend(ctx); err != nil {
 		return errors.Wrapf(err, "connect backend for %v", v.StreamURL)
@@ -406,25 +802,39 @@ func (v *RTCConnection) HandlePacket(addr *net.UDPAddr, data []byte) error {
 	if v.backendUDP == nil {
 		return nil
 	}
+	srsTrafficCapturer.record(ctx, v.listenerUDP.LocalAddr(), addr, true, data)
+	v.stats.onClientPacket(data)
+	alarm.SrsUsageMonitor.AddBytes(len(data))
+	if v.Role == session.RolePublisher {
+		lb.SrsServerBandwidth.AddBytes(v.StreamURL, len(data))
+	}
 
 	// Proxy all messages from backend to client.
-	go func() {
+	go debug.DoWithProfileLabels(ctx, "rtc", v.StreamURL, func(ctx context.Context) {
+		defer session.SrsSessionManager.Remove(v.session)
+		defer v.release()
+
 		for ctx.Err() == nil {
 			buf := make([]byte, 4096)
 			n, _, err := v.backendUDP.ReadFromUDP(buf)
 			if err != nil {
 				// TODO: If backend server closed unexpectedly, we should notice the stream to quit.
 				logger.Wf(ctx, "read from backend failed, err=%v", err)
+				v.session.SetCloseReason(session.CloseReasonOf(err, session.CloseBackendClosed))
 				break
 			}
 
+			v.stats.onBackendPacket(buf[:n])
+			alarm.SrsUsageMonitor.AddBytes(n)
+			srsTrafficCapturer.record(ctx, v.listenerUDP.LocalAddr(), v.clientUDP, false, buf[:n])
 			if _, err = v.listenerUDP.WriteToUDP(buf[:n], v.clientUDP); err != nil {
 				// TODO: If backend server closed unexpectedly, we should notice the stream to quit.
 				logger.Wf(ctx, "write to client failed, err=%v", err)
+				v.session.SetCloseReason(session.CloseReasonOf(err, session.CloseClientClosed))
 				break
 			}
 		}
-	}()
+	})
 
 	if _, err := v.backendUDP.Write(data); err != nil {
 		return errors.Wrapf(err, "write to backend %v", v.StreamURL)
@@ -438,10 +848,28 @@ func (v *RTCConnection) connectBackend(ctx context.Context) error {
 		return nil
 	}
 
-	// Pick a backend SRS server to proxy the RTC stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, v.StreamURL)
+	// Reject the excess sessions early, before any backend contact, and release it with the backend.
+	releaseConn, err := srsConnLimiter.Acquire("webrtc", v.clientUDP.String())
 	if err != nil {
-		return errors.Wrapf(err, "pick backend")
+		return errors.Wrapf(err, "limit connections")
+	}
+	defer func() {
+		if v.release == nil {
+			releaseConn()
+		}
+	}()
+
+	// Use the backend SRS server of WHIP or WHEP, or pick one for the connection of old proxy.
+	backend := v.Backend
+	if backend == nil {
+		var err error
+		pick := lb.SrsLoadBalancer.PickForPlay
+		if v.Role == session.RolePublisher {
+			pick = lb.SrsLoadBalancer.PickForPublish
+		}
+		if backend, err = pick(ctx, v.StreamURL); err != nil {
+			return errors.Wrapf(err, "pick backend")
+		}
 	}
 
 	// Parse UDP port from backend.
@@ -456,13 +884,32 @@ func (v *RTCConnection) connectBackend(ctx context.Context) error {
 
 	// Connect to backend SRS server via UDP client.
 	// TODO: FIXME: Support close the connection when timeout or DTLS alert.
-	backendAddr := net.UDPAddr{IP: net.ParseIP(backend.IP), Port: int(udpPort)}
-	if backendUDP, err := net.DialUDP("udp", nil, &backendAddr); err != nil {
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, v.StreamURL, backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	backendAddr := net.UDPAddr{IP: net.ParseIP(ip), Port: int(udpPort)}
+	if backendUDP, err := dialUDP(ctx, &backendAddr); err != nil {
+		lb.ReportBackend(ctx, v.StreamURL, backend, 0, err)
 		return errors.Wrapf(err, "dial udp to %v", backendAddr)
 	} else {
 		v.backendUDP = backendUDP
 	}
 
+	// Register the session, the client will reconnect after the backend UDP is closed by kick.
+	releaseBackend := lb.SrsServerConnections.Acquire(backend)
+	v.release = func() {
+		releaseBackend()
+		releaseConn()
+	}
+	v.stats = newRTCStats(v.Role)
+	v.session = session.SrsSessionManager.Add(ctx, "rtc", v.StreamURL, v.clientUDP.String(), func() {
+		v.backendUDP.Close()
+	}, session.WithRole(v.Role), session.WithStats(v.stats), session.WithAnnotations(v.Annotations),
+		session.WithLabels(v.Labels))
+	srsTrafficCapturer.attach(ctx, v.clientUDP)
+
 	return nil
 }
 
@@ -529,3 +976,174 @@ func (v *RTCStunPacket) UnmarshalBinary(data []byte) error {
 
 	return nil
 }
+
+// rtcDirectionStats is the stats of packets in a direction, from client or to client.
+type rtcDirectionStats struct {
+	// The number of bytes.
+	bytes uint64
+	// The number of UDP packets, including STUN, DTLS, RTP and RTCP.
+	packets uint64
+	// The number of RTP packets lost, by the gaps of sequence number.
+	lost uint64
+	// The number of RTP packets retransmitted, which are older than the highest sequence number.
+	retransmits uint64
+	// The number of RTP packets.
+	rtpPackets uint64
+	// The highest sequence number of each SSRC.
+	sequences map[uint32]uint16
+
+	// The bitrate of packets, sampled by the bitrate sampler.
+	meter bitrateMeter
+}
+
+// update the stats by a packet, and the sequence number if it's an RTP packet, whose header is not
+// encrypted by SRTP.
+func (v *rtcDirectionStats) update(data []byte) {
+	v.bytes += uint64(len(data))
+	v.packets++
+
+	// Ignore the RTCP packets, whose payload type is in [192, 223] with the marker bit.
+	if !utils.RtcIsRTPOrRTCP(data) || (data[1] >= 192 && data[1] <= 223) {
+		return
+	}
+	v.rtpPackets++
+
+	seq, ssrc := binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint32(data[8:])
+	highest, ok := v.sequences[ssrc]
+	if !ok {
+		v.sequences[ssrc] = seq
+		return
+	}
+
+	// The sequence number wraps around, so use the signed difference.
+	if diff := int16(seq - highest); diff > 0 {
+		v.lost += uint64(diff - 1)
+		v.sequences[ssrc] = seq
+	} else {
+		v.retransmits++
+	}
+}
+
+// kbps returns the bitrate in kbps, without any side effect.
+func (v *rtcDirectionStats) kbps(now time.Time, createdAt time.Time) float64 {
+	return v.meter.bitrate(v.bytes, now, createdAt) / 1000
+}
+
+// rtcStats is the stats of a WebRTC session measured by proxy, because the media is encrypted by SRTP,
+// only the UDP packets, the RTP headers and the STUN packets are available.
+type rtcStats struct {
+	// The role of client, publisher or viewer.
+	role string
+	// The time created.
+	createdAt time.Time
+	// The packets from client to backend.
+	recv rtcDirectionStats
+	// The packets from backend to client.
+	send rtcDirectionStats
+	// The STUN binding requests from backend to client, key is the transaction ID.
+	requests map[string]time.Time
+	// The smoothed RTT between proxy and client, by the STUN binding requests of ICE consent.
+	rtt time.Duration
+	// The lock to protect all fields.
+	lock stdSync.Mutex
+}
+
+func newRTCStats(role string) *rtcStats {
+	return &rtcStats{
+		role: role, createdAt: time.Now(), requests: make(map[string]time.Time),
+		recv: rtcDirectionStats{sequences: make(map[uint32]uint16)},
+		send: rtcDirectionStats{sequences: make(map[uint32]uint16)},
+	}
+}
+
+// onClientPacket updates the stats by a packet from client to backend.
+func (v *rtcStats) onClientPacket(data []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recv.update(data)
+
+	// The STUN binding success response of client, to the request of backend.
+	if utils.RtcIsSTUN(data) && len(data) >= 20 && binary.BigEndian.Uint16(data) == 0x0101 {
+		if sentAt, ok := v.requests[string(data[8:20])]; ok {
+			delete(v.requests, string(data[8:20]))
+
+			// See https://datatracker.ietf.org/doc/html/rfc6298#section-2
+			if sample := time.Since(sentAt); v.rtt == 0 {
+				v.rtt = sample
+			} else {
+				v.rtt = v.rtt*7/8 + sample/8
+			}
+		}
+	}
+}
+
+// onBackendPacket updates the stats by a packet from backend to client.
+func (v *rtcStats) onBackendPacket(data []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.send.update(data)
+
+	// The STUN binding request of backend, for ICE consent. The stale requests are removed, because the
+	// response might be lost.
+	if utils.RtcIsSTUN(data) && len(data) >= 20 && binary.BigEndian.Uint16(data) == 0x0001 {
+		now := time.Now()
+		for id, sentAt := range v.requests {
+			if now.Sub(sentAt) > 10*time.Second {
+				delete(v.requests, id)
+			}
+		}
+		v.requests[string(data[8:20])] = now
+	}
+}
+
+// sampleBitrate samples the bitrate from client and to client, by the bitrate sampler.
+func (v *rtcStats) sampleBitrate(now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recv.meter.sample(v.recv.bytes, now, v.createdAt)
+	v.send.meter.sample(v.send.bytes, now, v.createdAt)
+}
+
+// MarshalJSON marshals the snapshot of stats, and the loss in percent, which is the gaps of sequence
+// number from publisher, or the retransmitted packets to viewer because of its NACK.
+func (v *rtcStats) MarshalJSON() ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	type Direction struct {
+		Bytes       uint64  `json:"bytes"`
+		Packets     uint64  `json:"packets"`
+		Kbps        float64 `json:"kbps"`
+		Lost        uint64  `json:"lost"`
+		Retransmits uint64  `json:"retransmits"`
+	}
+	type Stats struct {
+		Recv Direction `json:"recv"`
+		Send Direction `json:"send"`
+		RTT  float64   `json:"rtt_ms"`
+		Loss float64   `json:"loss"`
+	}
+
+	now := time.Now()
+	stats := Stats{
+		Recv: Direction{
+			Bytes: v.recv.bytes, Packets: v.recv.packets, Kbps: v.recv.kbps(now, v.createdAt),
+			Lost: v.recv.lost, Retransmits: v.recv.retransmits,
+		},
+		Send: Direction{
+			Bytes: v.send.bytes, Packets: v.send.packets, Kbps: v.send.kbps(now, v.createdAt),
+			Lost: v.send.lost, Retransmits: v.send.retransmits,
+		},
+		RTT: float64(v.rtt) / float64(time.Millisecond),
+	}
+
+	if v.role == session.RolePublisher && v.recv.rtpPackets+v.recv.lost > 0 {
+		stats.Loss = float64(v.recv.lost) * 100 / float64(v.recv.rtpPackets+v.recv.lost)
+	} else if v.role == session.RoleViewer && v.send.rtpPackets > 0 {
+		stats.Loss = float64(v.send.retransmits) * 100 / float64(v.send.rtpPackets)
+	}
+	return json.Marshal(&stats)
+}
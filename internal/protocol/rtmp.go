@@ -5,17 +5,29 @@ package protocol
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	stdSync "sync"
+	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/auth"
+	"srsx/internal/debug"
 	"srsx/internal/env"
 	"srsx/internal/errors"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
+	"srsx/internal/restream"
 	"srsx/internal/rtmp"
+	"srsx/internal/session"
+	"srsx/internal/sync"
 	"srsx/internal/utils"
 	"srsx/internal/version"
 )
@@ -26,10 +38,20 @@ import (
 type srsRTMPServer struct {
 	// The environment interface.
 	environment env.Environment
-	// The TCP listener for RTMP server.
-	listener *net.TCPListener
+	// The TCP listeners for RTMP and RTMPS server.
+	listeners []*net.TCPListener
+	// The grace window to keep the backend of disconnected publisher.
+	publishGrace time.Duration
+	// The idle timeout of client and backend connections, 0 to disable.
+	idleTimeout, backendIdleTimeout time.Duration
+	// The parked publishing sessions in grace window, key is stream URL.
+	publishers sync.Map[string, *rtmpPublishSession]
+	// Whether redirect the clients to backend by RTMP 302, instead of proxying.
+	redirect bool
+	// Whether serve the viewers by the edge streams, which are pulled once from backend.
+	edge bool
 	// The wait group for all goroutines.
-	wg sync.WaitGroup
+	wg stdSync.WaitGroup
 }
 
 func NewSRSRTMPServer(environment env.Environment, opts ...func(*srsRTMPServer)) *srsRTMPServer {
@@ -40,64 +62,163 @@ func NewSRSRTMPServer(environment env.Environment, opts ...func(*srsRTMPServer))
 	return v
 }
 
+// StopAccepting closes the listeners to stop accepting new connections, while the existing connections
+// are kept until Close.
+func (v *srsRTMPServer) StopAccepting() error {
+	for _, listener := range v.listeners {
+		listener.Close()
+	}
+	return nil
+}
+
 func (v *srsRTMPServer) Close() error {
-	if v.listener != nil {
-		v.listener.Close()
+	for _, listener := range v.listeners {
+		listener.Close()
 	}
 
+	v.publishers.Range(func(streamURL string, session *rtmpPublishSession) bool {
+		session.Close()
+		return true
+	})
+
 	v.wg.Wait()
 	return nil
 }
 
 func (v *srsRTMPServer) Run(ctx context.Context) error {
-	endpoint := v.environment.RtmpServer()
-	if !strings.Contains(endpoint, ":") {
-		endpoint = ":" + endpoint
+	endpoints, err := utils.ParseListenAddrs(v.environment.RtmpServer(), "tcp")
+	if err != nil {
+		return errors.Wrapf(err, "parse rtmp server %v", v.environment.RtmpServer())
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", endpoint)
-	if err != nil {
-		return errors.Wrapf(err, "resolve rtmp addr %v", endpoint)
+	if publishGrace, err := time.ParseDuration(v.environment.RtmpPublishGrace()); err != nil {
+		return errors.Wrapf(err, "parse rtmp publish grace %v", v.environment.RtmpPublishGrace())
+	} else {
+		v.publishGrace = publishGrace
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
+	if idleTimeout, err := time.ParseDuration(v.environment.RtmpIdleTimeout()); err != nil {
+		return errors.Wrapf(err, "parse rtmp idle timeout %v", v.environment.RtmpIdleTimeout())
+	} else {
+		v.idleTimeout = idleTimeout
+	}
+
+	if backendIdleTimeout, err := time.ParseDuration(v.environment.RtmpBackendIdleTimeout()); err != nil {
+		return errors.Wrapf(err, "parse rtmp backend idle timeout %v", v.environment.RtmpBackendIdleTimeout())
+	} else {
+		v.backendIdleTimeout = backendIdleTimeout
+	}
+
+	if mode, err := parseRedirectMode(v.environment.RedirectMode()); err != nil {
+		return errors.Wrapf(err, "parse redirect mode %v", v.environment.RedirectMode())
+	} else {
+		v.redirect = mode.rtmp
+	}
+	v.edge = v.environment.EdgeFanout() == "on"
+
+	listeners, err := srsUpgrader.listenTCPs(ctx, "rtmp", endpoints)
 	if err != nil {
-		return errors.Wrapf(err, "listen rtmp addr %v", addr)
+		return errors.Wrapf(err, "listen rtmp addr %v", strings.Join(endpoints, ","))
+	}
+	for i, listener := range listeners {
+		v.listeners = append(v.listeners, listener)
+		logger.Df(ctx, "RTMP server listen at %v", listener.Addr())
+		v.accept(ctx, listenerName("rtmp", i), listener, nil)
+	}
+
+	// The RTMPS server terminates TLS, while the backends are connected over plain RTMP.
+	if v.environment.RtmpsServer() != "" {
+		tlsEndpoints, err := utils.ParseListenAddrs(v.environment.RtmpsServer(), "tcp")
+		if err != nil {
+			return errors.Wrapf(err, "parse rtmps server %v", v.environment.RtmpsServer())
+		}
+
+		cert, err := newTLSCertificate(ctx, "rtmps", v.environment.RtmpsCert(), v.environment.RtmpsKey())
+		if err != nil {
+			return errors.Wrapf(err, "rtmps certificate")
+		}
+
+		tlsListeners, err := srsUpgrader.listenTCPs(ctx, "rtmps", tlsEndpoints)
+		if err != nil {
+			return errors.Wrapf(err, "listen rtmps addr %v", strings.Join(tlsEndpoints, ","))
+		}
+		for i, listener := range tlsListeners {
+			v.listeners = append(v.listeners, listener)
+			logger.Df(ctx, "RTMPS server listen at %v", listener.Addr())
+			v.accept(ctx, listenerName("rtmps", i), listener, cert.Config())
+		}
 	}
-	v.listener = listener
-	logger.Df(ctx, "RTMP server listen at %v", addr)
+
+	return nil
+}
+
+// accept the RTMP clients from listener name, over TLS if config is not nil.
+func (v *srsRTMPServer) accept(ctx context.Context, name string, listener *net.TCPListener, config *tls.Config) {
+	addr := listener.Addr().(*net.TCPAddr)
+	updateListener(name, addr.String(), true, nil)
 
 	v.wg.Add(1)
 	go func() {
 		defer v.wg.Done()
 
 		for {
-			conn, err := v.listener.AcceptTCP()
+			conn, err := listener.AcceptTCP()
 			if err != nil {
 				// If context is canceled or connection is closed, exit gracefully without logging error.
 				if ctx.Err() != nil || utils.IsClosedNetworkError(err) {
-					logger.Df(ctx, "RTMP server done")
+					logger.Df(ctx, "RTMP server %v done", name)
+					updateListener(name, addr.String(), false, nil)
 				} else {
 					// TODO: If RTMP server closed unexpectedly, we should notice the main loop to quit.
-					logger.Wf(ctx, "RTMP server accept err %+v", err)
+					logger.Wf(ctx, "RTMP server %v accept err %+v", name, err)
+					updateListener(name, addr.String(), false, err)
 				}
 				return
 			}
 
+			// Reject the excess connections right after accepted, before the RTMP handshake.
+			release, err := srsConnLimiter.Acquire(name, conn.RemoteAddr().String())
+			if err != nil {
+				logger.Wf(ctx, "Reject %v connection from %v, %v", name, conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+
 			v.wg.Add(1)
-			go func(ctx context.Context, conn *net.TCPConn) {
+			go func(ctx context.Context, conn net.Conn) {
 				defer v.wg.Done()
+				defer release()
 				defer conn.Close()
 
 				handleErr := func(err error) {
 					if utils.IsPeerClosedError(err) || utils.IsClosedNetworkError(err) {
 						logger.Df(ctx, "RTMP connection closed")
+					} else if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+						logger.Df(ctx, "RTMP connection idle timeout, %v", errors.Cause(err))
 					} else {
 						logger.Wf(ctx, "RTMP serve err %+v", err)
 					}
 				}
 
-				rc := NewRTMPConnection()
+				// Close the idle client, including the handshake of TLS and RTMP.
+				conn = newIdleConn(conn, v.idleTimeout)
+
+				// Limit the egress of client, including the bytes of TLS.
+				conn = srsEgressThrottler.newConn(conn)
+
+				// The TLS handshake is done by the first read of RTMP handshake.
+				if config != nil {
+					conn = tls.Server(conn, config)
+				}
+
+				// Capture the plain bytes of client by System API, after the TLS is decrypted.
+				conn = newCaptureConn(ctx, conn)
+
+				rc := NewRTMPConnection(func(c *RTMPConnection) {
+					c.publishGrace, c.publishers = v.publishGrace, &v.publishers
+					c.backendIdleTimeout = v.backendIdleTimeout
+					c.redirect, c.edge = v.redirect, v.edge
+				})
 				if err := rc.serve(ctx, conn); err != nil {
 					handleErr(err)
 				} else {
@@ -106,8 +227,6 @@ func (v *srsRTMPServer) Run(ctx context.Context) error {
 			}(logger.WithContext(ctx), conn)
 		}
 	}()
-
-	return nil
 }
 
 // RTMPConnection is an RTMP streaming connection. There is no state need to be sync between
@@ -117,6 +236,16 @@ func (v *srsRTMPServer) Run(ctx context.Context) error {
 // then proxy to the corresponding backend server. All state is in the RTMP request, so this
 // connection is stateless.
 type RTMPConnection struct {
+	// The grace window to keep the backend of publisher after disconnected, 0 to disable.
+	publishGrace time.Duration
+	// The parked publishing sessions in grace window, key is stream URL.
+	publishers *sync.Map[string, *rtmpPublishSession]
+	// The idle timeout of backend connections, 0 to disable.
+	backendIdleTimeout time.Duration
+	// Whether redirect the client to backend by RTMP 302, instead of proxying.
+	redirect bool
+	// Whether serve the viewer by the edge stream, which is pulled once from backend.
+	edge bool
 }
 
 func NewRTMPConnection(opts ...func(*RTMPConnection)) *RTMPConnection {
@@ -127,7 +256,7 @@ func NewRTMPConnection(opts ...func(*RTMPConnection)) *RTMPConnection {
 	return v
 }
 
-func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
+func (v *RTMPConnection) serve(ctx context.Context, conn net.Conn) error {
 	logger.Df(ctx, "Got RTMP client from %v", conn.RemoteAddr())
 
 	// If any goroutine quit, cancel another one.
@@ -146,7 +275,7 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 		}()
 	}
 
-	// Simple handshake with client.
+	// Complex handshake with client if C1 has a valid digest, or simple handshake.
 	hs := rtmp.NewHandshake()
 	if _, err := hs.ReadC0S0(conn); err != nil {
 		return errors.Wrapf(err, "read c0")
@@ -155,20 +284,30 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 		return errors.Wrapf(err, "read c1")
 	}
 	if err := hs.WriteC0S0(conn); err != nil {
-		return errors.Wrapf(err, "write s1")
+		return errors.Wrapf(err, "write s0")
 	}
-	if err := hs.WriteC1S1(conn); err != nil {
-		return errors.Wrapf(err, "write s1")
+	complexHandshake, err := hs.WriteComplexS1S2(conn)
+	if err != nil {
+		return errors.Wrapf(err, "write complex s1s2")
 	}
-	if err := hs.WriteC2S2(conn, hs.C1S1()); err != nil {
-		return errors.Wrapf(err, "write s2")
+	if !complexHandshake {
+		if err := hs.WriteC1S1(conn); err != nil {
+			return errors.Wrapf(err, "write s1")
+		}
+		if err := hs.WriteC2S2(conn, hs.C1S1()); err != nil {
+			return errors.Wrapf(err, "write s2")
+		}
 	}
 	if _, err := hs.ReadC2S2(conn); err != nil {
 		return errors.Wrapf(err, "read c2")
 	}
 
 	client := rtmp.NewProtocol(conn)
-	logger.Df(ctx, "RTMP simple handshake done")
+	if complexHandshake {
+		logger.Df(ctx, "RTMP complex handshake done")
+	} else {
+		logger.Df(ctx, "RTMP simple handshake done")
+	}
 
 	// Expect RTMP connect command with tcUrl.
 	var connectReq *rtmp.ConnectAppPacket
@@ -288,61 +427,139 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 	logger.Df(ctx, "RTMP identify tcUrl=%v, stream=%v, id=%v, type=%v",
 		tcUrl, streamName, currentStreamID, clientType)
 
+	streamURL, err := utils.BuildStreamURL(fmt.Sprintf("%v/%v", tcUrl, streamName))
+	if err != nil {
+		return errors.Wrapf(err, "build stream url %v/%v", tcUrl, streamName)
+	}
+
+	// Deny or route the client by policy, the throttle rules of RTMP are rejected when loading policy.
+	operation := policy.OperationPlay
+	if clientType == RTMPClientTypePublisher {
+		operation = policy.OperationPublish
+	}
+	if ctx, _, err = applyPolicy(ctx, "rtmp", operation, streamURL, conn.RemoteAddr().String(), nil); err != nil {
+		return errors.Wrapf(err, "apply policy")
+	}
+
+	// Verify the secret of client in the query of stream name, like livestream?secret=xxx.
+	authClient := &auth.Client{
+		Action: auth.ActionPlay, Protocol: "rtmp", StreamURL: streamURL, RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if clientType == RTMPClientTypePublisher {
+		authClient.Action = auth.ActionPublish
+	}
+	if index := strings.Index(streamName, "?"); index >= 0 {
+		authClient.Param = streamName[index:]
+	}
+	if err := auth.SrsAuthenticator.Authenticate(ctx, authClient); err != nil {
+		return errors.Wrapf(err, "authenticate")
+	}
+	ctx = logger.WithLabels(ctx, authClient.Labels)
+
+	// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+	if ctx, _, err = applySelector(ctx, authClient.Param); err != nil {
+		return errors.Wrapf(err, "apply selector")
+	}
+
+	// Keep the picked server by the affinity of publishers or players, which might be sticky by client.
+	ctx = lb.WithClient(ctx, conn.RemoteAddr().String())
+	// Prefer the servers in the region of client, by the geolocation of client.
+	ctx = lb.WithClientRegions(ctx, conn.RemoteAddr().String(), nil)
+
+	// Register the session, which is closed by cancelling the context when kicked.
+	stats := newRTMPStats()
+	clientSession := session.SrsSessionManager.Add(ctx, "rtmp", streamURL, conn.RemoteAddr().String(), cancel,
+		session.WithRole(string(clientType)), session.WithStats(stats),
+		session.WithAnnotations(authClient.Annotations), session.WithLabels(authClient.Labels))
+	defer session.SrsSessionManager.Remove(clientSession)
+
+	// Reject the viewer if the token is revoked for restreaming, by the token in the query of stream name.
+	if clientType == RTMPClientTypeViewer {
+		query, err := url.ParseQuery(strings.TrimPrefix(authClient.Param, "?"))
+		if err != nil {
+			return errors.Wrapf(err, "parse query %v", authClient.Param)
+		}
+
+		if err := restream.SrsDetector.Check(ctx, &restream.Client{
+			StreamURL: streamURL, RemoteAddr: conn.RemoteAddr().String(), Query: query, Session: clientSession,
+		}); err != nil {
+			clientSession.SetCloseReason(session.CloseAuthFailed)
+			return errors.Wrapf(err, "check restreaming")
+		}
+	}
+
+	// Redirect the client to the proxy which owns the stream, by the hash of stream URL.
+	if owner := srsStreamSharding.Redirect(streamURL, false); owner != nil {
+		if err := redirectRTMP(ctx, client, owner, tcUrl, streamName, currentStreamID); err != nil {
+			return errors.Wrapf(err, "redirect to shard owner %v", owner.IP)
+		}
+		clientSession.SetCloseReason(session.CloseRedirected)
+		return nil
+	}
+
+	// Redirect the client to the picked backend, so the proxy is not in the data path.
+	if v.redirect {
+		pick := lb.SrsLoadBalancer.PickForPlay
+		if clientType == RTMPClientTypePublisher {
+			pick = lb.SrsLoadBalancer.PickForPublish
+		}
+
+		picked, err := pick(ctx, streamURL)
+		if err != nil {
+			v.rejectStream(ctx, client, clientType, currentStreamID, err)
+			return errors.Wrapf(err, "pick backend for %v", streamURL)
+		}
+
+		if err := redirectRTMP(ctx, client, picked, tcUrl, streamName, currentStreamID); err != nil {
+			return errors.Wrapf(err, "redirect to %v", picked)
+		}
+		clientSession.SetCloseReason(session.CloseRedirected)
+		return nil
+	}
+
+	// Serve the viewer by the edge stream, which is pulled once from backend for all local viewers.
+	if clientType == RTMPClientTypeViewer && v.edge {
+		return v.serveEdgeViewer(parentCtx, ctx, cancel, client, clientSession, stats, streamURL, currentStreamID)
+	}
+
+	// Keep the backend alive after publisher disconnected, to splice in the reconnected publisher.
+	if clientType == RTMPClientTypePublisher && v.publishGrace > 0 && v.publishers != nil {
+		return v.servePublisher(
+			parentCtx, ctx, client, clientSession, stats, tcUrl, streamName, streamURL, currentStreamID,
+		)
+	}
+
 	// Find a backend SRS server to proxy the RTMP stream.
 	backend = NewRTMPClientToBackend(func(client *RTMPClientToBackend) {
-		client.typ = clientType
+		client.typ, client.idleTimeout = clientType, v.backendIdleTimeout
 	})
 	defer backend.Close()
 
 	if err := backend.Connect(ctx, tcUrl, streamName); err != nil {
+		v.rejectStream(ctx, client, clientType, currentStreamID, err)
 		return errors.Wrapf(err, "connect backend, tcUrl=%v, stream=%v", tcUrl, streamName)
 	}
 
 	// Start the streaming.
 	if clientType == RTMPClientTypePublisher {
-		identifyRes := rtmp.NewCallPacket()
-
-		identifyRes.CommandName = "onStatus"
-		identifyRes.CommandObject = rtmp.NewAmf0Null()
-
-		data := rtmp.NewAmf0Object()
-		data.Set("level", rtmp.NewAmf0String("status"))
-		data.Set("code", rtmp.NewAmf0String("NetStream.Publish.Start"))
-		data.Set("description", rtmp.NewAmf0String("Started publishing stream."))
-		data.Set("clientid", rtmp.NewAmf0String("ASAICiss"))
-		identifyRes.Args = data
-
-		if err := client.WritePacket(ctx, identifyRes, currentStreamID); err != nil {
+		if err := v.startPublish(ctx, client, currentStreamID); err != nil {
 			return errors.Wrapf(err, "start publish")
 		}
 	} else if clientType == RTMPClientTypeViewer {
-		identifyRes := rtmp.NewCallPacket()
-
-		identifyRes.CommandName = "onStatus"
-		identifyRes.CommandObject = rtmp.NewAmf0Null()
-
-		data := rtmp.NewAmf0Object()
-		data.Set("level", rtmp.NewAmf0String("status"))
-		data.Set("code", rtmp.NewAmf0String("NetStream.Play.Start"))
-		data.Set("description", rtmp.NewAmf0String("Started playing stream."))
-		data.Set("details", rtmp.NewAmf0String("stream"))
-		data.Set("clientid", rtmp.NewAmf0String("ASAICiss"))
-		identifyRes.Args = data
-
-		if err := client.WritePacket(ctx, identifyRes, currentStreamID); err != nil {
+		if err := v.startPlay(ctx, client, currentStreamID); err != nil {
 			return errors.Wrapf(err, "start play")
 		}
 	}
 	logger.Df(ctx, "RTMP start streaming")
 
 	// For all proxy goroutines.
-	var wg sync.WaitGroup
+	var wg stdSync.WaitGroup
 	defer wg.Wait()
 
 	// Proxy all message from backend to client.
 	wg.Add(1)
 	var r0 error
-	go func() {
+	go debug.DoWithProfileLabels(ctx, "rtmp", streamURL, func(ctx context.Context) {
 		defer wg.Done()
 		defer cancel()
 
@@ -353,19 +570,23 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 					return errors.Wrapf(err, "read message")
 				}
 				//logger.Df(ctx, "client<- %v %v %vB", m.MessageType, m.Timestamp, len(m.Payload))
+				stats.onBackendMessage(ctx, m)
 
 				// TODO: Update the stream ID if not the same.
 				if err := client.WriteMessage(ctx, m); err != nil {
 					return errors.Wrapf(err, "write message")
 				}
+				alarm.SrsUsageMonitor.AddBytes(len(m.Payload))
 			}
 		}()
-	}()
+		// The first goroutine quit is the cause of close, the other is cancelled.
+		clientSession.SetCloseReason(session.CloseReasonOf(r0, session.CloseBackendClosed))
+	})
 
 	// Proxy all messages from client to backend.
 	wg.Add(1)
 	var r1 error
-	go func() {
+	go debug.DoWithProfileLabels(ctx, "rtmp", streamURL, func(ctx context.Context) {
 		defer wg.Done()
 		defer cancel()
 
@@ -376,14 +597,20 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 					return errors.Wrapf(err, "read message")
 				}
 				//logger.Df(ctx, "client-> %v %v %vB", m.MessageType, m.Timestamp, len(m.Payload))
+				stats.onClientMessage(ctx, m)
 
 				// TODO: Update the stream ID if not the same.
 				if err := backend.client.WriteMessage(ctx, m); err != nil {
 					return errors.Wrapf(err, "write message")
 				}
+				alarm.SrsUsageMonitor.AddBytes(len(m.Payload))
+				if clientType == RTMPClientTypePublisher {
+					lb.SrsServerBandwidth.AddBytes(streamURL, len(m.Payload))
+				}
 			}
 		}()
-	}()
+		clientSession.SetCloseReason(session.CloseReasonOf(r1, session.CloseClientClosed))
+	})
 
 	// Wait until all goroutine quit.
 	wg.Wait()
@@ -409,6 +636,302 @@ func (v *RTMPConnection) serve(ctx context.Context, conn *net.TCPConn) error {
 	return parentCtx.Err()
 }
 
+// startPublish responses the publisher with NetStream.Publish.Start, to start publishing.
+func (v *RTMPConnection) startPublish(ctx context.Context, client *rtmp.Protocol, currentStreamID int) error {
+	identifyRes := rtmp.NewCallPacket()
+
+	identifyRes.CommandName = "onStatus"
+	identifyRes.CommandObject = rtmp.NewAmf0Null()
+
+	data := rtmp.NewAmf0Object()
+	data.Set("level", rtmp.NewAmf0String("status"))
+	data.Set("code", rtmp.NewAmf0String("NetStream.Publish.Start"))
+	data.Set("description", rtmp.NewAmf0String("Started publishing stream."))
+	data.Set("clientid", rtmp.NewAmf0String("ASAICiss"))
+	identifyRes.Args = data
+
+	return client.WritePacket(ctx, identifyRes, currentStreamID)
+}
+
+// startPlay responses the viewer with NetStream.Play.Start, to start playing.
+func (v *RTMPConnection) startPlay(ctx context.Context, client *rtmp.Protocol, currentStreamID int) error {
+	identifyRes := rtmp.NewCallPacket()
+
+	identifyRes.CommandName = "onStatus"
+	identifyRes.CommandObject = rtmp.NewAmf0Null()
+
+	data := rtmp.NewAmf0Object()
+	data.Set("level", rtmp.NewAmf0String("status"))
+	data.Set("code", rtmp.NewAmf0String("NetStream.Play.Start"))
+	data.Set("description", rtmp.NewAmf0String("Started playing stream."))
+	data.Set("details", rtmp.NewAmf0String("stream"))
+	data.Set("clientid", rtmp.NewAmf0String("ASAICiss"))
+	identifyRes.Args = data
+
+	if err := client.WritePacket(ctx, identifyRes, currentStreamID); err != nil {
+		return errors.Wrapf(err, "write play start")
+	}
+	return nil
+}
+
+// rejectStream responses the client with an error onStatus, when all backend servers are full, so the
+// client knows the stream is rejected, rather than a closed connection. Ignore other errors.
+func (v *RTMPConnection) rejectStream(
+	ctx context.Context, client *rtmp.Protocol, clientType RTMPClientType, currentStreamID int, err error,
+) {
+	if errors.Cause(err) != lb.ErrClusterFull {
+		return
+	}
+
+	code := "NetStream.Play.Failed"
+	if clientType == RTMPClientTypePublisher {
+		code = "NetStream.Publish.Rejected"
+	}
+
+	identifyRes := rtmp.NewCallPacket()
+
+	identifyRes.CommandName = "onStatus"
+	identifyRes.CommandObject = rtmp.NewAmf0Null()
+
+	data := rtmp.NewAmf0Object()
+	data.Set("level", rtmp.NewAmf0String("error"))
+	data.Set("code", rtmp.NewAmf0String(code))
+	data.Set("description", rtmp.NewAmf0String("Cluster full."))
+	identifyRes.Args = data
+
+	if err := client.WritePacket(ctx, identifyRes, currentStreamID); err != nil {
+		logger.Wf(ctx, "RTMP reject %v failed, err %+v", code, err)
+		return
+	}
+	logger.Wf(ctx, "RTMP reject %v, cluster full", code)
+}
+
+// servePublisher proxies the publisher to a backend session, which is parked in the grace window when
+// publisher disconnects, and spliced in when the publisher reconnects, so the backend stream and all
+// players are not torn down by a network blip of publisher. The sessionCtx is the context to keep the
+// backend session, while ctx is cancelled when the client connection is closed.
+func (v *RTMPConnection) servePublisher(
+	sessionCtx, ctx context.Context, client *rtmp.Protocol, clientSession *session.Session, stats *rtmpStats,
+	tcUrl, streamName, streamURL string, currentStreamID int,
+) error {
+	// Take the parked session in grace window, or connect to a new backend.
+	publishing, ok := v.publishers.LoadAndDelete(streamURL)
+	if ok && publishing.take() {
+		logger.Df(ctx, "RTMP splice publisher into parked backend of %v", streamURL)
+	} else {
+		backend := NewRTMPClientToBackend(func(client *RTMPClientToBackend) {
+			client.typ, client.idleTimeout = RTMPClientTypePublisher, v.backendIdleTimeout
+		})
+		if err := backend.Connect(ctx, tcUrl, streamName); err != nil {
+			backend.Close()
+			v.rejectStream(ctx, client, RTMPClientTypePublisher, currentStreamID, err)
+			return errors.Wrapf(err, "connect backend, tcUrl=%v, stream=%v", tcUrl, streamName)
+		}
+
+		publishing = newRTMPPublishSession(streamURL, backend, v.publishGrace, v.publishers)
+		publishing.take()
+		go debug.DoWithProfileLabels(sessionCtx, "rtmp", streamURL, publishing.run)
+	}
+
+	if err := v.startPublish(ctx, client, currentStreamID); err != nil {
+		publishing.detach(ctx)
+		return errors.Wrapf(err, "start publish")
+	}
+	publishing.attach(client)
+	logger.Df(ctx, "RTMP start streaming")
+
+	// Proxy all messages from client to backend, until client or backend quit.
+	var r0 error
+	debug.DoWithProfileLabels(ctx, "rtmp", streamURL, func(ctx context.Context) {
+		r0 = func() error {
+			for {
+				m, err := client.ReadMessage(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "read message")
+				}
+				stats.onClientMessage(ctx, m)
+
+				if err := publishing.write(ctx, m); err != nil {
+					return errors.Wrapf(err, "write message")
+				}
+			}
+		}()
+	})
+
+	// Park the backend session if client quit, and the backend is still alive. If the session is kicked,
+	// for example, to re-pick the backend, close the backend session.
+	if clientSession.Kicked() {
+		publishing.Close()
+	} else {
+		publishing.detach(ctx)
+	}
+
+	clientSession.SetCloseReason(session.CloseReasonOf(r0, session.CloseClientClosed))
+	if utils.IsClosedNetworkError(r0) || utils.IsPeerClosedError(r0) {
+		logger.Df(ctx, "RTMP client disconnected")
+		return nil
+	}
+	return errors.Wrapf(r0, "proxy client->backend")
+}
+
+// rtmpPublishSession is the session of publisher to backend, which outlives the publisher connection in
+// the grace window, so the reconnected publisher is spliced into the same backend stream.
+type rtmpPublishSession struct {
+	// The stream URL in vhost/app/stream schema.
+	streamURL string
+	// The backend publishing connection.
+	backend *RTMPClientToBackend
+	// The grace window to keep the session after publisher disconnected.
+	grace time.Duration
+	// The parked sessions, to remove this session when expired.
+	publishers *sync.Map[string, *rtmpPublishSession]
+
+	// The lock to protect the fields below.
+	lock stdSync.Mutex
+	// The attached publisher, nil if not attached.
+	client *rtmp.Protocol
+	// Whether the session is taken by a publisher.
+	taken bool
+	// Whether the session is closed.
+	closed bool
+	// The generation of parking, to ignore the stale expiration.
+	generation int
+	// The offset added to the timestamp of publisher, to keep the timestamp monotonic when spliced.
+	offset uint64
+	// The last timestamp written to backend.
+	lastTimestamp uint64
+	// Closed when the session is closed.
+	done chan struct{}
+}
+
+func newRTMPPublishSession(
+	streamURL string, backend *RTMPClientToBackend, grace time.Duration,
+	publishers *sync.Map[string, *rtmpPublishSession],
+) *rtmpPublishSession {
+	return &rtmpPublishSession{
+		streamURL: streamURL, backend: backend, grace: grace, publishers: publishers,
+		done: make(chan struct{}),
+	}
+}
+
+// take marks the session is taken by a publisher, returns false if the session is closed.
+func (v *rtmpPublishSession) take() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return false
+	}
+
+	v.taken = true
+	v.generation++
+
+	// The timestamp of reconnected publisher starts from zero, so we continue from the last one.
+	v.offset = v.lastTimestamp
+	return true
+}
+
+// attach the publisher to the session, to receive the messages from backend.
+func (v *rtmpPublishSession) attach(client *rtmp.Protocol) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.client = client
+}
+
+// detach the publisher, and park the session in grace window, then close it if not taken again.
+func (v *rtmpPublishSession) detach(ctx context.Context) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.client, v.taken = nil, false
+	if v.closed {
+		return
+	}
+
+	v.generation++
+	generation := v.generation
+	v.publishers.Store(v.streamURL, v)
+	logger.Df(ctx, "RTMP park backend of %v for %v", v.streamURL, v.grace)
+
+	time.AfterFunc(v.grace, func() {
+		v.lock.Lock()
+		expired := !v.taken && !v.closed && generation == v.generation
+		v.lock.Unlock()
+
+		if expired {
+			logger.Df(ctx, "RTMP parked backend of %v expired", v.streamURL)
+			v.Close()
+		}
+	})
+}
+
+// write the message of publisher to backend, with the timestamp spliced.
+func (v *rtmpPublishSession) write(ctx context.Context, m *rtmp.Message) error {
+	switch m.MessageType {
+	case rtmp.MessageTypeAudio, rtmp.MessageTypeVideo, rtmp.MessageTypeAMF0Data, rtmp.MessageTypeAMF3Data:
+		v.lock.Lock()
+		m.Timestamp += v.offset
+		if m.Timestamp > v.lastTimestamp {
+			v.lastTimestamp = m.Timestamp
+		}
+		v.lock.Unlock()
+	}
+
+	alarm.SrsUsageMonitor.AddBytes(len(m.Payload))
+	lb.SrsServerBandwidth.AddBytes(v.streamURL, len(m.Payload))
+	return v.backend.client.WriteMessage(ctx, m)
+}
+
+// run proxies the messages from backend to the attached publisher, until backend quit.
+func (v *rtmpPublishSession) run(ctx context.Context) {
+	defer v.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			v.Close()
+		case <-v.done:
+		}
+	}()
+
+	for {
+		m, err := v.backend.client.ReadMessage(ctx)
+		if err != nil {
+			logger.Df(ctx, "RTMP backend of %v done, %v", v.streamURL, err)
+			return
+		}
+
+		v.lock.Lock()
+		client := v.client
+		v.lock.Unlock()
+
+		// Drop the messages when parked, for example, the acknowledgement.
+		if client != nil {
+			if err := client.WriteMessage(ctx, m); err != nil {
+				logger.Wf(ctx, "RTMP write to publisher of %v failed, %v", v.streamURL, err)
+			}
+			alarm.SrsUsageMonitor.AddBytes(len(m.Payload))
+		}
+	}
+}
+
+// Close the backend session, and remove it from parked sessions.
+func (v *rtmpPublishSession) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	close(v.done)
+
+	if actual, ok := v.publishers.Load(v.streamURL); ok && actual == v {
+		v.publishers.Delete(v.streamURL)
+	}
+	return v.backend.Close()
+}
+
 type RTMPClientType string
 
 const (
@@ -424,6 +947,10 @@ type RTMPClientToBackend struct {
 	client *rtmp.Protocol
 	// The stream type.
 	typ RTMPClientType
+	// The idle timeout of connection, 0 to disable.
+	idleTimeout time.Duration
+	// Release the session of backend server, for least-connections strategy.
+	release func()
 }
 
 func NewRTMPClientToBackend(opts ...func(*RTMPClientToBackend)) *RTMPClientToBackend {
@@ -438,22 +965,37 @@ func (v *RTMPClientToBackend) Close() error {
 	if v.tcpConn != nil {
 		v.tcpConn.Close()
 	}
+	if v.release != nil {
+		v.release()
+	}
 	return nil
 }
 
-func (v *RTMPClientToBackend) Connect(ctx context.Context, tcUrl, streamName string) error {
+func (v *RTMPClientToBackend) Connect(ctx context.Context, tcUrl, streamName string) (err error) {
 	// Build the stream URL in vhost/app/stream schema.
 	streamURL, err := utils.BuildStreamURL(fmt.Sprintf("%v/%v", tcUrl, streamName))
 	if err != nil {
 		return errors.Wrapf(err, "build stream url %v/%v", tcUrl, streamName)
 	}
 
-	// Pick a backend SRS server to proxy the RTMP stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	// Pick a backend SRS server to proxy the RTMP stream, by the strategy of publishers or players.
+	pick := lb.SrsLoadBalancer.PickForPlay
+	if v.typ == RTMPClientTypePublisher {
+		pick = lb.SrsLoadBalancer.PickForPublish
+	}
+	backend, err := srsStreamSharding.pick(ctx, streamURL, pick)
 	if err != nil {
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
 
+	v.release = lb.SrsServerConnections.Acquire(backend)
+
+	// Report the result of connecting to backend, to remove the failing backend by circuit breaker.
+	starttime := time.Now()
+	defer func() {
+		lb.ReportBackend(ctx, streamURL, backend, time.Since(starttime), err)
+	}()
+
 	// Parse RTMP port from backend.
 	if len(backend.RTMP) == 0 {
 		return errors.Errorf("no rtmp server %+v for %v", backend, streamURL)
@@ -466,38 +1008,50 @@ func (v *RTMPClientToBackend) Connect(ctx context.Context, tcUrl, streamName str
 		rtmpPort = int(iv)
 	}
 
-	// Connect to backend SRS server via TCP client.
-	addr := &net.TCPAddr{IP: net.ParseIP(backend.IP), Port: rtmpPort}
+	// Connect to backend SRS server via TCP client, by the IP of backend hostname.
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: rtmpPort}
 	c, err := net.DialTCP("tcp", nil, addr)
 	if err != nil {
 		return errors.Wrapf(err, "dial backend addr=%v, srs=%v", addr, backend)
 	}
 	v.tcpConn = c
 
+	// Close the idle backend, for example, the stalled backend which never responds.
+	conn := newIdleConn(c, v.idleTimeout)
+
+	// Connect to backend by rtmps, when the proxy and backend traverse untrusted networks.
+	if conn, err = lb.SrsServerTLS.Client(ctx, lb.BackendProtocolRTMP, conn); err != nil {
+		return errors.Wrapf(err, "tls to backend addr=%v, srs=%v", addr, backend)
+	}
+
 	hs := rtmp.NewHandshake()
-	client := rtmp.NewProtocol(c)
+	client := rtmp.NewProtocol(conn)
 	v.client = client
 
 	// Simple RTMP handshake with server.
-	if err := hs.WriteC0S0(c); err != nil {
+	if err := hs.WriteC0S0(conn); err != nil {
 		return errors.Wrapf(err, "write c0")
 	}
-	if err := hs.WriteC1S1(c); err != nil {
+	if err := hs.WriteC1S1(conn); err != nil {
 		return errors.Wrapf(err, "write c1")
 	}
 
-	if _, err = hs.ReadC0S0(c); err != nil {
+	if _, err = hs.ReadC0S0(conn); err != nil {
 		return errors.Wrapf(err, "read s0")
 	}
-	if _, err := hs.ReadC1S1(c); err != nil {
+	if _, err := hs.ReadC1S1(conn); err != nil {
 		return errors.Wrapf(err, "read s1")
 	}
-	if _, err = hs.ReadC2S2(c); err != nil {
+	if _, err = hs.ReadC2S2(conn); err != nil {
 		return errors.Wrapf(err, "read c2")
 	}
 	logger.Df(ctx, "backend simple handshake done, server=%v", addr)
 
-	if err := hs.WriteC2S2(c, hs.C1S1()); err != nil {
+	if err := hs.WriteC2S2(conn, hs.C1S1()); err != nil {
 		return errors.Wrapf(err, "write c2")
 	}
 
@@ -658,3 +1212,207 @@ func (v *RTMPClientToBackend) play(ctx context.Context, client *rtmp.Protocol, s
 	}
 	return nil
 }
+
+// rtmpDirectionStats is the stats of RTMP messages in one direction.
+type rtmpDirectionStats struct {
+	// The bytes of message payload.
+	bytes uint64
+	// The number of messages.
+	messages uint64
+
+	// The bitrate of message payload, sampled by the bitrate sampler.
+	meter bitrateMeter
+}
+
+// kbps returns the bitrate in kbps, without any side effect.
+func (v *rtmpDirectionStats) kbps(now time.Time, createdAt time.Time) float64 {
+	return v.meter.bitrate(v.bytes, now, createdAt) / 1000
+}
+
+// rtmpStats is the stats of a RTMP session measured by proxy, from the RTMP messages demuxed from chunks,
+// where the recv is from client and the send is to client. The metadata and codecs are parsed from the
+// media messages, which are from the publisher, or to the viewer.
+type rtmpStats struct {
+	// The time created.
+	createdAt time.Time
+	// The messages from client to backend.
+	recv rtmpDirectionStats
+	// The messages from backend to client.
+	send rtmpDirectionStats
+	// The onMetaData of stream, nil if not received.
+	metadata *rtmp.Metadata
+	// The codecs parsed from the media messages.
+	videoCodec, audioCodec string
+	// The number of video and audio frames, excluding the sequence headers.
+	videoFrames, audioFrames uint64
+	// The number of video keyframes.
+	keyframes uint64
+	// The lock to protect all fields.
+	lock stdSync.Mutex
+}
+
+func newRTMPStats() *rtmpStats {
+	return &rtmpStats{createdAt: time.Now()}
+}
+
+// onClientMessage updates the stats by a message from client to backend.
+func (v *rtmpStats) onClientMessage(ctx context.Context, m *rtmp.Message) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recv.bytes += uint64(len(m.Payload))
+	v.recv.messages++
+	v.onMedia(ctx, m)
+}
+
+// onBackendMessage updates the stats by a message from backend to client.
+func (v *rtmpStats) onBackendMessage(ctx context.Context, m *rtmp.Message) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.send.bytes += uint64(len(m.Payload))
+	v.send.messages++
+	v.onMedia(ctx, m)
+}
+
+// onMedia parses the metadata, codecs and frames from the media message, which only flows in the direction
+// from publisher or to viewer.
+func (v *rtmpStats) onMedia(ctx context.Context, m *rtmp.Message) {
+	switch m.MessageType {
+	case rtmp.MessageTypeVideo:
+		codec, keyframe, sequenceHeader := rtmp.ParseVideo(m.Payload)
+		if codec != "" {
+			v.videoCodec = codec
+		}
+		if !sequenceHeader {
+			v.videoFrames++
+		}
+		if keyframe {
+			v.keyframes++
+		}
+	case rtmp.MessageTypeAudio:
+		// The AAC sequence header is the AACPacketType 0.
+		if codec := rtmp.ParseAudio(m.Payload); codec != "" {
+			v.audioCodec = codec
+			if codec != "AAC" || len(m.Payload) < 2 || m.Payload[1] != 0 {
+				v.audioFrames++
+			}
+		}
+	case rtmp.MessageTypeAMF0Data, rtmp.MessageTypeAMF3Data:
+		metadata, err := rtmp.ParseMetadata(m)
+		if err != nil {
+			logger.Wf(ctx, "RTMP ignore invalid metadata, %v", err)
+		} else if metadata != nil {
+			v.metadata = metadata
+		}
+	}
+}
+
+// sampleBitrate samples the bitrate from client and to client, by the bitrate sampler.
+func (v *rtmpStats) sampleBitrate(now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recv.meter.sample(v.recv.bytes, now, v.createdAt)
+	v.send.meter.sample(v.send.bytes, now, v.createdAt)
+}
+
+// traffic returns the bytes and bitrate in kbps, from client and to client.
+func (v *rtmpStats) traffic() (bytesIn, bytesOut uint64, kbpsIn, kbpsOut float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	return v.recv.bytes, v.send.bytes, v.recv.kbps(now, v.createdAt), v.send.kbps(now, v.createdAt)
+}
+
+// MarshalJSON marshals the snapshot of stats, with the duration in seconds, and the metadata and codecs of
+// stream.
+func (v *rtmpStats) MarshalJSON() ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	type Direction struct {
+		Bytes    uint64  `json:"bytes"`
+		Messages uint64  `json:"messages"`
+		Kbps     float64 `json:"kbps"`
+	}
+	type Stats struct {
+		Duration    float64        `json:"duration"`
+		Recv        Direction      `json:"recv"`
+		Send        Direction      `json:"send"`
+		VideoCodec  string         `json:"vcodec,omitempty"`
+		AudioCodec  string         `json:"acodec,omitempty"`
+		VideoFrames uint64         `json:"video_frames"`
+		AudioFrames uint64         `json:"audio_frames"`
+		Keyframes   uint64         `json:"keyframes"`
+		Metadata    *rtmp.Metadata `json:"metadata,omitempty"`
+	}
+
+	now := time.Now()
+	return json.Marshal(&Stats{
+		Duration:   now.Sub(v.createdAt).Seconds(),
+		Recv:       Direction{Bytes: v.recv.bytes, Messages: v.recv.messages, Kbps: v.recv.kbps(now, v.createdAt)},
+		Send:       Direction{Bytes: v.send.bytes, Messages: v.send.messages, Kbps: v.send.kbps(now, v.createdAt)},
+		VideoCodec: v.videoCodec, AudioCodec: v.audioCodec,
+		VideoFrames: v.videoFrames, AudioFrames: v.audioFrames, Keyframes: v.keyframes,
+		Metadata: v.metadata,
+	})
+}
+
+// RTMPStreamTraffic is the traffic of a RTMP stream through proxy, of all its RTMP sessions.
+type RTMPStreamTraffic struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The number of publishers and viewers.
+	Publishers int `json:"publishers"`
+	Viewers    int `json:"viewers"`
+	// The bytes from clients and to clients.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// The bitrate in kbps from clients and to clients.
+	KbpsIn  float64 `json:"kbps_in"`
+	KbpsOut float64 `json:"kbps_out"`
+	// The duration in seconds of the longest session.
+	Duration float64 `json:"duration"`
+}
+
+// listRTMPStreamTraffic returns the traffic of RTMP streams, the most bitrate first.
+func listRTMPStreamTraffic() []*RTMPStreamTraffic {
+	now := time.Now()
+	streams := make(map[string]*RTMPStreamTraffic)
+	for _, s := range session.SrsSessionManager.List("") {
+		stats, ok := s.Stats.(*rtmpStats)
+		if s.Protocol != "rtmp" || !ok {
+			continue
+		}
+
+		stream, ok := streams[s.StreamURL]
+		if !ok {
+			stream = &RTMPStreamTraffic{StreamURL: s.StreamURL}
+			streams[s.StreamURL] = stream
+		}
+
+		if s.Role == string(RTMPClientTypePublisher) {
+			stream.Publishers++
+		} else {
+			stream.Viewers++
+		}
+
+		bytesIn, bytesOut, kbpsIn, kbpsOut := stats.traffic()
+		stream.BytesIn, stream.BytesOut = stream.BytesIn+bytesIn, stream.BytesOut+bytesOut
+		stream.KbpsIn, stream.KbpsOut = stream.KbpsIn+kbpsIn, stream.KbpsOut+kbpsOut
+		if duration := now.Sub(s.CreatedAt).Seconds(); duration > stream.Duration {
+			stream.Duration = duration
+		}
+	}
+
+	traffic := []*RTMPStreamTraffic{}
+	for _, stream := range streams {
+		traffic = append(traffic, stream)
+	}
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].KbpsIn+traffic[i].KbpsOut > traffic[j].KbpsIn+traffic[j].KbpsOut
+	})
+	return traffic
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"srsx/internal/event"
+	"srsx/internal/logger"
+	"srsx/internal/sync"
+)
+
+// The duration to deduplicate the same SCTE-35 marker, because the marker is fetched by all viewers, and
+// the playlist with marker is fetched repeatedly.
+const scte35DedupDuration = 60 * time.Second
+
+// The stream type of SCTE-35 in PMT, see SCTE 35 section 8.1.
+const tsStreamTypeSCTE35 = 0x86
+
+// The table id of SCTE-35 splice info section.
+const scte35TableID = 0xfc
+
+// The names of SCTE-35 splice command type.
+var scte35Commands = map[byte]string{
+	0x00: "splice_null",
+	0x04: "splice_schedule",
+	0x05: "splice_insert",
+	0x06: "time_signal",
+	0x07: "bandwidth_reservation",
+	0xff: "private_command",
+}
+
+// isSCTE35Tag returns whether the HLS tag is a SCTE-35 marker in playlist. Note that EXT-X-CUE-OUT-CONT
+// is not a marker, because it repeats in each playlist during the break.
+func isSCTE35Tag(line string) bool {
+	switch {
+	case line == "#EXT-X-CUE-OUT", strings.HasPrefix(line, "#EXT-X-CUE-OUT:"), strings.HasPrefix(line, "#EXT-X-CUE-IN"):
+		return true
+	case strings.HasPrefix(line, "#EXT-X-SCTE35"), strings.HasPrefix(line, "#EXT-OATCLS-SCTE35"):
+		return true
+	case strings.HasPrefix(line, "#EXT-X-DATERANGE:") && strings.Contains(line, "SCTE35"):
+		return true
+	}
+	return false
+}
+
+// scte35Detector detects the SCTE-35 markers in proxied TS and HLS content, and emits the events, for
+// downstream ad insertion systems to key off.
+type scte35Detector struct {
+	// The markers seen, to deduplicate, key is stream URL and hash of marker.
+	seen sync.Map[string, time.Time]
+}
+
+var srsSCTE35 = &scte35Detector{}
+
+// NewScanner creates a TS scanner of stream, which detects the SCTE-35 markers in TS packets written to it.
+func (v *scte35Detector) NewScanner(ctx context.Context, streamURL, source string) *tsScanner {
+	return newTSScanner(func(pid uint16, section []byte) {
+		var command string
+		if len(section) > 13 {
+			if command = scte35Commands[section[13]]; command == "" {
+				command = fmt.Sprintf("0x%02x", section[13])
+			}
+		}
+
+		v.emit(ctx, streamURL, section, map[string]interface{}{
+			"source": source, "pid": pid, "command": command,
+			"section": base64.StdEncoding.EncodeToString(section),
+		})
+	})
+}
+
+// ScanPlaylist detects the SCTE-35 tags in HLS playlist.
+func (v *scte35Detector) ScanPlaylist(ctx context.Context, streamURL, m3u8 string) {
+	for _, line := range strings.Split(m3u8, "\n") {
+		if line = strings.TrimSpace(line); isSCTE35Tag(line) {
+			v.emit(ctx, streamURL, []byte(line), map[string]interface{}{"source": "playlist", "tag": line})
+		}
+	}
+}
+
+// emit the event of marker for stream, if not seen recently.
+func (v *scte35Detector) emit(ctx context.Context, streamURL string, marker []byte, data map[string]interface{}) {
+	hash := sha1.Sum(marker)
+	key := streamURL + "/" + hex.EncodeToString(hash[:])
+
+	now := time.Now()
+	if seen, ok := v.seen.Load(key); ok && now.Sub(seen) < scte35DedupDuration {
+		return
+	}
+	v.seen.Store(key, now)
+
+	// Remove the expired markers.
+	v.seen.Range(func(k string, seen time.Time) bool {
+		if now.Sub(seen) >= scte35DedupDuration {
+			v.seen.Delete(k)
+		}
+		return true
+	})
+
+	logger.Df(ctx, "SCTE-35 marker of %v, %v", streamURL, data)
+	event.SrsEventNotifier.Notify(ctx, &event.Event{
+		Type: "scte35", Time: now, StreamURL: streamURL, Data: data,
+	})
+}
+
+// tsScanner parses the TS packets written to it, and callbacks the SCTE-35 sections. It finds the PIDs of
+// SCTE-35 by PAT and PMT. Note that the section across multiple TS packets is ignored, because the PAT, PMT
+// and SCTE-35 sections are small and always in one packet in practice.
+type tsScanner struct {
+	// The bytes of partial TS packet.
+	pending []byte
+	// The PIDs of PMT.
+	pmtPIDs map[uint16]bool
+	// The PIDs of SCTE-35.
+	scte35PIDs map[uint16]bool
+	// The callback for SCTE-35 section.
+	onSection func(pid uint16, section []byte)
+}
+
+func newTSScanner(onSection func(pid uint16, section []byte)) *tsScanner {
+	return &tsScanner{
+		pmtPIDs: make(map[uint16]bool), scte35PIDs: make(map[uint16]bool), onSection: onSection,
+	}
+}
+
+// Write the TS stream, never fails so it's safe to be used by io.TeeReader.
+func (v *tsScanner) Write(p []byte) (int, error) {
+	b := append(v.pending, p...)
+	for len(b) >= 188 {
+		// Resync to the sync byte of TS packet.
+		if b[0] != 0x47 {
+			if i := bytes.IndexByte(b, 0x47); i > 0 {
+				b = b[i:]
+				continue
+			}
+			b = nil
+			break
+		}
+
+		v.parsePacket(b[:188])
+		b = b[188:]
+	}
+
+	v.pending = append(v.pending[:0], b...)
+	return len(p), nil
+}
+
+func (v *tsScanner) parsePacket(b []byte) {
+	pusi := b[1]&0x40 != 0
+	pid := uint16(b[1]&0x1f)<<8 | uint16(b[2])
+	afc := (b[3] >> 4) & 0x03
+	if !pusi || afc&0x01 == 0 {
+		return
+	}
+	if pid != 0 && !v.pmtPIDs[pid] && !v.scte35PIDs[pid] {
+		return
+	}
+
+	// Skip the adaptation field, and the pointer field of section.
+	payload := b[4:]
+	if afc&0x02 != 0 {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if len(payload) < 1 || len(payload) < 1+int(payload[0])+3 {
+		return
+	}
+	section := payload[1+int(payload[0]):]
+
+	sectionLength := int(section[1]&0x0f)<<8 | int(section[2])
+	if len(section) < 3+sectionLength {
+		return
+	}
+	section = section[:3+sectionLength]
+
+	switch {
+	case pid == 0 && section[0] == 0x00 && len(section) >= 12:
+		// The programs of PAT, each is program_number(16) and PMT PID(13), excludes the CRC32.
+		for p := section[8 : len(section)-4]; len(p) >= 4; p = p[4:] {
+			if program := uint16(p[0])<<8 | uint16(p[1]); program != 0 {
+				v.pmtPIDs[uint16(p[2]&0x1f)<<8|uint16(p[3])] = true
+			}
+		}
+	case v.pmtPIDs[pid] && section[0] == 0x02 && len(section) >= 12:
+		// The streams of PMT, each is stream_type(8), PID(13) and ES info, excludes the CRC32.
+		programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+		if len(section) < 12+programInfoLength+4 {
+			return
+		}
+		for p := section[12+programInfoLength : len(section)-4]; len(p) >= 5; {
+			esInfoLength := int(p[3]&0x0f)<<8 | int(p[4])
+			if p[0] == tsStreamTypeSCTE35 {
+				v.scte35PIDs[uint16(p[1]&0x1f)<<8|uint16(p[2])] = true
+			}
+			if len(p) < 5+esInfoLength {
+				break
+			}
+			p = p[5+esInfoLength:]
+		}
+	case v.scte35PIDs[pid] && section[0] == scte35TableID:
+		v.onSection(pid, append([]byte(nil), section...))
+	}
+}
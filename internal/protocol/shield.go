@@ -0,0 +1,141 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+)
+
+// The timeout to fetch a collapsed request from backend, which is not cancelled by any single client.
+const collapsedRequestTimeout = 10 * time.Second
+
+// collapsedCall is an in-flight request to backend, shared by the concurrent requests of the same URL.
+type collapsedCall struct {
+	// Closed when the response is ready.
+	done chan struct{}
+	// The response without body, and the body read from backend.
+	resp *http.Response
+	body []byte
+	// The error of request.
+	err error
+}
+
+// originShield makes the proxy an origin shield of a commercial CDN, which verifies the requests signed
+// by CDN with the shared secret header, applies separate rate limit for CDN and direct traffic, and
+// collapses the concurrent HLS requests of CDN edges to one backend request.
+type originShield struct {
+	// The header of shared secret, set by CDN.
+	header string
+	// The shared secret with CDN.
+	secret string
+	// Whether reject the direct requests, not signed by CDN.
+	cdnOnly bool
+	// The quota of CDN requests, while the direct requests use the HTTP quota.
+	quota *httpQuota
+
+	// The in-flight requests to backend, key is the URL.
+	calls map[string]*collapsedCall
+	// The lock to protect calls.
+	lock stdSync.Mutex
+}
+
+func newOriginShield(header, secret string, cdnOnly bool, quota *httpQuota) *originShield {
+	return &originShield{
+		header: header, secret: secret, cdnOnly: cdnOnly, quota: quota,
+		calls: make(map[string]*collapsedCall),
+	}
+}
+
+// verify the request is signed by CDN, returns error if the signature is invalid, or the direct request
+// is rejected.
+func (v *originShield) verify(r *http.Request) (fromCDN bool, err error) {
+	signature := r.Header.Get(v.header)
+	if signature == "" {
+		if v.cdnOnly {
+			return false, errors.Errorf("no cdn signature header %v", v.header)
+		}
+		return false, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(v.secret)) != 1 {
+		return false, errors.Errorf("invalid cdn signature header %v", v.header)
+	}
+	return true, nil
+}
+
+// Do the GET request to backend, and the concurrent requests of the same URL share the response. The
+// caller should close the body of response.
+func (v *originShield) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+
+	v.lock.Lock()
+	call, ok := v.calls[key]
+	if !ok {
+		call = &collapsedCall{done: make(chan struct{})}
+		v.calls[key] = call
+	}
+	v.lock.Unlock()
+
+	// The first request fetches from backend, for all concurrent requests.
+	if !ok {
+		go func() {
+			defer close(call.done)
+			call.resp, call.body, call.err = v.fetch(key)
+
+			v.lock.Lock()
+			delete(v.calls, key)
+			v.lock.Unlock()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	resp := *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(call.body))
+	return &resp, nil
+}
+
+// fetch the URL from backend, and read all the body.
+func (v *originShield) fetch(url string) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), collapsedRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "create request to %v", url)
+	}
+
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "request %v", url)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read %v", url)
+	}
+	return resp, body, nil
+}
+
+// srsOriginShield is the origin shield of CDN, nil if disabled.
+var srsOriginShield *originShield
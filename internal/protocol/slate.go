@@ -0,0 +1,356 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"srsx/internal/alarm"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/rtmp"
+)
+
+// The prefix of HLS slate segments, to distinguish from the segments of backend.
+const slateSegmentPrefix = "srs-proxy-slate-"
+
+// slate is the filler stream served to viewers, when the backend of stream dies and cannot be failed
+// over, to keep the players connected until the stream recovers.
+type slate struct {
+	// The tags of FLV slate, for HTTP-FLV viewers, nil if disabled.
+	flv []*flvTag
+	// The TS segment of HLS slate, for HLS viewers, nil if disabled.
+	ts []byte
+	// The duration of TS segment.
+	tsDuration time.Duration
+	// The max duration to serve slate for a stream, after the stream was live.
+	maxDuration time.Duration
+}
+
+// The slate, nil if disabled. It's global because the HLS stream is created by load balancer.
+var srsSlate *slate
+
+// newSlate loads the FLV file for HTTP-FLV, and the TS file for HLS, which is optional if empty.
+func newSlate(flvFile, tsFile string, tsDuration, maxDuration time.Duration) (*slate, error) {
+	v := &slate{tsDuration: tsDuration, maxDuration: maxDuration}
+
+	if flvFile != "" {
+		b, err := ioutil.ReadFile(flvFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %v", flvFile)
+		}
+
+		r := bytes.NewReader(b)
+		if err := readFLVHeader(r); err != nil {
+			return nil, errors.Wrapf(err, "read header of %v", flvFile)
+		}
+		for {
+			tag, err := readFLVTag(r)
+			if err != nil {
+				break
+			}
+			v.flv = append(v.flv, tag)
+		}
+		if len(v.flv) == 0 {
+			return nil, errors.Errorf("no tags in %v", flvFile)
+		}
+	}
+
+	if tsFile != "" {
+		b, err := ioutil.ReadFile(tsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %v", tsFile)
+		}
+		v.ts = b
+	}
+
+	return v, nil
+}
+
+// Play the FLV slate once to splicer in realtime, until ctx is done.
+func (v *slate) Play(ctx context.Context, splicer *flvSplicer) error {
+	splicer.Splice()
+
+	starttime, base := time.Now(), v.flv[0].Timestamp
+	for _, tag := range v.flv {
+		if wait := time.Duration(tag.Timestamp-base)*time.Millisecond - time.Since(starttime); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		if err := splicer.Write(tag); err != nil {
+			return errors.Wrapf(err, "write slate")
+		}
+	}
+	return nil
+}
+
+// ServeHLS serves the HLS slate of stream with spbhid, for the playlist or segment in r.
+func (v *slate) ServeHLS(ctx context.Context, w http.ResponseWriter, r *http.Request, spbhid string) error {
+	if strings.HasSuffix(r.URL.Path, ".ts") {
+		w.Header().Set("Content-Type", "video/mp2t")
+		n, err := w.Write(v.ts)
+		alarm.SrsUsageMonitor.AddBytes(n)
+		if err != nil {
+			return errors.Wrapf(err, "write slate")
+		}
+		return nil
+	}
+
+	// The media sequence increases by time, so the player keeps requesting the playlist as a live stream,
+	// and the discontinuity is required because the slate is not continuous to the stream.
+	sequence := time.Now().UnixNano() / int64(v.tsDuration)
+	seconds := v.tsDuration.Seconds()
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%v\n", int(math.Ceil(seconds))))
+	sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%v\n", sequence))
+	for i := int64(0); i < 3; i++ {
+		sb.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY\n#EXTINF:%.3f,\n", seconds))
+		sb.WriteString(fmt.Sprintf("%v%v.ts?spbhid=%v\n", slateSegmentPrefix, sequence+i, spbhid))
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	n, err := w.Write([]byte(sb.String()))
+	alarm.SrsUsageMonitor.AddBytes(n)
+	if err != nil {
+		return errors.Wrapf(err, "write slate playlist")
+	}
+	return nil
+}
+
+// isSlateSegment returns whether the URL path is a HLS slate segment.
+func isSlateSegment(urlPath string) bool {
+	return strings.HasPrefix(path.Base(urlPath), slateSegmentPrefix) && strings.HasSuffix(urlPath, ".ts")
+}
+
+// flvTag is an audio, video or script tag of FLV, see https://veovera.org/docs/legacy/video-file-format-v10-1-spec.pdf
+type flvTag struct {
+	// The RTMP message type, same to FLV tag type.
+	MessageType rtmp.MessageType
+	// The timestamp in milliseconds.
+	Timestamp uint32
+	// The tag data.
+	Payload []byte
+}
+
+// readFLVHeader reads the FLV header 9 bytes, and the first previous tag size 4 bytes.
+func readFLVHeader(r io.Reader) error {
+	b := make([]byte, 13)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return errors.Wrapf(err, "read flv header")
+	}
+	if string(b[:3]) != "FLV" {
+		return errors.Errorf("invalid flv header %v", b[:3])
+	}
+	return nil
+}
+
+// readFLVTag reads a FLV tag, and the previous tag size after it.
+func readFLVTag(r io.Reader) (*flvTag, error) {
+	b := make([]byte, 11)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.Wrapf(err, "read tag header")
+	}
+
+	size := int(binary.BigEndian.Uint32(b) & 0x00ffffff)
+	tag := &flvTag{
+		MessageType: rtmp.MessageType(b[0]),
+		Timestamp:   uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6]) | uint32(b[7])<<24,
+		Payload:     make([]byte, size+4),
+	}
+	if _, err := io.ReadFull(r, tag.Payload); err != nil {
+		return nil, errors.Wrapf(err, "read tag %vB", size)
+	}
+	tag.Payload = tag.Payload[:size]
+	return tag, nil
+}
+
+// flvSplicer writes the FLV tags of multiple sources to a HTTP-FLV client, such as the backend and the
+// slate, and keeps the timestamp monotonic when splicing to another source.
+type flvSplicer struct {
+	// The HTTP-FLV client.
+	w http.ResponseWriter
+	// Whether the HTTP header and FLV header is written.
+	headerWritten bool
+	// Whether to splice a new source, the offset is updated by its first tag.
+	splicing bool
+	// The timestamp offset of current source.
+	offset int64
+	// The last timestamp written to client.
+	lastTimestamp int64
+	// The error of writing to client, the client should be closed if not nil.
+	err error
+}
+
+func newFLVSplicer(w http.ResponseWriter) *flvSplicer {
+	return &flvSplicer{w: w, splicing: true}
+}
+
+// Splice starts a new source, so the timestamp of next tag continues from the last one.
+func (v *flvSplicer) Splice() {
+	v.splicing = true
+}
+
+// Write the tag of current source to client.
+func (v *flvSplicer) Write(tag *flvTag) error {
+	if v.err != nil {
+		return v.err
+	}
+
+	if !v.headerWritten {
+		v.headerWritten = true
+		v.w.Header().Set("Content-Type", "video/x-flv")
+		v.w.WriteHeader(http.StatusOK)
+		if _, v.err = v.w.Write([]byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0, 0, 0, 0}); v.err != nil {
+			return v.err
+		}
+	}
+
+	if v.splicing {
+		v.splicing = false
+		v.offset = v.lastTimestamp - int64(tag.Timestamp)
+	}
+
+	timestamp := int64(tag.Timestamp) + v.offset
+	if timestamp < v.lastTimestamp {
+		timestamp = v.lastTimestamp
+	}
+	v.lastTimestamp = timestamp
+
+	size := len(tag.Payload)
+	b := make([]byte, 11, 11+size+4)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	b[0] = byte(tag.MessageType)
+	b[4], b[5], b[6], b[7] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24)
+	b = append(b, tag.Payload...)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[11+size:], uint32(11+size))
+
+	var n int
+	n, v.err = v.w.Write(b)
+	alarm.SrsUsageMonitor.AddBytes(n)
+	if v.err != nil {
+		return v.err
+	}
+	if flusher, ok := v.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// serveWithSlate serves the HTTP-FLV client by backend, and plays the slate when the backend dies, then
+// retries the backend after each loop of slate, until the client quits, or the slate exceeds the max duration.
+// The stream which was never live, such as not published, is responded by 404 rather than the slate.
+func (v *HTTPFlvTsConnection) serveWithSlate(ctx context.Context, w http.ResponseWriter, r *http.Request, streamURL string) error {
+	splicer := newFLVSplicer(w)
+
+	var live bool
+	var slateAt time.Time
+	for ctx.Err() == nil {
+		streamed, err := v.spliceBackend(ctx, splicer, r, streamURL)
+		if splicer.err != nil {
+			return errors.Wrapf(splicer.err, "write to client")
+		}
+
+		if streamed {
+			live, slateAt = true, time.Time{}
+		}
+		if !live {
+			if isNoServerError(err) {
+				newNoServerError(srsHTTPQuota.retryAfter, err).write(ctx, w)
+				return nil
+			}
+			http.Error(w, fmt.Sprintf("stream %v not found", streamURL), http.StatusNotFound)
+			return errors.Wrapf(err, "stream not live")
+		}
+
+		if slateAt.IsZero() {
+			slateAt = time.Now()
+		}
+		if time.Since(slateAt) > srsSlate.maxDuration {
+			return errors.Wrapf(err, "slate exceeds %v", srsSlate.maxDuration)
+		}
+		logger.Wf(ctx, "HTTP-FLV play slate for %v, err %+v", streamURL, err)
+
+		if err := srsSlate.Play(ctx, splicer); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrapf(err, "play slate for %v", streamURL)
+		}
+	}
+	return nil
+}
+
+// spliceBackend picks the backend of stream, and proxies the FLV tags from backend via splicer. Returns whether
+// any tag is streamed from backend.
+func (v *HTTPFlvTsConnection) spliceBackend(ctx context.Context, splicer *flvSplicer, r *http.Request, streamURL string) (bool, error) {
+	backend, err := srsStreamSharding.pick(ctx, streamURL, lb.SrsLoadBalancer.PickForPlay)
+	if err != nil {
+		return false, errors.Wrapf(err, "pick backend for %v", streamURL)
+	}
+
+	release := lb.SrsServerConnections.Acquire(backend)
+	defer release()
+
+	if len(backend.HTTP) == 0 {
+		return false, errors.Errorf("no http stream server")
+	}
+
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, streamURL, backend, 0, err)
+		return false, errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	backendURL := fmt.Sprintf("%v://%v:%v%s", lb.SrsServerTLS.Scheme(lb.BackendProtocolHTTP), ip, backend.HTTP[0], r.URL.Path)
+	req, err := http.NewRequestWithContext(ctx, r.Method, backendURL, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "create request to %v", backendURL)
+	}
+
+	starttime := time.Now()
+	resp, err := lb.SrsServerTLS.HTTPClient().Do(req)
+	lb.ReportBackend(ctx, streamURL, backend, time.Since(starttime), backendError(resp, err))
+	if err != nil {
+		return false, errors.Wrapf(err, "do request to %v", backendURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("proxy stream to %v failed, status=%v", backendURL, resp.Status)
+	}
+
+	if err := readFLVHeader(resp.Body); err != nil {
+		return false, errors.Wrapf(err, "read header from %v", backendURL)
+	}
+	logger.Df(ctx, "HTTP-FLV start streaming from %v", backendURL)
+
+	splicer.Splice()
+	for streamed := false; ; streamed = true {
+		tag, err := readFLVTag(resp.Body)
+		if err != nil {
+			return streamed, errors.Wrapf(err, "read tag from %v", backendURL)
+		}
+
+		if err := splicer.Write(tag); err != nil {
+			return true, errors.Wrapf(err, "write tag to client")
+		}
+	}
+}
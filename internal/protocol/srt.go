@@ -7,16 +7,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"net"
 	"strings"
 	stdSync "sync"
 	"time"
 
+	"srsx/internal/alarm"
+	"srsx/internal/auth"
+	"srsx/internal/debug"
 	"srsx/internal/env"
 	"srsx/internal/errors"
 	"srsx/internal/lb"
 	"srsx/internal/logger"
+	"srsx/internal/policy"
+	"srsx/internal/session"
 	"srsx/internal/sync"
 	"srsx/internal/utils"
 )
@@ -34,6 +40,8 @@ type srsSRTServer struct {
 	sockets sync.Map[uint32, *SRTConnection]
 	// The system start time.
 	start time.Time
+	// The shard of this process, when multiple processes share the UDP port.
+	shard *udpShard
 
 	// The wait group for server.
 	wg stdSync.WaitGroup
@@ -55,6 +63,7 @@ func (v *srsSRTServer) Close() error {
 	if v.listener != nil {
 		v.listener.Close()
 	}
+	v.shard.Close()
 
 	v.wg.Wait()
 	return nil
@@ -62,9 +71,9 @@ func (v *srsSRTServer) Close() error {
 
 func (v *srsSRTServer) Run(ctx context.Context) error {
 	// Parse address to listen.
-	endpoint := v.environment.SRTServer()
-	if !strings.Contains(endpoint, ":") {
-		endpoint = ":" + endpoint
+	endpoint, err := utils.ParseListenAddr(v.environment.SRTServer(), "udp")
+	if err != nil {
+		return errors.Wrapf(err, "parse srt server %v", v.environment.SRTServer())
 	}
 
 	saddr, err := net.ResolveUDPAddr("udp", endpoint)
@@ -72,12 +81,36 @@ func (v *srsSRTServer) Run(ctx context.Context) error {
 		return errors.Wrapf(err, "resolve udp addr %v", endpoint)
 	}
 
-	listener, err := net.ListenUDP("udp", saddr)
+	shard, err := newUDPShardFromEnvironment(v.environment, "srt", 1)
+	if err != nil {
+		return errors.Wrapf(err, "create udp shard")
+	}
+
+	listener, err := srsUpgrader.listenUDP(ctx, "srt", saddr, v.environment.UDPReusePort() == "on")
 	if err != nil {
 		return errors.Wrapf(err, "listen udp %v", saddr)
 	}
 	v.listener = listener
-	logger.Df(ctx, "SRT server listen at %v", saddr)
+	saddr = listener.LocalAddr().(*net.UDPAddr)
+	logger.Df(ctx, "SRT server listen at %v, reuseport=%v", saddr, v.environment.UDPReusePort())
+	updateListener("srt", saddr.String(), true, nil)
+
+	// Handle the packets forwarded by other processes, for the sessions owned by this process.
+	if shard.Enabled() {
+		v.shard = shard
+		if err := shard.Run(ctx, &v.wg, func(addr *net.UDPAddr, data []byte) error {
+			return v.handleClientUDP(ctx, addr, data)
+		}); err != nil {
+			return errors.Wrapf(err, "run udp shard")
+		}
+	}
+
+	// Handle the new connections handed off by the parent process, which is draining for upgrade.
+	if err := srsUpgrader.runHandoff(ctx, "srt", &v.wg, func(addr *net.UDPAddr, data []byte) error {
+		return v.handleClientUDP(ctx, addr, data)
+	}); err != nil {
+		return errors.Wrapf(err, "run handoff")
+	}
 
 	// Consume all messages from UDP media transport.
 	v.wg.Add(1)
@@ -91,6 +124,7 @@ func (v *srsSRTServer) Run(ctx context.Context) error {
 				// If context is canceled or connection is closed, exit gracefully without logging error.
 				if ctx.Err() != nil || utils.IsClosedNetworkError(err) {
 					logger.Df(ctx, "SRT server done")
+					updateListener("srt", saddr.String(), false, nil)
 					return
 				}
 				// TODO: If SRT server closed unexpectedly, we should notice the main loop to quit.
@@ -99,7 +133,7 @@ func (v *srsSRTServer) Run(ctx context.Context) error {
 				continue
 			}
 
-			if err := v.handleClientUDP(ctx, caddr, buf[:n]); err != nil {
+			if err := v.handleListenerUDP(ctx, caddr, buf[:n]); err != nil {
 				logger.Wf(ctx, "SRT handle udp %vB failed, addr=%v, err=%+v", n, caddr, err)
 			}
 		}
@@ -108,6 +142,20 @@ func (v *srsSRTServer) Run(ctx context.Context) error {
 	return nil
 }
 
+// handleListenerUDP handles the packet from the shared UDP port, which is forwarded to the owner process by
+// the client address, if sharded to multiple processes, because the SRT connection is not sync between
+// processes, and the kernel might steer the address to another process when processes restart.
+func (v *srsSRTServer) handleListenerUDP(ctx context.Context, addr *net.UDPAddr, data []byte) error {
+	if !v.shard.Enabled() {
+		return v.handleClientUDP(ctx, addr, data)
+	}
+
+	if owner := v.shard.Owner(addr.String()); owner != v.shard.index {
+		return v.shard.Forward(owner, addr, data)
+	}
+	return v.handleClientUDP(ctx, addr, data)
+}
+
 func (v *srsSRTServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr, data []byte) error {
 	socketID := utils.SrtParseSocketID(data)
 
@@ -123,6 +171,15 @@ func (v *srsSRTServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr, d
 		}
 	}
 
+	// Hand off the new connections to the new process if upgraded, or ignore them when draining, while the
+	// existing connections are still served.
+	if SrsProxyDrainer.Draining() {
+		if _, ok := v.sockets.Load(socketID); !ok {
+			srsUpgrader.Handoff("srt", addr, data)
+			return nil
+		}
+	}
+
 	conn, ok := v.sockets.LoadOrStore(socketID, NewSRTConnection(func(c *SRTConnection) {
 		c.ctx = logger.WithContext(ctx)
 		c.listenerUDP, c.socketID = v.listener, socketID
@@ -132,6 +189,7 @@ func (v *srsSRTServer) handleClientUDP(ctx context.Context, addr *net.UDPAddr, d
 	ctx = conn.ctx
 	if !ok {
 		logger.Df(ctx, "Create new SRT connection skt=%v", socketID)
+		srsTrafficCapturer.attach(ctx, addr)
 	}
 
 	if newSocketID, err := conn.HandlePacket(pkt, addr, data); err != nil {
@@ -168,6 +226,14 @@ type SRTConnection struct {
 
 	// Listener start time.
 	start time.Time
+	// The client session, closed by closing the backend UDP when kicked.
+	session *session.Session
+	// Release the session of backend server, for least-connections strategy.
+	release func()
+	// The stats of session, in the JSON format of srt-live-transmit.
+	stats *srtStats
+	// The stream URL if publisher, to track the bitrate of stream.
+	publishURL string
 
 	// Handshake packets with client.
 	handshake0 *SRTHandshakePacket
@@ -186,11 +252,17 @@ func NewSRTConnection(opts ...func(*SRTConnection)) *SRTConnection {
 
 func (v *SRTConnection) HandlePacket(pkt *SRTHandshakePacket, addr *net.UDPAddr, data []byte) (uint32, error) {
 	ctx := v.ctx
+	srsTrafficCapturer.record(ctx, v.listenerUDP.LocalAddr(), addr, true, data)
 
 	// If not handshake, try to proxy to backend directly.
 	if pkt == nil {
 		// Proxy client message to backend.
 		if v.backendUDP != nil {
+			v.stats.onClientPacket(data)
+			alarm.SrsUsageMonitor.AddBytes(len(data))
+			if v.publishURL != "" {
+				lb.SrsServerBandwidth.AddBytes(v.publishURL, len(data))
+			}
 			if _, err := v.backendUDP.Write(data); err != nil {
 				return v.socketID, errors.Wrapf(err, "write to backend")
 			}
@@ -207,6 +279,12 @@ func (v *SRTConnection) HandlePacket(pkt *SRTHandshakePacket, addr *net.UDPAddr,
 	return v.socketID, nil
 }
 
+// writeToClient writes the packet b to client addr, which is recorded by the capture of session.
+func (v *SRTConnection) writeToClient(b []byte, addr *net.UDPAddr) (int, error) {
+	srsTrafficCapturer.record(v.ctx, v.listenerUDP.LocalAddr(), addr, false, b)
+	return v.listenerUDP.WriteToUDP(b, addr)
+}
+
 func (v *SRTConnection) handleHandshake(ctx context.Context, pkt *SRTHandshakePacket, addr *net.UDPAddr, data []byte) error {
 	// Handle handshake 0 and 1 messages.
 	if pkt.SynCookie == 0 {
@@ -237,7 +315,7 @@ func (v *SRTConnection) handleHandshake(ctx context.Context, pkt *SRTHandshakePa
 
 		if b, err := v.handshake1.MarshalBinary(); err != nil {
 			return errors.Wrapf(err, "marshal handshake 1")
-		} else if _, err = v.listenerUDP.WriteToUDP(b, addr); err != nil {
+		} else if _, err = v.writeToClient(b, addr); err != nil {
 			return errors.Wrapf(err, "write handshake 1")
 		}
 
@@ -256,7 +334,7 @@ func (v *SRTConnection) handleHandshake(ctx context.Context, pkt *SRTHandshakePa
 	logger.Df(ctx, "SRT Handshake 2: %v, sid=%v", v.handshake2, streamID)
 
 	// Start the UDP proxy to backend.
-	if err := v.connectBackend(ctx, streamID); err != nil {
+	if err := v.connectBackend(ctx, streamID, addr); err != nil {
 		return errors.Wrapf(err, "connect backend for %v", streamID)
 	}
 
@@ -306,39 +384,58 @@ func (v *SRTConnection) handleHandshake(ctx context.Context, pkt *SRTHandshakePa
 	v.handshake3 = &*handshake3p
 	v.handshake3.SynCookie = v.handshake1.SynCookie
 	v.socketID = handshake3p.SRTSocketID
+	v.stats.setSocketID(v.socketID)
 	logger.Df(ctx, "Handshake 3: %v", v.handshake3)
 
 	if b, err := v.handshake3.MarshalBinary(); err != nil {
 		return errors.Wrapf(err, "marshal handshake 3")
-	} else if _, err = v.listenerUDP.WriteToUDP(b, addr); err != nil {
+	} else if _, err = v.writeToClient(b, addr); err != nil {
 		return errors.Wrapf(err, "write handshake 3")
 	}
 
 	// Start a goroutine to proxy message from backend to client.
 	// TODO: FIXME: Support close the connection when timeout or client disconnected.
-	go func() {
+	go debug.DoWithProfileLabels(ctx, "srt", streamID, func(ctx context.Context) {
+		defer session.SrsSessionManager.Remove(v.session)
+		defer v.release()
+
 		for ctx.Err() == nil {
 			nn, err := v.backendUDP.Read(b)
 			if err != nil {
 				// TODO: If backend server closed unexpectedly, we should notice the stream to quit.
 				logger.Wf(ctx, "read from backend failed, err=%v", err)
+				v.session.SetCloseReason(session.CloseReasonOf(err, session.CloseBackendClosed))
 				return
 			}
-			if _, err = v.listenerUDP.WriteToUDP(b[:nn], addr); err != nil {
+			v.stats.onBackendPacket(b[:nn])
+			alarm.SrsUsageMonitor.AddBytes(nn)
+			if _, err = v.writeToClient(b[:nn], addr); err != nil {
 				// TODO: If backend server closed unexpectedly, we should notice the stream to quit.
 				logger.Wf(ctx, "write to client failed, err=%v", err)
+				v.session.SetCloseReason(session.CloseReasonOf(err, session.CloseClientClosed))
 				return
 			}
 		}
-	}()
+	})
 	return nil
 }
 
-func (v *SRTConnection) connectBackend(ctx context.Context, streamID string) error {
+func (v *SRTConnection) connectBackend(ctx context.Context, streamID string, addr *net.UDPAddr) error {
 	if v.backendUDP != nil {
 		return nil
 	}
 
+	// Reject the excess sessions early, before any backend contact, and release it with the backend.
+	releaseConn, err := srsConnLimiter.Acquire("srt", addr.String())
+	if err != nil {
+		return errors.Wrapf(err, "limit connections")
+	}
+	defer func() {
+		if v.release == nil {
+			releaseConn()
+		}
+	}()
+
 	// Parse stream id to host and resource.
 	host, resource, err := utils.ParseSRTStreamID(streamID)
 	if err != nil {
@@ -354,8 +451,44 @@ func (v *SRTConnection) connectBackend(ctx context.Context, streamID string) err
 		return errors.Wrapf(err, "build stream url %v", streamID)
 	}
 
-	// Pick a backend SRS server to proxy the SRT stream.
-	backend, err := lb.SrsLoadBalancer.Pick(ctx, streamURL)
+	// Deny or route the client by policy, the throttle rules of SRT are rejected when loading policy.
+	operation := policy.OperationPlay
+	if strings.Contains(streamID, "m=publish") {
+		operation = policy.OperationPublish
+	}
+	if ctx, _, err = applyPolicy(ctx, "srt", operation, streamURL, addr.String(), nil); err != nil {
+		return errors.Wrapf(err, "apply policy")
+	}
+
+	// Verify the secret of client in the query of resource, like r=live/livestream?secret=xxx.
+	authClient := &auth.Client{Action: auth.ActionPlay, Protocol: "srt", StreamURL: streamURL, RemoteAddr: addr.String()}
+	if operation == policy.OperationPublish {
+		authClient.Action = auth.ActionPublish
+	}
+	if index := strings.Index(resource, "?"); index >= 0 {
+		authClient.Param = resource[index:]
+	}
+	if err := auth.SrsAuthenticator.Authenticate(ctx, authClient); err != nil {
+		return errors.Wrapf(err, "authenticate")
+	}
+	ctx = logger.WithLabels(ctx, authClient.Labels)
+
+	// Select the backend servers by the label selector in the query, like ?selector=region%3Dus-east.
+	if ctx, _, err = applySelector(ctx, authClient.Param); err != nil {
+		return errors.Wrapf(err, "apply selector")
+	}
+
+	// Keep the picked server by the affinity of publishers or players, which might be sticky by client.
+	ctx = lb.WithClient(ctx, addr.String())
+	// Prefer the servers in the region of client, by the geolocation of client.
+	ctx = lb.WithClientRegions(ctx, addr.String(), nil)
+
+	// Pick a backend SRS server to proxy the SRT stream, by the strategy of publishers or players.
+	pick := lb.SrsLoadBalancer.PickForPlay
+	if authClient.Action == auth.ActionPublish {
+		pick = lb.SrsLoadBalancer.PickForPublish
+	}
+	backend, err := srsStreamSharding.pick(ctx, streamURL, pick)
 	if err != nil {
 		return errors.Wrapf(err, "pick backend for %v", streamURL)
 	}
@@ -372,13 +505,34 @@ func (v *SRTConnection) connectBackend(ctx context.Context, streamID string) err
 
 	// Connect to backend SRS server via UDP client.
 	// TODO: FIXME: Support close the connection when timeout or client disconnected.
-	backendAddr := net.UDPAddr{IP: net.ParseIP(backend.IP), Port: int(udpPort)}
-	if backendUDP, err := net.DialUDP("udp", nil, &backendAddr); err != nil {
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		lb.ReportBackend(ctx, streamURL, backend, 0, err)
+		return errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	backendAddr := net.UDPAddr{IP: net.ParseIP(ip), Port: int(udpPort)}
+	if backendUDP, err := dialUDP(ctx, &backendAddr); err != nil {
+		lb.ReportBackend(ctx, streamURL, backend, 0, err)
 		return errors.Wrapf(err, "dial udp to %v of %v for %v", backendAddr, backend, streamURL)
 	} else {
 		v.backendUDP = backendUDP
 	}
 
+	// Register the session, the client will reconnect after the backend UDP is closed by kick.
+	releaseBackend := lb.SrsServerConnections.Acquire(backend)
+	v.release = func() {
+		releaseBackend()
+		releaseConn()
+	}
+	v.stats = newSRTStats(v.socketID)
+	if authClient.Action == auth.ActionPublish {
+		v.publishURL = streamURL
+	}
+	v.session = session.SrsSessionManager.Add(ctx, "srt", streamURL, addr.String(), func() {
+		v.backendUDP.Close()
+	}, session.WithStats(v.stats), session.WithAnnotations(authClient.Annotations),
+		session.WithLabels(authClient.Labels))
+
 	return nil
 }
 
@@ -584,3 +738,280 @@ func (v *SRTHandshakePacket) MarshalBinary() ([]byte, error) {
 
 	return b, nil
 }
+
+// The size of SRT packet header with IP and UDP, and the full packet, to convert the packets to bitrate
+// like srt-live-transmit.
+const (
+	srtPacketHeaderSize = 44
+	srtFullPacketSize   = 1500
+)
+
+// srtDirectionStats is the stats of SRT data packets in a direction, from client or to client.
+type srtDirectionStats struct {
+	// The number of data packets, including retransmitted.
+	packets uint64
+	// The number of data packets, excluding retransmitted.
+	packetsUnique uint64
+	// The number of data packets lost.
+	packetsLost uint64
+	// The number of data packets dropped by sender, by the drop requests.
+	packetsDropped uint64
+	// The number of data packets retransmitted, by the R flag.
+	packetsRetransmitted uint64
+	// The number of data packets older than the highest sequence number, but not retransmitted.
+	packetsBelated uint64
+	// The bytes of payload, including retransmitted.
+	bytes uint64
+	// The bytes of payload, excluding retransmitted.
+	bytesUnique uint64
+	// The highest sequence number, valid if hasHighest.
+	highest    uint32
+	hasHighest bool
+
+	// The bitrate with the packet headers, sampled by the bitrate sampler.
+	meter bitrateMeter
+}
+
+// onData updates the stats by a data packet, and counts the gaps of sequence number as lost if
+// countGaps, because the loss is only observable on the link from client.
+func (v *srtDirectionStats) onData(data []byte, countGaps bool) {
+	if len(data) < 16 {
+		return
+	}
+
+	payload := uint64(len(data) - 16)
+	v.packets++
+	v.bytes += payload
+
+	// See https://datatracker.ietf.org/doc/html/draft-sharabayko-srt-01#section-3.1
+	if retransmitted := binary.BigEndian.Uint32(data[4:])&(1<<26) != 0; retransmitted {
+		v.packetsRetransmitted++
+		return
+	}
+	v.packetsUnique++
+	v.bytesUnique += payload
+
+	seq := binary.BigEndian.Uint32(data) & 0x7fffffff
+	if !v.hasHighest {
+		v.highest, v.hasHighest = seq, true
+		return
+	}
+
+	// The sequence number is 31 bits and wraps around, so use the signed difference in 31 bits.
+	if diff := int32((seq-v.highest)<<1) >> 1; diff > 0 {
+		if countGaps {
+			v.packetsLost += uint64(diff - 1)
+		}
+		v.highest = seq
+	} else {
+		v.packetsBelated++
+	}
+}
+
+// total returns the bytes with the packet headers, to calculate the bitrate.
+func (v *srtDirectionStats) total() uint64 {
+	return v.bytes + v.packets*srtPacketHeaderSize
+}
+
+// mbps returns the bitrate with the packet headers in Mbps, without any side effect.
+func (v *srtDirectionStats) mbps(now time.Time, createdAt time.Time) float64 {
+	return v.meter.bitrate(v.total(), now, createdAt) / 1e6
+}
+
+// srtStats is the stats of an SRT session measured by proxy, from the headers of data packets and the
+// control packets, in the JSON format of srt-live-transmit, where the send is to client and the recv is
+// from client. The stats not observable by proxy, such as the buffers, are always zero.
+type srtStats struct {
+	// The socket ID of session.
+	socketID uint32
+	// The time created.
+	createdAt time.Time
+	// The data packets from client to backend.
+	recv srtDirectionStats
+	// The data packets from backend to client.
+	send srtDirectionStats
+	// The RTT in ms, by the last full ACK.
+	rtt float64
+	// The available buffer of receiver in packets, by the last full ACK.
+	flow uint32
+	// The packets sent but not acknowledged, by the last full ACK.
+	flight int32
+	// The estimated link capacity in Mbps, by the last full ACK.
+	bandwidth float64
+	// The lock to protect all fields.
+	lock stdSync.Mutex
+}
+
+func newSRTStats(socketID uint32) *srtStats {
+	return &srtStats{socketID: socketID, createdAt: time.Now()}
+}
+
+// sampleBitrate samples the bitrate from client and to client, by the bitrate sampler.
+func (v *srtStats) sampleBitrate(now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recv.meter.sample(v.recv.total(), now, v.createdAt)
+	v.send.meter.sample(v.send.total(), now, v.createdAt)
+}
+
+// setSocketID updates the socket ID, which is changed by handshake.
+func (v *srtStats) setSocketID(socketID uint32) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.socketID = socketID
+}
+
+// onClientPacket updates the stats by a packet from client to backend.
+func (v *srtStats) onClientPacket(data []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(data) > 0 && data[0]&0x80 == 0 {
+		v.recv.onData(data, true)
+	} else {
+		v.onControl(data, true)
+	}
+}
+
+// onBackendPacket updates the stats by a packet from backend to client.
+func (v *srtStats) onBackendPacket(data []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(data) > 0 && data[0]&0x80 == 0 {
+		v.send.onData(data, false)
+	} else {
+		v.onControl(data, false)
+	}
+}
+
+// onControl updates the stats by a control packet, the ACK and NAK are sent by receiver, and the drop
+// request is sent by sender.
+// See https://datatracker.ietf.org/doc/html/draft-sharabayko-srt-01#section-3.2
+func (v *srtStats) onControl(data []byte, fromClient bool) {
+	if len(data) < 16 {
+		return
+	}
+
+	// The data packets acknowledged or reported by receiver, which are sent by the peer.
+	received, sent := &v.send, &v.recv
+	if !fromClient {
+		received, sent = &v.recv, &v.send
+	}
+
+	switch binary.BigEndian.Uint16(data) & 0x7fff {
+	case 0x0002: // ACK, only the full ACK has RTT and link capacity.
+		if len(data) < 16+28 {
+			return
+		}
+		ackSeq := binary.BigEndian.Uint32(data[16:]) & 0x7fffffff
+		v.rtt = float64(binary.BigEndian.Uint32(data[20:])) / 1000
+		v.flow = binary.BigEndian.Uint32(data[28:])
+		v.bandwidth = float64(binary.BigEndian.Uint32(data[36:])) * srtFullPacketSize * 8 / 1e6
+		if received.hasHighest {
+			v.flight = int32((received.highest+1-ackSeq)<<1) >> 1
+		}
+	case 0x0003: // NAK, the loss list of receiver, only counts the loss reported by client, because the
+		// loss from client is counted by the gaps of sequence number.
+		if !fromClient {
+			return
+		}
+		for p := data[16:]; len(p) >= 4; p = p[4:] {
+			if first := binary.BigEndian.Uint32(p); first&0x80000000 == 0 {
+				received.packetsLost++
+			} else if len(p) >= 8 {
+				// The range of lost packets, the first has the highest bit set.
+				first, last := first&0x7fffffff, binary.BigEndian.Uint32(p[4:])
+				received.packetsLost += uint64((last-first)&0x7fffffff) + 1
+				p = p[4:]
+			}
+		}
+	case 0x0007: // Drop request, the packets dropped by sender.
+		if len(data) < 24 {
+			return
+		}
+		first, last := binary.BigEndian.Uint32(data[16:]), binary.BigEndian.Uint32(data[20:])
+		sent.packetsDropped += uint64((last-first)&0x7fffffff) + 1
+	}
+}
+
+// MarshalJSON marshals the snapshot of stats, in the JSON format of srt-live-transmit.
+// See https://github.com/Haivision/srt/blob/master/apps/apputil.cpp
+func (v *srtStats) MarshalJSON() ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	type Window struct {
+		Flow       uint32 `json:"flow"`
+		Congestion int    `json:"congestion"`
+		Flight     int32  `json:"flight"`
+	}
+	type Link struct {
+		RTT          float64 `json:"rtt"`
+		Bandwidth    float64 `json:"bandwidth"`
+		MaxBandwidth float64 `json:"maxBandwidth"`
+	}
+	type Send struct {
+		Packets              uint64  `json:"packets"`
+		PacketsUnique        uint64  `json:"packetsUnique"`
+		PacketsLost          uint64  `json:"packetsLost"`
+		PacketsDropped       uint64  `json:"packetsDropped"`
+		PacketsRetransmitted uint64  `json:"packetsRetransmitted"`
+		PacketsFilterExtra   uint64  `json:"packetsFilterExtra"`
+		Bytes                uint64  `json:"bytes"`
+		BytesUnique          uint64  `json:"bytesUnique"`
+		BytesDropped         uint64  `json:"bytesDropped"`
+		ByteAvailBuf         uint64  `json:"byteAvailBuf"`
+		MsBuf                uint64  `json:"msBuf"`
+		MbitRate             float64 `json:"mbitRate"`
+		SendPeriod           float64 `json:"sendPeriod"`
+	}
+	type Recv struct {
+		Packets              uint64  `json:"packets"`
+		PacketsUnique        uint64  `json:"packetsUnique"`
+		PacketsLost          uint64  `json:"packetsLost"`
+		PacketsDropped       uint64  `json:"packetsDropped"`
+		PacketsRetransmitted uint64  `json:"packetsRetransmitted"`
+		PacketsBelated       uint64  `json:"packetsBelated"`
+		PacketsFilterExtra   uint64  `json:"packetsFilterExtra"`
+		PacketsFilterSupply  uint64  `json:"packetsFilterSupply"`
+		PacketsFilterLoss    uint64  `json:"packetsFilterLoss"`
+		Bytes                uint64  `json:"bytes"`
+		BytesUnique          uint64  `json:"bytesUnique"`
+		BytesLost            uint64  `json:"bytesLost"`
+		BytesDropped         uint64  `json:"bytesDropped"`
+		ByteAvailBuf         uint64  `json:"byteAvailBuf"`
+		MsBuf                uint64  `json:"msBuf"`
+		MbitRate             float64 `json:"mbitRate"`
+		MsTsbPdDelay         uint64  `json:"msTsbPdDelay"`
+	}
+	type Stats struct {
+		SID       uint32 `json:"sid"`
+		Timepoint string `json:"timepoint"`
+		Time      int64  `json:"time"`
+		Window    Window `json:"window"`
+		Link      Link   `json:"link"`
+		Send      Send   `json:"send"`
+		Recv      Recv   `json:"recv"`
+	}
+
+	now := time.Now()
+	return json.Marshal(&Stats{
+		SID: v.socketID, Timepoint: now.Format("2006-01-02T15:04:05.000000-0700"),
+		Time:   now.Sub(v.createdAt).Milliseconds(),
+		Window: Window{Flow: v.flow, Flight: v.flight},
+		Link:   Link{RTT: v.rtt, Bandwidth: v.bandwidth},
+		Send: Send{
+			Packets: v.send.packets, PacketsUnique: v.send.packetsUnique, PacketsLost: v.send.packetsLost,
+			PacketsDropped: v.send.packetsDropped, PacketsRetransmitted: v.send.packetsRetransmitted,
+			Bytes: v.send.bytes, BytesUnique: v.send.bytesUnique, MbitRate: v.send.mbps(now, v.createdAt),
+		},
+		Recv: Recv{
+			Packets: v.recv.packets, PacketsUnique: v.recv.packetsUnique, PacketsLost: v.recv.packetsLost,
+			PacketsDropped: v.recv.packetsDropped, PacketsRetransmitted: v.recv.packetsRetransmitted,
+			PacketsBelated: v.recv.packetsBelated, Bytes: v.recv.bytes, BytesUnique: v.recv.bytesUnique,
+			MbitRate: v.recv.mbps(now, v.createdAt),
+		},
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// streamSharding splits the streams to the proxies by the hash of stream URL, so each proxy owns a
+// deterministic shard of streams, and the publishers and players of a stream always land on the same proxy,
+// even behind a L4 load balancer. The stream outside the shard of this proxy is redirected to the owner by
+// the redirect of protocol, or forwarded to the owner like a backend server. The owner is selected by the
+// rendezvous hashing, so only the streams of the joined or left proxy are moved. All proxies must be
+// configured with the same peers and listen ports.
+type streamSharding struct {
+	// Whether redirect the clients to the owner, instead of forwarding.
+	redirect bool
+	// The hosts of all proxies, empty to disable.
+	peers []string
+	// The host of this proxy in peers.
+	self string
+
+	// The listen ports of proxies, to redirect or forward to the owner.
+	rtmp, http, api, srt string
+	// The listen ports of HTTPS, to redirect the HTTPS clients to the owner, empty if not listen.
+	httpsServer, httpsAPI string
+}
+
+// The sharding of streams to proxies, enabled by PROXY_STREAM_SHARD.
+var srsStreamSharding = &streamSharding{}
+
+// configure the sharding by the mode, peers and self in environment, and the ports of listeners.
+func (v *streamSharding) configure(ctx context.Context, environment env.Environment) error {
+	mode := environment.StreamShard()
+	if mode == "" || mode == "off" {
+		return nil
+	}
+	if mode != "redirect" && mode != "forward" {
+		return errors.Errorf("invalid stream shard %v", mode)
+	}
+
+	var peers []string
+	for _, peer := range strings.Split(environment.StreamShardPeers(), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+
+	self := environment.StreamShardSelf()
+	if self == "" {
+		return errors.Errorf("empty stream shard self")
+	}
+	found := false
+	for _, peer := range peers {
+		found = found || peer == self
+	}
+	if !found {
+		return errors.Errorf("self %v not in peers %v", self, strings.Join(peers, ","))
+	}
+
+	// The proxies listen at the same ports, so the ports of owner are the ports of this proxy, the first one if
+	// listen at multiple ports.
+	ports := make(map[string]string)
+	for name, ep := range map[string]struct{ endpoint, network string }{
+		"rtmp": {environment.RtmpServer(), "tcp"},
+		"http": {environment.HttpServer(), "tcp"},
+		"api":  {environment.HttpAPI(), "tcp"},
+		"srt":  {environment.SRTServer(), "udp"},
+	} {
+		endpoints := utils.SplitListenEndpoints(ep.endpoint)
+		if len(endpoints) == 0 {
+			return errors.Errorf("empty %v endpoint", name)
+		}
+
+		endpoint, err := utils.ParseListenEndpointStrict(endpoints[0], ep.network)
+		if err != nil {
+			return errors.Wrapf(err, "parse %v endpoint %v", name, ep.endpoint)
+		}
+		ports[name] = strconv.Itoa(int(endpoint.Port))
+	}
+
+	// The HTTPS is optional, to redirect the HTTPS clients to the HTTPS of owner.
+	for name, endpoints := range map[string]string{
+		"https-server": environment.HttpsServer(), "https-api": environment.HttpsAPI(),
+	} {
+		if endpoints := utils.SplitListenEndpoints(endpoints); len(endpoints) > 0 {
+			endpoint, err := utils.ParseListenEndpointStrict(endpoints[0], "tcp")
+			if err != nil {
+				return errors.Wrapf(err, "parse %v endpoint %v", name, endpoints[0])
+			}
+			ports[name] = strconv.Itoa(int(endpoint.Port))
+		}
+	}
+
+	v.redirect, v.peers, v.self = mode == "redirect", peers, self
+	v.rtmp, v.http, v.api, v.srt = ports["rtmp"], ports["http"], ports["api"], ports["srt"]
+	v.httpsServer, v.httpsAPI = ports["https-server"], ports["https-api"]
+	logger.Df(ctx, "Stream sharding mode=%v, self=%v, peers=%v", mode, self, strings.Join(peers, ","))
+	return nil
+}
+
+// Enabled returns whether the streams are sharded to proxies.
+func (v *streamSharding) Enabled() bool {
+	return len(v.peers) > 0
+}
+
+// Owner returns the proxy which owns the stream, as a backend server, or nil if owned by this proxy.
+func (v *streamSharding) Owner(streamURL string) *lb.SRSServer {
+	if !v.Enabled() {
+		return nil
+	}
+
+	// The peer with the highest hash of stream URL owns the stream.
+	var owner string
+	var highest uint64
+	for _, peer := range v.peers {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%v/%v", peer, streamURL)))
+		if score := binary.BigEndian.Uint64(h[:8]); owner == "" || score > highest {
+			owner, highest = peer, score
+		}
+	}
+	if owner == v.self {
+		return nil
+	}
+
+	return &lb.SRSServer{
+		IP: owner, ServerID: fmt.Sprintf("proxy-%v", owner), ServiceID: "shard", PID: "0", Weight: 1,
+		RTMP: []string{v.rtmp}, HTTP: []string{v.http}, API: []string{v.api}, SRT: []string{v.srt},
+	}
+}
+
+// Redirect returns the proxy which owns the stream, to redirect the client to, or nil if owned by this proxy
+// or forwarded. The HLS and WebRTC clients are always redirected, because the HLS playlist and the WebRTC
+// session are bound to the proxy.
+func (v *streamSharding) Redirect(streamURL string, always bool) *lb.SRSServer {
+	if !v.redirect && !always {
+		return nil
+	}
+	return v.Owner(streamURL)
+}
+
+// pick the backend server of stream by pick, or the proxy which owns the stream if forwarded.
+func (v *streamSharding) pick(
+	ctx context.Context, streamURL string, pick func(ctx context.Context, streamURL string) (*lb.SRSServer, error),
+) (*lb.SRSServer, error) {
+	if !v.redirect {
+		if owner := v.Owner(streamURL); owner != nil {
+			logger.Df(ctx, "Forward %v to shard owner %v", streamURL, owner.IP)
+			return owner, nil
+		}
+	}
+	return pick(ctx, streamURL)
+}
+
+// location returns the URL of request r on the owner proxy, by the HTTPS port if r is over TLS and the proxies
+// listen at HTTPS, or the HTTP port.
+func (v *streamSharding) location(r *http.Request, owner *lb.SRSServer, httpPort, httpsPort string) string {
+	scheme, port := "http", httpPort
+	if r.TLS != nil && httpsPort != "" {
+		scheme, port = "https", httpsPort
+	}
+	return fmt.Sprintf("%v://%v%v", scheme, net.JoinHostPort(owner.IP, port), r.URL.RequestURI())
+}
+
+// redirectAPI responses the WHIP or WHEP client by HTTP 307 to the HTTP API of owner, so the client follows
+// the redirect with the same method and SDP.
+func redirectAPI(ctx context.Context, w http.ResponseWriter, r *http.Request, owner *lb.SRSServer) {
+	location := srsStreamSharding.location(r, owner, srsStreamSharding.api, srsStreamSharding.httpsAPI)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+
+	logger.Df(ctx, "WebRTC redirect to %v", location)
+}
+
+// redirectStream responses the HTTP-FLV, HTTP-TS or HLS client by HTTP 302 to the HTTP server of owner.
+func redirectStream(ctx context.Context, w http.ResponseWriter, r *http.Request, owner *lb.SRSServer) {
+	location := srsStreamSharding.location(r, owner, srsStreamSharding.http, srsStreamSharding.httpsServer)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, location, http.StatusFound)
+
+	logger.Df(ctx, "HTTP redirect to %v", location)
+}
+
+// ConfigureStreamSharding configures the sharding of streams to proxies, see streamSharding.
+func ConfigureStreamSharding(ctx context.Context, environment env.Environment) error {
+	return srsStreamSharding.configure(ctx, environment)
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// egressThrottler limits the egress bitrate of each client connection of RTMP, and each response of HTTP-FLV,
+// HTTP-TS and HLS segments, by the token bucket on the writes to client, so a single misbehaving player or
+// download tool can't saturate the uplink of proxy. The burst allows the client to fetch the cached GOP fast
+// at startup. The HTTP API and other responses, such as the playlists, are not limited.
+type egressThrottler struct {
+	// The max egress in bytes per second of each connection, 0 for unlimited.
+	rate float64
+	// The max bytes to write in a burst.
+	burst float64
+	// The duration of burst, to allow the burst of the bitrate limited by policy.
+	burstDuration time.Duration
+}
+
+// The egress limit of client connections, by PROXY_MAX_CONN_EGRESS_KBPS and PROXY_MAX_CONN_EGRESS_BURST.
+var srsEgressThrottler = &egressThrottler{}
+
+// configure the egress limit by environment.
+func (v *egressThrottler) configure(ctx context.Context, environment env.Environment) error {
+	kbps, err := strconv.Atoi(environment.MaxConnEgressKbps())
+	if err != nil || kbps < 0 {
+		return errors.Errorf("invalid max conn egress kbps %v", environment.MaxConnEgressKbps())
+	}
+
+	burst, err := time.ParseDuration(environment.MaxConnEgressBurst())
+	if err != nil || burst < 0 {
+		return errors.Errorf("invalid max conn egress burst %v", environment.MaxConnEgressBurst())
+	}
+
+	// The burst is at least 1400 bytes, so each write is able to send a packet.
+	v.rate, v.burstDuration = float64(kbps)*1000/8, burst
+	v.burst = v.burstOf(v.rate)
+	if kbps > 0 {
+		logger.Df(ctx, "Connection egress limit kbps=%v, burst=%v", kbps, burst)
+	}
+	return nil
+}
+
+// burstOf returns the burst in bytes of rate, which is at least 1400 bytes, so each write is able to send a
+// packet.
+func (v *egressThrottler) burstOf(rate float64) float64 {
+	return math.Max(1400, rate*v.burstDuration.Seconds())
+}
+
+// newConn wraps the client conn by the egress limit, or returns the conn if unlimited.
+func (v *egressThrottler) newConn(conn net.Conn) net.Conn {
+	if v.rate <= 0 {
+		return conn
+	}
+	return &throttleConn{Conn: conn, bucket: newTokenBucket(v.rate, v.burst), closed: make(chan struct{})}
+}
+
+// newResponseWriter wraps the response writer w by the bitrate limit kbps of policy, until ctx is done.
+func (v *egressThrottler) newResponseWriter(ctx context.Context, w http.ResponseWriter, kbps int) http.ResponseWriter {
+	rate := float64(kbps) * 1000 / 8
+	return &throttleResponseWriter{ResponseWriter: w, ctx: ctx, bucket: newTokenBucket(rate, v.burstOf(rate))}
+}
+
+// newStreamResponseWriter wraps the response writer w of stream by the egress limit, until ctx is done, or
+// returns w if unlimited.
+func (v *egressThrottler) newStreamResponseWriter(ctx context.Context, w http.ResponseWriter) http.ResponseWriter {
+	if v.rate <= 0 {
+		return w
+	}
+	return &throttleResponseWriter{ResponseWriter: w, ctx: ctx, bucket: newTokenBucket(v.rate, v.burst)}
+}
+
+// tokenBucket limits the bytes by rate, and allows a burst, which is the only bitrate limiter of egress,
+// for the connections and the responses limited by policy.
+type tokenBucket struct {
+	// The tokens in bytes per second.
+	rate float64
+	// The max tokens of bucket.
+	burst float64
+
+	// The lock to serialize the writes.
+	lock stdSync.Mutex
+	// The available tokens, negative if overdrawn.
+	tokens float64
+	// The time of last refill.
+	updatedAt time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, updatedAt: time.Now()}
+}
+
+// write b by fn in chunks, and waits for the tokens before writing each chunk, until done is closed, or the
+// write deadline returned by deadline, which is zero if no deadline.
+func (v *tokenBucket) write(
+	b []byte, done <-chan struct{}, deadline func() time.Time, fn func([]byte) (int, error),
+) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var written int
+	for len(b) > 0 {
+		// Write at most a burst each time, to smooth the egress of large writes.
+		chunk := b
+		if len(chunk) > int(v.burst) {
+			chunk = chunk[:int(v.burst)]
+		}
+
+		// Take the tokens, and wait for the overdrawn tokens to be refilled.
+		now := time.Now()
+		v.tokens = math.Min(v.burst, v.tokens+now.Sub(v.updatedAt).Seconds()*v.rate)
+		v.updatedAt = now
+		v.tokens -= float64(len(chunk))
+		if v.tokens < 0 {
+			// Never wait beyond the write deadline, and return the timeout like the write of conn.
+			wait := time.Duration(-v.tokens / v.rate * float64(time.Second))
+			expired := false
+			if at := deadline(); !at.IsZero() && now.Add(wait).After(at) {
+				wait, expired = at.Sub(now), true
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return written, net.ErrClosed
+			case <-timer.C:
+			}
+
+			// Return the tokens of chunk not written, which are taken again by the next write.
+			if expired {
+				v.tokens += float64(len(chunk))
+				return written, os.ErrDeadlineExceeded
+			}
+		}
+
+		n, err := fn(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttleConn limits the egress of conn by the token bucket, which waits for the tokens before writing.
+type throttleConn struct {
+	net.Conn
+	// The token bucket of egress.
+	bucket *tokenBucket
+
+	// Closed when the conn is closed, to stop waiting.
+	closed chan struct{}
+	// To close the conn once.
+	once stdSync.Once
+
+	// The write deadline, to stop waiting for the tokens.
+	writeDeadline time.Time
+	// The lock to protect writeDeadline.
+	lock stdSync.Mutex
+}
+
+func (v *throttleConn) Write(b []byte) (int, error) {
+	return v.bucket.write(b, v.closed, v.deadline, v.Conn.Write)
+}
+
+func (v *throttleConn) SetDeadline(t time.Time) error {
+	v.setWriteDeadline(t)
+	return v.Conn.SetDeadline(t)
+}
+
+func (v *throttleConn) SetWriteDeadline(t time.Time) error {
+	v.setWriteDeadline(t)
+	return v.Conn.SetWriteDeadline(t)
+}
+
+func (v *throttleConn) setWriteDeadline(t time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.writeDeadline = t
+}
+
+// deadline returns the write deadline, zero if no deadline.
+func (v *throttleConn) deadline() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.writeDeadline
+}
+
+func (v *throttleConn) Close() error {
+	v.once.Do(func() {
+		close(v.closed)
+	})
+	return v.Conn.Close()
+}
+
+// throttleResponseWriter limits the bitrate of response by the token bucket, for the throttle action of policy.
+type throttleResponseWriter struct {
+	http.ResponseWriter
+	// The context to stop waiting.
+	ctx context.Context
+	// The token bucket of response.
+	bucket *tokenBucket
+}
+
+func (v *throttleResponseWriter) Write(b []byte) (int, error) {
+	return v.bucket.write(b, v.ctx.Done(), noDeadline, v.ResponseWriter.Write)
+}
+
+// noDeadline returns no write deadline, for the response whose deadline is the context.
+func noDeadline() time.Time {
+	return time.Time{}
+}
+
+func (v *throttleResponseWriter) Flush() {
+	if flusher, ok := v.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ConfigureEgressThrottle configures the egress limit of client connections, see egressThrottler.
+func ConfigureEgressThrottle(ctx context.Context, environment env.Environment) error {
+	return srsEgressThrottler.configure(ctx, environment)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	stdSync "sync"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/signal"
+)
+
+// tlsCertificate is the certificate of a TLS listener, loaded from the cert and key files, and reloaded by
+// SIGHUP, so the renewed certificate takes effect for the new connections without restarting.
+type tlsCertificate struct {
+	// The name of listener, for logs.
+	name string
+	// The certificate file in PEM, which might include the intermediate certificates.
+	certFile string
+	// The private key file in PEM.
+	keyFile string
+
+	// The loaded certificate.
+	cert *tls.Certificate
+	// The lock to protect the certificate.
+	lock stdSync.RWMutex
+}
+
+// newTLSCertificate loads the certificate of listener name from certFile and keyFile, and reloads it by SIGHUP.
+func newTLSCertificate(ctx context.Context, name, certFile, keyFile string) (*tlsCertificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.Errorf("empty cert %v or key %v", certFile, keyFile)
+	}
+
+	v := &tlsCertificate{name: name, certFile: certFile, keyFile: keyFile}
+	if err := v.load(ctx); err != nil {
+		return nil, err
+	}
+
+	signal.HandleReload(name, v.load)
+	return v, nil
+}
+
+// load the certificate from files, the current certificate is kept if failed.
+func (v *tlsCertificate) load(ctx context.Context) error {
+	cert, err := tls.LoadX509KeyPair(v.certFile, v.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "load %v cert %v key %v", v.name, v.certFile, v.keyFile)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.cert = &cert
+
+	logger.Df(ctx, "Load %v cert %v key %v", v.name, v.certFile, v.keyFile)
+	return nil
+}
+
+// Config returns the TLS config of server, which always uses the latest certificate.
+func (v *tlsCertificate) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			v.lock.RLock()
+			defer v.lock.RUnlock()
+			return v.cert, nil
+		},
+	}
+}
+
+// listenHTTPS listens the addrs of HTTPS listener name, and loads the certificate by PROXY_HTTPS_CERT and
+// PROXY_HTTPS_KEY, returns the TLS config to serve the listeners.
+func listenHTTPS(ctx context.Context, environment env.Environment, name string, addrs []string) ([]*net.TCPListener, *tls.Config, error) {
+	cert, err := newTLSCertificate(ctx, name, environment.HttpsCert(), environment.HttpsKey())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%v certificate", name)
+	}
+
+	listeners, err := srsUpgrader.listenTCPs(ctx, name, addrs)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "listen %v addr %v", name, strings.Join(addrs, ","))
+	}
+	return listeners, cert.Config(), nil
+}
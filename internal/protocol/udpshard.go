@@ -0,0 +1,206 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/netutil"
+	"srsx/internal/utils"
+)
+
+// udpShard steers the UDP sessions to the proxy processes on one host, which share the same UDP port by
+// SO_REUSEPORT. The kernel distributes the packets to processes by the hash of addresses, which is not the
+// process that created the session, for example, the WHIP or WHEP of WebRTC is served by another process, so
+// each process owns the sessions by the hash of key, such as the ufrag of WebRTC, and forwards the packets of
+// other sessions to the owner process via loopback UDP. The owner process responds to the client via the
+// shared UDP port, so the client never knows about the shards.
+type udpShard struct {
+	// The name of shard, webrtc or srt.
+	name string
+	// The index of this process, in [0, count).
+	index int
+	// The number of processes, 1 to disable sharding.
+	count int
+	// The loopback UDP addresses of all shards, by index.
+	peers []*net.UDPAddr
+
+	// The loopback UDP listener of this shard, to receive the forwarded packets.
+	listener *net.UDPConn
+}
+
+// newUDPShardFromEnvironment creates the UDP shard by the shards and index in environment. The loopback ports
+// of shards are base+slot*shards+index, where the slot is 0 for WebRTC and 1 for SRT, to not conflict.
+func newUDPShardFromEnvironment(environment env.Environment, name string, slot int) (*udpShard, error) {
+	count, err := strconv.Atoi(environment.UDPShards())
+	if err != nil || count < 1 {
+		return nil, errors.Errorf("invalid udp shards %v", environment.UDPShards())
+	}
+	index, err := strconv.Atoi(environment.UDPShardIndex())
+	if err != nil || index < 0 || index >= count {
+		return nil, errors.Errorf("invalid udp shard index %v of %v shards", environment.UDPShardIndex(), count)
+	}
+	base, err := strconv.Atoi(environment.UDPShardPort())
+	if err != nil || base <= 0 || base+(slot+1)*count > 65535 {
+		return nil, errors.Errorf("invalid udp shard port %v", environment.UDPShardPort())
+	}
+	if count > 1 && environment.UDPReusePort() != "on" {
+		return nil, errors.Errorf("udp shards %v requires reuseport", count)
+	}
+
+	v := &udpShard{name: name, index: index, count: count}
+	for i := 0; i < count; i++ {
+		v.peers = append(v.peers, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: base + slot*count + i})
+	}
+	return v, nil
+}
+
+// Enabled returns whether the sessions are sharded to multiple processes.
+func (v *udpShard) Enabled() bool {
+	return v != nil && v.count > 1
+}
+
+// Owner returns the index of process which owns the session by key.
+func (v *udpShard) Owner(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(v.count))
+}
+
+// Run the loopback UDP listener, and handle the packets forwarded by other processes, with the client address.
+func (v *udpShard) Run(ctx context.Context, wg *stdSync.WaitGroup, handler func(addr *net.UDPAddr, data []byte) error) error {
+	listener, err := listenUDP(ctx, v.peers[v.index], false)
+	if err != nil {
+		return errors.Wrapf(err, "listen udp %v", v.peers[v.index])
+	}
+	v.listener = listener
+	logger.Df(ctx, "UDP shard %v %v/%v listen at %v", v.name, v.index, v.count, v.peers[v.index])
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			buf := make([]byte, 4096)
+			n, _, err := listener.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil || utils.IsClosedNetworkError(err) {
+					logger.Df(ctx, "UDP shard %v done", v.name)
+					return
+				}
+				logger.Wf(ctx, "UDP shard %v read failed, err=%+v", v.name, err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			addr, data, err := decodeShardPacket(buf[:n])
+			if err != nil {
+				logger.Wf(ctx, "UDP shard %v decode %vB failed, err=%+v", v.name, n, err)
+				continue
+			}
+
+			if err := handler(addr, data); err != nil {
+				logger.Wf(ctx, "UDP shard %v handle %vB failed, addr=%v, err=%+v", v.name, len(data), addr, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Forward the packet from client addr to the owner process.
+func (v *udpShard) Forward(owner int, addr *net.UDPAddr, data []byte) error {
+	if _, err := v.listener.WriteToUDP(encodeShardPacket(addr, data), v.peers[owner]); err != nil {
+		return errors.Wrapf(err, "forward %vB to shard %v", len(data), owner)
+	}
+	return nil
+}
+
+func (v *udpShard) Close() error {
+	if v != nil && v.listener != nil {
+		v.listener.Close()
+	}
+	return nil
+}
+
+// encodeShardPacket encodes the client address and packet, as the IP length in 1 byte, the IP, the port
+// in 2 bytes, and the packet.
+func encodeShardPacket(addr *net.UDPAddr, data []byte) []byte {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b := make([]byte, 0, 1+len(ip)+2+len(data))
+	b = append(b, byte(len(ip)))
+	b = append(b, ip...)
+	b = append(b, byte(addr.Port>>8), byte(addr.Port))
+	return append(b, data...)
+}
+
+// decodeShardPacket decodes the client address and packet, see encodeShardPacket.
+func decodeShardPacket(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, errors.Errorf("empty packet")
+	}
+	ipLen := int(b[0])
+	if (ipLen != net.IPv4len && ipLen != net.IPv6len) || len(b) < 1+ipLen+2 {
+		return nil, nil, errors.Errorf("invalid packet %vB, ip %vB", len(b), ipLen)
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, b[1:1+ipLen])
+	port := binary.BigEndian.Uint16(b[1+ipLen:])
+	return &net.UDPAddr{IP: ip, Port: int(port)}, b[1+ipLen+2:], nil
+}
+
+// listenUDP listens the UDP address, with SO_REUSEPORT if reusePort, so multiple processes share the port. The
+// socket is tuned for relaying packets by the platform.
+func listenUDP(ctx context.Context, saddr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if !reusePort {
+		c, err := net.ListenUDP("udp", saddr)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	} else {
+		lc := net.ListenConfig{Control: reusePortControl}
+		c, err := lc.ListenPacket(ctx, "udp", saddr.String())
+		if err != nil {
+			return nil, err
+		}
+		conn = c.(*net.UDPConn)
+	}
+
+	tuneUDP(ctx, conn)
+	return conn, nil
+}
+
+// dialUDP connects to the backend UDP address, and tunes the socket for relaying packets by the platform.
+func dialUDP(ctx context.Context, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tuneUDP(ctx, conn)
+	return conn, nil
+}
+
+// tuneUDP tunes the UDP socket, which is ignored if failed, because the socket still works with the defaults.
+func tuneUDP(ctx context.Context, conn *net.UDPConn) {
+	if err := netutil.TuneUDP(conn); err != nil {
+		logger.Wf(ctx, "ignore tune udp %v failed, err=%+v", conn.LocalAddr(), err)
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// The variable of the listener FDs inherited from the parent process by hot restart, like rtmp=3,http-api=4,
+// which is set by the parent process, not by users.
+const upgradeFDsVariable = "PROXY_UPGRADE_FDS"
+
+// The timeout to wait for the new process to be ready.
+const upgradeReadyTimeout = 30 * time.Second
+
+// The suffix of the loopback UDP socket passed to the new process, like webrtc-handoff, which receives the
+// packets of new sessions handed off by the old process.
+const upgradeHandoffSuffix = "-handoff"
+
+// listenerFiler is a listener which is able to duplicate its socket as a file, to pass to the new process.
+type listenerFiler interface {
+	File() (*os.File, error)
+}
+
+// proxyUpgrader upgrades the binary of proxy without downtime, like the smooth upgrade of SRS. It starts the new
+// binary with the listening sockets of all listeners, waits for the new process to be ready, then drains the old
+// process, so the new connections are never refused during deploys. Both processes share the sockets while the
+// old process is draining, the old process stops accepting the new TCP connections, and hands off the packets
+// of new UDP sessions to the new process via loopback UDP, because the kernel delivers the packets of the shared
+// UDP socket to either process.
+type proxyUpgrader struct {
+	// The files of listeners inherited from the parent process, key is the name of listener.
+	inherited map[string]*os.File
+	// The listeners to pass to the new process, key is the name of listener.
+	listeners map[string]listenerFiler
+	// The loopback UDP conns to hand off the packets of new sessions to the new process, key is the name of
+	// UDP listener, set when the new process is ready.
+	handoffs map[string]*net.UDPConn
+	// Whether upgrading.
+	upgrading bool
+	// The lock to protect the fields.
+	lock stdSync.Mutex
+}
+
+// The upgrader, to inherit the listeners from parent process, and pass the listeners to new process.
+var srsUpgrader = newProxyUpgrader(os.Getenv(upgradeFDsVariable))
+
+// newProxyUpgrader creates the upgrader with the FDs inherited from parent, like rtmp=3,http-api=4.
+func newProxyUpgrader(fds string) *proxyUpgrader {
+	v := &proxyUpgrader{
+		inherited: make(map[string]*os.File), listeners: make(map[string]listenerFiler),
+		handoffs: make(map[string]*net.UDPConn),
+	}
+	for _, item := range strings.Split(fds, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if fd, err := strconv.Atoi(kv[1]); err == nil && fd >= 3 {
+			v.inherited[kv[0]] = os.NewFile(uintptr(fd), kv[0])
+		}
+	}
+	return v
+}
+
+// inherit returns the file of listener name inherited from parent, nil if not inherited.
+func (v *proxyUpgrader) inherit(name string) *os.File {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	f := v.inherited[name]
+	delete(v.inherited, name)
+	return f
+}
+
+// register the listener name, to pass to the new process when upgrading.
+func (v *proxyUpgrader) register(name string, listener listenerFiler) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.listeners[name] = listener
+}
+
+// listenTCP listens the TCP addr for listener name, or uses the listener inherited from parent.
+func (v *proxyUpgrader) listenTCP(ctx context.Context, name, addr string) (*net.TCPListener, error) {
+	var listener *net.TCPListener
+	if f := v.inherit(name); f != nil {
+		defer f.Close()
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherit %v fd %v", name, f.Fd())
+		}
+		var ok bool
+		if listener, ok = l.(*net.TCPListener); !ok {
+			return nil, errors.Errorf("inherit %v fd %v not tcp", name, f.Fd())
+		}
+		logger.Df(ctx, "Inherit %v listener %v from parent", name, listener.Addr())
+	} else {
+		taddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve %v", addr)
+		}
+		if listener, err = net.ListenTCP("tcp", taddr); err != nil {
+			return nil, errors.Wrapf(err, "listen %v", addr)
+		}
+	}
+
+	v.register(name, listener)
+	return listener, nil
+}
+
+// listenTCPs listens the TCP addrs for listener name, the first one is named by name, and others are named
+// like name-1, see listenerName.
+func (v *proxyUpgrader) listenTCPs(ctx context.Context, name string, addrs []string) ([]*net.TCPListener, error) {
+	var listeners []*net.TCPListener
+	for i, addr := range addrs {
+		listener, err := v.listenTCP(ctx, listenerName(name, i), addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "listen %v", listenerName(name, i))
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenUDP listens the UDP saddr for listener name, or uses the socket inherited from parent.
+func (v *proxyUpgrader) listenUDP(ctx context.Context, name string, saddr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if f := v.inherit(name); f != nil {
+		defer f.Close()
+
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherit %v fd %v", name, f.Fd())
+		}
+		var ok bool
+		if conn, ok = c.(*net.UDPConn); !ok {
+			return nil, errors.Errorf("inherit %v fd %v not udp", name, f.Fd())
+		}
+		tuneUDP(ctx, conn)
+		logger.Df(ctx, "Inherit %v listener %v from parent", name, conn.LocalAddr())
+	} else {
+		var err error
+		if conn, err = listenUDP(ctx, saddr, reusePort); err != nil {
+			return nil, err
+		}
+	}
+
+	v.register(name, conn)
+	return conn, nil
+}
+
+// runHandoff receives the packets of new sessions handed off by the parent process for the UDP listener name, and
+// handles them as the packets from client addr, until ctx is done. Nothing to do if not upgraded from parent.
+func (v *proxyUpgrader) runHandoff(ctx context.Context, name string, wg *stdSync.WaitGroup, handler func(addr *net.UDPAddr, data []byte) error) error {
+	f := v.inherit(name + upgradeHandoffSuffix)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return errors.Wrapf(err, "inherit %v handoff fd %v", name, f.Fd())
+	}
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return errors.Errorf("inherit %v handoff fd %v not udp", name, f.Fd())
+	}
+	logger.Df(ctx, "Inherit %v handoff %v from parent", name, conn.LocalAddr())
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			buf := make([]byte, 4096)
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil || utils.IsClosedNetworkError(err) {
+					return
+				}
+				logger.Wf(ctx, "Handoff %v read failed, err=%+v", name, err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			addr, data, err := decodeShardPacket(buf[:n])
+			if err != nil {
+				logger.Wf(ctx, "Handoff %v decode %vB failed, err=%+v", name, n, err)
+				continue
+			}
+
+			if err := handler(addr, data); err != nil {
+				logger.Wf(ctx, "Handoff %v handle %vB failed, addr=%v, err=%+v", name, len(data), addr, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Handoff hands off the packet of a new session from client addr on the UDP listener name to the new process,
+// returns false if not upgraded.
+func (v *proxyUpgrader) Handoff(name string, addr *net.UDPAddr, data []byte) bool {
+	v.lock.Lock()
+	conn := v.handoffs[name]
+	v.lock.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	conn.Write(encodeShardPacket(addr, data))
+	return true
+}
+
+// Upgrade starts the new binary with the listeners, waits for it to be ready, then drains this process. Returns
+// the pid of new process.
+func (v *proxyUpgrader) Upgrade(ctx context.Context, environment env.Environment) (int, error) {
+	if environment.UDPShards() != "1" {
+		return 0, errors.Errorf("upgrade with udp shards %v", environment.UDPShards())
+	}
+	if SrsProxyDrainer.Draining() {
+		return 0, errors.Errorf("draining")
+	}
+
+	v.lock.Lock()
+	if v.upgrading {
+		v.lock.Unlock()
+		return 0, errors.Errorf("upgrading")
+	}
+	v.upgrading = true
+	v.lock.Unlock()
+
+	pid, err := v.upgrade(ctx)
+
+	v.lock.Lock()
+	v.upgrading = false
+	v.lock.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Drain this process, the new connections are accepted by the new process.
+	SrsProxyDrainer.Drain(ctx, "upgrade")
+	return pid, nil
+}
+
+func (v *proxyUpgrader) upgrade(ctx context.Context) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, errors.Wrapf(err, "get executable")
+	}
+
+	// Duplicate the sockets of listeners, the FD of the nth file is 3+n in new process.
+	v.lock.Lock()
+	names := make([]string, 0, len(v.listeners))
+	for name := range v.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*os.File
+	var fds []string
+	for _, name := range names {
+		f, err := v.listeners[name].File()
+		if err != nil {
+			v.lock.Unlock()
+			closeFiles(files)
+			return 0, errors.Wrapf(err, "dup %v listener", name)
+		}
+		fds = append(fds, fmt.Sprintf("%v=%v", name, 3+len(files)))
+		files = append(files, f)
+	}
+
+	// Create the loopback UDP sockets for the new process, to receive the new sessions handed off by this process.
+	handoffs := make(map[string]*net.UDPConn)
+	for _, name := range names {
+		if _, ok := v.listeners[name].(*net.UDPConn); !ok {
+			continue
+		}
+
+		f, conn, err := newHandoff()
+		if err != nil {
+			v.lock.Unlock()
+			closeFiles(files)
+			closeHandoffs(handoffs)
+			return 0, errors.Wrapf(err, "create %v handoff", name)
+		}
+		fds = append(fds, fmt.Sprintf("%v%v=%v", name, upgradeHandoffSuffix, 3+len(files)))
+		files = append(files, f)
+		handoffs[name] = conn
+	}
+	v.lock.Unlock()
+	defer closeFiles(files)
+
+	// The new process notifies ready by writing one line to the pipe, see PROXY_READY_FD.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, errors.Wrapf(err, "create pipe")
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, upgradeFDsVariable+"=") && !strings.HasPrefix(e, "PROXY_READY_FD=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%v=%v", upgradeFDsVariable, strings.Join(fds, ",")),
+		fmt.Sprintf("PROXY_READY_FD=%v", 3+len(files)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		closeHandoffs(handoffs)
+		return 0, errors.Wrapf(err, "start %v", executable)
+	}
+	logger.Df(ctx, "Upgrade start %v pid=%v, listeners=%v", executable, cmd.Process.Pid, strings.Join(fds, ","))
+
+	// Reap the new process if it quits before ready, and the pipe is closed.
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Wf(ctx, "Upgrade process %v quit, err %v", cmd.Process.Pid, err)
+		}
+	}()
+
+	ready := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		ready <- line
+	}()
+
+	select {
+	case line := <-ready:
+		if line == "" {
+			closeHandoffs(handoffs)
+			return 0, errors.Errorf("process %v quit before ready", cmd.Process.Pid)
+		}
+		logger.Df(ctx, "Upgrade process %v ready %v", cmd.Process.Pid, strings.TrimSpace(line))
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		closeHandoffs(handoffs)
+		return 0, errors.Errorf("process %v not ready in %v", cmd.Process.Pid, upgradeReadyTimeout)
+	}
+
+	// Hand off the new UDP sessions to the new process, which is ready.
+	v.lock.Lock()
+	closeHandoffs(v.handoffs)
+	v.handoffs = handoffs
+	v.lock.Unlock()
+	return cmd.Process.Pid, nil
+}
+
+// newHandoff creates a loopback UDP socket, returns its file to pass to the new process, and the conn to send
+// the packets to it.
+func newHandoff() (*os.File, *net.UDPConn, error) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "listen loopback udp")
+	}
+	defer listener.Close()
+
+	f, err := listener.File()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "dup loopback udp")
+	}
+
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "dial loopback udp %v", listener.LocalAddr())
+	}
+	return f, conn, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func closeHandoffs(handoffs map[string]*net.UDPConn) {
+	for _, conn := range handoffs {
+		conn.Close()
+	}
+}
+
+// UpgradeProxy upgrades the binary of proxy, see proxyUpgrader.
+func UpgradeProxy(ctx context.Context, environment env.Environment) (int, error) {
+	return srsUpgrader.Upgrade(ctx, environment)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package ratelimit
+
+import (
+	"context"
+	"math"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/store"
+)
+
+// Limiter limits the rate of requests of each key, such as the client IP, token or stream, by token
+// bucket, where the burst is the rate in one second.
+type Limiter interface {
+	// Take a token of key, returns zero if allowed, or the duration to retry after if exceeded.
+	Take(ctx context.Context, key string) (time.Duration, error)
+	// Rate returns the max number of requests per second of each key.
+	Rate() float64
+}
+
+// NewLimiterFromEnvironment creates a limiter of rate per second by the store in environment, memory or redis,
+// the name is used to isolate the keys of limiters in Redis.
+func NewLimiterFromEnvironment(environment env.Environment, name string, rate float64) (Limiter, error) {
+	switch environment.RateLimitStore() {
+	case "memory":
+		return NewMemoryLimiter(rate), nil
+	case "redis":
+		rdb, err := store.NewRedisClient(environment)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create redis client")
+		}
+		return NewRedisLimiter(rdb, environment.RedisKeyPrefix(), name, rate), nil
+	}
+	return nil, errors.Errorf("invalid rate limit store %v", environment.RateLimitStore())
+}
+
+// bucket is the token bucket of a key.
+type bucket struct {
+	// The available tokens.
+	tokens float64
+	// The time of last refill.
+	updatedAt time.Time
+}
+
+// memoryLimiter limits the rate in memory of this proxy.
+type memoryLimiter struct {
+	// The max number of requests per second of each key.
+	rate float64
+
+	// The token buckets, key is the key of limit.
+	buckets map[string]*bucket
+	// The time of last sweep of idle buckets.
+	sweepAt time.Time
+	// The lock to protect buckets.
+	lock stdSync.Mutex
+}
+
+// NewMemoryLimiter creates a limiter of rate per second in memory, which only limits the requests on this
+// proxy.
+func NewMemoryLimiter(rate float64) Limiter {
+	return &memoryLimiter{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+func (v *memoryLimiter) Rate() float64 {
+	return v.rate
+}
+
+func (v *memoryLimiter) Take(ctx context.Context, key string) (time.Duration, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	burst := math.Max(1, v.rate)
+
+	// Remove the idle buckets, which are full of tokens, at most once a minute.
+	if now.Sub(v.sweepAt) > time.Minute {
+		v.sweepAt = now
+		for k, b := range v.buckets {
+			if b.tokens+now.Sub(b.updatedAt).Seconds()*v.rate >= burst {
+				delete(v.buckets, k)
+			}
+		}
+	}
+
+	b, ok := v.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updatedAt: now}
+		v.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updatedAt).Seconds()*v.rate)
+	b.updatedAt = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+
+	return time.Duration((1 - b.tokens) / v.rate * float64(time.Second)), nil
+}
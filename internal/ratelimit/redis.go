@@ -0,0 +1,72 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"srsx/internal/errors"
+)
+
+// redisTokenBucket takes a token of the bucket in KEYS[1] atomically, where ARGV is the rate, burst and the
+// time in milliseconds. Returns the milliseconds to retry after, 0 if allowed. The bucket expires when it's
+// full, so the idle keys are removed by Redis.
+var redisTokenBucket = redis.NewScript(`
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local v = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens, ts = tonumber(v[1]), tonumber(v[2])
+if tokens == nil or ts == nil then
+  tokens, ts = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  retry = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return retry
+`)
+
+// redisLimiter limits the rate by the token buckets in Redis, shared by all proxies, so the limits hold
+// cluster-wide instead of per proxy. The time is of proxy, so the clocks of proxies should be synchronized.
+type redisLimiter struct {
+	// The redis client sdk.
+	rdb *redis.Client
+	// The prefix of keys in Redis, to share one Redis by multiple proxy clusters.
+	prefix string
+	// The name of limiter, to isolate the keys of limiters, such as http or cdn.
+	name string
+	// The max number of requests per second of each key.
+	rate float64
+}
+
+// NewRedisLimiter creates a limiter of rate per second by Redis, the name is used to isolate the keys of
+// limiters, and all keys are prefixed by prefix.
+func NewRedisLimiter(rdb *redis.Client, prefix, name string, rate float64) Limiter {
+	return &redisLimiter{rdb: rdb, prefix: prefix, name: name, rate: rate}
+}
+
+func (v *redisLimiter) Rate() float64 {
+	return v.rate
+}
+
+func (v *redisLimiter) Take(ctx context.Context, key string) (time.Duration, error) {
+	redisKey := fmt.Sprintf("%vsrs-proxy-ratelimit:%v:%v", v.prefix, v.name, key)
+	burst := math.Max(1, v.rate)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	retry, err := redisTokenBucket.Run(ctx, v.rdb, []string{redisKey}, v.rate, burst, now).Int64()
+	if err != nil {
+		return 0, errors.Wrapf(err, "take token of key=%v", redisKey)
+	}
+	return time.Duration(retry) * time.Millisecond, nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package relay
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"srsx/internal/errors"
+)
+
+// The max duration to search the next time of cron expression, for example, Feb 30 never matches.
+const cronMaxSearch = 5 * 366 * 24 * time.Hour
+
+// cronField is the bounds of a field of cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+// The fields of cron expression, minute, hour, day of month, month and day of week.
+var cronFields = []cronField{
+	{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7},
+}
+
+// cronExpression is the parsed cron expression in 5 fields, like "0 9 * * 1-5" for 09:00 on weekdays. Each
+// field is a list of values, ranges like 1-5, and steps like */15 or 0-30/10. The day of week is 0 to 7,
+// where both 0 and 7 are Sunday.
+type cronExpression struct {
+	// The original expression.
+	expression string
+	// The matched values of fields, in bits.
+	minute, hour, dom, month, dow uint64
+	// Whether day of month or day of week is restricted, not *.
+	domRestricted, dowRestricted bool
+}
+
+// parseCronExpression parses the expression in 5 fields.
+func parseCronExpression(expression string) (*cronExpression, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf("cron %v requires %v fields", expression, len(cronFields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse cron %v", expression)
+		}
+		bits[i] = b
+	}
+
+	// Both 0 and 7 are Sunday.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronExpression{
+		expression: expression,
+		minute:     bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"), dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a field like 1,3-5,*/10 to bits.
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		start, end, step := bounds.min, bounds.max, 1
+
+		rangePart := part
+		if index := strings.Index(part, "/"); index >= 0 {
+			rangePart = part[:index]
+			v, err := strconv.Atoi(part[index+1:])
+			if err != nil || v <= 0 {
+				return 0, errors.Errorf("invalid step %v of %v", part, bounds.name)
+			}
+			step = v
+		}
+
+		if rangePart != "*" {
+			var err error
+			if index := strings.Index(rangePart, "-"); index >= 0 {
+				start, err = strconv.Atoi(rangePart[:index])
+				if err == nil {
+					end, err = strconv.Atoi(rangePart[index+1:])
+				}
+			} else if start, err = strconv.Atoi(rangePart); err == nil && step == 1 {
+				end = start
+			}
+			if err != nil {
+				return 0, errors.Errorf("invalid %v of %v", part, bounds.name)
+			}
+		}
+
+		if start < bounds.min || end > bounds.max || start > end {
+			return 0, errors.Errorf("%v out of range %v-%v of %v", part, bounds.min, bounds.max, bounds.name)
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time matched after t, in the location of t, or zero if never matched.
+func (v *cronExpression) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	deadline := t.Add(cronMaxSearch)
+
+	for t.Before(deadline) {
+		if v.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !v.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if v.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if v.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Prev returns the last time matched not after t, in the location of t, or zero if never matched.
+func (v *cronExpression) Prev(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	deadline := t.Add(-cronMaxSearch)
+
+	for t.After(deadline) {
+		if v.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !v.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if v.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if v.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(-time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay returns whether the day matches. Like the standard cron, if both day of month and day of week
+// are restricted, the day matches either of them.
+func (v *cronExpression) matchDay(t time.Time) bool {
+	dom := v.dom&(1<<uint(t.Day())) != 0
+	dow := v.dow&(1<<uint(t.Weekday())) != 0
+	if v.domRestricted && v.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (v *cronExpression) String() string {
+	return v.expression
+}
@@ -0,0 +1,639 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/lb"
+	"srsx/internal/logger"
+	"srsx/internal/utils"
+)
+
+// The restart policies of task, the same as Docker.
+const (
+	// Always restart the task when it exits.
+	RestartAlways = "always"
+	// Restart the task only when it exits with error.
+	RestartOnFailure = "on-failure"
+	// Never restart the task.
+	RestartNever = "never"
+)
+
+// The states of task.
+const (
+	// The process is starting, for example, picking the backend server.
+	StateStarting = "starting"
+	// The process is running.
+	StateRunning = "running"
+	// The process exited, and waits to restart.
+	StateRestarting = "restarting"
+	// The process exited without error, and not restarted.
+	StateStopped = "stopped"
+	// The process exited with error, and not restarted.
+	StateFailed = "failed"
+)
+
+// The max backoff to restart the task, which doubles from one second.
+const relayMaxBackoff = 30 * time.Second
+
+// The task which runs longer than this duration is stable, so the backoff is reset.
+const relayStableDuration = 30 * time.Second
+
+// The max bytes of the stderr of process kept, for the error of task.
+const relayStderrSize = 1024
+
+// The interval to check the IP of backend hostname, to restart the process publishing to the stale IP.
+const relayResolveInterval = 5 * time.Second
+
+// The schemes of input and output, only the streams, so FFmpeg never reads or writes the local files.
+var relaySchemes = map[string]bool{
+	"rtsp": true, "rtsps": true, "rtmp": true, "rtmps": true, "srt": true, "http": true, "https": true,
+}
+
+// The output options of FFmpeg allowed in args, the value is whether the option takes a value. The options
+// which read or write files, such as the filters, are not allowed.
+var relayArgs = map[string]bool{
+	"-c": true, "-c:v": true, "-c:a": true, "-codec": true, "-vcodec": true, "-acodec": true,
+	"-b:v": true, "-b:a": true, "-maxrate": true, "-bufsize": true, "-g": true, "-r": true, "-s": true,
+	"-ar": true, "-ac": true, "-preset": true, "-tune": true, "-profile:v": true, "-level": true,
+	"-pix_fmt": true, "-bsf:v": true, "-bsf:a": true, "-f": true, "-an": false, "-vn": false,
+}
+
+// The value of output option, like flv, libx264, 2000k or 1280x720, without any path or URL.
+var relayArgValue = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+
+// Task is a relay task, which pulls the input, such as an RTSP camera, and pushes to the output, or
+// publishes into the cluster via the backend server picked for the stream.
+type Task struct {
+	// The id of task, generated if empty.
+	ID string `json:"id"`
+	// The input URL to pull, such as rtsp://192.168.1.10/cam or a file.
+	Input string `json:"input"`
+	// The stream to publish into the cluster, like rtmp://example.com/live/camera1 or /live/camera1, which
+	// is published to the backend server picked by load balancer, when the output is empty.
+	Stream string `json:"stream,omitempty"`
+	// The output URL to push, such as rtmp://other.server/live/camera1, overrides the stream.
+	Output string `json:"output,omitempty"`
+	// The output options of FFmpeg in the allow-list, default to -c copy -f flv.
+	Args []string `json:"args,omitempty"`
+	// The restart policy, always, on-failure or never, default to always.
+	Restart string `json:"restart,omitempty"`
+	// The max number of restarts, 0 for unlimited.
+	MaxRestarts int `json:"max_restarts,omitempty"`
+}
+
+// Status is the status of a task.
+type Status struct {
+	*Task
+	// The state, running, restarting, stopped or failed.
+	State string `json:"state"`
+	// The process id of FFmpeg, when running.
+	PID int `json:"pid,omitempty"`
+	// The number of restarts.
+	Restarts int `json:"restarts"`
+	// The time of process started.
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// The output URL of the running process.
+	URL string `json:"url,omitempty"`
+	// The error of last exited process.
+	Error string `json:"error,omitempty"`
+	// Whether the task is not saved, such as started by schedule.
+	Transient bool `json:"transient,omitempty"`
+}
+
+// Manager spawns and supervises the relay tasks by FFmpeg, and restarts the exited tasks by the restart
+// policy, with exponential backoff.
+type Manager interface {
+	// Add a task and start it, returns the status.
+	Add(ctx context.Context, task *Task) (*Status, error)
+	// Run a task without saving it, such as started by schedule, returns the status.
+	Run(ctx context.Context, task *Task) (*Status, error)
+	// Remove a task by id, stops the process.
+	Remove(ctx context.Context, id string) error
+	// List the status of tasks, sorted by id.
+	List() []*Status
+	// Close the manager, stops all processes.
+	Close() error
+}
+
+type managerImpl struct {
+	// The path of FFmpeg.
+	ffmpeg string
+	// The file to load and save the tasks, empty if not configured.
+	filename string
+
+	// The context of all tasks, cancelled when closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The wait group for all tasks.
+	wg stdSync.WaitGroup
+
+	// The tasks, key is the task id.
+	tasks map[string]*relayTask
+	// The lock to protect tasks.
+	lock stdSync.Mutex
+}
+
+// NewManager creates a relay manager, loads and starts the tasks from filename if not empty.
+func NewManager(ctx context.Context, ffmpeg, filename string) (Manager, error) {
+	v := &managerImpl{ffmpeg: ffmpeg, filename: filename, tasks: make(map[string]*relayTask)}
+	v.ctx, v.cancel = context.WithCancel(ctx)
+	if filename == "" {
+		return v, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return v, nil
+		}
+		return nil, errors.Wrapf(err, "read %v", filename)
+	}
+
+	var tasks []*Task
+	if err := json.Unmarshal(b, &tasks); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	for _, task := range tasks {
+		if err := task.initialize(); err != nil {
+			return nil, errors.Wrapf(err, "invalid task %v in %v", task.ID, filename)
+		}
+		v.start(task, true)
+	}
+	logger.Df(ctx, "Relay load %v tasks from %v", len(tasks), filename)
+	return v, nil
+}
+
+// NewManagerFromEnvironment creates the relay manager by the FFmpeg and task file in environment.
+func NewManagerFromEnvironment(ctx context.Context, environment env.Environment) (Manager, error) {
+	return NewManager(ctx, environment.RelayFFmpeg(), environment.RelayFile())
+}
+
+func (v *managerImpl) Add(ctx context.Context, task *Task) (*Status, error) {
+	return v.add(ctx, task, true)
+}
+
+func (v *managerImpl) Run(ctx context.Context, task *Task) (*Status, error) {
+	return v.add(ctx, task, false)
+}
+
+// add the task and start it, and save the tasks if persist.
+func (v *managerImpl) add(ctx context.Context, task *Task, persist bool) (*Status, error) {
+	if err := task.initialize(); err != nil {
+		return nil, errors.Wrapf(err, "invalid task")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.ctx.Err() != nil {
+		return nil, errors.Errorf("relay manager closed")
+	}
+	if _, ok := v.tasks[task.ID]; ok {
+		return nil, errors.Errorf("task %v exists", task.ID)
+	}
+
+	t := v.start(task, persist)
+	if persist {
+		if err := v.save(); err != nil {
+			delete(v.tasks, task.ID)
+			t.cancel()
+			return nil, errors.Wrapf(err, "save tasks")
+		}
+	}
+
+	logger.Df(ctx, "Relay add task %v, input=%v, stream=%v, output=%v, restart=%v",
+		task.ID, task.Input, task.Stream, task.Output, task.Restart)
+	return t.status(), nil
+}
+
+func (v *managerImpl) Remove(ctx context.Context, id string) error {
+	v.lock.Lock()
+	t, ok := v.tasks[id]
+	if ok {
+		delete(v.tasks, id)
+	}
+	err := v.save()
+	v.lock.Unlock()
+
+	if !ok {
+		return errors.Errorf("task %v not found", id)
+	}
+
+	// Stop the process and wait for the task to quit.
+	t.cancel()
+	<-t.done
+
+	if err != nil {
+		return errors.Wrapf(err, "save tasks")
+	}
+	logger.Df(ctx, "Relay remove task %v", id)
+	return nil
+}
+
+func (v *managerImpl) List() []*Status {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	statuses := make([]*Status, 0, len(v.tasks))
+	for _, t := range v.tasks {
+		statuses = append(statuses, t.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses
+}
+
+func (v *managerImpl) Close() error {
+	v.cancel()
+	v.wg.Wait()
+	return nil
+}
+
+// start the task in goroutine, the caller should hold the lock.
+func (v *managerImpl) start(task *Task, persist bool) *relayTask {
+	t := &relayTask{
+		task: task, ffmpeg: v.ffmpeg, persist: persist, state: StateStarting, done: make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(logger.WithContext(v.ctx))
+	t.cancel = cancel
+	v.tasks[task.ID] = t
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer close(t.done)
+		t.run(ctx)
+	}()
+	return t
+}
+
+// save the tasks to file if configured, the caller should hold the lock.
+func (v *managerImpl) save() error {
+	if v.filename == "" {
+		return nil
+	}
+
+	tasks := make([]*Task, 0, len(v.tasks))
+	for _, t := range v.tasks {
+		if t.persist {
+			tasks = append(tasks, t.task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].ID < tasks[j].ID
+	})
+
+	b, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal tasks")
+	}
+
+	// Write to a temporary file then rename, to avoid a corrupted file when crashing.
+	tmpfile := v.filename + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, b, 0644); err != nil {
+		return errors.Wrapf(err, "write %v", tmpfile)
+	}
+	if err := os.Rename(tmpfile, v.filename); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmpfile, v.filename)
+	}
+	return nil
+}
+
+// initialize validates the task, and sets the default values.
+func (v *Task) initialize() error {
+	if v.ID == "" {
+		v.ID = logger.GenerateContextID()
+	}
+	if strings.Contains(v.ID, "/") {
+		return errors.Errorf("invalid id %v", v.ID)
+	}
+	if v.Input == "" {
+		return errors.Errorf("empty input")
+	}
+	if err := validateStreamURL(v.Input); err != nil {
+		return errors.Wrapf(err, "invalid input")
+	}
+	if v.Output == "" && v.Stream == "" {
+		return errors.Errorf("empty stream and output")
+	}
+	if v.Output == "" {
+		if _, err := utils.BuildStreamURL(v.Stream); err != nil {
+			return errors.Wrapf(err, "invalid stream %v", v.Stream)
+		}
+	} else if err := validateStreamURL(v.Output); err != nil {
+		return errors.Wrapf(err, "invalid output")
+	}
+	if err := validateArgs(v.Args); err != nil {
+		return errors.Wrapf(err, "invalid args")
+	}
+
+	if v.Restart == "" {
+		v.Restart = RestartAlways
+	}
+	if v.Restart != RestartAlways && v.Restart != RestartOnFailure && v.Restart != RestartNever {
+		return errors.Errorf("invalid restart %v", v.Restart)
+	}
+	if v.MaxRestarts < 0 {
+		return errors.Errorf("invalid max restarts %v", v.MaxRestarts)
+	}
+	return nil
+}
+
+// validateStreamURL checks the URL of input or output is a stream in the allowed schemes, rather than a file.
+func validateStreamURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", u)
+	}
+	if !relaySchemes[strings.ToLower(parsed.Scheme)] || parsed.Host == "" {
+		return errors.Errorf("url %v not in schemes rtsp, rtsps, rtmp, rtmps, srt, http or https", u)
+	}
+	return nil
+}
+
+// validateArgs checks the output options of FFmpeg are in the allow-list, and the values are not paths or URLs.
+func validateArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		takesValue, ok := relayArgs[args[i]]
+		if !ok {
+			return errors.Errorf("option %v not allowed", args[i])
+		}
+		if !takesValue {
+			continue
+		}
+
+		if i++; i >= len(args) {
+			return errors.Errorf("no value of option %v", args[i-1])
+		}
+		if !relayArgValue.MatchString(args[i]) {
+			return errors.Errorf("invalid value %v of option %v", args[i], args[i-1])
+		}
+	}
+	return nil
+}
+
+// relayTask supervises the FFmpeg process of a task.
+type relayTask struct {
+	// The task.
+	task *Task
+	// The path of FFmpeg.
+	ffmpeg string
+	// Whether the task is saved to file.
+	persist bool
+	// Cancel the task, and closed done when quit.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// The status, protected by lock.
+	state     string
+	pid       int
+	restarts  int
+	startedAt time.Time
+	url       string
+	err       error
+	lock      stdSync.Mutex
+}
+
+func (v *relayTask) status() *Status {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	s := &Status{
+		Task: v.task, State: v.state, PID: v.pid, Restarts: v.restarts, StartedAt: v.startedAt, URL: v.url,
+		Transient: !v.persist,
+	}
+	if v.err != nil {
+		s.Error = v.err.Error()
+	}
+	return s
+}
+
+// run the task until cancelled, or not restarted by the policy.
+func (v *relayTask) run(ctx context.Context) {
+	task := v.task
+	backoff := time.Second
+
+	for {
+		starttime := time.Now()
+		err := v.cycle(ctx)
+
+		v.lock.Lock()
+		v.pid, v.url, v.err = 0, "", err
+		v.lock.Unlock()
+
+		if ctx.Err() != nil {
+			v.setState(StateStopped)
+			logger.Df(ctx, "Relay task %v stopped", task.ID)
+			return
+		}
+
+		// Whether restart the task by policy.
+		state := StateStopped
+		if err != nil {
+			state = StateFailed
+		}
+		if task.Restart == RestartNever || (task.Restart == RestartOnFailure && err == nil) {
+			v.setState(state)
+			logger.Wf(ctx, "Relay task %v exited, state=%v, err %v", task.ID, state, err)
+			return
+		}
+		if task.MaxRestarts > 0 && v.restarts >= task.MaxRestarts {
+			v.setState(state)
+			logger.Wf(ctx, "Relay task %v exited, state=%v, restarts=%v, err %v", task.ID, state, v.restarts, err)
+			return
+		}
+
+		// Restart with backoff, which is reset if the process runs stable.
+		if time.Since(starttime) > relayStableDuration {
+			backoff = time.Second
+		}
+		v.setState(StateRestarting)
+		logger.Wf(ctx, "Relay task %v restart in %v, restarts=%v, err %v", task.ID, backoff, v.restarts, err)
+
+		select {
+		case <-ctx.Done():
+			v.setState(StateStopped)
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > relayMaxBackoff {
+			backoff = relayMaxBackoff
+		}
+		v.lock.Lock()
+		v.state, v.restarts = StateStarting, v.restarts+1
+		v.lock.Unlock()
+	}
+}
+
+func (v *relayTask) setState(state string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.state = state
+}
+
+// cycle runs the FFmpeg process once, returns the error if exits with error.
+func (v *relayTask) cycle(ctx context.Context) error {
+	task := v.task
+
+	// Publish to the backend server picked for the stream, if no output.
+	output := task.Output
+	var host, ip string
+	if output == "" {
+		backend, u, resolved, err := v.pick(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "pick backend for %v", task.Stream)
+		}
+		output, host, ip = u, backend.IP, resolved
+
+		release := lb.SrsServerConnections.Acquire(backend)
+		defer release()
+	}
+
+	// Restart the process when the IP of backend hostname changed, instead of publishing to the stale IP.
+	processCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var changed string
+	if host != ip {
+		go func() {
+			ticker := time.NewTicker(relayResolveInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-processCtx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				if newIP, err := lb.SrsServerResolver.Resolve(processCtx, host); err == nil && newIP != ip {
+					v.lock.Lock()
+					changed = newIP
+					v.lock.Unlock()
+
+					logger.Wf(ctx, "Relay task %v backend host %v changed from %v to %v, restart", task.ID, host, ip, newIP)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if strings.HasPrefix(task.Input, "rtsp://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args, "-i", task.Input)
+	if len(task.Args) > 0 {
+		args = append(args, task.Args...)
+	} else {
+		args = append(args, "-c", "copy", "-f", "flv")
+	}
+	args = append(args, output)
+
+	stderr := &tailWriter{max: relayStderrSize}
+	cmd := exec.CommandContext(processCtx, v.ffmpeg, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start %v", v.ffmpeg)
+	}
+
+	v.lock.Lock()
+	v.state, v.pid, v.startedAt, v.url = StateRunning, cmd.Process.Pid, time.Now(), output
+	v.lock.Unlock()
+	logger.Df(ctx, "Relay task %v started, pid=%v, input=%v, output=%v", task.ID, cmd.Process.Pid, task.Input, output)
+
+	err := cmd.Wait()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if changed != "" {
+		return errors.Errorf("backend host %v changed from %v to %v", host, ip, changed)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "ffmpeg exit, %v", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// pick the backend server for the stream, returns the RTMP URL to publish, and the IP of backend.
+func (v *relayTask) pick(ctx context.Context) (*lb.SRSServer, string, string, error) {
+	streamURL, err := utils.BuildStreamURL(v.task.Stream)
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "build stream url %v", v.task.Stream)
+	}
+
+	backend, err := lb.SrsLoadBalancer.PickForPublish(ctx, streamURL)
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "pick backend for %v", streamURL)
+	}
+	if len(backend.RTMP) == 0 {
+		return nil, "", "", errors.Errorf("no rtmp server %+v for %v", backend, streamURL)
+	}
+
+	_, _, port, err := utils.ParseListenEndpoint(backend.RTMP[0])
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "parse rtmp port %v of %v", backend.RTMP[0], backend)
+	}
+
+	// The stream URL is in vhost/app/stream schema, and the vhost is passed by query of SRS.
+	vhost, appStream := streamURL, ""
+	if index := strings.Index(streamURL, "/"); index >= 0 {
+		vhost, appStream = streamURL[:index], streamURL[index:]
+	}
+	ip, err := lb.SrsServerResolver.Resolve(ctx, backend.IP)
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "resolve backend %v", backend)
+	}
+	u := fmt.Sprintf("rtmp://%v:%v%v", ip, port, appStream)
+	if vhost != "__defaultVhost__" {
+		u += "?vhost=" + url.QueryEscape(vhost)
+	}
+	return backend, u, ip, nil
+}
+
+// tailWriter keeps the last bytes written, such as the stderr of process.
+type tailWriter struct {
+	// The max bytes to keep.
+	max int
+	// The bytes kept, protected by lock.
+	b    []byte
+	lock stdSync.Mutex
+}
+
+func (v *tailWriter) Write(p []byte) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.b = append(v.b, p...); len(v.b) > v.max {
+		v.b = v.b[len(v.b)-v.max:]
+	}
+	return len(p), nil
+}
+
+func (v *tailWriter) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return string(v.b)
+}
+
+// SrsRelayManager is the global relay manager, which has no task by default.
+var SrsRelayManager, _ = NewManager(context.Background(), "ffmpeg", "")
@@ -0,0 +1,375 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+	"srsx/internal/store"
+)
+
+// The interval to reload the schedules from state store, which might be added by other proxies.
+const scheduleReloadInterval = 10 * time.Second
+
+// The interval to retry starting the task of schedule, when failed.
+const scheduleRetryInterval = 10 * time.Second
+
+// Schedule is a cron-like schedule of relay task, which starts the task at the start time and stops it at
+// the stop time, for example, pulls a feed only during business hours.
+type Schedule struct {
+	// The id of schedule, also the id of task, generated if empty.
+	ID string `json:"id"`
+	// The cron expression to start the task, like "0 9 * * 1-5" for 09:00 on weekdays. The task runs when
+	// the last start time is later than the last stop time.
+	Start string `json:"start"`
+	// The cron expression to stop the task, like "0 18 * * 1-5" for 18:00 on weekdays.
+	Stop string `json:"stop"`
+	// The timezone of cron expressions, like Asia/Shanghai, default to local.
+	Timezone string `json:"timezone,omitempty"`
+	// The relay task to run.
+	Task *Task `json:"task"`
+}
+
+// ScheduleStatus is the status of a schedule.
+type ScheduleStatus struct {
+	*Schedule
+	// Whether in the window of schedule, where the task should be running.
+	Active bool `json:"active"`
+	// The next time to start the task.
+	NextStart time.Time `json:"next_start,omitempty"`
+	// The next time to stop the task.
+	NextStop time.Time `json:"next_stop,omitempty"`
+}
+
+// Scheduler starts and stops the relay tasks by schedules, which are persisted in the state store, so the
+// schedules survive restarts, and the task is started if restarted in the window of schedule.
+type Scheduler interface {
+	// Add a schedule, returns the status.
+	Add(ctx context.Context, schedule *Schedule) (*ScheduleStatus, error)
+	// Remove a schedule by id, stops the task if started.
+	Remove(ctx context.Context, id string) error
+	// List the status of schedules, sorted by id.
+	List() []*ScheduleStatus
+	// Close the scheduler, the started tasks are stopped by closing the relay manager.
+	Close() error
+}
+
+type schedulerImpl struct {
+	// The relay manager to run the tasks.
+	manager Manager
+	// The state store to persist the schedules.
+	store store.Store
+	// Whether to run the tasks on this proxy.
+	run bool
+
+	// The context of scheduler, cancelled when closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The wait group for scheduler.
+	wg stdSync.WaitGroup
+
+	// The schedules, key is the schedule id.
+	schedules map[string]*relaySchedule
+	// The lock to protect schedules.
+	lock stdSync.Mutex
+}
+
+// NewScheduler creates a relay scheduler, loads the schedules from s, and runs the tasks by manager if run.
+func NewScheduler(ctx context.Context, manager Manager, s store.Store, run bool) (Scheduler, error) {
+	v := &schedulerImpl{manager: manager, store: s, run: run, schedules: make(map[string]*relaySchedule)}
+	v.ctx, v.cancel = context.WithCancel(ctx)
+
+	if err := v.reload(ctx); err != nil {
+		return nil, errors.Wrapf(err, "load schedules")
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		v.loop(logger.WithContext(v.ctx))
+	}()
+	return v, nil
+}
+
+// NewSchedulerFromEnvironment creates the relay scheduler, which runs the tasks if enabled in environment.
+func NewSchedulerFromEnvironment(
+	ctx context.Context, environment env.Environment, manager Manager, s store.Store,
+) (Scheduler, error) {
+	return NewScheduler(ctx, manager, s, environment.RelayScheduler() == "on")
+}
+
+func (v *schedulerImpl) Add(ctx context.Context, schedule *Schedule) (*ScheduleStatus, error) {
+	r, err := newRelaySchedule(schedule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid schedule")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.ctx.Err() != nil {
+		return nil, errors.Errorf("relay scheduler closed")
+	}
+	if _, ok := v.schedules[schedule.ID]; ok {
+		return nil, errors.Errorf("schedule %v exists", schedule.ID)
+	}
+
+	b, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal schedule")
+	}
+	if err := v.store.Set(ctx, v.key(schedule.ID), b, 0); err != nil {
+		return nil, errors.Wrapf(err, "save schedule %v", schedule.ID)
+	}
+	v.schedules[schedule.ID] = r
+
+	logger.Df(ctx, "Relay add schedule %v, start=%v, stop=%v, timezone=%v, input=%v",
+		schedule.ID, schedule.Start, schedule.Stop, schedule.Timezone, schedule.Task.Input)
+	return r.status(time.Now()), nil
+}
+
+func (v *schedulerImpl) Remove(ctx context.Context, id string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r, ok := v.schedules[id]
+	if !ok {
+		return errors.Errorf("schedule %v not found", id)
+	}
+	if err := v.store.Delete(ctx, v.key(id)); err != nil {
+		return errors.Wrapf(err, "delete schedule %v", id)
+	}
+	delete(v.schedules, id)
+	v.stop(ctx, r)
+
+	logger.Df(ctx, "Relay remove schedule %v", id)
+	return nil
+}
+
+func (v *schedulerImpl) List() []*ScheduleStatus {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	statuses := make([]*ScheduleStatus, 0, len(v.schedules))
+	for _, r := range v.schedules {
+		statuses = append(statuses, r.status(now))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses
+}
+
+func (v *schedulerImpl) Close() error {
+	v.cancel()
+	v.wg.Wait()
+	return nil
+}
+
+// loop reloads the schedules and starts or stops the tasks, until closed.
+func (v *schedulerImpl) loop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	reloadAt := time.Now().Add(scheduleReloadInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if now := time.Now(); now.After(reloadAt) {
+			reloadAt = now.Add(scheduleReloadInterval)
+			if err := v.reload(ctx); err != nil {
+				logger.Wf(ctx, "Relay reload schedules failed, %v", err)
+			}
+		}
+
+		if v.run {
+			v.evaluate(ctx, time.Now())
+		}
+	}
+}
+
+// reload the schedules from state store, keeps the state of existing schedules, and stops the tasks of
+// the schedules removed by other proxies.
+func (v *schedulerImpl) reload(ctx context.Context) error {
+	// Hold the lock when scanning, to not remove the schedule added meanwhile.
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	loaded := make(map[string]*relaySchedule)
+	if err := v.store.Scan(ctx, v.key(""), func(k string, b []byte) bool {
+		var schedule Schedule
+		if err := json.Unmarshal(b, &schedule); err != nil {
+			logger.Wf(ctx, "Relay ignore invalid schedule key=%v, %v", k, string(b))
+			return true
+		}
+		r, err := newRelaySchedule(&schedule)
+		if err != nil {
+			logger.Wf(ctx, "Relay ignore invalid schedule key=%v, %v", k, err)
+			return true
+		}
+		loaded[schedule.ID] = r
+		return true
+	}); err != nil {
+		return errors.Wrapf(err, "scan schedules")
+	}
+
+	for id, r := range v.schedules {
+		if _, ok := loaded[id]; !ok {
+			delete(v.schedules, id)
+			v.stop(ctx, r)
+			logger.Df(ctx, "Relay schedule %v removed", id)
+		}
+	}
+	for id, r := range loaded {
+		if _, ok := v.schedules[id]; !ok {
+			v.schedules[id] = r
+		}
+	}
+	return nil
+}
+
+// evaluate starts the tasks in the window of schedules, and stops the tasks out of window.
+func (v *schedulerImpl) evaluate(ctx context.Context, now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, r := range v.schedules {
+		if now.Before(r.checkAt) {
+			continue
+		}
+
+		active, nextStart, nextStop := r.window(now)
+		r.checkAt = earliest(nextStart, nextStop, now.Add(time.Hour))
+
+		if active && !r.running {
+			// Copy the task, because the task is initialized and referenced by the relay manager.
+			task := *r.schedule.Task
+			if _, err := v.manager.Run(ctx, &task); err != nil {
+				logger.Wf(ctx, "Relay schedule %v start task failed, %v", r.schedule.ID, err)
+				r.checkAt = now.Add(scheduleRetryInterval)
+				continue
+			}
+			r.running = true
+			logger.Df(ctx, "Relay schedule %v start task, stop at %v", r.schedule.ID, nextStop)
+		} else if !active && r.running {
+			v.stop(ctx, r)
+			logger.Df(ctx, "Relay schedule %v stop task, start at %v", r.schedule.ID, nextStart)
+		}
+	}
+}
+
+// stop the task of schedule if started, the caller should hold the lock.
+func (v *schedulerImpl) stop(ctx context.Context, r *relaySchedule) {
+	if !r.running {
+		return
+	}
+	r.running = false
+
+	if err := v.manager.Remove(ctx, r.schedule.ID); err != nil {
+		logger.Wf(ctx, "Relay schedule %v stop task failed, %v", r.schedule.ID, err)
+	}
+}
+
+func (v *schedulerImpl) key(id string) string {
+	return fmt.Sprintf("srs-proxy-relay-schedule:%v", id)
+}
+
+// relaySchedule is a parsed schedule, and the state of its task.
+type relaySchedule struct {
+	// The schedule.
+	schedule *Schedule
+	// The parsed cron expressions.
+	start, stop *cronExpression
+	// The location of cron expressions.
+	location *time.Location
+
+	// Whether the task is started by scheduler, accessed by the scheduler lock.
+	running bool
+	// The time to check the window again, accessed by the scheduler lock.
+	checkAt time.Time
+}
+
+// newRelaySchedule validates the schedule, sets the default values, and parses the cron expressions.
+func newRelaySchedule(schedule *Schedule) (*relaySchedule, error) {
+	if schedule.ID == "" {
+		schedule.ID = logger.GenerateContextID()
+	}
+	if strings.Contains(schedule.ID, "/") {
+		return nil, errors.Errorf("invalid id %v", schedule.ID)
+	}
+	if schedule.Task == nil {
+		return nil, errors.Errorf("empty task")
+	}
+
+	// The task is identified by the schedule id.
+	schedule.Task.ID = schedule.ID
+	if err := schedule.Task.initialize(); err != nil {
+		return nil, errors.Wrapf(err, "invalid task")
+	}
+
+	v := &relaySchedule{schedule: schedule, location: time.Local}
+	if schedule.Timezone != "" {
+		location, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timezone %v", schedule.Timezone)
+		}
+		v.location = location
+	}
+
+	var err error
+	if v.start, err = parseCronExpression(schedule.Start); err != nil {
+		return nil, errors.Wrapf(err, "invalid start")
+	}
+	if v.stop, err = parseCronExpression(schedule.Stop); err != nil {
+		return nil, errors.Wrapf(err, "invalid stop")
+	}
+
+	now := time.Now().In(v.location)
+	if v.start.Next(now).IsZero() || v.stop.Next(now).IsZero() {
+		return nil, errors.Errorf("start %v or stop %v never matches", schedule.Start, schedule.Stop)
+	}
+	return v, nil
+}
+
+// window returns whether now is in the window of schedule, where the last start is later than the last
+// stop, and the next times to start and stop.
+func (v *relaySchedule) window(now time.Time) (active bool, nextStart, nextStop time.Time) {
+	now = now.In(v.location)
+	lastStart, lastStop := v.start.Prev(now), v.stop.Prev(now)
+	active = !lastStart.IsZero() && lastStart.After(lastStop)
+	return active, v.start.Next(now), v.stop.Next(now)
+}
+
+func (v *relaySchedule) status(now time.Time) *ScheduleStatus {
+	active, nextStart, nextStop := v.window(now)
+	return &ScheduleStatus{Schedule: v.schedule, Active: active, NextStart: nextStart, NextStop: nextStop}
+}
+
+// earliest returns the earliest non-zero time of times.
+func earliest(times ...time.Time) time.Time {
+	var t time.Time
+	for _, v := range times {
+		if !v.IsZero() && (t.IsZero() || v.Before(t)) {
+			t = v
+		}
+	}
+	return t
+}
+
+// SrsRelayScheduler is the global relay scheduler, which has no schedule by default.
+var SrsRelayScheduler, _ = NewScheduler(context.Background(), SrsRelayManager, store.NewMemoryStore(), false)
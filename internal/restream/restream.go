@@ -0,0 +1,363 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package restream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/dryrun"
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/geo"
+	"srsx/internal/logger"
+	"srsx/internal/session"
+)
+
+// The min distance in kilometers to detect the impossible geolocation jump, to ignore the inaccuracy
+// of geolocation database.
+const minJumpDistance = 100.0
+
+// Client is a client to check by the detector.
+type Client struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string
+	// The address of client, in ip:port or ip.
+	RemoteAddr string
+	// The query of client request, which has the token.
+	Query url.Values
+	// The header of HTTP request, nil for other protocols.
+	Header http.Header
+	// The client session, which is kicked when token is revoked, nil for stateless client such as HLS.
+	Session *session.Session
+}
+
+// RevokedToken is a token revoked automatically, because it's used for restreaming.
+type RevokedToken struct {
+	// The token.
+	Token string `json:"token"`
+	// The reason of revocation.
+	Reason string `json:"reason"`
+	// The time revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+	// The time to expire the revocation.
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// Detector detects the unauthorized restreaming by the heuristics of tokens, such as a single token
+// used from many IPs or ASNs, or impossible geolocation jumps.
+type Detector interface {
+	// Check the client, returns error if the token of client is revoked. The client without token is
+	// always allowed.
+	Check(ctx context.Context, c *Client) error
+	// Revoked returns the revoked tokens.
+	Revoked() []*RevokedToken
+	// Restore the revoked token, returns false if not revoked.
+	Restore(token string) bool
+}
+
+type nopDetector struct{}
+
+// NewNopDetector creates a detector which allows all clients.
+func NewNopDetector() Detector {
+	return &nopDetector{}
+}
+
+func (v *nopDetector) Check(ctx context.Context, c *Client) error {
+	return nil
+}
+
+func (v *nopDetector) Revoked() []*RevokedToken {
+	return []*RevokedToken{}
+}
+
+func (v *nopDetector) Restore(token string) bool {
+	return false
+}
+
+// observation is a client using the token.
+type observation struct {
+	// The IP of client.
+	ip string
+	// The location of client.
+	location *geo.Location
+	// The client session, nil for stateless client.
+	session *session.Session
+	// The time observed.
+	at time.Time
+}
+
+// tokenState is the recent observations of token.
+type tokenState struct {
+	// The observations in window, in the order of time.
+	observations []*observation
+	// The time of last alert, to alert once in window.
+	alertAt time.Time
+}
+
+type detectorImpl struct {
+	// The name of query parameter of token.
+	tokenParam string
+	// The window of observations.
+	window time.Duration
+	// The max number of IPs for a token in window.
+	maxIPs int
+	// The max number of ASNs for a token in window.
+	maxASNs int
+	// The max speed in km/h between two locations of a token.
+	maxSpeed float64
+	// The duration to revoke the token, zero to disable revocation.
+	revokeDuration time.Duration
+
+	// The states of tokens.
+	tokens map[string]*tokenState
+	// The revoked tokens.
+	revoked map[string]*RevokedToken
+	// The time of last sweep of expired tokens.
+	sweepAt time.Time
+	// The lock to protect tokens and revoked.
+	lock stdSync.Mutex
+}
+
+// NewDetector creates a detector by options.
+func NewDetector(opts ...func(*detectorImpl)) Detector {
+	v := &detectorImpl{
+		tokenParam: "token", window: 10 * time.Minute, maxIPs: 5, maxASNs: 3, maxSpeed: 1000,
+		tokens: make(map[string]*tokenState), revoked: make(map[string]*RevokedToken),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewDetectorFromEnvironment creates the detector by environment, or a nop detector if disabled.
+func NewDetectorFromEnvironment(environment env.Environment) (Detector, error) {
+	if environment.RestreamDetect() != "on" {
+		return NewNopDetector(), nil
+	}
+
+	window, err := time.ParseDuration(environment.RestreamWindow())
+	if err != nil || window <= 0 {
+		return nil, errors.Errorf("invalid window %v", environment.RestreamWindow())
+	}
+
+	maxIPs, err := strconv.Atoi(environment.RestreamMaxIPs())
+	if err != nil || maxIPs <= 0 {
+		return nil, errors.Errorf("invalid max ips %v", environment.RestreamMaxIPs())
+	}
+	maxASNs, err := strconv.Atoi(environment.RestreamMaxASNs())
+	if err != nil || maxASNs <= 0 {
+		return nil, errors.Errorf("invalid max asns %v", environment.RestreamMaxASNs())
+	}
+	maxSpeed, err := strconv.ParseFloat(environment.RestreamMaxSpeed(), 64)
+	if err != nil || maxSpeed <= 0 {
+		return nil, errors.Errorf("invalid max speed %v", environment.RestreamMaxSpeed())
+	}
+
+	var revokeDuration time.Duration
+	if environment.RestreamRevoke() == "on" {
+		if revokeDuration, err = time.ParseDuration(environment.RestreamRevokeDuration()); err != nil || revokeDuration <= 0 {
+			return nil, errors.Errorf("invalid revoke duration %v", environment.RestreamRevokeDuration())
+		}
+	}
+
+	return NewDetector(func(v *detectorImpl) {
+		v.tokenParam, v.window = environment.RestreamTokenParam(), window
+		v.maxIPs, v.maxASNs, v.maxSpeed = maxIPs, maxASNs, maxSpeed
+		v.revokeDuration = revokeDuration
+	}), nil
+}
+
+func (v *detectorImpl) Check(ctx context.Context, c *Client) error {
+	token := c.Query.Get(v.tokenParam)
+	if token == "" {
+		return nil
+	}
+
+	ip := c.RemoteAddr
+	if host, _, err := net.SplitHostPort(c.RemoteAddr); err == nil {
+		ip = host
+	}
+	location := geo.SrsLocator.Locate(ip, c.Header)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	v.sweep(now)
+
+	if revoked, ok := v.revoked[token]; ok && now.Before(revoked.ExpireAt) {
+		return errors.Errorf("token revoked at %v for %v", revoked.RevokedAt.Format(time.RFC3339), revoked.Reason)
+	}
+
+	state, ok := v.tokens[token]
+	if !ok {
+		state = &tokenState{}
+		v.tokens[token] = state
+	}
+	state.expire(now.Add(-v.window))
+
+	// For the stateless client such as HLS, which refreshes the playlist, only update the time of last
+	// observation from the same IP and location.
+	if n := len(state.observations); n > 0 && c.Session == nil {
+		if last := state.observations[n-1]; last.session == nil && last.ip == ip && *last.location == *location {
+			last.at = now
+			return nil
+		}
+	}
+
+	current := &observation{ip: ip, location: location, session: c.Session, at: now}
+	reason := v.detect(state, current)
+	state.observations = append(state.observations, current)
+	if reason == "" {
+		return nil
+	}
+
+	if now.Sub(state.alertAt) > v.window {
+		state.alertAt = now
+		logger.Wf(ctx, "Restream detected for %v of %v from %v, %v", c.StreamURL, ip, location.Country, reason)
+		event.SrsEventNotifier.Notify(ctx, &event.Event{
+			Type: "restream", Time: now, StreamURL: c.StreamURL,
+			Data: map[string]interface{}{
+				"token": token, "reason": reason, "ip": ip, "country": location.Country, "asn": location.ASN,
+				"revoked": v.revokeDuration > 0,
+			},
+		})
+	}
+
+	if v.revokeDuration <= 0 {
+		return nil
+	}
+	if !dryrun.SrsDryRun.Enforce(ctx, dryrun.KindRestream, "revoke token %v of %v from %v, %v",
+		token, c.StreamURL, ip, reason) {
+		return nil
+	}
+
+	v.revoked[token] = &RevokedToken{Token: token, Reason: reason, RevokedAt: now, ExpireAt: now.Add(v.revokeDuration)}
+	for _, o := range state.observations {
+		if o.session != nil && o.session != c.Session {
+			session.SrsSessionManager.KickSession(ctx, o.session, session.CloseAuthFailed)
+		}
+	}
+	delete(v.tokens, token)
+
+	return errors.Errorf("token revoked for %v", reason)
+}
+
+// detect returns the reason if the current observation of token looks like restreaming, or empty.
+func (v *detectorImpl) detect(state *tokenState, current *observation) string {
+	ips, asns := map[string]bool{current.ip: true}, make(map[string]bool)
+	if current.location.ASN != "" {
+		asns[current.location.ASN] = true
+	}
+	for _, o := range state.observations {
+		ips[o.ip] = true
+		if o.location.ASN != "" {
+			asns[o.location.ASN] = true
+		}
+	}
+
+	if len(ips) > v.maxIPs {
+		return fmt.Sprintf("used from %v ips in %v", len(ips), v.window)
+	}
+	if len(asns) > v.maxASNs {
+		return fmt.Sprintf("used from %v asns in %v", len(asns), v.window)
+	}
+
+	// Compare with the last location with coordinates, for impossible geolocation jump.
+	if !current.location.HasCoordinates {
+		return ""
+	}
+	for i := len(state.observations) - 1; i >= 0; i-- {
+		o := state.observations[i]
+		if !o.location.HasCoordinates {
+			continue
+		}
+
+		distance := o.location.DistanceTo(current.location)
+		if distance < minJumpDistance {
+			return ""
+		}
+
+		// Use at least one second, to avoid dividing by zero.
+		elapsed := current.at.Sub(o.at)
+		if elapsed < time.Second {
+			elapsed = time.Second
+		}
+		if speed := distance / elapsed.Hours(); speed > v.maxSpeed {
+			return fmt.Sprintf("jumped %.0fkm from %v to %v in %v", distance,
+				o.location.Country, current.location.Country, elapsed.Round(time.Second))
+		}
+		return ""
+	}
+	return ""
+}
+
+// sweep removes the expired tokens and revocations, at most once in window.
+func (v *detectorImpl) sweep(now time.Time) {
+	if now.Sub(v.sweepAt) < v.window {
+		return
+	}
+	v.sweepAt = now
+
+	for token, state := range v.tokens {
+		if state.expire(now.Add(-v.window)); len(state.observations) == 0 {
+			delete(v.tokens, token)
+		}
+	}
+	for token, revoked := range v.revoked {
+		if now.After(revoked.ExpireAt) {
+			delete(v.revoked, token)
+		}
+	}
+}
+
+func (v *detectorImpl) Revoked() []*RevokedToken {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	tokens := []*RevokedToken{}
+	for _, revoked := range v.revoked {
+		if now.Before(revoked.ExpireAt) {
+			tokens = append(tokens, revoked)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].RevokedAt.Before(tokens[j].RevokedAt)
+	})
+	return tokens
+}
+
+func (v *detectorImpl) Restore(token string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, ok := v.revoked[token]; !ok {
+		return false
+	}
+	delete(v.revoked, token)
+	return true
+}
+
+// expire removes the observations before t.
+func (v *tokenState) expire(t time.Time) {
+	var index int
+	for index < len(v.observations) && v.observations[index].at.Before(t) {
+		index++
+	}
+	v.observations = v.observations[index:]
+}
+
+// SrsDetector is the global restreaming detector, which allows all clients by default.
+var SrsDetector = NewNopDetector()
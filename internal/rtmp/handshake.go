@@ -0,0 +1,118 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package rtmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"srsx/internal/errors"
+)
+
+// The complex handshake, introduced by Flash Player 9.0.115.0, where the C1 and S1 carry a digest of HMAC-SHA256
+// by the key of player and server, and the C2 and S2 carry a digest of the peer's digest. The C1 and S1 are the
+// time, version, then two 764 bytes blocks, the key and digest in schema0, or the digest and key in schema1.
+const (
+	handshakeSize   = 1536
+	handshakeDigest = 32
+	handshakeBlock  = 764
+)
+
+// The key of Flash Player, 30 bytes of text and 32 bytes of random, to verify the digest of C1.
+var genuineFPKey = append([]byte("Genuine Adobe Flash Player 001"), genuineRandomKey...)
+
+// The key of Flash Media Server, 36 bytes of text and 32 bytes of random, to sign the digest of S1 and S2.
+var genuineFMSKey = append([]byte("Genuine Adobe Flash Media Server 001"), genuineRandomKey...)
+
+var genuineRandomKey = []byte{
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8, 0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab, 0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
+// The version of server in S1, the same as SRS.
+var complexServerVersion = []byte{0x01, 0x00, 0x05, 0x04}
+
+// digestOffset returns the offset of digest in C1 or S1 p, by the schema. The digest block is at 772 in
+// schema0, or at 8 in schema1, and the offset of digest is the sum of the first 4 bytes of block.
+func digestOffset(p []byte, schema int) int {
+	base := 8 + handshakeBlock
+	if schema == 1 {
+		base = 8
+	}
+	sum := int(p[base]) + int(p[base+1]) + int(p[base+2]) + int(p[base+3])
+	return base + 4 + sum%(handshakeBlock-4-handshakeDigest)
+}
+
+// makeDigest returns the HMAC-SHA256 of C1 or S1 p by key, excluding the digest at offset.
+func makeDigest(p []byte, offset int, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(p[:offset])
+	h.Write(p[offset+handshakeDigest:])
+	return h.Sum(nil)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of p by key.
+func hmacSHA256(key, p []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(p)
+	return h.Sum(nil)
+}
+
+// parseComplexC1 verifies the digest of C1 c1 by the key of Flash Player, in schema0 or schema1, returns the
+// schema and digest, or nil digest if not a complex handshake.
+func parseComplexC1(c1 []byte) (schema int, digest []byte) {
+	// The version is zero for simple handshake.
+	if len(c1) != handshakeSize || binary.BigEndian.Uint32(c1[4:8]) == 0 {
+		return 0, nil
+	}
+
+	for _, schema := range []int{0, 1} {
+		offset := digestOffset(c1, schema)
+		expect := makeDigest(c1, offset, genuineFPKey[:30])
+		if hmac.Equal(expect, c1[offset:offset+handshakeDigest]) {
+			return schema, expect
+		}
+	}
+	return 0, nil
+}
+
+// WriteComplexS1S2 writes the S1 and S2 of complex handshake, for the C1 read by ReadC1S1. The S1 is signed in
+// the same schema of C1, and the S2 is signed by the digest of C1. Returns false and writes nothing, if the C1
+// has no valid digest, so the server should do the simple handshake.
+//
+// The key block of S1 is random, because the proxy doesn't support the RTMPE encryption by the DH key.
+func (v *Handshake) WriteComplexS1S2(w io.Writer) (bool, error) {
+	schema, c1Digest := parseComplexC1(v.c1s1)
+	if c1Digest == nil {
+		return false, nil
+	}
+
+	s1 := make([]byte, handshakeSize)
+	if _, err := rand.Read(s1[8:]); err != nil {
+		return false, errors.Wrap(err, "generate s1")
+	}
+	binary.BigEndian.PutUint32(s1[0:4], uint32(time.Now().Unix()))
+	copy(s1[4:8], complexServerVersion)
+
+	offset := digestOffset(s1, schema)
+	copy(s1[offset:], makeDigest(s1, offset, genuineFMSKey[:36]))
+
+	// The digest of S2 is signed by the key made from the digest of C1.
+	s2 := make([]byte, handshakeSize)
+	if _, err := rand.Read(s2); err != nil {
+		return false, errors.Wrap(err, "generate s2")
+	}
+	key := hmacSHA256(genuineFMSKey, c1Digest)
+	copy(s2[handshakeSize-handshakeDigest:], hmacSHA256(key, s2[:handshakeSize-handshakeDigest]))
+
+	if _, err := io.Copy(w, bytes.NewReader(append(s1, s2...))); err != nil {
+		return false, errors.Wrap(err, "write s1s2")
+	}
+	return true, nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package rtmp
+
+import (
+	"fmt"
+
+	"srsx/internal/errors"
+)
+
+// Metadata is the onMetaData of stream, sent by the publisher in @setDataFrame, or by the server to players.
+type Metadata struct {
+	// The codec of video and audio, such as H264 and AAC.
+	VideoCodec string `json:"vcodec,omitempty"`
+	AudioCodec string `json:"acodec,omitempty"`
+	// The resolution and frame rate of video.
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	FrameRate float64 `json:"fps,omitempty"`
+	// The bitrate in kbps, configured by encoder.
+	VideoDataRate float64 `json:"vkbps,omitempty"`
+	AudioDataRate float64 `json:"akbps,omitempty"`
+	// The sample rate and channels of audio.
+	AudioSampleRate float64 `json:"sample_rate,omitempty"`
+	Stereo          bool    `json:"stereo,omitempty"`
+	// The encoder, such as obs-output module.
+	Encoder string `json:"encoder,omitempty"`
+}
+
+// ParseMetadata parses the onMetaData from the data message m, or nil if m is not the metadata. The metadata is
+// a data message of "@setDataFrame", "onMetaData", {...} from publisher, or "onMetaData", {...} to player.
+func ParseMetadata(m *Message) (*Metadata, error) {
+	var p []byte
+	switch m.MessageType {
+	case MessageTypeAMF0Data:
+		p = m.Payload
+	case MessageTypeAMF3Data:
+		if len(m.Payload) < 1 {
+			return nil, nil
+		}
+		p = m.Payload[1:]
+	default:
+		return nil, nil
+	}
+
+	var name amf0String
+	if err := name.UnmarshalBinary(p); err != nil {
+		return nil, nil
+	}
+	p = p[name.Size():]
+
+	if name == "@setDataFrame" {
+		if err := name.UnmarshalBinary(p); err != nil {
+			return nil, nil
+		}
+		p = p[name.Size():]
+	}
+	if name != "onMetaData" {
+		return nil, nil
+	}
+
+	a, err := Amf0Discovery(p)
+	if err != nil {
+		return nil, errors.WithMessage(err, "discovery")
+	}
+	if err = a.UnmarshalBinary(p); err != nil {
+		return nil, errors.WithMessage(err, "unmarshal")
+	}
+
+	var props *amf0ObjectBase
+	if obj := NewAmf0Converter(a).ToObject(); obj != nil {
+		props = &obj.amf0ObjectBase
+	} else if arr := NewAmf0Converter(a).ToEcmaArray(); arr != nil {
+		props = &arr.amf0ObjectBase
+	} else {
+		return nil, errors.Errorf("invalid metadata %v", a.amf0Marker())
+	}
+
+	number := func(key string) float64 {
+		if v := NewAmf0Converter(props.Get(key)).ToNumber(); v != nil {
+			return float64(*v)
+		}
+		return 0
+	}
+	str := func(key string) string {
+		if v := NewAmf0Converter(props.Get(key)).ToString(); v != nil {
+			return string(*v)
+		}
+		return ""
+	}
+	// The codec id is a number of FLV, or a FourCC string of enhanced RTMP.
+	codec := func(key string, names map[string]string) string {
+		if v := str(key); v != "" {
+			return fourCCName(v, names)
+		}
+		if v := number(key); v > 0 {
+			return fourCCName(fmt.Sprintf("%v", int(v)), names)
+		}
+		return ""
+	}
+
+	md := &Metadata{
+		VideoCodec: codec("videocodecid", videoCodecs), AudioCodec: codec("audiocodecid", audioCodecs),
+		Width: int(number("width")), Height: int(number("height")), FrameRate: number("framerate"),
+		VideoDataRate: number("videodatarate"), AudioDataRate: number("audiodatarate"),
+		AudioSampleRate: number("audiosamplerate"), Encoder: str("encoder"),
+	}
+	if v := NewAmf0Converter(props.Get("stereo")).ToBoolean(); v != nil {
+		md.Stereo = bool(*v)
+	}
+	return md, nil
+}
+
+// The name of video codec, by the codec id of FLV or the FourCC of enhanced RTMP.
+var videoCodecs = map[string]string{
+	"2": "H263", "3": "Screen", "4": "VP6", "5": "VP6A", "6": "Screen2", "7": "H264", "12": "HEVC", "13": "AV1",
+	"avc1": "H264", "hvc1": "HEVC", "av01": "AV1", "vp09": "VP9", "vp08": "VP8",
+}
+
+// The name of audio codec, by the sound format of FLV or the FourCC of enhanced RTMP.
+var audioCodecs = map[string]string{
+	"0": "PCM", "1": "ADPCM", "2": "MP3", "3": "PCM", "7": "G711A", "8": "G711U", "10": "AAC", "11": "Speex",
+	"13": "Opus", "mp4a": "AAC", "Opus": "Opus", ".mp3": "MP3", "fLaC": "FLAC", "ac-3": "AC3", "ec-3": "EAC3",
+}
+
+// fourCCName returns the name of codec id, or the id itself if unknown.
+func fourCCName(id string, names map[string]string) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return id
+}
+
+// ParseVideo parses the codec of video message payload p, and whether it's a keyframe or sequence header, which
+// supports the FourCC of enhanced RTMP.
+func ParseVideo(p []byte) (codec string, keyframe, sequenceHeader bool) {
+	if len(p) < 1 {
+		return
+	}
+
+	// The enhanced RTMP, the IsExHeader flag, frame type and packet type, then the FourCC.
+	if p[0]&0x80 != 0 {
+		if len(p) < 5 {
+			return
+		}
+		frameType, packetType := (p[0]>>4)&0x07, p[0]&0x0f
+		// The PacketTypeSequenceStart is 0, and PacketTypeMPEG2TSSequenceStart is 5.
+		sequenceHeader = packetType == 0 || packetType == 5
+		return fourCCName(string(p[1:5]), videoCodecs), frameType == 1 && !sequenceHeader, sequenceHeader
+	}
+
+	frameType, codecID := p[0]>>4, p[0]&0x0f
+	// The AVCPacketType of H.264 and HEVC, 0 for sequence header.
+	sequenceHeader = (codecID == 7 || codecID == 12) && len(p) > 1 && p[1] == 0
+	return fourCCName(fmt.Sprintf("%v", codecID), videoCodecs), frameType == 1 && !sequenceHeader, sequenceHeader
+}
+
+// ParseAudio parses the codec of audio message payload p, which supports the FourCC of enhanced RTMP.
+func ParseAudio(p []byte) (codec string) {
+	if len(p) < 1 {
+		return
+	}
+
+	// The enhanced RTMP, the sound format 9 is ExHeader, followed by the FourCC.
+	soundFormat := p[0] >> 4
+	if soundFormat == 9 {
+		if len(p) < 5 {
+			return
+		}
+		return fourCCName(string(p[1:5]), audioCodecs)
+	}
+	return fourCCName(fmt.Sprintf("%v", soundFormat), audioCodecs)
+}
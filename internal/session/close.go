@@ -0,0 +1,50 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package session
+
+import (
+	"net"
+
+	"srsx/internal/errors"
+	"srsx/internal/utils"
+)
+
+// The reasons of session closed, the standard taxonomy across protocols, to aggregate in logs, events and
+// metrics, instead of the free-form errors.
+const (
+	// The client closed the connection, such as the player stopped.
+	CloseClientClosed = "client-closed"
+	// The backend server closed the connection, such as the stream unpublished.
+	CloseBackendClosed = "backend-closed"
+	// The connection timed out without traffic.
+	CloseIdleTimeout = "idle-timeout"
+	// The session kicked by API, for example, to re-pick the backend server.
+	CloseKicked = "kicked"
+	// The session rejected or revoked by the authentication, such as the token revoked for restreaming.
+	CloseAuthFailed = "auth-failed"
+	// The session cancelled by the drain timeout when proxy quit.
+	CloseDrained = "drained"
+	// The client redirected to the backend server by 302, in redirect mode.
+	CloseRedirected = "redirected"
+	// The session quit by other errors, such as no backend server.
+	CloseError = "error"
+)
+
+// CloseReasons is all the close reasons.
+var CloseReasons = []string{
+	CloseClientClosed, CloseBackendClosed, CloseIdleTimeout, CloseKicked, CloseAuthFailed, CloseDrained, CloseRedirected,
+	CloseError,
+}
+
+// CloseReasonOf returns the close reason by the err of connection to peer, which is closed if the peer closed
+// the connection, idle-timeout if timeout, or error.
+func CloseReasonOf(err error, closed string) string {
+	if err == nil || utils.IsPeerClosedError(err) || utils.IsClosedNetworkError(err) {
+		return closed
+	}
+	if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+		return CloseIdleTimeout
+	}
+	return CloseError
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package session
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Fingerprint is the fingerprint of client, to identify the scraping or restreaming bots, which
+// usually use the same HTTP library and TLS stack, even from different addresses.
+type Fingerprint struct {
+	// The TLS ClientHello fingerprint such as JA3, from the header set by the TLS terminator in front of
+	// proxy, because the ClientHello is not exposed by the TLS stack of Go, even if the proxy terminates
+	// TLS by HTTPS. Empty if not available.
+	TLS string `json:"tls,omitempty"`
+	// The MD5 of HTTP fingerprint string, see HTTPString.
+	HTTP string `json:"http"`
+	// The HTTP fingerprint string, in JA3-like format, the fields are separated by comma, which are the
+	// protocol, method, sorted header names, Accept, Accept-Language and Accept-Encoding.
+	HTTPString string `json:"http_string"`
+	// The User-Agent of client.
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// NewHTTPFingerprint creates the fingerprint of HTTP request r. The tlsHeader is the header name of
+// TLS fingerprint set by the TLS terminator, such as X-JA3-Fingerprint, ignored if empty.
+//
+// Note that the header order is not available in Go, so we use the sorted header names, and ignore
+// the headers which are set by the proxies in the middle, such as the X-Forwarded-For.
+func NewHTTPFingerprint(r *http.Request, tlsHeader string) *Fingerprint {
+	var names []string
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-forwarded-") || name == "x-real-ip" || name == "via" ||
+			(tlsHeader != "" && name == strings.ToLower(tlsHeader)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := strings.Join([]string{
+		r.Proto, r.Method, strings.Join(names, "-"),
+		r.Header.Get("Accept"), r.Header.Get("Accept-Language"), r.Header.Get("Accept-Encoding"),
+	}, ",")
+	hash := md5.Sum([]byte(s))
+
+	v := &Fingerprint{
+		HTTP: hex.EncodeToString(hash[:]), HTTPString: s, UserAgent: r.Header.Get("User-Agent"),
+	}
+	if tlsHeader != "" {
+		v.TLS = r.Header.Get(tlsHeader)
+	}
+	return v
+}
+
+// WithFingerprint sets the fingerprint of session.
+func WithFingerprint(fingerprint *Fingerprint) func(*Session) {
+	return func(v *Session) {
+		v.Fingerprint = fingerprint
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/logger"
+	"srsx/internal/sync"
+)
+
+// The label value of session, which aggregates the values out of the max values of a label.
+const labelValueOther = "other"
+
+// The roles of session.
+const (
+	// The client publishes the stream, such as WHIP.
+	RolePublisher = "publisher"
+	// The client plays the stream, such as WHEP.
+	RoleViewer = "viewer"
+)
+
+// Session is a client session of proxy, such as an RTMP or HTTP-FLV connection, which is bound to
+// a stream and proxied to a backend server.
+type Session struct {
+	// The session ID, which is the context ID of session.
+	ID string `json:"id"`
+	// The protocol of session, such as rtmp, http, rtc or srt.
+	Protocol string `json:"protocol"`
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The address of client.
+	RemoteAddr string `json:"remote_addr"`
+	// The time session created.
+	CreatedAt time.Time `json:"created_at"`
+	// The role of client, publisher or viewer, empty if unknown.
+	Role string `json:"role,omitempty"`
+	// The fingerprint of client, nil if not available, for example, the RTMP client.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// The stats of session, such as the bitrate, RTT and loss of WebRTC, nil if not available.
+	Stats json.Marshaler `json:"stats,omitempty"`
+	// The annotations of session, set by the external authorization service.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The labels of session, like user id, plan or region, set by the auth hooks.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// The function to close the session.
+	closer func()
+	// Whether the session is kicked by API.
+	kicked bool
+	// The reason of session closed, empty if not closed.
+	closeReason string
+	// The lock to protect kicked and closeReason.
+	lock stdSync.Mutex
+}
+
+// Kicked returns whether the session is kicked, for example, to re-pick the backend server.
+func (v *Session) Kicked() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.kicked
+}
+
+// SetCloseReason sets the reason of session closed, such as client-closed, and the first reason wins, for
+// example, the session kicked is closed by kicked, not the backend closed by kick.
+func (v *Session) SetCloseReason(reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closeReason == "" {
+		v.closeReason = reason
+	}
+}
+
+// CloseReason returns the reason of session closed, empty if not set.
+func (v *Session) CloseReason() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.closeReason
+}
+
+// WithRole sets the role of session, publisher or viewer.
+func WithRole(role string) func(*Session) {
+	return func(v *Session) {
+		v.Role = role
+	}
+}
+
+// WithStats sets the stats of session, which is marshaled when listing the sessions, to get the latest.
+func WithStats(stats json.Marshaler) func(*Session) {
+	return func(v *Session) {
+		v.Stats = stats
+	}
+}
+
+// WithAnnotations sets the annotations of session, by the external authorization service.
+func WithAnnotations(annotations map[string]string) func(*Session) {
+	return func(v *Session) {
+		v.Annotations = annotations
+	}
+}
+
+// WithLabels sets the labels of session, by the auth hooks.
+func WithLabels(labels map[string]string) func(*Session) {
+	return func(v *Session) {
+		v.Labels = labels
+	}
+}
+
+// StreamStats is the number of sessions of a stream.
+type StreamStats struct {
+	// The stream URL in vhost/app/stream schema.
+	StreamURL string `json:"stream_url"`
+	// The number of sessions of each protocol, such as rtmp, http, rtc or srt.
+	Sessions map[string]int `json:"sessions"`
+	// The number of WebRTC viewers, by WHEP.
+	RTCViewers int `json:"rtc_viewers"`
+	// The number of WebRTC publishers, by WHIP.
+	RTCPublishers int `json:"rtc_publishers"`
+}
+
+// SessionManager manages all the client sessions of proxy.
+type SessionManager interface {
+	// Add a session of protocol for streamURL, the closer is used to close the session when kicked.
+	// The caller should remove the session when it's done. The opts is used to set the optional fields,
+	// such as the fingerprint by WithFingerprint.
+	Add(ctx context.Context, protocol, streamURL, remoteAddr string, closer func(), opts ...func(*Session)) *Session
+	// Remove the session, which is closed by the close reason of session, or error if not set.
+	Remove(session *Session)
+	// List the sessions of streamURL, or all sessions if streamURL is empty.
+	List(streamURL string) []*Session
+	// Count returns the number of sessions of streamURL, without listing the sessions.
+	Count(streamURL string) int
+	// Streams returns the number of sessions of each stream, sorted by stream URL.
+	Streams() []*StreamStats
+	// Kick all sessions of streamURL, returns the number of sessions kicked.
+	Kick(ctx context.Context, streamURL string) int
+	// Kick the session for the close reason, for example, auth-failed if the token of session is revoked.
+	KickSession(ctx context.Context, session *Session, reason string)
+	// Closes returns the number of sessions closed, key is the protocol, then the close reason.
+	Closes() map[string]map[string]int64
+	// LabelStats returns the number of sessions of each value of the label keys, in bounded cardinality,
+	// key is the label key, then the label value.
+	LabelStats() map[string]map[string]int
+}
+
+type sessionManagerImpl struct {
+	// The sessions, key is the session ID.
+	sessions sync.Map[string, *Session]
+
+	// The label keys to aggregate in stats, such as plan or region.
+	labelKeys []string
+	// The max values of each label key in stats, others are aggregated as other.
+	labelMaxValues int
+	// Whether notify the metering record when session is closed.
+	metering bool
+
+	// The number of sessions closed, key is the protocol, then the close reason.
+	closes map[string]map[string]int64
+	// The number of sessions of each stream, key is the stream URL.
+	streams map[string]int
+	// The lock to protect closes and streams.
+	lock stdSync.Mutex
+}
+
+// NewSessionManager creates a new session manager with options.
+func NewSessionManager(opts ...func(*sessionManagerImpl)) SessionManager {
+	v := &sessionManagerImpl{
+		labelMaxValues: 20, closes: make(map[string]map[string]int64), streams: make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewSessionManagerFromEnvironment creates the session manager by the label keys and metering in environment.
+func NewSessionManagerFromEnvironment(environment env.Environment) (SessionManager, error) {
+	var labelKeys []string
+	for _, key := range strings.Split(environment.SessionLabelKeys(), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			labelKeys = append(labelKeys, key)
+		}
+	}
+
+	maxValues, err := strconv.Atoi(environment.SessionLabelMaxValues())
+	if err != nil || maxValues <= 0 {
+		return nil, errors.Errorf("invalid label max values %v", environment.SessionLabelMaxValues())
+	}
+
+	return NewSessionManager(func(v *sessionManagerImpl) {
+		v.labelKeys, v.labelMaxValues = labelKeys, maxValues
+		v.metering = environment.SessionMetering() == "on"
+	}), nil
+}
+
+func (v *sessionManagerImpl) Add(ctx context.Context, protocol, streamURL, remoteAddr string, closer func(), opts ...func(*Session)) *Session {
+	session := &Session{
+		ID: logger.ContextID(ctx), Protocol: protocol, StreamURL: streamURL, RemoteAddr: remoteAddr,
+		CreatedAt: time.Now(), closer: closer,
+	}
+	for _, opt := range opts {
+		opt(session)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// The session of the same ID is replaced, so it's no longer counted.
+	if previous, ok := v.sessions.Load(session.ID); ok {
+		v.uncount(previous.StreamURL)
+	}
+	v.sessions.Store(session.ID, session)
+	v.streams[session.StreamURL]++
+	return session
+}
+
+// uncount decreases the number of sessions of streamURL, and removes the stream without sessions. The lock
+// should be held by caller.
+func (v *sessionManagerImpl) uncount(streamURL string) {
+	if v.streams[streamURL] <= 1 {
+		delete(v.streams, streamURL)
+	} else {
+		v.streams[streamURL]--
+	}
+}
+
+func (v *sessionManagerImpl) Remove(session *Session) {
+	if session == nil {
+		return
+	}
+
+	if removed := func() bool {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if actual, ok := v.sessions.Load(session.ID); !ok || actual != session {
+			return false
+		}
+		v.sessions.Delete(session.ID)
+		v.uncount(session.StreamURL)
+		return true
+	}(); !removed {
+		return
+	}
+
+	// The session without close reason quits by the error of proxy.
+	session.SetCloseReason(CloseError)
+	reason := session.CloseReason()
+
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		closes, ok := v.closes[session.Protocol]
+		if !ok {
+			closes = make(map[string]int64)
+			v.closes[session.Protocol] = closes
+		}
+		closes[reason]++
+	}()
+
+	ctx := logger.WithLabels(logger.WithContextID(context.Background(), session.ID), session.Labels)
+	duration := time.Since(session.CreatedAt)
+	logger.Df(ctx, "Close %v session %v of %v from %v by %v, duration=%v",
+		session.Protocol, session.ID, session.StreamURL, session.RemoteAddr, reason, duration.Round(time.Millisecond))
+
+	// Notify the metering record of session, with the labels for business.
+	if v.metering {
+		event.SrsEventNotifier.Notify(ctx, &event.Event{
+			Type: "session", Time: time.Now(), StreamURL: session.StreamURL,
+			Data: map[string]interface{}{
+				"id": session.ID, "protocol": session.Protocol, "role": session.Role,
+				"remote_addr": session.RemoteAddr, "created_at": session.CreatedAt,
+				"duration": int64(duration.Seconds()), "labels": session.Labels, "close_reason": reason,
+			},
+		})
+	}
+}
+
+func (v *sessionManagerImpl) List(streamURL string) []*Session {
+	sessions := []*Session{}
+	v.sessions.Range(func(id string, session *Session) bool {
+		if streamURL == "" || session.StreamURL == streamURL {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+	return sessions
+}
+
+func (v *sessionManagerImpl) Count(streamURL string) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.streams[streamURL]
+}
+
+func (v *sessionManagerImpl) Streams() []*StreamStats {
+	streams := make(map[string]*StreamStats)
+	v.sessions.Range(func(id string, session *Session) bool {
+		stream, ok := streams[session.StreamURL]
+		if !ok {
+			stream = &StreamStats{StreamURL: session.StreamURL, Sessions: make(map[string]int)}
+			streams[session.StreamURL] = stream
+		}
+
+		stream.Sessions[session.Protocol]++
+		if session.Protocol == "rtc" && session.Role == RoleViewer {
+			stream.RTCViewers++
+		} else if session.Protocol == "rtc" && session.Role == RolePublisher {
+			stream.RTCPublishers++
+		}
+		return true
+	})
+
+	stats := make([]*StreamStats, 0, len(streams))
+	for _, stream := range streams {
+		stats = append(stats, stream)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].StreamURL < stats[j].StreamURL
+	})
+	return stats
+}
+
+func (v *sessionManagerImpl) Kick(ctx context.Context, streamURL string) int {
+	sessions := v.List(streamURL)
+	for _, session := range sessions {
+		v.KickSession(ctx, session, CloseKicked)
+	}
+	return len(sessions)
+}
+
+func (v *sessionManagerImpl) KickSession(ctx context.Context, session *Session, reason string) {
+	session.lock.Lock()
+	session.kicked = true
+	session.lock.Unlock()
+	session.SetCloseReason(reason)
+
+	logger.Df(ctx, "Kick %v session %v of %v from %v by %v",
+		session.Protocol, session.ID, session.StreamURL, session.RemoteAddr, reason)
+	if session.closer != nil {
+		session.closer()
+	}
+}
+
+func (v *sessionManagerImpl) Closes() map[string]map[string]int64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	stats := make(map[string]map[string]int64)
+	for protocol, closes := range v.closes {
+		stats[protocol] = make(map[string]int64)
+		for reason, n := range closes {
+			stats[protocol][reason] = n
+		}
+	}
+	return stats
+}
+
+func (v *sessionManagerImpl) LabelStats() map[string]map[string]int {
+	stats := make(map[string]map[string]int)
+	for _, key := range v.labelKeys {
+		stats[key] = make(map[string]int)
+	}
+	if len(v.labelKeys) == 0 {
+		return stats
+	}
+
+	v.sessions.Range(func(id string, session *Session) bool {
+		for _, key := range v.labelKeys {
+			if value, ok := session.Labels[key]; ok {
+				stats[key][value]++
+			}
+		}
+		return true
+	})
+
+	// Keep the values with most sessions, and aggregate others, to bound the cardinality for metrics.
+	for key, values := range stats {
+		if len(values) <= v.labelMaxValues {
+			continue
+		}
+
+		sorted := make([]string, 0, len(values))
+		for value := range values {
+			sorted = append(sorted, value)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if values[sorted[i]] != values[sorted[j]] {
+				return values[sorted[i]] > values[sorted[j]]
+			}
+			return sorted[i] < sorted[j]
+		})
+
+		bounded := make(map[string]int)
+		for i, value := range sorted {
+			if i < v.labelMaxValues-1 {
+				bounded[value] = values[value]
+			} else {
+				bounded[labelValueOther] += values[value]
+			}
+		}
+		stats[key] = bounded
+	}
+	return stats
+}
+
+// SrsSessionManager is the global session manager instance.
+var SrsSessionManager = NewSessionManager()
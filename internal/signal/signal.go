@@ -7,6 +7,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	stdSync "sync"
 	"syscall"
 	"time"
 
@@ -27,6 +28,78 @@ func InstallSignals(ctx context.Context, cancel context.CancelFunc) {
 	}()
 }
 
+// InstallDrain drains the proxy by drain when got SIGUSR2, to stop accepting new connections and quit after the
+// sessions drained.
+func InstallDrain(ctx context.Context, drain func()) {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGUSR2)
+
+	go func() {
+		for s := range sc {
+			logger.Df(ctx, "Got signal %v, drain", s)
+			drain()
+		}
+	}()
+}
+
+// InstallUpgrade upgrades the binary by upgrade when got SIGUSR1, to start the new process with the listeners.
+func InstallUpgrade(ctx context.Context, upgrade func()) {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGUSR1)
+
+	go func() {
+		for s := range sc {
+			logger.Df(ctx, "Got signal %v, upgrade", s)
+			upgrade()
+		}
+	}()
+}
+
+// reloadHandler is a handler to reload by SIGHUP.
+type reloadHandler struct {
+	// The name of handler, for logs.
+	name string
+	// The function to reload.
+	reload func(ctx context.Context) error
+}
+
+// The handlers to reload by SIGHUP, after the .env file.
+var reloadHandlers []*reloadHandler
+var reloadLock stdSync.Mutex
+
+// HandleReload registers the reload function to call when got SIGHUP, after the .env file reloaded.
+func HandleReload(name string, reload func(ctx context.Context) error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	reloadHandlers = append(reloadHandlers, &reloadHandler{name: name, reload: reload})
+}
+
+// InstallReload reloads the .env file when got SIGHUP, note that only the variables read at runtime
+// take effect, for example, the listen ports require restarting. Then reloads by the handlers.
+func InstallReload(ctx context.Context, environment env.Environment) {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGHUP)
+
+	go func() {
+		for s := range sc {
+			logger.Df(ctx, "Got signal %v, reload .env", s)
+			if _, err := environment.Reload(ctx); err != nil {
+				logger.Wf(ctx, "Reload .env failed, err %+v", err)
+			}
+
+			reloadLock.Lock()
+			handlers := append([]*reloadHandler(nil), reloadHandlers...)
+			reloadLock.Unlock()
+
+			for _, handler := range handlers {
+				if err := handler.reload(ctx); err != nil {
+					logger.Wf(ctx, "Reload %v failed, err %+v", handler.name, err)
+				}
+			}
+		}
+	}()
+}
+
 func InstallForceQuit(ctx context.Context, environment env.Environment) error {
 	var forceTimeout time.Duration
 	timeoutStr := environment.ForceQuitTimeout()
@@ -0,0 +1,193 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// The magic prefix of sealed value, to distinguish from the plaintext value written before encryption
+// is enabled, which is only accepted when migrating.
+var sealedMagic = []byte("srsx:gcm:")
+
+// Cipher encrypts and decrypts the values at rest.
+type Cipher interface {
+	// Seal encrypts the plaintext, bound to the key as additional authenticated data, so the sealed value is
+	// unable to be moved to another key.
+	Seal(key, plaintext []byte) ([]byte, error)
+	// Open decrypts the value sealed by Seal for the same key. The plaintext value is rejected, unless
+	// migrating, which returns it as is.
+	Open(key, value []byte) ([]byte, error)
+}
+
+type aesGCMCipher struct {
+	// The AEAD of AES-GCM.
+	aead cipher.AEAD
+	// Whether migrating the store, to accept the plaintext values and the values sealed without key.
+	migrate bool
+}
+
+// NewAESGCMCipher creates a AES-GCM cipher by key, which should be 16, 24 or 32 bytes. Set migrate to accept
+// the plaintext values written before encryption is enabled.
+func NewAESGCMCipher(key []byte, migrate bool) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create aes with %v bytes key", len(key))
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create gcm")
+	}
+	return &aesGCMCipher{aead: aead, migrate: migrate}, nil
+}
+
+func (v *aesGCMCipher) Seal(key, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrapf(err, "generate nonce")
+	}
+
+	b := make([]byte, 0, len(sealedMagic)+len(nonce)+len(plaintext)+v.aead.Overhead())
+	b = append(b, sealedMagic...)
+	b = append(b, nonce...)
+	return v.aead.Seal(b, nonce, plaintext, key), nil
+}
+
+func (v *aesGCMCipher) Open(key, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, sealedMagic) {
+		if v.migrate {
+			return value, nil
+		}
+		return nil, errors.Errorf("reject plaintext value, %v bytes", len(value))
+	}
+
+	b := value[len(sealedMagic):]
+	if len(b) < v.aead.NonceSize() {
+		return nil, errors.Errorf("sealed value too short, %v bytes", len(value))
+	}
+
+	nonce, ciphertext := b[:v.aead.NonceSize()], b[v.aead.NonceSize():]
+	plaintext, err := v.aead.Open(nil, nonce, ciphertext, key)
+	if err != nil && v.migrate {
+		// The value might be sealed without key by the old proxy.
+		plaintext, err = v.aead.Open(nil, nonce, ciphertext, nil)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "open sealed value")
+	}
+	return plaintext, nil
+}
+
+// NewCipherFromEnvironment creates the cipher by the key in environment, or the key file which is
+// usually mounted by KMS or secret manager. Returns nil if encryption is not enabled.
+func NewCipherFromEnvironment(environment env.Environment) (Cipher, error) {
+	key := environment.StoreEncryptionKey()
+	if filename := environment.StoreEncryptionKeyFile(); key == "" && filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read key file %v", filename)
+		}
+		key = string(b)
+	}
+
+	if key = strings.TrimSpace(key); key == "" {
+		return nil, nil
+	}
+
+	// The key is encoded in hex or base64, for example, by `openssl rand -hex 32`.
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, errors.Errorf("invalid key, should be hex or base64")
+		}
+	}
+
+	migrate := environment.StoreEncryptionMigrate()
+	if migrate != "on" && migrate != "off" {
+		return nil, errors.Errorf("invalid encryption migrate %v", migrate)
+	}
+	return NewAESGCMCipher(b, migrate == "on")
+}
+
+// encryptedStore seals the values before writing to the underlayer store, and opens the values after
+// reading from it. The keys are not encrypted, because they are used to scan, but bound to the values.
+type encryptedStore struct {
+	// The underlayer store.
+	store Store
+	// The cipher to seal and open values.
+	cipher Cipher
+}
+
+// NewEncryptedStore creates a store which encrypts the values of s by c.
+func NewEncryptedStore(s Store, c Cipher) Store {
+	return &encryptedStore{store: s, cipher: c}
+}
+
+func (v *encryptedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := v.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := v.cipher.Open([]byte(key), b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open key=%v", key)
+	}
+	return plaintext, nil
+}
+
+func (v *encryptedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	b, err := v.cipher.Seal([]byte(key), value)
+	if err != nil {
+		return errors.Wrapf(err, "seal key=%v", key)
+	}
+	return v.store.Set(ctx, key, b, ttl)
+}
+
+func (v *encryptedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return v.store.TTL(ctx, key)
+}
+
+func (v *encryptedStore) Delete(ctx context.Context, key string) error {
+	return v.store.Delete(ctx, key)
+}
+
+func (v *encryptedStore) Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	var r0 error
+	if err := v.store.Scan(ctx, prefix, func(key string, value []byte) bool {
+		plaintext, err := v.cipher.Open([]byte(key), value)
+		if err != nil {
+			r0 = errors.Wrapf(err, "open key=%v", key)
+			return false
+		}
+		return fn(key, plaintext)
+	}); err != nil {
+		return err
+	}
+	return r0
+}
+
+func (v *encryptedStore) Close() error {
+	return v.store.Close()
+}
+
+func (v *encryptedStore) Record(ctx context.Context, kind, key string, value []byte) error {
+	if h, ok := v.store.(Historian); ok {
+		return h.Record(ctx, kind, key, value)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+// Link the SQL drivers of postgres and mysql into the binary, for the SQL store.
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
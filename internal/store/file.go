@@ -0,0 +1,225 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	stdSync "sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"srsx/internal/clock"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// The bucket of bbolt to store the state.
+var fileStoreBucket = []byte("state")
+
+// The interval to cleanup the expired entries in file.
+const fileStoreCleanupInterval = time.Minute
+
+// fileStore is an embedded store, which persists the state to a local bbolt file, so the state survives
+// the restart of proxy without running Redis. Each write is committed to the file by a transaction, so
+// there is no lost state if proxy crashes. It's designed for single proxy deployments, because the file
+// is locked by one process.
+type fileStore struct {
+	// The bbolt database.
+	db *bolt.DB
+
+	// The cancel function for cleanup goroutine.
+	cancel context.CancelFunc
+	// The wait group for cleanup goroutine.
+	wg stdSync.WaitGroup
+}
+
+// NewFileStore creates a new file-based store, open or create the bbolt database of filename.
+func NewFileStore(ctx context.Context, filename string) (Store, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v", filename)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(fileStoreBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "create bucket of %v", filename)
+	}
+
+	v := &fileStore{db: db}
+	if n, err := v.cleanup(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "cleanup %v", filename)
+	} else {
+		logger.Df(ctx, "FileStore: open %v, cleanup %v expired entries", filename, n)
+	}
+
+	// Cleanup the expired entries periodically.
+	ctx, v.cancel = context.WithCancel(ctx)
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(fileStoreCleanupInterval):
+				if _, err := v.cleanup(); err != nil {
+					logger.Wf(ctx, "FileStore: cleanup %v failed, err %+v", filename, err)
+				}
+			}
+		}
+	}()
+
+	return v, nil
+}
+
+func (v *fileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	if err := v.db.View(func(tx *bolt.Tx) error {
+		entry, ok := decodeFileEntry(tx.Bucket(fileStoreBucket).Get([]byte(key)))
+		if !ok || entry.expired(clock.SrsClock.Now()) {
+			return ErrNotFound
+		}
+		value = entry.Value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (v *fileStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	entry := &memoryEntry{Value: value}
+	if ttl > 0 {
+		entry.ExpireAt = clock.SrsClock.Now().Add(ttl)
+	}
+
+	if err := v.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileStoreBucket).Put([]byte(key), encodeFileEntry(entry))
+	}); err != nil {
+		return errors.Wrapf(err, "put %v", key)
+	}
+	return nil
+}
+
+func (v *fileStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	if err := v.db.View(func(tx *bolt.Tx) error {
+		now := clock.SrsClock.Now()
+		entry, ok := decodeFileEntry(tx.Bucket(fileStoreBucket).Get([]byte(key)))
+		if !ok || entry.expired(now) {
+			return ErrNotFound
+		}
+		if !entry.ExpireAt.IsZero() {
+			ttl = entry.ExpireAt.Sub(now)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+func (v *fileStore) Delete(ctx context.Context, key string) error {
+	if err := v.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileStoreBucket).Delete([]byte(key))
+	}); err != nil {
+		return errors.Wrapf(err, "delete %v", key)
+	}
+	return nil
+}
+
+func (v *fileStore) Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	// Copy the matched entries, so fn is able to write the store, which is not allowed in a read transaction.
+	type kv struct {
+		key   string
+		value []byte
+	}
+	var matched []kv
+
+	if err := v.db.View(func(tx *bolt.Tx) error {
+		now := clock.SrsClock.Now()
+		c := tx.Bucket(fileStoreBucket).Cursor()
+		for k, b := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, b = c.Next() {
+			if entry, ok := decodeFileEntry(b); ok && !entry.expired(now) {
+				matched = append(matched, kv{string(k), entry.Value})
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "scan %v", prefix)
+	}
+
+	for _, e := range matched {
+		if !fn(e.key, e.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (v *fileStore) Close() error {
+	v.cancel()
+	v.wg.Wait()
+	return v.db.Close()
+}
+
+// cleanup removes the expired entries, returns the number of removed entries.
+func (v *fileStore) cleanup() (n int, err error) {
+	err = v.db.Update(func(tx *bolt.Tx) error {
+		now := clock.SrsClock.Now()
+		bucket := tx.Bucket(fileStoreBucket)
+
+		// Collect the expired keys, because deleting by cursor in iteration skips the next entry.
+		var expired [][]byte
+		if err := bucket.ForEach(func(k, b []byte) error {
+			if entry, ok := decodeFileEntry(b); !ok || entry.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return
+}
+
+// encodeFileEntry encodes the entry as the expire time in unix nanoseconds, zero for never expire, in 8
+// bytes of big-endian, then followed by the value.
+func encodeFileEntry(entry *memoryEntry) []byte {
+	b := make([]byte, 8+len(entry.Value))
+	if !entry.ExpireAt.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(entry.ExpireAt.UnixNano()))
+	}
+	copy(b[8:], entry.Value)
+	return b
+}
+
+// decodeFileEntry decodes the entry from b, see encodeFileEntry. The value is copied, because b is only
+// valid in the transaction.
+func decodeFileEntry(b []byte) (*memoryEntry, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+
+	entry := &memoryEntry{Value: append([]byte{}, b[8:]...)}
+	if expireAt := binary.BigEndian.Uint64(b); expireAt > 0 {
+		entry.ExpireAt = time.Unix(0, int64(expireAt))
+	}
+	return entry, true
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"context"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/clock"
+)
+
+// memoryEntry is the value and expiration of a key.
+type memoryEntry struct {
+	// The value of key.
+	Value []byte `json:"value"`
+	// The expire time, zero means never expire.
+	ExpireAt time.Time `json:"expire_at,omitempty"`
+}
+
+func (v *memoryEntry) expired(now time.Time) bool {
+	return !v.ExpireAt.IsZero() && now.After(v.ExpireAt)
+}
+
+// memoryStore stores state in memory, lost when process restarts.
+type memoryStore struct {
+	// The entries, key is the key of store.
+	entries map[string]*memoryEntry
+	// The lock for entries.
+	lock stdSync.RWMutex
+}
+
+// NewMemoryStore creates a new memory-based store.
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (v *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if entry, ok := v.entries[key]; ok && !entry.expired(clock.SrsClock.Now()) {
+		return entry.Value, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (v *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	entry := &memoryEntry{Value: value}
+	if ttl > 0 {
+		entry.ExpireAt = clock.SrsClock.Now().Add(ttl)
+	}
+	v.entries[key] = entry
+
+	// Cleanup the expired entries, amortized by writes.
+	if len(v.entries)%1024 == 0 {
+		v.cleanup()
+	}
+	return nil
+}
+
+func (v *memoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	now := clock.SrsClock.Now()
+	if entry, ok := v.entries[key]; ok && !entry.expired(now) {
+		if entry.ExpireAt.IsZero() {
+			return 0, nil
+		}
+		return entry.ExpireAt.Sub(now), nil
+	}
+	return 0, ErrNotFound
+}
+
+func (v *memoryStore) Delete(ctx context.Context, key string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.entries, key)
+	return nil
+}
+
+func (v *memoryStore) Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	// Copy the matched entries, so fn is able to write the store.
+	type kv struct {
+		key   string
+		value []byte
+	}
+	var matched []kv
+
+	v.lock.RLock()
+	now := clock.SrsClock.Now()
+	for key, entry := range v.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			matched = append(matched, kv{key, entry.Value})
+		}
+	}
+	v.lock.RUnlock()
+
+	for _, e := range matched {
+		if !fn(e.key, e.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (v *memoryStore) Close() error {
+	return nil
+}
+
+// cleanup removes the expired entries, the caller should hold the lock.
+func (v *memoryStore) cleanup() {
+	now := clock.SrsClock.Now()
+	for key, entry := range v.entries {
+		if entry.expired(now) {
+			delete(v.entries, key)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+)
+
+// NewRedisClient creates the redis client by the environment, without connecting to it.
+func NewRedisClient(environment env.Environment) (*redis.Client, error) {
+	redisDatabase, err := strconv.Atoi(environment.RedisDB())
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid PROXY_REDIS_DB %v", environment.RedisDB())
+	}
+
+	// The prefix is used in the pattern to scan keys, so it should not contain the glob characters.
+	if prefix := environment.RedisKeyPrefix(); strings.ContainsAny(prefix, "*?[]\\") {
+		return nil, errors.Errorf("invalid PROXY_REDIS_KEY_PREFIX %v", prefix)
+	}
+
+	var tlsConfig *tls.Config
+	if environment.RedisTLS() == "on" {
+		if tlsConfig, err = newRedisTLSConfig(environment); err != nil {
+			return nil, errors.Wrapf(err, "redis tls")
+		}
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:      fmt.Sprintf("%v:%v", environment.RedisHost(), environment.RedisPort()),
+		Username:  environment.RedisUsername(),
+		Password:  environment.RedisPassword(),
+		DB:        redisDatabase,
+		TLSConfig: tlsConfig,
+	}), nil
+}
+
+// newRedisTLSConfig creates the TLS config to verify the redis server by the CA, or system CAs if no CA, with
+// the client certificate for mutual TLS if set.
+func newRedisTLSConfig(environment env.Environment) (*tls.Config, error) {
+	config := &tls.Config{ServerName: environment.RedisHost(), MinVersion: tls.VersionTLS12}
+
+	if caFile := environment.RedisTLSCA(); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read ca %v", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("invalid ca %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	certFile, keyFile := environment.RedisTLSCert(), environment.RedisTLSKey()
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.Errorf("require both cert %v and key %v", certFile, keyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load cert %v and key %v", certFile, keyFile)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// redisStore stores state in Redis, shared by all proxy servers.
+type redisStore struct {
+	// The redis client sdk.
+	rdb *redis.Client
+	// The prefix of keys in Redis, to share one Redis by multiple proxy clusters, which is transparent to
+	// the users of store.
+	prefix string
+}
+
+// NewRedisStore creates a new Redis-based store by the client, all keys are prefixed by prefix in Redis.
+func NewRedisStore(rdb *redis.Client, prefix string) Store {
+	return &redisStore{rdb: rdb, prefix: prefix}
+}
+
+func (v *redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := v.rdb.Get(ctx, v.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "get key=%v", key)
+	}
+	return b, nil
+}
+
+func (v *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := v.rdb.Set(ctx, v.prefix+key, value, ttl).Err(); err != nil {
+		return errors.Wrapf(err, "set key=%v", key)
+	}
+	return nil
+}
+
+func (v *redisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := v.rdb.TTL(ctx, v.prefix+key).Result()
+	if err != nil {
+		return 0, errors.Wrapf(err, "ttl key=%v", key)
+	}
+
+	// Redis returns -2 if key not exists, -1 if never expire.
+	if ttl == -2 {
+		return 0, ErrNotFound
+	} else if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (v *redisStore) Delete(ctx context.Context, key string) error {
+	if err := v.rdb.Del(ctx, v.prefix+key).Err(); err != nil {
+		return errors.Wrapf(err, "del key=%v", key)
+	}
+	return nil
+}
+
+func (v *redisStore) Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	iter := v.rdb.Scan(ctx, 0, v.prefix+prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), v.prefix)
+
+		// Ignore the key expired during scanning.
+		b, err := v.Get(ctx, key)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !fn(key, b) {
+			return nil
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return errors.Wrapf(err, "scan %v", prefix)
+	}
+	return nil
+}
+
+func (v *redisStore) Close() error {
+	return v.rdb.Close()
+}
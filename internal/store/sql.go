@@ -0,0 +1,298 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/clock"
+	"srsx/internal/errors"
+	"srsx/internal/logger"
+)
+
+// Historian records the history of state changes, for stores which support queries, such as SQL, so
+// users are able to query the historical registration and session data.
+type Historian interface {
+	// Record a history event of kind, such as register or pick, for key with value. It never blocks, because
+	// it's called when picking the server for each stream.
+	Record(ctx context.Context, kind, key string, value []byte) error
+}
+
+// The max history events to write in queue, the new events are dropped if full.
+const sqlHistoryQueueSize = 4096
+
+// sqlHistory is a history event to write to SQL.
+type sqlHistory struct {
+	kind, key string
+	value     []byte
+	createdAt int64
+}
+
+// IsLeader indicates whether this proxy is the leader of cluster, to cleanup the expired entries in the
+// shared database once per cluster, set by bootstrap.
+var IsLeader = func() bool {
+	return true
+}
+
+// sqlStore stores state in a relational database, such as Postgres or MySQL, by the drivers linked in
+// driver.go. The history events are written by a goroutine, to not block the callers.
+type sqlStore struct {
+	// The database handle.
+	db *sql.DB
+	// The driver name, postgres or mysql.
+	driver string
+	// The history events to write.
+	history chan *sqlHistory
+
+	// The cancel function for cleanup goroutine.
+	cancel context.CancelFunc
+	// The wait group for cleanup goroutine.
+	wg stdSync.WaitGroup
+}
+
+// NewSQLStore creates a new SQL-based store, create the tables if not exists.
+func NewSQLStore(ctx context.Context, driver, dsn string) (Store, error) {
+	switch driver {
+	case "postgres", "mysql":
+	default:
+		return nil, errors.Errorf("unsupported sql driver %v", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v", driver)
+	}
+
+	v := &sqlStore{db: db, driver: driver, history: make(chan *sqlHistory, sqlHistoryQueueSize)}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "ping %v", driver)
+	}
+
+	if err := v.createTables(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "create tables")
+	}
+	logger.Df(ctx, "SQLStore: connected to %v ok", driver)
+
+	// Cleanup the expired entries periodically.
+	ctx, v.cancel = context.WithCancel(ctx)
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(60 * time.Second):
+				if !IsLeader() {
+					continue
+				}
+				query := v.rebind("DELETE FROM srs_proxy_state WHERE expire_at > 0 AND expire_at < ?")
+				if _, err := v.db.ExecContext(ctx, query, clock.SrsClock.Now().UnixMilli()); err != nil {
+					logger.Wf(ctx, "SQLStore: cleanup failed, err %+v", err)
+				}
+			}
+		}
+	}()
+
+	// Write the history events, and flush the queued events when closing.
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				for {
+					select {
+					case e := <-v.history:
+						v.writeHistory(logger.WithContext(context.Background()), e)
+					default:
+						return
+					}
+				}
+			case e := <-v.history:
+				v.writeHistory(ctx, e)
+			}
+		}
+	}()
+
+	return v, nil
+}
+
+func (v *sqlStore) createTables(ctx context.Context) error {
+	blob, serial := "BYTEA", "BIGSERIAL PRIMARY KEY"
+	if v.driver == "mysql" {
+		blob, serial = "LONGBLOB", "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS srs_proxy_state (
+			k VARCHAR(512) PRIMARY KEY,
+			v %v NOT NULL,
+			expire_at BIGINT NOT NULL DEFAULT 0
+		)`, blob),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS srs_proxy_history (
+			id %v,
+			kind VARCHAR(32) NOT NULL,
+			k VARCHAR(512) NOT NULL,
+			v %v,
+			created_at BIGINT NOT NULL
+		)`, serial, blob),
+	} {
+		if _, err := v.db.ExecContext(ctx, query); err != nil {
+			return errors.Wrapf(err, "exec %v", query)
+		}
+	}
+	return nil
+}
+
+func (v *sqlStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	var expireAt int64
+
+	query := v.rebind("SELECT v, expire_at FROM srs_proxy_state WHERE k = ?")
+	if err := v.db.QueryRowContext(ctx, query, key).Scan(&value, &expireAt); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "get key=%v", key)
+	}
+
+	if expireAt > 0 && clock.SrsClock.Now().UnixMilli() > expireAt {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (v *sqlStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = clock.SrsClock.Now().Add(ttl).UnixMilli()
+	}
+
+	query := "INSERT INTO srs_proxy_state (k, v, expire_at) VALUES (?, ?, ?) " +
+		"ON CONFLICT (k) DO UPDATE SET v = EXCLUDED.v, expire_at = EXCLUDED.expire_at"
+	if v.driver == "mysql" {
+		query = "INSERT INTO srs_proxy_state (k, v, expire_at) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE v = VALUES(v), expire_at = VALUES(expire_at)"
+	}
+
+	if _, err := v.db.ExecContext(ctx, v.rebind(query), key, value, expireAt); err != nil {
+		return errors.Wrapf(err, "set key=%v", key)
+	}
+	return nil
+}
+
+func (v *sqlStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var expireAt int64
+
+	query := v.rebind("SELECT expire_at FROM srs_proxy_state WHERE k = ?")
+	if err := v.db.QueryRowContext(ctx, query, key).Scan(&expireAt); err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "ttl key=%v", key)
+	}
+
+	if expireAt == 0 {
+		return 0, nil
+	}
+	if ttl := time.UnixMilli(expireAt).Sub(clock.SrsClock.Now()); ttl > 0 {
+		return ttl, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (v *sqlStore) Delete(ctx context.Context, key string) error {
+	query := v.rebind("DELETE FROM srs_proxy_state WHERE k = ?")
+	if _, err := v.db.ExecContext(ctx, query, key); err != nil {
+		return errors.Wrapf(err, "delete key=%v", key)
+	}
+	return nil
+}
+
+func (v *sqlStore) Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	// Escape the wildcards of LIKE in prefix, such as the _ in __defaultVhost__.
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+
+	query := v.rebind("SELECT k, v FROM srs_proxy_state WHERE k LIKE ? AND (expire_at = 0 OR expire_at > ?)")
+	rows, err := v.db.QueryContext(ctx, query, pattern, clock.SrsClock.Now().UnixMilli())
+	if err != nil {
+		return errors.Wrapf(err, "scan %v", prefix)
+	}
+	defer rows.Close()
+
+	// Read all rows first, so fn is able to write the store without holding the connection.
+	type kv struct {
+		key   string
+		value []byte
+	}
+	var matched []kv
+	for rows.Next() {
+		var e kv
+		if err := rows.Scan(&e.key, &e.value); err != nil {
+			return errors.Wrapf(err, "scan row")
+		}
+		matched = append(matched, e)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "scan rows")
+	}
+
+	for _, e := range matched {
+		if !fn(e.key, e.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (v *sqlStore) Record(ctx context.Context, kind, key string, value []byte) error {
+	select {
+	case v.history <- &sqlHistory{kind: kind, key: key, value: value, createdAt: time.Now().UnixMilli()}:
+		return nil
+	default:
+		return errors.Errorf("history queue full, drop %v key=%v", kind, key)
+	}
+}
+
+// writeHistory writes the history event e to SQL, in a timeout to not stuck the queue.
+func (v *sqlStore) writeHistory(ctx context.Context, e *sqlHistory) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := v.rebind("INSERT INTO srs_proxy_history (kind, k, v, created_at) VALUES (?, ?, ?, ?)")
+	if _, err := v.db.ExecContext(ctx, query, e.kind, e.key, e.value, e.createdAt); err != nil {
+		logger.Wf(ctx, "SQLStore: record %v key=%v failed, err %+v", e.kind, e.key, err)
+	}
+}
+
+func (v *sqlStore) Close() error {
+	v.cancel()
+	v.wg.Wait()
+	return v.db.Close()
+}
+
+// rebind converts the ? placeholders to $1, $2, etc, for postgres.
+func (v *sqlStore) rebind(query string) string {
+	if v.driver == "mysql" {
+		return query
+	}
+
+	var sb strings.Builder
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString(fmt.Sprintf("$%v", n))
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package store
+
+import (
+	"context"
+	stdErr "errors"
+	"time"
+)
+
+// ErrNotFound is returned when the key does not exist or is expired.
+var ErrNotFound = stdErr.New("not found")
+
+// Store is the key-value storage for the state of proxy, such as the backend servers and the stream
+// affinity. All values are opaque bytes, the caller should serialize the value, such as JSON.
+type Store interface {
+	// Get the value of key, returns ErrNotFound if not exists or expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set the value of key, expire after ttl. Never expire if ttl is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// TTL returns the remaining time to live of key, returns 0 if never expire, or ErrNotFound if not
+	// exists or expired.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Delete the key, ignore if not exists.
+	Delete(ctx context.Context, key string) error
+	// Scan all alive keys with prefix, stop when fn returns false.
+	Scan(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error
+	// Close the store, flush the data if needed.
+	Close() error
+}
+
+// IsNotFound indicates whether err is caused by key not found.
+func IsNotFound(err error) bool {
+	return stdErr.Is(err, ErrNotFound)
+}
@@ -43,3 +43,13 @@ func (m *Map[K, V]) Range(f func(key K, value V) bool) {
 func (m *Map[K, V]) Store(key K, value V) {
 	m.m.Store(key, value)
 }
+
+// Len returns the number of entries, by ranging all entries, so it's O(n).
+func (m *Map[K, V]) Len() int {
+	var n int
+	m.m.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package tarpit
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	stdSync "sync"
+	"time"
+
+	"srsx/internal/env"
+	"srsx/internal/errors"
+	"srsx/internal/event"
+	"srsx/internal/logger"
+)
+
+// The reasons of rejections, which count as offenses.
+const (
+	// The client fails the authentication.
+	ReasonAuth = "auth"
+	// The client exceeds the rate limit.
+	ReasonRateLimited = "rate-limited"
+)
+
+// Offender is a client IP in tarpit, whose rejections are delayed.
+type Offender struct {
+	// The IP of client.
+	IP string `json:"ip"`
+	// The reason of last offense.
+	Reason string `json:"reason"`
+	// The number of offenses in window.
+	Offenses int `json:"offenses"`
+	// The time in tarpit.
+	Since time.Time `json:"since"`
+	// The time to release from tarpit, extended by each offense.
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// Tarpit delays the rejections of the client IPs which repeatedly fail the authentication or exceed the
+// limits, instead of rejecting immediately, to raise the cost of brute-force and scraping attacks, which
+// usually retry immediately after rejected.
+type Tarpit interface {
+	// Reject records the rejection of client for reason, and if the client is an offender, blocks for the
+	// delay or until ctx done, before the rejection is responded.
+	Reject(ctx context.Context, remoteAddr, reason string)
+	// Offenders returns the client IPs in tarpit.
+	Offenders() []*Offender
+	// Release the client IP from tarpit, returns false if not in tarpit.
+	Release(ip string) bool
+}
+
+type nopTarpit struct{}
+
+// NewNopTarpit creates a tarpit which never delays.
+func NewNopTarpit() Tarpit {
+	return &nopTarpit{}
+}
+
+func (v *nopTarpit) Reject(ctx context.Context, remoteAddr, reason string) {
+}
+
+func (v *nopTarpit) Offenders() []*Offender {
+	return []*Offender{}
+}
+
+func (v *nopTarpit) Release(ip string) bool {
+	return false
+}
+
+// clientState is the offenses of a client IP.
+type clientState struct {
+	// The time of offenses in window, the oldest first.
+	offenses []time.Time
+	// The offender if in tarpit, or nil.
+	offender *Offender
+}
+
+type tarpitImpl struct {
+	// The number of offenses in window to put the client in tarpit.
+	threshold int
+	// The window to count the offenses.
+	window time.Duration
+	// The duration in tarpit after the last offense.
+	duration time.Duration
+	// The delay of each rejection of offender.
+	delay time.Duration
+	// The max number of rejections delayed at the same time, the others are rejected immediately, to not
+	// exhaust the resources of proxy by the tarpit itself.
+	maxConns int
+
+	// The number of rejections being delayed.
+	conns int
+	// The states of clients, key is the IP.
+	clients map[string]*clientState
+	// The time of last sweep of expired clients.
+	sweepAt time.Time
+	// The lock to protect conns, clients and sweepAt.
+	lock stdSync.Mutex
+}
+
+// NewTarpit creates a tarpit by options.
+func NewTarpit(opts ...func(*tarpitImpl)) Tarpit {
+	v := &tarpitImpl{
+		threshold: 5, window: time.Minute, duration: 10 * time.Minute, delay: 10 * time.Second, maxConns: 1000,
+		clients: make(map[string]*clientState),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// NewTarpitFromEnvironment creates the tarpit by environment, or a nop tarpit if disabled.
+func NewTarpitFromEnvironment(environment env.Environment) (Tarpit, error) {
+	if environment.Tarpit() != "on" {
+		return NewNopTarpit(), nil
+	}
+
+	threshold, err := strconv.Atoi(environment.TarpitThreshold())
+	if err != nil || threshold <= 0 {
+		return nil, errors.Errorf("invalid tarpit threshold %v", environment.TarpitThreshold())
+	}
+	window, err := time.ParseDuration(environment.TarpitWindow())
+	if err != nil || window <= 0 {
+		return nil, errors.Errorf("invalid tarpit window %v", environment.TarpitWindow())
+	}
+	duration, err := time.ParseDuration(environment.TarpitDuration())
+	if err != nil || duration <= 0 {
+		return nil, errors.Errorf("invalid tarpit duration %v", environment.TarpitDuration())
+	}
+	delay, err := time.ParseDuration(environment.TarpitDelay())
+	if err != nil || delay <= 0 {
+		return nil, errors.Errorf("invalid tarpit delay %v", environment.TarpitDelay())
+	}
+	maxConns, err := strconv.Atoi(environment.TarpitMaxConns())
+	if err != nil || maxConns <= 0 {
+		return nil, errors.Errorf("invalid tarpit max conns %v", environment.TarpitMaxConns())
+	}
+
+	return NewTarpit(func(v *tarpitImpl) {
+		v.threshold, v.window, v.duration, v.delay, v.maxConns = threshold, window, duration, delay, maxConns
+	}), nil
+}
+
+func (v *tarpitImpl) Reject(ctx context.Context, remoteAddr, reason string) {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	delayed, offender := v.offend(ip, reason)
+	if offender != nil {
+		logger.Wf(ctx, "Tarpit client %v for %v offenses in %v, last %v", ip, offender.Offenses, v.window, reason)
+		event.SrsEventNotifier.Notify(ctx, &event.Event{
+			Type: "tarpit", Time: time.Now(),
+			Data: map[string]interface{}{
+				"ip": ip, "reason": reason, "offenses": offender.Offenses, "expire_at": offender.ExpireAt,
+			},
+		})
+	}
+	if !delayed {
+		return
+	}
+
+	defer func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.conns--
+	}()
+
+	logger.Df(ctx, "Tarpit delay %v rejection of %v for %v", v.delay, ip, reason)
+	select {
+	case <-ctx.Done():
+	case <-time.After(v.delay):
+	}
+}
+
+// offend records the offense of ip, returns whether to delay the rejection, and the offender if the ip is just
+// put in tarpit.
+func (v *tarpitImpl) offend(ip, reason string) (bool, *Offender) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	v.sweep(now)
+
+	client, ok := v.clients[ip]
+	if !ok {
+		client = &clientState{}
+		v.clients[ip] = client
+	}
+
+	for len(client.offenses) > 0 && now.Sub(client.offenses[0]) > v.window {
+		client.offenses = client.offenses[1:]
+	}
+	client.offenses = append(client.offenses, now)
+
+	// Put the client in tarpit, or extend the duration by the offense.
+	var jailed *Offender
+	if client.offender != nil && now.Before(client.offender.ExpireAt) {
+		client.offender.Reason, client.offender.ExpireAt = reason, now.Add(v.duration)
+		client.offender.Offenses = len(client.offenses)
+	} else if len(client.offenses) >= v.threshold {
+		client.offender = &Offender{
+			IP: ip, Reason: reason, Offenses: len(client.offenses), Since: now, ExpireAt: now.Add(v.duration),
+		}
+		copied := *client.offender
+		jailed = &copied
+	} else {
+		client.offender = nil
+		return false, nil
+	}
+
+	if v.conns >= v.maxConns {
+		return false, jailed
+	}
+	v.conns++
+	return true, jailed
+}
+
+// sweep the clients without offenses in window and not in tarpit, at most once in window.
+func (v *tarpitImpl) sweep(now time.Time) {
+	if now.Sub(v.sweepAt) < v.window {
+		return
+	}
+	v.sweepAt = now
+
+	for ip, client := range v.clients {
+		if client.offender != nil && now.Before(client.offender.ExpireAt) {
+			continue
+		}
+		if n := len(client.offenses); n == 0 || now.Sub(client.offenses[n-1]) > v.window {
+			delete(v.clients, ip)
+		}
+	}
+}
+
+func (v *tarpitImpl) Offenders() []*Offender {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	offenders := []*Offender{}
+	for _, client := range v.clients {
+		if client.offender != nil && now.Before(client.offender.ExpireAt) {
+			copied := *client.offender
+			offenders = append(offenders, &copied)
+		}
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		return offenders[i].Since.Before(offenders[j].Since)
+	})
+	return offenders
+}
+
+func (v *tarpitImpl) Release(ip string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	client, ok := v.clients[ip]
+	if !ok || client.offender == nil || !time.Now().Before(client.offender.ExpireAt) {
+		return false
+	}
+	delete(v.clients, ip)
+	return true
+}
+
+// SrsTarpit is the global tarpit, which never delays by default.
+var SrsTarpit = NewNopTarpit()
@@ -322,3 +322,159 @@ func ParseListenEndpoint(ep string) (protocol string, ip net.IP, port uint16, er
 		return parts[0], net.ParseIP(parts[1]), uint16(p), nil
 	}
 }
+
+// ListenEndpointError is the error of invalid listen endpoint, with the field which is invalid, such as the
+// protocol mismatch, the port out of range, or the unknown host.
+type ListenEndpointError struct {
+	// The endpoint to parse.
+	Endpoint string
+	// The invalid field, protocol, host or port.
+	Field string
+	// The reason why the field is invalid.
+	Reason string
+}
+
+func (v *ListenEndpointError) Error() string {
+	return fmt.Sprintf("invalid %v of endpoint %v, %v", v.Field, v.Endpoint, v.Reason)
+}
+
+// ListenEndpoint is the listen endpoint parsed in strict mode.
+type ListenEndpoint struct {
+	// The protocol, tcp or udp.
+	Protocol string
+	// The IP or the name of network interface, like eth0, empty for all interfaces.
+	Host string
+	// The port, 1 to 65535, or 0 to auto-assign for the address to listen.
+	Port uint16
+}
+
+// ParseListenEndpointStrict parse the listen endpoint for network tcp or udp, in the same formats of
+// ParseListenEndpoint, and the ip:port format, like :1935 or 0.0.0.0:1935. The protocol must match the
+// network, for example, tcp for RTMP, udp for WebRTC and SRT, and the port must be 1 to 65535. The host is
+// the IP or the name of network interface, like tcp://eth0:1935. The error is *ListenEndpointError.
+func ParseListenEndpointStrict(ep, network string) (*ListenEndpoint, error) {
+	return parseListenEndpointStrict(ep, network, false)
+}
+
+// parseListenEndpointStrict parse the listen endpoint in strict mode, and the port 0 is allowed if autoPort.
+func parseListenEndpointStrict(ep, network string, autoPort bool) (*ListenEndpoint, error) {
+	fail := func(field, format string, a ...interface{}) (*ListenEndpoint, error) {
+		return nil, &ListenEndpointError{Endpoint: ep, Field: field, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	// Parse the protocol, by the URL-style format protocol://host:port, or the legacy format protocol:ip:port.
+	protocol, hostPort := network, ep
+	if parts := strings.SplitN(ep, "://", 2); len(parts) == 2 {
+		protocol, hostPort = parts[0], parts[1]
+	} else if parts := strings.SplitN(ep, ":", 2); len(parts) == 2 && (parts[0] == "tcp" || parts[0] == "udp") {
+		protocol, hostPort = parts[0], parts[1]
+	}
+	if protocol != network {
+		return fail("protocol", "protocol %v should be %v", protocol, network)
+	}
+
+	// Parse the host and port, the host is optional.
+	host, portStr := "", hostPort
+	if strings.Contains(hostPort, ":") {
+		var err error
+		if host, portStr, err = net.SplitHostPort(hostPort); err != nil {
+			return fail("host", "%v", err)
+		}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fail("port", "port %v is not a number", portStr)
+	}
+	if port == 0 && autoPort {
+		// The port is auto-assigned by system when listening.
+	} else if port <= 0 || port > 65535 {
+		return fail("port", "port %v out of range 1-65535", port)
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		if !regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.@-]*$`).MatchString(host) {
+			return fail("host", "host %v is neither an IP nor an interface", host)
+		}
+	}
+
+	return &ListenEndpoint{Protocol: protocol, Host: host, Port: uint16(port)}, nil
+}
+
+// Addr returns the address to listen, like 0.0.0.0:1935, where the network interface is resolved to its
+// IP, the IPv4 address preferred.
+func (v *ListenEndpoint) Addr() (string, error) {
+	host := v.Host
+	if host != "" && net.ParseIP(host) == nil {
+		iface, err := net.InterfaceByName(host)
+		if err != nil {
+			return "", &ListenEndpointError{
+				Endpoint: v.String(), Field: "host", Reason: fmt.Sprintf("no interface %v, %v", host, err),
+			}
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", errors.Wrapf(err, "addresses of interface %v", host)
+		}
+
+		var ip net.IP
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && (ip == nil || ip.To4() == nil) {
+				ip = ipNet.IP
+			}
+		}
+		if ip == nil {
+			return "", &ListenEndpointError{
+				Endpoint: v.String(), Field: "host", Reason: fmt.Sprintf("no address of interface %v", host),
+			}
+		}
+		host = ip.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(v.Port))), nil
+}
+
+func (v *ListenEndpoint) String() string {
+	return fmt.Sprintf("%v://%v", v.Protocol, net.JoinHostPort(v.Host, strconv.Itoa(int(v.Port))))
+}
+
+// ParseListenAddr parse the listen endpoint in strict mode for network, and returns the address to listen.
+// The port 0 is allowed, to listen at a port auto-assigned by system.
+func ParseListenAddr(ep, network string) (string, error) {
+	endpoint, err := parseListenEndpointStrict(ep, network, true)
+	if err != nil {
+		return "", err
+	}
+	return endpoint.Addr()
+}
+
+// SplitListenEndpoints splits the comma-separated listen endpoints, like tcp://:1935,tcp://:19350.
+func SplitListenEndpoints(eps string) []string {
+	var endpoints []string
+	for _, ep := range strings.Split(eps, ",") {
+		if ep = strings.TrimSpace(ep); ep != "" {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// ParseListenAddrs parse the comma-separated listen endpoints like ParseListenAddr, and returns the addresses
+// to listen, at least one.
+func ParseListenAddrs(eps, network string) ([]string, error) {
+	endpoints := SplitListenEndpoints(eps)
+	if len(endpoints) == 0 {
+		return nil, &ListenEndpointError{Endpoint: eps, Field: "port", Reason: "no endpoint"}
+	}
+
+	var addrs []string
+	for _, ep := range endpoints {
+		addr, err := ParseListenAddr(ep, network)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
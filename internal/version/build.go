@@ -0,0 +1,57 @@
+// Copyright (c) 2025 Winlin
+//
+// SPDX-License-Identifier: MIT
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// The build commit, which is optional and overwrites the VCS revision embedded by Go, for example, set by
+// go build -ldflags "-X srsx/internal/version.buildCommit=$(git rev-parse HEAD)" when building without git.
+var buildCommit string
+
+// BuildInfo is the information about how the binary is built.
+type BuildInfo struct {
+	// The signature of proxy.
+	Signature string `json:"signature"`
+	// The version of proxy.
+	Version string `json:"version"`
+	// The commit of source code, empty if unknown.
+	Commit string `json:"commit"`
+	// The time of commit, empty if unknown.
+	CommitTime string `json:"commit_time"`
+	// Whether the source code is modified, not committed.
+	Modified bool `json:"modified"`
+	// The Go version to build the binary.
+	GoVersion string `json:"go_version"`
+	// The OS and architecture of binary.
+	Platform string `json:"platform"`
+}
+
+// NewBuildInfo creates the build information, from the VCS information embedded by Go.
+func NewBuildInfo() *BuildInfo {
+	v := &BuildInfo{
+		Signature: Signature(), Version: Version(),
+		GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				v.Commit = setting.Value
+			case "vcs.time":
+				v.CommitTime = setting.Value
+			case "vcs.modified":
+				v.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	if buildCommit != "" {
+		v.Commit = buildCommit
+	}
+	return v
+}